@@ -126,6 +126,9 @@ CONFIG_SH_IS_ASH=y
 CONFIG_ASH=y
 CONFIG_ASH_BASH_COMPAT=y
 CONFIG_FEATURE_SH_STANDALONE=n
+CONFIG_IP=y
+CONFIG_UDHCPC=y
+CONFIG_WGET=y
 EOF
 
 # Normalize config for any new options with defaults
@@ -165,6 +168,48 @@ if [ -d "$INITRAMFS_SRC/scripts" ]; then
     log_ok "Helper scripts installed"
 fi
 
+# Storage hooks generated by 'mix setup' (RAID1/LVM layouts), plus the
+# tools they need
+STORAGE_HOOKS="${STORAGE_HOOKS:-$BUILD_DIR/rootfs/etc/mixos/initramfs/hooks}"
+if [ -d "$STORAGE_HOOKS" ]; then
+    mkdir -p "$INITRAMFS_BUILD/scripts/hooks"
+    cp "$STORAGE_HOOKS"/*.sh "$INITRAMFS_BUILD/scripts/hooks/" 2>/dev/null || true
+    for tool in sbin/mdadm sbin/lvm; do
+        if [ -x "$BUILD_DIR/rootfs/$tool" ]; then
+            cp "$BUILD_DIR/rootfs/$tool" "$INITRAMFS_BUILD/$tool"
+        fi
+    done
+    log_ok "Storage hooks installed"
+fi
+
+# dmsetup, for the SSD cache of tiered VRAM ('mix vram tier')
+for tool in sbin/dmsetup usr/sbin/dmsetup; do
+    if [ -x "$BUILD_DIR/rootfs/$tool" ]; then
+        mkdir -p "$INITRAMFS_BUILD/sbin"
+        cp "$BUILD_DIR/rootfs/$tool" "$INITRAMFS_BUILD/sbin/dmsetup"
+        log_ok "dmsetup installed"
+        break
+    fi
+done
+
+# minisign and the public key of trusted images, for the signature check
+# of VISO images ('mix viso sign'); VISO_PUBKEY is a minisign public key
+if [ -n "$VISO_PUBKEY" ]; then
+    mkdir -p "$INITRAMFS_BUILD/etc/mixos"
+    cp "$VISO_PUBKEY" "$INITRAMFS_BUILD/etc/mixos/viso.pub"
+    for tool in usr/bin/minisign bin/minisign; do
+        if [ -x "$BUILD_DIR/rootfs/$tool" ]; then
+            cp "$BUILD_DIR/rootfs/$tool" "$INITRAMFS_BUILD/bin/minisign"
+            break
+        fi
+    done
+    if [ -x "$INITRAMFS_BUILD/bin/minisign" ]; then
+        log_ok "VISO public key installed"
+    else
+        log_warn "minisign not found in the rootfs, signed images will not be checked"
+    fi
+fi
+
 # ============================================================================
 # Step 4: Copy kernel modules
 # ============================================================================
@@ -192,6 +237,16 @@ ESSENTIAL_MODULES="
     kernel/drivers/cdrom/cdrom.ko
     kernel/drivers/block/loop.ko
     kernel/drivers/net/virtio_net.ko
+    kernel/drivers/net/ethernet/intel/e1000/e1000.ko
+    kernel/drivers/net/ethernet/intel/e1000e/e1000e.ko
+    kernel/drivers/md/md-mod.ko
+    kernel/drivers/md/raid1.ko
+    kernel/drivers/md/dm-mod.ko
+    kernel/drivers/md/dm-bufio.ko
+    kernel/drivers/md/dm-bio-prison.ko
+    kernel/drivers/md/persistent-data/dm-persistent-data.ko
+    kernel/drivers/md/dm-cache.ko
+    kernel/drivers/md/dm-cache-smq.ko
     kernel/lib/crc32c_generic.ko
     kernel/crypto/crc32c_generic.ko
 "
@@ -243,6 +298,25 @@ cat > "$INITRAMFS_BUILD/etc/modprobe.d/mixos.conf" << 'EOF'
 options loop max_loop=8
 EOF
 
+# Apply the DHCP lease of a network boot (VISO_URL)
+cat > "$INITRAMFS_BUILD/etc/udhcpc.script" << 'EOF'
+#!/bin/sh
+case "$1" in
+    bound|renew)
+        ip addr flush dev "$interface"
+        ip addr add "$ip/${mask:-24}" dev "$interface"
+        if [ -n "$router" ]; then
+            ip route add default via "${router%% *}" dev "$interface"
+        fi
+        : > /etc/resolv.conf
+        for ns in $dns; do
+            echo "nameserver $ns" >> /etc/resolv.conf
+        done
+        ;;
+esac
+EOF
+chmod 755 "$INITRAMFS_BUILD/etc/udhcpc.script"
+
 # Create udev rules for block devices
 cat > "$INITRAMFS_BUILD/etc/udev/rules.d/10-mixos.rules" << 'EOF'
 # MixOS-GO udev rules
@@ -420,6 +420,86 @@ post_install_scripts:
         echo "Post-install script running"
 EOF
 
+# VRAM settings: compression of the root in RAM and, for selective VRAM,
+# the directories loaded into RAM instead of the whole root
+cat > "$ROOTFS_DIR/etc/mixos/vram.conf" << 'EOF'
+# VRAM settings and the directories loaded into RAM, one per line.
+# Managed by 'mix vram config', 'mix vram resize', 'mix vram tune',
+# 'mix vram tier', 'mix vram exclude' and 'mix vram paths'.
+# No directories loads the whole root.
+#compression = zstd
+#level = 6
+#backend = zram
+#zram_algorithm = zstd
+#size = 3072
+#tmpfs_huge = within_size
+#tmpfs_mpol = interleave
+#tmpfs_mode = 0755
+#tier_cache = /dev/nvme0n1p3
+#exclude = /var/log
+#/usr
+#/opt
+EOF
+
+# VRAM hotsets: what a size-limited VRAM boot (VRAM=2G) loads into RAM
+# first, per system profile; /etc/mixos/vram-hotset overrides them
+mkdir -p "$ROOTFS_DIR/usr/share/mixos/vram-hotset"
+cat > "$ROOTFS_DIR/usr/share/mixos/vram-hotset/default" << 'EOF'
+# Directories loaded into RAM on VRAM=<size> boots, most important first.
+# Those that do not fit in the size are left on disk.
+/usr/bin
+/usr/sbin
+/usr/lib
+/etc
+/usr/libexec
+/var/lib
+/usr/share
+/opt
+EOF
+cat > "$ROOTFS_DIR/usr/share/mixos/vram-hotset/minimal" << 'EOF'
+# Directories loaded into RAM on VRAM=<size> boots, most important first.
+/usr/bin
+/usr/sbin
+/usr/lib
+/etc
+EOF
+cat > "$ROOTFS_DIR/usr/share/mixos/vram-hotset/server" << 'EOF'
+# Directories loaded into RAM on VRAM=<size> boots, most important first.
+/usr/bin
+/usr/sbin
+/usr/lib
+/etc
+/usr/libexec
+/var/lib
+/opt
+/usr/share
+EOF
+cat > "$ROOTFS_DIR/usr/share/mixos/vram-hotset/desktop" << 'EOF'
+# Directories loaded into RAM on VRAM=<size> boots, most important first.
+/usr/bin
+/usr/lib
+/etc
+/usr/libexec
+/usr/share/fonts
+/usr/share/icons
+/usr/share/applications
+/usr/sbin
+/opt
+/usr/share
+EOF
+cat > "$ROOTFS_DIR/usr/share/mixos/vram-hotset/developer" << 'EOF'
+# Directories loaded into RAM on VRAM=<size> boots, most important first.
+/usr/bin
+/usr/lib
+/usr/include
+/usr/libexec
+/etc
+/usr/local
+/opt
+/usr/sbin
+/usr/share
+EOF
+
 # First-boot init script (runs installer on first boot if present)
 cat > "$ROOTFS_DIR/etc/init.d/S10firstboot" << 'EOF'
 #!/bin/sh
@@ -451,6 +531,21 @@ exit 0
 EOF
 chmod +x "$ROOTFS_DIR/etc/init.d/S10firstboot"
 
+# Record how the root came up (RAM or disk) in the VRAM event log; see
+# 'mix vram events'
+cat > "$ROOTFS_DIR/etc/init.d/S02vram-events" << 'EOF'
+#!/bin/sh
+# Records the VRAM activation of this boot in /var/log/mixos/vram.log
+
+case "$1" in
+    start)
+        [ -x /usr/bin/mix ] && /usr/bin/mix vram events record-boot 2>/dev/null
+        ;;
+esac
+exit 0
+EOF
+chmod +x "$ROOTFS_DIR/etc/init.d/S02vram-events"
+
 # Ensure marker dir exists on image
 mkdir -p "$ROOTFS_DIR/var/lib/mixos"
 
@@ -480,9 +575,42 @@ echo "Setting up MixMagisk..."
 
 # Create mixmagisk directories
 mkdir -p "$ROOTFS_DIR/etc/mixmagisk/policy.d"
+mkdir -p "$ROOTFS_DIR/etc/mixmagisk/include.d"
 mkdir -p "$ROOTFS_DIR/var/log"
 mkdir -p "$ROOTFS_DIR/run/mixmagisk"
 
+# Start the privileged broker at boot, so that mix needs no setuid bit
+cat > "$ROOTFS_DIR/etc/init.d/S45mixmagisk" << 'EOF'
+#!/bin/sh
+# MixMagisk broker startup script
+
+MIX=/usr/bin/mix
+PIDFILE=/run/mixmagisk-broker.pid
+LOGFILE=/var/log/mixmagisk-broker.log
+
+case "$1" in
+    start)
+        echo "Starting MixMagisk broker..."
+        $MIX mixmagisk broker >> $LOGFILE 2>&1 &
+        echo $! > $PIDFILE
+        ;;
+    stop)
+        echo "Stopping MixMagisk broker..."
+        [ -f $PIDFILE ] && kill $(cat $PIDFILE) && rm -f $PIDFILE
+        ;;
+    restart)
+        $0 stop
+        sleep 1
+        $0 start
+        ;;
+    *)
+        echo "Usage: $0 {start|stop|restart}"
+        exit 1
+        ;;
+esac
+EOF
+chmod +x "$ROOTFS_DIR/etc/init.d/S45mixmagisk"
+
 # Create default mixmagisk config
 cat > "$ROOTFS_DIR/etc/mixmagisk/config" << 'EOF'
 # MixMagisk Configuration
@@ -491,7 +619,29 @@ cat > "$ROOTFS_DIR/etc/mixmagisk/config" << 'EOF'
 [general]
 version = 1.0.0
 log_level = info
+# Default for users whose policy sets no timeout (seconds, 0 = always ask)
 session_timeout = 300
+# Password prompt program for -A or when stdin is not a terminal
+# (overridden by $MIXMAGISK_ASKPASS)
+# askpass = /usr/bin/ssh-askpass
+# Show the lecture before the password prompt: once, always or never
+lecture = once
+# lecture_file = /etc/mixmagisk/lecture
+
+[auth]
+# How users prove their identity, in order: password, totp (codes from
+# the base32 secret in totp_dir/<user>), fido2 (a security key registered
+# with "mixmagisk fido enroll", needs a build with libfido2) and/or command
+# (a site program that exits 0 to accept, 2 if it does not apply to the user)
+methods = password
+# any: the first method that succeeds is enough; all: every one is needed
+require = any
+# totp_dir = /etc/mixmagisk/totp
+# command = /usr/local/libexec/mixmagisk-sso
+# command_timeout = 60
+# fido2_dir = /etc/mixmagisk/fido2
+# fido2_rp_id = mixmagisk
+# fido2_device = /dev/hidraw0
 
 [security]
 require_password = true
@@ -502,8 +652,53 @@ audit_all_commands = true
 default_policy = deny
 allow_wheel_group = true
 allow_mixmagisk_group = true
+
+[directory]
+# Where group memberships come from: nss (the system's name service,
+# including sssd or nss-ldap) and/or ldap (query a server directly)
+backend = nss
+# Members of these groups may use mixmagisk without a policy file
+admin_groups = mixmagisk, wheel, sudo
+# ldap_uri = ldaps://ldap.example.com
+# ldap_base = ou=groups,dc=example,dc=com
+# ldap_bind_dn = cn=mixmagisk,ou=services,dc=example,dc=com
+# ldap_bind_password_file = /etc/mixmagisk/ldap.secret
+# ldap_group_filter = (&(objectClass=posixGroup)(memberUid=%u))
+
+[log]
+# Rotate /var/log/mixmagisk.log at this size or when its oldest entry is
+# max_age days old; keep retain gzipped old logs
+max_size = 10M
+max_age = 30
+retain = 5
+compress = true
+# Also send every event to journald (or syslog when journald is absent)
+forward_syslog = true
+syslog_facility = authpriv
+
+[notify]
+# Alert on these audit actions or results (denied covers access denials,
+# failed authentication and lockouts)
+events = denied
+# POST each event as JSON to a URL and/or pipe it to a program
+# webhook = https://alerts.example.com/mixmagisk
+# exec = /usr/local/sbin/mixmagisk-alert
+timeout = 5
 EOF
 
+# PAM service for mixmagisk (used when mix is built with MIX_TAGS=pam)
+if [ -d "$ROOTFS_DIR/etc/pam.d" ]; then
+    cat > "$ROOTFS_DIR/etc/pam.d/mixmagisk" << 'EOF'
+#%PAM-1.0
+# MixMagisk elevation: password, lockout and account expiry
+auth      required      pam_faillock.so preauth
+auth      required      pam_unix.so
+auth      [default=die] pam_faillock.so authfail
+account   required      pam_faillock.so
+account   required      pam_unix.so
+EOF
+fi
+
 # Create root user policy
 cat > "$ROOTFS_DIR/etc/mixmagisk/policy.d/root.policy" << 'EOF'
 # MixMagisk Policy for root
@@ -518,6 +713,8 @@ timeout = 0
 
 [commands]
 allow = *
+run_as = *
+run_as_group = *
 
 [restrictions]
 # No restrictions for root
@@ -533,11 +730,57 @@ name = USERNAME
 allow_root = true
 require_pin = false
 log_level = info
+# End of a temporary grant (set by grant --duration)
+# expires = 2026-01-02T15:04:05Z
+# Seconds a password stays valid in one terminal; 0 asks every time
 timeout = 300
+# Limit elevation to a time window (local time)
+# allowed_days = mon-fri
+# allowed_hours = 08:00-18:00
+# Make "mixmagisk -i" a built-in shell that checks each command
+# restricted_shell = true
+# Record interactive shells under /var/log/mixmagisk/sessions
+# record_sessions = true
+# Also require a touch of a security key ("mixmagisk fido enroll")
+# require_fido2 = true
+# Message shown every time this user elevates
+# banner = "Access is logged. Authorized use only."
 
 [commands]
 # Allow all commands (use specific patterns to restrict)
 allow = *
+# Commands that may run without a password (also allowed)
+# nopasswd = /usr/bin/systemctl restart myapp
+# Pin a command to its content ("mixmagisk policy digest <file>")
+# allow = sha256:<digest>/usr/sbin/backup.sh *
+# Limit arguments with regular expressions in parentheses
+# allow = systemctl (start|stop|restart) nginx
+# Users and groups other than root that -u / -g may select
+# run_as = root, postgres
+# run_as_group = postgres
+# Run commands as yourself with only these capabilities instead of as root
+# capabilities = cap_net_admin, cap_net_raw
+# Confine commands with a seccomp profile (OCI/Docker JSON format)
+# seccomp = /etc/mixmagisk/seccomp/default.json
+# Run commands in new namespaces (mount, net, ipc, uts, pid, cgroup)
+# and/or inside a root-owned jail directory
+# confine = mount, net
+# chroot = /srv/jail
+# File creation mask, start directory and the directories mixmagisk may
+# be run from (subdirectories included)
+# umask = 027
+# cwd = /srv/app
+# allowed_cwd = /srv/*, /home/deploy
+# Resource limits: one value, soft:hard or unlimited
+# rlimit_nofile = 1024
+# rlimit_nproc = 256:512
+# rlimit_core = 0
+
+[env]
+# Commands get a clean environment with a fixed PATH; list extra
+# variables to pass through (globs allowed)
+# env_keep = EDITOR, http_proxy, https_proxy
+# secure_path = /usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
 
 [restrictions]
 # Deny dangerous commands
@@ -96,6 +96,12 @@ log_ok "Prerequisites verified"
 # ============================================================================
 log_step "Creating squashfs rootfs..."
 
+# Checksums of the root for 'mix vram verify'
+MANIFEST="usr/share/mixos/manifest.sha256"
+mkdir -p "$ROOTFS_DIR/$(dirname "$MANIFEST")"
+(cd "$ROOTFS_DIR" && find . -xdev -type f ! -path "./$MANIFEST" -print0 | sort -z | xargs -0 -r sha256sum) \
+    > "$ROOTFS_DIR/$MANIFEST"
+
 SQUASHFS_PATH="$BUILD_DIR/rootfs.squashfs"
 
 if command -v mksquashfs >/dev/null 2>&1; then
@@ -271,6 +277,17 @@ if [ -n "$LOOP_DEV" ]; then
     umount "$VISO_MOUNT"
     losetup -d "$LOOP_DEV"
     
+    # Keep the metadata in the header of the image too, in the 1024 bytes
+    # before the ext4 superblock, for 'mix viso info' (see viso_metadata.go)
+    VISO_HEADER="$BUILD_DIR/viso-header"
+    { printf 'MIXOS-VISO-META\n'; sed 's/^ *//' "$VISO_BUILD/config/viso.json" | tr -d '\n'; } > "$VISO_HEADER"
+    if [ "$(stat -c %s "$VISO_HEADER")" -le 1024 ]; then
+        dd if="$VISO_HEADER" of="$VISO_RAW" conv=notrunc 2>/dev/null
+    else
+        log_warn "Metadata too large for the image header"
+    fi
+    rm -f "$VISO_HEADER"
+    
     # Convert to qcow2
     if command -v qemu-img >/dev/null 2>&1; then
         qemu-img convert -f raw -O qcow2 -c "$VISO_RAW" "$VISO_IMG"
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// blockDevice mirrors the subset of `lsblk -J` output the installer needs.
+type blockDevice struct {
+	Name       string        `json:"name"`
+	Path       string        `json:"path"`
+	Size       json.Number   `json:"size"`
+	Type       string        `json:"type"`
+	FSType     string        `json:"fstype"`
+	Label      string        `json:"label"`
+	PartLabel  string        `json:"partlabel"`
+	PTType     string        `json:"pttype"`
+	PartType   string        `json:"parttype"`
+	Mountpoint string        `json:"mountpoint"`
+	Children   []blockDevice `json:"children,omitempty"`
+}
+
+// scanDisk returns the disk and its partitions as reported by lsblk.
+func scanDisk(disk string) (*blockDevice, error) {
+	if _, err := exec.LookPath("lsblk"); err != nil {
+		return nil, fmt.Errorf("lsblk not available; cannot inspect %s", disk)
+	}
+	out, err := exec.Command("lsblk", "-J", "-b",
+		"-o", "NAME,PATH,SIZE,TYPE,FSTYPE,LABEL,PARTLABEL,PTTYPE,PARTTYPE,MOUNTPOINT", disk).Output()
+	if err != nil {
+		return nil, fmt.Errorf("lsblk %s: %w", disk, err)
+	}
+
+	var result struct {
+		BlockDevices []blockDevice `json:"blockdevices"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse lsblk output: %w", err)
+	}
+	if len(result.BlockDevices) == 0 {
+		return nil, fmt.Errorf("%s: no such block device", disk)
+	}
+	dev := result.BlockDevices[0]
+	if dev.Type != "disk" {
+		return nil, fmt.Errorf("%s is a %s, not a whole disk", disk, dev.Type)
+	}
+	return &dev, nil
+}
+
+func (d *blockDevice) sizeBytes() int64 {
+	n, _ := strconv.ParseInt(d.Size.String(), 10, 64)
+	return n
+}
+
+// signature describes what lives on the device in human terms.
+func (d *blockDevice) signature() string {
+	switch d.FSType {
+	case "":
+		return "no signature"
+	case "linux_raid_member":
+		return "RAID member (mdadm)"
+	case "LVM2_member":
+		return "LVM physical volume"
+	case "crypto_LUKS":
+		return "LUKS encrypted volume"
+	case "swap":
+		return "swap"
+	}
+	return d.FSType + " filesystem"
+}
+
+func (d *blockDevice) describe() string {
+	var parts []string
+	parts = append(parts, d.signature())
+	if d.Label != "" {
+		parts = append(parts, fmt.Sprintf("label %q", d.Label))
+	}
+	if d.PartLabel != "" {
+		parts = append(parts, fmt.Sprintf("partlabel %q", d.PartLabel))
+	}
+	if d.Mountpoint != "" {
+		parts = append(parts, "mounted at "+d.Mountpoint)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// isHome reports whether the partition looks like an existing /home.
+func (d *blockDevice) isHome() bool {
+	return d.Type == "part" && d.FSType != "" &&
+		(strings.EqualFold(d.Label, "home") || strings.EqualFold(d.PartLabel, "home") || d.Mountpoint == "/home")
+}
+
+// isESP reports whether the partition is an EFI system partition, by its
+// GPT type GUID or MBR type.
+func (d *blockDevice) isESP() bool {
+	return d.Type == "part" &&
+		(strings.EqualFold(d.PartType, "c12a7328-f81f-11d2-ba4b-00a0c93ec93b") || d.PartType == "0xef")
+}
+
+// checkNotInUse refuses a disk when it, one of its partitions or a device
+// stacked on them (LVM, md, dm-crypt; lsblk lists those holders as
+// children, recursively) is mounted or active.
+func checkNotInUse(disk *blockDevice) error {
+	var mounted func(d *blockDevice) error
+	mounted = func(d *blockDevice) error {
+		if d.Mountpoint != "" {
+			return fmt.Errorf("%s is mounted at %s; unmount it first", d.Path, d.Mountpoint)
+		}
+		for i := range d.Children {
+			if err := mounted(&d.Children[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := mounted(disk); err != nil {
+		return err
+	}
+
+	holder := func(d, h *blockDevice) error {
+		return fmt.Errorf("%s is in use by %s (%s); deactivate it first", d.Path, h.Path, h.Type)
+	}
+	for i := range disk.Children {
+		part := &disk.Children[i]
+		if part.Type != "part" {
+			return holder(disk, part)
+		}
+		if len(part.Children) > 0 {
+			return holder(part, &part.Children[0])
+		}
+	}
+	return nil
+}
+
+// findPartition returns the partition of disk named by path or name.
+func findPartition(disk *blockDevice, name string) *blockDevice {
+	for i := range disk.Children {
+		part := &disk.Children[i]
+		if part.Type == "part" && (part.Path == name || part.Name == name) {
+			return part
+		}
+	}
+	return nil
+}
+
+// findHomePartition returns the existing home partition on the disk, if any.
+func findHomePartition(disk *blockDevice) *blockDevice {
+	for i := range disk.Children {
+		if disk.Children[i].isHome() {
+			return &disk.Children[i]
+		}
+	}
+	return nil
+}
+
+// printDestructionReport lists everything that will be erased from disk:
+// the whole disk, or only root when it is set.
+func printDestructionReport(w io.Writer, disk *blockDevice, root *blockDevice) {
+	fmt.Fprintf(w, "\nTarget disk: %s (%s)\n", disk.Path, humanSize(disk.sizeBytes()))
+	if disk.PTType != "" {
+		fmt.Fprintf(w, "Partition table: %s\n", disk.PTType)
+	}
+	if disk.FSType != "" {
+		fmt.Fprintf(w, "Whole-disk signature: %s\n", disk.describe())
+	}
+
+	if len(disk.Children) == 0 && disk.FSType == "" && disk.PTType == "" {
+		fmt.Fprintln(w, "The disk appears to be empty.")
+		return
+	}
+
+	fmt.Fprintln(w, "\nThe following will be DESTROYED:")
+	var kept []blockDevice
+	for _, part := range disk.Children {
+		if root != nil && part.Path != root.Path {
+			kept = append(kept, part)
+			continue
+		}
+		fmt.Fprintf(w, "  %-16s %10s  %s\n", part.Path, humanSize(part.sizeBytes()), part.describe())
+		for _, child := range part.Children {
+			fmt.Fprintf(w, "    └ %-12s %10s  %s\n", child.Name, humanSize(child.sizeBytes()), child.describe())
+		}
+	}
+	if len(kept) > 0 {
+		fmt.Fprintln(w, "\nThe following will be KEPT:")
+		for _, part := range kept {
+			fmt.Fprintf(w, "  %-16s %10s  %s\n", part.Path, humanSize(part.sizeBytes()), part.describe())
+		}
+	}
+}
+
+// confirmWipe requires the user to type the disk name before anything is
+// destroyed.
+func confirmWipe(in io.Reader, out io.Writer, disk *blockDevice) bool {
+	fmt.Fprintf(out, "\nType the disk name (%s) to continue, anything else aborts: ", disk.Name)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return false
+	}
+	answer := strings.TrimSpace(line)
+	return answer == disk.Name || answer == disk.Path
+}
+
+// prepareDisk scans, reports and (after confirmation) partitions and
+// formats the target disk. When preserveHome is set an existing home
+// partition must exist and only rootPart is formatted; the home partition,
+// the EFI system partition and anything else on the disk are kept.
+// confirmed skips the interactive prompt and must name the disk; dryRun
+// only prints the report.
+func prepareDisk(diskPath string, preserveHome bool, rootPart string, confirmed string, dryRun bool) error {
+	disk, err := scanDisk(diskPath)
+	if err != nil {
+		return err
+	}
+	if err := checkNotInUse(disk); err != nil {
+		return err
+	}
+
+	var root *blockDevice
+	if preserveHome {
+		home := findHomePartition(disk)
+		if home == nil {
+			return fmt.Errorf("--preserve-home: no partition labelled 'home' found on %s", disk.Path)
+		}
+		if rootPart == "" {
+			return fmt.Errorf("--preserve-home: name the partition to format as the new root with --root-partition")
+		}
+		if root = findPartition(disk, rootPart); root == nil {
+			return fmt.Errorf("--root-partition: %s is not a partition of %s", rootPart, disk.Path)
+		}
+		switch {
+		case root.Path == home.Path:
+			return fmt.Errorf("--root-partition: %s is the home partition", root.Path)
+		case root.isESP():
+			return fmt.Errorf("--root-partition: %s is the EFI system partition", root.Path)
+		}
+	}
+
+	printDestructionReport(os.Stdout, disk, root)
+
+	if dryRun {
+		fmt.Println("\nDry-run mode: no changes made to", disk.Path)
+		return nil
+	}
+
+	if confirmed != "" {
+		if confirmed != disk.Name && confirmed != disk.Path {
+			return fmt.Errorf("confirmation %q does not match disk %s", confirmed, disk.Name)
+		}
+	} else if !confirmWipe(os.Stdin, os.Stdout, disk) {
+		return fmt.Errorf("aborted: disk name not confirmed")
+	}
+
+	if root != nil {
+		return reformatRoot(root)
+	}
+	return partitionAndFormat(disk)
+}
+
+// The fresh layout: an EFI system partition first, the root after it.
+const (
+	espSize   = "512MiB"
+	espLabel  = "EFI"
+	rootLabel = "mixos"
+
+	// partitionWait bounds the wait for udev to create partition nodes.
+	partitionWait = 10 * time.Second
+)
+
+// diskLayout is the sfdisk script of the fresh layout.
+func diskLayout() string {
+	return "label: gpt\n" +
+		"," + espSize + ",U\n" + // EFI system partition
+		",,L\n" // Linux root, the rest of the disk
+}
+
+// partitionAndFormat wipes all signatures and creates a fresh layout: a
+// FAT32 EFI system partition labelled "EFI" and an ext4 root partition
+// labelled "mixos".
+func partitionAndFormat(disk *blockDevice) error {
+	for _, part := range disk.Children {
+		if err := runTool("wipefs", "-a", part.Path); err != nil {
+			return err
+		}
+	}
+	if err := runTool("wipefs", "-a", disk.Path); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sfdisk", disk.Path)
+	cmd.Stdin = strings.NewReader(diskLayout())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sfdisk: %w", err)
+	}
+
+	esp, root := partitionPath(disk.Path, 1), partitionPath(disk.Path, 2)
+	if err := waitForPartitions(esp, root); err != nil {
+		return err
+	}
+	if err := runTool("mkfs.vfat", "-F", "32", "-n", espLabel, esp); err != nil {
+		return err
+	}
+	return runTool("mkfs.ext4", "-F", "-L", rootLabel, root)
+}
+
+// waitForPartitions waits until the nodes of freshly written partitions
+// exist: udev creates them asynchronously after the kernel re-reads the
+// table, and mkfs on a missing node fails (or worse, on a stale one).
+func waitForPartitions(paths ...string) error {
+	if _, err := exec.LookPath("udevadm"); err == nil {
+		// Settle failing only means udev is not running; poll below
+		exec.Command("udevadm", "settle", fmt.Sprintf("--timeout=%d", int(partitionWait.Seconds()))).Run()
+	}
+	deadline := time.Now().Add(partitionWait)
+	for _, path := range paths {
+		for !isBlockDevice(path) {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s did not appear after partitioning", path)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// isBlockDevice reports whether path is a block device node.
+func isBlockDevice(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
+
+// reformatRoot keeps the partition table and every other partition and
+// formats root as the new root filesystem.
+func reformatRoot(root *blockDevice) error {
+	if err := runTool("wipefs", "-a", root.Path); err != nil {
+		return err
+	}
+	return runTool("mkfs.ext4", "-F", "-L", rootLabel, root.Path)
+}
+
+// partitionPath returns the device path of partition n (sda -> sda1,
+// nvme0n1 -> nvme0n1p1).
+func partitionPath(disk string, n int) string {
+	base := filepath.Base(disk)
+	if len(base) > 0 && base[len(base)-1] >= '0' && base[len(base)-1] <= '9' {
+		return fmt.Sprintf("%sp%d", disk, n)
+	}
+	return fmt.Sprintf("%s%d", disk, n)
+}
+
+func runTool(name string, args ...string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s not available", name)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func humanSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
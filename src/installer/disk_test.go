@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testDisk is a disk holding an ESP, a root, a home and an LVM volume.
+func testDisk() *blockDevice {
+	return &blockDevice{
+		Name: "sda", Path: "/dev/sda", Size: "107374182400", Type: "disk", PTType: "gpt",
+		Children: []blockDevice{
+			{Name: "sda1", Path: "/dev/sda1", Size: "536870912", Type: "part", FSType: "vfat",
+				PartType: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"},
+			{Name: "sda2", Path: "/dev/sda2", Size: "21474836480", Type: "part", FSType: "ext4", Label: "mixos"},
+			{Name: "sda3", Path: "/dev/sda3", Size: "53687091200", Type: "part", FSType: "ext4", Label: "home"},
+			{Name: "sda4", Path: "/dev/sda4", Size: "31138512896", Type: "part", FSType: "LVM2_member",
+				Children: []blockDevice{{Name: "vg-data", Path: "/dev/mapper/vg-data", Size: "31134318592", Type: "lvm", FSType: "xfs"}}},
+		},
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		dev      blockDevice
+		expected string
+	}{
+		{blockDevice{}, "no signature"},
+		{blockDevice{FSType: "ext4", Label: "home"}, `ext4 filesystem, label "home"`},
+		{blockDevice{FSType: "linux_raid_member", PartLabel: "raid"}, `RAID member (mdadm), partlabel "raid"`},
+		{blockDevice{FSType: "crypto_LUKS"}, "LUKS encrypted volume"},
+		{blockDevice{FSType: "LVM2_member"}, "LVM physical volume"},
+		{blockDevice{FSType: "swap", Mountpoint: "[SWAP]"}, "swap, mounted at [SWAP]"},
+		{blockDevice{FSType: "vfat", Label: "EFI", PartLabel: "esp", Mountpoint: "/boot/efi"},
+			`vfat filesystem, label "EFI", partlabel "esp", mounted at /boot/efi`},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dev.describe(); got != tt.expected {
+			t.Errorf("describe(%+v) = %q, expected %q", tt.dev, got, tt.expected)
+		}
+	}
+}
+
+func TestPrintDestructionReport(t *testing.T) {
+	disk := testDisk()
+	tests := []struct {
+		name      string
+		disk      *blockDevice
+		root      *blockDevice
+		contains  []string
+		destroyed []string
+		kept      []string
+	}{
+		{
+			name:      "whole disk",
+			disk:      disk,
+			contains:  []string{"Target disk: /dev/sda (100.0 GB)", "Partition table: gpt"},
+			destroyed: []string{"/dev/sda1", "/dev/sda2", "/dev/sda3", "/dev/sda4", "└ vg-data", "xfs filesystem"},
+		},
+		{
+			name:      "root only",
+			disk:      disk,
+			root:      &disk.Children[1],
+			destroyed: []string{"/dev/sda2"},
+			kept:      []string{"/dev/sda1", "/dev/sda3", "/dev/sda4"},
+		},
+		{
+			name:     "empty",
+			disk:     &blockDevice{Name: "vdb", Path: "/dev/vdb", Size: "1073741824", Type: "disk"},
+			contains: []string{"Target disk: /dev/vdb (1.0 GB)", "The disk appears to be empty."},
+		},
+		{
+			name:      "whole-disk filesystem",
+			disk:      &blockDevice{Name: "vdb", Path: "/dev/vdb", Size: "1073741824", Type: "disk", FSType: "ext4", Label: "backup"},
+			contains:  []string{`Whole-disk signature: ext4 filesystem, label "backup"`},
+			destroyed: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		printDestructionReport(&out, tt.disk, tt.root)
+		report := out.String()
+		for _, s := range tt.contains {
+			if !strings.Contains(report, s) {
+				t.Errorf("%s: report lacks %q:\n%s", tt.name, s, report)
+			}
+		}
+
+		// Split the report into its DESTROYED and KEPT sections
+		_, rest, found := strings.Cut(report, "will be DESTROYED:")
+		if found != (tt.destroyed != nil) {
+			t.Errorf("%s: DESTROYED section present = %v:\n%s", tt.name, found, report)
+		}
+		destroyed, kept, _ := strings.Cut(rest, "will be KEPT:")
+		if (kept != "") != (tt.kept != nil) {
+			t.Errorf("%s: KEPT section present = %v:\n%s", tt.name, kept != "", report)
+		}
+		for _, s := range tt.destroyed {
+			if !strings.Contains(destroyed, s) {
+				t.Errorf("%s: %s not listed as destroyed:\n%s", tt.name, s, report)
+			}
+		}
+		for _, s := range tt.kept {
+			if !strings.Contains(kept, s) || strings.Contains(destroyed, s) {
+				t.Errorf("%s: %s not listed as kept:\n%s", tt.name, s, report)
+			}
+		}
+	}
+}
+
+func TestConfirmWipe(t *testing.T) {
+	disk := testDisk()
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"sda\n", true},
+		{"/dev/sda\n", true},
+		{"  sda  \n", true},
+		{"sda", true}, // no newline before end of input
+		{"sdb\n", false},
+		{"yes\n", false},
+		{"\n", false},
+		{"", false},
+		{"SDA\n", false},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if got := confirmWipe(strings.NewReader(tt.input), &out, disk); got != tt.expected {
+			t.Errorf("confirmWipe(%q) = %v, expected %v", tt.input, got, tt.expected)
+		}
+		if !strings.Contains(out.String(), "Type the disk name (sda)") {
+			t.Errorf("confirmWipe prompt = %q", out.String())
+		}
+	}
+}
+
+func TestCheckNotInUse(t *testing.T) {
+	part := func(name string, children ...blockDevice) blockDevice {
+		return blockDevice{Name: name, Path: "/dev/" + name, Type: "part", FSType: "ext4", Children: children}
+	}
+	tests := []struct {
+		name string
+		disk blockDevice
+		err  string // "" when the disk is free
+	}{
+		{"empty", blockDevice{Path: "/dev/sda", Type: "disk"}, ""},
+		{"partitions", blockDevice{Path: "/dev/sda", Type: "disk", Children: []blockDevice{part("sda1"), part("sda2")}}, ""},
+		{"disk mounted", blockDevice{Path: "/dev/sda", Type: "disk", Mountpoint: "/mnt"}, "/dev/sda is mounted at /mnt"},
+		{"partition mounted",
+			blockDevice{Path: "/dev/sda", Type: "disk", Children: []blockDevice{part("sda1"), {Name: "sda2", Path: "/dev/sda2", Type: "part", Mountpoint: "/home"}}},
+			"/dev/sda2 is mounted at /home"},
+		{"swap in use",
+			blockDevice{Path: "/dev/sda", Type: "disk", Children: []blockDevice{{Name: "sda1", Path: "/dev/sda1", Type: "part", FSType: "swap", Mountpoint: "[SWAP]"}}},
+			"/dev/sda1 is mounted at [SWAP]"},
+		{"lvm mounted",
+			blockDevice{Path: "/dev/sda", Type: "disk", Children: []blockDevice{part("sda1", blockDevice{Path: "/dev/mapper/vg-root", Type: "lvm", Mountpoint: "/"})}},
+			"/dev/mapper/vg-root is mounted at /"},
+		{"lvm active",
+			blockDevice{Path: "/dev/sda", Type: "disk", Children: []blockDevice{part("sda1", blockDevice{Path: "/dev/mapper/vg-data", Type: "lvm"})}},
+			"/dev/sda1 is in use by /dev/mapper/vg-data (lvm)"},
+		{"raid member",
+			blockDevice{Path: "/dev/sda", Type: "disk", Children: []blockDevice{part("sda1", blockDevice{Path: "/dev/md0", Type: "raid1"})}},
+			"/dev/sda1 is in use by /dev/md0 (raid1)"},
+		{"luks on the whole disk",
+			blockDevice{Path: "/dev/sda", Type: "disk", Children: []blockDevice{{Path: "/dev/mapper/secret", Type: "crypt"}}},
+			"/dev/sda is in use by /dev/mapper/secret (crypt)"},
+	}
+
+	for _, tt := range tests {
+		err := checkNotInUse(&tt.disk)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: checkNotInUse failed: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+			t.Errorf("%s: checkNotInUse = %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestDiskLayout(t *testing.T) {
+	if layout := diskLayout(); layout != "label: gpt\n,512MiB,U\n,,L\n" {
+		t.Errorf("diskLayout() = %q", layout)
+	}
+
+	tests := []struct {
+		disk     string
+		n        int
+		expected string
+	}{
+		{"/dev/sda", 1, "/dev/sda1"},
+		{"/dev/vdb", 2, "/dev/vdb2"},
+		{"/dev/nvme0n1", 2, "/dev/nvme0n1p2"},
+		{"/dev/mmcblk0", 1, "/dev/mmcblk0p1"},
+		{"/dev/loop0", 2, "/dev/loop0p2"},
+	}
+	for _, tt := range tests {
+		if got := partitionPath(tt.disk, tt.n); got != tt.expected {
+			t.Errorf("partitionPath(%q, %d) = %q, expected %q", tt.disk, tt.n, got, tt.expected)
+		}
+	}
+}
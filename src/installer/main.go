@@ -145,6 +145,10 @@ func main() {
 	// Simple flag parsing for unattended mode
 	cfgPath := ""
 	dryRun := false
+	disk := ""
+	confirmDisk := ""
+	preserveHome := false
+	rootPart := ""
 	args := os.Args[1:]
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
@@ -158,6 +162,23 @@ func main() {
 			}
 		case "--dry-run":
 			dryRun = true
+		case "--disk":
+			if i+1 < len(args) {
+				disk = args[i+1]
+				i++
+			}
+		case "--confirm-disk":
+			if i+1 < len(args) {
+				confirmDisk = args[i+1]
+				i++
+			}
+		case "--preserve-home":
+			preserveHome = true
+		case "--root-partition":
+			if i+1 < len(args) {
+				rootPart = args[i+1]
+				i++
+			}
 		}
 	}
 
@@ -172,13 +193,21 @@ func main() {
 	}
 
 	if cfgPath != "" {
-		if err := runAutoinstall(cfgPath, dryRun); err != nil {
+		if err := runAutoinstall(cfgPath, dryRun, disk, confirmDisk, preserveHome, rootPart); err != nil {
 			fmt.Fprintln(os.Stderr, "Autoinstall error:", err)
 			os.Exit(1)
 		}
 		return
 	}
 
+	// Interactive install: the target disk must be confirmed before the UI starts
+	if disk != "" {
+		if err := prepareDisk(disk, preserveHome, rootPart, confirmDisk, dryRun); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	}
+
 	if err := runInstaller(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
 		os.Exit(1)
@@ -205,9 +234,17 @@ type InstallConfig struct {
 	} `yaml:"network,omitempty"`
 	Packages    []string `yaml:"packages,omitempty"`
 	PostInstall []string `yaml:"post_install_scripts,omitempty"`
+
+	// Disk is the target disk to partition and format. Unattended installs
+	// must repeat the disk name in ConfirmDisk since nobody can type it.
+	// With PreserveHome only RootPartition is formatted.
+	Disk          string `yaml:"disk,omitempty"`
+	ConfirmDisk   string `yaml:"confirm_disk,omitempty"`
+	PreserveHome  bool   `yaml:"preserve_home,omitempty"`
+	RootPartition string `yaml:"root_partition,omitempty"`
 }
 
-func runAutoinstall(path string, dryRun bool) error {
+func runAutoinstall(path string, dryRun bool, disk, confirmDisk string, preserveHome bool, rootPart string) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -220,6 +257,28 @@ func runAutoinstall(path string, dryRun bool) error {
 		return err
 	}
 
+	if disk != "" {
+		cfg.Disk = disk
+	}
+	if confirmDisk != "" {
+		cfg.ConfirmDisk = confirmDisk
+	}
+	if preserveHome {
+		cfg.PreserveHome = true
+	}
+	if rootPart != "" {
+		cfg.RootPartition = rootPart
+	}
+
+	if cfg.Disk != "" {
+		if cfg.ConfirmDisk == "" && !dryRun {
+			return fmt.Errorf("unattended install to %s requires confirm_disk: %s in the config or --confirm-disk %s", cfg.Disk, filepath.Base(cfg.Disk), filepath.Base(cfg.Disk))
+		}
+		if err := prepareDisk(cfg.Disk, cfg.PreserveHome, cfg.RootPartition, cfg.ConfirmDisk, dryRun); err != nil {
+			return fmt.Errorf("disk preparation failed: %w", err)
+		}
+	}
+
 	if dryRun {
 		fmt.Println("Dry-run mode: would apply config:")
 		fmt.Printf("%+v\n", cfg)
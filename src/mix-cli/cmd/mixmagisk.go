@@ -1,19 +1,26 @@
 package cmd
 
 import (
-	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/mixos-go/src/mix-cli/pkg/shadow"
 	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
 )
 
 // ============================================================================
@@ -26,6 +33,7 @@ const (
 	mixmagiskConfig  = "/etc/mixmagisk/config"
 	mixmagiskLog     = "/var/log/mixmagisk.log"
 	mixmagiskPolicy  = "/etc/mixmagisk/policy.d"
+	mixmagiskHashes  = "/etc/mixmagisk/hashes" // <user>.hash for users without a shadow entry
 	mixmagiskCache   = "/run/mixmagisk"
 )
 
@@ -56,53 +64,181 @@ Features:
   • Comprehensive audit logging
   • Session management
   • PIN/password authentication
+  • SSH agent / certificate authentication
+  • FIDO2 security keys
   • Command whitelisting/blacklisting
 
 Usage:
   mixmagisk <command>           Run command as root
+  mixmagisk -u <user> [-g <group>] <command>
+                                Run command as another user
   mixmagisk -i                  Interactive root shell
+  mixmagisk -S <command>        Read the password from stdin (for scripts)
+  mixmagisk -k | -K             Forget this terminal's / all authentication
   mixmagisk status              Show mixmagisk status
-  mixmagisk grant <user>        Grant root access to user
+  mixmagisk doctor              Check the installation for problems
+  mixmagisk broker              Run the privileged broker (as root, at boot)
+  mixmagisk grant <user> [--duration 2h]
+                                Grant root access to user, optionally
+                                for a limited time
   mixmagisk revoke <user>       Revoke root access from user
-  mixmagisk log                 Show recent root operations
-  mixmagisk policy              Manage access policies`,
+  mixmagisk log [filters]       Show recent root operations
+                                (--user --action --since --grep --json ...)
+  mixmagisk log rotate          Rotate and compress the audit log
+  mixmagisk log verify [file]   Check the audit log hash chain
+  mixmagisk log export --format cef|auditd|jsonl [--since 24h]
+                                Export the audit log for a SIEM
+  mixmagisk sessions            List active sessions (cached authentication)
+  mixmagisk sessions kill <id> | --user <user>
+                                End sessions, e.g. after offboarding
+  mixmagisk sessions list       List recorded shell sessions
+  mixmagisk replay [--speed N] <id>
+                                Play back a recorded session
+  mixmagisk fido enroll <user> [--name N]
+                                Register a FIDO2 security key
+  mixmagisk fido list [user] | remove <user> <name>
+                                Manage registered security keys
+  mixmagisk policy              Manage access policies
+  mixmagisk policy check [user] Validate policy files
+  mixmagisk policy show --effective <user>
+                                Show a policy merged with include.d
+  mixmagisk policy digest <file>
+                                Print a sha256-pinned pattern for a command
+  mixmagisk policy test <user> -- <command>
+                                Show whether a command would be allowed`,
+	DisableFlagParsing: true,
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) == 0 {
-			showMixmagiskStatus()
-			return
+		runMixmagisk(args)
+	},
+}
+
+// runMixmagisk parses options and dispatches to a subcommand, the shell or
+// command execution
+func runMixmagisk(args []string) {
+	if len(args) > 0 && args[0] == seccompHelperCmd {
+		runSeccompHelper(args[1:])
+	}
+	if len(args) > 0 && args[0] == credentialProbeCmd {
+		runCredentialProbe()
+	}
+	if len(args) > 0 && args[0] == brokerServeCmd {
+		runBrokerServe(args[1:])
+	}
+	if useBroker() {
+		code, err := runBrokerClient(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mixmagisk: %v\n", err)
+			os.Exit(exitError)
 		}
+		os.Exit(code)
+	}
 
-		// Handle subcommands
-		switch args[0] {
-		case "status":
-			showMixmagiskStatus()
-		case "grant":
-			if len(args) < 2 {
-				fmt.Println("Usage: mixmagisk grant <username>")
-				return
-			}
-			grantRootAccess(args[1])
-		case "revoke":
-			if len(args) < 2 {
-				fmt.Println("Usage: mixmagisk revoke <username>")
-				return
-			}
-			revokeRootAccess(args[1])
-		case "log":
-			showMixmagiskLog()
-		case "policy":
-			if len(args) < 2 {
-				showPolicies()
-			} else {
-				managePolicies(args[1:])
-			}
-		case "shell", "-i":
-			startRootShell()
+	opts, rest, err := parseMixmagiskArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixmagisk: %v\n", err)
+		fmt.Fprintln(os.Stderr, "Run 'mixmagisk --help' for usage")
+		os.Exit(exitError)
+	}
+	askpassForced = opts.AskPass
+	stdinPassword = opts.Stdin
+	expireGrants()
+
+	switch {
+	case opts.Help:
+		showMixmagiskHelp()
+		return
+	case opts.Version:
+		fmt.Printf("MixMagisk version %s\n", mixmagiskVersion)
+		return
+	case opts.RemoveAll:
+		if len(rest) > 0 || opts.Shell || opts.hasTarget() {
+			fmt.Fprintln(os.Stderr, "mixmagisk: -K cannot be combined with a command")
+			os.Exit(1)
+		}
+		invalidateAllSessions()
+		return
+	case opts.Invalidate && len(rest) == 0 && !opts.Shell:
+		// -k alone, or with -u/-g and nothing to run
+		invalidateSession()
+		return
+	}
+
+	// -k ends the ticket, then the command, shell or subcommand runs as
+	// without it, authenticating anew
+	if opts.Invalidate {
+		invalidateSession()
+	}
+	switch {
+	case opts.Shell:
+		if len(rest) > 0 {
+			fmt.Fprintln(os.Stderr, "mixmagisk: -i does not take a command")
+			os.Exit(1)
+		}
+		startShell(opts)
+		return
+	case len(rest) == 0:
+		if opts.hasTarget() {
+			fmt.Fprintln(os.Stderr, "mixmagisk: a command is required with -u/-g")
+			os.Exit(1)
+		}
+		showMixmagiskStatus()
+		return
+	case opts.hasTarget():
+		// -u/-g always means "run this command"
+		executeCommand(opts, rest)
+		return
+	}
+
+	// Handle subcommands
+	switch rest[0] {
+	case "status":
+		showMixmagiskStatus()
+	case "grant":
+		user, duration, err := parseGrantArgs(rest[1:])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			fmt.Println("Usage: mixmagisk grant <username> [--duration 2h]")
+			return
+		}
+		grantRootAccess(user, duration)
+	case "revoke":
+		if len(rest) < 2 {
+			fmt.Println("Usage: mixmagisk revoke <username>")
+			return
+		}
+		revokeRootAccess(rest[1])
+	case "log":
+		switch {
+		case len(rest) > 1 && rest[1] == "rotate":
+			rotateAuditLogNow()
+		case len(rest) > 1 && rest[1] == "verify":
+			verifyAuditLogCmd(rest[2:])
+		case len(rest) > 1 && rest[1] == "export":
+			exportAuditLog(rest[2:])
 		default:
-			// Execute command as root
-			executeAsRoot(args)
+			showMixmagiskLog(rest[1:])
 		}
-	},
+	case "policy":
+		if len(rest) < 2 {
+			showPolicies()
+		} else {
+			managePolicies(rest[1:])
+		}
+	case "doctor":
+		runDoctor()
+	case "broker":
+		runBroker()
+	case "sessions":
+		sessionsCmd(rest[1:])
+	case "fido":
+		fidoCmd(rest[1:])
+	case "replay":
+		replaySession(rest[1:])
+	case "shell":
+		startShell(opts)
+	default:
+		executeCommand(opts, rest)
+	}
 }
 
 // ============================================================================
@@ -120,7 +256,7 @@ func showMixmagiskStatus() {
 	fmt.Printf("  Version:     %s\n", mixmagiskVersion)
 
 	// Current user
-	user := os.Getenv("USER")
+	user := callerName()
 	fmt.Printf("  Current User: %s\n", user)
 
 	// Check if user has root access
@@ -140,12 +276,17 @@ func showMixmagiskStatus() {
 	fmt.Printf("  Running Root: %s\n", rootStr)
 
 	// Session status
-	sessionActive := checkSession()
+	sessionActive := checkSession(user)
 	sessionStr := "❌ Inactive"
 	if sessionActive {
 		sessionStr = "✅ Active"
 	}
 	fmt.Printf("  Session:      %s\n", sessionStr)
+	if timeout := sessionTimeout(user); timeout == 0 {
+		fmt.Printf("  Timeout:      always ask for password\n")
+	} else {
+		fmt.Printf("  Timeout:      %s\n", timeout)
+	}
 
 	// Policy count
 	policyCount := countPolicies()
@@ -167,34 +308,48 @@ func showMixmagiskStatus() {
 // ============================================================================
 
 func checkRootAccess(user string) bool {
+	_, ok := rootAccessReason(user)
+	return ok
+}
+
+// rootAccessReason reports whether user may use mixmagisk at all, and why
+func rootAccessReason(user string) (string, bool) {
 	// Check if user is in mixmagisk group or has policy
 	configPath := filepath.Join(mixmagiskPolicy, user+".policy")
-	if _, err := os.Stat(configPath); err == nil {
-		return true
+	expired := false
+	if p, err := readPolicyFile(configPath); err == nil && p.expired(time.Now()) {
+		expireGrant(configPath)
+		expired = true
+	} else if _, err := os.Stat(configPath); err == nil {
+		return "policy file " + configPath, true
 	}
 
 	// Check group membership
-	groups, err := exec.Command("groups", user).Output()
-	if err == nil {
-		if strings.Contains(string(groups), "mixmagisk") ||
-			strings.Contains(string(groups), "wheel") ||
-			strings.Contains(string(groups), "sudo") {
-			return true
-		}
+	if group, dir, ok := adminGroupMembership(user); ok {
+		return fmt.Sprintf("member of group %s (%s)", group, dir), true
 	}
 
 	// Root always has access
 	if user == "root" {
-		return true
+		return "root", true
 	}
 
-	return false
+	if expired {
+		return "temporary grant expired and not in " + describeAdminGroups(), false
+	}
+	return "no policy file and not in " + describeAdminGroups(), false
 }
 
-func grantRootAccess(user string) {
-	if os.Geteuid() != 0 {
+// grantRootAccess writes a default policy for user, ending after
+// duration unless it is zero
+func grantRootAccess(user string, duration time.Duration) {
+	// euid is always 0 in a setuid binary; the real uid is the caller
+	if os.Getuid() != 0 {
 		fmt.Println("Error: Must be root to grant access")
-		fmt.Println("Run: mixmagisk grant", user)
+		return
+	}
+	if err := checkPolicyUser(user); err != nil {
+		fmt.Printf("Error: %v\n", err)
 		return
 	}
 
@@ -203,6 +358,12 @@ func grantRootAccess(user string) {
 
 	// Create user policy
 	policyPath := filepath.Join(mixmagiskPolicy, user+".policy")
+	expires := "# End of a temporary grant (set by grant --duration)\n# expires = 2026-01-02T15:04:05Z"
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration).UTC().Truncate(time.Second)
+		expires = "# Temporary grant: access ends at this time\nexpires = " + until.Format(time.RFC3339)
+	}
 	policy := fmt.Sprintf(`# MixMagisk Policy for %s
 # Created: %s
 
@@ -211,17 +372,68 @@ name = %s
 allow_root = true
 require_pin = false
 log_level = info
+%s
+# Seconds a password stays valid in one terminal; 0 asks every time
 timeout = 300
+# Limit elevation to a time window (local time)
+# allowed_days = mon-fri
+# allowed_hours = 08:00-18:00
+# Make "mixmagisk -i" a built-in shell that checks each command
+# restricted_shell = true
+# Record interactive shells under /var/log/mixmagisk/sessions
+# record_sessions = true
+# Also require a touch of a security key ("mixmagisk fido enroll")
+# require_fido2 = true
+# Message shown every time this user elevates
+# banner = "Access is logged. Authorized use only."
+
+[auth]
+# Passwordless elevation over SSH (agent forwarding required)
+# ssh_ca = /etc/mixmagisk/ssh_user_ca.pub
+# ssh_principals = %s
+# ssh_authorized_keys = /etc/mixmagisk/keys/%s.pub
 
 [commands]
 # Allow all commands (use specific patterns to restrict)
 allow = *
+# Commands that may run without a password (also allowed)
+# nopasswd = /usr/bin/systemctl restart myapp
+# Pin a command to its content ("mixmagisk policy digest <file>")
+# allow = sha256:<digest>/usr/sbin/backup.sh *
+# Limit arguments with regular expressions in parentheses
+# allow = systemctl (start|stop|restart) nginx
+# Users and groups other than root that -u / -g may select
+# run_as = root, postgres
+# run_as_group = postgres
+# Run commands as yourself with only these capabilities instead of as root
+# capabilities = cap_net_admin, cap_net_raw
+# Confine commands with a seccomp profile (OCI/Docker JSON format)
+# seccomp = /etc/mixmagisk/seccomp/default.json
+# Run commands in new namespaces (mount, net, ipc, uts, pid, cgroup)
+# and/or inside a root-owned jail directory
+# confine = mount, net
+# chroot = /srv/jail
+# File creation mask, start directory and the directories mixmagisk may
+# be run from (subdirectories included)
+# umask = 027
+# cwd = /srv/app
+# allowed_cwd = /srv/*, /home/deploy
+# Resource limits: one value, soft:hard or unlimited
+# rlimit_nofile = 1024
+# rlimit_nproc = 256:512
+# rlimit_core = 0
+
+[env]
+# Commands get a clean environment with a fixed PATH; list extra
+# variables to pass through (globs allowed)
+# env_keep = EDITOR, http_proxy, https_proxy
+# secure_path = /usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
 
 [restrictions]
 # Deny dangerous commands
 deny = rm -rf /
 deny = dd if=/dev/zero of=/dev/sda
-`, user, time.Now().Format(time.RFC3339), user)
+`, user, time.Now().Format(time.RFC3339), user, expires, user, user)
 
 	if err := os.WriteFile(policyPath, []byte(policy), 0644); err != nil {
 		fmt.Printf("Error creating policy: %v\n", err)
@@ -229,17 +441,26 @@ deny = dd if=/dev/zero of=/dev/sda
 	}
 
 	// Log the action
-	logAction("grant", user, "Root access granted")
-
-	fmt.Printf("✅ Root access granted to user: %s\n", user)
+	if duration > 0 {
+		logAction("grant", user, "Root access granted until "+until.Format(time.RFC3339))
+		fmt.Printf("✅ Root access granted to user: %s\n", user)
+		fmt.Printf("   Expires:     %s\n", formatExpiry(until, time.Now()))
+	} else {
+		logAction("grant", user, "Root access granted")
+		fmt.Printf("✅ Root access granted to user: %s\n", user)
+	}
 	fmt.Printf("   Policy file: %s\n", policyPath)
 }
 
 func revokeRootAccess(user string) {
-	if os.Geteuid() != 0 {
+	if os.Getuid() != 0 {
 		fmt.Println("Error: Must be root to revoke access")
 		return
 	}
+	if err := checkPolicyUser(user); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
 
 	policyPath := filepath.Join(mixmagiskPolicy, user+".policy")
 	if err := os.Remove(policyPath); err != nil {
@@ -255,199 +476,678 @@ func revokeRootAccess(user string) {
 	logAction("revoke", user, "Root access revoked")
 
 	fmt.Printf("✅ Root access revoked from user: %s\n", user)
+
+	// A cached ticket would otherwise outlive the policy until it times out
+	if n := endUserSessions(user, "on revoke"); n > 0 {
+		fmt.Printf("   Ended %d active session(s)\n", n)
+	}
 }
 
 // ============================================================================
 // Session Management
 // ============================================================================
 
-func checkSession() bool {
-	sessionFile := filepath.Join(mixmagiskCache, fmt.Sprintf("session_%d", os.Getuid()))
-	info, err := os.Stat(sessionFile)
+// Tickets are keyed by uid, terminal and login session (the session
+// leader's pid and start time), so authenticating in one terminal does not
+// unlock another, and processes without a terminal (cron, scripts) never
+// reuse a ticket.
+
+// defaultSessionTimeout is how long a ticket stays valid without use when
+// neither the user's policy nor the config sets a timeout
+const defaultSessionTimeout = 5 * time.Minute
+
+// sessionTimeout returns the ticket lifetime for user: the policy's
+// "timeout" (seconds), else session_timeout from [general] in the config.
+// Zero means a password is asked for every time.
+func sessionTimeout(user string) time.Duration {
+	if policy, err := loadUserPolicy(user); err == nil {
+		if v, ok := policy.get("timeout"); ok {
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	s := loadMixmagiskSettings()
+	return time.Duration(s.integer("general", "session_timeout", int(defaultSessionTimeout/time.Second))) * time.Second
+}
+
+// sessionTicket identifies the terminal session a ticket belongs to
+type sessionTicket struct {
+	UID       int
+	TTY       string
+	SID       int
+	SIDStart  string // start time of the session leader, guards against pid reuse
+	CreatedAt time.Time
+	User      string // user who authenticated, checked again on reuse
+}
+
+// currentTicket describes the calling terminal session, or returns nil when
+// there is no terminal
+func currentTicket() *sessionTicket {
+	tty := currentTTY()
+	if tty == "" {
+		return nil
+	}
+	sid, err := unix.Getsid(callerPID)
+	if err != nil || callerGone() {
+		return nil
+	}
+	return &sessionTicket{
+		UID:      os.Getuid(),
+		TTY:      tty,
+		SID:      sid,
+		SIDStart: processStartTime(sid),
+	}
+}
+
+// path returns the ticket file, e.g. /run/mixmagisk/ticket_1000_pts-3_4242
+func (t *sessionTicket) path() string {
+	tty := strings.ReplaceAll(strings.TrimPrefix(t.TTY, "/dev/"), "/", "-")
+	return filepath.Join(mixmagiskCache, fmt.Sprintf("ticket_%d_%s_%d", t.UID, tty, t.SID))
+}
+
+func (t *sessionTicket) encode() string {
+	return fmt.Sprintf("%d\n%s\n%d\n%s\n%s\n%s\n", t.UID, t.TTY, t.SID, t.SIDStart, t.CreatedAt.Format(time.RFC3339), t.User)
+}
+
+// processStartTime returns field 22 of /proc/<pid>/stat
+func processStartTime(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// the command name may contain spaces; fields resume after ")"
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19]
+}
+
+func checkSession(user string) bool {
+	timeout := sessionTimeout(user)
+	t := currentTicket()
+	if t == nil || timeout == 0 {
+		return false
+	}
+	info, err := os.Lstat(t.path())
 	if err != nil {
 		return false
 	}
 
-	// Check if session is still valid (5 minute timeout)
-	if time.Since(info.ModTime()) > 5*time.Minute {
-		os.Remove(sessionFile)
+	// Only trust regular files written by us
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.Mode().IsRegular() || !ok || int(st.Uid) != os.Geteuid() || info.Mode().Perm()&0077 != 0 {
+		os.Remove(t.path())
 		return false
 	}
 
+	// Check if the ticket is still valid
+	if time.Since(info.ModTime()) > timeout {
+		os.Remove(t.path())
+		return false
+	}
+
+	data, err := os.ReadFile(t.path())
+	if err != nil {
+		return false
+	}
+	lines := strings.Split(string(data), "\n")
+	// Tickets from before the user was recorded have five lines and are
+	// not reused
+	if len(lines) < 6 || lines[0] != fmt.Sprint(t.UID) || lines[1] != t.TTY ||
+		lines[2] != fmt.Sprint(t.SID) || lines[3] != t.SIDStart || lines[5] != user {
+		os.Remove(t.path())
+		return false
+	}
 	return true
 }
 
-func createSession() error {
-	os.MkdirAll(mixmagiskCache, 0755)
-	sessionFile := filepath.Join(mixmagiskCache, fmt.Sprintf("session_%d", os.Getuid()))
-
-	// Create session with timestamp
-	data := fmt.Sprintf("%d\n%s\n", os.Getuid(), time.Now().Format(time.RFC3339))
-	return os.WriteFile(sessionFile, []byte(data), 0600)
+func createSession(user string) error {
+	t := currentTicket()
+	if t == nil || sessionTimeout(user) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(mixmagiskCache, 0700); err != nil {
+		return err
+	}
+	t.CreatedAt = time.Now()
+	t.User = user
+	return os.WriteFile(t.path(), []byte(t.encode()), 0600)
 }
 
 func refreshSession() {
-	sessionFile := filepath.Join(mixmagiskCache, fmt.Sprintf("session_%d", os.Getuid()))
-	os.Chtimes(sessionFile, time.Now(), time.Now())
+	if t := currentTicket(); t != nil {
+		os.Chtimes(t.path(), time.Now(), time.Now())
+	}
+}
+
+// invalidateSession removes the ticket of the current terminal session (-k)
+func invalidateSession() {
+	if t := currentTicket(); t != nil {
+		os.Remove(t.path())
+	}
+}
+
+// invalidateAllSessions removes every ticket of the calling user (-K)
+func invalidateAllSessions() {
+	removeUserTickets(os.Getuid())
 }
 
 // ============================================================================
 // Command Execution
 // ============================================================================
 
-func executeAsRoot(args []string) {
-	user := os.Getenv("USER")
+// policyEvaluation is the result of checking a command against a policy
+type policyEvaluation struct {
+	Allowed bool
+	Path    string // resolved executable, "" if not found
+	Action  string // audit action: policy_allow, policy_deny, policy_time_deny or policy_error
+	Reason  string // deciding rule or the reason for denial
+
+	NoPasswd bool // matched a nopasswd rule, no authentication needed
+	NoPolicy bool // user has no policy file, so no rules apply
+}
+
+// evaluatePolicy checks the target identity and args against the user's
+// policy without side effects. Users admitted by group membership alone
+// have no rules.
+func evaluatePolicy(user string, target *runTarget, args []string) *policyEvaluation {
+	policy, err := loadUserPolicy(user)
+	if os.IsNotExist(err) {
+		path, _ := lookCommand(args[0], secureSearchPath)
+		return &policyEvaluation{Allowed: true, Path: path, Action: "policy_allow", Reason: "no policy file, no rules apply", NoPolicy: true}
+	}
+	if err != nil {
+		return &policyEvaluation{Action: "policy_error", Reason: "invalid policy: " + err.Error()}
+	}
+
+	conf, err := policy.confinement()
+	if err != nil {
+		return &policyEvaluation{Action: "policy_error", Reason: "invalid policy: " + err.Error()}
+	}
+	path, _ := lookJailedCommand(conf.root(), args[0], loadEnvPolicy(policy).path)
+	// A capability-scoped target is the caller, which run_as does not cover
+	if err := policy.allowsTarget(target); err != nil && len(target.Caps) == 0 {
+		return &policyEvaluation{Path: path, Action: "policy_deny", Reason: err.Error()}
+	}
+
+	window, err := policy.accessWindow()
+	if err != nil {
+		return &policyEvaluation{Path: path, Action: "policy_error", Reason: "invalid policy: " + err.Error()}
+	}
+	if window != nil && !window.contains(time.Now()) {
+		return &policyEvaluation{Path: path, Action: "policy_time_deny",
+			Reason: "outside the allowed time window (" + policy.describeAccessWindow() + ")"}
+	}
+
+	limits, err := policy.processLimits()
+	if err != nil {
+		return &policyEvaluation{Path: path, Action: "policy_error", Reason: "invalid policy: " + err.Error()}
+	}
+	if wd, _ := os.Getwd(); !limits.allowsCwd(wd) {
+		return &policyEvaluation{Path: path, Action: "policy_deny",
+			Reason: "working directory " + wd + " is not in allowed_cwd (" + strings.Join(limits.allowed, ", ") + ")"}
+	}
+
+	decision := policy.checkCommand(path, args)
+	ev := &policyEvaluation{Allowed: decision.Allowed, Path: path, Action: "policy_allow",
+		Reason: decision.String(), NoPasswd: decision.NoPasswd}
+	if !decision.Allowed {
+		ev.Action = "policy_deny"
+	}
+	return ev
+}
+
+// enforcePolicy evaluates the policy, reports a denial and logs the
+// deciding rule
+func enforcePolicy(user string, target *runTarget, args []string) *policyEvaluation {
+	ev := evaluatePolicy(user, target, args)
+	if ev.Action == "policy_error" {
+		printFailure(ev.Reason, "❌ "+ev.Reason)
+		logAction("policy_error", user, ev.Reason)
+		return ev
+	}
+	if ev.NoPolicy {
+		return ev
+	}
+
+	logCommand(ev.Action, user, target, args, ev.Reason)
+	switch {
+	case ev.Action == "policy_time_deny":
+		printFailure("elevation is not permitted at this time: "+ev.Reason,
+			"❌ Elevation is not permitted at this time", "   "+ev.Reason)
+	case !ev.Allowed:
+		printFailure("command not permitted by policy: "+ev.Reason,
+			"❌ Command not permitted by policy", "   "+ev.Reason)
+	}
+	return ev
+}
+
+// authorize checks that the user may run an allowed command: it matched
+// a nopasswd rule, a session ticket is valid, or the user authenticates.
+// ev may be nil when no policy evaluation applies.
+func authorize(user string, target *runTarget, args []string, ev *policyEvaluation) bool {
+	if ev != nil && ev.NoPasswd {
+		// No ticket is created: the exemption covers this command only
+		logCommand("auth_nopasswd", user, target, args, ev.Reason)
+		return true
+	}
+	if checkSession(user) {
+		refreshSession()
+		return true
+	}
+	if !authenticate(user) {
+		printFailure("authentication failed", "❌ Authentication failed")
+		logCommand("auth_failed", user, target, args, "")
+		return false
+	}
+	createSession(user)
+	return true
+}
+
+// lookupTarget resolves -u/-g, or the capability-scoped caller when the
+// policy sets capabilities, exiting on unknown names
+func lookupTarget(user string, opts *mixmagiskOptions) *runTarget {
+	target, err := resolveTarget(opts)
+	if err == nil {
+		target, err = scopeTarget(user, opts, target)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixmagisk: %v\n", err)
+		os.Exit(exitError)
+	}
+	return target
+}
+
+func executeCommand(opts *mixmagiskOptions, args []string) {
+	user := callerName()
+	target := lookupTarget(user, opts)
 
 	// Check access
 	if !checkRootAccess(user) {
-		fmt.Println("❌ Access denied")
-		fmt.Printf("   User '%s' is not authorized to use mixmagisk\n", user)
-		fmt.Println("   Contact system administrator for access")
-		logAction("denied", user, strings.Join(args, " "))
-		return
+		printFailure("user "+user+" is not authorized to use mixmagisk",
+			"❌ Access denied",
+			fmt.Sprintf("   User '%s' is not authorized to use mixmagisk", user),
+			"   Contact system administrator for access")
+		logCommand("denied", user, target, args, "not authorized")
+		os.Exit(exitDenied)
 	}
 
-	// Check/create session
-	if !checkSession() {
-		// Authenticate
-		if !authenticate(user) {
-			fmt.Println("❌ Authentication failed")
-			logAction("auth_failed", user, strings.Join(args, " "))
-			return
-		}
-		createSession()
-	} else {
-		refreshSession()
+	// Check the target and command against the user's policy
+	ev := enforcePolicy(user, target, args)
+	if !ev.Allowed {
+		os.Exit(ev.exitCode())
+	}
+	showBanner(user)
+	if !authorize(user, target, args, ev) {
+		os.Exit(exitAuthFailed)
+	}
+
+	if code := runAsTarget(user, target, args); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// runAsTarget runs args as target in the secure environment, logs the
+// result and returns the exit code (127 if the command was not found)
+func runAsTarget(user string, target *runTarget, args []string) int {
+	// The command is logged once it has finished, with its exit status
+	record := newAuditRecord("execute", user)
+	record.Target = target.String()
+	record.Argv = args
+
+	// Resolve the command in the secure PATH and drop the caller's environment
+	fail := func(code int, err error) int {
+		record.Result = "error"
+		record.Details = err.Error()
+		record.write()
+		printFailure(err.Error(), "Error: "+err.Error())
+		return code
+	}
+
+	conf, err := policyConfinement(user)
+	if err != nil {
+		return fail(exitError, err)
+	}
+	limits, err := policyProcessLimits(user)
+	if err != nil {
+		return fail(exitError, err)
+	}
+	env := commandEnv(user, target, args)
+	path, err := lookJailedCommand(conf.root(), args[0], envValue(env, "PATH"))
+	if err != nil {
+		return fail(exitNotFound, err)
 	}
+	record.Command = path
 
-	// Log the command
-	logAction("execute", user, strings.Join(args, " "))
+	profile, filter, err := policySeccomp(user, target)
+	if err != nil {
+		return fail(exitError, err)
+	}
+	if filter != nil && conf.root() != "" && !fileExists(filepath.Join(conf.root(), "proc/self/exe")) {
+		return fail(exitError, fmt.Errorf("seccomp inside chroot %s needs /proc mounted in it", conf.root()))
+	}
+	var details []string
+	if profile != "" {
+		details = append(details, "seccomp "+profile)
+	}
+	if conf != nil {
+		details = append(details, conf.String())
+	}
+	if s := limits.describe(); s != "" {
+		details = append(details, s)
+	}
+	record.Details = strings.Join(details, ", ")
 
-	// Execute command
-	cmd := exec.Command(args[0], args[1:]...)
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Args[0] = args[0]
+	cmd.Env = env
+	// Entered by the child after it has switched to the target identity
+	cmd.Dir = target.Dir
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	// Set UID to root
+	// Switch to the target identity
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid: 0,
-			Gid: 0,
-		},
+		Credential:  target.credential(),
+		AmbientCaps: target.Caps,
+	}
+	conf.apply(cmd)
+	restore, err := limits.apply(cmd)
+	if err != nil {
+		return fail(exitError, err)
 	}
 
-	if err := cmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitErr.ExitCode())
-		}
-		fmt.Printf("Error: %v\n", err)
-		os.Exit(1)
+	err = runSeccomp(cmd, filter)
+	restore()
+	if cmd.ProcessState == nil {
+		return fail(exitError, err)
 	}
+	code := record.setFinished(cmd.ProcessState)
+	record.write()
+	return code
 }
 
-func startRootShell() {
-	user := os.Getenv("USER")
+func startShell(opts *mixmagiskOptions) {
+	user := callerName()
+	target := lookupTarget(user, opts)
 
-	// Check access
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	// Check access. A restricted shell checks each command instead of
+	// the shell itself.
 	if !checkRootAccess(user) {
-		fmt.Println("❌ Access denied")
+		printFailure("user "+user+" is not authorized to use mixmagisk", "❌ Access denied")
+		os.Exit(exitDenied)
+	}
+	var ev *policyEvaluation
+	restricted := restrictedShellEnabled(user)
+	if !restricted {
+		if ev = enforcePolicy(user, target, []string{shell}); !ev.Allowed {
+			os.Exit(ev.exitCode())
+		}
+	}
+	showBanner(user)
+	if !authorize(user, target, []string{shell}, ev) {
+		os.Exit(exitAuthFailed)
+	}
+
+	if restricted {
+		logAction("shell", user, "Restricted shell as "+target.String())
+		runRestrictedShell(user, target)
 		return
 	}
 
-	// Authenticate
-	if !checkSession() {
-		if !authenticate(user) {
-			fmt.Println("❌ Authentication failed")
-			return
-		}
-		createSession()
+	profile, filter, err := policySeccomp(user, target)
+	var conf *confinement
+	if err == nil {
+		conf, err = policyConfinement(user)
+	}
+	if err == nil && conf.root() != "" {
+		_, err = lookJailedCommand(conf.root(), shell, "")
+	}
+	var limits *processLimits
+	if err == nil {
+		limits, err = policyProcessLimits(user)
+	}
+	if err != nil {
+		printFailure(err.Error(), "Error: "+err.Error())
+		logAction("shell_error", user, err.Error())
+		os.Exit(exitError)
 	}
 
 	// Log shell access
-	logAction("shell", user, "Interactive root shell")
+	details := "Interactive shell as " + target.String()
+	if profile != "" {
+		details += " (seccomp " + profile + ")"
+	}
+	if conf != nil {
+		details += " (" + conf.String() + ")"
+	}
+	if s := limits.describe(); s != "" {
+		details += " (" + s + ")"
+	}
+	var rec *sessionRecorder
+	if recordSessionsEnabled(user) {
+		if rec, err = newSessionRecorder(user, target, shell); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			logAction("shell_error", user, err.Error())
+			return
+		}
+		details += " (recorded " + rec.meta.ID + ")"
+	}
+	logAction("shell", user, details)
 
 	// Start shell
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/sh"
+	if target.isRoot() {
+		fmt.Println("🔐 Starting root shell...")
+	} else {
+		fmt.Printf("🔐 Starting shell as %s...\n", target.User)
 	}
-
-	fmt.Println("🔐 Starting root shell...")
 	fmt.Println("   Type 'exit' to return to normal user")
 	fmt.Println()
 
+	prompt := "PS1=\\[\\033[1;31m\\]root@\\h\\[\\033[0m\\]:\\w# "
+	if !target.isRoot() {
+		prompt = "PS1=\\[\\033[1;33m\\]" + target.User + "@\\h\\[\\033[0m\\]:\\w$ "
+	}
+
 	cmd := exec.Command(shell)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Env = append(os.Environ(),
-		"USER=root",
-		"HOME=/root",
-		"PS1=\\[\\033[1;31m\\]root@\\h\\[\\033[0m\\]:\\w# ",
-	)
+	cmd.Env = append(commandEnv(user, target, nil), "SHELL="+shell, prompt)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid: 0,
-			Gid: 0,
-		},
+		Credential:  target.credential(),
+		AmbientCaps: target.Caps,
+	}
+	conf.apply(cmd)
+	restore, err := limits.apply(cmd)
+	if err != nil {
+		printFailure(err.Error(), "Error: "+err.Error())
+		logAction("shell_error", user, err.Error())
+		os.Exit(exitError)
 	}
+	defer restore()
 
-	cmd.Run()
-	fmt.Println("🔓 Exited root shell")
+	if rec != nil {
+		err := runRecorded(cmd, filter, rec)
+		code := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "mixmagisk: %v\n", err)
+			code = 1
+		}
+		rec.finish(code)
+	} else {
+		runSeccomp(cmd, filter)
+	}
+	if target.isRoot() {
+		fmt.Println("🔓 Exited root shell")
+	} else {
+		fmt.Printf("🔓 Exited shell as %s\n", target.User)
+	}
 }
 
 // ============================================================================
 // Authentication
 // ============================================================================
 
+// maxAuthAttempts is how many passwords are accepted before giving up
+const maxAuthAttempts = 3
+
+// errNoTTY means the password came from a pipe, which cannot be re-prompted
+var errNoTTY = errors.New("no terminal")
+
 func authenticate(user string) bool {
-	// For now, simple password authentication
-	// In production, this would integrate with PAM or similar
+	// root gains nothing by authenticating
+	if os.Getuid() == 0 {
+		return true
+	}
 
-	fmt.Printf("[mixmagisk] Password for %s: ", user)
+	// Automation over SSH: prove possession of a trusted agent key
+	s := loadMixmagiskSettings()
+	methods := authenticators(s)
+	requireAll := s.str("auth", "require", "any") == "all"
 
-	// Read password (without echo)
-	password, err := readPassword()
-	if err != nil {
-		return false
+	// require_fido2 asks for the key after the other methods, unless they
+	// already all have to pass and include it
+	key := fido2Required(user) && !(requireAll && slices.ContainsFunc(methods, isFIDO2))
+	if key {
+		methods = slices.DeleteFunc(methods, isFIDO2)
 	}
 
-	// Verify password (simplified - in production use PAM)
-	return verifyPassword(user, password)
+	if identity, ok := authenticateSSH(user); ok {
+		logAction("auth_ssh", user, identity)
+	} else {
+		if !stdinPassword {
+			showLecture(user)
+		}
+		if (len(methods) > 0 || !key) && !runAuthenticators(user, methods, requireAll) {
+			return false
+		}
+		markLectured(user)
+	}
+	return !key || runAuthenticators(user, []Authenticator{newFIDO2Authenticator(s)}, true)
 }
 
-func readPassword() (string, error) {
-	// Simple password reading
-	// In production, use terminal raw mode to hide input
-	reader := bufio.NewReader(os.Stdin)
-	password, err := reader.ReadString('\n')
+// readPassword prompts for a password without echoing it. With -S the
+// first line of stdin is taken without a prompt. With -A, or
+// when stdin is not a terminal and an askpass program is configured, the
+// askpass program is asked instead. Otherwise, when stdin is not a
+// terminal the controlling terminal is used; without one a single line is
+// read from stdin and errNoTTY is returned alongside it.
+func readPassword(prompt string) (string, error) {
+	if stdinPassword {
+		// One line, one attempt: retrying would eat the command's input
+		line, err := readLine(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		return line, errNoTTY
+	}
+	fd := int(os.Stdin.Fd())
+	if program := askpassProgram(); program != "" && (askpassForced || !term.IsTerminal(fd)) {
+		return runAskpass(program, prompt)
+	}
+	if askpassForced {
+		return "", errors.New("no askpass program: set MIXMAGISK_ASKPASS or askpass in " + mixmagiskConfig)
+	}
+
+	out := os.Stderr
+	if !term.IsTerminal(fd) {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			fmt.Fprint(os.Stderr, prompt)
+			line, err := readLine(os.Stdin)
+			if err != nil {
+				fmt.Fprintln(os.Stderr)
+				return "", err
+			}
+			return line, errNoTTY
+		}
+		defer tty.Close()
+		fd = int(tty.Fd())
+		out = tty
+	}
+
+	// Restore echo if interrupted mid-prompt
+	state, err := term.GetState(fd)
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(password), nil
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-sigs:
+			term.Restore(fd, state)
+			fmt.Fprintln(out)
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	fmt.Fprint(out, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(out)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
 }
 
 func verifyPassword(user, password string) bool {
-	// Simplified verification
-	// In production, this would use PAM or shadow file
-
-	// For demo purposes, accept any non-empty password
-	// or check against a hash file
 	if password == "" {
 		return false
 	}
 
-	// Check hash file
-	hashFile := filepath.Join(mixmagiskConfig, user+".hash")
+	// PAM knows the real account database and lockout policy
+	ok, err := pamAuthenticate(user, password)
+	if err == nil {
+		return ok
+	}
+	if err != errPAMUnavailable {
+		logAction("auth_pam_error", user, err.Error())
+	}
+
+	// Without PAM: the system shadow file
+	ok, err = shadowAuthenticate(user, password)
+	if err == nil {
+		return ok
+	}
+	if err != errNoShadowEntry {
+		logAction("auth_shadow_error", user, err.Error())
+		return false
+	}
+
+	// Users without a shadow entry: mixmagisk hash file
+	hashFile := filepath.Join(mixmagiskHashes, user+".hash")
 	if data, err := os.ReadFile(hashFile); err == nil {
+		stored := strings.TrimSpace(string(data))
+		if strings.HasPrefix(stored, "$") {
+			ok, _ := shadow.Verify(password, stored)
+			return ok
+		}
 		hash := sha256.Sum256([]byte(password))
-		return hex.EncodeToString(hash[:]) == strings.TrimSpace(string(data))
+		return hex.EncodeToString(hash[:]) == stored
 	}
 
-	// Default: accept for demo
-	return true
+	return false
 }
 
 // ============================================================================
@@ -455,9 +1155,40 @@ func verifyPassword(user, password string) bool {
 // ============================================================================
 
 func logAction(action, user, details string) {
+	r := newAuditRecord(action, user)
+	r.Details = details
+	r.write()
+}
+
+// logCommand records an action concerning a command line
+func logCommand(action, user string, target *runTarget, argv []string, details string) {
+	r := newAuditRecord(action, user)
+	if target != nil {
+		r.Target = target.String()
+	}
+	r.Argv = argv
+	r.Details = details
+	r.write()
+}
+
+// appendAuditRecord links r to the previous record, seals it and appends
+// it to the audit log, rotating the log first when it is due
+func appendAuditRecord(r *auditRecord) {
 	// Ensure log directory exists
 	os.MkdirAll(filepath.Dir(mixmagiskLog), 0755)
 
+	if lock, err := lockAuditLog(); err == nil {
+		defer lock.Close()
+		maybeRotateAuditLog()
+	}
+
+	r.Prev = chainHead()
+	content, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	line, hash := sealAuditLine(content)
+
 	// Open log file
 	f, err := os.OpenFile(mixmagiskLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
 	if err != nil {
@@ -465,50 +1196,79 @@ func logAction(action, user, details string) {
 	}
 	defer f.Close()
 
-	// Write log entry
-	timestamp := time.Now().Format(time.RFC3339)
-	entry := fmt.Sprintf("%s [%s] user=%s action=%s details=\"%s\"\n",
-		timestamp, action, user, action, details)
-	f.WriteString(entry)
+	if _, err := f.Write(append(line, '\n')); err == nil {
+		os.WriteFile(auditHeadFile, []byte(hash+"\n"), 0640)
+	}
 }
 
-func showMixmagiskLog() {
-	f, err := os.Open(mixmagiskLog)
+func showMixmagiskLog(args []string) {
+	q, err := parseAuditQuery(args, time.Now())
 	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("No log entries yet")
-		} else {
-			fmt.Printf("Error reading log: %v\n", err)
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Usage: mixmagisk log [--user U] [--action A] [--since 2h] [--grep TEXT] [--limit N] [--page P] [--all] [--json]")
+		return
+	}
+	if os.Getuid() != 0 {
+		caller := callerName()
+		if q.user != "" && q.user != caller {
+			fmt.Println("Error: Must be root to read other users' log entries")
+			return
 		}
+		q.user = caller
+	}
+
+	all, err := readAuditRecords(q.all)
+	if err != nil {
+		fmt.Printf("Error reading log: %v\n", err)
+		return
+	}
+	var records []*auditRecord
+	for _, r := range all {
+		if q.matches(r) {
+			records = append(records, r)
+		}
+	}
+	page := q.paginate(records)
+
+	if q.json {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range page {
+			enc.Encode(r)
+		}
+		return
+	}
+
+	if len(all) == 0 {
+		fmt.Println("No log entries yet")
 		return
 	}
-	defer f.Close()
 
 	fmt.Println("╔══════════════════════════════════════════════════════════════╗")
 	fmt.Println("║     MixMagisk Audit Log                                      ║")
 	fmt.Println("╚══════════════════════════════════════════════════════════════╝")
 	fmt.Println()
 
-	// Read last 20 lines
-	lines := make([]string, 0)
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-		if len(lines) > 20 {
-			lines = lines[1:]
+	color := term.IsTerminal(int(os.Stdout.Fd()))
+	for _, r := range page {
+		code := "32" // Green
+		switch {
+		case r.Result == "denied" || r.Result == "error":
+			code = "31" // Red
+		case r.Action == "grant" || r.Action == "revoke" || r.Result == "failed":
+			code = "33" // Yellow
 		}
-	}
-
-	for _, line := range lines {
-		// Color code by action type
-		if strings.Contains(line, "[denied]") || strings.Contains(line, "[auth_failed]") {
-			fmt.Printf("\033[31m%s\033[0m\n", line) // Red
-		} else if strings.Contains(line, "[grant]") || strings.Contains(line, "[revoke]") {
-			fmt.Printf("\033[33m%s\033[0m\n", line) // Yellow
+		if color {
+			fmt.Printf("\033[%sm%s\033[0m\n", code, r.format())
 		} else {
-			fmt.Printf("\033[32m%s\033[0m\n", line) // Green
+			fmt.Println(r.format())
 		}
 	}
+
+	if q.limit > 0 && len(records) > q.limit {
+		pages := (len(records) + q.limit - 1) / q.limit
+		fmt.Printf("\nPage %d of %d (%d matching entries); older entries: --page %d\n",
+			q.page, pages, len(records), q.page+1)
+	}
 }
 
 // ============================================================================
@@ -558,7 +1318,8 @@ func showPolicies() {
 				for _, line := range lines {
 					if strings.HasPrefix(line, "allow_root") ||
 						strings.HasPrefix(line, "require_pin") ||
-						strings.HasPrefix(line, "timeout") {
+						strings.HasPrefix(line, "timeout") ||
+						strings.HasPrefix(line, "expires") {
 						fmt.Printf("     %s\n", strings.TrimSpace(line))
 					}
 				}
@@ -576,11 +1337,13 @@ func managePolicies(args []string) {
 
 	switch args[0] {
 	case "add":
-		if len(args) < 2 {
-			fmt.Println("Usage: mixmagisk policy add <user>")
+		user, duration, err := parseGrantArgs(args[1:])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			fmt.Println("Usage: mixmagisk policy add <user> [--duration 2h]")
 			return
 		}
-		grantRootAccess(args[1])
+		grantRootAccess(user, duration)
 
 	case "remove":
 		if len(args) < 2 {
@@ -594,6 +1357,14 @@ func managePolicies(args []string) {
 			showPolicies()
 			return
 		}
+		if args[1] == "--effective" {
+			if len(args) < 3 {
+				fmt.Println("Usage: mixmagisk policy show --effective <user>")
+				return
+			}
+			showEffectivePolicy(args[2])
+			return
+		}
 		showUserPolicy(args[1])
 
 	case "edit":
@@ -603,9 +1374,26 @@ func managePolicies(args []string) {
 		}
 		editPolicy(args[1])
 
+	case "check":
+		checkPolicies(args[1:])
+
+	case "digest":
+		if len(args) < 2 {
+			fmt.Println("Usage: mixmagisk policy digest <file...>")
+			return
+		}
+		showPolicyDigest(args[1:])
+
+	case "test":
+		if len(args) < 3 {
+			fmt.Println("Usage: mixmagisk policy test <user> [-u user] [-g group] -- <command...>")
+			return
+		}
+		simulatePolicy(args[1], args[2:])
+
 	default:
 		fmt.Printf("Unknown policy command: %s\n", args[0])
-		fmt.Println("Available: add, remove, show, edit")
+		fmt.Println("Available: add, remove, show, edit, check, digest, test")
 	}
 }
 
@@ -622,22 +1410,12 @@ func showUserPolicy(user string) {
 	}
 
 	fmt.Printf("Policy for %s:\n", user)
-	fmt.Println(string(content))
-}
-
-func editPolicy(user string) {
-	policyPath := filepath.Join(mixmagiskPolicy, user+".policy")
-
-	editor := os.Getenv("EDITOR")
-	if editor == "" {
-		editor = "vi"
+	if p, err := parsePolicy(strings.NewReader(string(content))); err == nil {
+		if t, ok := p.expiry(); ok {
+			fmt.Printf("Expires: %s\n", formatExpiry(t, time.Now()))
+		}
 	}
-
-	cmd := exec.Command(editor, policyPath)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Run()
+	fmt.Println(string(content))
 }
 
 // ============================================================================
@@ -647,46 +1425,69 @@ func editPolicy(user string) {
 // RunMixmagisk can be called directly for standalone binary
 func RunMixmagisk() {
 	// When run as standalone binary, parse args directly
-	args := os.Args[1:]
-
-	if len(args) == 0 {
-		showMixmagiskStatus()
-		return
-	}
-
-	switch args[0] {
-	case "--help", "-h":
-		fmt.Println("MixMagisk - MixOS Root Management System")
-		fmt.Println()
-		fmt.Println("Usage: mixmagisk [options] [command] [args...]")
-		fmt.Println()
-		fmt.Println("Options:")
-		fmt.Println("  -i, --interactive    Start interactive root shell")
-		fmt.Println("  -h, --help           Show this help")
-		fmt.Println("  -v, --version        Show version")
-		fmt.Println()
-		fmt.Println("Commands:")
-		fmt.Println("  status               Show mixmagisk status")
-		fmt.Println("  grant <user>         Grant root access")
-		fmt.Println("  revoke <user>        Revoke root access")
-		fmt.Println("  log                  Show audit log")
-		fmt.Println("  policy               Manage policies")
-		fmt.Println()
-		fmt.Println("Examples:")
-		fmt.Println("  mixmagisk ls -la /root")
-		fmt.Println("  mixmagisk -i")
-		fmt.Println("  mixmagisk grant john")
-
-	case "--version", "-v":
-		fmt.Printf("MixMagisk version %s\n", mixmagiskVersion)
-
-	case "-i", "--interactive":
-		startRootShell()
+	runMixmagisk(os.Args[1:])
+}
 
-	default:
-		// Execute as root command
-		executeAsRoot(args)
-	}
+func showMixmagiskHelp() {
+	fmt.Println("MixMagisk - MixOS Root Management System")
+	fmt.Println()
+	fmt.Println("Usage: mixmagisk [options] [command] [args...]")
+	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("  -u, --user <user>    Run as user (name or #uid, default root)")
+	fmt.Println("  -g, --group <group>  Run with primary group (name or #gid)")
+	fmt.Println("  -i, --interactive    Start interactive shell")
+	fmt.Println("  -A, --askpass        Ask for the password with $MIXMAGISK_ASKPASS")
+	fmt.Println("  -S, --stdin          Read the password from stdin, print only errors")
+	fmt.Println("  -k, --reset-timestamp")
+	fmt.Println("                       Forget this terminal's authentication")
+	fmt.Println("  -K, --remove-timestamp")
+	fmt.Println("                       Forget authentication on all terminals")
+	fmt.Println("  -h, --help           Show this help")
+	fmt.Println("  -v, --version        Show version")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  status               Show mixmagisk status")
+	fmt.Println("  doctor               Check the installation and suggest fixes")
+	fmt.Println("  broker               Serve unprivileged clients on " + brokerSocket + "")
+	fmt.Println("  grant <user> [--duration D]")
+	fmt.Println("                       Grant root access, for D (30m, 2h, 7d) if given")
+	fmt.Println("  revoke <user>        Revoke root access")
+	fmt.Println("  log [filters]        Show audit log (--user, --action, --since,")
+	fmt.Println("                       --grep, --limit, --page, --all, --json)")
+	fmt.Println("  log rotate           Rotate and compress the audit log")
+	fmt.Println("  log verify [file]    Check the audit log hash chain")
+	fmt.Println("  log export [--format cef|auditd|jsonl] [--since S]")
+	fmt.Println("                       Write the audit log in a SIEM format to stdout")
+	fmt.Println("  sessions             List active sessions (cached authentication)")
+	fmt.Println("  sessions kill <id> | --user <user>")
+	fmt.Println("                       End sessions so a password is needed again")
+	fmt.Println("  sessions list        List recorded shell sessions")
+	fmt.Println("  fido enroll <user> [--name N]")
+	fmt.Println("                       Register a FIDO2 security key for a user")
+	fmt.Println("  fido list [user]     List registered security keys")
+	fmt.Println("  fido remove <user> <name>")
+	fmt.Println("                       Unregister a security key")
+	fmt.Println("  replay <id>          Play back a recorded session (--speed,")
+	fmt.Println("                       --max-delay)")
+	fmt.Println("  policy               Manage policies")
+	fmt.Println("  policy check [user]  Validate policy files")
+	fmt.Println("  policy show --effective <user>")
+	fmt.Println("                       Show a policy merged with include.d")
+	fmt.Println("  policy digest <file> Print a sha256-pinned pattern for a command")
+	fmt.Println("  policy test <user> -- <command>")
+	fmt.Println("                       Show whether a command would be allowed")
+	fmt.Println()
+	fmt.Println("Exit status:")
+	fmt.Println("  the command's own status once it ran (128+N if killed by signal N),")
+	fmt.Println("  1 usage or internal error, 121 authentication failed, 122 not")
+	fmt.Println("  authorized or denied by policy, 123 invalid policy, 127 not found")
+	fmt.Println()
+	fmt.Println("Examples:")
+	fmt.Println("  mixmagisk ls -la /root")
+	fmt.Println("  mixmagisk -u postgres -g postgres psql -l")
+	fmt.Println("  mixmagisk -i")
+	fmt.Println("  mixmagisk grant john")
 }
 
 func init() {
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ============================================================================
+// Askpass Helpers
+// ============================================================================
+//
+// Like sudo -A, mixmagisk can ask an external program for the password so
+// that desktop tools and scripts without a terminal can request elevation.
+// The program comes from $MIXMAGISK_ASKPASS or askpass in the [general]
+// section of /etc/mixmagisk/config. It is used when -A/--askpass is given
+// or stdin is not a terminal; it receives the prompt as its only argument,
+// runs as the calling user and prints the password on stdout. A non-zero
+// exit status cancels authentication.
+
+// askpassForced is set by -A/--askpass
+var askpassForced bool
+
+// askpassProgram returns the configured askpass program, or ""
+func askpassProgram() string {
+	if program := os.Getenv("MIXMAGISK_ASKPASS"); program != "" {
+		return program
+	}
+	return loadMixmagiskSettings().str("general", "askpass", "")
+}
+
+// runAskpass runs program with prompt and returns the first line it
+// prints. The program never runs with mixmagisk's privileges.
+func runAskpass(program, prompt string) (string, error) {
+	if !filepath.IsAbs(program) {
+		return "", fmt.Errorf("askpass program %q must be an absolute path", program)
+	}
+
+	groups, err := os.Getgroups()
+	if err != nil {
+		return "", err
+	}
+	cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	for _, g := range groups {
+		cred.Groups = append(cred.Groups, uint32(g))
+	}
+
+	cmd := exec.Command(program, strings.TrimSpace(prompt))
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	out, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("password prompt cancelled")
+		}
+		return "", fmt.Errorf("askpass: %w", err)
+	}
+
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
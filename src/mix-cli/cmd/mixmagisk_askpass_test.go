@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunAskpass(t *testing.T) {
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	password, err := runAskpass(script("ok", `printf 'pa ss\r\nignored\n'; [ "$1" = "Password:" ]`), "Password: ")
+	if err != nil || password != "pa ss" {
+		t.Errorf("runAskpass = %q, %v; expected \"pa ss\"", password, err)
+	}
+	if _, err := runAskpass(script("cancel", "exit 1"), "Password:"); err == nil {
+		t.Error("runAskpass ignored a cancelled prompt")
+	}
+	if _, err := runAskpass("ok", "Password:"); err == nil {
+		t.Error("runAskpass accepted a relative program path")
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Write([]byte("s3cret\r\nline for the command\nlast"))
+	w.Close()
+
+	for _, want := range []string{"s3cret", "line for the command", "last"} {
+		if got, err := readLine(r); err != nil || got != want {
+			t.Errorf("readLine = %q, %v; want %q", got, err, want)
+		}
+	}
+	if _, err := readLine(r); err != io.EOF {
+		t.Errorf("readLine at end = %v, want EOF", err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, v := range vectors {
+		if got := totpCode(secret, uint64(v.unix/30)); got != v.code {
+			t.Errorf("totpCode(%d) = %s, want %s", v.unix, got, v.code)
+		}
+	}
+
+	encoded := base32.StdEncoding.EncodeToString(secret)
+	decoded, err := decodeTOTPSecret(" " + encoded[:8] + " " + encoded[8:] + "\n")
+	if err != nil || string(decoded) != string(secret) {
+		t.Errorf("decodeTOTPSecret = %q, %v", decoded, err)
+	}
+	if _, err := decodeTOTPSecret("not base32!"); err == nil {
+		t.Error("decodeTOTPSecret accepted garbage")
+	}
+
+	now := time.Unix(1111111109, 0)
+	step := uint64(1111111109 / 30)
+	if got, ok := verifyTOTP(secret, "081804", now, 0); !ok || got != step {
+		t.Errorf("current code: %d, %v", got, ok)
+	}
+	if _, ok := verifyTOTP(secret, totpCode(secret, step-1), now, 0); !ok {
+		t.Error("code of the previous step rejected")
+	}
+	if _, ok := verifyTOTP(secret, totpCode(secret, step-2), now, 0); ok {
+		t.Error("code two steps old accepted")
+	}
+	if _, ok := verifyTOTP(secret, "081804", now, step); ok {
+		t.Error("code accepted twice")
+	}
+	if _, ok := verifyTOTP(secret, "81804", now, 0); ok {
+		t.Error("short code accepted")
+	}
+}
+
+// fakeAuthenticator answers with a fixed result and counts its calls
+type fakeAuthenticator struct {
+	ok    bool
+	err   error
+	calls int
+}
+
+func (f *fakeAuthenticator) Name() string { return "fake" }
+
+func (f *fakeAuthenticator) Authenticate(string) (bool, error) {
+	f.calls++
+	return f.ok, f.err
+}
+
+func TestRunAuthenticators(t *testing.T) {
+	pass := func() *fakeAuthenticator { return &fakeAuthenticator{ok: true} }
+	fail := func() *fakeAuthenticator { return &fakeAuthenticator{} }
+	absent := func() *fakeAuthenticator { return &fakeAuthenticator{err: errAuthUnavailable} }
+	broken := func() *fakeAuthenticator { return &fakeAuthenticator{err: errors.New("device error")} }
+
+	tests := []struct {
+		name    string
+		methods []*fakeAuthenticator
+		all     bool
+		want    bool
+		calls   []int
+	}{
+		{"any: first passes", []*fakeAuthenticator{pass(), fail()}, false, true, []int{1, 0}},
+		{"any: falls back", []*fakeAuthenticator{fail(), pass()}, false, true, []int{1, 1}},
+		{"any: skips unavailable", []*fakeAuthenticator{absent(), pass()}, false, true, []int{1, 1}},
+		{"any: none apply", []*fakeAuthenticator{absent()}, false, false, []int{1}},
+		{"any: error stops", []*fakeAuthenticator{broken(), pass()}, false, false, []int{1, 0}},
+		{"all: every one passes", []*fakeAuthenticator{pass(), pass()}, true, true, []int{1, 1}},
+		{"all: one fails", []*fakeAuthenticator{fail(), pass()}, true, false, []int{1, 0}},
+		{"all: unavailable fails", []*fakeAuthenticator{pass(), absent()}, true, false, []int{1, 1}},
+		{"all: no methods", nil, true, false, nil},
+	}
+	for _, tt := range tests {
+		methods := make([]Authenticator, len(tt.methods))
+		for i, m := range tt.methods {
+			methods[i] = m
+		}
+		if got := runAuthenticators("alice", methods, tt.all); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for i, m := range tt.methods {
+			if m.calls != tt.calls[i] {
+				t.Errorf("%s: method %d called %d times, want %d", tt.name, i, m.calls, tt.calls[i])
+			}
+		}
+	}
+}
+
+func TestFIDO2Assertion(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xy := append(priv.PublicKey.X.FillBytes(make([]byte, 32)), priv.PublicKey.Y.FillBytes(make([]byte, 32))...)
+	pub, err := fido2PublicKey(xy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sign builds the CBOR encoded authenticator data libfido2 returns
+	cdh := bytes.Repeat([]byte{7}, 32)
+	sign := func(rpID string, flags byte, cdh []byte) *fido2Assertion {
+		rpHash := sha256.Sum256([]byte(rpID))
+		authData := append(rpHash[:], flags, 0, 0, 0, 42)
+		digest := sha256.Sum256(append(append([]byte{}, authData...), cdh...))
+		sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &fido2Assertion{AuthData: append([]byte{0x58, byte(len(authData))}, authData...), Signature: sig}
+	}
+
+	if err := verifyFIDO2Assertion(pub, "mixmagisk", cdh, sign("mixmagisk", 0x01, cdh)); err != nil {
+		t.Errorf("valid assertion rejected: %v", err)
+	}
+	tests := []struct {
+		name string
+		a    *fido2Assertion
+	}{
+		{"other relying party", sign("example.com", 0x01, cdh)},
+		{"not touched", sign("mixmagisk", 0x00, cdh)},
+		{"other challenge", sign("mixmagisk", 0x01, make([]byte, 32))},
+		{"not CBOR", &fido2Assertion{AuthData: []byte{1, 2, 3}}},
+	}
+	for _, tt := range tests {
+		if err := verifyFIDO2Assertion(pub, "mixmagisk", cdh, tt.a); err == nil {
+			t.Errorf("%s: assertion accepted", tt.name)
+		}
+	}
+
+	// Keys survive a round trip through the key file
+	dir := t.TempDir()
+	keys := []fido2Key{{Name: "yubikey", CredentialID: []byte{1, 2, 3}, PublicKey: pub, Enrolled: time.Unix(1700000000, 0)}}
+	if err := writeFIDO2Keys(dir, "alice", keys); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFIDO2Keys(dir, "alice")
+	if err != nil || len(got) != 1 || got[0].Name != "yubikey" || !bytes.Equal(got[0].PublicKey, pub) || !got[0].Enrolled.Equal(keys[0].Enrolled) {
+		t.Errorf("readFIDO2Keys = %+v, %v", got, err)
+	}
+	if got, err := readFIDO2Keys(dir, "bob"); got != nil || err != nil {
+		t.Errorf("no key file: got %v, %v", got, err)
+	}
+}
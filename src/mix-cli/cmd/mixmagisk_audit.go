@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// Audit Records
+// ============================================================================
+//
+// The audit log holds one hash-chained JSON object per line. Lines written before the
+// JSON format ("<time> [action] user=... details=...") are still shown by
+// "mixmagisk log" as they are.
+
+// auditRecord is one line of the audit log
+type auditRecord struct {
+	Time     time.Time  `json:"time"`
+	Action   string     `json:"action"`
+	User     string     `json:"user"`
+	UID      int        `json:"uid"`
+	TTY      string     `json:"tty,omitempty"`
+	Cwd      string     `json:"cwd,omitempty"`
+	Target   string     `json:"target,omitempty"` // user:group the command ran as
+	Command  string     `json:"command,omitempty"`
+	Argv     []string   `json:"argv,omitempty"`
+	Result   string     `json:"result"` // success, failed, denied or error
+	ExitCode *int       `json:"exit_code,omitempty"`
+	Signal   string     `json:"signal,omitempty"`   // signal that killed the command
+	Start    *time.Time `json:"start,omitempty"`    // when a finished command started; Time is its end
+	Duration float64    `json:"duration,omitempty"` // seconds the command ran
+	Details  string     `json:"details,omitempty"`
+
+	// Hash chain, see mixmagisk_auditchain.go; Hash is only filled in when
+	// reading a record back
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// newAuditRecord starts a record for action by user in the current
+// terminal and directory
+func newAuditRecord(action, user string) *auditRecord {
+	r := &auditRecord{
+		Time:   time.Now(),
+		Action: action,
+		User:   user,
+		UID:    os.Getuid(),
+		TTY:    currentTTY(),
+		Result: actionResult(action),
+	}
+	r.Cwd, _ = os.Getwd()
+	return r
+}
+
+// actionResult is the default result for an action name
+func actionResult(action string) string {
+	switch {
+	case action == "denied" || action == "auth_failed" || action == "auth_expired" || action == "auth_lockout" ||
+		strings.HasSuffix(action, "_deny") || strings.HasSuffix(action, "_denied"):
+		return "denied"
+	case strings.HasSuffix(action, "_error"):
+		return "error"
+	}
+	return "success"
+}
+
+// setExit records the exit status of the command
+func (r *auditRecord) setExit(code int) {
+	r.ExitCode = &code
+	if code != 0 {
+		r.Result = "failed"
+	}
+}
+
+// setFinished records how a command that started at r.Time ended and
+// returns its exit status, 128 plus the signal number when it was killed
+func (r *auditRecord) setFinished(state *os.ProcessState) int {
+	start := r.Time
+	r.Time = time.Now()
+	r.Start = &start
+	r.Duration = r.Time.Sub(start).Round(time.Millisecond).Seconds()
+
+	code := state.ExitCode()
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		r.Signal = unix.SignalName(ws.Signal())
+		code = 128 + int(ws.Signal())
+	}
+	r.setExit(code)
+	return code
+}
+
+// write appends the record to the audit log, forwards it to the system
+// log and sends notifications when configured
+func (r *auditRecord) write() {
+	appendAuditRecord(r)
+	forwardAuditRecord(r)
+	notifyAuditRecord(r)
+}
+
+// parseAuditLine decodes a JSON audit line; ok is false for legacy lines
+func parseAuditLine(line string) (*auditRecord, bool) {
+	if !strings.HasPrefix(line, "{") {
+		return nil, false
+	}
+	var r auditRecord
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		return nil, false
+	}
+	return &r, true
+}
+
+// format renders the record as one human-readable line
+func (r *auditRecord) format() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %-8s %-14s", r.Time.Local().Format("2006-01-02 15:04:05"), r.User, r.Action)
+	if r.TTY != "" {
+		fmt.Fprintf(&b, " %s", strings.TrimPrefix(r.TTY, "/dev/"))
+	}
+	if r.Target != "" {
+		fmt.Fprintf(&b, " as %s", r.Target)
+	}
+	if len(r.Argv) > 0 {
+		fmt.Fprintf(&b, ": %s", strings.Join(r.Argv, " "))
+	}
+	if r.ExitCode != nil {
+		status := fmt.Sprintf("exit %d", *r.ExitCode)
+		if r.Signal != "" {
+			status = "killed by " + r.Signal
+		}
+		if r.Start != nil {
+			status += " after " + formatRunTime(r.Duration)
+		}
+		fmt.Fprintf(&b, " (%s)", status)
+	}
+	if r.Details != "" {
+		fmt.Fprintf(&b, " - %s", r.Details)
+	}
+	return b.String()
+}
+
+// formatRunTime renders seconds as a duration, to the second from a
+// minute up
+func formatRunTime(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+	if d >= time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return d.Round(time.Millisecond).String()
+}
@@ -0,0 +1,332 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyAuditChain(t *testing.T) {
+	var lines []string
+	prev := ""
+	for i, action := range []string{"grant", "execute", "denied", "execute"} {
+		r := &auditRecord{Time: time.Unix(int64(1700000000+i), 0).UTC(), Action: action, User: "alice", Prev: prev}
+		content, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, hash := sealAuditLine(content)
+		lines = append(lines, string(line))
+		prev = hash
+	}
+	legacy := `2024-01-01T00:00:00Z [grant] user=alice action=grant details="Root access granted"`
+
+	check := func(name string, log []string, wantProblems int) *chainReport {
+		t.Helper()
+		report, err := verifyAuditChain(strings.NewReader(strings.Join(log, "\n") + "\n"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(report.Problems) != wantProblems {
+			t.Errorf("%s: %d problems %v, expected %d", name, len(report.Problems), report.Problems, wantProblems)
+		}
+		return report
+	}
+
+	report := check("intact", append([]string{legacy}, lines...), 0)
+	if report.Sealed != 4 || report.Legacy != 1 || report.Last != prev {
+		t.Errorf("intact: unexpected report %+v", report)
+	}
+
+	modified := append([]string{}, lines...)
+	modified[1] = strings.Replace(modified[1], `"execute"`, `"status"`, 1)
+	if r := check("modified", modified, 1); r.Problems[0].Line != 2 {
+		t.Errorf("modified: reported line %d, expected 2", r.Problems[0].Line)
+	}
+
+	removed := append(append([]string{}, lines[:1]...), lines[2:]...)
+	if r := check("removed", removed, 1); r.Problems[0].Line != 2 {
+		t.Errorf("removed: reported line %d, expected 2", r.Problems[0].Line)
+	}
+
+	if r := check("truncated", lines[:3], 0); r.Last == prev {
+		t.Error("truncated: last hash should differ from the head")
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	q, err := parseAuditQuery([]string{"--user", "alice", "--action", "denied", "--since", "2h", "--grep", "rm "}, now)
+	if err != nil {
+		t.Fatalf("parseAuditQuery failed: %v", err)
+	}
+
+	tests := []struct {
+		r        auditRecord
+		expected bool
+	}{
+		{auditRecord{User: "alice", Action: "policy_deny", Result: "denied", Time: now.Add(-time.Hour), Argv: []string{"rm", "-rf", "/"}}, true},
+		{auditRecord{User: "bob", Action: "policy_deny", Result: "denied", Time: now.Add(-time.Hour), Argv: []string{"rm", "-rf", "/"}}, false},
+		{auditRecord{User: "alice", Action: "execute", Result: "success", Time: now.Add(-time.Hour), Argv: []string{"rm", "-rf", "/tmp/x"}}, false},
+		{auditRecord{User: "alice", Action: "denied", Result: "denied", Time: now.Add(-3 * time.Hour), Argv: []string{"rm", "x"}}, false},
+		{auditRecord{User: "alice", Action: "denied", Result: "denied", Time: now, Argv: []string{"ls"}}, false},
+	}
+	for i, tt := range tests {
+		if got := q.matches(&tt.r); got != tt.expected {
+			t.Errorf("record %d: matches = %v, expected %v", i, got, tt.expected)
+		}
+	}
+
+	records := make([]*auditRecord, 45)
+	q = &auditQuery{limit: 20, page: 3}
+	if page := q.paginate(records); len(page) != 5 {
+		t.Errorf("page 3 of 45 entries has %d entries, expected 5", len(page))
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	r := &auditRecord{Action: "auth_lockout", User: "alice", Result: "denied", Details: "3 incorrect password attempts"}
+	payload, _ := json.Marshal(r)
+
+	var received auditRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	if err := postNotification(context.Background(), server.URL, payload); err != nil {
+		t.Fatalf("postNotification failed: %v", err)
+	}
+	if received.Action != "auth_lockout" || received.User != "alice" {
+		t.Errorf("webhook received %+v", received)
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "alert")
+	os.WriteFile(script, []byte("#!/bin/sh\n{ echo \"$MIXMAGISK_ACTION $MIXMAGISK_USER\"; cat; } > "+out+"\n"), 0755)
+	if err := execNotification(context.Background(), script, r, payload); err != nil {
+		t.Fatalf("execNotification failed: %v", err)
+	}
+	data, _ := os.ReadFile(out)
+	first, rest, _ := strings.Cut(string(data), "\n")
+	if first != "auth_lockout alice" || rest != string(payload) {
+		t.Errorf("program received %q", data)
+	}
+
+	slow := filepath.Join(dir, "slow")
+	os.WriteFile(slow, []byte("#!/bin/sh\nexec sleep 10\n"), 0755)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := execNotification(ctx, slow, r, payload); err == nil {
+		t.Error("execNotification ignored the timeout")
+	}
+}
+
+func TestSessionRecorder(t *testing.T) {
+	dir := t.TempDir()
+	r := &sessionRecorder{dir: dir, last: time.Now(), meta: sessionMeta{ID: "s1", User: "alice"}}
+	for name, f := range map[string]**os.File{"typescript": &r.out, "input": &r.in, "timing": &r.timing} {
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		*f = file
+	}
+
+	r.write('O', []byte("$ "))
+	r.write('I', []byte("id\r"))
+	r.write('O', []byte("uid=0(root)\r\n"))
+	r.finish(3)
+
+	read := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+	if got := read("typescript"); got != "$ uid=0(root)\r\n" {
+		t.Errorf("typescript = %q", got)
+	}
+	if got := read("input"); got != "id\r" {
+		t.Errorf("input = %q", got)
+	}
+
+	lines := strings.Split(strings.TrimSpace(read("timing")), "\n")
+	want := []string{"O 2", "I 3", "O 13"}
+	if len(lines) != len(want) {
+		t.Fatalf("timing = %q", lines)
+	}
+	for i, line := range lines {
+		f := strings.Fields(line)
+		if len(f) != 3 || f[0]+" "+f[2] != want[i] {
+			t.Errorf("timing line %d = %q, want %q", i, line, want[i])
+		}
+	}
+
+	var meta sessionMeta
+	if err := json.Unmarshal([]byte(read("meta.json")), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.ExitCode == nil || *meta.ExitCode != 3 || meta.End.IsZero() {
+		t.Errorf("meta = %+v", meta)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	typescript := "$ id\r\nuid=0(root)\r\n$ exit\r\n"
+	timing := "O 0.5 2\nI 1.0 3\nO 0.5 4\nO 30 13\nI 2 5\nO 0 8\n"
+
+	tests := []struct {
+		name string
+		opts replayOptions
+		want []time.Duration
+	}{
+		{"real time", replayOptions{speed: 1}, []time.Duration{500 * time.Millisecond, 1500 * time.Millisecond, 30 * time.Second, 2 * time.Second}},
+		{"double speed", replayOptions{speed: 2}, []time.Duration{250 * time.Millisecond, 750 * time.Millisecond, 15 * time.Second, time.Second}},
+		{"max delay", replayOptions{speed: 1, maxDelay: time.Second}, []time.Duration{500 * time.Millisecond, time.Second, time.Second, time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			var slept []time.Duration
+			err := replay(&out, strings.NewReader(typescript), strings.NewReader(timing), tt.opts,
+				func(d time.Duration) { slept = append(slept, d) })
+			if err != nil {
+				t.Fatalf("replay failed: %v", err)
+			}
+			if out.String() != typescript {
+				t.Errorf("output = %q", out.String())
+			}
+			if fmt.Sprint(slept) != fmt.Sprint(tt.want) {
+				t.Errorf("slept %v, want %v", slept, tt.want)
+			}
+		})
+	}
+
+	if err := replay(io.Discard, strings.NewReader(""), strings.NewReader("O x 2\n"), replayOptions{speed: 1}, func(time.Duration) {}); err == nil {
+		t.Error("malformed timing accepted")
+	}
+}
+
+func TestAuditSetFinished(t *testing.T) {
+	tests := []struct {
+		script string
+		code   int
+		signal string
+		format string
+	}{
+		{"exit 0", 0, "", "(exit 0 after "},
+		{"exit 3", 3, "", "(exit 3 after "},
+		{"kill -KILL $$", 137, "SIGKILL", "(killed by SIGKILL after "},
+	}
+	for _, tt := range tests {
+		r := newAuditRecord("execute", "alice")
+		started := r.Time
+		cmd := exec.Command("/bin/sh", "-c", tt.script)
+		cmd.Run()
+		if code := r.setFinished(cmd.ProcessState); code != tt.code || r.Signal != tt.signal {
+			t.Errorf("%s: code %d signal %q, want %d %q", tt.script, code, r.Signal, tt.code, tt.signal)
+		}
+		if r.Start == nil || !r.Start.Equal(started) || r.Time.Before(started) {
+			t.Errorf("%s: start %v, time %v", tt.script, r.Start, r.Time)
+		}
+		if !strings.Contains(r.format(), tt.format) {
+			t.Errorf("%s: format() = %q", tt.script, r.format())
+		}
+	}
+
+	for seconds, want := range map[float64]string{0.0015: "2ms", 12.3456: "12.346s", 3723.4: "1h2m3s"} {
+		if got := formatRunTime(seconds); got != want {
+			t.Errorf("formatRunTime(%v) = %q, want %q", seconds, got, want)
+		}
+	}
+}
+
+func TestReadTicket(t *testing.T) {
+	pid := os.Getpid()
+	ticket := &sessionTicket{UID: 1000, TTY: "/dev/pts/3", SID: pid, SIDStart: processStartTime(pid),
+		CreatedAt: time.Now().Add(-time.Hour).Truncate(time.Second)}
+	path := filepath.Join(t.TempDir(), "ticket_1000_pts-3_"+fmt.Sprint(pid))
+	os.WriteFile(path, []byte(ticket.encode()), 0600)
+
+	got, err := readTicket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "1000_pts-3_"+fmt.Sprint(pid) || got.UID != 1000 || got.TTY != "/dev/pts/3" ||
+		got.SID != pid || !got.CreatedAt.Equal(ticket.CreatedAt) {
+		t.Errorf("readTicket = %+v, want %+v", got, ticket)
+	}
+
+	if s := got.state(5 * time.Minute); s != "active" {
+		t.Errorf("fresh ticket is %s", s)
+	}
+	if s := got.state(0); s != "expired" {
+		t.Errorf("ticket with timeout 0 is %s", s)
+	}
+	old := time.Now().Add(-10 * time.Minute)
+	os.Chtimes(path, old, old)
+	if got, _ = readTicket(path); got.state(5*time.Minute) != "expired" {
+		t.Errorf("idle ticket is %s", got.state(5*time.Minute))
+	}
+	got.SIDStart = "1"
+	if s := got.state(time.Hour); s != "ended" {
+		t.Errorf("ticket of a reused pid is %s", s)
+	}
+
+	os.WriteFile(path, []byte("1000\n/dev/pts/3\n"), 0600)
+	if _, err := readTicket(path); err == nil {
+		t.Error("readTicket accepted a truncated ticket")
+	}
+}
+
+func TestLogExport(t *testing.T) {
+	code := 1
+	start := time.UnixMilli(1700000000000).UTC()
+	r := &auditRecord{Time: start.Add(1500 * time.Millisecond), Action: "execute", User: "alice", UID: 1000,
+		TTY: "/dev/pts/3", Cwd: "/home/alice", Target: "root:root", Command: "/usr/bin/grep",
+		Argv: []string{"grep", "a=b|c", `C:\x`}, Result: "failed", ExitCode: &code, Start: &start}
+
+	cef := formatCEF(r, "mixos")
+	for _, want := range []string{
+		"CEF:0|MixOS|mixmagisk|" + mixmagiskVersion + "|execute|execute|5|",
+		"rt=1700000001500 ", "suser=alice ", "duser=root ", `cs1=grep a\=b|c C:\\x `, "cs2=/dev/pts/3 ", "cn1=1 ",
+	} {
+		if !strings.Contains(cef, want) {
+			t.Errorf("CEF line %q lacks %q", cef, want)
+		}
+	}
+
+	want := `type=USER_CMD msg=audit(1700000001.500:7): uid=1000 msg='op="execute" acct="alice" target="root:root" ` +
+		`cwd="/home/alice" cmd=6772657020613D627C6320433A5C78 exe="/usr/bin/grep" exit=1 terminal=pts/3 res=failed'`
+	if got := formatAuditd(r, 7); got != want {
+		t.Errorf("auditd line:\n got %s\nwant %s", got, want)
+	}
+
+	for action, want := range map[string]string{"policy_deny": "USER_ACCT", "auth_lockout": "USER_AUTH",
+		"grant": "USER_MGMT", "shell": "USER_CMD", "log_rotate": "TRUSTED_APP"} {
+		if got := auditdType(action); got != want {
+			t.Errorf("auditdType(%s) = %s, want %s", action, got, want)
+		}
+	}
+
+	if _, err := parseExportArgs([]string{"--format", "xml"}, time.Now()); err == nil {
+		t.Error("unknown format accepted")
+	}
+	q, err := parseExportArgs([]string{"--format", "cef", "--since", "2h", "--user", "alice"}, start)
+	if err != nil || q.format != "cef" || !q.since.Equal(start.Add(-2*time.Hour)) || !q.matches(r) {
+		t.Errorf("parseExportArgs = %+v, %v", q, err)
+	}
+}
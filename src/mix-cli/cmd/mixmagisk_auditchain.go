@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ============================================================================
+// Audit Log Hash Chain
+// ============================================================================
+//
+// Every JSON record carries "prev", the hash of the record before it, and
+// ends with "hash", the SHA-256 of the record's own JSON without the hash
+// field. Editing a record breaks its hash, and deleting or reordering
+// records breaks the prev link of the next one. The newest hash is kept in
+// mixmagisk.log.head so that truncating the end of the log is detected
+// too. The chain continues across rotation.
+
+const auditHeadFile = mixmagiskLog + ".head"
+
+// auditHashSuffix matches the hash field that seals a record
+var auditHashSuffix = regexp.MustCompile(`,"hash":"([0-9a-f]{64})"}$`)
+
+// sealAuditLine appends the hash field to a marshalled record
+func sealAuditLine(content []byte) ([]byte, string) {
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	line := append(bytes.TrimSuffix(content, []byte("}")), []byte(`,"hash":"`+hash+`"}`)...)
+	return line, hash
+}
+
+// splitAuditLine separates a sealed line into the hashed content and the
+// stored hash
+func splitAuditLine(line string) (content []byte, hash string, ok bool) {
+	m := auditHashSuffix.FindStringSubmatchIndex(line)
+	if m == nil {
+		return nil, "", false
+	}
+	return []byte(line[:m[0]] + "}"), line[m[2]:m[3]], true
+}
+
+// chainHead returns the hash of the newest record: from the head file, or
+// from the last sealed line of the log if the head file is missing
+func chainHead() string {
+	if data, err := os.ReadFile(auditHeadFile); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	f, err := os.Open(mixmagiskLog)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if _, hash, ok := splitAuditLine(scanner.Text()); ok {
+			head = hash
+		}
+	}
+	return head
+}
+
+// chainProblem is the first inconsistency found in a log
+type chainProblem struct {
+	Line    int
+	Message string
+}
+
+// chainReport summarizes a verified log
+type chainReport struct {
+	Sealed   int    // records with a hash
+	Legacy   int    // lines written before hashing was introduced
+	First    string // prev of the first sealed record
+	Last     string // hash of the last sealed record
+	Problems []chainProblem
+}
+
+// verifyAuditChain walks the records in r and checks every hash and link
+func verifyAuditChain(r io.Reader) (*chainReport, error) {
+	report := &chainReport{}
+	prev, started := "", false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		content, hash, ok := splitAuditLine(line)
+		if !ok {
+			if started {
+				report.Problems = append(report.Problems, chainProblem{lineNo, "unsealed entry inside the chain (inserted?)"})
+			} else {
+				report.Legacy++
+			}
+			continue
+		}
+
+		rec, ok := parseAuditLine(line)
+		if !ok {
+			report.Problems = append(report.Problems, chainProblem{lineNo, "entry is not valid JSON"})
+			continue
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != hash {
+			report.Problems = append(report.Problems, chainProblem{lineNo, "entry was modified (hash mismatch)"})
+		}
+		if !started {
+			report.First = rec.Prev
+			started = true
+		} else if rec.Prev != prev {
+			report.Problems = append(report.Problems, chainProblem{lineNo, "chain broken: previous entry removed or reordered"})
+		}
+		prev = hash
+		report.Sealed++
+	}
+	report.Last = prev
+	return report, scanner.Err()
+}
+
+// lastAuditHash returns the hash of the last record in a rotated log
+func lastAuditHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	report, err := verifyAuditChain(r)
+	if err != nil {
+		return "", err
+	}
+	return report.Last, nil
+}
+
+// verifyAuditLogCmd implements "mixmagisk log verify [file]"
+func verifyAuditLogCmd(args []string) {
+	path := mixmagiskLog
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Error reading log: %v\n", err)
+		os.Exit(1)
+	}
+	report, err := verifyAuditChain(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("Error reading log: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Verified %d sealed entries in %s\n", report.Sealed, path)
+	if report.Legacy > 0 {
+		fmt.Printf("  %d older entries predate hashing and cannot be verified\n", report.Legacy)
+	}
+
+	problems := report.Problems
+	if path == mixmagiskLog {
+		// The chain must continue from the newest rotated log ...
+		if report.First != "" {
+			for _, rotated := range []string{rotatedLogName(path, 1, true), rotatedLogName(path, 1, false)} {
+				if last, err := lastAuditHash(rotated); err == nil {
+					if last != report.First {
+						problems = append(problems, chainProblem{1, "does not continue from " + rotated})
+					}
+					break
+				}
+			}
+		}
+		// ... and end at the recorded head
+		if data, err := os.ReadFile(auditHeadFile); err == nil {
+			if head := strings.TrimSpace(string(data)); head != report.Last {
+				problems = append(problems, chainProblem{0, "log ends before the last recorded entry (truncated)"})
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("✅ Audit log chain intact")
+		return
+	}
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Printf("❌ line %d: %s\n", p.Line, p.Message)
+		} else {
+			fmt.Printf("❌ %s\n", p.Message)
+		}
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mixos-go/src/mix-cli/pkg/shadow"
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// Authentication Backends
+// ============================================================================
+//
+// Passwords are checked against PAM when mix was built with the "pam" tag
+// and /etc/pam.d/mixmagisk exists; otherwise against /etc/shadow, and only
+// for users without a shadow entry against the per-user hash file in
+// mixmagiskConfig. Anything else is denied.
+
+const (
+	mixmagiskPAMService = "mixmagisk"
+	mixmagiskPAMConfig  = "/etc/pam.d/mixmagisk"
+	shadowFile          = "/etc/shadow"
+)
+
+// errPAMUnavailable means PAM support is not built in or not configured
+var errPAMUnavailable = errors.New("PAM not available")
+
+// errNoShadowEntry means the shadow file is unreadable or has no entry for
+// the user
+var errNoShadowEntry = errors.New("no shadow entry")
+
+// shadowAuthenticate checks password against the user's /etc/shadow entry,
+// refusing locked and expired accounts
+func shadowAuthenticate(user, password string) (bool, error) {
+	entry, err := shadow.Lookup(shadowFile, user)
+	if err != nil {
+		return false, errNoShadowEntry
+	}
+	if entry.Expired(time.Now()) {
+		logAction("auth_expired", user, "account or password expired")
+		return false, nil
+	}
+	ok, err := shadow.Verify(password, entry.Hash)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", user, err)
+	}
+	return ok, nil
+}
+
+// currentTTY returns the controlling terminal of the calling process, or
+// "" when it has none. Redirecting stdin does not change the answer.
+func currentTTY() string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", callerPID))
+	if err != nil || callerGone() {
+		return ""
+	}
+	// Fields after the command name: state ppid pgrp session tty_nr ...
+	i := strings.LastIndexByte(string(data), ')')
+	fields := strings.Fields(string(data)[i+1:])
+	if i < 0 || len(fields) < 5 {
+		return ""
+	}
+	nr, err := strconv.ParseUint(fields[4], 10, 32)
+	if err != nil || nr == 0 {
+		return ""
+	}
+
+	// Prefer the name the terminal is open under
+	for fd := 0; fd <= 2; fd++ {
+		path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+		if err != nil || !strings.HasPrefix(path, "/dev/") {
+			continue
+		}
+		var st unix.Stat_t
+		if unix.Stat(path, &st) == nil && st.Mode&unix.S_IFMT == unix.S_IFCHR && st.Rdev == nr {
+			return path
+		}
+	}
+	major, minor := unix.Major(nr), unix.Minor(nr)
+	switch {
+	case major >= 136 && major <= 143:
+		return fmt.Sprintf("/dev/pts/%d", (major-136)*256+minor)
+	case major == 4 && minor < 64:
+		return fmt.Sprintf("/dev/tty%d", minor)
+	case major == 4:
+		return fmt.Sprintf("/dev/ttyS%d", minor-64)
+	case major == 5 && minor == 1:
+		return "/dev/console"
+	}
+	return fmt.Sprintf("/dev/char/%d:%d", major, minor)
+}
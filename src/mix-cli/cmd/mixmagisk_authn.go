@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// Authentication Methods
+// ============================================================================
+//
+// How a user proves who they are is chosen in the [auth] section of
+// /etc/mixmagisk/config:
+//
+//	[auth]
+//	methods = totp, password
+//	require = any
+//	totp_dir = /etc/mixmagisk/totp
+//	command = /usr/local/libexec/sso-check --realm corp
+//	command_timeout = 60
+//
+// With require = any the methods are tried in order until one succeeds;
+// with require = all each of them must succeed, for multi-factor
+// authentication. A method that does not apply to the user (no TOTP
+// secret enrolled, say) is skipped with any and fails with all.
+//
+// password asks for the account password (PAM, /etc/shadow, hash file).
+// totp asks for an RFC 6238 code from the base32 secret in
+// totp_dir/<user>. command runs a site program as root with the user name
+// as its last argument and MIXMAGISK_USER/MIXMAGISK_TTY set; it may talk
+// to the user on the terminal and exits 0 to accept, 2 when it does not
+// apply to the user and anything else to refuse. fido2 asks for a touch of
+// a registered security key (see mixmagisk_fido2.go).
+
+// Authenticator is one way for a user to prove their identity
+type Authenticator interface {
+	// Name is the method name used in the config
+	Name() string
+	// Authenticate challenges user. errAuthUnavailable means the method
+	// cannot be used for this user.
+	Authenticate(user string) (bool, error)
+}
+
+// errAuthUnavailable means an authentication method does not apply
+var errAuthUnavailable = errors.New("not available for this user")
+
+// authenticators returns the configured methods in order
+func authenticators(s *mixmagiskSettings) []Authenticator {
+	var methods []Authenticator
+	for _, name := range strings.Split(s.str("auth", "methods", "password"), ",") {
+		switch strings.TrimSpace(name) {
+		case "password":
+			methods = append(methods, passwordAuthenticator{})
+		case "totp":
+			methods = append(methods, totpAuthenticator{dir: s.str("auth", "totp_dir", totpSecretDir)})
+		case "fido2":
+			methods = append(methods, newFIDO2Authenticator(s))
+		case "command":
+			methods = append(methods, &commandAuthenticator{
+				command: strings.Fields(s.str("auth", "command", "")),
+				timeout: time.Duration(s.integer("auth", "command_timeout", 60)) * time.Second,
+			})
+		default:
+			fmt.Fprintf(os.Stderr, "mixmagisk: unknown authentication method %q\n", name)
+		}
+	}
+	return methods
+}
+
+// runAuthenticators authenticates user with methods, requiring all of them
+// or any one
+func runAuthenticators(user string, methods []Authenticator, requireAll bool) bool {
+	passed := 0
+	for _, m := range methods {
+		ok, err := m.Authenticate(user)
+		switch {
+		case errors.Is(err, errAuthUnavailable):
+			if requireAll {
+				fmt.Fprintf(os.Stderr, "mixmagisk: %s: %v\n", m.Name(), err)
+				return false
+			}
+			continue
+		case err != nil:
+			// Cancelled or broken: do not fall back to another method
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "mixmagisk: %s: %v\n", m.Name(), err)
+			}
+			return false
+		}
+		if ok {
+			passed++
+			if !requireAll {
+				return true
+			}
+		} else if requireAll {
+			return false
+		}
+	}
+	return requireAll && passed > 0
+}
+
+// askRepeatedly prompts up to maxAuthAttempts times until check accepts
+// the answer, slowing down after each mistake. Without a terminal only
+// one answer is read.
+func askRepeatedly(user, prompt, what string, check func(string) bool) (bool, error) {
+	for attempt := 1; attempt <= maxAuthAttempts; attempt++ {
+		answer, err := readPassword(prompt)
+		if err != nil && err != errNoTTY {
+			return false, err
+		}
+		if check(answer) {
+			return true, nil
+		}
+		if err == errNoTTY {
+			break
+		}
+		if attempt == maxAuthAttempts {
+			logAction("auth_lockout", user, fmt.Sprintf("%d incorrect %s attempts", maxAuthAttempts, what))
+			break
+		}
+
+		// Slow down guessing: 1s, 2s, ...
+		time.Sleep(time.Duration(attempt) * time.Second)
+		fmt.Fprintln(os.Stderr, "Sorry, try again.")
+	}
+	return false, nil
+}
+
+// passwordAuthenticator asks for the account password
+type passwordAuthenticator struct{}
+
+func (passwordAuthenticator) Name() string { return "password" }
+
+func (passwordAuthenticator) Authenticate(user string) (bool, error) {
+	return askRepeatedly(user, fmt.Sprintf("[mixmagisk] Password for %s: ", user), "password",
+		func(password string) bool { return verifyPassword(user, password) })
+}
+
+// totpSecretDir holds one base32 TOTP secret per user, readable by root
+const totpSecretDir = "/etc/mixmagisk/totp"
+
+// totpAuthenticator asks for a time-based one-time code
+type totpAuthenticator struct {
+	dir string
+}
+
+func (totpAuthenticator) Name() string { return "totp" }
+
+func (a totpAuthenticator) Authenticate(user string) (bool, error) {
+	if strings.ContainsRune(user, '/') {
+		return false, errAuthUnavailable
+	}
+	data, err := os.ReadFile(filepath.Join(a.dir, user))
+	if os.IsNotExist(err) {
+		return false, errAuthUnavailable
+	}
+	if err != nil {
+		return false, err
+	}
+	secret, err := decodeTOTPSecret(string(data))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", filepath.Join(a.dir, user), err)
+	}
+
+	// A code is accepted once: remember the last time step used
+	usedFile := filepath.Join(mixmagiskCache, "totp_"+user)
+	var last uint64
+	if data, err := os.ReadFile(usedFile); err == nil {
+		last, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+
+	return askRepeatedly(user, fmt.Sprintf("[mixmagisk] Verification code for %s: ", user), "verification code",
+		func(code string) bool {
+			step, ok := verifyTOTP(secret, code, time.Now(), last)
+			if ok && os.MkdirAll(mixmagiskCache, 0700) == nil {
+				os.WriteFile(usedFile, []byte(strconv.FormatUint(step, 10)+"\n"), 0600)
+			}
+			return ok
+		})
+}
+
+// decodeTOTPSecret decodes a base32 secret, ignoring case, spaces and
+// padding
+func decodeTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("invalid base32 TOTP secret")
+	}
+	return secret, nil
+}
+
+// totpCode computes the 6-digit code for a 30 second time step
+func totpCode(secret []byte, step uint64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// verifyTOTP checks code against the time steps around now, allowing one
+// step of clock drift, and never accepts a step at or before last
+func verifyTOTP(secret []byte, code string, now time.Time, last uint64) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		return 0, false
+	}
+	current := uint64(now.Unix() / 30)
+	for _, step := range []uint64{current - 1, current, current + 1} {
+		if step <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// commandAuthenticator delegates to a site program
+type commandAuthenticator struct {
+	command []string
+	timeout time.Duration
+}
+
+func (*commandAuthenticator) Name() string { return "command" }
+
+func (a *commandAuthenticator) Authenticate(user string) (bool, error) {
+	if len(a.command) == 0 {
+		return false, errors.New("command is not set in [auth]")
+	}
+	if !filepath.IsAbs(a.command[0]) {
+		return false, fmt.Errorf("command %q must be an absolute path", a.command[0])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, a.command[0], append(a.command[1:], user)...)
+	// The user may answer on the terminal; stdout is kept for the command
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if os.Geteuid() == 0 {
+		// Run as full root so that the user cannot tamper with it
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{}}
+	}
+	cmd.Env = []string{
+		"PATH=" + secureSearchPath,
+		"MIXMAGISK_USER=" + user,
+		"MIXMAGISK_TTY=" + currentTTY(),
+	}
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case ctx.Err() != nil:
+		return false, fmt.Errorf("timed out after %s", a.timeout)
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 2:
+		return false, errAuthUnavailable
+	case errors.As(err, &exitErr):
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,464 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// Privileged Broker
+// ============================================================================
+//
+// Instead of installing mix setuid root, "mixmagisk broker" can run as a
+// root daemon started at boot. It listens on brokerSocket; an
+// unprivileged mixmagisk passes its arguments, environment and standard
+// streams over the socket and relays signals until the broker reports the
+// exit status.
+//
+// The broker learns who is asking from the socket's peer credentials, not
+// from anything the client says, and serves each request in a fresh
+// process (brokerServeCmd) whose real uid and gid are the caller's and
+// whose effective uid is 0, the same identity a setuid run has. USER and
+// LOGNAME are set from the peer's uid, the working directory and terminal
+// are taken from the calling process. Policy evaluation, authentication
+// and logging then happen exactly as they do with the setuid binary.
+//
+// A shell started through the broker has no controlling terminal, so it
+// runs without job control.
+
+const (
+	brokerSocket   = "/run/mixmagisk.sock"
+	brokerServeCmd = "__broker-serve"
+
+	// brokerMaxRequest bounds a request: arguments plus environment
+	brokerMaxRequest = 1 << 20
+)
+
+// callerPID is the process mixmagisk acts for: this process, or the
+// client when serving a broker request
+var callerPID = os.Getpid()
+
+// callerStart is the start time of callerPID when the broker took the
+// request, or "" when mixmagisk acts for itself
+var callerStart string
+
+// callerGone reports whether callerPID has exited since the broker took
+// the request, so that the pid may now be another process's. Check it
+// after anything read from /proc/<callerPID>.
+func callerGone() bool {
+	return callerStart != "" && processStartTime(callerPID) != callerStart
+}
+
+// callerName returns the name of the user mixmagisk acts for, from the
+// real uid: the setuid bit and the broker both leave the caller's uid
+// there. $USER is the caller's to set and never says who they are.
+func callerName() string {
+	u, err := user.LookupId(strconv.Itoa(os.Getuid()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixmagisk: unknown uid %d\n", os.Getuid())
+		os.Exit(exitError)
+	}
+	return u.Username
+}
+
+// brokerRequest is what a client sends, along with its stdin, stdout and
+// stderr as SCM_RIGHTS
+type brokerRequest struct {
+	Args []string `json:"args"`
+	Env  []string `json:"env"`
+}
+
+// useBroker reports whether this mixmagisk should hand its work to the
+// broker: it lacks the privileges to do it itself and a broker runs
+func useBroker() bool {
+	if os.Geteuid() == 0 {
+		return false
+	}
+	info, err := os.Stat(brokerSocket)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
+
+// brokerRelayed are the signals a client may pass on: those a terminal
+// sends, and SIGTERM
+var brokerRelayed = map[syscall.Signal]bool{
+	syscall.SIGINT:   true,
+	syscall.SIGQUIT:  true,
+	syscall.SIGTERM:  true,
+	syscall.SIGHUP:   true,
+	syscall.SIGWINCH: true,
+}
+
+// brokerRunning reports whether a broker accepts connections
+func brokerRunning() bool {
+	conn, err := net.Dial("unix", brokerSocket)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// runBrokerClient sends args to the broker and returns the exit status
+func runBrokerClient(args []string) (int, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: brokerSocket, Net: "unix"})
+	if err != nil {
+		return 0, fmt.Errorf("cannot reach the broker: %w", err)
+	}
+	defer conn.Close()
+
+	payload, err := json.Marshal(brokerRequest{Args: args, Env: os.Environ()})
+	if err != nil {
+		return 0, err
+	}
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	msg = append(msg, payload...)
+	rights := unix.UnixRights(int(os.Stdin.Fd()), int(os.Stdout.Fd()), int(os.Stderr.Fd()))
+	if _, _, err := conn.WriteMsgUnix(msg, rights, nil); err != nil {
+		return 0, fmt.Errorf("broker: %w", err)
+	}
+
+	// Keyboard signals reach this process, not the command: pass them on
+	sigs := make(chan os.Signal, 8)
+	for sig := range brokerRelayed {
+		signal.Notify(sigs, sig)
+	}
+	defer signal.Stop(sigs)
+	go func() {
+		for sig := range sigs {
+			conn.Write([]byte{byte(sig.(syscall.Signal))})
+		}
+	}()
+
+	var status [4]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return 0, errors.New("the broker closed the connection")
+	}
+	return int(binary.BigEndian.Uint32(status[:])), nil
+}
+
+// readBrokerRequest reads a request and the three descriptors sent with it
+func readBrokerRequest(conn *net.UnixConn) (*brokerRequest, []*os.File, error) {
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, unix.CmsgSpace(3*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []*os.File
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err == nil {
+		for _, m := range msgs {
+			fds, err := unix.ParseUnixRights(&m)
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "client"))
+			}
+		}
+	}
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	if len(files) != 3 {
+		closeAll()
+		return nil, nil, fmt.Errorf("expected 3 descriptors, got %d", len(files))
+	}
+
+	if n < 4 {
+		closeAll()
+		return nil, nil, errors.New("short request")
+	}
+	size := int(binary.BigEndian.Uint32(buf[:4]))
+	if size > brokerMaxRequest {
+		closeAll()
+		return nil, nil, fmt.Errorf("request of %d bytes is too large", size)
+	}
+	data := append([]byte(nil), buf[4:n]...)
+	if len(data) < size {
+		rest := make([]byte, size-len(data))
+		if _, err := io.ReadFull(conn, rest); err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		data = append(data, rest...)
+	}
+
+	req := &brokerRequest{}
+	if err := json.Unmarshal(data[:size], req); err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return req, files, nil
+}
+
+// brokerEnv is the client's environment with the identity variables set
+// from the peer credentials
+func brokerEnv(env []string, name string) []string {
+	var out []string
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "USER=") && !strings.HasPrefix(kv, "LOGNAME=") {
+			out = append(out, kv)
+		}
+	}
+	return append(out, "USER="+name, "LOGNAME="+name)
+}
+
+// serveBrokerConn handles one client connection
+func serveBrokerConn(conn *net.UnixConn) {
+	defer conn.Close()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var cred *unix.Ucred
+	var groups []int
+	pidfd := -1
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+		if err == nil {
+			groups, err = peerGroups(int(fd))
+		}
+		if err == nil {
+			pidfd, err = peerPidfd(int(fd), int(cred.Pid))
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixmagisk broker: peer credentials: %v\n", err)
+		return
+	}
+	defer unix.Close(pidfd)
+
+	req, files, err := readBrokerRequest(conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixmagisk broker: pid %d: %v\n", cred.Pid, err)
+		return
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	status := func(code int) {
+		conn.Write(binary.BigEndian.AppendUint32(nil, uint32(code)))
+	}
+	u, err := user.LookupId(strconv.Itoa(int(cred.Uid)))
+	if err != nil {
+		fmt.Fprintf(files[2], "mixmagisk: unknown uid %d\n", cred.Uid)
+		status(exitError)
+		return
+	}
+
+	// The pid is only trusted while the pidfd shows the client alive: once
+	// it exits, the pid may be reused and /proc would describe another
+	// process. The start time lets the serving process check it again.
+	start := processStartTime(int(cred.Pid))
+	dir := "/"
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", cred.Pid)); err == nil {
+		dir = cwd
+	}
+	if start == "" || unix.PidfdSendSignal(pidfd, 0, nil, 0) != nil {
+		fmt.Fprintf(os.Stderr, "mixmagisk broker: pid %d exited before its request was served\n", cred.Pid)
+		status(exitError)
+		return
+	}
+
+	cmd := exec.Command("/proc/self/exe", append([]string{"mixmagisk", brokerServeCmd,
+		strconv.Itoa(int(cred.Pid)), start, strconv.Itoa(int(cred.Uid)), strconv.Itoa(int(cred.Gid)),
+		formatGroups(groups)}, req.Args...)...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = brokerEnv(req.Env, u.Username)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = files[0], files[1], files[2]
+	cmd.Dir = dir
+	// Its own process group, so that relayed signals reach the command too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(files[2], "mixmagisk: broker: %v\n", err)
+		status(exitError)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				select {
+				case <-done:
+				default:
+					// The client is gone, as if its terminal hung up
+					unix.Kill(-cmd.Process.Pid, unix.SIGHUP)
+				}
+				return
+			}
+			if sig := syscall.Signal(buf[0]); brokerRelayed[sig] {
+				unix.Kill(-cmd.Process.Pid, sig)
+			}
+		}
+	}()
+
+	cmd.Wait()
+	close(done)
+	code := cmd.ProcessState.ExitCode()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		code = 128 + int(ws.Signal())
+	}
+	status(code)
+}
+
+// runBroker implements "mixmagisk broker"
+func runBroker() {
+	if os.Getuid() != 0 || os.Geteuid() != 0 {
+		fmt.Println("Error: Must be root to run the broker")
+		os.Exit(exitError)
+	}
+
+	// A socket left behind by a broker that died is replaced
+	if brokerRunning() {
+		fmt.Fprintf(os.Stderr, "mixmagisk broker: already running on %s\n", brokerSocket)
+		os.Exit(exitError)
+	}
+	os.Remove(brokerSocket)
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: brokerSocket, Net: "unix"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mixmagisk broker: %v\n", err)
+		os.Exit(exitError)
+	}
+	// Anyone may ask; the peer credentials say who is asking
+	if err := os.Chmod(brokerSocket, 0666); err != nil {
+		fmt.Fprintf(os.Stderr, "mixmagisk broker: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+	signal.Ignore(syscall.SIGHUP, syscall.SIGPIPE)
+
+	fmt.Fprintf(os.Stderr, "mixmagisk broker: listening on %s\n", brokerSocket)
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "mixmagisk broker: %v\n", err)
+			continue
+		}
+		go serveBrokerConn(conn)
+	}
+}
+
+// runBrokerServe takes on the caller's identity and runs their request:
+// mixmagisk __broker-serve <pid> <start> <uid> <gid> <groups> <args...>
+func runBrokerServe(args []string) {
+	fail := func(format string, a ...any) {
+		fmt.Fprintf(os.Stderr, "mixmagisk: "+format+"\n", a...)
+		os.Exit(exitError)
+	}
+	// Started by a user rather than by the broker
+	if os.Getuid() != 0 || os.Geteuid() != 0 || len(args) < 5 {
+		fail("unknown command %s", brokerServeCmd)
+	}
+	pid, err1 := strconv.Atoi(args[0])
+	uid, err2 := strconv.Atoi(args[2])
+	gid, err3 := strconv.Atoi(args[3])
+	groups, err4 := parseGroups(args[4])
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		fail("%s: %v", brokerServeCmd, err)
+	}
+	// Real ids of the caller, effective uid 0: what the setuid bit gives
+	if err := syscall.Setgroups(groups); err != nil {
+		fail("broker: setgroups: %v", err)
+	}
+	if err := syscall.Setresgid(gid, gid, gid); err != nil {
+		fail("broker: setresgid: %v", err)
+	}
+	if err := syscall.Setresuid(uid, 0, 0); err != nil {
+		fail("broker: setresuid: %v", err)
+	}
+
+	callerPID, callerStart = pid, args[1]
+	runMixmagisk(args[5:])
+	os.Exit(0)
+}
+
+// peerGroups returns the supplementary groups the client had when it
+// connected, as SO_PEERGROUPS records them
+func peerGroups(fd int) ([]int, error) {
+	buf := make([]uint32, 64)
+	for {
+		size := uint32(len(buf) * 4)
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_PEERGROUPS,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+		if errno == unix.ERANGE && int(size/4) > len(buf) {
+			buf = make([]uint32, size/4)
+			continue
+		}
+		if errno != 0 {
+			return nil, fmt.Errorf("SO_PEERGROUPS: %w", errno)
+		}
+		groups := make([]int, size/4)
+		for i := range groups {
+			groups[i] = int(buf[i])
+		}
+		return groups, nil
+	}
+}
+
+// peerPidfd returns a pidfd for the client. SO_PEERPIDFD (Linux 6.5) names
+// the process that connected; older kernels open one for its pid.
+func peerPidfd(fd, pid int) (int, error) {
+	if pidfd, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PEERPIDFD); err == nil {
+		return pidfd, nil
+	}
+	return unix.PidfdOpen(pid, 0)
+}
+
+// formatGroups and parseGroups pass group ids to __broker-serve as one
+// comma-separated argument
+func formatGroups(groups []int) string {
+	ids := make([]string, len(groups))
+	for i, g := range groups {
+		ids[i] = strconv.Itoa(g)
+	}
+	return strings.Join(ids, ",")
+}
+
+func parseGroups(s string) ([]int, error) {
+	var groups []int
+	for _, f := range strings.Split(s, ",") {
+		if f == "" {
+			continue
+		}
+		g, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// unixPair returns both ends of a connected unix stream socket
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := func(fd int) *net.UnixConn {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		defer f.Close()
+		c, err := net.FileConn(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c.(*net.UnixConn)
+	}
+	return conn(fds[0]), conn(fds[1])
+}
+
+func TestReadBrokerRequest(t *testing.T) {
+	send := func(client *net.UnixConn, req brokerRequest, fds []int) {
+		payload, _ := json.Marshal(req)
+		msg := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+		msg = append(msg, payload...)
+		var rights []byte
+		if len(fds) > 0 {
+			rights = unix.UnixRights(fds...)
+		}
+		go client.WriteMsgUnix(msg, rights, nil)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// A request larger than the first read, as a long environment makes it
+	client, server := unixPair(t)
+	want := brokerRequest{Args: []string{"-u", "postgres", "psql"}, Env: []string{"TERM=xterm", "BIG=" + strings.Repeat("x", 100000)}}
+	send(client, want, []int{int(r.Fd()), int(w.Fd()), int(w.Fd())})
+	req, files, err := readBrokerRequest(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(req.Args, want.Args) || !slices.Equal(req.Env, want.Env) {
+		t.Errorf("request = %q, %d variables", req.Args, len(req.Env))
+	}
+	if len(files) != 3 {
+		t.Fatalf("got %d files", len(files))
+	}
+	files[1].Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := r.Read(buf); err != nil || string(buf) != "hi" {
+		t.Errorf("passed stdout does not reach the pipe: %q, %v", buf, err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+
+	// Without the standard streams the request is refused
+	client, server = unixPair(t)
+	send(client, want, nil)
+	if _, _, err := readBrokerRequest(server); err == nil {
+		t.Error("request without descriptors accepted")
+	}
+}
+
+func TestBrokerIdentity(t *testing.T) {
+	env := brokerEnv([]string{"USER=root", "HOME=/home/alice", "LOGNAME=root", "TERM=xterm"}, "alice")
+	want := []string{"HOME=/home/alice", "TERM=xterm", "USER=alice", "LOGNAME=alice"}
+	if !slices.Equal(env, want) {
+		t.Errorf("brokerEnv = %q, want %q", env, want)
+	}
+
+	_, server := unixPair(t)
+	raw, _ := server.SyscallConn()
+	var groups []int
+	var pidfd int
+	var err error
+	raw.Control(func(fd uintptr) {
+		if groups, err = peerGroups(int(fd)); err == nil {
+			pidfd, err = peerPidfd(int(fd), os.Getpid())
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(pidfd)
+	own, _ := os.Getgroups()
+	slices.Sort(groups)
+	slices.Sort(own)
+	if !slices.Equal(groups, own) {
+		t.Errorf("peerGroups = %v, want %v", groups, own)
+	}
+	if err := unix.PidfdSendSignal(pidfd, 0, nil, 0); err != nil {
+		t.Errorf("pidfd of a live peer: %v", err)
+	}
+
+	for _, g := range [][]int{nil, {0}, {4, 24, 1000}} {
+		got, err := parseGroups(formatGroups(g))
+		if err != nil || !slices.Equal(got, g) {
+			t.Errorf("parseGroups(formatGroups(%v)) = %v, %v", g, got, err)
+		}
+	}
+	if _, err := parseGroups("4,x"); err == nil {
+		t.Error("parseGroups(\"4,x\") succeeded")
+	}
+
+	// A pid whose start time changed belongs to another process
+	defer func(start string) { callerStart = start }(callerStart)
+	for _, tt := range []struct {
+		start string
+		gone  bool
+	}{
+		{"", false},
+		{processStartTime(os.Getpid()), false},
+		{"1", true},
+	} {
+		callerStart = tt.start
+		if got := callerGone(); got != tt.gone {
+			t.Errorf("callerGone() with start %q = %v", tt.start, got)
+		}
+	}
+}
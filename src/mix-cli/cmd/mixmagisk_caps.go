@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// Capability-Scoped Elevation
+// ============================================================================
+//
+// A policy with
+//
+//	capabilities = cap_net_admin, cap_net_raw
+//
+// runs commands as the calling user with only those capabilities raised
+// as ambient capabilities, instead of as root. Selecting a target with -u
+// or -g bypasses this and runs with the target's full identity, subject
+// to run_as as usual.
+
+// linuxCapabilities maps capability names, without the cap_ prefix, to
+// their numbers
+var linuxCapabilities = map[string]uintptr{
+	"chown":              unix.CAP_CHOWN,
+	"dac_override":       unix.CAP_DAC_OVERRIDE,
+	"dac_read_search":    unix.CAP_DAC_READ_SEARCH,
+	"fowner":             unix.CAP_FOWNER,
+	"fsetid":             unix.CAP_FSETID,
+	"kill":               unix.CAP_KILL,
+	"setgid":             unix.CAP_SETGID,
+	"setuid":             unix.CAP_SETUID,
+	"setpcap":            unix.CAP_SETPCAP,
+	"linux_immutable":    unix.CAP_LINUX_IMMUTABLE,
+	"net_bind_service":   unix.CAP_NET_BIND_SERVICE,
+	"net_broadcast":      unix.CAP_NET_BROADCAST,
+	"net_admin":          unix.CAP_NET_ADMIN,
+	"net_raw":            unix.CAP_NET_RAW,
+	"ipc_lock":           unix.CAP_IPC_LOCK,
+	"ipc_owner":          unix.CAP_IPC_OWNER,
+	"sys_module":         unix.CAP_SYS_MODULE,
+	"sys_rawio":          unix.CAP_SYS_RAWIO,
+	"sys_chroot":         unix.CAP_SYS_CHROOT,
+	"sys_ptrace":         unix.CAP_SYS_PTRACE,
+	"sys_pacct":          unix.CAP_SYS_PACCT,
+	"sys_admin":          unix.CAP_SYS_ADMIN,
+	"sys_boot":           unix.CAP_SYS_BOOT,
+	"sys_nice":           unix.CAP_SYS_NICE,
+	"sys_resource":       unix.CAP_SYS_RESOURCE,
+	"sys_time":           unix.CAP_SYS_TIME,
+	"sys_tty_config":     unix.CAP_SYS_TTY_CONFIG,
+	"mknod":              unix.CAP_MKNOD,
+	"lease":              unix.CAP_LEASE,
+	"audit_write":        unix.CAP_AUDIT_WRITE,
+	"audit_control":      unix.CAP_AUDIT_CONTROL,
+	"setfcap":            unix.CAP_SETFCAP,
+	"mac_override":       unix.CAP_MAC_OVERRIDE,
+	"mac_admin":          unix.CAP_MAC_ADMIN,
+	"syslog":             unix.CAP_SYSLOG,
+	"wake_alarm":         unix.CAP_WAKE_ALARM,
+	"block_suspend":      unix.CAP_BLOCK_SUSPEND,
+	"audit_read":         unix.CAP_AUDIT_READ,
+	"perfmon":            unix.CAP_PERFMON,
+	"bpf":                unix.CAP_BPF,
+	"checkpoint_restore": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// parseCapabilities parses a comma-separated capability list. Names are
+// case-insensitive and the cap_ prefix is optional. The canonical names
+// are returned sorted.
+func parseCapabilities(list []string) ([]uintptr, []string, error) {
+	seen := make(map[string]bool)
+	var names []string
+	for _, item := range list {
+		name := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(item)), "cap_")
+		if _, ok := linuxCapabilities[name]; !ok {
+			return nil, nil, fmt.Errorf("unknown capability %q", item)
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	caps := make([]uintptr, len(names))
+	for i, name := range names {
+		caps[i] = linuxCapabilities[name]
+		names[i] = "cap_" + name
+	}
+	return caps, names, nil
+}
+
+func validateCapabilities(v string) error {
+	_, _, err := parseCapabilities(strings.Split(v, ","))
+	return err
+}
+
+// scopeTarget replaces the default root target with the calling user
+// plus ambient capabilities when the user's policy sets capabilities.
+// An explicit -u or -g target is returned unchanged.
+func scopeTarget(user string, opts *mixmagiskOptions, target *runTarget) (*runTarget, error) {
+	if opts.hasTarget() {
+		return target, nil
+	}
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return target, nil
+	}
+	list := policy.values("capabilities")
+	if len(list) == 0 {
+		return target, nil
+	}
+	caps, names, err := parseCapabilities(list)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", policy.Path, err)
+	}
+
+	self, err := resolveTarget(&mixmagiskOptions{User: user})
+	if err != nil {
+		return nil, err
+	}
+	self.Caps = caps
+	self.capNames = names
+	return self, nil
+}
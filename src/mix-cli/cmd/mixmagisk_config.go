@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Global Configuration
+// ============================================================================
+//
+// /etc/mixmagisk/config uses the same INI format as policy files. Missing
+// or unreadable configuration falls back to the built-in defaults.
+
+// mixmagiskSettings is the parsed global configuration
+type mixmagiskSettings struct {
+	file *policyFile
+}
+
+// loadMixmagiskSettings reads mixmagiskConfig when it is a regular file
+func loadMixmagiskSettings() *mixmagiskSettings {
+	s := &mixmagiskSettings{file: &policyFile{}}
+	f, err := os.Open(mixmagiskConfig)
+	if err != nil {
+		return s
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return s
+	}
+	if p, err := parsePolicy(f); err == nil {
+		p.Path = mixmagiskConfig
+		s.file = p
+	}
+	return s
+}
+
+// lookup returns the value of key in section
+func (s *mixmagiskSettings) lookup(section, key string) (string, bool) {
+	value, found := "", false
+	for _, e := range s.file.Entries {
+		if e.Section == section && e.Key == key {
+			value, found = e.Value, true
+		}
+	}
+	return value, found
+}
+
+// str returns a string setting
+func (s *mixmagiskSettings) str(section, key, def string) string {
+	if v, ok := s.lookup(section, key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// integer returns a non-negative integer setting
+func (s *mixmagiskSettings) integer(section, key string, def int) int {
+	if v, ok := s.lookup(section, key); ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// boolean returns a yes/no setting
+func (s *mixmagiskSettings) boolean(section, key string, def bool) bool {
+	v, ok := s.lookup(section, key)
+	if !ok {
+		return def
+	}
+	switch strings.ToLower(v) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0":
+		return false
+	}
+	return def
+}
+
+// sizeMB returns a size setting such as "10M" in megabytes
+func (s *mixmagiskSettings) sizeMB(section, key string, def int64) int64 {
+	if v, ok := s.lookup(section, key); ok {
+		if n, err := parseSizeMB(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// ============================================================================
+// Namespace and Chroot Confinement
+// ============================================================================
+//
+//	confine = mount, net
+//	chroot = /srv/jail
+//
+// confine runs elevated commands in new namespaces: mount (private mount
+// table), net (loopback only), ipc, uts, pid and cgroup. chroot runs them
+// with the given directory as "/"; commands are looked up in the secure
+// PATH inside it and start in its root directory. The jail must be owned
+// by root and not writable by others, like sshd's ChrootDirectory.
+
+// namespaceFlags maps confine names to clone flags. pid needs a fresh
+// process (clone); the others are unshared so that a new mount namespace
+// is made private before the command starts.
+var namespaceFlags = map[string]struct {
+	flag  uintptr
+	clone bool
+}{
+	"mount":  {syscall.CLONE_NEWNS, false},
+	"net":    {syscall.CLONE_NEWNET, false},
+	"ipc":    {syscall.CLONE_NEWIPC, false},
+	"uts":    {syscall.CLONE_NEWUTS, false},
+	"pid":    {syscall.CLONE_NEWPID, true},
+	"cgroup": {syscall.CLONE_NEWCGROUP, false},
+}
+
+// confinement is the namespace and chroot setup of a policy
+type confinement struct {
+	namespaces   []string
+	cloneflags   uintptr
+	unshareflags uintptr
+	chroot       string
+}
+
+// confinement parses the confine and chroot keys; it returns nil when the
+// policy sets neither
+func (p *policyFile) confinement() (*confinement, error) {
+	c := &confinement{}
+	for _, name := range p.values("confine") {
+		name = strings.ToLower(name)
+		if name == "mnt" {
+			name = "mount"
+		}
+		ns, ok := namespaceFlags[name]
+		if !ok {
+			return nil, fmt.Errorf("confine: unknown namespace %q", name)
+		}
+		if ns.clone {
+			c.cloneflags |= ns.flag
+		} else {
+			c.unshareflags |= ns.flag
+		}
+		c.namespaces = append(c.namespaces, name)
+	}
+	sort.Strings(c.namespaces)
+
+	if root, ok := p.get("chroot"); ok && root != "" {
+		if err := checkJail(root); err != nil {
+			return nil, fmt.Errorf("chroot: %w", err)
+		}
+		c.chroot = root
+	}
+	if len(c.namespaces) == 0 && c.chroot == "" {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// checkJail verifies that a chroot directory is safe to use
+func checkJail(root string) error {
+	if !filepath.IsAbs(root) {
+		return fmt.Errorf("%s is not an absolute path", root)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by group or others", root)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		return fmt.Errorf("%s is not owned by root", root)
+	}
+	return nil
+}
+
+func validateConfine(v string) error {
+	_, err := (&policyFile{Entries: []policyEntry{{Key: "confine", Value: v}}}).confinement()
+	return err
+}
+
+func validateChroot(v string) error {
+	return checkJail(v)
+}
+
+// policyConfinement returns the confinement of user's policy, or nil
+func policyConfinement(user string) (*confinement, error) {
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return nil, nil
+	}
+	return policy.confinement()
+}
+
+// apply sets up cmd to start confined; a nil confinement does nothing
+func (c *confinement) apply(cmd *exec.Cmd) {
+	if c == nil {
+		return
+	}
+	attr := cmd.SysProcAttr
+	attr.Cloneflags |= c.cloneflags
+	attr.Unshareflags |= c.unshareflags
+	if c.chroot != "" {
+		attr.Chroot = c.chroot
+		cmd.Dir = "/"
+	}
+}
+
+// String describes the confinement for the audit log
+func (c *confinement) String() string {
+	var parts []string
+	if len(c.namespaces) > 0 {
+		parts = append(parts, "confine "+strings.Join(c.namespaces, ","))
+	}
+	if c.chroot != "" {
+		parts = append(parts, "chroot "+c.chroot)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// root returns the chroot directory, "" when there is none
+func (c *confinement) root() string {
+	if c == nil {
+		return ""
+	}
+	return c.chroot
+}
+
+// lookJailedCommand is lookCommand inside the chroot root: the command is
+// searched below root and the returned path is the one seen inside it
+func lookJailedCommand(root, name, searchPath string) (string, error) {
+	if root == "" {
+		return lookCommand(name, searchPath)
+	}
+	candidates := []string{name}
+	if !strings.Contains(name, "/") {
+		candidates = nil
+		for _, dir := range filepath.SplitList(searchPath) {
+			if filepath.IsAbs(dir) {
+				candidates = append(candidates, filepath.Join(dir, name))
+			}
+		}
+	} else if !filepath.IsAbs(name) {
+		return "", fmt.Errorf("%s: relative paths cannot be used inside a chroot", name)
+	}
+	for _, path := range candidates {
+		if info, err := os.Stat(filepath.Join(root, path)); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: command not found in %s", name, root)
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Account Directories
+// ============================================================================
+//
+// Group memberships that admit users without a policy file come from the
+// directories listed in the [directory] section of /etc/mixmagisk/config:
+//
+//	[directory]
+//	backend = nss, ldap
+//	admin_groups = mixmagisk, wheel, sudo
+//	ldap_uri = ldaps://ldap.example.com
+//	ldap_base = ou=groups,dc=example,dc=com
+//	ldap_bind_dn = cn=mixmagisk,ou=services,dc=example,dc=com
+//	ldap_bind_password_file = /etc/mixmagisk/ldap.secret
+//	ldap_group_filter = (&(objectClass=posixGroup)(memberUid=%u))
+//
+// nss asks the system's name service switch, so accounts from sssd or
+// nss-ldap work as local ones do. ldap queries a server directly with
+// ldap_group_filter, %u standing for the user name, and takes the group
+// names from ldap_group_attribute (cn).
+
+// accountDirectory resolves the groups a user belongs to
+type accountDirectory interface {
+	userGroups(name string) ([]string, error)
+	String() string
+}
+
+// accountDirectories returns the configured directories in order
+func accountDirectories(s *mixmagiskSettings) []accountDirectory {
+	var dirs []accountDirectory
+	for _, name := range strings.Split(s.str("directory", "backend", "nss"), ",") {
+		switch strings.TrimSpace(name) {
+		case "nss":
+			dirs = append(dirs, nssDirectory{})
+		case "ldap":
+			dirs = append(dirs, newLDAPDirectory(s))
+		default:
+			fmt.Fprintf(os.Stderr, "mixmagisk: unknown directory backend %q\n", name)
+		}
+	}
+	return dirs
+}
+
+// adminGroups returns the groups whose members may use mixmagisk
+func adminGroups(s *mixmagiskSettings) []string {
+	var groups []string
+	for _, g := range strings.Split(s.str("directory", "admin_groups", "mixmagisk, wheel, sudo"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// adminGroupMembership returns the first admin group user belongs to and
+// the directory that says so
+func adminGroupMembership(name string) (group string, dir accountDirectory, ok bool) {
+	s := loadMixmagiskSettings()
+	admin := adminGroups(s)
+	for _, dir := range accountDirectories(s) {
+		groups, err := dir.userGroups(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mixmagisk: %s: %v\n", dir, err)
+			continue
+		}
+		for _, g := range admin {
+			if slices.Contains(groups, g) {
+				return g, dir, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// describeAdminGroups lists the admin groups for messages: "a, b or c"
+func describeAdminGroups() string {
+	groups := adminGroups(loadMixmagiskSettings())
+	switch len(groups) {
+	case 0:
+		return "no admin group"
+	case 1:
+		return "the " + groups[0] + " group"
+	}
+	return "the " + strings.Join(groups[:len(groups)-1], ", ") + " or " + groups[len(groups)-1] + " group"
+}
+
+// nssDirectory looks groups up through the C library's name service
+// switch in cgo builds, and /etc/group otherwise
+type nssDirectory struct{}
+
+func (nssDirectory) String() string { return "nss" }
+
+func (nssDirectory) userGroups(name string) ([]string, error) {
+	u, err := user.Lookup(name)
+	if _, unknown := err.(user.UnknownUserError); unknown {
+		return nil, nil // may be known to another directory
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, id := range ids {
+		if g, err := user.LookupGroupId(id); err == nil {
+			groups = append(groups, g.Name)
+		}
+	}
+	return groups, nil
+}
+
+// ldapDirectory searches an LDAP server for the user's groups
+type ldapDirectory struct {
+	uri          string
+	caFile       string
+	base         string
+	bindDN       string
+	passwordFile string
+	filter       string
+	attribute    string
+	timeout      time.Duration
+}
+
+func newLDAPDirectory(s *mixmagiskSettings) *ldapDirectory {
+	return &ldapDirectory{
+		uri:          s.str("directory", "ldap_uri", ""),
+		caFile:       s.str("directory", "ldap_ca_file", ""),
+		base:         s.str("directory", "ldap_base", ""),
+		bindDN:       s.str("directory", "ldap_bind_dn", ""),
+		passwordFile: s.str("directory", "ldap_bind_password_file", ""),
+		filter:       s.str("directory", "ldap_group_filter", "(&(objectClass=posixGroup)(memberUid=%u))"),
+		attribute:    s.str("directory", "ldap_group_attribute", "cn"),
+		timeout:      time.Duration(s.integer("directory", "ldap_timeout", 5)) * time.Second,
+	}
+}
+
+func (d *ldapDirectory) String() string { return "ldap" }
+
+func (d *ldapDirectory) userGroups(name string) ([]string, error) {
+	if d.uri == "" || d.base == "" {
+		return nil, fmt.Errorf("ldap_uri and ldap_base must be set")
+	}
+	conn, err := dialLDAP(d.uri, d.caFile, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if d.bindDN != "" {
+		password := ""
+		if d.passwordFile != "" {
+			data, err := os.ReadFile(d.passwordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		if err := conn.bind(d.bindDN, password); err != nil {
+			return nil, err
+		}
+	}
+
+	filter := strings.ReplaceAll(d.filter, "%u", escapeLDAPValue(name))
+	groups, err := conn.search(d.base, filter, d.attribute, d.timeout)
+	conn.unbind()
+	return groups, err
+}
@@ -0,0 +1,366 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// Installation Health
+// ============================================================================
+//
+// "mixmagisk doctor" looks for the installation problems that make
+// mixmagisk fail or weaken it: a binary without the setuid bit, policy
+// files others can write, an audit log it cannot append to, a ticket
+// cache readable by users. Every problem comes with the command that
+// fixes it, and the exit status is 1 if any check failed.
+
+// credentialProbeCmd re-executes mixmagisk as an unprivileged user to see
+// whether the credential switch done before running a command works
+const credentialProbeCmd = "__credential-probe"
+
+type doctorStatus int
+
+const (
+	doctorOK doctorStatus = iota
+	doctorWarn
+	doctorFail
+)
+
+// doctorResult is the outcome of one check
+type doctorResult struct {
+	Status doctorStatus
+	Name   string
+	Detail string
+	Fix    string
+}
+
+func (r doctorResult) String() string {
+	mark := "✅"
+	switch r.Status {
+	case doctorWarn:
+		mark = "⚠️ "
+	case doctorFail:
+		mark = "❌"
+	}
+	s := fmt.Sprintf("%s %s: %s", mark, r.Name, r.Detail)
+	if r.Fix != "" {
+		s += "\n     Fix: " + r.Fix
+	}
+	return s
+}
+
+// checkPermissions checks that path is owned by root and has no mode bits
+// outside allowed. A missing path gets the missing status; with doctorOK
+// the path is created when needed.
+func checkPermissions(name, path string, allowed os.FileMode, missing doctorStatus) doctorResult {
+	r := doctorResult{Name: name}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		r.Status = missing
+		r.Detail = path + " does not exist"
+		if missing == doctorOK {
+			r.Detail += " (created when needed)"
+		}
+		return r
+	}
+	if err != nil {
+		r.Status = doctorFail
+		r.Detail = err.Error()
+		return r
+	}
+
+	var problems, fixes []string
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		problems = append(problems, "owned by uid "+strconv.Itoa(int(st.Uid)))
+		fixes = append(fixes, "chown root:root "+path)
+	}
+	if extra := info.Mode().Perm() &^ allowed.Perm(); extra != 0 {
+		problems = append(problems, fmt.Sprintf("mode %04o allows %s", info.Mode().Perm(), describeModeBits(extra)))
+		fixes = append(fixes, fmt.Sprintf("chmod %04o %s", info.Mode().Perm()&allowed.Perm(), path))
+	}
+	if len(problems) > 0 {
+		r.Status = doctorFail
+		r.Detail = path + ": " + strings.Join(problems, ", ")
+		r.Fix = strings.Join(fixes, " && ")
+		return r
+	}
+	r.Detail = fmt.Sprintf("%s (root, %04o)", path, info.Mode().Perm())
+	return r
+}
+
+// describeModeBits names the permissions in bits: "others to read/write"
+func describeModeBits(bits os.FileMode) string {
+	var parts []string
+	for _, who := range []struct {
+		name  string
+		shift uint
+	}{{"owner", 6}, {"group", 3}, {"others", 0}} {
+		var can []string
+		if bits&(4<<who.shift) != 0 {
+			can = append(can, "read")
+		}
+		if bits&(2<<who.shift) != 0 {
+			can = append(can, "write")
+		}
+		if bits&(1<<who.shift) != 0 {
+			can = append(can, "execute")
+		}
+		if len(can) > 0 {
+			parts = append(parts, who.name+" to "+strings.Join(can, "/"))
+		}
+	}
+	return strings.Join(parts, " and ")
+}
+
+// checkBinary checks that the running binary is a root-owned setuid file
+// on a filesystem that honors the setuid bit, unless a broker does the
+// privileged work
+func checkBinary() []doctorResult {
+	path, err := os.Executable()
+	if err != nil {
+		return []doctorResult{{Status: doctorFail, Name: "binary", Detail: err.Error()}}
+	}
+	r := doctorResult{Name: "binary"}
+	info, err := os.Stat(path)
+	if err != nil {
+		r.Status = doctorFail
+		r.Detail = err.Error()
+		return []doctorResult{r}
+	}
+
+	st, _ := info.Sys().(*syscall.Stat_t)
+	brokered := callerPID != os.Getpid() || brokerRunning()
+	mode := "4755"
+	if brokered {
+		mode = "0755"
+	}
+	switch {
+	case st != nil && st.Uid != 0:
+		r.Status = doctorFail
+		r.Detail = fmt.Sprintf("%s is owned by uid %d, not root", path, st.Uid)
+		r.Fix = fmt.Sprintf("chown root:root %s && chmod %s %s", path, mode, path)
+	case info.Mode().Perm()&0022 != 0:
+		r.Status = doctorFail
+		r.Detail = fmt.Sprintf("%s runs as root and is writable by %s", path, describeModeBits(info.Mode().Perm()&0022))
+		r.Fix = fmt.Sprintf("chmod %s %s", mode, path)
+	case info.Mode()&os.ModeSetuid == 0 && brokered:
+		r.Detail = fmt.Sprintf("%s (not setuid, the broker on %s runs commands)", path, brokerSocket)
+		return []doctorResult{r}
+	case info.Mode()&os.ModeSetuid == 0:
+		r.Status = doctorFail
+		r.Detail = path + " does not have the setuid bit and no broker is running"
+		r.Fix = "start the broker (mixmagisk broker, as root), or chmod 4755 " + path
+	default:
+		r.Detail = fmt.Sprintf("%s (setuid root, %04o)", path, info.Mode().Perm())
+	}
+	results := []doctorResult{r}
+
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err == nil && fs.Flags&unix.ST_NOSUID != 0 && !brokered {
+		results = append(results, doctorResult{
+			Status: doctorFail,
+			Name:   "binary",
+			Detail: path + " is on a filesystem mounted nosuid, the setuid bit is ignored",
+			Fix:    "install mixmagisk on a filesystem mounted without nosuid",
+		})
+	}
+	return results
+}
+
+// checkPrivileges checks that this process runs as root and could switch
+// to another user the way runAsTarget does
+func checkPrivileges() []doctorResult {
+	r := doctorResult{Name: "privileges"}
+	if os.Geteuid() != 0 {
+		r.Status = doctorFail
+		r.Detail = fmt.Sprintf("effective uid is %d, mixmagisk cannot act as root", os.Geteuid())
+		r.Fix = "fix the binary problems above, or run mixmagisk doctor as root"
+		if noNewPrivs() {
+			r.Detail += " (no_new_privs is set, so the setuid bit is ignored)"
+			r.Fix = "run mixmagisk outside of the sandbox or container that sets no_new_privs"
+		}
+		return []doctorResult{r}
+	}
+	r.Detail = "running with effective uid 0"
+	return []doctorResult{r, probeCredentials()}
+}
+
+// noNewPrivs reports whether no_new_privs is set for this process
+func noNewPrivs() bool {
+	v, err := unix.PrctlRetInt(unix.PR_GET_NO_NEW_PRIVS, 0, 0, 0, 0)
+	return err == nil && v == 1
+}
+
+// probeCredentials runs credentialProbeCmd as nobody and compares the ids
+// it reports with the requested ones
+func probeCredentials() doctorResult {
+	r := doctorResult{Name: "credentials"}
+	uid, gid := uint32(65534), uint32(65534)
+	if u, err := user.Lookup("nobody"); err == nil {
+		if n, err := strconv.ParseUint(u.Uid, 10, 32); err == nil {
+			uid = uint32(n)
+		}
+		if n, err := strconv.ParseUint(u.Gid, 10, 32); err == nil {
+			gid = uint32(n)
+		}
+	}
+
+	cmd := exec.Command("/proc/self/exe", "mixmagisk", credentialProbeCmd)
+	cmd.Args[0] = os.Args[0]
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uid, Gid: gid, Groups: []uint32{gid}},
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		r.Status = doctorFail
+		r.Detail = fmt.Sprintf("cannot start a process as uid %d: %v", uid, err)
+		r.Fix = "mixmagisk needs CAP_SETUID and CAP_SETGID; check the container or security module that removes them"
+		return r
+	}
+
+	// Only the real ids: the setuid bit makes the probe's effective uid 0
+	want := fmt.Sprintf("%d %d %d", uid, gid, gid)
+	if got := strings.TrimSpace(string(out)); got != want {
+		r.Status = doctorFail
+		r.Detail = fmt.Sprintf("a process started as uid %d reports ids %q, want %q", uid, got, want)
+		r.Fix = "check the security module or seccomp profile that interferes with setuid/setgid"
+		return r
+	}
+	r.Detail = fmt.Sprintf("commands can be run as another user (probed uid %d)", uid)
+	return r
+}
+
+// runCredentialProbe prints "uid gid groups"
+func runCredentialProbe() {
+	groups, _ := os.Getgroups()
+	ids := make([]string, len(groups))
+	for i, g := range groups {
+		ids[i] = strconv.Itoa(g)
+	}
+	fmt.Printf("%d %d %s\n", os.Getuid(), os.Getgid(), strings.Join(ids, ","))
+	os.Exit(0)
+}
+
+// checkConfiguration checks the configuration and policy files, which
+// decide who becomes root and must not be writable by anyone else
+func checkConfiguration() []doctorResult {
+	results := []doctorResult{
+		checkPermissions("config", filepath.Dir(mixmagiskConfig), 0755, doctorFail),
+		checkPermissions("config", mixmagiskConfig, 0644, doctorWarn),
+		checkPermissions("policies", mixmagiskPolicy, 0755, doctorOK),
+		checkPermissions("policies", policyIncludeDir, 0755, doctorOK),
+	}
+	if results[1].Status == doctorWarn {
+		results[1].Detail = mixmagiskConfig + " does not exist, the defaults are used"
+	}
+
+	files, _ := filepath.Glob(filepath.Join(mixmagiskPolicy, "*.policy"))
+	files = append(files, policyFragments()...)
+	bad := 0
+	for _, path := range files {
+		if r := checkPermissions("policies", path, 0644, doctorFail); r.Status != doctorOK {
+			results = append(results, r)
+			bad++
+		}
+	}
+	if bad == 0 && len(files) > 0 {
+		results = append(results, doctorResult{Name: "policies", Detail: fmt.Sprintf("%d policy file(s) owned by root and not writable by others", len(files))})
+	}
+
+	s := loadMixmagiskSettings()
+	if dir := s.str("auth", "totp_dir", totpSecretDir); fileExists(dir) {
+		results = append(results, checkPermissions("auth", dir, 0700, doctorFail))
+	}
+	if dir := s.str("auth", "fido2_dir", fido2KeyDir); fileExists(dir) {
+		results = append(results, checkPermissions("auth", dir, 0700, doctorFail))
+	}
+	if secret := s.str("directory", "ldap_bind_password_file", ""); secret != "" {
+		results = append(results, checkPermissions("directory", secret, 0600, doctorFail))
+	}
+	return results
+}
+
+// checkLogging checks that the audit log can be appended to and that the
+// log and session recordings are not readable by users
+func checkLogging() []doctorResult {
+	r := checkPermissions("audit log", mixmagiskLog, 0644, doctorOK)
+	info, err := os.Stat(mixmagiskLog)
+	switch {
+	case r.Status != doctorOK:
+	case os.IsNotExist(err):
+		dir := filepath.Dir(mixmagiskLog)
+		if err := unix.Faccessat(unix.AT_FDCWD, dir, unix.W_OK, unix.AT_EACCESS); err != nil {
+			r.Status = doctorFail
+			r.Detail = fmt.Sprintf("%s does not exist and %s is not writable", mixmagiskLog, dir)
+			r.Fix = "mkdir -p " + dir + " && chown root:root " + dir
+		}
+	case info.Mode().Perm()&0004 != 0:
+		// Others reading the log see every command, but cannot forge it
+		r.Status = doctorWarn
+		r.Detail = mixmagiskLog + " is readable by everyone"
+		r.Fix = "chmod 0640 " + mixmagiskLog
+	default:
+		f, err := os.OpenFile(mixmagiskLog, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			r.Status = doctorFail
+			r.Detail = fmt.Sprintf("cannot append to %s: %v", mixmagiskLog, err)
+			r.Fix = "chattr -i " + mixmagiskLog + ", or remount " + filepath.Dir(mixmagiskLog) + " read-write"
+			break
+		}
+		f.Close()
+	}
+	return []doctorResult{
+		r,
+		checkPermissions("audit log", sessionLogDir, 0700, doctorOK),
+	}
+}
+
+// checkCaches checks the ticket cache, where a file readable or writable
+// by a user would let them skip authentication, and the lecture cache
+func checkCaches() []doctorResult {
+	return []doctorResult{
+		checkPermissions("cache", mixmagiskCache, 0700, doctorOK),
+		checkPermissions("cache", lectureDir, 0700, doctorOK),
+	}
+}
+
+// runDoctor implements "mixmagisk doctor"
+func runDoctor() {
+	var results []doctorResult
+	results = append(results, checkBinary()...)
+	results = append(results, checkPrivileges()...)
+	results = append(results, checkConfiguration()...)
+	results = append(results, checkLogging()...)
+	results = append(results, checkCaches()...)
+
+	failed, warned := 0, 0
+	for _, r := range results {
+		fmt.Println(r)
+		switch r.Status {
+		case doctorFail:
+			failed++
+		case doctorWarn:
+			warned++
+		}
+	}
+
+	fmt.Println()
+	switch {
+	case failed > 0:
+		fmt.Printf("%d problem(s), %d warning(s)\n", failed, warned)
+		os.Exit(exitError)
+	case warned > 0:
+		fmt.Printf("No problems, %d warning(s)\n", warned)
+	default:
+		fmt.Println("No problems found")
+	}
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ============================================================================
+// Environment Sanitization
+// ============================================================================
+//
+// Commands start from an empty environment. Only a few harmless variables
+// (terminal, locale, timezone) and those listed in the policy's env_keep
+// are copied from the caller; PATH is always replaced with a fixed search
+// path. Variables that change how the dynamic loader or a shell behaves are
+// dropped even when env_keep lists them.
+
+// secureSearchPath is the PATH commands run with unless the policy sets
+// secure_path
+const secureSearchPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// defaultEnvKeep are always preserved
+var defaultEnvKeep = []string{
+	"TERM", "COLORTERM", "COLORS", "LANG", "LANGUAGE", "LC_*", "TZ",
+	"DISPLAY", "XAUTHORITY",
+}
+
+// unsafeEnv are never preserved; a trailing * matches any suffix
+var unsafeEnv = []string{
+	"LD_*", "GCONV_PATH", "LOCPATH", "NLSPATH", "HOSTALIASES", "RESOLV_HOST_CONF",
+	"MALLOC_*", "GLIBC_TUNABLES", "IFS", "CDPATH", "ENV", "BASH_ENV",
+	"BASH_FUNC_*", "SHELLOPTS", "BASHOPTS", "PS4", "PATH",
+}
+
+// envPolicy holds the environment settings from a user's policy
+type envPolicy struct {
+	keep []string
+	path string
+}
+
+// loadEnvPolicy reads env_keep and secure_path from policy, which may be nil
+func loadEnvPolicy(policy *policyFile) envPolicy {
+	ep := envPolicy{keep: defaultEnvKeep, path: secureSearchPath}
+	if policy == nil {
+		return ep
+	}
+	ep.keep = append(append([]string{}, defaultEnvKeep...), policy.values("env_keep")...)
+	if path, ok := policy.get("secure_path"); ok && path != "" {
+		ep.path = path
+	}
+	return ep
+}
+
+// sanitizeEnv builds the environment for a command run as target by caller
+// from the caller's environment
+func sanitizeEnv(environ []string, ep envPolicy, caller string, target *runTarget, command []string) []string {
+	vars := make(map[string]string)
+
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			continue
+		}
+		if matchAny(unsafeEnv, name) || !matchAny(ep.keep, name) {
+			continue
+		}
+		// exported shell functions can hide in any variable
+		if strings.HasPrefix(value, "()") {
+			continue
+		}
+		vars[name] = value
+	}
+
+	vars["PATH"] = ep.path
+	vars["HOME"] = target.Home
+	vars["USER"] = target.User
+	vars["LOGNAME"] = target.User
+	vars["MIXMAGISK_USER"] = caller
+	vars["MIXMAGISK_UID"] = fmt.Sprint(os.Getuid())
+	vars["MIXMAGISK_GID"] = fmt.Sprint(os.Getgid())
+	if len(command) > 0 {
+		vars["MIXMAGISK_COMMAND"] = strings.Join(command, " ")
+	}
+
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// commandEnv returns the sanitized environment for running command as
+// target, using the caller's policy if there is one
+func commandEnv(caller string, target *runTarget, command []string) []string {
+	policy, err := loadUserPolicy(caller)
+	if err != nil {
+		policy = nil
+	}
+	return sanitizeEnv(os.Environ(), loadEnvPolicy(policy), caller, target, command)
+}
+
+// lookCommand finds name in searchPath, the PATH the command will run with,
+// rather than in the caller's PATH
+func lookCommand(name, searchPath string) (string, error) {
+	if strings.Contains(name, "/") {
+		return exec.LookPath(name)
+	}
+	for _, dir := range filepath.SplitList(searchPath) {
+		if dir == "" || !filepath.IsAbs(dir) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: command not found", name)
+}
+
+// envValue returns the value of name in env
+func envValue(env []string, name string) string {
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, name+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeEnv(t *testing.T) {
+	policy, err := parsePolicy(strings.NewReader("[env]\nenv_keep = EDITOR, http_*, LD_PRELOAD\n"))
+	if err != nil {
+		t.Fatalf("parsePolicy failed: %v", err)
+	}
+	target := &runTarget{User: "root", Home: "/root"}
+
+	env := sanitizeEnv([]string{
+		"PATH=/home/alice/bin:/usr/bin",
+		"HOME=/home/alice",
+		"TERM=xterm-256color",
+		"LC_ALL=C.UTF-8",
+		"EDITOR=vim",
+		"http_proxy=http://proxy:3128",
+		"LD_PRELOAD=/tmp/evil.so",
+		"IFS=/",
+		"BASH_ENV=/tmp/rc",
+		"SECRET_TOKEN=abc",
+		"TZ=() { :; }; id",
+	}, loadEnvPolicy(policy), "alice", target, []string{"id"})
+
+	expected := map[string]string{
+		"PATH":              secureSearchPath,
+		"HOME":              "/root",
+		"USER":              "root",
+		"TERM":              "xterm-256color",
+		"LC_ALL":            "C.UTF-8",
+		"EDITOR":            "vim",
+		"http_proxy":        "http://proxy:3128",
+		"MIXMAGISK_USER":    "alice",
+		"MIXMAGISK_COMMAND": "id",
+	}
+	for name, value := range expected {
+		if got := envValue(env, name); got != value {
+			t.Errorf("%s = %q, expected %q", name, got, value)
+		}
+	}
+	for _, name := range []string{"LD_PRELOAD", "IFS", "BASH_ENV", "SECRET_TOKEN", "TZ"} {
+		if strings.Contains(strings.Join(env, "\n"), name+"=") {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+}
+
+func TestUnquoteBanner(t *testing.T) {
+	tests := map[string]string{
+		`Authorized use only`:          "Authorized use only",
+		`"Access is logged.\nBe nice"`: "Access is logged.\nBe nice",
+		`"unbalanced`:                  `"unbalanced`,
+	}
+	for in, expected := range tests {
+		if got := unquoteBanner(in); got != expected {
+			t.Errorf("unquoteBanner(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Temporary Grants
+// ============================================================================
+//
+// "mixmagisk grant <user> --duration 2h" writes the end of the grant into
+// the policy:
+//
+//	[user]
+//	expires = 2026-10-17T16:00:00Z
+//
+// Once that time has passed the policy no longer admits the user. The
+// policy file is removed and the user's tickets are ended the first time
+// mixmagisk notices, either when the user tries to elevate or in the
+// cleanup pass every run as root makes over all policies.
+
+// checkPolicyUser makes sure a name given to grant or revoke is an account
+// in the passwd database, so it can't point the policy path elsewhere
+func checkPolicyUser(name string) error {
+	if name == "" || name[0] == '.' || name[0] == '-' || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	if _, err := user.Lookup(name); err != nil {
+		return fmt.Errorf("unknown user %s", name)
+	}
+	return nil
+}
+
+// parseGrantDuration parses a grant length: a Go duration ("90m", "2h")
+// or a number of days ("3d")
+func parseGrantDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q (e.g. 30m, 2h, 7d)", s)
+	}
+	return d, nil
+}
+
+// parseGrantArgs parses "<user> [--duration D]"
+func parseGrantArgs(args []string) (user string, duration time.Duration, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--duration" || arg == "-d":
+			if i+1 == len(args) {
+				return "", 0, fmt.Errorf("%s needs a value", arg)
+			}
+			i++
+			if duration, err = parseGrantDuration(args[i]); err != nil {
+				return "", 0, err
+			}
+		case strings.HasPrefix(arg, "--duration="):
+			if duration, err = parseGrantDuration(strings.TrimPrefix(arg, "--duration=")); err != nil {
+				return "", 0, err
+			}
+		case strings.HasPrefix(arg, "-"):
+			return "", 0, fmt.Errorf("unknown option %s", arg)
+		case user != "":
+			return "", 0, fmt.Errorf("unexpected argument %s", arg)
+		default:
+			user = arg
+		}
+	}
+	if user == "" {
+		return "", 0, fmt.Errorf("a user name is required")
+	}
+	return user, duration, nil
+}
+
+func validateExpiry(v string) error {
+	if _, err := time.Parse(time.RFC3339, v); err != nil {
+		return fmt.Errorf("expected a time like 2026-01-02T15:04:05Z, got %q", v)
+	}
+	return nil
+}
+
+// expiry returns the end of a temporary grant
+func (p *policyFile) expiry() (time.Time, bool) {
+	v, ok := p.get("expires")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, err == nil
+}
+
+// expired reports whether p is a temporary grant that has ended. An
+// unreadable expires value counts as ended rather than as forever.
+func (p *policyFile) expired(now time.Time) bool {
+	if _, ok := p.get("expires"); !ok {
+		return false
+	}
+	t, ok := p.expiry()
+	return !ok || !now.Before(t)
+}
+
+// formatExpiry describes the end of a grant relative to now
+func formatExpiry(t, now time.Time) string {
+	at := t.Local().Format("2006-01-02 15:04:05 MST")
+	if !now.Before(t) {
+		return at + " (expired)"
+	}
+	return fmt.Sprintf("%s (in %s)", at, t.Sub(now).Round(time.Second))
+}
+
+// expireGrant removes the policy at path if it is an ended temporary
+// grant, ending the user's tickets too. It returns whether it did.
+func expireGrant(path string) bool {
+	p, err := readPolicyFile(path)
+	if err != nil || !p.expired(time.Now()) {
+		return false
+	}
+	if os.Remove(path) != nil {
+		return false // not root, or another run got there first
+	}
+	user := strings.TrimSuffix(filepath.Base(path), ".policy")
+	v, _ := p.get("expires")
+	logAction("grant_expired", user, "Temporary root access ended at "+v)
+	endUserSessions(user, "on expiry")
+	return true
+}
+
+// expireGrants is the cleanup pass over all policies, made when the real
+// uid is root; a user's own expired grant is removed by rootAccessReason
+func expireGrants() {
+	if os.Getuid() != 0 {
+		return
+	}
+	paths, _ := filepath.Glob(filepath.Join(mixmagiskPolicy, "*.policy"))
+	for _, path := range paths {
+		expireGrant(path)
+	}
+}
@@ -0,0 +1,470 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// FIDO2 Security Keys
+// ============================================================================
+//
+//	[user]
+//	require_fido2 = true
+//
+// A policy with require_fido2 makes every elevation that is not covered by
+// a ticket end with a touch of one of the user's registered security keys,
+// on top of the methods in [auth]. "fido2" can also be listed in the
+// [auth] methods like any other method. Keys are registered by root with
+// "mixmagisk fido enroll <user>" and kept in fido2_dir/<user>, one line
+// per key:
+//
+//	<name> <credential id> <public key> <enrolled>
+//
+// Talking to the key needs libfido2; build with -tags fido2. The
+// assertion is checked here against the stored ES256 public key.
+
+// fido2KeyDir holds the registered keys of each user, readable by root
+const fido2KeyDir = "/etc/mixmagisk/fido2"
+
+// fido2RelyingParty is the default relying party id keys are registered for
+const fido2RelyingParty = "mixmagisk"
+
+// errFIDO2Unavailable means FIDO2 support is not built in
+var errFIDO2Unavailable = errors.New("FIDO2 security keys not supported (build with -tags fido2)")
+
+// errFIDO2PINRequired means the key wants its PIN before it registers a
+// credential
+var errFIDO2PINRequired = errors.New("security key PIN required")
+
+// fido2Credential is a credential made by a key at enrollment
+type fido2Credential struct {
+	ID        []byte
+	PublicKey []byte // ES256 point as x||y
+}
+
+// fido2Assertion is a key's signature over a challenge
+type fido2Assertion struct {
+	CredentialID []byte // empty when the key did not say
+	AuthData     []byte // CBOR encoded, as libfido2 returns it
+	Signature    []byte
+}
+
+// fido2Key is a registered security key
+type fido2Key struct {
+	Name         string
+	CredentialID []byte
+	PublicKey    []byte // PKIX DER
+	Enrolled     time.Time
+}
+
+// readFIDO2Keys returns the keys registered for user; none when the file
+// does not exist
+func readFIDO2Keys(dir, user string) ([]fido2Key, error) {
+	if strings.ContainsRune(user, '/') {
+		return nil, nil
+	}
+	f, err := os.Open(filepath.Join(dir, user))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []fido2Key
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: malformed key", f.Name(), n)
+		}
+		k := fido2Key{Name: fields[0]}
+		k.CredentialID, err = base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad credential id", f.Name(), n)
+		}
+		k.PublicKey, err = base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad public key", f.Name(), n)
+		}
+		if len(fields) > 3 {
+			k.Enrolled, _ = time.Parse(time.RFC3339, fields[3])
+		}
+		keys = append(keys, k)
+	}
+	return keys, scanner.Err()
+}
+
+// writeFIDO2Keys replaces the key file of user
+func writeFIDO2Keys(dir, user string, keys []fido2Key) error {
+	path := filepath.Join(dir, user)
+	if len(keys) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Security keys of %s (mixmagisk fido enroll)\n", user)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s %s %s %s\n", k.Name,
+			base64.StdEncoding.EncodeToString(k.CredentialID),
+			base64.StdEncoding.EncodeToString(k.PublicKey),
+			k.Enrolled.UTC().Format(time.RFC3339))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// fido2PublicKey converts the x||y point of a new credential to PKIX DER
+func fido2PublicKey(xy []byte) ([]byte, error) {
+	pub, err := ecdh.P256().NewPublicKey(append([]byte{4}, xy...))
+	if err != nil {
+		return nil, fmt.Errorf("security key returned an invalid ES256 public key")
+	}
+	return x509.MarshalPKIXPublicKey(pub)
+}
+
+// cborBytes decodes a CBOR byte string that makes up all of data
+func cborBytes(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0]>>5 != 2 {
+		return nil, errors.New("not a CBOR byte string")
+	}
+	n, head := uint64(data[0]&0x1f), 1
+	switch {
+	case n < 24:
+	case n == 24 && len(data) >= 2:
+		n, head = uint64(data[1]), 2
+	case n == 25 && len(data) >= 3:
+		n, head = uint64(data[1])<<8|uint64(data[2]), 3
+	default:
+		return nil, errors.New("unsupported CBOR length")
+	}
+	if uint64(len(data)-head) != n {
+		return nil, errors.New("truncated CBOR byte string")
+	}
+	return data[head:], nil
+}
+
+// verifyFIDO2Assertion checks that the key behind pubDER signed the
+// challenge cdh for rpID with the user present
+func verifyFIDO2Assertion(pubDER []byte, rpID string, cdh []byte, a *fido2Assertion) error {
+	parsed, err := x509.ParsePKIXPublicKey(pubDER)
+	if err != nil {
+		return fmt.Errorf("stored public key: %w", err)
+	}
+	pub, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("stored public key is not an ES256 key")
+	}
+	authData, err := cborBytes(a.AuthData)
+	if err != nil {
+		return fmt.Errorf("authenticator data: %w", err)
+	}
+	// rpIdHash (32) | flags (1) | signCount (4)
+	if len(authData) < 37 {
+		return errors.New("authenticator data too short")
+	}
+	rpHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(authData[:32], rpHash[:]) {
+		return errors.New("assertion is for another relying party")
+	}
+	if authData[32]&0x01 == 0 {
+		return errors.New("security key was not touched")
+	}
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdh...))
+	if !ecdsa.VerifyASN1(pub, digest[:], a.Signature) {
+		return errors.New("signature does not match the registered key")
+	}
+	return nil
+}
+
+// fido2Device returns the configured device or the first key plugged in
+func fido2Device(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	devices, err := fido2Devices()
+	if err != nil {
+		return "", err
+	}
+	if len(devices) == 0 {
+		return "", errors.New("no security key found, insert one and try again")
+	}
+	return devices[0], nil
+}
+
+// fido2Challenge returns a random client data hash
+func fido2Challenge() ([]byte, error) {
+	cdh := make([]byte, 32)
+	_, err := rand.Read(cdh)
+	return cdh, err
+}
+
+// fido2Authenticator asks for a touch of a registered security key
+type fido2Authenticator struct {
+	dir    string
+	rpID   string
+	device string
+}
+
+func newFIDO2Authenticator(s *mixmagiskSettings) fido2Authenticator {
+	return fido2Authenticator{
+		dir:    s.str("auth", "fido2_dir", fido2KeyDir),
+		rpID:   s.str("auth", "fido2_rp_id", fido2RelyingParty),
+		device: s.str("auth", "fido2_device", ""),
+	}
+}
+
+func (fido2Authenticator) Name() string { return "fido2" }
+
+func isFIDO2(m Authenticator) bool { return m.Name() == "fido2" }
+
+func (a fido2Authenticator) Authenticate(user string) (bool, error) {
+	keys, err := readFIDO2Keys(a.dir, user)
+	if err != nil {
+		return false, err
+	}
+	if len(keys) == 0 {
+		return false, errAuthUnavailable
+	}
+	device, err := fido2Device(a.device)
+	if err != nil {
+		return false, err
+	}
+	cdh, err := fido2Challenge()
+	if err != nil {
+		return false, err
+	}
+	allow := make([][]byte, len(keys))
+	for i, k := range keys {
+		allow[i] = k.CredentialID
+	}
+
+	fmt.Fprintln(os.Stderr, "[mixmagisk] Touch your security key...")
+	assertion, err := fido2GetAssertion(device, a.rpID, cdh, allow)
+	if err != nil {
+		return false, err
+	}
+	key := &keys[0]
+	if len(assertion.CredentialID) > 0 {
+		key = nil
+		for i := range keys {
+			if bytes.Equal(keys[i].CredentialID, assertion.CredentialID) {
+				key = &keys[i]
+			}
+		}
+	} else if len(keys) > 1 {
+		return false, errors.New("security key did not name its credential")
+	}
+	if key == nil {
+		logAction("auth_fido2_fail", user, "unregistered credential")
+		return false, nil
+	}
+	if err := verifyFIDO2Assertion(key.PublicKey, a.rpID, cdh, assertion); err != nil {
+		logAction("auth_fido2_fail", user, "Security key "+key.Name+": "+err.Error())
+		return false, nil
+	}
+	logAction("auth_fido2", user, "Security key "+key.Name)
+	return true, nil
+}
+
+// fido2Required reports whether user's policy demands a security key
+func fido2Required(user string) bool {
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return false
+	}
+	return policy.flag("require_fido2")
+}
+
+// ============================================================================
+// Key Management
+// ============================================================================
+
+// fidoCmd handles "mixmagisk fido ..."
+func fidoCmd(args []string) {
+	switch {
+	case len(args) >= 2 && args[0] == "enroll":
+		enrollFIDO2Key(args[1:])
+	case len(args) >= 1 && args[0] == "list":
+		listFIDO2Keys(args[1:])
+	case len(args) == 3 && args[0] == "remove":
+		removeFIDO2Key(args[1], args[2])
+	default:
+		fmt.Println("Usage: mixmagisk fido enroll <user> [--name NAME] | list [user] | remove <user> <name>")
+	}
+}
+
+func enrollFIDO2Key(args []string) {
+	if os.Getuid() != 0 {
+		fmt.Println("Error: Must be root to enroll security keys")
+		return
+	}
+	user, name := args[0], ""
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "--name" && i+1 < len(args):
+			i++
+			name = args[i]
+		case strings.HasPrefix(args[i], "--name="):
+			name = strings.TrimPrefix(args[i], "--name=")
+		default:
+			fmt.Println("Usage: mixmagisk fido enroll <user> [--name NAME]")
+			return
+		}
+	}
+	if user == "" || strings.ContainsRune(user, '/') {
+		fmt.Printf("Error: invalid user name %q\n", user)
+		return
+	}
+
+	a := newFIDO2Authenticator(loadMixmagiskSettings())
+	keys, err := readFIDO2Keys(a.dir, user)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if name == "" {
+		name = fmt.Sprintf("key%d", len(keys)+1)
+	}
+	if strings.ContainsAny(name, " \t#") {
+		fmt.Printf("Error: invalid key name %q\n", name)
+		return
+	}
+	for _, k := range keys {
+		if k.Name == name {
+			fmt.Printf("Error: %s already has a key named %s\n", user, name)
+			return
+		}
+	}
+
+	device, err := fido2Device(a.device)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	cdh, err := fido2Challenge()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	userID := sha256.Sum256([]byte(user))
+
+	fmt.Printf("Touch the security key on %s to register it for %s...\n", device, user)
+	cred, err := fido2MakeCredential(device, a.rpID, user, userID[:], cdh, "")
+	if errors.Is(err, errFIDO2PINRequired) {
+		var pin string
+		if pin, err = readPassword("Security key PIN: "); err == nil {
+			fmt.Println("Touch the security key again...")
+			cred, err = fido2MakeCredential(device, a.rpID, user, userID[:], cdh, pin)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	pub, err := fido2PublicKey(cred.PublicKey)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	keys = append(keys, fido2Key{Name: name, CredentialID: cred.ID, PublicKey: pub, Enrolled: time.Now()})
+	if err := writeFIDO2Keys(a.dir, user, keys); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	logAction("fido_enroll", user, "Security key "+name+" enrolled")
+	fmt.Printf("✅ Security key %s enrolled for %s\n", name, user)
+}
+
+func listFIDO2Keys(args []string) {
+	caller := callerName()
+	user := caller
+	if len(args) > 0 {
+		user = args[0]
+	}
+	// Users may see their own keys
+	if os.Getuid() != 0 && user != caller {
+		fmt.Println("Error: Must be root to list other users' keys")
+		return
+	}
+	keys, err := readFIDO2Keys(newFIDO2Authenticator(loadMixmagiskSettings()).dir, user)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(keys) == 0 {
+		fmt.Printf("No security keys enrolled for %s\n", user)
+		return
+	}
+	fmt.Printf("%-16s %-24s %s\n", "NAME", "CREDENTIAL", "ENROLLED")
+	for _, k := range keys {
+		id := base64.RawURLEncoding.EncodeToString(k.CredentialID)
+		if len(id) > 20 {
+			id = id[:20] + "..."
+		}
+		enrolled := "-"
+		if !k.Enrolled.IsZero() {
+			enrolled = k.Enrolled.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-16s %-24s %s\n", k.Name, id, enrolled)
+	}
+}
+
+func removeFIDO2Key(user, name string) {
+	if os.Getuid() != 0 {
+		fmt.Println("Error: Must be root to remove security keys")
+		return
+	}
+	dir := newFIDO2Authenticator(loadMixmagiskSettings()).dir
+	keys, err := readFIDO2Keys(dir, user)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	var kept []fido2Key
+	for _, k := range keys {
+		if k.Name != name {
+			kept = append(kept, k)
+		}
+	}
+	if len(kept) == len(keys) {
+		fmt.Printf("Error: %s has no key named %s\n", user, name)
+		return
+	}
+	if err := writeFIDO2Keys(dir, user, kept); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	logAction("fido_remove", user, "Security key "+name+" removed")
+	fmt.Printf("✅ Security key %s of %s removed\n", name, user)
+	if len(kept) == 0 && fido2Required(user) {
+		fmt.Printf("⚠️  %s's policy has require_fido2: they cannot elevate until a key is enrolled\n", user)
+	}
+}
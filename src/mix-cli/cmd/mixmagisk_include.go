@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ============================================================================
+// Policy Fragments
+// ============================================================================
+//
+// Packages and configuration management drop policy fragments into
+// policyIncludeDir instead of editing the per-user files. A fragment uses
+// the policy format and applies to every user with a policy, or only to
+// those matching its users patterns:
+//
+//	# /etc/mixmagisk/include.d/50-backup.policy
+//	users = backup, ops-*
+//	[commands]
+//	allow = /usr/bin/restic *
+//
+// Fragments are merged after the user's own policy in file name order, so
+// a later file wins for single-value keys (timeout, chroot, ...) while
+// list keys (allow, deny, env_keep, ...) collect the values of all files.
+// A fragment never grants access by itself: users without a policy file
+// are unaffected.
+
+const policyIncludeDir = "/etc/mixmagisk/include.d"
+
+// policyListKeys are the keys read with values(); every other key takes
+// its last value
+var policyListKeys = map[string]bool{
+	"allow":               true,
+	"deny":                true,
+	"nopasswd":            true,
+	"run_as":              true,
+	"run_as_group":        true,
+	"env_keep":            true,
+	"capabilities":        true,
+	"confine":             true,
+	"allowed_cwd":         true,
+	"ssh_ca":              true,
+	"ssh_principals":      true,
+	"ssh_authorized_keys": true,
+}
+
+// readPolicyFile reads and parses the policy file at path
+func readPolicyFile(path string) (*policyFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := parsePolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	p.Path = path
+	for i := range p.Entries {
+		p.Entries[i].File = path
+	}
+	return p, nil
+}
+
+// policyFragments returns the paths of all fragments in merge order
+func policyFragments() []string {
+	paths, _ := filepath.Glob(filepath.Join(policyIncludeDir, "*.policy"))
+	return paths
+}
+
+// isFragment reports whether p was read from policyIncludeDir
+func (p *policyFile) isFragment() bool {
+	return filepath.Dir(p.Path) == policyIncludeDir
+}
+
+// appliesTo reports whether fragment p applies to user
+func (p *policyFile) appliesTo(user string) bool {
+	users := p.values("users")
+	return len(users) == 0 || matchAny(users, user)
+}
+
+// mergeFragments appends the entries of every fragment that applies to
+// user. A fragment that cannot be parsed fails the whole policy.
+func (p *policyFile) mergeFragments(user string) error {
+	for _, path := range policyFragments() {
+		fragment, err := readPolicyFile(path)
+		if err != nil {
+			return err
+		}
+		if !fragment.appliesTo(user) {
+			continue
+		}
+		for _, e := range fragment.Entries {
+			if e.Key != "users" {
+				p.Entries = append(p.Entries, e)
+			}
+		}
+		p.Includes = append(p.Includes, path)
+	}
+	return nil
+}
+
+// overriddenBy returns the later entry that replaces Entries[i], if any
+func (p *policyFile) overriddenBy(i int) (policyEntry, bool) {
+	key := p.Entries[i].Key
+	if policyListKeys[key] {
+		return policyEntry{}, false
+	}
+	for j := len(p.Entries) - 1; j > i; j-- {
+		if p.Entries[j].Key == key {
+			return p.Entries[j], true
+		}
+	}
+	return policyEntry{}, false
+}
+
+// showEffectivePolicy implements "mixmagisk policy show --effective <user>"
+func showEffectivePolicy(user string) {
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Printf("No policy for user: %s\n", user)
+		} else {
+			fmt.Printf("Error reading policy: %v\n", err)
+		}
+		return
+	}
+
+	fmt.Printf("# Effective policy for %s\n", user)
+	fmt.Printf("#   %s\n", policy.Path)
+	for _, path := range policy.Includes {
+		fmt.Printf("#   %s\n", path)
+	}
+
+	// Group entries by section in order of first appearance
+	var sections []string
+	bySection := make(map[string][]int)
+	for i, e := range policy.Entries {
+		if _, seen := bySection[e.Section]; !seen {
+			sections = append(sections, e.Section)
+		}
+		bySection[e.Section] = append(bySection[e.Section], i)
+	}
+
+	for _, section := range sections {
+		fmt.Println()
+		if section != "" {
+			fmt.Printf("[%s]\n", section)
+		}
+		for _, i := range bySection[section] {
+			e := policy.Entries[i]
+			line := e.Key + " = " + e.Value
+			origin := fmt.Sprintf("%s:%d", filepath.Base(e.File), e.Line)
+			if later, ok := policy.overriddenBy(i); ok {
+				line = "# " + line
+				origin += fmt.Sprintf(", overridden by %s:%d", filepath.Base(later.File), later.Line)
+			}
+			fmt.Printf("%-44s # %s\n", line, origin)
+		}
+	}
+}
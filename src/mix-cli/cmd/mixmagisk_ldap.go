@@ -0,0 +1,451 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// LDAP Client
+// ============================================================================
+//
+// Just enough of LDAPv3 (RFC 4511) to look up group memberships: simple
+// bind, search with an RFC 4515 filter made of &, |, !, equality and
+// presence tests, and unbind.
+
+// BER and LDAP protocol tags
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest     = 0x60
+	ldapBindResponse    = 0x61
+	ldapUnbindRequest   = 0x42
+	ldapSearchRequest   = 0x63
+	ldapSearchEntry     = 0x64
+	ldapSearchDone      = 0x65
+	ldapSearchReference = 0x73
+
+	ldapFilterAnd      = 0xa0
+	ldapFilterOr       = 0xa1
+	ldapFilterNot      = 0xa2
+	ldapFilterEquality = 0xa3
+	ldapFilterPresent  = 0x87
+	ldapAuthSimple     = 0x80
+)
+
+var errBERTruncated = errors.New("ldap: truncated BER element")
+
+// berElement is one decoded tag-length-value
+type berElement struct {
+	tag   byte
+	value []byte
+}
+
+// berEncode wraps content in a tag and length
+func berEncode(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+	out := append([]byte{tag}, berLength(n)...)
+	for _, c := range content {
+		out = append(out, c...)
+	}
+	return out
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// berInt encodes a non-negative integer
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+// berParse splits data into its top-level elements
+func berParse(data []byte) ([]berElement, error) {
+	var out []berElement
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errBERTruncated
+		}
+		n, header := int(data[1]), 2
+		if n&0x80 != 0 {
+			size := n & 0x7f
+			if size == 0 || size > 4 || len(data) < 2+size {
+				return nil, errBERTruncated
+			}
+			n = 0
+			for _, b := range data[2 : 2+size] {
+				n = n<<8 | int(b)
+			}
+			header += size
+		}
+		if n < 0 || len(data)-header < n {
+			return nil, errBERTruncated
+		}
+		out = append(out, berElement{data[0], data[header : header+n]})
+		data = data[header+n:]
+	}
+	return out, nil
+}
+
+func (e berElement) int() int {
+	v := 0
+	for _, b := range e.value {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// readBERElement reads one complete element from r
+func readBERElement(r *bufio.Reader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		size := int(first & 0x7f)
+		if size == 0 || size > 4 {
+			return berElement{}, fmt.Errorf("ldap: unsupported BER length")
+		}
+		n = 0
+		for i := 0; i < size; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n < 0 || n > 16<<20 {
+		return berElement{}, fmt.Errorf("ldap: message too large")
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return berElement{}, err
+	}
+	return berElement{tag, value}, nil
+}
+
+// escapeLDAPValue escapes s for use as a value in a search filter
+func escapeLDAPValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeLDAPValue decodes the \XX escapes of a filter value
+func unescapeLDAPValue(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("bad escape in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("bad escape in %q", s)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// encodeLDAPFilter encodes a string filter such as
+// "(&(objectClass=posixGroup)(memberUid=alice))"
+func encodeLDAPFilter(s string) ([]byte, error) {
+	filter, rest, err := parseLDAPFilter(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("ldap filter %q: %w", s, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap filter %q: trailing %q", s, rest)
+	}
+	return filter, nil
+}
+
+func parseLDAPFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("expected '('")
+	}
+	s = s[1:]
+
+	switch {
+	case strings.HasPrefix(s, "&"), strings.HasPrefix(s, "|"):
+		tag := byte(ldapFilterAnd)
+		if s[0] == '|' {
+			tag = ldapFilterOr
+		}
+		s = s[1:]
+		var items [][]byte
+		for strings.HasPrefix(s, "(") {
+			item, rest, err := parseLDAPFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			items, s = append(items, item), rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", fmt.Errorf("expected ')'")
+		}
+		return berEncode(tag, items...), s[1:], nil
+
+	case strings.HasPrefix(s, "!"):
+		item, rest, err := parseLDAPFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("expected ')'")
+		}
+		return berEncode(ldapFilterNot, item), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("expected ')'")
+	}
+	attr, value, ok := strings.Cut(s[:end], "=")
+	if !ok || attr == "" || strings.ContainsAny(attr, "<>~:") {
+		return nil, "", fmt.Errorf("unsupported item %q", s[:end])
+	}
+	rest := s[end+1:]
+	if value == "*" {
+		return berString(ldapFilterPresent, attr), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("substring matches are not supported")
+	}
+	value, err := unescapeLDAPValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berEncode(ldapFilterEquality, berString(berOctetString, attr), berString(berOctetString, value)), rest, nil
+}
+
+// ldapConn is an open connection to a directory server
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URI
+func dialLDAP(uri, caFile string, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		config := &tls.Config{ServerName: u.Hostname()}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("ldap: %w", err)
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("ldap: no certificates in %s", caFile)
+			}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, config)
+	default:
+		return nil, fmt.Errorf("ldap: unsupported URI %q (use ldap:// or ldaps://)", uri)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *ldapConn) Close() error {
+	return c.conn.Close()
+}
+
+// send writes one LDAPMessage with the next message ID
+func (c *ldapConn) send(op []byte) error {
+	c.id++
+	_, err := c.conn.Write(berEncode(berSequence, berInt(berInteger, c.id), op))
+	return err
+}
+
+// receive reads the protocol operation of the next message
+func (c *ldapConn) receive() (berElement, error) {
+	msg, err := readBERElement(c.r)
+	if err != nil {
+		return berElement{}, fmt.Errorf("ldap: %w", err)
+	}
+	fields, err := berParse(msg.value)
+	if err != nil {
+		return berElement{}, err
+	}
+	if msg.tag != berSequence || len(fields) < 2 || fields[0].int() != c.id {
+		return berElement{}, fmt.Errorf("ldap: unexpected message")
+	}
+	return fields[1], nil
+}
+
+// ldapResultError returns the error reported by an LDAPResult, if any
+func ldapResultError(op berElement) error {
+	fields, err := berParse(op.value)
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 || fields[0].tag != berEnumerated {
+		return fmt.Errorf("ldap: malformed result")
+	}
+	if code := fields[0].int(); code != 0 {
+		if msg := string(fields[2].value); msg != "" {
+			return fmt.Errorf("ldap: result code %d: %s", code, msg)
+		}
+		return fmt.Errorf("ldap: result code %d", code)
+	}
+	return nil
+}
+
+// bind authenticates with a DN and password
+func (c *ldapConn) bind(dn, password string) error {
+	err := c.send(berEncode(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(ldapAuthSimple, password)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return fmt.Errorf("ldap: unexpected bind response")
+	}
+	return ldapResultError(op)
+}
+
+// search runs a subtree search and returns the values of attr in all
+// matching entries
+func (c *ldapConn) search(base, filter, attr string, timeout time.Duration) ([]string, error) {
+	encoded, err := encodeLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	err = c.send(berEncode(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 0),
+		berInt(berInteger, int(timeout/time.Second)),
+		[]byte{0x01, 0x01, 0x00}, // typesOnly FALSE
+		encoded,
+		berEncode(berSequence, berString(berOctetString, attr))))
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for {
+		op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchDone:
+			return values, ldapResultError(op)
+		case ldapSearchReference:
+			continue
+		case ldapSearchEntry:
+		default:
+			return nil, fmt.Errorf("ldap: unexpected search response")
+		}
+
+		fields, err := berParse(op.value)
+		if err != nil || len(fields) < 2 {
+			return nil, fmt.Errorf("ldap: malformed search entry")
+		}
+		attrs, err := berParse(fields[1].value)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attrs {
+			parts, err := berParse(a.value)
+			if err != nil || len(parts) < 2 || !strings.EqualFold(string(parts[0].value), attr) {
+				continue
+			}
+			vals, err := berParse(parts[1].value)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range vals {
+				values = append(values, string(v.value))
+			}
+		}
+	}
+}
+
+// unbind ends the session politely before the connection is closed
+func (c *ldapConn) unbind() {
+	c.send(berEncode(ldapUnbindRequest))
+}
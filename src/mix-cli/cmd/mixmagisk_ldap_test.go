@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeLDAPFilter(t *testing.T) {
+	attr := func(tag byte, a, v string) []byte {
+		return berEncode(tag, berString(berOctetString, a), berString(berOctetString, v))
+	}
+	tests := []struct {
+		filter string
+		want   []byte
+	}{
+		{"(cn=wheel)", attr(ldapFilterEquality, "cn", "wheel")},
+		{"(memberUid=a\\2ab\\29)", attr(ldapFilterEquality, "memberUid", "a*b)")},
+		{"(cn=*)", berString(ldapFilterPresent, "cn")},
+		{"(&(objectClass=posixGroup)(|(memberUid=alice)(!(cn=x))))", berEncode(ldapFilterAnd,
+			attr(ldapFilterEquality, "objectClass", "posixGroup"),
+			berEncode(ldapFilterOr,
+				attr(ldapFilterEquality, "memberUid", "alice"),
+				berEncode(ldapFilterNot, attr(ldapFilterEquality, "cn", "x"))))},
+	}
+	for _, tt := range tests {
+		got, err := encodeLDAPFilter(tt.filter)
+		if err != nil {
+			t.Errorf("encodeLDAPFilter(%q) failed: %v", tt.filter, err)
+		} else if !bytes.Equal(got, tt.want) {
+			t.Errorf("encodeLDAPFilter(%q) = %x, want %x", tt.filter, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"cn=x", "(cn=x", "(cn=a*)", "(cn>=1)", "(cn=x))", "(cn=\\zz)"} {
+		if _, err := encodeLDAPFilter(bad); err == nil {
+			t.Errorf("encodeLDAPFilter(%q) accepted", bad)
+		}
+	}
+
+	if got := escapeLDAPValue("a*(b)\\"); got != `a\2a\28b\29\5c` {
+		t.Errorf("escapeLDAPValue = %q", got)
+	}
+}
+
+// fakeLDAPServer answers one bind and one search
+func fakeLDAPServer(t *testing.T, password string, groups []string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(id int, op []byte) {
+			conn.Write(berEncode(berSequence, berInt(berInteger, id), op))
+		}
+		result := func(tag byte, code int) []byte {
+			return berEncode(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, ""))
+		}
+
+		for {
+			msg, err := readBERElement(r)
+			if err != nil {
+				return
+			}
+			fields, _ := berParse(msg.value)
+			id, op := fields[0].int(), fields[1]
+			parts, _ := berParse(op.value)
+			switch op.tag {
+			case ldapBindRequest:
+				code := 0
+				if string(parts[2].value) != password {
+					code = 49 // invalidCredentials
+				}
+				reply(id, result(ldapBindResponse, code))
+			case ldapSearchRequest:
+				want, _ := encodeLDAPFilter("(&(objectClass=posixGroup)(memberUid=alice))")
+				if string(parts[0].value) == "ou=groups,dc=example,dc=com" && bytes.Equal(parts[6].value, want[2:]) {
+					for _, g := range groups {
+						reply(id, berEncode(ldapSearchEntry,
+							berString(berOctetString, "cn="+g+",ou=groups,dc=example,dc=com"),
+							berEncode(berSequence, berEncode(berSequence,
+								berString(berOctetString, "CN"),
+								berEncode(0x31, berString(berOctetString, g))))))
+					}
+				}
+				reply(id, result(ldapSearchDone, 0))
+			case ldapUnbindRequest:
+				return
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestLDAPDirectory(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "ldap.secret")
+	os.WriteFile(secret, []byte("s3cret\n"), 0600)
+
+	dir := &ldapDirectory{
+		uri:          "ldap://" + fakeLDAPServer(t, "s3cret", []string{"admins", "wheel"}),
+		base:         "ou=groups,dc=example,dc=com",
+		bindDN:       "cn=mixmagisk,dc=example,dc=com",
+		passwordFile: secret,
+		filter:       "(&(objectClass=posixGroup)(memberUid=%u))",
+		attribute:    "cn",
+		timeout:      5 * time.Second,
+	}
+	groups, err := dir.userGroups("alice")
+	if err != nil {
+		t.Fatalf("userGroups failed: %v", err)
+	}
+	if strings.Join(groups, ",") != "admins,wheel" {
+		t.Errorf("userGroups = %q", groups)
+	}
+
+	dir.uri = "ldap://" + fakeLDAPServer(t, "other", nil)
+	if _, err := dir.userGroups("alice"); err == nil || !strings.Contains(err.Error(), "49") {
+		t.Errorf("bad bind password: err = %v", err)
+	}
+}
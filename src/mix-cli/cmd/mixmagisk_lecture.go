@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ============================================================================
+// Lecture and Banner
+// ============================================================================
+//
+// The lecture is shown before the password prompt: with lecture = once
+// (the default) only the first time a user authenticates, with always
+// every time, never to disable it. Its text is read from lecture_file in
+// the [general] section of /etc/mixmagisk/config, or the built-in one.
+// Users who have seen it are recorded in lectureDir.
+//
+// A policy may also set banner, shown on every elevation of that user,
+// e.g. for legal notices:
+//
+//	banner = "Access is logged. Authorized use only."
+
+const lectureDir = "/var/cache/mixmagisk/lectured"
+
+const defaultLecture = `
+We trust you have received the usual lecture from the local System
+Administrator. It usually boils down to these three things:
+
+    #1) Respect the privacy of others.
+    #2) Think before you type.
+    #3) With great power comes great responsibility.
+
+Everything you run through mixmagisk is logged.
+
+`
+
+// showLecture prints the lecture if the configuration calls for it
+func showLecture(user string) {
+	s := loadMixmagiskSettings()
+	mode := s.str("general", "lecture", "once")
+	if mode == "never" || (mode == "once" && fileExists(filepath.Join(lectureDir, user))) {
+		return
+	}
+
+	text := defaultLecture
+	if path := s.str("general", "lecture_file", ""); path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			text = string(data)
+		}
+	}
+	fmt.Fprint(os.Stderr, text)
+}
+
+// markLectured records that user has seen the lecture
+func markLectured(user string) {
+	if err := os.MkdirAll(lectureDir, 0700); err != nil {
+		return
+	}
+	os.WriteFile(filepath.Join(lectureDir, user), nil, 0600)
+}
+
+// showBanner prints the banner of the user's policy, if any
+func showBanner(user string) {
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return
+	}
+	if banner, ok := policy.get("banner"); ok && banner != "" {
+		fmt.Fprintln(os.Stderr, unquoteBanner(banner))
+	}
+}
+
+// unquoteBanner strips optional surrounding quotes and expands \n and \t
+func unquoteBanner(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	return strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(s)
+}
@@ -0,0 +1,191 @@
+//go:build fido2
+
+package cmd
+
+/*
+#cgo LDFLAGS: -lfido2
+#include <fido.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// fido2TouchTimeout is how long a key waits to be touched, in milliseconds
+const fido2TouchTimeout = 30000
+
+var fido2Init sync.Once
+
+// fido2Error describes a libfido2 status code
+func fido2Error(r C.int) error {
+	if r == C.FIDO_ERR_PIN_REQUIRED {
+		return errFIDO2PINRequired
+	}
+	return fmt.Errorf("security key: %s", C.GoString(C.fido_strerr(r)))
+}
+
+// cBytes passes b to C for the duration of a call
+func cBytes(b []byte) (*C.uchar, C.size_t) {
+	if len(b) == 0 {
+		return nil, 0
+	}
+	return (*C.uchar)(unsafe.Pointer(&b[0])), C.size_t(len(b))
+}
+
+func goBytes(p *C.uchar, n C.size_t) []byte {
+	if p == nil || n == 0 {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(p), C.int(n))
+}
+
+// fido2Devices lists the paths of the security keys plugged in
+func fido2Devices() ([]string, error) {
+	fido2Init.Do(func() { C.fido_init(0) })
+	const max = 16
+	list := C.fido_dev_info_new(max)
+	if list == nil {
+		return nil, fmt.Errorf("security key: out of memory")
+	}
+	defer C.fido_dev_info_free(&list, max)
+
+	var n C.size_t
+	if r := C.fido_dev_info_manifest(list, max, &n); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	var paths []string
+	for i := C.size_t(0); i < n; i++ {
+		paths = append(paths, C.GoString(C.fido_dev_info_path(C.fido_dev_info_ptr(list, i))))
+	}
+	return paths, nil
+}
+
+// fido2Open opens the key at path; close it with fido2Close
+func fido2Open(path string) (*C.fido_dev_t, error) {
+	fido2Init.Do(func() { C.fido_init(0) })
+	dev := C.fido_dev_new()
+	if dev == nil {
+		return nil, fmt.Errorf("security key: out of memory")
+	}
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	if r := C.fido_dev_open(dev, cpath); r != C.FIDO_OK {
+		C.fido_dev_free(&dev)
+		return nil, fmt.Errorf("%s: %w", path, fido2Error(r))
+	}
+	C.fido_dev_set_timeout(dev, fido2TouchTimeout)
+	return dev, nil
+}
+
+func fido2Close(dev *C.fido_dev_t) {
+	C.fido_dev_close(dev)
+	C.fido_dev_free(&dev)
+}
+
+// fido2MakeCredential registers a new ES256 credential for user on the key
+func fido2MakeCredential(device, rpID, user string, userID, cdh []byte, pin string) (*fido2Credential, error) {
+	dev, err := fido2Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer fido2Close(dev)
+
+	cred := C.fido_cred_new()
+	if cred == nil {
+		return nil, fmt.Errorf("security key: out of memory")
+	}
+	defer C.fido_cred_free(&cred)
+
+	crp := C.CString(rpID)
+	defer C.free(unsafe.Pointer(crp))
+	cuser := C.CString(user)
+	defer C.free(unsafe.Pointer(cuser))
+	hash, hashLen := cBytes(cdh)
+	id, idLen := cBytes(userID)
+
+	if r := C.fido_cred_set_type(cred, C.COSE_ES256); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if r := C.fido_cred_set_clientdata_hash(cred, hash, hashLen); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if r := C.fido_cred_set_rp(cred, crp, nil); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if r := C.fido_cred_set_user(cred, id, idLen, cuser, nil, nil); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+
+	var cpin *C.char
+	if pin != "" {
+		cpin = C.CString(pin)
+		defer C.free(unsafe.Pointer(cpin))
+	}
+	if r := C.fido_dev_make_cred(dev, cred, cpin); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+
+	// Keys without an attestation certificate sign with the new credential
+	r := C.fido_cred_verify_self(cred)
+	if C.fido_cred_x5c_ptr(cred) != nil {
+		r = C.fido_cred_verify(cred)
+	}
+	if r != C.FIDO_OK {
+		return nil, fmt.Errorf("attestation: %w", fido2Error(r))
+	}
+	return &fido2Credential{
+		ID:        goBytes(C.fido_cred_id_ptr(cred), C.fido_cred_id_len(cred)),
+		PublicKey: goBytes(C.fido_cred_pubkey_ptr(cred), C.fido_cred_pubkey_len(cred)),
+	}, nil
+}
+
+// fido2GetAssertion has the key sign cdh with one of the allowed
+// credentials once the user touches it
+func fido2GetAssertion(device, rpID string, cdh []byte, allow [][]byte) (*fido2Assertion, error) {
+	dev, err := fido2Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer fido2Close(dev)
+
+	assert := C.fido_assert_new()
+	if assert == nil {
+		return nil, fmt.Errorf("security key: out of memory")
+	}
+	defer C.fido_assert_free(&assert)
+
+	crp := C.CString(rpID)
+	defer C.free(unsafe.Pointer(crp))
+	hash, hashLen := cBytes(cdh)
+
+	if r := C.fido_assert_set_clientdata_hash(assert, hash, hashLen); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if r := C.fido_assert_set_rp(assert, crp); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	for _, credID := range allow {
+		id, idLen := cBytes(credID)
+		if r := C.fido_assert_allow_cred(assert, id, idLen); r != C.FIDO_OK {
+			return nil, fido2Error(r)
+		}
+	}
+	if r := C.fido_assert_set_up(assert, C.FIDO_OPT_TRUE); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if r := C.fido_dev_get_assert(dev, assert, nil); r != C.FIDO_OK {
+		return nil, fido2Error(r)
+	}
+	if C.fido_assert_count(assert) != 1 {
+		return nil, fmt.Errorf("security key returned %d assertions", C.fido_assert_count(assert))
+	}
+	return &fido2Assertion{
+		CredentialID: goBytes(C.fido_assert_id_ptr(assert, 0), C.fido_assert_id_len(assert, 0)),
+		AuthData:     goBytes(C.fido_assert_authdata_ptr(assert, 0), C.fido_assert_authdata_len(assert, 0)),
+		Signature:    goBytes(C.fido_assert_sig_ptr(assert, 0), C.fido_assert_sig_len(assert, 0)),
+	}, nil
+}
@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// Umask, Working Directory and Resource Limits
+// ============================================================================
+//
+//	umask = 027
+//	cwd = /srv/app
+//	allowed_cwd = /srv/*, /home/deploy
+//	rlimit_nofile = 1024
+//	rlimit_nproc = 256:512
+//	rlimit_core = 0
+//
+// umask is the file creation mask of elevated commands. cwd is the
+// directory they start in (inside the jail with chroot). allowed_cwd lists
+// the directories, as glob patterns, mixmagisk may be run from; their
+// subdirectories are allowed too. rlimit_nofile, rlimit_nproc and
+// rlimit_core set the limits on open files, processes of the target user
+// and core dump size: one value sets both the soft and the hard limit,
+// "soft:hard" sets them apart and "unlimited" removes the limit.
+//
+// The umask and limits are set in mixmagisk itself just before the command
+// starts, so that it inherits them, and are put back once it has ended.
+
+// rlimitNames are the resource limits a policy may set, in the order they
+// are applied
+var rlimitNames = []string{"nofile", "nproc", "core"}
+
+var rlimitResources = map[string]int{
+	"nofile": unix.RLIMIT_NOFILE,
+	"nproc":  unix.RLIMIT_NPROC,
+	"core":   unix.RLIMIT_CORE,
+}
+
+// resourceLimit is one rlimit_* key
+type resourceLimit struct {
+	name  string
+	limit syscall.Rlimit
+}
+
+// processLimits is the umask, directory and resource limit setup of a
+// policy
+type processLimits struct {
+	umask   int // -1 keeps the caller's umask
+	cwd     string
+	allowed []string
+	rlimits []resourceLimit
+}
+
+// processLimits parses the umask, cwd, allowed_cwd and rlimit_* keys; it
+// returns nil when the policy sets none of them
+func (p *policyFile) processLimits() (*processLimits, error) {
+	l := &processLimits{umask: -1}
+	if v, ok := p.get("umask"); ok && v != "" {
+		mask, err := parseUmask(v)
+		if err != nil {
+			return nil, fmt.Errorf("umask: %w", err)
+		}
+		l.umask = mask
+	}
+	if v, ok := p.get("cwd"); ok && v != "" {
+		if !filepath.IsAbs(v) {
+			return nil, fmt.Errorf("cwd: %s is not an absolute path", v)
+		}
+		l.cwd = filepath.Clean(v)
+	}
+	for _, pattern := range p.values("allowed_cwd") {
+		if err := validateCwdPattern(pattern); err != nil {
+			return nil, fmt.Errorf("allowed_cwd: %w", err)
+		}
+		l.allowed = append(l.allowed, filepath.Clean(pattern))
+	}
+	for _, name := range rlimitNames {
+		v, ok := p.get("rlimit_" + name)
+		if !ok || v == "" {
+			continue
+		}
+		limit, err := parseRlimit(v)
+		if err != nil {
+			return nil, fmt.Errorf("rlimit_%s: %w", name, err)
+		}
+		l.rlimits = append(l.rlimits, resourceLimit{name, limit})
+	}
+	if l.umask < 0 && l.cwd == "" && len(l.allowed) == 0 && len(l.rlimits) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// parseUmask parses an octal umask such as 027 or 0077
+func parseUmask(v string) (int, error) {
+	mask, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("expected an octal mask like 027, got %q", v)
+	}
+	return int(mask), nil
+}
+
+// parseRlimit parses "n", "soft:hard" or "unlimited"
+func parseRlimit(v string) (syscall.Rlimit, error) {
+	value := func(s string) (uint64, error) {
+		if s == "unlimited" || s == "infinity" {
+			return unix.RLIM_INFINITY, nil
+		}
+		return strconv.ParseUint(s, 10, 64)
+	}
+	soft, hard, split := strings.Cut(v, ":")
+	if !split {
+		hard = soft
+	}
+	cur, err1 := value(strings.TrimSpace(soft))
+	max, err2 := value(strings.TrimSpace(hard))
+	if err1 != nil || err2 != nil {
+		return syscall.Rlimit{}, fmt.Errorf("expected a number, soft:hard or unlimited, got %q", v)
+	}
+	if cur > max {
+		return syscall.Rlimit{}, fmt.Errorf("soft limit above the hard limit in %q", v)
+	}
+	return syscall.Rlimit{Cur: cur, Max: max}, nil
+}
+
+func validateUmask(v string) error {
+	_, err := parseUmask(v)
+	return err
+}
+
+func validateCwd(v string) error {
+	if !filepath.IsAbs(v) {
+		return fmt.Errorf("expected an absolute path, got %q", v)
+	}
+	return nil
+}
+
+func validateCwdPattern(v string) error {
+	if !filepath.IsAbs(v) {
+		return fmt.Errorf("expected an absolute path, got %q", v)
+	}
+	if _, err := filepath.Match(v, ""); err != nil {
+		return fmt.Errorf("bad pattern %q", v)
+	}
+	return nil
+}
+
+func validateRlimit(v string) error {
+	_, err := parseRlimit(v)
+	return err
+}
+
+// policyProcessLimits returns the process limits of user's policy, or nil
+func policyProcessLimits(user string) (*processLimits, error) {
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return nil, nil
+	}
+	return policy.processLimits()
+}
+
+// allowsCwd reports whether mixmagisk may be run from dir: it or one of
+// its parents matches allowed_cwd. Without allowed_cwd every directory
+// is allowed; an unknown directory ("") is not.
+func (l *processLimits) allowsCwd(dir string) bool {
+	if l == nil || len(l.allowed) == 0 {
+		return true
+	}
+	if !filepath.IsAbs(dir) {
+		return false
+	}
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if matchAny(l.allowed, dir) {
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
+
+// apply sets the working directory of cmd and the umask and resource
+// limits it will inherit. The returned function restores mixmagisk's own
+// once the command has ended. A nil processLimits does nothing.
+func (l *processLimits) apply(cmd *exec.Cmd) (restore func(), err error) {
+	var undo []func()
+	restore = func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	if l == nil {
+		return restore, nil
+	}
+	if l.cwd != "" {
+		cmd.Dir = l.cwd
+	}
+	for _, r := range l.rlimits {
+		resource := rlimitResources[r.name]
+		var old syscall.Rlimit
+		if err := syscall.Getrlimit(resource, &old); err != nil {
+			restore()
+			return nil, fmt.Errorf("rlimit_%s: %w", r.name, err)
+		}
+		limit := r.limit
+		if err := syscall.Setrlimit(resource, &limit); err != nil {
+			restore()
+			return nil, fmt.Errorf("rlimit_%s: %w", r.name, err)
+		}
+		undo = append(undo, func() { syscall.Setrlimit(resource, &old) })
+	}
+	if l.umask >= 0 {
+		old := syscall.Umask(l.umask)
+		undo = append(undo, func() { syscall.Umask(old) })
+	}
+	return restore, nil
+}
+
+// describe summarizes the limits for the audit log; "" when there are
+// none to report
+func (l *processLimits) describe() string {
+	if l == nil {
+		return ""
+	}
+	var parts []string
+	if l.umask >= 0 {
+		parts = append(parts, fmt.Sprintf("umask %04o", l.umask))
+	}
+	if l.cwd != "" {
+		parts = append(parts, "cwd "+l.cwd)
+	}
+	for _, r := range l.rlimits {
+		parts = append(parts, r.name+" "+formatRlimit(r.limit))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatRlimit(r syscall.Rlimit) string {
+	value := func(n uint64) string {
+		if n == unix.RLIM_INFINITY {
+			return "unlimited"
+		}
+		return strconv.FormatUint(n, 10)
+	}
+	if r.Cur == r.Max {
+		return value(r.Cur)
+	}
+	return value(r.Cur) + ":" + value(r.Max)
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Audit Log Export
+// ============================================================================
+//
+//	mixmagisk log export [--format jsonl|cef|auditd] [--since S]
+//	                     [--user U] [--action A] [--all]
+//
+// Writes the matching records, oldest first, to stdout for a SIEM to
+// ingest. jsonl is the log's own JSON records. cef is ArcSight Common
+// Event Format. auditd mimics Linux audit USER_* records the way sudo
+// writes them, so that ausearch-style parsers read them. Only root, by
+// real uid, can export.
+
+// exportQuery holds the options of "mixmagisk log export"
+type exportQuery struct {
+	auditQuery
+	format string
+}
+
+// logExportFormats lists the --format values
+var logExportFormats = []string{"jsonl", "cef", "auditd"}
+
+// parseExportArgs parses the options of "mixmagisk log export"
+func parseExportArgs(args []string, now time.Time) (*exportQuery, error) {
+	q := &exportQuery{}
+	var since string
+
+	fs := flag.NewFlagSet("mixmagisk log export", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&q.format, "format", "jsonl", "jsonl, cef or auditd")
+	fs.StringVar(&since, "since", "", "only entries newer than a duration or date")
+	fs.StringVar(&q.user, "user", "", "only entries by this user")
+	fs.StringVar(&q.action, "action", "", "only this action or result")
+	fs.BoolVar(&q.all, "all", false, "include rotated logs")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if !slices.Contains(logExportFormats, q.format) {
+		return nil, fmt.Errorf("unknown format %q (use %s)", q.format, strings.Join(logExportFormats, ", "))
+	}
+	if since != "" {
+		t, err := parseSince(since, now)
+		if err != nil {
+			return nil, err
+		}
+		q.since = t
+	}
+	return q, nil
+}
+
+// exportAuditLog handles "mixmagisk log export"
+func exportAuditLog(args []string) {
+	if os.Getuid() != 0 {
+		fmt.Fprintln(os.Stderr, "Error: Must be root to export the log")
+		os.Exit(exitError)
+	}
+	q, err := parseExportArgs(args, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintln(os.Stderr, "Usage: mixmagisk log export [--format jsonl|cef|auditd] [--since 2h] [--user U] [--action A] [--all]")
+		os.Exit(exitError)
+	}
+	records, err := readAuditRecords(q.all)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading log: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	host, _ := os.Hostname()
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	serial := 0
+	for _, r := range records {
+		if !q.matches(r) {
+			continue
+		}
+		serial++
+		switch q.format {
+		case "cef":
+			fmt.Fprintln(w, formatCEF(r, host))
+		case "auditd":
+			fmt.Fprintln(w, formatAuditd(r, serial))
+		default:
+			line, _ := json.Marshal(r)
+			fmt.Fprintf(w, "%s\n", line)
+		}
+	}
+}
+
+// cefSeverity maps a result to the 0-10 CEF severity
+var cefSeverity = map[string]int{
+	"success": 3,
+	"failed":  5,
+	"error":   6,
+	"denied":  8,
+}
+
+// cefHeader escapes a CEF header field
+var cefHeader = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+
+// cefValue escapes a CEF extension value
+var cefValue = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// formatCEF renders r as one CEF:0 line
+func formatCEF(r *auditRecord, host string) string {
+	severity, ok := cefSeverity[r.Result]
+	if !ok {
+		severity = 3
+	}
+	name := strings.ReplaceAll(r.Action, "_", " ")
+	header := []string{"CEF:0", "MixOS", "mixmagisk", mixmagiskVersion, r.Action, name, strconv.Itoa(severity)}
+	for i, h := range header {
+		header[i] = cefHeader.Replace(h)
+	}
+
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefValue.Replace(value))
+		}
+	}
+	add("rt", strconv.FormatInt(r.Time.UnixMilli(), 10))
+	add("dvchost", host)
+	add("act", r.Action)
+	add("outcome", r.Result)
+	add("suser", r.User)
+	add("suid", strconv.Itoa(r.UID))
+	if r.Target != "" {
+		add("duser", strings.SplitN(r.Target, ":", 2)[0])
+	}
+	add("dproc", r.Command)
+	if len(r.Argv) > 0 {
+		add("cs1Label", "argv")
+		add("cs1", strings.Join(r.Argv, " "))
+	}
+	if r.TTY != "" {
+		add("cs2Label", "tty")
+		add("cs2", r.TTY)
+	}
+	if r.Cwd != "" {
+		add("cs3Label", "cwd")
+		add("cs3", r.Cwd)
+	}
+	if r.Target != "" {
+		add("cs4Label", "target")
+		add("cs4", r.Target)
+	}
+	if r.Signal != "" {
+		add("cs5Label", "signal")
+		add("cs5", r.Signal)
+	}
+	if r.ExitCode != nil {
+		add("cn1Label", "exit_code")
+		add("cn1", strconv.Itoa(*r.ExitCode))
+	}
+	if r.Start != nil {
+		add("start", strconv.FormatInt(r.Start.UnixMilli(), 10))
+		add("end", strconv.FormatInt(r.Time.UnixMilli(), 10))
+	}
+	add("msg", r.Details)
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+// auditdType picks the Linux audit record type for an action
+func auditdType(action string) string {
+	switch {
+	case action == "execute" || strings.HasPrefix(action, "shell"):
+		return "USER_CMD"
+	case action == "denied" || strings.HasPrefix(action, "auth_"):
+		return "USER_AUTH"
+	case action == "policy_edit":
+		return "USER_MGMT"
+	case strings.HasPrefix(action, "policy_"):
+		return "USER_ACCT" // access decisions
+	case action == "grant" || action == "revoke" || action == "grant_expired" ||
+		action == "session_kill" || strings.HasPrefix(action, "fido_"):
+		return "USER_MGMT"
+	}
+	return "TRUSTED_APP"
+}
+
+// auditdValue quotes a field value, or hex encodes it when it holds
+// spaces, quotes or control characters, as the kernel audit does
+func auditdValue(s string) string {
+	for _, c := range []byte(s) {
+		if c <= 0x20 || c >= 0x7f || c == '"' || c == '\'' {
+			return strings.ToUpper(hex.EncodeToString([]byte(s)))
+		}
+	}
+	return `"` + s + `"`
+}
+
+// formatAuditd renders r as one audit record with serial number serial
+func formatAuditd(r *auditRecord, serial int) string {
+	fields := []string{"op=" + auditdValue(r.Action), "acct=" + auditdValue(r.User)}
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+auditdValue(value))
+		}
+	}
+	add("target", r.Target)
+	add("cwd", r.Cwd)
+	if len(r.Argv) > 0 {
+		add("cmd", strings.Join(r.Argv, " "))
+	}
+	add("exe", r.Command)
+	if r.ExitCode != nil {
+		fields = append(fields, "exit="+strconv.Itoa(*r.ExitCode))
+	}
+	add("reason", r.Details)
+	terminal := strings.TrimPrefix(r.TTY, "/dev/")
+	if terminal == "" {
+		terminal = "?"
+	}
+	fields = append(fields, "terminal="+terminal)
+	res := "success"
+	if r.Result != "success" {
+		res = "failed"
+	}
+	fields = append(fields, "res="+res)
+
+	ms := r.Time.UnixMilli()
+	return fmt.Sprintf("type=%s msg=audit(%d.%03d:%d): uid=%d msg='%s'",
+		auditdType(r.Action), ms/1000, ms%1000, serial, r.UID, strings.Join(fields, " "))
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Audit Log Queries
+// ============================================================================
+//
+//	mixmagisk log [--user U] [--action A] [--since S] [--grep TEXT]
+//	              [--limit N] [--page P] [--all] [--json]
+//
+// --action matches the action name (execute, grant, policy_deny, ...) or the
+// result (success, failed, denied, error). --since takes a duration ("2h",
+// "7d") or a date ("2024-06-01", RFC 3339). Entries are shown oldest first;
+// page 1 is the newest --limit entries, page 2 the ones before, and so on.
+// Only root (by real uid) reads other users' entries; everyone else sees
+// their own.
+
+// auditQuery holds the log filters and output options
+type auditQuery struct {
+	user   string
+	action string
+	grep   string
+	since  time.Time
+	limit  int
+	page   int
+	all    bool // include rotated logs
+	json   bool
+}
+
+// parseAuditQuery parses the options of "mixmagisk log"
+func parseAuditQuery(args []string, now time.Time) (*auditQuery, error) {
+	q := &auditQuery{}
+	var since string
+
+	fs := flag.NewFlagSet("mixmagisk log", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&q.user, "user", "", "only entries by this user")
+	fs.StringVar(&q.action, "action", "", "only this action or result")
+	fs.StringVar(&q.grep, "grep", "", "only entries whose command or details contain text")
+	fs.StringVar(&since, "since", "", "only entries newer than a duration or date")
+	fs.IntVar(&q.limit, "limit", 20, "entries per page (0 for all)")
+	fs.IntVar(&q.page, "page", 1, "page number, 1 is the newest")
+	fs.BoolVar(&q.all, "all", false, "include rotated logs")
+	fs.BoolVar(&q.json, "json", false, "print JSON records")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if q.limit < 0 || q.page < 1 {
+		return nil, fmt.Errorf("--limit must be >= 0 and --page >= 1")
+	}
+	if since != "" {
+		t, err := parseSince(since, now)
+		if err != nil {
+			return nil, err
+		}
+		q.since = t
+	}
+	return q, nil
+}
+
+// parseSince parses a relative duration ("90m", "2h", "7d") or a date
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q (use e.g. 2h, 7d or 2024-06-01)", s)
+}
+
+// matches reports whether r passes every filter
+func (q *auditQuery) matches(r *auditRecord) bool {
+	if q.user != "" && r.User != q.user {
+		return false
+	}
+	if q.action != "" && r.Action != q.action && r.Result != q.action {
+		return false
+	}
+	if !q.since.IsZero() && r.Time.Before(q.since) {
+		return false
+	}
+	if q.grep != "" && !strings.Contains(strings.Join(r.Argv, " "), q.grep) &&
+		!strings.Contains(r.Details, q.grep) {
+		return false
+	}
+	return true
+}
+
+// paginate returns the requested page of records, oldest first
+func (q *auditQuery) paginate(records []*auditRecord) []*auditRecord {
+	if q.limit == 0 {
+		return records
+	}
+	end := len(records) - (q.page-1)*q.limit
+	if end <= 0 {
+		return nil
+	}
+	return records[max(end-q.limit, 0):end]
+}
+
+// legacyAuditLine matches lines written before the JSON format
+var legacyAuditLine = regexp.MustCompile(`^(\S+) \[([^\]]*)\] user=(\S*) action=\S* details="(.*)"$`)
+
+// parseLegacyAuditLine converts a pre-JSON line into a record
+func parseLegacyAuditLine(line string) (*auditRecord, bool) {
+	m := legacyAuditLine.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	t, err := time.Parse(time.RFC3339, m[1])
+	if err != nil {
+		return nil, false
+	}
+	return &auditRecord{Time: t, Action: m[2], User: m[3], Details: m[4], Result: actionResult(m[2])}, true
+}
+
+// readAuditRecords reads the current log, preceded by the rotated logs
+// (oldest first) when all is set
+func readAuditRecords(all bool) ([]*auditRecord, error) {
+	var files []string
+	if all {
+		lr := loadLogRotation()
+		for n := max(lr.retain, 1); n >= 1; n-- {
+			for _, compress := range []bool{true, false} {
+				if name := rotatedLogName(mixmagiskLog, n, compress); fileExists(name) {
+					files = append(files, name)
+				}
+			}
+		}
+	}
+	files = append(files, mixmagiskLog)
+
+	var records []*auditRecord
+	for _, name := range files {
+		recs, err := readAuditFile(name)
+		if err != nil {
+			if os.IsNotExist(err) && name == mixmagiskLog {
+				continue
+			}
+			return nil, err
+		}
+		records = append(records, recs...)
+	}
+	return records, nil
+}
+
+// readAuditFile reads the records of one (possibly gzipped) log
+func readAuditFile(name string) ([]*auditRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	var records []*auditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if rec, ok := parseAuditLine(line); ok {
+			records = append(records, rec)
+		} else if rec, ok := parseLegacyAuditLine(line); ok {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
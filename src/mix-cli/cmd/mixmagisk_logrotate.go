@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// Audit Log Rotation
+// ============================================================================
+//
+// The log is rotated when it exceeds max_size or its oldest record is older
+// than max_age days. Rotated logs are gzipped as mixmagisk.log.1.gz (newest)
+// up to mixmagisk.log.<retain>.gz; older ones are deleted. Settings live in
+// the [log] section of /etc/mixmagisk/config:
+//
+//	[log]
+//	max_size = 10M
+//	max_age = 30
+//	retain = 5
+//	compress = true
+
+const (
+	defaultLogMaxSizeMB = 10
+	defaultLogMaxAge    = 30
+	defaultLogRetain    = 5
+)
+
+// logRotation holds the rotation settings
+type logRotation struct {
+	maxSize  int64 // bytes, 0 disables size-based rotation
+	maxAge   int   // days, 0 disables age-based rotation
+	retain   int
+	compress bool
+}
+
+func loadLogRotation() logRotation {
+	s := loadMixmagiskSettings()
+	return logRotation{
+		maxSize:  s.sizeMB("log", "max_size", defaultLogMaxSizeMB) * 1024 * 1024,
+		maxAge:   s.integer("log", "max_age", defaultLogMaxAge),
+		retain:   s.integer("log", "retain", defaultLogRetain),
+		compress: s.boolean("log", "compress", true),
+	}
+}
+
+// lockAuditLog takes an exclusive lock that serializes writers and rotation
+func lockAuditLog() (*os.File, error) {
+	f, err := os.OpenFile(mixmagiskLog+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// due reports whether the log at path should be rotated now
+func (lr logRotation) due(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	if lr.maxSize > 0 && info.Size() >= lr.maxSize {
+		return true
+	}
+	if lr.maxAge > 0 {
+		if oldest, ok := oldestAuditTime(path); ok {
+			return time.Since(oldest) >= time.Duration(lr.maxAge)*24*time.Hour
+		}
+	}
+	return false
+}
+
+// oldestAuditTime returns the time of the first JSON record in path
+func oldestAuditTime(path string) (time.Time, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if r, ok := parseAuditLine(scanner.Text()); ok {
+			return r.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// rotatedLogName returns the name of rotated log n
+func rotatedLogName(path string, n int, compress bool) string {
+	name := fmt.Sprintf("%s.%d", path, n)
+	if compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// rotate shifts the rotated logs up by one, moves the current log to .1
+// (compressing it) and drops logs beyond the retention count. The caller
+// holds the audit log lock.
+func (lr logRotation) rotate(path string) error {
+	retain := lr.retain
+	if retain < 1 {
+		retain = 1
+	}
+
+	// Drop the oldest logs so that at most retain remain after the shift
+	matches, _ := filepath.Glob(path + ".*")
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		if n, err := strconv.Atoi(suffix); err == nil && n >= retain {
+			os.Remove(m)
+		}
+	}
+
+	for n := retain - 1; n >= 1; n-- {
+		for _, compress := range []bool{true, false} {
+			from := rotatedLogName(path, n, compress)
+			if _, err := os.Stat(from); err == nil {
+				if err := os.Rename(from, rotatedLogName(path, n+1, compress)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if !lr.compress {
+		return os.Rename(path, rotatedLogName(path, 1, false))
+	}
+	if err := gzipFile(path, rotatedLogName(path, 1, true)); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// gzipFile writes a gzip-compressed copy of src to dst
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst + ".tmp")
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// maybeRotateAuditLog rotates the log if it is due; called with the audit
+// log lock held before each write
+func maybeRotateAuditLog() {
+	lr := loadLogRotation()
+	if lr.due(mixmagiskLog) {
+		lr.rotate(mixmagiskLog)
+	}
+}
+
+// rotateAuditLogNow implements "mixmagisk log rotate"
+func rotateAuditLogNow() {
+	if os.Getuid() != 0 {
+		fmt.Println("Error: Must be root to rotate the log")
+		return
+	}
+	lock, err := lockAuditLog()
+	if err != nil {
+		fmt.Printf("Error locking log: %v\n", err)
+		return
+	}
+	defer lock.Close()
+
+	if info, err := os.Stat(mixmagiskLog); err != nil || info.Size() == 0 {
+		fmt.Println("Nothing to rotate")
+		return
+	}
+	lr := loadLogRotation()
+	if err := lr.rotate(mixmagiskLog); err != nil {
+		fmt.Printf("Error rotating log: %v\n", err)
+		return
+	}
+	fmt.Printf("✅ Rotated %s (keeping %d old logs)\n", mixmagiskLog, max(lr.retain, 1))
+}
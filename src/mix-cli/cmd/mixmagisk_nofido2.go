@@ -0,0 +1,18 @@
+//go:build !fido2
+
+package cmd
+
+// Without the "fido2" tag there is no libfido2 to talk to security keys;
+// policies that require one cannot be satisfied.
+
+func fido2Devices() ([]string, error) {
+	return nil, errFIDO2Unavailable
+}
+
+func fido2MakeCredential(device, rpID, user string, userID, cdh []byte, pin string) (*fido2Credential, error) {
+	return nil, errFIDO2Unavailable
+}
+
+func fido2GetAssertion(device, rpID string, cdh []byte, allow [][]byte) (*fido2Assertion, error) {
+	return nil, errFIDO2Unavailable
+}
@@ -0,0 +1,9 @@
+//go:build !pam
+
+package cmd
+
+// pamAuthenticate is unavailable in builds without the "pam" tag; callers
+// fall back to the hash file.
+func pamAuthenticate(user, password string) (bool, error) {
+	return false, errPAMUnavailable
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// Notifications
+// ============================================================================
+//
+// The [notify] section of /etc/mixmagisk/config alerts admins about
+// security events as they happen:
+//
+//	[notify]
+//	events = denied, auth_failed
+//	webhook = https://alerts.example.com/mixmagisk
+//	exec = /usr/local/sbin/mixmagisk-alert
+//	timeout = 5
+//
+// events lists audit actions (auth_failed, policy_time_deny, ...) or
+// results (denied, failed, error) to report; the default, denied, covers
+// access and policy denials, failed and expired authentication, and
+// auth_lockout after the last of the allowed password attempts. Runs of
+// "mix upgrade schedule" are reported as action upgrade, with result
+// success or failed.
+// webhook receives the audit record as a JSON POST; exec runs a program
+// with the record as JSON on stdin and its main fields in MIXMAGISK_*
+// environment variables. Both are given timeout seconds to finish.
+
+// notifyAuditRecord sends r to the configured webhook and program if its
+// action or result is one of the notify events
+func notifyAuditRecord(r *auditRecord) {
+	s := loadMixmagiskSettings()
+	webhook := s.str("notify", "webhook", "")
+	program := s.str("notify", "exec", "")
+	if webhook == "" && program == "" {
+		return
+	}
+
+	if !notifyEventMatches(s.str("notify", "events", "denied"), r) {
+		return
+	}
+
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	timeout := time.Duration(s.integer("notify", "timeout", 5)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if webhook != "" {
+		if err := postNotification(ctx, webhook, payload); err != nil {
+			fmt.Fprintf(os.Stderr, "mixmagisk: notify webhook: %v\n", err)
+		}
+	}
+	if program != "" {
+		if err := execNotification(ctx, program, r, payload); err != nil {
+			fmt.Fprintf(os.Stderr, "mixmagisk: notify exec: %v\n", err)
+		}
+	}
+}
+
+// notifyEventMatches reports whether the action or result of r is in the
+// comma-separated list of events
+func notifyEventMatches(events string, r *auditRecord) bool {
+	for _, event := range strings.Split(events, ",") {
+		event = strings.TrimSpace(event)
+		if event == r.Action || event == r.Result {
+			return true
+		}
+	}
+	return false
+}
+
+// postNotification POSTs the JSON payload to url
+func postNotification(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mixmagisk/"+mixmagiskVersion)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// execNotification runs program with the record on stdin
+func execNotification(ctx context.Context, program string, r *auditRecord, payload []byte) error {
+	cmd := exec.CommandContext(ctx, program)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if os.Geteuid() == 0 {
+		// Run as full root, not with the caller's real uid
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{}}
+	}
+	cmd.Env = []string{
+		"PATH=" + secureSearchPath,
+		"MIXMAGISK_ACTION=" + r.Action,
+		"MIXMAGISK_RESULT=" + r.Result,
+		"MIXMAGISK_USER=" + r.User,
+		"MIXMAGISK_TTY=" + r.TTY,
+		"MIXMAGISK_TARGET=" + r.Target,
+		"MIXMAGISK_COMMAND=" + strings.Join(r.Argv, " "),
+		"MIXMAGISK_DETAILS=" + r.Details,
+	}
+	return cmd.Run()
+}
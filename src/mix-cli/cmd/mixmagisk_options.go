@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ============================================================================
+// Command Line Options
+// ============================================================================
+//
+// mixmagisk parses its own options (cobra's flag parsing is disabled) so
+// that everything after the first non-option word belongs to the command
+// being run: "mixmagisk -u postgres psql -l" passes -l to psql.
+
+// mixmagiskOptions holds the options given before the command
+type mixmagiskOptions struct {
+	User    string // -u: target user (default root)
+	Group   string // -g: target group (default the user's primary group)
+	Shell   bool   // -i: interactive shell
+	AskPass bool   // -A: read the password with the askpass program
+	Stdin   bool   // -S: read the password from stdin, for scripts
+	Help    bool
+	Version bool
+
+	Invalidate bool // -k: drop this terminal's ticket first
+	RemoveAll  bool // -K: drop all of the user's tickets
+}
+
+// hasTarget reports whether -u or -g was given
+func (o *mixmagiskOptions) hasTarget() bool {
+	return o.User != "" || o.Group != ""
+}
+
+// parseMixmagiskArgs splits args into options and the command to run.
+// Accepted forms: -u NAME, -uNAME, --user NAME, --user=NAME (same for -g /
+// --group), -i/--interactive, -A/--askpass, -S/--stdin, -k/--reset-timestamp,
+// -K/--remove-timestamp, -h/--help, -v/--version and "--".
+func parseMixmagiskArgs(args []string) (*mixmagiskOptions, []string, error) {
+	opts := &mixmagiskOptions{}
+
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			return opts, args[1:], nil
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		args = args[1:]
+
+		name, value, hasValue := arg, "", false
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue = strings.Cut(arg, "=")
+		case len(arg) > 2:
+			name, value, hasValue = arg[:2], arg[2:], true
+		}
+
+		var dst *string
+		switch name {
+		case "-u", "--user":
+			dst = &opts.User
+		case "-g", "--group":
+			dst = &opts.Group
+		case "-i", "--interactive":
+			opts.Shell = true
+		case "-A", "--askpass":
+			opts.AskPass = true
+		case "-S", "--stdin":
+			opts.Stdin = true
+		case "-k", "--reset-timestamp":
+			opts.Invalidate = true
+		case "-K", "--remove-timestamp":
+			opts.RemoveAll = true
+		case "-h", "--help":
+			opts.Help = true
+		case "-v", "--version":
+			opts.Version = true
+		default:
+			return nil, nil, fmt.Errorf("unknown option: %s", arg)
+		}
+
+		if dst == nil {
+			if hasValue {
+				return nil, nil, fmt.Errorf("option %s takes no value", name)
+			}
+			continue
+		}
+		if !hasValue {
+			if len(args) == 0 {
+				return nil, nil, fmt.Errorf("option %s requires a value", name)
+			}
+			value, args = args[0], args[1:]
+		}
+		if value == "" {
+			return nil, nil, fmt.Errorf("option %s requires a value", name)
+		}
+		*dst = value
+	}
+	return opts, args, nil
+}
+
+// ============================================================================
+// Target Identity
+// ============================================================================
+
+// runTarget is the resolved identity a command runs as
+type runTarget struct {
+	User   string
+	Group  string
+	UID    uint32
+	GID    uint32
+	Groups []uint32 // supplementary groups of the target user
+	Home   string
+	Caps   []uintptr // ambient capabilities, see mixmagisk_caps.go
+	Dir    string    // working directory of commands, "" for the current one
+
+	primaryGID uint32   // the user's own group, always permitted
+	capNames   []string // names of Caps for messages
+}
+
+// String renders the target as user:group, followed by "+caps" when
+// capabilities are raised, for messages and the log
+func (t *runTarget) String() string {
+	if len(t.capNames) > 0 {
+		return t.User + ":" + t.Group + "+" + strings.Join(t.capNames, ",")
+	}
+	return t.User + ":" + t.Group
+}
+
+// isRoot reports whether the target is uid 0
+func (t *runTarget) isRoot() bool {
+	return t.UID == 0
+}
+
+// credential returns the process credential for the target
+func (t *runTarget) credential() *syscall.Credential {
+	return &syscall.Credential{Uid: t.UID, Gid: t.GID, Groups: t.Groups}
+}
+
+// resolveTarget looks up the user and group named by -u and -g. Names may
+// also be given as "#<id>".
+func resolveTarget(opts *mixmagiskOptions) (*runTarget, error) {
+	name := opts.User
+	if name == "" {
+		name = "root"
+	}
+
+	var u *user.User
+	var err error
+	if id, ok := strings.CutPrefix(name, "#"); ok {
+		u, err = user.LookupId(id)
+	} else {
+		u, err = user.Lookup(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", name)
+	}
+
+	t := &runTarget{User: u.Username, Home: u.HomeDir}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid uid %s", name, u.Uid)
+	}
+	t.UID = uint32(uid)
+
+	primary, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid gid %s", name, u.Gid)
+	}
+	t.primaryGID = uint32(primary)
+
+	gid := u.Gid
+	if opts.Group != "" {
+		var g *user.Group
+		if id, ok := strings.CutPrefix(opts.Group, "#"); ok {
+			g, err = user.LookupGroupId(id)
+		} else {
+			g, err = user.LookupGroup(opts.Group)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown group %s", opts.Group)
+		}
+		gid = g.Gid
+	}
+	n, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %s", gid)
+	}
+	t.GID = uint32(n)
+	if g, err := user.LookupGroupId(gid); err == nil {
+		t.Group = g.Name
+	} else {
+		t.Group = gid
+	}
+
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+				t.Groups = append(t.Groups, uint32(n))
+			}
+		}
+	}
+	return t, nil
+}
+
+// allowsTarget checks the run_as and run_as_group policy keys. Without
+// run_as only root may be targeted; without run_as_group only the target
+// user's own primary group may be chosen.
+func (p *policyFile) allowsTarget(t *runTarget) error {
+	users := p.values("run_as")
+	if len(users) == 0 {
+		users = []string{"root"}
+	}
+	if !matchAny(users, t.User) {
+		return fmt.Errorf("running as user %s is not permitted", t.User)
+	}
+
+	if t.GID == t.primaryGID {
+		return nil
+	}
+	if !matchAny(p.values("run_as_group"), t.Group) {
+		return fmt.Errorf("running as group %s is not permitted", t.Group)
+	}
+	return nil
+}
+
+// matchAny reports whether name matches one of the glob patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+//go:build pam
+
+package cmd
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdlib.h>
+#include <string.h>
+
+// mixmagisk_conv answers every prompt with the password passed as appdata.
+static int mixmagisk_conv(int n, const struct pam_message **msg,
+                          struct pam_response **resp, void *appdata)
+{
+	struct pam_response *r;
+	int i;
+
+	if (n <= 0 || n > PAM_MAX_NUM_MSG)
+		return PAM_CONV_ERR;
+	r = calloc(n, sizeof(struct pam_response));
+	if (r == NULL)
+		return PAM_BUF_ERR;
+
+	for (i = 0; i < n; i++) {
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_OFF:
+		case PAM_PROMPT_ECHO_ON:
+			r[i].resp = strdup((const char *)appdata);
+			break;
+		case PAM_ERROR_MSG:
+		case PAM_TEXT_INFO:
+			break;
+		default:
+			free(r);
+			return PAM_CONV_ERR;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+}
+
+static int mixmagisk_pam_auth(const char *service, const char *user,
+                              const char *password, const char *tty,
+                              const char **errmsg)
+{
+	struct pam_conv conv = { mixmagisk_conv, (void *)password };
+	pam_handle_t *h = NULL;
+	int rc;
+
+	rc = pam_start(service, user, &conv, &h);
+	if (rc != PAM_SUCCESS) {
+		*errmsg = pam_strerror(h, rc);
+		return rc;
+	}
+	if (tty != NULL && *tty != '\0')
+		pam_set_item(h, PAM_TTY, tty);
+	pam_set_item(h, PAM_RUSER, user);
+
+	rc = pam_authenticate(h, PAM_DISALLOW_NULL_AUTHTOK);
+	if (rc == PAM_SUCCESS)
+		rc = pam_acct_mgmt(h, PAM_DISALLOW_NULL_AUTHTOK);
+	if (rc != PAM_SUCCESS)
+		*errmsg = pam_strerror(h, rc);
+
+	pam_end(h, rc);
+	return rc;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// pamAuthenticate checks user's password through the "mixmagisk" PAM
+// service, which also applies the account's lockout and expiry policy
+// (pam_faillock, pam_unix account checks, ...). It returns
+// errPAMUnavailable when no service configuration is installed.
+func pamAuthenticate(user, password string) (bool, error) {
+	if !pamServiceConfigured() {
+		return false, errPAMUnavailable
+	}
+
+	cService := C.CString(mixmagiskPAMService)
+	cUser := C.CString(user)
+	cPassword := C.CString(password)
+	cTTY := C.CString(currentTTY())
+	defer func() {
+		C.free(unsafe.Pointer(cService))
+		C.free(unsafe.Pointer(cUser))
+		C.memset(unsafe.Pointer(cPassword), 0, C.size_t(len(password)))
+		C.free(unsafe.Pointer(cPassword))
+		C.free(unsafe.Pointer(cTTY))
+	}()
+
+	var errmsg *C.char
+	rc := C.mixmagisk_pam_auth(cService, cUser, cPassword, cTTY, &errmsg)
+	switch rc {
+	case C.PAM_SUCCESS:
+		return true, nil
+	case C.PAM_AUTH_ERR, C.PAM_USER_UNKNOWN, C.PAM_MAXTRIES, C.PAM_ACCT_EXPIRED,
+		C.PAM_NEW_AUTHTOK_REQD, C.PAM_PERM_DENIED, C.PAM_CRED_INSUFFICIENT:
+		logAction("auth_pam_denied", user, C.GoString(errmsg))
+		return false, nil
+	}
+	return false, fmt.Errorf("pam: %s", C.GoString(errmsg))
+}
+
+// pamServiceConfigured reports whether PAM has a policy for mixmagisk
+func pamServiceConfigured() bool {
+	if _, err := os.Stat(mixmagiskPAMConfig); err == nil {
+		return true
+	}
+	_, err := os.Stat("/etc/pam.conf")
+	return err == nil
+}
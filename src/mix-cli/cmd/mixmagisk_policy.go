@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Policy Files
+// ============================================================================
+
+// policyEntry is a single "key = value" line of a policy file
+type policyEntry struct {
+	Section string
+	Key     string
+	Value   string
+	Line    int
+	File    string // set when read from a file
+}
+
+// policyFile is a parsed .policy file. Keys may repeat (allow, deny, ...),
+// so entries are kept in file order.
+type policyFile struct {
+	Path     string
+	Entries  []policyEntry
+	Includes []string // merged include.d fragments
+}
+
+// parsePolicy parses the INI-style policy format written by grantRootAccess
+func parsePolicy(r io.Reader) (*policyFile, error) {
+	p := &policyFile{}
+	section := ""
+	lineNo := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section header", lineNo)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected 'key = value'", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", lineNo)
+		}
+		p.Entries = append(p.Entries, policyEntry{
+			Section: section,
+			Key:     key,
+			Value:   strings.TrimSpace(value),
+			Line:    lineNo,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// policyPath returns the policy file path for user
+func policyPath(user string) string {
+	return filepath.Join(mixmagiskPolicy, user+".policy")
+}
+
+// loadUserPolicy reads and parses the policy file for user and merges
+// the include.d fragments that apply to them. An ended temporary grant
+// reads as no policy.
+func loadUserPolicy(user string) (*policyFile, error) {
+	p, err := readPolicyFile(policyPath(user))
+	if err != nil {
+		return nil, err
+	}
+	if p.expired(time.Now()) {
+		return nil, &os.PathError{Op: "open", Path: p.Path, Err: os.ErrNotExist}
+	}
+	if err := p.mergeFragments(user); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// get returns the last value set for key in any section
+func (p *policyFile) get(key string) (string, bool) {
+	value, found := "", false
+	for _, e := range p.Entries {
+		if e.Key == key {
+			value, found = e.Value, true
+		}
+	}
+	return value, found
+}
+
+// values returns every value of key in file order. Comma-separated values
+// are split into separate items.
+func (p *policyFile) values(key string) []string {
+	var out []string
+	for _, e := range p.Entries {
+		if e.Key != key {
+			continue
+		}
+		for _, v := range strings.Split(e.Value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// flag reports whether a boolean key is set to true
+func (p *policyFile) flag(key string) bool {
+	v, _ := p.get(key)
+	switch strings.ToLower(v) {
+	case "true", "yes", "on", "1":
+		return true
+	}
+	return false
+}
+
+// ============================================================================
+// Command Rules
+// ============================================================================
+//
+// "allow" and "deny" values are command patterns: whitespace-separated
+// words matched one by one against the command line with shell globs. The
+// first word matches the command's base name, or its resolved path when the
+// pattern contains a slash. A pattern with only a command matches any
+// arguments, and a final "*" matches any remaining arguments. Short option
+// clusters compare as sets, so "rm -rf /" also catches "rm -fr /". An
+// argument word in parentheses is a regular expression that must match the
+// whole argument, so
+//
+//	allow = systemctl (start|stop|restart) nginx
+//
+// grants those three actions and not "systemctl isolate rescue.target".
+// Deny rules win over allow rules; no matching allow rule means deny.
+//
+// A command path may be pinned to the SHA-256 of the file, as printed by
+// "mixmagisk policy digest":
+//
+//	allow = sha256:9f86d081884c7d65...0f00a08/usr/sbin/backup.sh *
+//
+// The rule then only matches while the file has that content, so a
+// replaced binary is refused. The file is hashed when the rule is checked,
+// so pin only files that the caller cannot write.
+
+// policyDecision is the outcome of checking a command against a policy
+type policyDecision struct {
+	Allowed  bool
+	NoPasswd bool         // allowed by a nopasswd rule
+	Rule     *policyEntry // nil when no rule matched
+	Pinned   *policyEntry // a rule that matched but for the file's digest
+}
+
+// String describes the deciding rule for the log
+func (d policyDecision) String() string {
+	if d.Rule == nil && d.Pinned != nil {
+		return fmt.Sprintf("no matching allow rule (the file does not match the digest pinned on line %d)", d.Pinned.Line)
+	}
+	if d.Rule == nil {
+		return "no matching allow rule"
+	}
+	if d.Rule.File != "" && filepath.Dir(d.Rule.File) == policyIncludeDir {
+		return fmt.Sprintf("%s = %s (%s line %d)", d.Rule.Key, d.Rule.Value, filepath.Base(d.Rule.File), d.Rule.Line)
+	}
+	return fmt.Sprintf("%s = %s (line %d)", d.Rule.Key, d.Rule.Value, d.Rule.Line)
+}
+
+// checkCommand evaluates args (command first) against the allow, nopasswd
+// and deny rules. A nopasswd rule allows the command like allow does and
+// also waives authentication. path is the resolved executable, or "" if it
+// could not be found.
+func (p *policyFile) checkCommand(path string, args []string) policyDecision {
+	var allow, nopasswd, pinned *policyEntry
+	digests := make(map[string]string)
+	for i := range p.Entries {
+		e := &p.Entries[i]
+		if e.Key != "allow" && e.Key != "nopasswd" && e.Key != "deny" {
+			continue
+		}
+		if !matchCommandPattern(e.Value, path, args) {
+			continue
+		}
+		if digest, _ := splitDigest(strings.Fields(e.Value)[0]); digest != "" {
+			if !p.fileMatchesDigest(path, digest, digests) {
+				if pinned == nil && e.Key != "deny" {
+					pinned = e
+				}
+				continue
+			}
+		}
+		switch {
+		case e.Key == "deny":
+			return policyDecision{Allowed: false, Rule: e}
+		case e.Key == "nopasswd" && nopasswd == nil:
+			nopasswd = e
+		case e.Key == "allow" && allow == nil:
+			allow = e
+		}
+	}
+	if nopasswd != nil {
+		return policyDecision{Allowed: true, NoPasswd: true, Rule: nopasswd}
+	}
+	return policyDecision{Allowed: allow != nil, Rule: allow, Pinned: pinned}
+}
+
+// splitDigest splits "sha256:<hex>/path" into the digest and the path
+// pattern; digest is "" for a word without one
+func splitDigest(word string) (digest, rest string) {
+	hexDigest, ok := strings.CutPrefix(word, "sha256:")
+	if !ok || len(hexDigest) < sha256.Size*2 {
+		return "", word
+	}
+	return strings.ToLower(hexDigest[:sha256.Size*2]), hexDigest[sha256.Size*2:]
+}
+
+// fileDigest returns the hex SHA-256 of the file at path
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// showPolicyDigest implements "mixmagisk policy digest <file...>", printing
+// the pinned form of each file for allow rules
+func showPolicyDigest(paths []string) {
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			path = abs
+			var sum string
+			if sum, err = fileDigest(path); err == nil {
+				fmt.Printf("sha256:%s%s\n", sum, path)
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "mixmagisk: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// fileMatchesDigest hashes the resolved command, inside the policy's
+// chroot if it has one. cache keeps the hash for further rules.
+func (p *policyFile) fileMatchesDigest(path, digest string, cache map[string]string) bool {
+	if path == "" {
+		return false
+	}
+	sum, ok := cache[path]
+	if !ok {
+		host := path
+		if root, _ := p.get("chroot"); root != "" {
+			host = filepath.Join(root, path)
+		}
+		sum, _ = fileDigest(host)
+		cache[path] = sum
+	}
+	return sum != "" && sum == digest
+}
+
+// matchCommandPattern reports whether pattern matches the command line
+func matchCommandPattern(pattern, path string, args []string) bool {
+	words := strings.Fields(pattern)
+	if len(words) == 0 || len(args) == 0 {
+		return false
+	}
+	if len(words) == 1 && words[0] == "*" {
+		return true
+	}
+
+	_, words[0] = splitDigest(words[0])
+	name := filepath.Base(args[0])
+	if strings.Contains(words[0], "/") {
+		name = path
+		if name == "" {
+			name = args[0]
+		}
+	}
+	if ok, _ := filepath.Match(words[0], name); !ok {
+		return false
+	}
+	if len(words) == 1 {
+		return true
+	}
+
+	words, rest := words[1:], args[1:]
+	for i, w := range words {
+		if w == "*" && i == len(words)-1 {
+			return true
+		}
+		if i >= len(rest) || !matchArgument(w, rest[i]) {
+			return false
+		}
+	}
+	return len(rest) == len(words)
+}
+
+// matchArgument matches one pattern word against one argument
+func matchArgument(pattern, arg string) bool {
+	if isShortOptions(pattern) && isShortOptions(arg) {
+		return sameLetters(pattern[1:], arg[1:])
+	}
+	if strings.HasPrefix(arg, "/") {
+		arg = filepath.Clean(arg)
+	}
+	if re, ok, err := argumentRegexp(pattern); ok {
+		return err == nil && re.MatchString(arg)
+	}
+	ok, _ := filepath.Match(pattern, arg)
+	return ok
+}
+
+// argumentRegexp compiles a "(...)" argument word, anchored at both ends;
+// ok is false for other words
+func argumentRegexp(pattern string) (re *regexp.Regexp, ok bool, err error) {
+	if len(pattern) < 2 || pattern[0] != '(' || pattern[len(pattern)-1] != ')' {
+		return nil, false, nil
+	}
+	re, err = regexp.Compile("^" + pattern + "$")
+	return re, true, err
+}
+
+// isShortOptions reports whether s is a cluster of short options like "-rf"
+func isShortOptions(s string) bool {
+	if len(s) < 2 || s[0] != '-' || s[1] == '-' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+func sameLetters(a, b string) bool {
+	set := func(s string) map[rune]bool {
+		m := make(map[rune]bool)
+		for _, c := range s {
+			m[c] = true
+		}
+		return m
+	}
+	sa, sb := set(a), set(b)
+	if len(sa) != len(sb) {
+		return false
+	}
+	for c := range sa {
+		if !sb[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// ============================================================================
+// Time Windows
+// ============================================================================
+
+// accessWindow returns the window set by allowed_days and allowed_hours
+// (e.g. "mon-fri" and "08:00-18:00"), or nil when elevation is not limited
+// in time. Hours ending before they start run past midnight.
+func (p *policyFile) accessWindow() (*maintenanceWindow, error) {
+	days, hasDays := p.get("allowed_days")
+	hours, hasHours := p.get("allowed_hours")
+	if !hasDays && !hasHours {
+		return nil, nil
+	}
+	if !hasDays || days == "" {
+		days = "daily"
+	}
+	if !hasHours || hours == "" {
+		// whole days: parse the day list with a placeholder range
+		w, err := parseMaintenanceWindow(days + " 00:00-00:01")
+		if err != nil {
+			return nil, fmt.Errorf("allowed_days: %w", err)
+		}
+		w.end = 24 * 60
+		return w, nil
+	}
+	w, err := parseMaintenanceWindow(days + " " + hours)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_days/allowed_hours: %w", err)
+	}
+	return w, nil
+}
+
+// describeAccessWindow renders the window settings for messages
+func (p *policyFile) describeAccessWindow() string {
+	days, _ := p.get("allowed_days")
+	hours, _ := p.get("allowed_hours")
+	return strings.TrimSpace(days + " " + hours)
+}
@@ -0,0 +1,671 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPolicyCheckCommand(t *testing.T) {
+	policy, err := parsePolicy(strings.NewReader(`
+[commands]
+allow = systemctl restart *
+allow = /usr/bin/mix
+allow = ls
+nopasswd = /usr/bin/systemctl restart myapp
+nopasswd = mix remove *
+
+[restrictions]
+deny = rm -rf /
+deny = mkfs.*
+deny = mix remove *
+`))
+	if err != nil {
+		t.Fatalf("parsePolicy failed: %v", err)
+	}
+
+	tests := []struct {
+		args    []string
+		path    string
+		allowed bool
+		rule    string
+	}{
+		{[]string{"systemctl", "restart", "sshd"}, "/usr/bin/systemctl", true, "systemctl restart *"},
+		{[]string{"systemctl", "stop", "sshd"}, "/usr/bin/systemctl", false, ""},
+		{[]string{"ls"}, "/bin/ls", true, "ls"},
+		{[]string{"ls", "-la", "/root"}, "/bin/ls", true, "ls"},
+		{[]string{"mix", "install", "vim"}, "/usr/bin/mix", true, "/usr/bin/mix"},
+		{[]string{"mix", "remove", "vim"}, "/usr/bin/mix", false, "mix remove *"},
+		{[]string{"./mix", "install"}, "/tmp/mix", false, ""},
+		{[]string{"mkfs.ext4", "/dev/sda1"}, "/sbin/mkfs.ext4", false, "mkfs.*"},
+	}
+
+	for _, tt := range tests {
+		d := policy.checkCommand(tt.path, tt.args)
+		if d.Allowed != tt.allowed {
+			t.Errorf("%v: allowed = %v, expected %v (%s)", tt.args, d.Allowed, tt.allowed, d)
+		}
+		if tt.rule != "" && (d.Rule == nil || d.Rule.Value != tt.rule) {
+			t.Errorf("%v: decided by %s, expected %q", tt.args, d, tt.rule)
+		}
+		if d.NoPasswd {
+			t.Errorf("%v: unexpected nopasswd decision (%s)", tt.args, d)
+		}
+	}
+
+	d := policy.checkCommand("/usr/bin/systemctl", []string{"systemctl", "restart", "myapp"})
+	if !d.Allowed || !d.NoPasswd || d.Rule.Key != "nopasswd" {
+		t.Errorf("systemctl restart myapp: %s (nopasswd %v), expected the nopasswd rule", d, d.NoPasswd)
+	}
+}
+
+func TestMatchCommandPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		args     []string
+		expected bool
+	}{
+		{"*", []string{"anything", "at", "all"}, true},
+		{"rm -rf /", []string{"rm", "-rf", "/"}, true},
+		{"rm -rf /", []string{"rm", "-fr", "/"}, true},
+		{"rm -rf /", []string{"rm", "-rf", "//"}, true},
+		{"rm -rf /", []string{"rm", "-rf", "/tmp/x"}, false},
+		{"rm -rf /", []string{"rm", "-r", "/"}, false},
+		{"rm *", []string{"rm"}, true},
+		{"dd if=/dev/zero of=/dev/sd*", []string{"dd", "if=/dev/zero", "of=/dev/sdb"}, true},
+		{"cat /var/log/*", []string{"cat", "/var/log/messages"}, true},
+		{"cat /var/log/*", []string{"cat", "/etc/shadow"}, false},
+		{"systemctl (start|stop|restart) nginx", []string{"systemctl", "restart", "nginx"}, true},
+		{"systemctl (start|stop|restart) nginx", []string{"systemctl", "isolate", "rescue.target"}, false},
+		{"systemctl (start|stop|restart) nginx", []string{"systemctl", "restart-all", "nginx"}, false},
+		{"systemctl (start|stop|restart) nginx", []string{"systemctl", "start", "nginx", "sshd"}, false},
+		{"journalctl -u (nginx|web-[0-9]+) *", []string{"journalctl", "-u", "web-12", "-f"}, true},
+		{"journalctl -u (nginx|web-[0-9]+) *", []string{"journalctl", "-u", "web-x"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchCommandPattern(tt.pattern, "", tt.args); got != tt.expected {
+			t.Errorf("matchCommandPattern(%q, %v) = %v, expected %v", tt.pattern, tt.args, got, tt.expected)
+		}
+	}
+}
+
+func TestParseMixmagiskArgs(t *testing.T) {
+	tests := []struct {
+		args  []string
+		user  string
+		group string
+		rest  string
+		err   bool
+	}{
+		{[]string{"ls", "-la"}, "", "", "ls -la", false},
+		{[]string{"-u", "postgres", "-g", "postgres", "psql", "-l"}, "postgres", "postgres", "psql -l", false},
+		{[]string{"-upostgres", "--group=www", "id"}, "postgres", "www", "id", false},
+		{[]string{"--user", "#1000", "--", "-weird"}, "#1000", "", "-weird", false},
+		{[]string{"-A", "-u", "www", "id"}, "www", "", "id", false},
+		{[]string{"-Ax", "id"}, "", "", "", true},
+		{[]string{"-S", "--user=www", "cat"}, "www", "", "cat", false},
+		{[]string{"--stdin=yes", "id"}, "", "", "", true},
+		{[]string{"-u"}, "", "", "", true},
+		{[]string{"-x", "ls"}, "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		opts, rest, err := parseMixmagiskArgs(tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseMixmagiskArgs(%v) succeeded, expected error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseMixmagiskArgs(%v) failed: %v", tt.args, err)
+		}
+		if opts.User != tt.user || opts.Group != tt.group || strings.Join(rest, " ") != tt.rest {
+			t.Errorf("parseMixmagiskArgs(%v) = %q %q %v", tt.args, opts.User, opts.Group, rest)
+		}
+	}
+}
+
+func TestPolicyAllowsTarget(t *testing.T) {
+	policy, err := parsePolicy(strings.NewReader("[commands]\nrun_as = root, postgres\nrun_as_group = www*\n"))
+	if err != nil {
+		t.Fatalf("parsePolicy failed: %v", err)
+	}
+
+	tests := []struct {
+		target  runTarget
+		allowed bool
+	}{
+		{runTarget{User: "root", Group: "root", GID: 0, primaryGID: 0}, true},
+		{runTarget{User: "postgres", Group: "postgres", GID: 70, primaryGID: 70}, true},
+		{runTarget{User: "postgres", Group: "www-data", GID: 33, primaryGID: 70}, true},
+		{runTarget{User: "postgres", Group: "disk", GID: 6, primaryGID: 70}, false},
+		{runTarget{User: "mysql", Group: "mysql", GID: 80, primaryGID: 80}, false},
+	}
+
+	for _, tt := range tests {
+		err := policy.allowsTarget(&tt.target)
+		if (err == nil) != tt.allowed {
+			t.Errorf("allowsTarget(%s) = %v, expected allowed %v", &tt.target, err, tt.allowed)
+		}
+	}
+
+	empty := &policyFile{}
+	if err := empty.allowsTarget(&runTarget{User: "postgres", Group: "postgres"}); err == nil {
+		t.Error("policy without run_as allowed a non-root target")
+	}
+}
+
+func TestLintPolicy(t *testing.T) {
+	policy, err := parsePolicy(strings.NewReader(`
+[user]
+timeout = soon
+colour = blue
+
+[commands]
+allow = systemctl *
+allow = rm -rf /
+
+[restrictions]
+deny = rm   -rf /
+deny = systemctl (isolate|[) *
+`))
+	if err != nil {
+		t.Fatalf("parsePolicy failed: %v", err)
+	}
+
+	var got []string
+	for _, issue := range lintPolicy(policy) {
+		got = append(got, issue.String())
+	}
+	expected := []string{
+		`line 3: error: timeout: expected seconds (0 or more), got "soon"`,
+		`line 4: error: unknown key "colour"`,
+		`line 8: error: allow "rm -rf /" conflicts with deny on line 11 (deny wins)`,
+		"line 12: error: deny: bad argument expression \"(isolate|[)\": error parsing regexp: missing closing ]: `[)$`",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("lintPolicy =\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestPolicyAccessWindow(t *testing.T) {
+	// 2024-06-03 is a Monday
+	at := func(day int, clock string) time.Time {
+		ts, _ := time.Parse("2006-01-02 15:04", fmt.Sprintf("2024-06-%02d %s", day, clock))
+		return ts
+	}
+	tests := []struct {
+		policy string
+		when   time.Time
+		inside bool
+	}{
+		{"allowed_days = mon-fri\nallowed_hours = 08:00-18:00", at(3, "09:30"), true},
+		{"allowed_days = mon-fri\nallowed_hours = 08:00-18:00", at(3, "18:00"), false},
+		{"allowed_days = mon-fri\nallowed_hours = 08:00-18:00", at(8, "09:30"), false},
+		{"allowed_days = sat,sun", at(8, "23:59"), true},
+		{"allowed_days = sat,sun", at(7, "12:00"), false},
+		{"allowed_hours = 22:00-06:00", at(4, "02:00"), true},
+		{"allowed_hours = 22:00-06:00", at(4, "12:00"), false},
+	}
+
+	for _, tt := range tests {
+		policy, err := parsePolicy(strings.NewReader("[restrictions]\n" + tt.policy + "\n"))
+		if err != nil {
+			t.Fatalf("parsePolicy failed: %v", err)
+		}
+		w, err := policy.accessWindow()
+		if err != nil {
+			t.Fatalf("accessWindow(%q) failed: %v", tt.policy, err)
+		}
+		if got := w.contains(tt.when); got != tt.inside {
+			t.Errorf("%q contains %s = %v, expected %v", tt.policy, tt.when.Format("Mon 15:04"), got, tt.inside)
+		}
+	}
+
+	policy, _ := parsePolicy(strings.NewReader("[restrictions]\nallowed_hours = 8-18\n"))
+	if _, err := policy.accessWindow(); err == nil {
+		t.Error("accessWindow accepted an invalid time range")
+	}
+	if w, _ := (&policyFile{}).accessWindow(); w != nil {
+		t.Error("accessWindow without restrictions should be nil")
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected []string
+		fails    bool
+	}{
+		{"systemctl restart  nginx", []string{"systemctl", "restart", "nginx"}, false},
+		{`echo 'a b' "c d" e\ f`, []string{"echo", "a b", "c d", "e f"}, false},
+		{`grep "\$HOME" *.conf # comment`, []string{"grep", "$HOME", "*.conf"}, false},
+		{`""`, []string{""}, false},
+		{"cat /etc/shadow | nc host 80", nil, true},
+		{"id; sh", nil, true},
+		{"echo $(id)", nil, true},
+		{`echo "$HOME"`, nil, true},
+		{"echo > /etc/passwd", nil, true},
+		{"echo 'open", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := splitShellWords(tt.line)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("splitShellWords(%q) = %q, expected an error", tt.line, got)
+			}
+			continue
+		}
+		if err != nil || strings.Join(got, "|") != strings.Join(tt.expected, "|") || len(got) != len(tt.expected) {
+			t.Errorf("splitShellWords(%q) = %q, %v; expected %q", tt.line, got, err, tt.expected)
+		}
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	caps, names, err := parseCapabilities([]string{"CAP_NET_RAW", " net_admin", "cap_net_raw"})
+	if err != nil {
+		t.Fatalf("parseCapabilities failed: %v", err)
+	}
+	if strings.Join(names, ",") != "cap_net_admin,cap_net_raw" {
+		t.Errorf("names = %q, expected cap_net_admin,cap_net_raw", names)
+	}
+	if len(caps) != 2 || caps[0] != 12 || caps[1] != 13 {
+		t.Errorf("caps = %v, expected [12 13]", caps)
+	}
+
+	if _, _, err := parseCapabilities([]string{"cap_net_admin", "cap_everything"}); err == nil {
+		t.Error("parseCapabilities accepted an unknown capability")
+	}
+}
+
+func TestPolicyConfinement(t *testing.T) {
+	policy, err := parsePolicy(strings.NewReader("[restrictions]\nconfine = net, MNT\nconfine = pid\n"))
+	if err != nil {
+		t.Fatalf("parsePolicy failed: %v", err)
+	}
+	c, err := policy.confinement()
+	if err != nil {
+		t.Fatalf("confinement failed: %v", err)
+	}
+	if c.String() != "confine mount,net,pid" {
+		t.Errorf("confinement = %q, expected confine mount,net,pid", c)
+	}
+	if c.cloneflags != syscall.CLONE_NEWPID || c.unshareflags != syscall.CLONE_NEWNS|syscall.CLONE_NEWNET {
+		t.Errorf("flags = %#x/%#x, expected pid cloned and mount, net unshared", c.cloneflags, c.unshareflags)
+	}
+
+	for _, bad := range []string{"confine = user", "chroot = relative/jail", "chroot = /nonexistent/jail"} {
+		policy, _ := parsePolicy(strings.NewReader(bad + "\n"))
+		if _, err := policy.confinement(); err == nil {
+			t.Errorf("confinement accepted %q", bad)
+		}
+	}
+	if c, _ := (&policyFile{}).confinement(); c != nil {
+		t.Error("confinement without keys should be nil")
+	}
+}
+
+func TestProcessLimits(t *testing.T) {
+	policy, err := parsePolicy(strings.NewReader("[restrictions]\numask = 027\ncwd = /srv/app/\n" +
+		"allowed_cwd = /srv/*, /home/deploy\nrlimit_nofile = 512:1024\nrlimit_core = 0\nrlimit_nproc = unlimited\n"))
+	if err != nil {
+		t.Fatalf("parsePolicy failed: %v", err)
+	}
+	l, err := policy.processLimits()
+	if err != nil {
+		t.Fatalf("processLimits failed: %v", err)
+	}
+	if got, want := l.describe(), "umask 0027, cwd /srv/app, nofile 512:1024, nproc unlimited, core 0"; got != want {
+		t.Errorf("limits = %q, expected %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		dir     string
+		allowed bool
+	}{
+		{"/srv/app", true},
+		{"/srv/app/releases/42", true},
+		{"/home/deploy", true},
+		{"/home/deployer", false},
+		{"/srv", false},
+		{"/", false},
+		{"", false},
+	} {
+		if got := l.allowsCwd(tt.dir); got != tt.allowed {
+			t.Errorf("allowsCwd(%q) = %v, expected %v", tt.dir, got, tt.allowed)
+		}
+	}
+
+	for _, bad := range []string{"umask = 0999", "umask = 01777", "cwd = srv", "allowed_cwd = relative",
+		"rlimit_nofile = many", "rlimit_core = 10:5", "rlimit_nproc = -1"} {
+		policy, _ := parsePolicy(strings.NewReader(bad + "\n"))
+		if _, err := policy.processLimits(); err == nil {
+			t.Errorf("processLimits accepted %q", bad)
+		}
+	}
+	if l, _ := (&policyFile{}).processLimits(); l != nil || !l.allowsCwd("/tmp") || l.describe() != "" {
+		t.Error("limits without keys should be nil and allow everything")
+	}
+}
+
+func TestPolicyFragments(t *testing.T) {
+	fragment, _ := parsePolicy(strings.NewReader("users = backup, ops-*\n[commands]\nallow = restic *\n"))
+	fragment.Path = policyIncludeDir + "/50-backup.policy"
+	for user, want := range map[string]bool{"backup": true, "ops-alice": true, "alice": false} {
+		if got := fragment.appliesTo(user); got != want {
+			t.Errorf("appliesTo(%q) = %v, want %v", user, got, want)
+		}
+	}
+	if issues := lintPolicy(fragment); len(issues) != 0 {
+		t.Errorf("lintPolicy(fragment) = %v", issues)
+	}
+
+	policy, _ := parsePolicy(strings.NewReader("[user]\ntimeout = 300\n[commands]\nallow = ls\n"))
+	policy.Entries = append(policy.Entries, fragment.Entries[1:]...)
+	extra, _ := parsePolicy(strings.NewReader("[auth]\ntimeout = 60\n"))
+	policy.Entries = append(policy.Entries, extra.Entries...)
+
+	if later, ok := policy.overriddenBy(0); !ok || later.Value != "60" {
+		t.Errorf("timeout not overridden: %+v", later)
+	}
+	if _, ok := policy.overriddenBy(1); ok {
+		t.Error("allow reported as overridden")
+	}
+	if got := policy.values("allow"); strings.Join(got, "|") != "ls|restic *" {
+		t.Errorf("allow = %q", got)
+	}
+}
+
+func TestPolicyEditInstall(t *testing.T) {
+	dir := t.TempDir()
+	edited := filepath.Join(dir, "edited")
+
+	os.WriteFile(edited, []byte("[user]\ntimeout = soon\n[commands]\nallow = ls\n"), 0600)
+	if _, broken := policyEditErrors(edited); !broken {
+		t.Error("invalid timeout not reported")
+	}
+	os.WriteFile(edited, []byte("[commands\n"), 0600)
+	if _, broken := policyEditErrors(edited); !broken {
+		t.Error("syntax error not reported")
+	}
+	os.WriteFile(edited, []byte("[commands]\ncolour = blue\n"), 0600)
+	if _, broken := policyEditErrors(edited); !broken {
+		t.Error("unknown key not reported")
+	}
+	os.WriteFile(edited, []byte("[commands]\nallow = ls\nnopasswd = *\n"), 0600)
+	if issues, broken := policyEditErrors(edited); broken || len(issues) != 1 {
+		t.Errorf("warnings only: issues = %v, broken = %v", issues, broken)
+	}
+
+	dst := filepath.Join(dir, "alice.policy")
+	os.WriteFile(dst, []byte("old\n"), 0666)
+	if err := installPolicy(edited, dst, 0640); err != nil {
+		t.Fatalf("installPolicy failed: %v", err)
+	}
+	data, _ := os.ReadFile(dst)
+	info, _ := os.Stat(dst)
+	if string(data) != "[commands]\nallow = ls\nnopasswd = *\n" || info.Mode().Perm() != 0640 {
+		t.Errorf("installed %q with mode %04o", data, info.Mode().Perm())
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, ".alice.policy.*")); len(leftovers) != 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
+
+func TestPolicyDigestPinning(t *testing.T) {
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "backup.sh")
+	os.WriteFile(tool, []byte("#!/bin/sh\necho backup\n"), 0755)
+	sum, err := fileDigest(tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, _ := parsePolicy(strings.NewReader("[commands]\nallow = sha256:" + sum + tool + " *\n"))
+	args := []string{tool, "--full"}
+	if d := policy.checkCommand(tool, args); !d.Allowed {
+		t.Errorf("pinned command denied: %s", d)
+	}
+	if d := policy.checkCommand(tool, []string{"backup.sh"}); !d.Allowed {
+		t.Errorf("pinned command without arguments denied: %s", d)
+	}
+
+	os.WriteFile(tool, []byte("#!/bin/sh\nexec /bin/sh\n"), 0755)
+	d := policy.checkCommand(tool, args)
+	if d.Allowed || d.Pinned == nil || !strings.Contains(d.String(), "digest pinned on line 2") {
+		t.Errorf("modified command: allowed %v, %s", d.Allowed, d)
+	}
+
+	for _, bad := range []string{"sha256:abc/usr/bin/x", "sha256:" + sum + "backup.sh", "sha256:" + strings.Repeat("zz", 32) + "/x"} {
+		if validatePattern(bad) == nil {
+			t.Errorf("validatePattern(%q) accepted", bad)
+		}
+	}
+	if err := validatePattern("sha256:" + strings.ToUpper(sum) + "/usr/sbin/backup.sh *"); err != nil {
+		t.Errorf("validatePattern rejected an upper-case digest: %v", err)
+	}
+}
+
+func TestDoctorCheckPermissions(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the checked files must be owned by root")
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "alice.policy")
+	os.WriteFile(file, nil, 0644)
+	sub := filepath.Join(dir, "policy.d")
+	os.Mkdir(sub, 0755)
+
+	tests := []struct {
+		path    string
+		mode    os.FileMode
+		allowed os.FileMode
+		missing doctorStatus
+		status  doctorStatus
+		fix     string
+	}{
+		{file, 0644, 0644, doctorFail, doctorOK, ""},
+		{file, 0600, 0644, doctorFail, doctorOK, ""},
+		{file, 0666, 0644, doctorFail, doctorFail, "chmod 0644 " + file},
+		{file, 0664, 0600, doctorFail, doctorFail, "chmod 0600 " + file},
+		{sub, 0777, 0755, doctorFail, doctorFail, "chmod 0755 " + sub},
+		{sub, 0700, 0700, doctorFail, doctorOK, ""},
+		{filepath.Join(dir, "missing"), 0, 0700, doctorOK, doctorOK, ""},
+		{filepath.Join(dir, "missing"), 0, 0700, doctorWarn, doctorWarn, ""},
+	}
+	for _, tt := range tests {
+		if tt.mode != 0 {
+			os.Chmod(tt.path, tt.mode)
+		}
+		r := checkPermissions("test", tt.path, tt.allowed, tt.missing)
+		if r.Status != tt.status || r.Fix != tt.fix {
+			t.Errorf("checkPermissions(%s %04o, %04o) = %d %q, want %d %q", filepath.Base(tt.path), tt.mode, tt.allowed, r.Status, r.Fix, tt.status, tt.fix)
+		}
+	}
+
+	if got := describeModeBits(0066); got != "group to read/write and others to read/write" {
+		t.Errorf("describeModeBits(0066) = %q", got)
+	}
+}
+
+func TestGrantExpiry(t *testing.T) {
+	durations := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"2h", 2 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"0s", 0, false},
+		{"-1h", 0, false},
+		{"d", 0, false},
+		{"tomorrow", 0, false},
+	}
+	for _, tt := range durations {
+		got, err := parseGrantDuration(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseGrantDuration(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+
+	args := []struct {
+		args     []string
+		user     string
+		duration time.Duration
+		ok       bool
+	}{
+		{[]string{"alice"}, "alice", 0, true},
+		{[]string{"alice", "--duration", "2h"}, "alice", 2 * time.Hour, true},
+		{[]string{"--duration=1d", "alice"}, "alice", 24 * time.Hour, true},
+		{[]string{"-d", "30m", "alice"}, "alice", 30 * time.Minute, true},
+		{[]string{"alice", "--duration"}, "", 0, false},
+		{[]string{"alice", "bob"}, "", 0, false},
+		{[]string{"--duration", "2h"}, "", 0, false},
+		{[]string{"alice", "--forever"}, "", 0, false},
+	}
+	for _, tt := range args {
+		user, d, err := parseGrantArgs(tt.args)
+		if (err == nil) != tt.ok || user != tt.user || d != tt.duration {
+			t.Errorf("parseGrantArgs(%q) = %q, %v, %v", tt.args, user, d, err)
+		}
+	}
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	policies := []struct {
+		policy  string
+		expired bool
+	}{
+		{"[user]\ntimeout = 300\n", false},
+		{"[user]\nexpires = 2026-10-17T14:00:00Z\n", false},
+		{"[user]\nexpires = 2026-10-17T13:00:00+02:00\n", true},
+		{"[user]\nexpires = 2026-10-17T11:59:59Z\n", true},
+		{"[user]\nexpires = tomorrow\n", true},
+	}
+	for _, tt := range policies {
+		p, _ := parsePolicy(strings.NewReader(tt.policy))
+		if got := p.expired(now); got != tt.expired {
+			t.Errorf("expired(%q) = %v, want %v", tt.policy, got, tt.expired)
+		}
+	}
+}
+
+func TestGrantRevokeNeedRealRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to switch the real uid")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+
+	names := []struct {
+		name string
+		ok   bool
+	}{
+		{"root", true},
+		{"nobody", true},
+		{"", false},
+		{"../../x", false},
+		{"alice/../root", false},
+		{".hidden", false},
+		{"-rf", false},
+		{"no-such-user-4576", false},
+	}
+	for _, tt := range names {
+		if err := checkPolicyUser(tt.name); (err == nil) != tt.ok {
+			t.Errorf("checkPolicyUser(%q) = %v", tt.name, err)
+		}
+	}
+
+	// A setuid binary run by nobody: euid stays 0, the real uid is not root
+	policy := filepath.Join(mixmagiskPolicy, "nobody.policy")
+	if _, err := os.Stat(policy); err == nil {
+		t.Skip("nobody already has a policy")
+	}
+	if err := syscall.Setresuid(uid, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	grantRootAccess("nobody", 0)
+	syscall.Setresuid(0, 0, 0)
+	if _, err := os.Stat(policy); err == nil {
+		os.Remove(policy)
+		t.Fatal("grant as a non-root caller wrote a policy")
+	}
+
+	os.MkdirAll(mixmagiskPolicy, 0755)
+	if err := os.WriteFile(policy, []byte("[user]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(policy)
+	if err := syscall.Setresuid(uid, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	revokeRootAccess("nobody")
+	syscall.Setresuid(0, 0, 0)
+	if _, err := os.Stat(policy); err != nil {
+		t.Error("revoke as a non-root caller removed the policy")
+	}
+}
+
+func TestRestrictedShellDir(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to run as another user")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	gid, _ := strconv.Atoi(nobody.Gid)
+	target := &runTarget{User: "nobody", UID: uint32(uid), GID: uint32(gid)}
+
+	// t.TempDir is private to root; nobody needs a way in
+	dir, err := os.MkdirTemp("", "rshell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+	for _, d := range []struct {
+		name string
+		mode os.FileMode
+	}{{"open", 0755}, {"private", 0700}, {"private/inner", 0755}} {
+		os.Mkdir(filepath.Join(dir, d.name), d.mode)
+		os.Chmod(filepath.Join(dir, d.name), d.mode)
+	}
+
+	tests := []struct {
+		cwd, arg string
+		want     string
+	}{
+		{"/", dir, dir},
+		{dir, "open", filepath.Join(dir, "open")},
+		{filepath.Join(dir, "open"), "..", dir},
+		{dir, "private", ""},
+		{dir, "private/inner", ""},
+		{dir, "missing", ""},
+	}
+	for _, tt := range tests {
+		got, err := shellDir(target, tt.cwd, tt.arg)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("shellDir(%q, %q) = %q, %v, want %q", tt.cwd, tt.arg, got, err, tt.want)
+		}
+	}
+
+	// As root the same directories are open
+	if got, err := shellDir(&runTarget{User: "root"}, dir, "private/inner"); err != nil || got != filepath.Join(dir, "private/inner") {
+		t.Errorf("shellDir as root = %q, %v", got, err)
+	}
+}
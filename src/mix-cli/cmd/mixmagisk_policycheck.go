@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// Policy Check
+// ============================================================================
+//
+// "mixmagisk policy check [user]" validates policy files the way
+// "visudo -c" does for sudoers: syntax, known keys and values, rules that
+// contradict each other, and file permissions. It exits non-zero when any
+// error is found; warnings alone do not fail the check.
+
+// policyKeys lists every key a policy may contain with a validator for its
+// value (nil accepts anything)
+var policyKeys = map[string]func(string) error{
+	"name":                nil,
+	"users":               nil, // include.d fragments only
+	"banner":              nil,
+	"allow_root":          validateBool,
+	"require_pin":         validateBool,
+	"require_fido2":       validateBool,
+	"log_level":           validateOneOf("debug", "info", "warn", "error"),
+	"timeout":             validateSeconds,
+	"expires":             validateExpiry,
+	"ssh_ca":              nil,
+	"ssh_principals":      nil,
+	"ssh_authorized_keys": nil,
+	"allow":               validatePattern,
+	"deny":                validatePattern,
+	"nopasswd":            validatePattern,
+	"run_as":              nil,
+	"run_as_group":        nil,
+	"env_keep":            nil,
+	"secure_path":         validateSearchPath,
+	"allowed_days":        nil, // checked together with allowed_hours
+	"allowed_hours":       nil,
+	"restricted_shell":    validateBool,
+	"record_sessions":     validateBool,
+	"capabilities":        validateCapabilities,
+	"seccomp":             validateSeccompProfile,
+	"confine":             validateConfine,
+	"chroot":              validateChroot,
+	"umask":               validateUmask,
+	"cwd":                 validateCwd,
+	"allowed_cwd":         validateCwdPattern,
+	"rlimit_nofile":       validateRlimit,
+	"rlimit_nproc":        validateRlimit,
+	"rlimit_core":         validateRlimit,
+}
+
+func validateBool(v string) error {
+	switch strings.ToLower(v) {
+	case "true", "false", "yes", "no", "on", "off", "1", "0":
+		return nil
+	}
+	return fmt.Errorf("expected true or false, got %q", v)
+}
+
+func validateOneOf(values ...string) func(string) error {
+	return func(v string) error {
+		for _, allowed := range values {
+			if v == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s, got %q", strings.Join(values, ", "), v)
+	}
+}
+
+func validateSeconds(v string) error {
+	if n, err := strconv.Atoi(v); err != nil || n < 0 {
+		return fmt.Errorf("expected seconds (0 or more), got %q", v)
+	}
+	return nil
+}
+
+func validatePattern(v string) error {
+	if words := strings.Fields(v); len(words) > 0 && strings.HasPrefix(words[0], "sha256:") {
+		digest, path := splitDigest(words[0])
+		if _, err := hex.DecodeString(digest); err != nil || digest == "" {
+			return fmt.Errorf("sha256: needs 64 hex digits, got %q", words[0])
+		}
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("a pinned command needs an absolute path, got %q", path)
+		}
+	}
+	for i, w := range strings.Fields(v) {
+		if _, ok, err := argumentRegexp(w); i > 0 && ok {
+			if err != nil {
+				return fmt.Errorf("bad argument expression %q: %v", w, err)
+			}
+			continue
+		}
+		if _, err := filepath.Match(w, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", w)
+		}
+	}
+	if strings.TrimSpace(v) == "" {
+		return fmt.Errorf("empty command pattern")
+	}
+	return nil
+}
+
+func validateSearchPath(v string) error {
+	for _, dir := range filepath.SplitList(v) {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("secure_path entries must be absolute, got %q", dir)
+		}
+	}
+	return nil
+}
+
+// policyIssue is one finding of a policy check
+type policyIssue struct {
+	Line    int // 0 for file-level findings
+	Warning bool
+	Message string
+}
+
+func (i policyIssue) String() string {
+	level := "error"
+	if i.Warning {
+		level = "warning"
+	}
+	if i.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", i.Line, level, i.Message)
+	}
+	return fmt.Sprintf("%s: %s", level, i.Message)
+}
+
+// lintPolicy checks the contents of a parsed policy
+func lintPolicy(p *policyFile) []policyIssue {
+	var issues []policyIssue
+	allows := make(map[string]int)
+	denies := make(map[string]int)
+
+	for _, e := range p.Entries {
+		validate, known := policyKeys[e.Key]
+		if !known {
+			issues = append(issues, policyIssue{Line: e.Line, Message: fmt.Sprintf("unknown key %q", e.Key)})
+			continue
+		}
+		if validate != nil {
+			if err := validate(e.Value); err != nil {
+				issues = append(issues, policyIssue{Line: e.Line, Message: fmt.Sprintf("%s: %v", e.Key, err)})
+			}
+		}
+
+		normalized := strings.Join(strings.Fields(e.Value), " ")
+		switch e.Key {
+		case "allow", "nopasswd":
+			if line, dup := allows[normalized]; dup {
+				issues = append(issues, policyIssue{Line: e.Line, Warning: true,
+					Message: fmt.Sprintf("%s rule repeats line %d", e.Key, line)})
+			}
+			allows[normalized] = e.Line
+			if e.Key == "nopasswd" && normalized == "*" {
+				issues = append(issues, policyIssue{Line: e.Line, Warning: true,
+					Message: "nopasswd = * waives authentication for every command"})
+			}
+		case "deny":
+			denies[normalized] = e.Line
+		case "users":
+			if !p.isFragment() {
+				issues = append(issues, policyIssue{Line: e.Line, Warning: true,
+					Message: "users only applies in " + policyIncludeDir + " fragments"})
+			}
+		case "expires":
+			if p.isFragment() {
+				issues = append(issues, policyIssue{Line: e.Line, Warning: true,
+					Message: "expires only applies in a user's own policy"})
+			} else if t, ok := p.expiry(); ok && !time.Now().Before(t) {
+				issues = append(issues, policyIssue{Line: e.Line, Warning: true,
+					Message: "the grant has expired and will be removed"})
+			}
+		}
+	}
+
+	if _, err := p.accessWindow(); err != nil {
+		issues = append(issues, policyIssue{Message: err.Error()})
+	}
+
+	// A command both allowed and denied by the same pattern is always
+	// denied, which is rarely what was meant
+	for pattern, line := range allows {
+		if denyLine, ok := denies[pattern]; ok {
+			issues = append(issues, policyIssue{Line: line,
+				Message: fmt.Sprintf("allow %q conflicts with deny on line %d (deny wins)", pattern, denyLine)})
+		}
+	}
+	if denies["*"] > 0 && len(allows) > 0 {
+		issues = append(issues, policyIssue{Line: denies["*"], Warning: true,
+			Message: "deny = * overrides every allow rule"})
+	}
+	// Fragments add to a user's policy and need no allow rules of their own
+	if len(allows) == 0 && !p.isFragment() {
+		issues = append(issues, policyIssue{Warning: true, Message: "no allow rules: every command is denied"})
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Line < issues[j].Line })
+	return issues
+}
+
+// checkPolicyPermissions reports policy files that others could modify
+func checkPolicyPermissions(path string) []policyIssue {
+	var issues []policyIssue
+	for _, p := range []string{path, filepath.Dir(path)} {
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if info.Mode().Perm()&0022 != 0 {
+			issues = append(issues, policyIssue{Message: fmt.Sprintf("%s is writable by group or others (mode %04o)", p, info.Mode().Perm())})
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+			issues = append(issues, policyIssue{Message: fmt.Sprintf("%s is not owned by root", p)})
+		}
+	}
+	return issues
+}
+
+// checkPolicyFile parses and lints one policy file
+func checkPolicyFile(path string) []policyIssue {
+	issues := checkPolicyPermissions(path)
+
+	p, err := readPolicyFile(path)
+	if err != nil {
+		return append(issues, policyIssue{Message: err.Error()})
+	}
+	return append(issues, lintPolicy(p)...)
+}
+
+// checkPolicies implements "mixmagisk policy check [user]"
+func checkPolicies(args []string) {
+	var paths []string
+	if len(args) > 0 {
+		paths = []string{policyPath(args[0])}
+		for _, path := range policyFragments() {
+			if p, err := readPolicyFile(path); err != nil || p.appliesTo(args[0]) {
+				paths = append(paths, path)
+			}
+		}
+	} else {
+		matches, _ := filepath.Glob(filepath.Join(mixmagiskPolicy, "*.policy"))
+		paths = append(matches, policyFragments()...)
+		if len(paths) == 0 {
+			fmt.Println("No policies to check")
+			return
+		}
+	}
+
+	failed := false
+	for _, path := range paths {
+		issues := checkPolicyFile(path)
+		errors := 0
+		for _, i := range issues {
+			if !i.Warning {
+				errors++
+			}
+		}
+
+		switch {
+		case len(issues) == 0:
+			fmt.Printf("✅ %s: OK\n", path)
+			continue
+		case errors == 0:
+			fmt.Printf("⚠️  %s: %d warning(s)\n", path, len(issues))
+		default:
+			fmt.Printf("❌ %s: %d error(s)\n", path, errors)
+			failed = true
+		}
+		for _, i := range issues {
+			fmt.Printf("     %s\n", i)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// ============================================================================
+// Policy Editing
+// ============================================================================
+//
+// "mixmagisk policy edit <user>" works like visudo: the policy is copied
+// to a temporary file for the editor, the result is checked the way
+// "policy check" does, and only a policy without errors replaces the
+// original, atomically and owned by root. An exclusive lock on the policy
+// directory keeps two admins from editing at the same time.
+
+// lockPolicyDir takes the edit lock, failing if someone else holds it
+func lockPolicyDir() (*os.File, error) {
+	dir, err := os.Open(mixmagiskPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("%s is busy, another policy edit is in progress", mixmagiskPolicy)
+	}
+	return dir, nil
+}
+
+// policyEditor returns the editor command line from $VISUAL or $EDITOR
+func policyEditor() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if fields := strings.Fields(os.Getenv(env)); len(fields) > 0 {
+			return fields
+		}
+	}
+	return []string{"vi"}
+}
+
+// policyEditErrors returns the findings of a check of the edited file and
+// whether any of them is an error
+func policyEditErrors(path string) ([]policyIssue, bool) {
+	p, err := readPolicyFile(path)
+	if err != nil {
+		return []policyIssue{{Message: err.Error()}}, true
+	}
+	issues := lintPolicy(p)
+	for _, i := range issues {
+		if !i.Warning {
+			return issues, true
+		}
+	}
+	return issues, false
+}
+
+// installPolicy atomically replaces dst with the contents of src, owned
+// by root with the given mode
+func installPolicy(src, dst string, mode os.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if os.Geteuid() == 0 {
+		if err := tmp.Chown(0, 0); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(dst)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// askEditAgain asks what to do with a policy that failed the check.
+// Without a terminal to ask on, the edit is discarded.
+func askEditAgain() bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("What now? (e)dit again, e(x)it without saving: ")
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "e", "edit":
+			return true
+		case "x", "exit", "q":
+			return false
+		}
+	}
+}
+
+func editPolicy(user string) {
+	// The editor is chosen by the caller, so only the real root may run it
+	if os.Getuid() != 0 {
+		fmt.Println("Error: Must be root to edit policies")
+		return
+	}
+	if err := os.MkdirAll(mixmagiskPolicy, 0755); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	lock, err := lockPolicyDir()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer lock.Close()
+
+	path := policyPath(user)
+	original, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error reading policy: %v\n", err)
+		return
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		// Keep the mode, but never let group or others write
+		mode = info.Mode().Perm() &^ 0022
+	}
+
+	tmp, err := os.CreateTemp("", "mixmagisk-"+user+"-*.policy")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(original)
+	tmp.Close()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	editor := policyEditor()
+	for {
+		cmd := exec.Command(editor[0], append(editor[1:], tmp.Name())...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Printf("Editor failed: %v\n", err)
+			fmt.Println("Policy not changed")
+			return
+		}
+
+		edited, err := os.ReadFile(tmp.Name())
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if bytes.Equal(edited, original) {
+			fmt.Println("No changes made")
+			return
+		}
+
+		issues, broken := policyEditErrors(tmp.Name())
+		for _, i := range issues {
+			fmt.Printf("  %s\n", i)
+		}
+		if !broken {
+			break
+		}
+		fmt.Printf("❌ %s has errors and was not installed\n", path)
+		if !askEditAgain() {
+			fmt.Println("Policy not changed")
+			return
+		}
+	}
+
+	if err := installPolicy(tmp.Name(), path, mode); err != nil {
+		fmt.Printf("Error installing policy: %v\n", err)
+		return
+	}
+	logAction("policy_edit", user, "Policy "+path+" updated")
+	fmt.Printf("✅ %s updated\n", path)
+}
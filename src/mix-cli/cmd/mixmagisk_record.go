@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// ============================================================================
+// Session Recording
+// ============================================================================
+//
+// With record_sessions = true in a user's policy, "mixmagisk -i" runs the
+// shell on a pseudo-terminal and records everything that passes through
+// it in sessionLogDir/<id>/:
+//
+//	typescript  terminal output, as written by script(1)
+//	input       keystrokes sent to the shell
+//	timing      "O|I <seconds since previous> <bytes>" per chunk, the
+//	            util-linux advanced format, so that
+//	            scriptreplay -B typescript -I input -t timing
+//	            can replay it
+//	meta.json   who, as whom, when and the shell's exit status
+
+const sessionLogDir = "/var/log/mixmagisk/sessions"
+
+// sessionMeta describes a recorded session
+type sessionMeta struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Target   string    `json:"target"`
+	TTY      string    `json:"tty,omitempty"`
+	Shell    string    `json:"shell"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+}
+
+// sessionRecorder writes the streams of one session
+type sessionRecorder struct {
+	dir  string
+	meta sessionMeta
+
+	mu     sync.Mutex
+	last   time.Time
+	out    *os.File
+	in     *os.File
+	timing *os.File
+}
+
+// recordSessionsEnabled reports whether the user's policy asks for
+// session recording
+func recordSessionsEnabled(user string) bool {
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return false
+	}
+	return policy.flag("record_sessions")
+}
+
+// newSessionRecorder creates the directory and files of a new recording
+func newSessionRecorder(user string, target *runTarget, shell string) (*sessionRecorder, error) {
+	now := time.Now()
+	id := fmt.Sprintf("%s-%s-%d", now.Format("20060102-150405"), user, os.Getpid())
+	dir := filepath.Join(sessionLogDir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("session recording: %w", err)
+	}
+
+	r := &sessionRecorder{
+		dir:  dir,
+		last: now,
+		meta: sessionMeta{ID: id, User: user, Target: target.String(), TTY: currentTTY(), Shell: shell, Start: now},
+	}
+	for name, f := range map[string]**os.File{"typescript": &r.out, "input": &r.in, "timing": &r.timing} {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("session recording: %w", err)
+		}
+		*f = file
+	}
+	if err := r.writeMeta(); err != nil {
+		r.close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// write appends a chunk of output ('O') or input ('I') with its timing
+func (r *sessionRecorder) write(stream byte, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	fmt.Fprintf(r.timing, "%c %.6f %d\n", stream, now.Sub(r.last).Seconds(), len(p))
+	r.last = now
+	if stream == 'I' {
+		r.in.Write(p)
+	} else {
+		r.out.Write(p)
+	}
+}
+
+func (r *sessionRecorder) writeMeta() error {
+	data, err := json.MarshalIndent(r.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(r.dir, "meta.json"), append(data, '\n'), 0600)
+}
+
+// finish records the end of the session and closes the files
+func (r *sessionRecorder) finish(exitCode int) {
+	r.mu.Lock()
+	r.meta.End = time.Now()
+	r.meta.ExitCode = &exitCode
+	r.mu.Unlock()
+	r.writeMeta()
+	r.close()
+}
+
+func (r *sessionRecorder) close() {
+	for _, f := range []*os.File{r.out, r.in, r.timing} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// openPTY allocates a pseudo-terminal pair
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlockpt: %w", err)
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("ptsname: %w", err)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// recordingWriter passes writes through to w and records them
+type recordingWriter struct {
+	w      io.Writer
+	rec    *sessionRecorder
+	stream byte
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.rec.write(rw.stream, p)
+	return rw.w.Write(p)
+}
+
+// runRecorded runs cmd on a new pseudo-terminal, relaying the user's
+// terminal to it and recording both directions
+func runRecorded(cmd *exec.Cmd, filter []unix.SockFilter, rec *sessionRecorder) error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return err
+	}
+	defer master.Close()
+
+	stdin := int(os.Stdin.Fd())
+	resize := func() {
+		if ws, err := unix.IoctlGetWinsize(stdin, unix.TIOCGWINSZ); err == nil {
+			unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, ws)
+		}
+	}
+	resize()
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	err = startSeccomp(cmd, filter)
+	slave.Close()
+	if err != nil {
+		return err
+	}
+
+	if term.IsTerminal(stdin) {
+		if state, err := term.MakeRaw(stdin); err == nil {
+			defer term.Restore(stdin, state)
+		}
+	}
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	go func() {
+		for range winch {
+			resize()
+		}
+	}()
+
+	// The input copy stays blocked on stdin after the shell exits; it
+	// ends with the process
+	go io.Copy(&recordingWriter{w: master, rec: rec, stream: 'I'}, os.Stdin)
+	// Reading the master fails with EIO once the shell has exited
+	io.Copy(&recordingWriter{w: os.Stdout, rec: rec, stream: 'O'}, master)
+	return cmd.Wait()
+}
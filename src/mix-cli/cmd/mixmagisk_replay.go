@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Session Replay
+// ============================================================================
+
+// listSessions reads the metadata of all recordings, oldest first
+func listSessions() ([]*sessionMeta, error) {
+	entries, err := os.ReadDir(sessionLogDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*sessionMeta
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(sessionLogDir, e.Name(), "meta.json"))
+		if err != nil {
+			continue
+		}
+		meta := &sessionMeta{}
+		if json.Unmarshal(data, meta) == nil {
+			sessions = append(sessions, meta)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	return sessions, nil
+}
+
+// duration returns how long the session ran, or false while it is running
+func (m *sessionMeta) duration() (time.Duration, bool) {
+	if m.End.IsZero() {
+		return 0, false
+	}
+	return m.End.Sub(m.Start).Round(time.Second), true
+}
+
+func showSessions() {
+	// Recordings hold everything typed in root shells: only root reads them
+	if os.Getuid() != 0 {
+		fmt.Println("Error: Must be root to list recorded sessions")
+		return
+	}
+	sessions, err := listSessions()
+	if err != nil {
+		fmt.Printf("Error reading sessions: %v\n", err)
+		return
+	}
+	if len(sessions) == 0 {
+		fmt.Println("No recorded sessions")
+		return
+	}
+
+	fmt.Printf("%-36s %-12s %-16s %-19s %9s %5s\n", "ID", "USER", "TARGET", "START", "DURATION", "EXIT")
+	for _, s := range sessions {
+		duration, exit := "running", "-"
+		if d, ok := s.duration(); ok {
+			duration = d.String()
+		}
+		if s.ExitCode != nil {
+			exit = strconv.Itoa(*s.ExitCode)
+		}
+		fmt.Printf("%-36s %-12s %-16s %-19s %9s %5s\n",
+			s.ID, s.User, s.Target, s.Start.Local().Format("2006-01-02 15:04:05"), duration, exit)
+	}
+}
+
+// replayOptions controls the pace of a replay
+type replayOptions struct {
+	speed    float64
+	maxDelay time.Duration
+}
+
+// replaySession handles "mixmagisk replay [--speed N] [--max-delay S] <id>"
+func replaySession(args []string) {
+	opts := replayOptions{}
+	var maxDelay float64
+	fs := flag.NewFlagSet("mixmagisk replay", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Float64Var(&opts.speed, "speed", 1, "playback speed factor")
+	fs.Float64Var(&maxDelay, "max-delay", 0, "longest pause in seconds (0 for no limit)")
+	err := fs.Parse(args)
+	if err == nil && (fs.NArg() != 1 || opts.speed <= 0 || maxDelay < 0) {
+		err = fmt.Errorf("expected one session id, --speed > 0 and --max-delay >= 0")
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Usage: mixmagisk replay [--speed N] [--max-delay SECONDS] <session-id>")
+		return
+	}
+	opts.maxDelay = time.Duration(maxDelay * float64(time.Second))
+
+	if os.Getuid() != 0 {
+		fmt.Println("Error: Must be root to replay recorded sessions")
+		return
+	}
+	id := fs.Arg(0)
+	if id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		fmt.Printf("Error: invalid session id %q\n", id)
+		return
+	}
+	dir := filepath.Join(sessionLogDir, id)
+
+	typescript, err := os.Open(filepath.Join(dir, "typescript"))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer typescript.Close()
+	timing, err := os.Open(filepath.Join(dir, "timing"))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer timing.Close()
+
+	if err := replay(os.Stdout, typescript, timing, opts, time.Sleep); err != nil {
+		fmt.Fprintf(os.Stderr, "\nmixmagisk: replay: %v\n", err)
+	}
+}
+
+// replay copies the recorded output to w, pausing between chunks as the
+// timing file says. Input chunks are not shown, but their delays count.
+func replay(w io.Writer, typescript io.Reader, timing io.Reader, opts replayOptions, sleep func(time.Duration)) error {
+	var pending time.Duration
+	scanner := bufio.NewScanner(timing)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return fmt.Errorf("timing line %d: malformed", line)
+		}
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("timing line %d: bad delay %q", line, fields[1])
+		}
+		n, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("timing line %d: bad length %q", line, fields[2])
+		}
+
+		pending += time.Duration(seconds / opts.speed * float64(time.Second))
+		if fields[0] != "O" {
+			continue
+		}
+		if opts.maxDelay > 0 && pending > opts.maxDelay {
+			pending = opts.maxDelay
+		}
+		if pending > 0 {
+			sleep(pending)
+		}
+		pending = 0
+		if _, err := io.CopyN(w, typescript, n); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
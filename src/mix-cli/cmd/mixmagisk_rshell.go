@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ============================================================================
+// Restricted Shell
+// ============================================================================
+//
+// With restricted_shell = true in a user's policy, "mixmagisk -i" starts a
+// minimal built-in shell instead of the user's $SHELL. Every line is split
+// into words and checked against the policy like "mixmagisk <command>"
+// would be, so the allow and deny rules still apply inside the shell.
+// Pipes, redirections, variables and command substitution are rejected
+// rather than interpreted, and globs are passed through unexpanded.
+
+// restrictedShellEnabled reports whether the user's policy asks for the
+// restricted shell
+func restrictedShellEnabled(user string) bool {
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return false
+	}
+	return policy.flag("restricted_shell")
+}
+
+// errShellSyntax reports shell features the restricted shell does not offer
+var errShellSyntax = errors.New("pipes, redirections, variables and command substitution are not available in the restricted shell")
+
+// splitShellWords splits a command line into words, honouring single
+// quotes, double quotes and backslash escapes
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case quote == '"':
+			switch {
+			case c == '"':
+				quote = 0
+			case c == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`+"`", runes[i+1]):
+				i++
+				word.WriteRune(runes[i])
+			case c == '$' || c == '`':
+				return nil, errShellSyntax
+			default:
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.ContainsRune("|&;<>()$`", c):
+			return nil, errShellSyntax
+		case c == '#' && !inWord:
+			i = len(runes)
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// runRestrictedShell reads commands from stdin until exit or end of input
+func runRestrictedShell(user string, target *runTarget) {
+	host, _ := os.Hostname()
+	mark := "#"
+	if !target.isRoot() {
+		mark = "$"
+	}
+
+	fmt.Printf("🔐 Restricted shell as %s\n", target)
+	fmt.Println("   Commands are checked against your policy; type 'help' or 'exit'")
+	fmt.Println()
+
+	// Ctrl-C interrupts the running command, not the shell. Catching the
+	// signal (rather than ignoring it) leaves it at its default in children.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+		}
+	}()
+
+	// mixmagisk never changes its own directory: it runs as euid 0 and
+	// would enter directories the target cannot
+	cwd, _ := os.Getwd()
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("%s@%s:%s%s ", target.User, host, cwd, mark)
+
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			fmt.Println()
+			break
+		}
+
+		args, err := splitShellWords(strings.TrimSpace(line))
+		if err != nil {
+			fmt.Printf("mixmagisk: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "exit", "logout":
+			fmt.Println("🔓 Exited restricted shell")
+			return
+		case "help":
+			showRestrictedShellHelp(user)
+			continue
+		case "pwd":
+			fmt.Println(cwd)
+			continue
+		case "cd":
+			dir := target.Home
+			if len(args) > 1 {
+				dir = args[1]
+			}
+			dir, err := shellDir(target, cwd, dir)
+			if err != nil {
+				fmt.Printf("cd: %v\n", err)
+				continue
+			}
+			cwd, target.Dir = dir, dir
+			continue
+		}
+
+		ev := enforcePolicy(user, target, args)
+		if !ev.Allowed || !authorize(user, target, args, ev) {
+			continue
+		}
+		runAsTarget(user, target, args)
+	}
+	fmt.Println("🔓 Exited restricted shell")
+}
+
+// shellDir resolves the argument of cd from cwd in a shell running as
+// target, so the directories are searched with the target's permissions
+func shellDir(target *runTarget, cwd, dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(cwd, dir)
+	}
+	cmd := exec.Command("/bin/sh", "-c", `cd -- "$1" 2>/dev/null && pwd`, "sh", dir)
+	cmd.Dir = "/"
+	cmd.Env = []string{}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential:  target.credential(),
+		AmbientCaps: target.Caps,
+	}
+	out, err := cmd.Output()
+	if _, failed := err.(*exec.ExitError); failed {
+		return "", fmt.Errorf("%s: no such directory, or %s may not enter it", dir, target.User)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// showRestrictedShellHelp lists the built-ins and the user's command rules
+func showRestrictedShellHelp(user string) {
+	fmt.Println("Built-in commands:")
+	fmt.Println("  cd [dir]   Change directory")
+	fmt.Println("  pwd        Print the current directory")
+	fmt.Println("  help       Show this help")
+	fmt.Println("  exit       Leave the shell")
+	fmt.Println()
+	fmt.Println("Words may be quoted with '...' or \"...\"; globs are not expanded.")
+
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return
+	}
+	fmt.Println()
+	fmt.Println("Policy rules:")
+	for _, e := range policy.Entries {
+		if e.Key == "allow" || e.Key == "nopasswd" || e.Key == "deny" {
+			fmt.Printf("  %-8s %s\n", e.Key, e.Value)
+		}
+	}
+}
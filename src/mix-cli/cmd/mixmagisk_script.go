@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ============================================================================
+// Scripting Support
+// ============================================================================
+//
+// With -S/--stdin the password is the first line of stdin and mixmagisk
+// prints nothing but one-line "mixmagisk: ..." errors on stderr, so that
+// CI jobs and other automation can run it:
+//
+//	echo "$PASSWORD" | mixmagisk -S systemctl restart app
+//
+// The exit status tells why a command did not run; once it ran, it is the
+// command's own status (128 plus the signal number if it was killed).
+
+// Exit statuses of mixmagisk itself
+const (
+	exitError       = 1   // usage, configuration or internal error
+	exitAuthFailed  = 121 // authentication failed
+	exitDenied      = 122 // not authorized, or denied by policy
+	exitPolicyError = 123 // the user's policy is invalid
+	exitNotFound    = 127 // command not found
+)
+
+// stdinPassword is set by -S/--stdin
+var stdinPassword bool
+
+// printFailure reports why mixmagisk stops: the given lines normally, or
+// only plain on stderr with -S
+func printFailure(plain string, lines ...string) {
+	if stdinPassword {
+		fmt.Fprintf(os.Stderr, "mixmagisk: %s\n", plain)
+		return
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+// readLine reads one line from f a byte at a time, so that nothing after
+// the newline is consumed: the rest of stdin belongs to the command
+func readLine(f io.Reader) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := f.Read(buf)
+		if n == 1 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// exitCode is the exit status for a command the policy did not allow
+func (ev *policyEvaluation) exitCode() int {
+	if ev.Action == "policy_error" {
+		return exitPolicyError
+	}
+	return exitDenied
+}
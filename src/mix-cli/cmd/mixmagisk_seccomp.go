@@ -0,0 +1,453 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// Seccomp Profiles
+// ============================================================================
+//
+// A policy with
+//
+//	seccomp = /etc/mixmagisk/seccomp/net-tools.json
+//
+// confines elevated commands with a seccomp filter. Profiles use the OCI /
+// Docker JSON format: defaultAction, and syscalls rules with names, action,
+// errnoRet, args conditions and includes/excludes on capabilities and
+// architectures. Rules are checked in file order and the first match
+// decides; syscall names unknown on this architecture are skipped, as
+// libseccomp does.
+//
+// The filter is compiled by mixmagisk and handed over a pipe to a helper
+// (mixmagisk re-executed with seccompHelperCmd) that runs as the target,
+// sets no_new_privs, installs the filter and execs the command. The helper
+// is started with no_new_privs already set so that the setuid bit of the
+// mixmagisk binary is ignored, and it refuses to run when its real and
+// effective ids differ.
+
+const seccompHelperCmd = "__seccomp-exec"
+
+// seccompProfile is an OCI seccomp profile
+type seccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint32          `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	Syscalls        []seccompSyscall `json:"syscalls"`
+}
+
+type seccompSyscall struct {
+	Names    []string         `json:"names"`
+	Name     string           `json:"name,omitempty"` // older single-name form
+	Action   string           `json:"action"`
+	ErrnoRet *uint32          `json:"errnoRet,omitempty"`
+	Args     []seccompArg     `json:"args,omitempty"`
+	Includes seccompCondition `json:"includes"`
+	Excludes seccompCondition `json:"excludes"`
+}
+
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo"`
+	Op       string `json:"op"`
+}
+
+type seccompCondition struct {
+	Arches []string `json:"arches,omitempty"`
+	Caps   []string `json:"caps,omitempty"`
+}
+
+// loadSeccompProfile reads a JSON seccomp profile
+func loadSeccompProfile(path string) (*seccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p seccompProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if p.DefaultAction == "" {
+		return nil, fmt.Errorf("%s: missing defaultAction", path)
+	}
+	return &p, nil
+}
+
+// seccompAction converts a profile action to a filter return value
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_ERRNO":
+		errno := uint32(unix.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return unix.SECCOMP_RET_ERRNO | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return unix.SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_LOG":
+		return unix.SECCOMP_RET_LOG, nil
+	}
+	return 0, fmt.Errorf("unsupported action %q", action)
+}
+
+// applies reports whether the includes/excludes conditions of a rule hold
+// for this architecture and the capabilities the target holds
+func (s *seccompSyscall) applies(holds func(string) bool) bool {
+	native := func(arch string) bool {
+		for _, name := range seccompArchNames {
+			if strings.EqualFold(arch, name) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(s.Includes.Arches) > 0 && !anyOf(s.Includes.Arches, native) {
+		return false
+	}
+	if anyOf(s.Excludes.Arches, native) {
+		return false
+	}
+	for _, c := range s.Includes.Caps {
+		if !holds(c) {
+			return false
+		}
+	}
+	return !anyOf(s.Excludes.Caps, holds)
+}
+
+func anyOf(items []string, pred func(string) bool) bool {
+	for _, item := range items {
+		if pred(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// bpfInsn is a filter instruction whose jumps may target the failure
+// label of the rule being compiled
+type bpfInsn struct {
+	unix.SockFilter
+	jtFail, jfFail bool
+}
+
+func bpfStmt(code uint16, k uint32) bpfInsn {
+	return bpfInsn{SockFilter: unix.SockFilter{Code: code, K: k}}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) bpfInsn {
+	return bpfInsn{SockFilter: unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}}
+}
+
+const (
+	bpfLoad = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+	bpfRet  = unix.BPF_RET | unix.BPF_K
+	bpfJEQ  = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	bpfJGT  = unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K
+	bpfJGE  = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+	bpfAnd  = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// compileArg emits the test of one argument condition; a false condition
+// jumps to the failure label. Arguments are 64-bit and compared as their
+// high and low 32-bit halves (little-endian).
+func compileArg(a seccompArg) ([]bpfInsn, error) {
+	if a.Index > 5 {
+		return nil, fmt.Errorf("argument index %d out of range", a.Index)
+	}
+	lo := uint32(seccompDataArgs + 8*a.Index)
+	hi := lo + 4
+	vlo, vhi := uint32(a.Value), uint32(a.Value>>32)
+	fail := func(i bpfInsn, onTrue bool) bpfInsn {
+		i.jtFail, i.jfFail = onTrue, !onTrue
+		return i
+	}
+
+	switch a.Op {
+	case "SCMP_CMP_EQ":
+		return []bpfInsn{
+			bpfStmt(bpfLoad, hi), fail(bpfJump(bpfJEQ, vhi, 0, 0), false),
+			bpfStmt(bpfLoad, lo), fail(bpfJump(bpfJEQ, vlo, 0, 0), false),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []bpfInsn{
+			bpfStmt(bpfLoad, hi), bpfJump(bpfJEQ, vhi, 0, 2),
+			bpfStmt(bpfLoad, lo), fail(bpfJump(bpfJEQ, vlo, 0, 0), true),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		// value is the mask, valueTwo the expected result
+		dlo, dhi := uint32(a.ValueTwo), uint32(a.ValueTwo>>32)
+		return []bpfInsn{
+			bpfStmt(bpfLoad, hi), bpfStmt(bpfAnd, vhi), fail(bpfJump(bpfJEQ, dhi, 0, 0), false),
+			bpfStmt(bpfLoad, lo), bpfStmt(bpfAnd, vlo), fail(bpfJump(bpfJEQ, dlo, 0, 0), false),
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		last := fail(bpfJump(bpfJGT, vlo, 0, 0), false)
+		if a.Op == "SCMP_CMP_GE" {
+			last.Code = bpfJGE
+		}
+		return []bpfInsn{
+			bpfStmt(bpfLoad, hi), bpfJump(bpfJGT, vhi, 3, 0), fail(bpfJump(bpfJEQ, vhi, 0, 0), false),
+			bpfStmt(bpfLoad, lo), last,
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		last := fail(bpfJump(bpfJGE, vlo, 0, 0), true)
+		if a.Op == "SCMP_CMP_LE" {
+			last.Code = bpfJGT
+		}
+		return []bpfInsn{
+			bpfStmt(bpfLoad, hi), bpfJump(bpfJGE, vhi, 0, 3), fail(bpfJump(bpfJEQ, vhi, 0, 0), false),
+			bpfStmt(bpfLoad, lo), last,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported argument operator %q", a.Op)
+}
+
+// compile builds the filter program. holds reports whether the target
+// has a capability (for includes/excludes); nil means all of them.
+func (p *seccompProfile) compile(holds func(string) bool) ([]unix.SockFilter, error) {
+	if seccompAuditArch == 0 {
+		return nil, errors.New("seccomp profiles are not supported on this architecture")
+	}
+	if len(p.Architectures) > 0 && !anyOf(p.Architectures, func(a string) bool {
+		return anyOf(seccompArchNames, func(n string) bool { return strings.EqualFold(a, n) })
+	}) {
+		return nil, fmt.Errorf("profile does not cover %s", seccompArchNames[0])
+	}
+	if holds == nil {
+		holds = func(string) bool { return true }
+	}
+	defaultRet, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Foreign architectures and x32 syscall numbers are killed outright
+	prog := []unix.SockFilter{
+		{Code: bpfLoad, K: seccompDataArch},
+		{Code: bpfJEQ, Jt: 1, K: seccompAuditArch},
+		{Code: bpfRet, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: bpfLoad, K: seccompDataNr},
+	}
+	if seccompX32Bit != 0 {
+		prog = append(prog,
+			unix.SockFilter{Code: bpfJGE, Jf: 1, K: seccompX32Bit},
+			unix.SockFilter{Code: bpfRet, K: unix.SECCOMP_RET_KILL_PROCESS})
+	}
+
+	for i := range p.Syscalls {
+		rule := &p.Syscalls[i]
+		if !rule.applies(holds) {
+			continue
+		}
+		ret, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("syscalls[%d]: %w", i, err)
+		}
+		var conds []bpfInsn
+		for _, a := range rule.Args {
+			code, err := compileArg(a)
+			if err != nil {
+				return nil, fmt.Errorf("syscalls[%d]: %w", i, err)
+			}
+			conds = append(conds, code...)
+		}
+
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+		for _, name := range names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+			if len(conds) == 0 {
+				prog = append(prog,
+					unix.SockFilter{Code: bpfJEQ, Jf: 1, K: nr},
+					unix.SockFilter{Code: bpfRet, K: ret})
+				continue
+			}
+
+			// jeq nr; conditions; ret; failure label: reload nr
+			block := append([]bpfInsn{bpfJump(bpfJEQ, nr, 0, 0)}, conds...)
+			block[0].jfFail = true
+			block = append(block, bpfStmt(bpfRet, ret), bpfStmt(bpfLoad, seccompDataNr))
+			failAt := len(block) - 1
+			for j := range block {
+				if failAt-j-1 > 255 {
+					return nil, fmt.Errorf("syscalls[%d]: too many argument conditions", i)
+				}
+				if block[j].jtFail {
+					block[j].Jt = uint8(failAt - j - 1)
+				}
+				if block[j].jfFail {
+					block[j].Jf = uint8(failAt - j - 1)
+				}
+				prog = append(prog, block[j].SockFilter)
+			}
+		}
+	}
+
+	prog = append(prog, unix.SockFilter{Code: bpfRet, K: defaultRet})
+	if len(prog) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("profile compiles to %d instructions (limit %d)", len(prog), unix.BPF_MAXINSNS)
+	}
+	return prog, nil
+}
+
+func validateSeccompProfile(v string) error {
+	p, err := loadSeccompProfile(v)
+	if err != nil {
+		return err
+	}
+	_, err = p.compile(nil)
+	return err
+}
+
+// policySeccomp returns the profile named by the user's policy, compiled
+// for target; path is "" when the policy sets none
+func policySeccomp(user string, target *runTarget) (path string, filter []unix.SockFilter, err error) {
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return "", nil, nil
+	}
+	path, _ = policy.get("seccomp")
+	if path == "" {
+		return "", nil, nil
+	}
+	profile, err := loadSeccompProfile(path)
+	if err != nil {
+		return path, nil, fmt.Errorf("seccomp profile: %w", err)
+	}
+	filter, err = profile.compile(target.holdsCapability)
+	if err != nil {
+		return path, nil, fmt.Errorf("seccomp profile %s: %w", path, err)
+	}
+	return path, filter, nil
+}
+
+// holdsCapability reports whether the target runs with a capability:
+// root holds all of them, a capability-scoped target its listed ones
+func (t *runTarget) holdsCapability(name string) bool {
+	if t.isRoot() && len(t.Caps) == 0 {
+		return true
+	}
+	name = "cap_" + strings.TrimPrefix(strings.ToLower(name), "cap_")
+	for _, c := range t.capNames {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runSeccomp runs cmd, confined by filter when it is not nil
+func runSeccomp(cmd *exec.Cmd, filter []unix.SockFilter) error {
+	if err := startSeccomp(cmd, filter); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// startSeccomp starts cmd, confined by filter when it is not nil
+func startSeccomp(cmd *exec.Cmd, filter []unix.SockFilter) error {
+	if filter == nil {
+		return cmd.Start()
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, filter)
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// The program is far smaller than the pipe buffer
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		w.Close()
+		return err
+	}
+	w.Close()
+
+	cmd.Args = append([]string{os.Args[0], "mixmagisk", seccompHelperCmd, cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	cmd.ExtraFiles = []*os.File{r}
+
+	// no_new_privs is set on a dedicated thread that the child is forked
+	// from; the thread is discarded afterwards because it stays locked
+	started := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			started <- fmt.Errorf("no_new_privs: %w", err)
+			return
+		}
+		started <- cmd.Start()
+	}()
+	return <-started
+}
+
+// runSeccompHelper installs the filter passed on fd 3 and execs the
+// command: mixmagisk __seccomp-exec <path> <argv...>
+func runSeccompHelper(args []string) {
+	fail := func(code int, format string, a ...any) {
+		fmt.Fprintf(os.Stderr, "mixmagisk: "+format+"\n", a...)
+		os.Exit(code)
+	}
+	// Started by a user through the setuid binary rather than by runSeccomp
+	if os.Getuid() != os.Geteuid() || os.Getgid() != os.Getegid() || len(args) < 2 {
+		fail(1, "unknown command %s", seccompHelperCmd)
+	}
+
+	f := os.NewFile(3, "seccomp-filter")
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || len(data) == 0 || len(data)%8 != 0 {
+		fail(126, "seccomp: no filter received")
+	}
+	filter := make([]unix.SockFilter, len(data)/8)
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, filter); err != nil {
+		fail(126, "seccomp: %v", err)
+	}
+
+	// The filter applies to this thread only; execve discards the others
+	runtime.LockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		fail(126, "no_new_privs: %v", err)
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := unix.RawSyscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, 0, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		fail(126, "seccomp: %v", errno)
+	}
+
+	err = unix.Exec(args[0], args[1:], os.Environ())
+	if errors.Is(err, syscall.ENOENT) {
+		fail(127, "%s: %v", args[0], err)
+	}
+	fail(126, "%s: %v", args[0], err)
+}
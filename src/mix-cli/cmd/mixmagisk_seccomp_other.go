@@ -0,0 +1,14 @@
+//go:build !amd64
+
+package cmd
+
+// Seccomp profiles are only compiled for x86-64; see
+// mixmagisk_seccomp_amd64.go
+
+const seccompAuditArch = 0
+
+var seccompArchNames []string
+
+const seccompX32Bit = 0
+
+var syscallNumbers map[string]uint32
@@ -0,0 +1,101 @@
+//go:build amd64
+
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runFilter interprets the subset of classic BPF the compiler emits
+func runFilter(t *testing.T, prog []unix.SockFilter, arch, nr uint32, args [6]uint64) uint32 {
+	data := make([]uint32, 16)
+	data[0], data[1] = nr, arch
+	for i, a := range args {
+		data[4+2*i], data[5+2*i] = uint32(a), uint32(a>>32)
+	}
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+		switch in.Code {
+		case bpfLoad:
+			acc = data[in.K/4]
+		case bpfAnd:
+			acc &= in.K
+		case bpfRet:
+			return in.K
+		case bpfJEQ, bpfJGT, bpfJGE:
+			cond := acc == in.K
+			if in.Code == bpfJGT {
+				cond = acc > in.K
+			} else if in.Code == bpfJGE {
+				cond = acc >= in.K
+			}
+			if cond {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		default:
+			t.Fatalf("unexpected instruction %#x", in.Code)
+		}
+	}
+	t.Fatal("filter fell off the end")
+	return 0
+}
+
+func TestSeccompCompile(t *testing.T) {
+	var profile seccompProfile
+	err := json.Unmarshal([]byte(`{
+		"defaultAction": "SCMP_ACT_ERRNO",
+		"syscalls": [
+			{"names": ["read", "write", "not_a_syscall"], "action": "SCMP_ACT_ALLOW"},
+			{"names": ["socket"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 1, "op": "SCMP_CMP_EQ"}]},
+			{"names": ["personality"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 4294967296, "op": "SCMP_CMP_LT"}]},
+			{"names": ["clone"], "action": "SCMP_ACT_ALLOW", "args": [{"index": 0, "value": 2114060288, "valueTwo": 0, "op": "SCMP_CMP_MASKED_EQ"}]},
+			{"names": ["mount"], "action": "SCMP_ACT_ALLOW", "includes": {"caps": ["CAP_SYS_ADMIN"]}}
+		]}`), &profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := uint32(unix.SECCOMP_RET_ERRNO | unix.EPERM)
+	arch := uint32(unix.AUDIT_ARCH_X86_64)
+	tests := []struct {
+		name     string
+		arch, nr uint32
+		arg0     uint64
+		expected uint32
+	}{
+		{"read", arch, unix.SYS_READ, 0, unix.SECCOMP_RET_ALLOW},
+		{"getpid", arch, unix.SYS_GETPID, 0, denied},
+		{"socket AF_UNIX", arch, unix.SYS_SOCKET, 1, unix.SECCOMP_RET_ALLOW},
+		{"socket AF_INET", arch, unix.SYS_SOCKET, 2, denied},
+		{"socket high bits", arch, unix.SYS_SOCKET, 1 | 1<<32, denied},
+		{"personality low", arch, unix.SYS_PERSONALITY, 0xffffffff, unix.SECCOMP_RET_ALLOW},
+		{"personality high", arch, unix.SYS_PERSONALITY, 1 << 32, denied},
+		{"clone thread", arch, unix.SYS_CLONE, unix.CLONE_VM | unix.CLONE_THREAD, unix.SECCOMP_RET_ALLOW},
+		{"clone newns", arch, unix.SYS_CLONE, unix.CLONE_NEWNS, denied},
+		{"mount", arch, unix.SYS_MOUNT, 0, denied},
+		{"x32 read", arch, seccompX32Bit | unix.SYS_READ, 0, unix.SECCOMP_RET_KILL_PROCESS},
+		{"i386", unix.AUDIT_ARCH_I386, unix.SYS_READ, 0, unix.SECCOMP_RET_KILL_PROCESS},
+	}
+
+	holds := func(name string) bool { return false }
+	prog, err := profile.compile(holds)
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	for _, tt := range tests {
+		if got := runFilter(t, prog, tt.arch, tt.nr, [6]uint64{tt.arg0}); got != tt.expected {
+			t.Errorf("%s: filter returned %#x, expected %#x", tt.name, got, tt.expected)
+		}
+	}
+
+	prog, _ = profile.compile(nil)
+	if got := runFilter(t, prog, arch, unix.SYS_MOUNT, [6]uint64{}); got != unix.SECCOMP_RET_ALLOW {
+		t.Errorf("mount with CAP_SYS_ADMIN: filter returned %#x, expected allow", got)
+	}
+}
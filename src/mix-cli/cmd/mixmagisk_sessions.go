@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Active Sessions
+// ============================================================================
+//
+// "mixmagisk sessions" lists the tickets in mixmagiskCache, that is every
+// terminal where someone can run commands without typing a password, and
+// "mixmagisk sessions kill" removes them, so an admin can end a user's
+// cached elevation at once instead of waiting for the timeout.
+
+// activeTicket is a ticket file as found in mixmagiskCache
+type activeTicket struct {
+	sessionTicket
+	ID       string    // file name without the "ticket_" prefix
+	LastUsed time.Time // modification time, refreshed on every use
+}
+
+// readTicket parses the ticket file at path
+func readTicket(path string) (*activeTicket, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	if len(lines) < 4 {
+		return nil, fmt.Errorf("%s: malformed ticket", path)
+	}
+	t := &activeTicket{
+		ID:       strings.TrimPrefix(filepath.Base(path), "ticket_"),
+		LastUsed: info.ModTime(),
+	}
+	t.TTY, t.SIDStart = lines[1], lines[3]
+	if t.UID, err = strconv.Atoi(lines[0]); err != nil {
+		return nil, fmt.Errorf("%s: malformed ticket", path)
+	}
+	if t.SID, err = strconv.Atoi(lines[2]); err != nil {
+		return nil, fmt.Errorf("%s: malformed ticket", path)
+	}
+	if len(lines) > 4 {
+		t.CreatedAt, _ = time.Parse(time.RFC3339, lines[4])
+	}
+	if len(lines) > 5 {
+		t.User = lines[5]
+	}
+	return t, nil
+}
+
+// listTickets returns all tickets, oldest first
+func listTickets() ([]*activeTicket, error) {
+	paths, err := filepath.Glob(filepath.Join(mixmagiskCache, "ticket_*"))
+	if err != nil {
+		return nil, err
+	}
+	var tickets []*activeTicket
+	for _, path := range paths {
+		if t, err := readTicket(path); err == nil {
+			tickets = append(tickets, t)
+		}
+	}
+	sort.Slice(tickets, func(i, j int) bool {
+		return tickets[i].CreatedAt.Before(tickets[j].CreatedAt)
+	})
+	return tickets, nil
+}
+
+// userName returns the name of the ticket's user, or #uid for an account
+// that no longer exists
+func (t *activeTicket) userName() string {
+	if u, err := user.LookupId(strconv.Itoa(t.UID)); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("#%d", t.UID)
+}
+
+// state tells whether checkSession would still accept the ticket
+func (t *activeTicket) state(timeout time.Duration) string {
+	switch {
+	case processStartTime(t.SID) != t.SIDStart:
+		return "ended" // the login session is gone
+	case timeout == 0 || time.Since(t.LastUsed) > timeout:
+		return "expired"
+	}
+	return "active"
+}
+
+// sessionsCmd handles "mixmagisk sessions ..."
+func sessionsCmd(args []string) {
+	switch {
+	case len(args) == 0:
+		showTickets()
+	case args[0] == "kill":
+		killTickets(args[1:])
+	case args[0] == "list":
+		showSessions()
+	default:
+		fmt.Println("Usage: mixmagisk sessions [kill <id> | kill --user <user> | list]")
+	}
+}
+
+func showTickets() {
+	// Other users' tickets say who can act as root right now
+	if os.Getuid() != 0 {
+		fmt.Println("Error: Must be root to list active sessions")
+		return
+	}
+	tickets, err := listTickets()
+	if err != nil {
+		fmt.Printf("Error reading sessions: %v\n", err)
+		return
+	}
+	if len(tickets) == 0 {
+		fmt.Println("No active sessions")
+		return
+	}
+
+	fmt.Printf("%-28s %-12s %6s %-10s %8s %8s  %s\n", "ID", "USER", "UID", "TTY", "AGE", "IDLE", "STATE")
+	for _, t := range tickets {
+		name := t.userName()
+		age := "-"
+		if !t.CreatedAt.IsZero() {
+			age = time.Since(t.CreatedAt).Round(time.Second).String()
+		}
+		idle := time.Since(t.LastUsed).Round(time.Second).String()
+		fmt.Printf("%-28s %-12s %6d %-10s %8s %8s  %s\n",
+			t.ID, name, t.UID, strings.TrimPrefix(t.TTY, "/dev/"), age, idle, t.state(sessionTimeout(name)))
+	}
+}
+
+// removeUserTickets removes every ticket of uid and returns how many
+// there were
+func removeUserTickets(uid int) int {
+	removed := 0
+	paths, _ := filepath.Glob(filepath.Join(mixmagiskCache, fmt.Sprintf("ticket_%d_*", uid)))
+	// tickets from before per-terminal sessions
+	paths = append(paths, filepath.Join(mixmagiskCache, fmt.Sprintf("session_%d", uid)))
+	for _, path := range paths {
+		if os.Remove(path) == nil {
+			removed++
+		}
+	}
+	return removed
+}
+
+// endUserSessions removes the tickets of the named user and logs why
+func endUserSessions(name, why string) int {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0
+	}
+	n := removeUserTickets(uid)
+	if n > 0 {
+		logAction("session_kill", name, fmt.Sprintf("%d session(s) ended %s", n, why))
+	}
+	return n
+}
+
+// killTickets handles "mixmagisk sessions kill <id>|--user <user>"
+func killTickets(args []string) {
+	if os.Getuid() != 0 {
+		fmt.Println("Error: Must be root to end sessions")
+		return
+	}
+
+	switch {
+	case len(args) == 2 && args[0] == "--user":
+		name, uid := args[1], -1
+		if id, ok := strings.CutPrefix(name, "#"); ok {
+			// The account may already be deleted
+			if n, err := strconv.Atoi(id); err == nil && n >= 0 {
+				uid = n
+			}
+			if u, err := user.LookupId(id); err == nil {
+				name = u.Username
+			}
+		} else if u, err := user.Lookup(name); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		if uid < 0 {
+			fmt.Printf("Error: unknown user %s\n", args[1])
+			return
+		}
+		n := removeUserTickets(uid)
+		if n == 0 {
+			fmt.Printf("No active sessions for %s\n", name)
+			return
+		}
+		logAction("session_kill", name, fmt.Sprintf("%d session(s) ended by root", n))
+		fmt.Printf("✅ Ended %d session(s) of %s\n", n, name)
+
+	case len(args) == 1 && !strings.HasPrefix(args[0], "-"):
+		id := args[0]
+		if strings.Contains(id, "/") {
+			fmt.Printf("Error: invalid session id %q\n", id)
+			return
+		}
+		t, err := readTicket(filepath.Join(mixmagiskCache, "ticket_"+id))
+		if err != nil {
+			fmt.Printf("No active session %s\n", id)
+			return
+		}
+		if err := os.Remove(filepath.Join(mixmagiskCache, "ticket_"+id)); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		logAction("session_kill", t.userName(), "Session "+id+" on "+t.TTY+" ended by root")
+		fmt.Printf("✅ Ended session %s of %s\n", id, t.userName())
+
+	default:
+		fmt.Println("Usage: mixmagisk sessions kill <id> | --user <user>")
+	}
+}
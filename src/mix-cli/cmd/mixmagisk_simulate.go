@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ============================================================================
+// Policy Simulation
+// ============================================================================
+
+// simulatePolicy implements "mixmagisk policy test <user> [-u U] [-g G] --
+// <command...>": it runs the same access checks as a real invocation by
+// user, prints every step and the decision, and executes nothing. The exit
+// status is 0 when the command would be allowed and 1 otherwise.
+func simulatePolicy(user string, args []string) {
+	opts, command, err := parseMixmagiskArgs(args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(2)
+	}
+	if len(command) == 0 {
+		fmt.Println("Error: no command given")
+		os.Exit(2)
+	}
+	target, err := resolveTarget(opts)
+	if err == nil {
+		target, err = scopeTarget(user, opts, target)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("User:     %s\n", user)
+	fmt.Printf("Target:   %s\n", target)
+	fmt.Printf("Command:  %s\n", strings.Join(command, " "))
+
+	allowed, nopasswd := true, false
+	reason, ok := rootAccessReason(user)
+	fmt.Printf("Access:   %s %s\n", checkMark(ok), reason)
+	if !ok {
+		allowed = false
+	} else {
+		ev := evaluatePolicy(user, target, command)
+		if ev.Path != "" {
+			fmt.Printf("Resolved: %s\n", ev.Path)
+		} else {
+			fmt.Printf("Resolved: (not found in the secure PATH)\n")
+		}
+		fmt.Printf("Policy:   %s %s\n", checkMark(ev.Allowed), ev.Reason)
+		allowed, nopasswd = ev.Allowed, ev.NoPasswd
+	}
+
+	fmt.Println()
+	switch {
+	case allowed && nopasswd:
+		fmt.Println("Decision: ✅ ALLOWED (no password required)")
+		return
+	case allowed:
+		fmt.Println("Decision: ✅ ALLOWED (a password may still be required)")
+		return
+	}
+	fmt.Println("Decision: ❌ DENIED")
+	os.Exit(1)
+}
+
+func checkMark(ok bool) string {
+	if ok {
+		return "✅"
+	}
+	return "❌"
+}
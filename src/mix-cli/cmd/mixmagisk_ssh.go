@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// SSH Agent / Certificate Authentication
+// ============================================================================
+//
+// Automation accounts connecting over SSH with agent forwarding can elevate
+// without a password. The agent is asked to sign a fresh random challenge
+// with a key that the user's policy trusts, either:
+//
+//   ssh_ca = /etc/mixmagisk/ssh_user_ca.pub       (certificates signed by CA)
+//   ssh_principals = deploy, ci                   (accepted cert principals)
+//   ssh_authorized_keys = /etc/mixmagisk/keys/ci  (plain public keys)
+//
+// mixmagisk runs as root, which may open any user's agent socket, so the
+// agent is only trusted when both its socket and the process serving it
+// belong to the real uid.
+
+// authenticateSSH tries agent-based authentication and returns the identity
+// of the key or certificate that answered the challenge.
+func authenticateSSH(user string) (string, bool) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return "", false
+	}
+
+	policy, err := loadUserPolicy(user)
+	if err != nil {
+		return "", false
+	}
+
+	caKeys := loadSSHKeys(policy.values("ssh_ca"))
+	principals := policy.values("ssh_principals")
+	authorized := loadSSHKeys(policy.values("ssh_authorized_keys"))
+	if len(caKeys) == 0 && len(authorized) == 0 {
+		return "", false
+	}
+
+	conn, err := dialSSHAgent(sock)
+	if err != nil {
+		return "", false
+	}
+	defer conn.Close()
+
+	client := agent.NewClient(conn)
+	keys, err := client.List()
+	if err != nil {
+		return "", false
+	}
+
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+
+		identity := ""
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			identity, ok = checkSSHCertificate(cert, caKeys, principals)
+			if !ok {
+				continue
+			}
+		} else if containsSSHKey(authorized, pub) {
+			identity = "ssh-key:" + ssh.FingerprintSHA256(pub)
+		} else {
+			continue
+		}
+
+		if verifyAgentChallenge(client, pub) {
+			return identity, true
+		}
+	}
+
+	return "", false
+}
+
+// dialSSHAgent connects to the agent at sock when it is the caller's: the
+// socket is owned by the real uid, and so is the peer that accepted
+func dialSSHAgent(sock string) (net.Conn, error) {
+	info, err := os.Lstat(sock)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if info.Mode()&os.ModeSocket == 0 || !ok || int(st.Uid) != os.Getuid() {
+		return nil, fmt.Errorf("%s is not an agent socket of uid %d", sock, os.Getuid())
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	// The socket may have been replaced since the Lstat
+	raw, err := conn.(*net.UnixConn).SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		credErr = err
+	}
+	if credErr != nil {
+		conn.Close()
+		return nil, credErr
+	}
+	if int(cred.Uid) != os.Getuid() {
+		conn.Close()
+		return nil, fmt.Errorf("the agent at %s runs as uid %d, not %d", sock, cred.Uid, os.Getuid())
+	}
+	return conn, nil
+}
+
+// checkSSHCertificate validates a user certificate against the trusted CAs
+// and accepted principals
+func checkSSHCertificate(cert *ssh.Certificate, caKeys []ssh.PublicKey, principals []string) (string, bool) {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return containsSSHKey(caKeys, auth)
+		},
+	}
+
+	for _, principal := range principals {
+		if err := checker.CheckCert(principal, cert); err == nil {
+			return fmt.Sprintf("ssh-cert:%s principal=%s serial=%d ca=%s",
+				cert.KeyId, principal, cert.Serial, ssh.FingerprintSHA256(cert.SignatureKey)), true
+		}
+	}
+	return "", false
+}
+
+// verifyAgentChallenge asks the agent to sign random data with pub and
+// verifies the signature
+func verifyAgentChallenge(client agent.ExtendedAgent, pub ssh.PublicKey) bool {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return false
+	}
+	challenge = append([]byte("mixmagisk-elevation:"), challenge...)
+
+	sig, err := client.Sign(pub, challenge)
+	if err != nil {
+		return false
+	}
+
+	verifyKey := pub
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		verifyKey = cert.Key
+	}
+	return verifyKey.Verify(challenge, sig) == nil
+}
+
+// loadSSHKeys reads public keys from authorized_keys-format files
+func loadSSHKeys(paths []string) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			// Accept both authorized_keys and "@cert-authority" known_hosts style lines
+			line = strings.TrimPrefix(line, "@cert-authority ")
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func containsSSHKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
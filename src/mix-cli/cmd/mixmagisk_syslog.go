@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+// ============================================================================
+// Syslog / journald Forwarding
+// ============================================================================
+//
+// With forward_syslog enabled in the [log] section of /etc/mixmagisk/config
+// every audit record is also sent to the local log daemon: to journald over
+// its native socket when it is running (with the record fields as
+// MIXMAGISK_* journal fields), otherwise to syslog via /dev/log.
+//
+//	[log]
+//	forward_syslog = true
+//	syslog_facility = authpriv
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// syslogFacilities maps facility names to their syslog values
+var syslogFacilities = map[string]syslog.Priority{
+	"auth":     syslog.LOG_AUTH,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"daemon":   syslog.LOG_DAEMON,
+	"user":     syslog.LOG_USER,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// forwardAuditRecord sends r to journald or syslog if forwarding is enabled
+func forwardAuditRecord(r *auditRecord) {
+	s := loadMixmagiskSettings()
+	if !s.boolean("log", "forward_syslog", false) {
+		return
+	}
+	facility, ok := syslogFacilities[s.str("log", "syslog_facility", "authpriv")]
+	if !ok {
+		facility = syslog.LOG_AUTHPRIV
+	}
+
+	severity := syslog.LOG_INFO
+	switch r.Result {
+	case "denied":
+		severity = syslog.LOG_WARNING
+	case "error":
+		severity = syslog.LOG_ERR
+	case "failed":
+		severity = syslog.LOG_NOTICE
+	}
+
+	if err := sendJournal(r, facility, severity); err == nil {
+		return
+	}
+	if w, err := syslog.New(facility|severity, "mixmagisk"); err == nil {
+		w.Write([]byte(r.syslogMessage()))
+		w.Close()
+	}
+}
+
+// syslogMessage renders r in the key=value style of sudo's syslog lines
+func (r *auditRecord) syslogMessage() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s : action=%s result=%s", r.User, r.Action, r.Result)
+	if r.TTY != "" {
+		fmt.Fprintf(&b, " ; TTY=%s", strings.TrimPrefix(r.TTY, "/dev/"))
+	}
+	if r.Cwd != "" {
+		fmt.Fprintf(&b, " ; PWD=%s", r.Cwd)
+	}
+	if r.Target != "" {
+		fmt.Fprintf(&b, " ; TARGET=%s", r.Target)
+	}
+	if len(r.Argv) > 0 {
+		fmt.Fprintf(&b, " ; COMMAND=%s", strings.Join(r.Argv, " "))
+	}
+	if r.ExitCode != nil {
+		fmt.Fprintf(&b, " ; EXIT=%d", *r.ExitCode)
+	}
+	if r.Details != "" {
+		fmt.Fprintf(&b, " ; %s", r.Details)
+	}
+	return b.String()
+}
+
+// sendJournal sends r to journald using its native datagram protocol
+func sendJournal(r *auditRecord, facility, severity syslog.Priority) error {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	field := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(&buf, "%s=%s\n", key, value)
+			return
+		}
+		// Multi-line values use the length-prefixed binary form
+		buf.WriteString(key + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(value)))
+		buf.WriteString(value + "\n")
+	}
+
+	field("MESSAGE", r.syslogMessage())
+	field("PRIORITY", fmt.Sprint(int(severity)))
+	field("SYSLOG_FACILITY", fmt.Sprint(int(facility)>>3))
+	field("SYSLOG_IDENTIFIER", "mixmagisk")
+	field("MIXMAGISK_ACTION", r.Action)
+	field("MIXMAGISK_USER", r.User)
+	field("MIXMAGISK_UID", fmt.Sprint(r.UID))
+	field("MIXMAGISK_TTY", r.TTY)
+	field("MIXMAGISK_CWD", r.Cwd)
+	field("MIXMAGISK_TARGET", r.Target)
+	field("MIXMAGISK_COMMAND", strings.Join(r.Argv, " "))
+	field("MIXMAGISK_RESULT", r.Result)
+	if r.ExitCode != nil {
+		field("MIXMAGISK_EXIT_CODE", fmt.Sprint(*r.ExitCode))
+	}
+	field("MIXMAGISK_DETAILS", r.Details)
+
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
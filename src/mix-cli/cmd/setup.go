@@ -11,9 +11,13 @@ import (
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/mixos-go/src/mix-cli/pkg/shadow"
 	"github.com/spf13/cobra"
 )
 
+// setupRoot is the root of the system being configured
+var setupRoot = "/"
+
 // ============================================================================
 // Styles
 // ============================================================================
@@ -89,6 +93,127 @@ const welcomeArt = `
     ╚══════════════════════════════════════════════════════════════╝
 `
 
+// ============================================================================
+// Layout
+// ============================================================================
+
+// Smallest terminal the setup screens can be laid out in. 80x24 serial
+// consoles get the compact layout.
+const (
+	setupMinWidth  = 60
+	setupMinHeight = 20
+
+	// Below this height blank lines are squeezed and padding dropped
+	setupCompactHeight = 32
+)
+
+// tooSmall reports whether the terminal is below the minimum size. Before
+// the first WindowSizeMsg the size is unknown and assumed to fit.
+func (m setupModel) tooSmall() bool {
+	return m.width > 0 && (m.width < setupMinWidth || m.height < setupMinHeight)
+}
+
+// compact reports whether the short-terminal layout should be used
+func (m setupModel) compact() bool {
+	return m.height > 0 && m.height < setupCompactHeight
+}
+
+// fullArt reports whether there is room for the ASCII art banners
+func (m setupModel) fullArt() bool {
+	return !m.compact() && (m.width == 0 || m.width >= 72)
+}
+
+// box renders a step inside the setup frame, reflowed to fit the terminal:
+// long lines are wrapped and, if the step is still too tall, the middle is
+// cut so the key help on the last line stays visible.
+func (m setupModel) box(content string) string {
+	style := boxStyle
+	if m.compact() {
+		style = style.Padding(0, 1)
+	}
+	if m.width == 0 || m.height == 0 {
+		return style.Render(content)
+	}
+
+	// One column spare: terminals disagree on the width of some emoji
+	inner := m.width - style.GetHorizontalFrameSize() - 1
+	if lipgloss.Width(content) > inner {
+		content = lipgloss.NewStyle().Width(inner).Render(content)
+	}
+
+	lines := strings.Split(content, "\n")
+	if m.compact() {
+		lines = squeezeBlankLines(lines)
+	}
+
+	// Leave a line below the frame for error messages
+	maxLines := m.height - style.GetVerticalFrameSize() - 1
+	if len(lines) > maxLines && maxLines > 2 {
+		last := lines[len(lines)-1]
+		lines = append(lines[:maxLines-2:maxLines-2], mutedStyle.Render("  …"), last)
+	}
+
+	return style.Render(strings.Join(lines, "\n"))
+}
+
+// fitInputs narrows the text inputs so prompt and field fit inside the
+// frame on narrow terminals
+func (m *setupModel) fitInputs() {
+	for i := range m.inputs {
+		width := 30
+		if i == 7 {
+			width = 40
+		}
+		avail := m.width - lipgloss.Width(m.inputs[i].Prompt) - 10
+		if avail < width {
+			width = max(avail, 8)
+		}
+		m.inputs[i].Width = width
+	}
+}
+
+// squeezeBlankLines collapses runs of blank lines into one
+func squeezeBlankLines(lines []string) []string {
+	out := make([]string, 0, len(lines))
+	blank := false
+	for _, line := range lines {
+		isBlank := strings.TrimSpace(line) == ""
+		if isBlank && blank {
+			continue
+		}
+		blank = isBlank
+		out = append(out, line)
+	}
+	return out
+}
+
+// viewTooSmall replaces the step view when the terminal cannot hold it
+func (m setupModel) viewTooSmall() string {
+	lines := []string{
+		"Terminal too small",
+		"",
+		fmt.Sprintf("Current size: %dx%d", m.width, m.height),
+		fmt.Sprintf("Required:     %dx%d", setupMinWidth, setupMinHeight),
+		"",
+		"Resize the window or press Q to quit.",
+	}
+
+	var s strings.Builder
+	for i, line := range lines {
+		if len(line) > m.width {
+			line = line[:m.width]
+		}
+		if i == 0 {
+			line = errorStyle.Render(line)
+		}
+		s.WriteString(line)
+		if i < len(lines)-1 {
+			s.WriteString("\n")
+		}
+	}
+	return s.String()
+}
+
 // ============================================================================
 // Setup Steps
 // ============================================================================
@@ -99,6 +224,8 @@ const (
 	stepWelcome setupStep = iota
 	stepCredentials
 	stepNetwork
+	stepNetworkAdvanced
+	stepTime
 	stepDiskVRAM
 	stepProfiles
 	stepSummary
@@ -125,29 +252,62 @@ type setupModel struct {
 	progress    int
 	progressMsg string
 
+	// reconfigure names the single section being edited on an installed
+	// system ("network", "credentials", "time", "profile"); empty for a full install
+	reconfigure string
+
+	// disks lists whole disks available to the storage layouts
+	disks []string
+
+	// failed is the install task waiting for a retry/skip/abort decision;
+	// failChoice is the highlighted option
+	failed     *installErrorMsg
+	failChoice int
+	aborted    bool
+
 	// Configuration
 	config setupConfig
 }
 
 type setupConfig struct {
 	// Credentials
-	hostname string
-	username string
-	password string
+	hostname     string
+	username     string
+	passwordHash string // sha512crypt; the plaintext is never kept
 
 	// Network
 	networkType string // dhcp, static, none
+	iface       string // NIC carrying the address without a bond; detected when empty
 	ipAddress   string
 	gateway     string
 	dns         string
 
+	// Advanced network: the address above is applied to bond0 when
+	// bonding is enabled
+	bondEnabled bool
+	bondMode    string
+	bondSlaves  string // space or comma separated NICs
+	vlans       string // VLAN specs, see parseVLANs
+
+	// Time
+	ntpEnabled bool
+	ntpServers string // space or comma separated
+	hwclock    string // utc, localtime
+
 	// Disk/VRAM
-	bootMode    string // vram, standard, minimal
-	diskTarget  string
-	vramSize    string
+	bootMode      string // vram, standard, minimal
+	storageLayout string // existing, plain, lvm, raid1
+	diskTarget    string
+	diskSecondary string // second RAID1 member
+	vramSize      string
 
 	// Profiles
 	profile string // desktop, server, minimal, developer
+
+	startedAt time.Time
+
+	// skippedTasks lists install tasks the user chose to skip after a failure
+	skippedTasks []string
 }
 
 // ============================================================================
@@ -160,7 +320,11 @@ type installProgressMsg struct {
 	message  string
 }
 type installCompleteMsg struct{}
-type installErrorMsg struct{ err error }
+type installErrorMsg struct {
+	progress int
+	message  string
+	err      error
+}
 
 // ============================================================================
 // Init
@@ -172,7 +336,7 @@ func initialSetupModel() setupModel {
 	s.Style = lipgloss.NewStyle().Foreground(primaryColor)
 
 	// Create text inputs
-	inputs := make([]textinput.Model, 7)
+	inputs := make([]textinput.Model, 10)
 
 	// Hostname
 	inputs[0] = textinput.New()
@@ -226,19 +390,93 @@ func initialSetupModel() setupModel {
 	inputs[6].Width = 30
 	inputs[6].Prompt = "💾 VRAM Size: "
 
-	return setupModel{
+	// NTP Servers
+	inputs[7] = textinput.New()
+	inputs[7].Placeholder = defaultNTPServers
+	inputs[7].CharLimit = 128
+	inputs[7].Width = 40
+	inputs[7].Prompt = "🕒 NTP Servers: "
+
+	// Bond NICs
+	inputs[8] = textinput.New()
+	inputs[8].Placeholder = "eth0 eth1"
+	inputs[8].CharLimit = 64
+	inputs[8].Width = 30
+	inputs[8].Prompt = "🔗 Bond NICs: "
+
+	// VLANs
+	inputs[9] = textinput.New()
+	inputs[9].Placeholder = "10 20=dhcp 30=10.0.30.5/24"
+	inputs[9].CharLimit = 128
+	inputs[9].Width = 30
+	inputs[9].Prompt = "🏷  VLANs: "
+
+	m := setupModel{
 		step:     stepWelcome,
 		spinner:  s,
 		inputs:   inputs,
 		selected: make(map[int]struct{}),
+		disks:    listInstallDisks(),
 		config: setupConfig{
-			hostname:    "mixos",
-			username:    "user",
-			networkType: "dhcp",
-			bootMode:    "vram",
-			profile:     "desktop",
+			hostname:      "mixos",
+			username:      "user",
+			networkType:   "dhcp",
+			ntpEnabled:    true,
+			ntpServers:    defaultNTPServers,
+			hwclock:       "utc",
+			bootMode:      "vram",
+			storageLayout: "existing",
+			bondMode:      defaultBondMode,
+			profile:       "desktop",
 		},
 	}
+	if nics := listNetworkInterfaces(); len(nics) >= 2 {
+		m.config.bondSlaves = nics[0] + " " + nics[1]
+	}
+	if len(m.disks) > 0 {
+		m.config.diskTarget = m.disks[0]
+	}
+	if len(m.disks) > 1 {
+		m.config.diskSecondary = m.disks[1]
+	}
+	return m
+}
+
+// reconfigureSetupModel returns a model that opens directly on a single
+// step, pre-filled from the live system.
+func reconfigureSetupModel(section string) (setupModel, error) {
+	m := initialSetupModel()
+	m.reconfigure = section
+	loadLiveSetupConfig(&m.config)
+
+	switch section {
+	case "credentials":
+		m.step = stepCredentials
+		m.inputs[0].SetValue(m.config.hostname)
+		m.inputs[1].SetValue(m.config.username)
+	case "network":
+		m.step = stepNetwork
+		m.inputs[0].Blur()
+		m.inputs[3].SetValue(m.config.ipAddress)
+		m.inputs[4].SetValue(m.config.gateway)
+		m.inputs[5].SetValue(m.config.dns)
+		m.inputs[8].SetValue(m.config.bondSlaves)
+		m.inputs[9].SetValue(m.config.vlans)
+		if m.config.networkType == "static" {
+			m.focusIndex = 3
+			m.inputs[3].Focus()
+		}
+	case "time":
+		m.step = stepTime
+		m.inputs[0].Blur()
+		m.inputs[7].SetValue(m.config.ntpServers)
+	case "profile":
+		m.step = stepProfiles
+		m.inputs[0].Blur()
+	default:
+		return m, fmt.Errorf("unknown section %q (expected network, credentials, time or profile)", section)
+	}
+	return m, nil
 }
 
 func (m setupModel) Init() tea.Cmd {
@@ -259,6 +497,7 @@ func (m setupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.WindowSizeMsg:
 		m.width = msg.Width
 		m.height = msg.Height
+		m.fitInputs()
 
 	case tea.KeyMsg:
 		switch msg.String() {
@@ -278,12 +517,28 @@ func (m setupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "shift+tab", "up":
 			return m.handlePrev()
 
+		case "r", "s", "a":
+			if m.failed != nil {
+				return m.handleInstallFailure(strings.Index("rsa", msg.String()))
+			}
+
 		case "left", "right":
-			if m.step == stepNetwork || m.step == stepDiskVRAM || m.step == stepProfiles {
+			if m.failed != nil {
+				if msg.String() == "right" {
+					m.failChoice = (m.failChoice + 1) % len(installFailureOptions)
+				} else {
+					m.failChoice = (m.failChoice + len(installFailureOptions) - 1) % len(installFailureOptions)
+				}
+				return m, nil
+			}
+			if m.step == stepNetwork || m.step == stepNetworkAdvanced || m.step == stepTime || m.step == stepDiskVRAM || m.step == stepProfiles {
 				return m.handleSelect(msg.String())
 			}
 
 		case "esc":
+			if m.reconfigure != "" {
+				return m, tea.Quit
+			}
 			if m.step > stepWelcome && m.step < stepInstalling {
 				m.step--
 			}
@@ -307,11 +562,13 @@ func (m setupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case installErrorMsg:
 		m.err = msg.err
+		m.failed = &msg
+		m.failChoice = 0
 		m.installing = false
 	}
 
 	// Update text inputs
-	if m.step == stepCredentials || m.step == stepNetwork {
+	if m.step == stepCredentials || m.step == stepNetwork || m.step == stepNetworkAdvanced || m.step == stepTime || m.step == stepDiskVRAM {
 		for i := range m.inputs {
 			var cmd tea.Cmd
 			m.inputs[i], cmd = m.inputs[i].Update(msg)
@@ -323,6 +580,10 @@ func (m setupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m setupModel) handleEnter() (tea.Model, tea.Cmd) {
+	if m.reconfigure != "" && m.step != stepComplete {
+		return m.handleReconfigureEnter()
+	}
+
 	switch m.step {
 	case stepWelcome:
 		m.step = stepCredentials
@@ -337,7 +598,13 @@ func (m setupModel) handleEnter() (tea.Model, tea.Cmd) {
 			m.config.username = m.inputs[1].Value()
 		}
 		if m.inputs[2].Value() != "" {
-			m.config.password = m.inputs[2].Value()
+			hash, err := shadow.HashPassword(m.inputs[2].Value())
+			if err != nil {
+				m.err = err
+				return m, nil
+			}
+			m.config.passwordHash = hash
+			m.inputs[2].SetValue("")
 		}
 		m.step = stepNetwork
 		m.cursor = 0
@@ -349,6 +616,23 @@ func (m setupModel) handleEnter() (tea.Model, tea.Cmd) {
 			m.config.gateway = m.inputs[4].Value()
 			m.config.dns = m.inputs[5].Value()
 		}
+		m.enterNetworkAdvanced()
+
+	case stepNetworkAdvanced:
+		if err := m.saveNetworkAdvanced(); err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.err = nil
+		m.inputs[8].Blur()
+		m.inputs[9].Blur()
+		m.step = stepTime
+		m.cursor = 0
+
+	case stepTime:
+		m.saveTimeInputs()
+		m.inputs[7].Blur()
+		m.inputs[6].Focus()
 		m.step = stepDiskVRAM
 		m.cursor = 0
 
@@ -357,6 +641,17 @@ func (m setupModel) handleEnter() (tea.Model, tea.Cmd) {
 		if m.inputs[6].Value() != "" {
 			m.config.vramSize = m.inputs[6].Value()
 		}
+		if m.config.bootMode == "vram" {
+			if _, err := validateVramSize(m.vramSizeInput()); err != nil {
+				m.err = err
+				return m, nil
+			}
+		}
+		if err := validateStorage(m.config); err != nil {
+			m.err = err
+			return m, nil
+		}
+		m.err = nil
 		m.step = stepProfiles
 		m.cursor = 0
 
@@ -365,10 +660,16 @@ func (m setupModel) handleEnter() (tea.Model, tea.Cmd) {
 
 	case stepSummary:
 		m.step = stepInstalling
+		m.config.startedAt = time.Now()
 		m.installing = true
 		m.progress = 0
 		return m, m.doInstallStep()
 
+	case stepInstalling:
+		if m.failed != nil {
+			return m.handleInstallFailure(m.failChoice)
+		}
+
 	case stepComplete:
 		return m, tea.Quit
 	}
@@ -376,6 +677,101 @@ func (m setupModel) handleEnter() (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// handleReconfigureEnter saves the current step's values and applies them
+// to the live system without running the install phase.
+func (m setupModel) handleReconfigureEnter() (tea.Model, tea.Cmd) {
+	var apply []func(setupConfig) error
+
+	switch m.step {
+	case stepCredentials:
+		if m.inputs[0].Value() != "" {
+			m.config.hostname = m.inputs[0].Value()
+		}
+		if m.inputs[1].Value() != "" {
+			m.config.username = m.inputs[1].Value()
+		}
+		if m.inputs[2].Value() != "" {
+			hash, err := shadow.HashPassword(m.inputs[2].Value())
+			if err != nil {
+				m.err = err
+				return m, nil
+			}
+			m.config.passwordHash = hash
+			m.inputs[2].SetValue("")
+		}
+		apply = append(apply, setupHostname, setupUserAccount)
+
+	case stepNetwork:
+		// Bond and VLAN settings are applied from the next screen
+		if m.config.networkType == "static" {
+			m.config.ipAddress = m.inputs[3].Value()
+			m.config.gateway = m.inputs[4].Value()
+			m.config.dns = m.inputs[5].Value()
+		}
+		m.enterNetworkAdvanced()
+		return m, nil
+
+	case stepNetworkAdvanced:
+		if err := m.saveNetworkAdvanced(); err != nil {
+			m.err = err
+			return m, nil
+		}
+		apply = append(apply, setupNetwork)
+
+	case stepTime:
+		m.saveTimeInputs()
+		apply = append(apply, setupTime)
+
+	case stepProfiles:
+		apply = append(apply, setupProfile)
+	}
+
+	for _, fn := range apply {
+		if err := fn(m.config); err != nil {
+			m.err = err
+			return m, nil
+		}
+	}
+
+	m.err = nil
+	m.step = stepComplete
+	return m, nil
+}
+
+// vramSizeInput returns the VRAM size being entered, or the default
+func (m setupModel) vramSizeInput() string {
+	if v := strings.TrimSpace(m.inputs[6].Value()); v != "" {
+		return v
+	}
+	if m.config.vramSize != "" {
+		return m.config.vramSize
+	}
+	return "2G"
+}
+
+// validateVramSize checks a VRAM size against physical memory. Sizes above
+// physical RAM are refused; sizes above half of it return a warning.
+func validateVramSize(size string) (string, error) {
+	sizeMB, err := parseSizeMB(size)
+	if err != nil {
+		return "", fmt.Errorf("VRAM size: %w (use e.g. 2G or 512M)", err)
+	}
+
+	info, err := getMemInfo()
+	if err != nil || info.MemTotal == 0 {
+		return "Could not read /proc/meminfo; VRAM size not checked", nil
+	}
+
+	if sizeMB > info.MemTotal {
+		return "", fmt.Errorf("VRAM size %s (%d MB) exceeds physical memory (%d MB)", size, sizeMB, info.MemTotal)
+	}
+	if sizeMB > info.MemTotal/2 {
+		return fmt.Sprintf("VRAM size %d MB is more than half of RAM (%d MB); little memory will be left for applications",
+			sizeMB, info.MemTotal), nil
+	}
+	return "", nil
+}
+
 func (m setupModel) handleNext() (tea.Model, tea.Cmd) {
 	switch m.step {
 	case stepCredentials:
@@ -411,13 +807,32 @@ func (m setupModel) handleNext() (tea.Model, tea.Cmd) {
 			}
 		}
 
-	case stepDiskVRAM, stepProfiles:
+	case stepNetworkAdvanced:
 		m.cursor++
-		maxCursor := 2
-		if m.step == stepProfiles {
-			maxCursor = 3
+		if m.cursor > 3 {
+			m.cursor = 0
 		}
-		if m.cursor > maxCursor {
+		if !m.config.bondEnabled && (m.cursor == 1 || m.cursor == 2) {
+			m.cursor = 3
+		}
+		m.focusNetworkAdvancedInput()
+
+	case stepTime:
+		m.cursor++
+		if m.cursor >= m.timeRows() {
+			m.cursor = 0
+		}
+		m.focusTimeInput()
+
+	case stepDiskVRAM:
+		m.cursor++
+		if m.cursor >= m.diskRows() {
+			m.cursor = 0
+		}
+
+	case stepProfiles:
+		m.cursor++
+		if m.cursor > 3 {
 			m.cursor = 0
 		}
 	}
@@ -440,7 +855,30 @@ func (m setupModel) handlePrev() (tea.Model, tea.Cmd) {
 			}
 		}
 
-	case stepNetwork, stepDiskVRAM, stepProfiles:
+	case stepNetworkAdvanced:
+		m.cursor--
+		if m.cursor < 0 {
+			m.cursor = 3
+		}
+		if !m.config.bondEnabled && (m.cursor == 1 || m.cursor == 2) {
+			m.cursor = 0
+		}
+		m.focusNetworkAdvancedInput()
+
+	case stepTime:
+		m.cursor--
+		if m.cursor < 0 {
+			m.cursor = m.timeRows() - 1
+		}
+		m.focusTimeInput()
+
+	case stepDiskVRAM:
+		m.cursor--
+		if m.cursor < 0 {
+			m.cursor = m.diskRows() - 1
+		}
+
+	case stepNetwork, stepProfiles:
 		m.cursor--
 		if m.cursor < 0 {
 			maxCursor := 2
@@ -454,8 +892,123 @@ func (m setupModel) handlePrev() (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// diskRows returns the number of selectable rows on the disk step: boot
+// mode, storage layout and the disks the layout needs
+func (m setupModel) diskRows() int {
+	switch m.config.storageLayout {
+	case "plain", "lvm":
+		return 3
+	case "raid1":
+		return 4
+	}
+	return 2
+}
+
+// cycleOption returns the option after (or before, for "left") current
+func cycleOption(options []string, current, direction string) string {
+	if len(options) == 0 {
+		return current
+	}
+	idx := 0
+	for i, o := range options {
+		if o == current {
+			idx = i
+			break
+		}
+	}
+	if direction == "right" {
+		idx++
+	} else {
+		idx--
+	}
+	if idx < 0 {
+		idx = len(options) - 1
+	}
+	if idx >= len(options) {
+		idx = 0
+	}
+	return options[idx]
+}
+
+// enterNetworkAdvanced moves from the network step to bonding and VLANs
+func (m *setupModel) enterNetworkAdvanced() {
+	for i := 3; i <= 5; i++ {
+		m.inputs[i].Blur()
+	}
+	if m.inputs[8].Value() == "" {
+		m.inputs[8].SetValue(m.config.bondSlaves)
+	}
+	m.step = stepNetworkAdvanced
+	m.cursor = 0
+	m.focusNetworkAdvancedInput()
+}
+
+// saveNetworkAdvanced stores and validates the bond and VLAN inputs
+func (m *setupModel) saveNetworkAdvanced() error {
+	m.config.bondSlaves = strings.TrimSpace(m.inputs[8].Value())
+	m.config.vlans = strings.TrimSpace(m.inputs[9].Value())
+	return validateAdvancedNetwork(m.config)
+}
+
+// focusNetworkAdvancedInput focuses the text input of the selected row
+func (m *setupModel) focusNetworkAdvancedInput() {
+	m.inputs[8].Blur()
+	m.inputs[9].Blur()
+	switch m.cursor {
+	case 2:
+		m.inputs[8].Focus()
+	case 3:
+		m.inputs[9].Focus()
+	}
+}
+
+// saveTimeInputs stores the NTP server list from its text input
+func (m *setupModel) saveTimeInputs() {
+	if v := strings.TrimSpace(m.inputs[7].Value()); v != "" {
+		m.config.ntpServers = v
+	}
+}
+
+// timeRows returns the number of rows of the time step: NTP sync, the
+// hardware clock and, while NTP is enabled, the server input
+func (m setupModel) timeRows() int {
+	if m.config.ntpEnabled {
+		return 3
+	}
+	return 2
+}
+
+// focusTimeInput focuses the NTP server input when its row is selected
+func (m *setupModel) focusTimeInput() {
+	if m.cursor == 2 && m.config.ntpEnabled {
+		m.inputs[7].Focus()
+	} else {
+		m.inputs[7].Blur()
+	}
+}
+
 func (m setupModel) handleSelect(direction string) (tea.Model, tea.Cmd) {
 	switch m.step {
+	case stepNetworkAdvanced:
+		switch m.cursor {
+		case 0:
+			m.config.bondEnabled = !m.config.bondEnabled
+		case 1:
+			m.config.bondMode = cycleOption(bondModes, m.config.bondMode, direction)
+		}
+
+	case stepTime:
+		switch m.cursor {
+		case 0:
+			m.config.ntpEnabled = !m.config.ntpEnabled
+		case 1:
+			if m.config.hwclock == "utc" {
+				m.config.hwclock = "localtime"
+			} else {
+				m.config.hwclock = "utc"
+			}
+		}
+
 	case stepNetwork:
 		types := []string{"dhcp", "static", "none"}
 		idx := 0
@@ -479,26 +1032,23 @@ func (m setupModel) handleSelect(direction string) (tea.Model, tea.Cmd) {
 		m.config.networkType = types[idx]
 
 	case stepDiskVRAM:
-		modes := []string{"vram", "standard", "minimal"}
-		idx := 0
-		for i, mode := range modes {
-			if mode == m.config.bootMode {
-				idx = i
-				break
+		switch m.cursor {
+		case 0:
+			m.config.bootMode = cycleOption([]string{"vram", "standard", "minimal"}, m.config.bootMode, direction)
+		case 1:
+			layouts := make([]string, len(storageLayouts))
+			for i, l := range storageLayouts {
+				layouts[i] = l.name
 			}
+			m.config.storageLayout = cycleOption(layouts, m.config.storageLayout, direction)
+			if m.cursor >= m.diskRows() {
+				m.cursor = m.diskRows() - 1
+			}
+		case 2:
+			m.config.diskTarget = cycleOption(m.disks, m.config.diskTarget, direction)
+		case 3:
+			m.config.diskSecondary = cycleOption(m.disks, m.config.diskSecondary, direction)
 		}
-		if direction == "right" {
-			idx++
-		} else {
-			idx--
-		}
-		if idx < 0 {
-			idx = len(modes) - 1
-		}
-		if idx >= len(modes) {
-			idx = 0
-		}
-		m.config.bootMode = modes[idx]
 
 	case stepProfiles:
 		profiles := []string{"desktop", "server", "minimal", "developer"}
@@ -530,31 +1080,80 @@ func (m setupModel) handleSelect(direction string) (tea.Model, tea.Cmd) {
 // Installation
 // ============================================================================
 
+// installTask is a single installation step. Tasks without a run function
+// only report progress.
+type installTask struct {
+	progress int
+	message  string
+	run      func(cfg setupConfig) error
+}
+
+func installTasks() []installTask {
+	return []installTask{
+		{10, "Initializing system...", nil},
+		{15, "Preparing storage...", setupStorage},
+		{20, "Configuring hostname...", setupHostname},
+		{30, "Creating user account...", setupUserAccount},
+		{40, "Setting up network...", setupNetwork},
+		{45, "Configuring time synchronization...", setupTime},
+		{50, "Configuring boot mode...", nil},
+		{60, "Installing profile packages...", setupProfile},
+		{70, "Setting up mixmagisk...", nil},
+		{80, "Configuring services...", nil},
+		{90, "Finalizing installation...", writeInstallManifest},
+		{100, "Installation complete!", nil},
+	}
+}
+
+// installFailureOptions are offered when an install task fails
+var installFailureOptions = []string{"Retry", "Skip", "Abort"}
+
+// handleInstallFailure applies the user's decision for the failed task:
+// 0 retries it, 1 marks it skipped and continues, 2 aborts the install.
+func (m setupModel) handleInstallFailure(choice int) (tea.Model, tea.Cmd) {
+	failed := m.failed
+	switch choice {
+	case 0:
+		m.failed = nil
+		m.err = nil
+		m.installing = true
+		m.progressMsg = "Retrying: " + strings.TrimSuffix(failed.message, "...")
+		return m, m.doInstallStep()
+
+	case 1:
+		m.failed = nil
+		m.err = nil
+		m.installing = true
+		m.config.skippedTasks = append(m.config.skippedTasks, strings.TrimSuffix(failed.message, "..."))
+		m.progress = failed.progress
+		m.progressMsg = failed.message + " skipped"
+		return m, m.doInstallStep()
+
+	case 2:
+		m.aborted = true
+		return m, tea.Quit
+	}
+	return m, nil
+}
+
 func (m setupModel) doInstallStep() tea.Cmd {
 	return func() tea.Msg {
 		time.Sleep(500 * time.Millisecond)
 
-		steps := []struct {
-			progress int
-			message  string
-		}{
-			{10, "Initializing system..."},
-			{20, "Configuring hostname..."},
-			{30, "Creating user account..."},
-			{40, "Setting up network..."},
-			{50, "Configuring boot mode..."},
-			{60, "Installing profile packages..."},
-			{70, "Setting up mixmagisk..."},
-			{80, "Configuring services..."},
-			{90, "Finalizing installation..."},
-			{100, "Installation complete!"},
-		}
-
-		for _, step := range steps {
-			if m.progress < step.progress {
+		for _, task := range installTasks() {
+			if m.progress < task.progress {
+				if task.run != nil {
+					if err := task.run(m.config); err != nil {
+						return installErrorMsg{
+							progress: task.progress,
+							message:  task.message,
+							err:      fmt.Errorf("%s %w", strings.TrimSuffix(task.message, "..."), err),
+						}
+					}
+				}
 				return installProgressMsg{
-					progress: step.progress,
-					message:  step.message,
+					progress: task.progress,
+					message:  task.message,
 				}
 			}
 		}
@@ -568,6 +1167,10 @@ func (m setupModel) doInstallStep() tea.Cmd {
 // ============================================================================
 
 func (m setupModel) View() string {
+	if m.tooSmall() {
+		return m.viewTooSmall()
+	}
+
 	var s strings.Builder
 
 	switch m.step {
@@ -577,6 +1180,10 @@ func (m setupModel) View() string {
 		s.WriteString(m.viewCredentials())
 	case stepNetwork:
 		s.WriteString(m.viewNetwork())
+	case stepNetworkAdvanced:
+		s.WriteString(m.viewNetworkAdvanced())
+	case stepTime:
+		s.WriteString(m.viewTime())
 	case stepDiskVRAM:
 		s.WriteString(m.viewDiskVRAM())
 	case stepProfiles:
@@ -589,6 +1196,11 @@ func (m setupModel) View() string {
 		s.WriteString(m.viewComplete())
 	}
 
+	if m.err != nil && m.step != stepInstalling {
+		s.WriteString("\n")
+		s.WriteString(errorStyle.Render("✗ " + m.err.Error()))
+	}
+
 	return s.String()
 }
 
@@ -600,10 +1212,15 @@ func (m setupModel) viewWelcome() string {
 		Bold(true).
 		Render(mixOSLogo)
 
-	s.WriteString(logo)
-	s.WriteString("\n")
-	s.WriteString(welcomeArt)
-	s.WriteString("\n\n")
+	if m.fullArt() {
+		s.WriteString(logo)
+		s.WriteString("\n")
+		s.WriteString(welcomeArt)
+		s.WriteString("\n\n")
+	} else {
+		s.WriteString(titleStyle.Render("🧡 Welcome to MixOS Setup"))
+		s.WriteString("\n")
+	}
 
 	info := []string{
 		"🚀 VISO: Virtual ISO - Revolutionary boot format",
@@ -639,7 +1256,7 @@ func (m setupModel) viewCredentials() string {
 	s.WriteString("\n")
 	s.WriteString(helpStyle.Render("TAB: Next field • ENTER: Continue • ESC: Back"))
 
-	return boxStyle.Render(s.String())
+	return m.box(s.String())
 }
 
 func (m setupModel) viewNetwork() string {
@@ -684,13 +1301,101 @@ func (m setupModel) viewNetwork() string {
 	s.WriteString("\n")
 	s.WriteString(helpStyle.Render("←/→: Select type • TAB: Next field • ENTER: Continue"))
 
-	return boxStyle.Render(s.String())
+	return m.box(s.String())
+}
+
+func (m setupModel) viewNetworkAdvanced() string {
+	var s strings.Builder
+
+	s.WriteString(titleStyle.Render("🔗 Step 2b: Bonding & VLANs"))
+	s.WriteString("\n\n")
+
+	s.WriteString(subtitleStyle.Render("Optional, for servers with redundant or trunked links"))
+	s.WriteString("\n\n")
+
+	rowStyle := func(row int) (string, lipgloss.Style) {
+		if row == m.cursor {
+			return "▶ ", selectedStyle
+		}
+		return "  ", normalStyle
+	}
+
+	cursor, style := rowStyle(0)
+	s.WriteString(style.Render(fmt.Sprintf("%s%-12s ◀ %s ▶", cursor, "Bonding", map[bool]string{true: "enabled", false: "disabled"}[m.config.bondEnabled])))
+	s.WriteString("\n")
+
+	if m.config.bondEnabled {
+		cursor, style = rowStyle(1)
+		s.WriteString(style.Render(fmt.Sprintf("%s%-12s ◀ %s ▶", cursor, "Mode", m.config.bondMode)))
+		s.WriteString("\n")
+		s.WriteString(m.inputs[8].View())
+		s.WriteString("\n")
+		if nics := listNetworkInterfaces(); len(nics) > 0 {
+			s.WriteString(mutedStyle.Render("    Detected: " + strings.Join(nics, " ")))
+			s.WriteString("\n")
+		}
+	}
+
+	s.WriteString("\n")
+	s.WriteString(m.inputs[9].View())
+	s.WriteString("\n")
+	s.WriteString(mutedStyle.Render(fmt.Sprintf("    Tagged on %s: ID, ID=dhcp or ID=address/prefix", primaryInterface(m.config))))
+
+	s.WriteString("\n\n")
+	s.WriteString(helpStyle.Render("↑/↓: Select option • ←/→: Change • ENTER: Continue • ESC: Back"))
+
+	return m.box(s.String())
+}
+
+func (m setupModel) viewTime() string {
+	var s strings.Builder
+
+	s.WriteString(titleStyle.Render("🕒 Step 3: Time Synchronization"))
+	s.WriteString("\n\n")
+
+	s.WriteString(subtitleStyle.Render("Keep the system clock accurate"))
+	s.WriteString("\n\n")
+
+	rows := []struct {
+		label string
+		value string
+	}{
+		{"NTP sync", map[bool]string{true: "enabled", false: "disabled"}[m.config.ntpEnabled]},
+		{"Hardware clock", map[string]string{"utc": "UTC (recommended)", "localtime": "Local time (dual-boot with Windows)"}[m.config.hwclock]},
+	}
+
+	for i, row := range rows {
+		cursor := "  "
+		style := normalStyle
+		if i == m.cursor {
+			cursor = "▶ "
+			style = selectedStyle
+		}
+		s.WriteString(style.Render(fmt.Sprintf("%s%-16s ◀ %s ▶", cursor, row.label, row.value)))
+		s.WriteString("\n")
+	}
+
+	if m.config.ntpEnabled {
+		cursor := "  "
+		if m.cursor == 2 {
+			cursor = "▶ "
+		}
+		s.WriteString("\n")
+		s.WriteString(cursor + m.inputs[7].View())
+		s.WriteString("\n")
+		s.WriteString(mutedStyle.Render("    Separate multiple servers with spaces"))
+	}
+
+	s.WriteString("\n\n")
+	s.WriteString(helpStyle.Render("↑/↓: Select option • ←/→: Change • ENTER: Continue • ESC: Back"))
+
+	return m.box(s.String())
 }
 
 func (m setupModel) viewDiskVRAM() string {
 	var s strings.Builder
 
-	s.WriteString(titleStyle.Render("💾 Step 3: Boot Mode & Storage"))
+	s.WriteString(titleStyle.Render("💾 Step 4: Boot Mode & Storage"))
 	s.WriteString("\n\n")
 
 	s.WriteString(subtitleStyle.Render("Select boot mode for optimal performance"))
@@ -712,6 +1417,9 @@ func (m setupModel) viewDiskVRAM() string {
 		if mode.name == m.config.bootMode {
 			cursor = "▶ "
 			style = selectedStyle
+			if m.cursor != 0 {
+				style = normalStyle.Bold(true)
+			}
 		}
 		s.WriteString(style.Render(cursor + mode.desc))
 		s.WriteString("\n")
@@ -725,18 +1433,79 @@ func (m setupModel) viewDiskVRAM() string {
 		s.WriteString(m.inputs[6].View())
 		s.WriteString("\n")
 		s.WriteString(mutedStyle.Render("    Recommended: 2G for desktop, 1G for server"))
+		if info, err := getMemInfo(); err == nil {
+			s.WriteString("\n")
+			s.WriteString(mutedStyle.Render(fmt.Sprintf("    Detected RAM: %d MB", info.MemTotal)))
+		}
+		if warning, err := validateVramSize(m.vramSizeInput()); err == nil && warning != "" {
+			s.WriteString("\n")
+			s.WriteString(warningStyle().Render("    ⚠️  " + warning))
+		}
+		s.WriteString("\n\n")
 	}
 
+	s.WriteString(m.viewStorage())
+
 	s.WriteString("\n\n")
-	s.WriteString(helpStyle.Render("←/→: Select mode • ENTER: Continue • ESC: Back"))
+	s.WriteString(helpStyle.Render("↑/↓: Select option • ←/→: Change • ENTER: Continue • ESC: Back"))
 
-	return boxStyle.Render(s.String())
+	return m.box(s.String())
+}
+
+// viewStorage renders the storage layout rows of the disk step
+func (m setupModel) viewStorage() string {
+	var s strings.Builder
+
+	s.WriteString(subtitleStyle.Render("Storage Layout:"))
+	s.WriteString("\n")
+
+	layoutDesc := ""
+	for _, l := range storageLayouts {
+		if l.name == m.config.storageLayout {
+			layoutDesc = l.desc
+		}
+	}
+	diskLabel := func(disk string) string {
+		if disk == "" {
+			return "(no disks detected)"
+		}
+		return fmt.Sprintf("%s (%s)", disk, formatSize(diskSizeBytes(disk)))
+	}
+
+	rows := []struct {
+		label string
+		value string
+	}{
+		{"Layout", layoutDesc},
+		{"Disk", diskLabel(m.config.diskTarget)},
+		{"Mirror disk", diskLabel(m.config.diskSecondary)},
+	}
+
+	for i, row := range rows[:m.diskRows()-1] {
+		cursor := "  "
+		style := normalStyle
+		if i+1 == m.cursor {
+			cursor = "▶ "
+			style = selectedStyle
+		}
+		s.WriteString(style.Render(fmt.Sprintf("%s%-12s ◀ %s ▶", cursor, row.label, row.value)))
+		s.WriteString("\n")
+	}
+
+	if m.config.storageLayout != "existing" {
+		s.WriteString(warningStyle().Render("    ⚠️  All data on the selected disk(s) will be erased"))
+		s.WriteString("\n")
+		s.WriteString(mutedStyle.Render("    New system will be mounted at " + m.config.targetRoot()))
+		s.WriteString("\n")
+	}
+
+	return s.String()
 }
 
 func (m setupModel) viewProfiles() string {
 	var s strings.Builder
 
-	s.WriteString(titleStyle.Render("👤 Step 4: System Profile"))
+	s.WriteString(titleStyle.Render("👤 Step 5: System Profile"))
 	s.WriteString("\n\n")
 
 	s.WriteString(subtitleStyle.Render("Select a profile that matches your use case"))
@@ -768,13 +1537,13 @@ func (m setupModel) viewProfiles() string {
 
 	s.WriteString(helpStyle.Render("←/→: Select profile • ENTER: Continue • ESC: Back"))
 
-	return boxStyle.Render(s.String())
+	return m.box(s.String())
 }
 
 func (m setupModel) viewSummary() string {
 	var s strings.Builder
 
-	s.WriteString(titleStyle.Render("📋 Step 5: Installation Summary"))
+	s.WriteString(titleStyle.Render("📋 Step 6: Installation Summary"))
 	s.WriteString("\n\n")
 
 	s.WriteString(subtitleStyle.Render("Review your configuration before installation"))
@@ -785,7 +1554,11 @@ func (m setupModel) viewSummary() string {
 	s.WriteString("\n")
 	s.WriteString(fmt.Sprintf("   Hostname: %s\n", m.config.hostname))
 	s.WriteString(fmt.Sprintf("   Username: %s\n", m.config.username))
-	s.WriteString(fmt.Sprintf("   Password: %s\n", strings.Repeat("•", len(m.config.password))))
+	password := "(not set)"
+	if m.config.passwordHash != "" {
+		password = "•••••••• (sha512crypt)"
+	}
+	s.WriteString(fmt.Sprintf("   Password: %s\n", password))
 	s.WriteString("\n")
 
 	// Network
@@ -797,6 +1570,23 @@ func (m setupModel) viewSummary() string {
 		s.WriteString(fmt.Sprintf("   Gateway: %s\n", m.config.gateway))
 		s.WriteString(fmt.Sprintf("   DNS: %s\n", m.config.dns))
 	}
+	if m.config.bondEnabled {
+		s.WriteString(fmt.Sprintf("   Bond: %s (%s) over %s\n", bondInterface, m.config.bondMode, m.config.bondSlaves))
+	}
+	if m.config.vlans != "" {
+		s.WriteString(fmt.Sprintf("   VLANs: %s\n", m.config.vlans))
+	}
+	s.WriteString("\n")
+
+	// Time
+	s.WriteString(selectedStyle.Render("🕒 Time"))
+	s.WriteString("\n")
+	if m.config.ntpEnabled {
+		s.WriteString(fmt.Sprintf("   NTP: %s\n", m.config.ntpServers))
+	} else {
+		s.WriteString("   NTP: disabled\n")
+	}
+	s.WriteString(fmt.Sprintf("   Hardware clock: %s\n", m.config.hwclock))
 	s.WriteString("\n")
 
 	// Boot Mode
@@ -810,6 +1600,13 @@ func (m setupModel) viewSummary() string {
 		}
 		s.WriteString(fmt.Sprintf("   VRAM Size: %s\n", vramSize))
 	}
+	s.WriteString(fmt.Sprintf("   Storage: %s\n", m.config.storageLayout))
+	switch m.config.storageLayout {
+	case "plain", "lvm":
+		s.WriteString(fmt.Sprintf("   Disk: %s (will be erased)\n", m.config.diskTarget))
+	case "raid1":
+		s.WriteString(fmt.Sprintf("   Disks: %s + %s (will be erased)\n", m.config.diskTarget, m.config.diskSecondary))
+	}
 	s.WriteString("\n")
 
 	// Profile
@@ -822,7 +1619,7 @@ func (m setupModel) viewSummary() string {
 	s.WriteString("\n\n")
 	s.WriteString(helpStyle.Render("ENTER: Install • ESC: Go back and modify"))
 
-	return boxStyle.Render(s.String())
+	return m.box(s.String())
 }
 
 func warningStyle() lipgloss.Style {
@@ -851,36 +1648,64 @@ func (m setupModel) viewInstalling() string {
 	s.WriteString(fmt.Sprintf("[%s] %d%%\n", bar, m.progress))
 	s.WriteString("\n")
 
-	steps := []string{
-		"Initializing system",
-		"Configuring hostname",
-		"Creating user account",
-		"Setting up network",
-		"Configuring boot mode",
-		"Installing profile packages",
-		"Setting up mixmagisk",
-		"Configuring services",
-		"Finalizing installation",
-	}
-
-	for i, step := range steps {
-		progress := (i + 1) * 10
-		if m.progress >= progress {
+	if m.err != nil {
+		s.WriteString(errorStyle.Render("✗ " + m.err.Error()))
+		s.WriteString("\n\n")
+	}
+
+	if m.failed != nil {
+		for i, option := range installFailureOptions {
+			if i == m.failChoice {
+				s.WriteString(selectedStyle.Render("[ " + option + " ]"))
+			} else {
+				s.WriteString(normalStyle.Render("  " + option + "  "))
+			}
+			s.WriteString(" ")
+		}
+		s.WriteString("\n")
+		s.WriteString(helpStyle.Render("←/→: Choose • ENTER: Confirm • R: Retry • S: Skip • A: Abort"))
+		s.WriteString("\n\n")
+	}
+
+	skipped := make(map[string]bool)
+	for _, name := range m.config.skippedTasks {
+		skipped[name] = true
+	}
+
+	tasks := installTasks()
+	prev := 0
+	for _, task := range tasks[:len(tasks)-1] {
+		step := strings.TrimSuffix(task.message, "...")
+		if skipped[step] {
+			s.WriteString(warningStyle().Render("  ⚠ " + step + " (skipped)"))
+		} else if m.failed != nil && m.failed.progress == task.progress {
+			s.WriteString(errorStyle.Render("  ✗ " + step))
+		} else if m.progress >= task.progress {
 			s.WriteString(successStyle.Render("  ✓ " + step))
-		} else if m.progress >= progress-10 {
+		} else if m.progress >= prev {
 			s.WriteString(normalStyle.Render("  ⋯ " + step))
 		} else {
 			s.WriteString(mutedStyle.Render("  ○ " + step))
 		}
 		s.WriteString("\n")
+		prev = task.progress
 	}
 
-	return boxStyle.Render(s.String())
+	return m.box(s.String())
 }
 
 func (m setupModel) viewComplete() string {
 	var s strings.Builder
 
+	if m.reconfigure != "" {
+		s.WriteString(successStyle.Render(fmt.Sprintf("✓ %s%s configuration updated", strings.ToUpper(m.reconfigure[:1]), m.reconfigure[1:])))
+		s.WriteString("\n\n")
+		s.WriteString(mutedStyle.Render("Changes were written to the live system in " + setupRoot))
+		s.WriteString("\n\n")
+		s.WriteString(helpStyle.Render("Press ENTER or Q to exit"))
+		return m.box(s.String())
+	}
+
 	completeArt := `
     ╔══════════════════════════════════════════════════════════════╗
     ║                                                              ║
@@ -891,8 +1716,20 @@ func (m setupModel) viewComplete() string {
     ╚══════════════════════════════════════════════════════════════╝
 `
 
-	s.WriteString(lipgloss.NewStyle().Foreground(successColor).Render(completeArt))
-	s.WriteString("\n")
+	if m.fullArt() {
+		s.WriteString(lipgloss.NewStyle().Foreground(successColor).Render(completeArt))
+		s.WriteString("\n")
+	} else {
+		s.WriteString(successStyle.Render("✨ Installation Complete! Welcome to MixOS!"))
+		s.WriteString("\n\n")
+	}
+
+	if len(m.config.skippedTasks) > 0 {
+		s.WriteString(warningStyle().Render("⚠️  Skipped: " + strings.Join(m.config.skippedTasks, ", ")))
+		s.WriteString("\n")
+		s.WriteString(mutedStyle.Render("   Run 'mix setup --reconfigure <section>' to finish these later"))
+		s.WriteString("\n\n")
+	}
 
 	s.WriteString(titleStyle.Render("🚀 Next Steps"))
 	s.WriteString("\n\n")
@@ -901,6 +1738,9 @@ func (m setupModel) viewComplete() string {
 	if m.config.bootMode == "vram" {
 		bootCmd = "VRAM=auto"
 	}
+	if args := storageKernelArgs(m.config); args != "" {
+		bootCmd += " " + args
+	}
 
 	steps := []string{
 		"1. Reboot your system",
@@ -942,11 +1782,21 @@ var setupCmd = &cobra.Command{
 This wizard guides you through:
   • System credentials (hostname, username, password)
   • Network configuration (DHCP, static, or none)
+  • Time synchronization (NTP servers, hardware clock mode)
   • Boot mode selection (VRAM, standard, minimal)
   • Profile selection (desktop, server, minimal, developer)
 
-After setup, reboot with the configured parameters to complete installation.`,
+After setup, reboot with the configured parameters to complete installation.
+
+Use --reconfigure to edit a single section of an already-installed system
+(for example after cloning a VISO image) without running the install phase:
+  mix setup --reconfigure network
+  mix setup --reconfigure credentials
+  mix setup --reconfigure time
+  mix setup --reconfigure profile`,
 	Run: func(cmd *cobra.Command, args []string) {
+		reconfigure, _ := cmd.Flags().GetString("reconfigure")
+
 		// Check if running as root
 		if os.Geteuid() != 0 {
 			fmt.Println("Warning: Setup should be run as root for full functionality")
@@ -954,11 +1804,25 @@ After setup, reboot with the configured parameters to complete installation.`,
 			fmt.Println()
 		}
 
-		p := tea.NewProgram(initialSetupModel(), tea.WithAltScreen())
-		if _, err := p.Run(); err != nil {
+		model := initialSetupModel()
+		if reconfigure != "" {
+			var err error
+			if model, err = reconfigureSetupModel(reconfigure); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		p := tea.NewProgram(model, tea.WithAltScreen())
+		final, err := p.Run()
+		if err != nil {
 			fmt.Printf("Error running setup: %v\n", err)
 			os.Exit(1)
 		}
+		if fm, ok := final.(setupModel); ok && fm.aborted {
+			fmt.Printf("Installation aborted: %v\n", fm.err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -975,4 +1839,6 @@ func runCommand(name string, args ...string) error {
 
 func init() {
 	rootCmd.AddCommand(setupCmd)
+	setupCmd.PersistentFlags().StringVar(&setupRoot, "root", setupRoot, "root directory of the system to configure")
+	setupCmd.Flags().String("reconfigure", "", "reconfigure one section of an installed system (network, credentials, time, profile)")
 }
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mixos-go/src/mix-cli/pkg/manager"
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// Install Manifest
+// ============================================================================
+
+const installManifestPath = "var/lib/mixos/install-manifest.json"
+
+// InstallManifest is a machine-readable record of an installation, used
+// for fleet inventory
+type InstallManifest struct {
+	SchemaVersion int       `json:"schema_version"`
+	MixVersion    string    `json:"mix_version"`
+	StartedAt     time.Time `json:"started_at"`
+	CompletedAt   time.Time `json:"completed_at"`
+
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	Profile  string `json:"profile"`
+
+	Network struct {
+		Type    string        `json:"type"`
+		Address string        `json:"address,omitempty"`
+		Gateway string        `json:"gateway,omitempty"`
+		DNS     string        `json:"dns,omitempty"`
+		Bond    *ManifestBond `json:"bond,omitempty"`
+		VLANs   []string      `json:"vlans,omitempty"`
+	} `json:"network"`
+
+	Time struct {
+		NTPEnabled bool     `json:"ntp_enabled"`
+		NTPServers []string `json:"ntp_servers,omitempty"`
+		HWClock    string   `json:"hwclock"`
+	} `json:"time"`
+
+	Boot struct {
+		Mode     string `json:"mode"`
+		VramSize string `json:"vram_size,omitempty"`
+		Disk     string `json:"disk,omitempty"`
+	} `json:"boot"`
+
+	Storage struct {
+		Layout     string   `json:"layout"`
+		Disks      []string `json:"disks,omitempty"`
+		KernelArgs string   `json:"kernel_args,omitempty"`
+	} `json:"storage"`
+
+	SkippedTasks []string `json:"skipped_tasks,omitempty"`
+
+	Partitions []ManifestPartition `json:"partitions"`
+	Packages   []ManifestPackage   `json:"packages"`
+}
+
+// ManifestBond describes the bonded interface of the installed system
+type ManifestBond struct {
+	Mode   string   `json:"mode"`
+	Slaves []string `json:"slaves"`
+}
+
+// ManifestPartition describes a filesystem mounted in the installed system
+type ManifestPartition struct {
+	Device     string `json:"device"`
+	Mountpoint string `json:"mountpoint"`
+	FSType     string `json:"fstype"`
+	SizeBytes  uint64 `json:"size_bytes"`
+}
+
+// ManifestPackage is an installed package and its version
+type ManifestPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+var setupManifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "Print the install manifest",
+	Long:  `Print /var/lib/mixos/install-manifest.json written at the end of installation.`,
+	RunE:  runSetupManifest,
+}
+
+func init() {
+	setupCmd.AddCommand(setupManifestCmd)
+}
+
+// writeInstallManifest records the final configuration in the target system
+func writeInstallManifest(cfg setupConfig) error {
+	m := InstallManifest{
+		SchemaVersion: 1,
+		MixVersion:    version,
+		StartedAt:     cfg.startedAt,
+		CompletedAt:   time.Now(),
+		Hostname:      cfg.hostname,
+		Username:      cfg.username,
+		Profile:       cfg.profile,
+	}
+
+	m.Network.Type = cfg.networkType
+	if cfg.networkType == "static" {
+		m.Network.Address = cfg.ipAddress
+		m.Network.Gateway = cfg.gateway
+		m.Network.DNS = cfg.dns
+	}
+	if cfg.bondEnabled {
+		m.Network.Bond = &ManifestBond{
+			Mode:   cfg.bondMode,
+			Slaves: strings.Fields(strings.ReplaceAll(cfg.bondSlaves, ",", " ")),
+		}
+	}
+	m.Network.VLANs = strings.Fields(strings.ReplaceAll(cfg.vlans, ",", " "))
+
+	m.Time.NTPEnabled = cfg.ntpEnabled
+	if cfg.ntpEnabled {
+		m.Time.NTPServers = strings.Fields(strings.ReplaceAll(cfg.ntpServers, ",", " "))
+	}
+	m.Time.HWClock = cfg.hwclock
+
+	m.Boot.Mode = cfg.bootMode
+	if cfg.storageLayout != "" && cfg.storageLayout != "existing" {
+		m.Boot.Disk = cfg.diskTarget
+	}
+	if cfg.bootMode == "vram" {
+		m.Boot.VramSize = cfg.vramSize
+		if m.Boot.VramSize == "" {
+			m.Boot.VramSize = "2G"
+		}
+	}
+
+	m.Storage.Layout = cfg.storageLayout
+	switch cfg.storageLayout {
+	case "plain", "lvm":
+		m.Storage.Disks = []string{cfg.diskTarget}
+	case "raid1":
+		m.Storage.Disks = []string{cfg.diskTarget, cfg.diskSecondary}
+	}
+	m.Storage.KernelArgs = storageKernelArgs(cfg)
+
+	m.SkippedTasks = cfg.skippedTasks
+
+	root := cfg.targetRoot()
+	m.Partitions = targetPartitions(root)
+	m.Packages = targetPackages(root)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	path := filepath.Join(root, installManifestPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	return nil
+}
+
+// targetPartitions lists block-device filesystems mounted at or below root
+func targetPartitions(root string) []ManifestPartition {
+	partitions := []ManifestPartition{}
+
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return partitions
+	}
+
+	root = filepath.Clean(root)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		mountpoint := fields[1]
+		if root != "/" && mountpoint != root && !strings.HasPrefix(mountpoint, root+"/") {
+			continue
+		}
+
+		p := ManifestPartition{Device: fields[0], Mountpoint: mountpoint, FSType: fields[2]}
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mountpoint, &st); err == nil {
+			p.SizeBytes = st.Blocks * uint64(st.Bsize)
+		}
+		if root != "/" {
+			p.Mountpoint = "/" + strings.TrimPrefix(strings.TrimPrefix(mountpoint, root), "/")
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions
+}
+
+// targetPackages lists packages recorded in the target's package database
+func targetPackages(root string) []ManifestPackage {
+	packages := []ManifestPackage{}
+
+	path := filepath.Join(root, dbPath)
+	if _, err := os.Stat(path); err != nil {
+		return packages
+	}
+	mgr, err := manager.New(path, repoURL, cacheDir)
+	if err != nil {
+		return packages
+	}
+	defer mgr.Close()
+
+	installed, err := mgr.ListInstalled()
+	if err != nil {
+		return packages
+	}
+	for _, p := range installed {
+		packages = append(packages, ManifestPackage{Name: p.Name, Version: p.Version})
+	}
+	return packages
+}
+
+func runSetupManifest(cmd *cobra.Command, args []string) error {
+	path := filepath.Join(setupRoot, installManifestPath)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no install manifest at %s (was this system installed with 'mix setup'?)", path)
+		}
+		return err
+	}
+	fmt.Print(string(data))
+	return nil
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Bonding and VLANs
+// ============================================================================
+//
+// Bonds and VLANs are written as ifupdown stanzas that drive the kernel
+// through sysfs and "ip link", so they work with the BusyBox ifup as well
+// as full ifupdown. The bond (or the first NIC without one) carries the
+// address chosen on the network step; each VLAN is stacked on top of it.
+
+const (
+	bondInterface   = "bond0"
+	defaultBondMode = "active-backup"
+)
+
+// bondModes are the bonding modes offered by the advanced network step
+var bondModes = []string{"active-backup", "802.3ad", "balance-rr", "balance-xor", "balance-alb"}
+
+// vlanSpec is one tagged VLAN interface: "10" (no address), "10=dhcp" or
+// "10=192.168.10.5/24"
+type vlanSpec struct {
+	ID      int
+	Method  string // manual, dhcp, static
+	Address string
+}
+
+// parseVLANs parses a space or comma separated list of VLAN specs
+func parseVLANs(s string) ([]vlanSpec, error) {
+	var vlans []vlanSpec
+	seen := make(map[int]bool)
+
+	for _, field := range strings.Fields(strings.ReplaceAll(s, ",", " ")) {
+		idStr, addr, hasAddr := strings.Cut(field, "=")
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id < 1 || id > 4094 {
+			return nil, fmt.Errorf("invalid VLAN ID %q (expected 1-4094)", idStr)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("VLAN %d listed twice", id)
+		}
+		seen[id] = true
+
+		v := vlanSpec{ID: id, Method: "manual"}
+		switch {
+		case !hasAddr:
+		case addr == "dhcp":
+			v.Method = "dhcp"
+		default:
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return nil, fmt.Errorf("VLAN %d: invalid address %q (expected CIDR, e.g. 192.168.10.5/24)", id, addr)
+			}
+			v.Method = "static"
+			v.Address = addr
+		}
+		vlans = append(vlans, v)
+	}
+	return vlans, nil
+}
+
+// listNetworkInterfaces returns physical network interfaces
+func listNetworkInterfaces() []string {
+	entries, err := os.ReadDir("/sys/class/net")
+	if err != nil {
+		return nil
+	}
+	var ifaces []string
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join("/sys/class/net", e.Name(), "device")); err == nil {
+			ifaces = append(ifaces, e.Name())
+		}
+	}
+	sort.Strings(ifaces)
+	return ifaces
+}
+
+// validateAdvancedNetwork checks the bond and VLAN settings
+func validateAdvancedNetwork(cfg setupConfig) error {
+	if cfg.bondEnabled {
+		slaves := strings.Fields(strings.ReplaceAll(cfg.bondSlaves, ",", " "))
+		if len(slaves) < 2 {
+			return fmt.Errorf("a bond needs at least two NICs")
+		}
+		seen := make(map[string]bool)
+		for _, s := range slaves {
+			if seen[s] {
+				return fmt.Errorf("NIC %s listed twice in bond", s)
+			}
+			seen[s] = true
+		}
+	}
+	_, err := parseVLANs(cfg.vlans)
+	return err
+}
+
+// primaryInterface returns the interface that carries the main address
+func primaryInterface(cfg setupConfig) string {
+	if cfg.bondEnabled {
+		return bondInterface
+	}
+	if cfg.iface != "" {
+		return cfg.iface
+	}
+	if nics := listNetworkInterfaces(); len(nics) > 0 {
+		return nics[0]
+	}
+	return "eth0"
+}
+
+// writeBondStanza appends the commands that create the bond and enslave
+// its NICs
+func writeBondStanza(b *strings.Builder, cfg setupConfig) {
+	mode := cfg.bondMode
+	if mode == "" {
+		mode = defaultBondMode
+	}
+	sysfs := "/sys/class/net/" + bondInterface
+
+	b.WriteString("    pre-up modprobe bonding max_bonds=0 2>/dev/null || true\n")
+	b.WriteString(fmt.Sprintf("    pre-up [ -d %s ] || echo +%s > /sys/class/net/bonding_masters\n", sysfs, bondInterface))
+	b.WriteString(fmt.Sprintf("    pre-up echo %s > %s/bonding/mode\n", mode, sysfs))
+	b.WriteString(fmt.Sprintf("    pre-up echo 100 > %s/bonding/miimon\n", sysfs))
+	for _, slave := range strings.Fields(strings.ReplaceAll(cfg.bondSlaves, ",", " ")) {
+		b.WriteString(fmt.Sprintf("    pre-up ip link set %s down && echo +%s > %s/bonding/slaves\n", slave, slave, sysfs))
+	}
+	b.WriteString(fmt.Sprintf("    post-down echo -%s > /sys/class/net/bonding_masters\n", bondInterface))
+}
+
+// writeVLANStanzas appends one interface per VLAN on top of parent
+func writeVLANStanzas(b *strings.Builder, parent string, vlans []vlanSpec) {
+	for _, v := range vlans {
+		name := fmt.Sprintf("%s.%d", parent, v.ID)
+		b.WriteString(fmt.Sprintf("\nauto %s\niface %s inet %s\n", name, name, v.Method))
+		if v.Method == "static" {
+			b.WriteString(fmt.Sprintf("    address %s\n", v.Address))
+		}
+		b.WriteString(fmt.Sprintf("    pre-up ip link add link %s name %s type vlan id %d\n", parent, name, v.ID))
+		if v.Method == "manual" {
+			b.WriteString(fmt.Sprintf("    up ip link set %s up\n", name))
+		}
+		b.WriteString(fmt.Sprintf("    post-down ip link delete %s\n", name))
+	}
+}
+
+// parseAdvancedNetwork reads bond and VLAN settings back from an
+// interfaces file written by setupNetwork
+func parseAdvancedNetwork(cfg *setupConfig, data string) {
+	var slaves, vlans []string
+	modeFile := "/sys/class/net/" + bondInterface + "/bonding/mode"
+	slavesFile := "/sys/class/net/" + bondInterface + "/bonding/slaves"
+
+	current := ""
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 4 && fields[0] == "iface":
+			current = fields[1]
+			if current == bondInterface {
+				cfg.bondEnabled = true
+			}
+			if _, id, ok := strings.Cut(current, "."); ok {
+				spec := id
+				if fields[3] == "dhcp" {
+					spec += "=dhcp"
+				}
+				vlans = append(vlans, spec)
+			}
+		case len(fields) == 2 && fields[0] == "address" && strings.Contains(current, "."):
+			vlans[len(vlans)-1] += "=" + fields[1]
+		case len(fields) >= 5 && fields[0] == "pre-up" && fields[1] == "echo" && fields[len(fields)-1] == modeFile:
+			cfg.bondMode = fields[2]
+		case len(fields) >= 4 && fields[0] == "pre-up" && fields[len(fields)-1] == slavesFile:
+			slaves = append(slaves, strings.TrimPrefix(fields[len(fields)-3], "+"))
+		}
+	}
+
+	if len(slaves) > 0 {
+		cfg.bondSlaves = strings.Join(slaves, " ")
+	}
+	cfg.vlans = strings.Join(vlans, " ")
+}
@@ -0,0 +1,513 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ============================================================================
+// Storage Layouts
+// ============================================================================
+//
+// The disk step can leave the existing root alone or lay out fresh storage:
+//
+//   plain  one ext4 root partition
+//   lvm    one LVM partition, volume group "mixos" with root and home LVs
+//   raid1  mdadm RAID1 mirror across two disks, ext4 on /dev/md0
+//
+// Anything other than "existing" mounts the new root at defaultInstallTarget
+// (unless --root was given) and copies the running system into it. The
+// initramfs hooks that assemble the storage at boot are appended to the
+// new system's initramfs, and its MixOS boot entry gets the root= and
+// rd.* parameters of the layout.
+
+const (
+	defaultInstallTarget = "/mnt/mixos"
+	lvmVolumeGroup       = "mixos"
+	lvmRootSize          = "20G"
+	raidDevice           = "/dev/md0"
+	storageHooksDir      = "etc/mixos/initramfs/hooks"
+	storageCmdlineFile   = "etc/mixos/cmdline"
+	storageBootBackup    = ".mix-setup.bak"
+)
+
+// storageBootParams are the kernel parameters setup replaces in the boot
+// entry of the new system
+var storageBootParams = []string{"root=", "rd.md=", "rd.lvm.vg="}
+
+// storageLayouts lists the layouts offered by the disk step, in display order
+var storageLayouts = []struct {
+	name string
+	desc string
+}{
+	{"existing", "Use the current root filesystem"},
+	{"plain", "Single disk, one ext4 partition"},
+	{"lvm", "LVM: volume group with separate /home"},
+	{"raid1", "RAID1 mirror across two disks (mdadm)"},
+}
+
+// listInstallDisks returns whole disks that can hold an installation
+func listInstallDisks() []string {
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil
+	}
+
+	var disks []string
+	for _, e := range entries {
+		name := e.Name()
+		skip := false
+		for _, prefix := range []string{"loop", "ram", "zram", "sr", "fd", "dm-", "md"} {
+			if strings.HasPrefix(name, prefix) {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		if data, err := os.ReadFile(filepath.Join("/sys/block", name, "removable")); err == nil && strings.TrimSpace(string(data)) == "1" {
+			continue
+		}
+		disks = append(disks, "/dev/"+name)
+	}
+	sort.Strings(disks)
+	return disks
+}
+
+// diskSizeBytes returns the size of a whole disk from sysfs
+func diskSizeBytes(disk string) int64 {
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(disk), "size"))
+	if err != nil {
+		return 0
+	}
+	var sectors int64
+	fmt.Sscanf(strings.TrimSpace(string(data)), "%d", &sectors)
+	return sectors * 512
+}
+
+// validateStorage checks the disk selection for the chosen layout
+func validateStorage(cfg setupConfig) error {
+	switch cfg.storageLayout {
+	case "", "existing":
+		return nil
+	case "plain", "lvm":
+		if cfg.diskTarget == "" {
+			return fmt.Errorf("no target disk selected")
+		}
+	case "raid1":
+		if cfg.diskTarget == "" || cfg.diskSecondary == "" {
+			return fmt.Errorf("RAID1 needs two disks")
+		}
+		if cfg.diskTarget == cfg.diskSecondary {
+			return fmt.Errorf("RAID1 needs two different disks")
+		}
+	default:
+		return fmt.Errorf("unknown storage layout %q", cfg.storageLayout)
+	}
+	return nil
+}
+
+// targetRoot returns the root the install tasks write to: --root, or
+// defaultInstallTarget when the disk step lays out fresh storage
+func (cfg setupConfig) targetRoot() string {
+	if setupRoot == "/" && cfg.storageLayout != "" && cfg.storageLayout != "existing" {
+		return defaultInstallTarget
+	}
+	return setupRoot
+}
+
+// storageRootDevice returns the device holding the root filesystem
+func storageRootDevice(cfg setupConfig) string {
+	switch cfg.storageLayout {
+	case "lvm":
+		return "/dev/mapper/" + lvmVolumeGroup + "-root"
+	case "raid1":
+		return raidDevice
+	}
+	return partitionPath(cfg.diskTarget, 1)
+}
+
+// storageKernelArgs returns the kernel parameters needed to boot the layout
+func storageKernelArgs(cfg setupConfig) string {
+	switch cfg.storageLayout {
+	case "", "existing":
+		return ""
+	case "lvm":
+		return fmt.Sprintf("root=%s rd.lvm.vg=%s", storageRootDevice(cfg), lvmVolumeGroup)
+	case "raid1":
+		return fmt.Sprintf("root=%s rd.md=1", storageRootDevice(cfg))
+	}
+	return "root=" + storageRootDevice(cfg)
+}
+
+// setupStorage partitions and formats the selected disks, mounts the new
+// root and seeds it with the running system
+func setupStorage(cfg setupConfig) error {
+	if cfg.storageLayout == "" || cfg.storageLayout == "existing" {
+		return nil
+	}
+	if err := validateStorage(cfg); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	var homeDevice string
+	var err error
+	switch cfg.storageLayout {
+	case "plain":
+		err = createPlainLayout(cfg.diskTarget)
+	case "lvm":
+		homeDevice, err = createLVMLayout(cfg.diskTarget)
+	case "raid1":
+		err = createRAID1Layout(cfg.diskTarget, cfg.diskSecondary)
+	}
+	if err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+
+	target := cfg.targetRoot()
+	rootDevice := storageRootDevice(cfg)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	if err := runQuiet("mount", rootDevice, target); err != nil {
+		return fmt.Errorf("failed to mount %s: %w", rootDevice, err)
+	}
+	if homeDevice != "" {
+		home := filepath.Join(target, "home")
+		os.MkdirAll(home, 0755)
+		if err := runQuiet("mount", homeDevice, home); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", homeDevice, err)
+		}
+	}
+
+	if err := copyLiveSystem(target); err != nil {
+		return fmt.Errorf("failed to copy system: %w", err)
+	}
+	if err := writeStorageConfig(cfg, target, rootDevice, homeDevice); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	if err := addStorageHooks(target); err != nil {
+		return fmt.Errorf("failed to update the initramfs: %w", err)
+	}
+	if err := writeStorageBootEntries(target, storageKernelArgs(cfg)); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	return nil
+}
+
+// runQuiet runs a command without writing to the terminal, which belongs
+// to the setup UI, and returns its output on failure
+func runQuiet(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s: %s", name, msg)
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// wipeDisk removes partition tables and signatures from disk
+func wipeDisk(disk string) error {
+	return runQuiet("wipefs", "-a", disk)
+}
+
+// partitionDisk writes a GPT with a single partition of the given sfdisk type
+func partitionDisk(disk, partType string) error {
+	if err := wipeDisk(disk); err != nil {
+		return err
+	}
+	cmd := exec.Command("sfdisk", "--quiet", disk)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("label: gpt\n,,%s\n", partType))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sfdisk %s: %s", disk, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func createPlainLayout(disk string) error {
+	if err := partitionDisk(disk, "L"); err != nil {
+		return err
+	}
+	return runQuiet("mkfs.ext4", "-F", "-q", "-L", "mixos", partitionPath(disk, 1))
+}
+
+// createLVMLayout builds the "mixos" volume group with a fixed-size root LV
+// and the remaining space as /home. It returns the home device.
+func createLVMLayout(disk string) (string, error) {
+	if err := partitionDisk(disk, "V"); err != nil {
+		return "", err
+	}
+	pv := partitionPath(disk, 1)
+
+	steps := [][]string{
+		{"pvcreate", "-ff", "-y", pv},
+		{"vgcreate", lvmVolumeGroup, pv},
+		{"lvcreate", "-y", "-L", lvmRootSize, "-n", "root", lvmVolumeGroup},
+		{"lvcreate", "-y", "-l", "100%FREE", "-n", "home", lvmVolumeGroup},
+	}
+	for _, step := range steps {
+		if err := runQuiet(step[0], step[1:]...); err != nil {
+			return "", err
+		}
+	}
+
+	root := "/dev/mapper/" + lvmVolumeGroup + "-root"
+	home := "/dev/mapper/" + lvmVolumeGroup + "-home"
+	if err := runQuiet("mkfs.ext4", "-F", "-q", "-L", "mixos", root); err != nil {
+		return "", err
+	}
+	if err := runQuiet("mkfs.ext4", "-F", "-q", "-L", "home", home); err != nil {
+		return "", err
+	}
+	return home, nil
+}
+
+// createRAID1Layout mirrors one partition on each disk into raidDevice
+func createRAID1Layout(first, second string) error {
+	for _, disk := range []string{first, second} {
+		if err := partitionDisk(disk, "R"); err != nil {
+			return err
+		}
+	}
+
+	err := runQuiet("mdadm", "--create", raidDevice, "--run", "--level=1",
+		"--metadata=1.2", "--raid-devices=2",
+		partitionPath(first, 1), partitionPath(second, 1))
+	if err != nil {
+		return err
+	}
+	return runQuiet("mkfs.ext4", "-F", "-q", "-L", "mixos", raidDevice)
+}
+
+// copyLiveSystem copies the running root filesystem into target, skipping
+// virtual and transient directories
+func copyLiveSystem(target string) error {
+	skip := map[string]bool{
+		"proc": true, "sys": true, "dev": true, "run": true,
+		"tmp": true, "mnt": true, "media": true, "lost+found": true,
+	}
+
+	entries, err := os.ReadDir("/")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if skip[e.Name()] {
+			continue
+		}
+		if err := runQuiet("cp", "-a", "/"+e.Name(), target+"/"); err != nil {
+			return err
+		}
+	}
+	for dir, mode := range map[string]os.FileMode{"proc": 0555, "sys": 0555, "dev": 0755, "run": 0755, "tmp": 01777, "mnt": 0755, "media": 0755} {
+		path := filepath.Join(target, dir)
+		os.MkdirAll(path, mode)
+		os.Chmod(path, mode)
+	}
+	return nil
+}
+
+// writeStorageConfig writes fstab, mdadm.conf, the initramfs hooks and the
+// kernel command line for the new layout into target
+func writeStorageConfig(cfg setupConfig, target, rootDevice, homeDevice string) error {
+	var fstab strings.Builder
+	fstab.WriteString("# /etc/fstab: generated by mix setup\n")
+	fstab.WriteString(fmt.Sprintf("%-28s %-8s %-6s %-10s 0 1\n", rootDevice, "/", "ext4", "defaults"))
+	if homeDevice != "" {
+		fstab.WriteString(fmt.Sprintf("%-28s %-8s %-6s %-10s 0 2\n", homeDevice, "/home", "ext4", "defaults"))
+	}
+	fstab.WriteString("proc                         /proc    proc   defaults   0 0\n")
+	fstab.WriteString("sysfs                        /sys     sysfs  defaults   0 0\n")
+	if err := os.WriteFile(filepath.Join(target, "etc/fstab"), []byte(fstab.String()), 0644); err != nil {
+		return err
+	}
+
+	hooksDir := filepath.Join(target, storageHooksDir)
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		return err
+	}
+
+	switch cfg.storageLayout {
+	case "raid1":
+		out, err := exec.Command("mdadm", "--detail", "--scan").Output()
+		if err != nil {
+			return fmt.Errorf("mdadm --detail --scan: %w", err)
+		}
+		conf := "# mdadm.conf: generated by mix setup\nDEVICE partitions\n" + string(out)
+		if err := os.WriteFile(filepath.Join(target, "etc/mdadm.conf"), []byte(conf), 0644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(hooksDir, "10-mdadm.sh"), []byte(mdadmHook(string(out))), 0755); err != nil {
+			return err
+		}
+	case "lvm":
+		if err := os.WriteFile(filepath.Join(hooksDir, "20-lvm.sh"), []byte(lvmHook()), 0755); err != nil {
+			return err
+		}
+	}
+
+	cmdline := storageKernelArgs(cfg) + "\n"
+	return os.WriteFile(filepath.Join(target, storageCmdlineFile), []byte(cmdline), 0644)
+}
+
+// addStorageHooks appends the hooks in target, with the mdadm and lvm
+// binaries they run, to every initramfs in target's /boot as a second cpio
+// archive, which the kernel unpacks over the first
+func addStorageHooks(target string) error {
+	hooks, _ := filepath.Glob(filepath.Join(target, storageHooksDir, "*.sh"))
+	if len(hooks) == 0 {
+		return nil
+	}
+	images, _ := filepath.Glob(filepath.Join(target, "boot", "initramfs*.img"))
+	if len(images) == 0 {
+		return fmt.Errorf("no initramfs in %s", filepath.Join(target, "boot"))
+	}
+
+	files := []cpioFile{
+		{name: "scripts", mode: 040755},
+		{name: "scripts/hooks", mode: 040755},
+		{name: "sbin", mode: 040755},
+	}
+	for _, hook := range hooks {
+		data, err := os.ReadFile(hook)
+		if err != nil {
+			return err
+		}
+		files = append(files, cpioFile{name: "scripts/hooks/" + filepath.Base(hook), mode: 0100755, data: data})
+	}
+	for _, tool := range []string{"sbin/mdadm", "sbin/lvm"} {
+		data, err := os.ReadFile(filepath.Join(target, tool))
+		if err != nil {
+			continue
+		}
+		files = append(files, cpioFile{name: tool, mode: 0100755, data: data})
+	}
+
+	var archive bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&archive, gzip.BestCompression)
+	if err := writeCpioArchive(zw, files); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		f, err := os.OpenFile(image, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(archive.Bytes())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", image, err)
+		}
+	}
+	return nil
+}
+
+// cpioFile is an entry of the archive written by writeCpioArchive
+type cpioFile struct {
+	name string
+	mode uint32 // file type and permission bits
+	data []byte
+}
+
+// writeCpioArchive writes files as a newc cpio archive, owned by root,
+// followed by its trailer
+func writeCpioArchive(w io.Writer, files []cpioFile) error {
+	pad := func(n int) error {
+		_, err := w.Write(make([]byte, (4-n%4)%4))
+		return err
+	}
+	for i, f := range append(files, cpioFile{name: "TRAILER!!!"}) {
+		name := f.name + "\x00"
+		header := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			i+1, f.mode, 0, 0, 1, 0, len(f.data), 0, 0, 0, 0, len(name), 0)
+		if _, err := io.WriteString(w, header+name); err != nil {
+			return err
+		}
+		if err := pad(len(header) + len(name)); err != nil {
+			return err
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return err
+		}
+		if err := pad(len(f.data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStorageBootEntries sets the kernel parameters of the layout on the
+// MixOS entry of each bootloader found in target, in place of the root=
+// and rd.* parameters of the system it was copied from
+func writeStorageBootEntries(target, args string) error {
+	byLoader := map[string][]*bootConfig{}
+	for _, c := range findBootConfigs(target) {
+		byLoader[c.Loader] = append(byLoader[c.Loader], c)
+	}
+	found := false
+	for _, search := range vramBootSearch {
+		conf, index := mixosBootEntry(byLoader[search.loader])
+		if conf == nil {
+			continue
+		}
+		found = true
+		if !conf.setBootArgs(index, storageBootParams, strings.Fields(args)) {
+			continue
+		}
+		if err := conf.write(storageBootBackup); err != nil {
+			return fmt.Errorf("failed to update %s: %w", conf.Path, err)
+		}
+	}
+	if !found {
+		return fmt.Errorf("no MixOS boot entry in %s to add %q to", target, args)
+	}
+	return nil
+}
+
+// mdadmHook returns an initramfs hook that assembles the mirror described by
+// the given "mdadm --detail --scan" output
+func mdadmHook(arrays string) string {
+	return `#!/bin/sh
+# Generated by mix setup: assemble the RAID1 root mirror
+modprobe raid1 2>/dev/null || true
+mkdir -p /etc
+cat > /etc/mdadm.conf << 'EOF'
+DEVICE partitions
+` + arrays + `EOF
+mdadm --assemble --scan --run
+`
+}
+
+// lvmHook returns an initramfs hook that activates the MixOS volume group
+func lvmHook() string {
+	return `#!/bin/sh
+# Generated by mix setup: activate the LVM volume group
+modprobe dm_mod 2>/dev/null || true
+lvm vgscan --mknodes
+lvm vgchange -ay ` + lvmVolumeGroup + `
+`
+}
+
+// partitionPath returns the device path of partition n (sda -> sda1,
+// nvme0n1 -> nvme0n1p1)
+func partitionPath(disk string, n int) string {
+	base := filepath.Base(disk)
+	if len(base) > 0 && base[len(base)-1] >= '0' && base[len(base)-1] <= '9' {
+		return fmt.Sprintf("%sp%d", disk, n)
+	}
+	return fmt.Sprintf("%s%d", disk, n)
+}
@@ -0,0 +1,382 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mixos-go/src/mix-cli/pkg/shadow"
+)
+
+// ============================================================================
+// Target System Configuration
+// ============================================================================
+
+const (
+	setupProfileFile    = "etc/mixos/profile"
+	setupInterfacesFile = "etc/network/interfaces"
+	defaultNTPServers   = "0.pool.ntp.org 1.pool.ntp.org 2.pool.ntp.org"
+	setupChronyConf     = "etc/chrony/chrony.conf"
+	setupChronyScript   = "etc/init.d/S20chronyd"
+	setupNtpdScript     = "etc/init.d/S20ntpd"
+)
+
+// setupHostname writes /etc/hostname in the target system
+func setupHostname(cfg setupConfig) error {
+	path := filepath.Join(cfg.targetRoot(), "etc/hostname")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(cfg.hostname+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	return nil
+}
+
+// setupUserAccount creates the user in the target system and stores the
+// password hash in /etc/shadow and the mixmagisk hash store.
+func setupUserAccount(cfg setupConfig) error {
+	root := cfg.targetRoot()
+	if !userExists(root, cfg.username) {
+		if _, err := exec.LookPath("useradd"); err != nil {
+			return fmt.Errorf("failed: useradd not available")
+		}
+		if out, err := exec.Command("useradd", "-R", root, "-m", cfg.username).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed: useradd: %s", strings.TrimSpace(string(out)))
+		}
+	}
+
+	if cfg.passwordHash == "" {
+		return nil
+	}
+
+	if err := shadow.SetHash(filepath.Join(root, "etc/shadow"), cfg.username, cfg.passwordHash); err != nil {
+		return fmt.Errorf("failed: writing shadow: %w", err)
+	}
+
+	hashStore := filepath.Join(root, mixmagiskHashes)
+	if err := os.MkdirAll(hashStore, 0700); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(hashStore, cfg.username+".hash"), []byte(cfg.passwordHash+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed: writing mixmagisk hash: %w", err)
+	}
+	return nil
+}
+
+// userExists reports whether name has an entry in root's /etc/passwd
+func userExists(root, name string) bool {
+	data, err := os.ReadFile(filepath.Join(root, "etc/passwd"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, name+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// setupNetwork writes /etc/network/interfaces and /etc/resolv.conf
+func setupNetwork(cfg setupConfig) error {
+	root := cfg.targetRoot()
+	var b strings.Builder
+	b.WriteString("# Generated by mix setup\n")
+	b.WriteString("auto lo\niface lo inet loopback\n")
+
+	vlans, err := parseVLANs(cfg.vlans)
+	if err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+
+	iface := primaryInterface(cfg)
+	method := cfg.networkType
+	if method == "none" && (cfg.bondEnabled || len(vlans) > 0) {
+		// The bond or trunk port must come up to carry VLANs
+		method = "manual"
+	}
+
+	switch method {
+	case "dhcp", "manual":
+		b.WriteString(fmt.Sprintf("\nauto %s\niface %s inet %s\n", iface, iface, method))
+	case "static":
+		address := cfg.ipAddress
+		if !strings.Contains(address, "/") {
+			address += "/24"
+		}
+		b.WriteString(fmt.Sprintf("\nauto %s\niface %s inet static\n", iface, iface))
+		b.WriteString(fmt.Sprintf("    address %s\n", address))
+		if cfg.gateway != "" {
+			b.WriteString(fmt.Sprintf("    gateway %s\n", cfg.gateway))
+		}
+	}
+	if method != "none" && cfg.bondEnabled {
+		writeBondStanza(&b, cfg)
+	}
+	if method == "manual" {
+		b.WriteString(fmt.Sprintf("    up ip link set %s up\n", iface))
+	}
+	writeVLANStanzas(&b, iface, vlans)
+
+	path := filepath.Join(root, setupInterfacesFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+
+	if cfg.networkType == "static" && cfg.dns != "" {
+		resolv := fmt.Sprintf("# Generated by mix setup\nnameserver %s\n", cfg.dns)
+		if err := os.WriteFile(filepath.Join(root, "etc/resolv.conf"), []byte(resolv), 0644); err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// profilePackages are the packages each profile adds to the base system
+var profilePackages = map[string][]string{
+	"desktop":   {"xorg-server", "xfce4", "firefox", "pulseaudio"},
+	"server":    {"openssh", "iptables", "nginx"},
+	"developer": {"openssh", "git", "make", "gcc", "vim"},
+	"minimal":   nil,
+}
+
+// setupProfile records the selected system profile and installs its
+// packages in the target system
+func setupProfile(cfg setupConfig) error {
+	root := cfg.targetRoot()
+	path := filepath.Join(root, setupProfileFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(cfg.profile+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+
+	pkgs := profilePackages[cfg.profile]
+	if len(pkgs) == 0 {
+		return nil
+	}
+	// The target's own mix and package database, chrooted unless the
+	// target is the running system; installed packages are skipped
+	args := append([]string{"install", "--yes"}, pkgs...)
+	var err error
+	if root == "/" {
+		exe, xerr := os.Executable()
+		if xerr != nil {
+			return fmt.Errorf("failed: %w", xerr)
+		}
+		err = runQuiet(exe, args...)
+	} else {
+		err = runQuiet("chroot", append([]string{root, "mix"}, args...)...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to install the %s packages: %w", cfg.profile, err)
+	}
+	return nil
+}
+
+// installedUsername returns the account created at installation: the one
+// in the install manifest, or else the first regular user of root
+func installedUsername(root string) string {
+	if data, err := os.ReadFile(filepath.Join(root, installManifestPath)); err == nil {
+		var m InstallManifest
+		if json.Unmarshal(data, &m) == nil && m.Username != "" && userExists(root, m.Username) {
+			return m.Username
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(root, "etc/passwd"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if uid, err := strconv.Atoi(fields[2]); err == nil && uid >= 1000 && uid < 65534 {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// loadLiveSetupConfig reads the current configuration of the system at
+// setupRoot so the wizard can be pre-filled when reconfiguring.
+func loadLiveSetupConfig(cfg *setupConfig) {
+	if data, err := os.ReadFile(filepath.Join(setupRoot, "etc/hostname")); err == nil {
+		if h := strings.TrimSpace(string(data)); h != "" {
+			cfg.hostname = h
+		}
+	}
+
+	if name := installedUsername(setupRoot); name != "" {
+		cfg.username = name
+	}
+
+	if data, err := os.ReadFile(filepath.Join(setupRoot, setupProfileFile)); err == nil {
+		if p := strings.TrimSpace(string(data)); p != "" {
+			cfg.profile = p
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(setupRoot, setupInterfacesFile)); err == nil {
+		cfg.networkType = "none"
+		primary := false
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 4 && fields[0] == "iface":
+				primary = fields[1] != "lo" && !strings.Contains(fields[1], ".")
+				if primary {
+					if fields[1] != bondInterface {
+						cfg.iface = fields[1]
+					}
+					cfg.networkType = fields[3]
+					if cfg.networkType == "manual" {
+						cfg.networkType = "none"
+					}
+				}
+			case primary && len(fields) == 2 && fields[0] == "address":
+				cfg.ipAddress = fields[1]
+			case primary && len(fields) == 2 && fields[0] == "gateway":
+				cfg.gateway = fields[1]
+			}
+		}
+		parseAdvancedNetwork(cfg, string(data))
+	}
+
+	if data, err := os.ReadFile(filepath.Join(setupRoot, "etc/adjtime")); err == nil {
+		if strings.Contains(string(data), "LOCAL") {
+			cfg.hwclock = "localtime"
+		}
+	}
+
+	// NTP is on when either client has a service
+	for _, conf := range []string{"etc/ntp.conf", setupChronyConf} {
+		data, err := os.ReadFile(filepath.Join(setupRoot, conf))
+		if err != nil {
+			continue
+		}
+		var servers []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && (fields[0] == "server" || fields[0] == "pool") {
+				servers = append(servers, fields[1])
+			}
+		}
+		if len(servers) > 0 {
+			cfg.ntpServers = strings.Join(servers, " ")
+		}
+	}
+	scripts, _ := filepath.Glob(filepath.Join(setupRoot, "etc/init.d/S*chrony*"))
+	_, err := os.Stat(filepath.Join(setupRoot, setupNtpdScript))
+	cfg.ntpEnabled = err == nil || len(scripts) > 0
+
+	if data, err := os.ReadFile(filepath.Join(setupRoot, "etc/resolv.conf")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "nameserver" {
+				cfg.dns = fields[1]
+				break
+			}
+		}
+	}
+}
+
+// setupTime writes the NTP client configuration and hardware clock mode.
+// chrony is used when installed in the target, busybox ntpd otherwise;
+// disabling NTP removes the services of both and chrony's configuration.
+func setupTime(cfg setupConfig) error {
+	root := cfg.targetRoot()
+	servers := strings.Fields(strings.ReplaceAll(cfg.ntpServers, ",", " "))
+
+	chronyConf := filepath.Join(root, setupChronyConf)
+	chronyScript := filepath.Join(root, setupChronyScript)
+	ntpdScript := filepath.Join(root, setupNtpdScript)
+	useChrony := false
+	for _, bin := range []string{"usr/sbin/chronyd", "sbin/chronyd", "usr/bin/chronyd"} {
+		if _, err := os.Stat(filepath.Join(root, bin)); err == nil {
+			useChrony = true
+			break
+		}
+	}
+
+	// Stop both clients from starting, including a chrony service of the
+	// package; the one in use gets its service back below
+	os.Remove(ntpdScript)
+	scripts, _ := filepath.Glob(filepath.Join(root, "etc/init.d/S*chrony*"))
+	for _, script := range scripts {
+		os.Remove(script)
+	}
+
+	if !cfg.ntpEnabled || len(servers) == 0 {
+		os.Remove(chronyConf)
+	} else if useChrony {
+		var b strings.Builder
+		b.WriteString("# Generated by mix setup\n")
+		for _, srv := range servers {
+			b.WriteString(fmt.Sprintf("server %s iburst\n", srv))
+		}
+		b.WriteString("driftfile /var/lib/chrony/drift\nmakestep 1.0 3\nrtcsync\n")
+		if err := os.MkdirAll(filepath.Dir(chronyConf), 0755); err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+		if err := os.WriteFile(chronyConf, []byte(b.String()), 0644); err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+
+		script := `#!/bin/sh
+# Generated by mix setup - chrony NTP client
+case "$1" in
+    start) chronyd -f /etc/chrony/chrony.conf ;;
+    stop)  killall chronyd 2>/dev/null ;;
+esac
+`
+		if err := os.MkdirAll(filepath.Dir(chronyScript), 0755); err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+		if err := os.WriteFile(chronyScript, []byte(script), 0755); err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+	} else {
+		var b strings.Builder
+		b.WriteString("# Generated by mix setup\n")
+		for _, srv := range servers {
+			b.WriteString(fmt.Sprintf("server %s\n", srv))
+		}
+		if err := os.WriteFile(filepath.Join(root, "etc/ntp.conf"), []byte(b.String()), 0644); err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+
+		script := `#!/bin/sh
+# Generated by mix setup - busybox NTP client
+case "$1" in
+    start) ntpd $(awk '/^server/ {printf "-p %s ", $2}' /etc/ntp.conf) ;;
+    stop)  killall ntpd 2>/dev/null ;;
+esac
+`
+		if err := os.MkdirAll(filepath.Dir(ntpdScript), 0755); err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+		if err := os.WriteFile(ntpdScript, []byte(script), 0755); err != nil {
+			return fmt.Errorf("failed: %w", err)
+		}
+	}
+
+	// /etc/adjtime: the third line selects UTC or LOCAL for hwclock
+	clock := "UTC"
+	if cfg.hwclock == "localtime" {
+		clock = "LOCAL"
+	}
+	adjtime := fmt.Sprintf("0.0 0 0.0\n0\n%s\n", clock)
+	if err := os.WriteFile(filepath.Join(root, "etc/adjtime"), []byte(adjtime), 0644); err != nil {
+		return fmt.Errorf("failed: %w", err)
+	}
+	return nil
+}
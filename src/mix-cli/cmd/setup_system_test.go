@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupUserAccountHashStore(t *testing.T) {
+	root := t.TempDir()
+	oldRoot := setupRoot
+	setupRoot = root
+	defer func() { setupRoot = oldRoot }()
+
+	config := "[general]\nsession_timeout = 300\n"
+	files := map[string]string{
+		"etc/passwd":           "root:x:0:0::/root:/bin/sh\nalice:x:1000:1000::/home/alice:/bin/sh\n",
+		"etc/shadow":           "root:*:19000:0:99999:7:::\nalice:!:19000:0:99999:7:::\n",
+		"etc/mixmagisk/config": config,
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := setupConfig{username: "alice", passwordHash: "$6$salt$hash", storageLayout: "existing"}
+	if err := setupUserAccount(cfg); err != nil {
+		t.Fatalf("setupUserAccount failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, mixmagiskHashes, "alice.hash"))
+	if err != nil {
+		t.Fatalf("hash not stored: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != cfg.passwordHash {
+		t.Errorf("stored hash = %q, expected %q", data, cfg.passwordHash)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, mixmagiskConfig)); err != nil || string(data) != config {
+		t.Errorf("config file changed: %q, %v", data, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "etc/shadow")); !strings.Contains(string(data), "alice:$6$salt$hash:") {
+		t.Errorf("shadow not updated:\n%s", data)
+	}
+}
@@ -0,0 +1,536 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mixos-go/src/mix-cli/pkg/manager"
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// Scheduled unattended upgrades
+// ============================================================================
+
+const (
+	upgradeScheduleConfig = "/etc/mixos/upgrade-schedule.json"
+	upgradeStateDir       = "/var/lib/mixos/upgrades"
+	upgradeLogFile        = "/var/log/mixos/upgrade.log"
+	upgradeCronFile       = "/etc/cron.d/mix-upgrade"
+)
+
+// UpgradeSchedule is the persisted unattended-upgrade configuration
+type UpgradeSchedule struct {
+	Enabled          bool      `json:"enabled"`
+	Window           string    `json:"window"`
+	RebootIfRequired bool      `json:"reboot_if_required"`
+	Updated          time.Time `json:"updated"`
+}
+
+// UpgradeReport records the outcome of one unattended upgrade run
+type UpgradeReport struct {
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"`
+	Snapshot       string    `json:"snapshot,omitempty"`
+	Upgraded       []string  `json:"upgraded"`
+	Failed         []string  `json:"failed,omitempty"`
+	Errors         []string  `json:"errors,omitempty"`
+	RebootRequired bool      `json:"reboot_required"`
+	Rebooted       bool      `json:"rebooted"`
+}
+
+var upgradeScheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Configure unattended upgrades in a maintenance window",
+	Long: `Configure unattended upgrades for appliance-style deployments.
+
+Upgrades are downloaded in advance and only applied inside the
+maintenance window. A snapshot of the installed package set is taken
+before anything changes.
+
+Window format: "<days> HH:MM-HH:MM", where days is a weekday (Sun),
+a range (Mon-Fri), a list (Mon,Wed) or "daily".
+
+The result of each run is logged to /var/log/mixos/upgrade.log and
+syslog, and sent to the mixmagisk notifications ([notify] in
+/etc/mixmagisk/config) when their events include upgrade, or failed for
+failed runs only.
+
+Examples:
+  mix upgrade schedule --window "Sun 03:00-05:00" --reboot-if-required
+  mix upgrade schedule --disable
+  mix upgrade schedule`,
+	RunE: runUpgradeSchedule,
+}
+
+var upgradeScheduleRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run the scheduled upgrade job (invoked periodically by cron)",
+	RunE:  runUpgradeScheduleJob,
+}
+
+func init() {
+	upgradeCmd.AddCommand(upgradeScheduleCmd)
+	upgradeScheduleCmd.AddCommand(upgradeScheduleRunCmd)
+
+	upgradeScheduleCmd.Flags().String("window", "", "maintenance window, e.g. \"Sun 03:00-05:00\"")
+	upgradeScheduleCmd.Flags().Bool("reboot-if-required", false, "reboot after upgrades that require it")
+	upgradeScheduleCmd.Flags().Bool("disable", false, "disable unattended upgrades")
+	upgradeScheduleRunCmd.Flags().Bool("now", false, "ignore the window and apply immediately")
+}
+
+// ============================================================================
+// Maintenance windows
+// ============================================================================
+
+type maintenanceWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(s)
+	if len(s) > 3 {
+		s = s[:3]
+	}
+	d, ok := weekdayNames[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown weekday %q", s)
+	}
+	return d, nil
+}
+
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+func parseMaintenanceWindow(s string) (*maintenanceWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid window %q (expected \"<days> HH:MM-HH:MM\")", s)
+	}
+
+	w := &maintenanceWindow{}
+	switch strings.ToLower(fields[0]) {
+	case "daily", "*":
+		for i := range w.days {
+			w.days[i] = true
+		}
+	default:
+		for _, part := range strings.Split(fields[0], ",") {
+			if from, to, ok := strings.Cut(part, "-"); ok {
+				a, err := parseWeekday(from)
+				if err != nil {
+					return nil, err
+				}
+				b, err := parseWeekday(to)
+				if err != nil {
+					return nil, err
+				}
+				for d := a; ; d = (d + 1) % 7 {
+					w.days[d] = true
+					if d == b {
+						break
+					}
+				}
+				continue
+			}
+			d, err := parseWeekday(part)
+			if err != nil {
+				return nil, err
+			}
+			w.days[d] = true
+		}
+	}
+
+	from, to, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time range %q", fields[1])
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("window start and end are identical")
+	}
+	return w, nil
+}
+
+// contains reports whether t falls inside the window. Windows whose end is
+// before their start run past midnight into the following day.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+	if w.days[t.Weekday()] && minute >= w.start {
+		return true
+	}
+	prev := (t.Weekday() + 6) % 7
+	return w.days[prev] && minute < w.end
+}
+
+// next returns the start of the next window opening after t
+func (w *maintenanceWindow) next(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i <= 7; i++ {
+		d := day.AddDate(0, 0, i)
+		start := d.Add(time.Duration(w.start) * time.Minute)
+		if w.days[d.Weekday()] && start.After(t) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+// ============================================================================
+// Configuration
+// ============================================================================
+
+func loadUpgradeSchedule() (*UpgradeSchedule, error) {
+	data, err := os.ReadFile(upgradeScheduleConfig)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &UpgradeSchedule{}, nil
+		}
+		return nil, err
+	}
+	var sched UpgradeSchedule
+	if err := json.Unmarshal(data, &sched); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", upgradeScheduleConfig, err)
+	}
+	return &sched, nil
+}
+
+func saveUpgradeSchedule(sched *UpgradeSchedule) error {
+	sched.Updated = time.Now()
+	data, err := json.MarshalIndent(sched, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(upgradeScheduleConfig), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(upgradeScheduleConfig, data, 0644)
+}
+
+func installUpgradeCron(enabled bool) error {
+	if !enabled {
+		err := os.Remove(upgradeCronFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(upgradeCronFile), 0755); err != nil {
+		return err
+	}
+	entry := "# Managed by 'mix upgrade schedule' - do not edit\n" +
+		"*/15 * * * * root mix upgrade schedule run >/dev/null 2>&1\n"
+	return os.WriteFile(upgradeCronFile, []byte(entry), 0644)
+}
+
+// logUpgradeEvent appends a line to the upgrade log and forwards it to syslog
+func logUpgradeEvent(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	os.MkdirAll(filepath.Dir(upgradeLogFile), 0755)
+	if f, err := os.OpenFile(upgradeLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+		fmt.Fprintf(f, "%s %s\n", time.Now().Format(time.RFC3339), msg)
+		f.Close()
+	}
+	if logger, err := exec.LookPath("logger"); err == nil {
+		exec.Command(logger, "-t", "mix-upgrade", msg).Run()
+	}
+	printVerbose("%s\n", msg)
+}
+
+// upgradeReportRecord turns the report of a run into a record for the
+// mixmagisk notifications: action upgrade, result success or failed
+func upgradeReportRecord(report *UpgradeReport) *auditRecord {
+	r := &auditRecord{
+		Time:   report.Finished,
+		Action: "upgrade",
+		User:   "root",
+		UID:    os.Getuid(),
+		Argv:   []string{"mix", "upgrade", "schedule", "run"},
+		Result: "success",
+	}
+	if u, err := user.Current(); err == nil {
+		r.User = u.Username
+	}
+	details := []string{fmt.Sprintf("%d upgraded, %d failed", len(report.Upgraded), len(report.Failed))}
+	if report.Snapshot != "" {
+		details = append(details, "snapshot "+report.Snapshot)
+	}
+	switch {
+	case report.Rebooted:
+		details = append(details, "rebooting")
+	case report.RebootRequired:
+		details = append(details, "reboot required")
+	}
+	if len(report.Failed) > 0 {
+		r.Result = "failed"
+		details = append(details, report.Errors...)
+	}
+	r.Details = strings.Join(details, "; ")
+	return r
+}
+
+// ============================================================================
+// Commands
+// ============================================================================
+
+func runUpgradeSchedule(cmd *cobra.Command, args []string) error {
+	window, _ := cmd.Flags().GetString("window")
+	disable, _ := cmd.Flags().GetBool("disable")
+
+	sched, err := loadUpgradeSchedule()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	if disable {
+		sched.Enabled = false
+		changed = true
+	}
+	if window != "" {
+		if _, err := parseMaintenanceWindow(window); err != nil {
+			return err
+		}
+		sched.Window = window
+		sched.Enabled = true
+		changed = true
+	}
+	if cmd.Flags().Changed("reboot-if-required") {
+		sched.RebootIfRequired, _ = cmd.Flags().GetBool("reboot-if-required")
+		changed = true
+	}
+
+	if changed {
+		if sched.Enabled && sched.Window == "" {
+			return fmt.Errorf("no maintenance window configured; use --window")
+		}
+		if err := saveUpgradeSchedule(sched); err != nil {
+			return fmt.Errorf("failed to save schedule: %w", err)
+		}
+		if err := installUpgradeCron(sched.Enabled); err != nil {
+			return fmt.Errorf("failed to update cron entry: %w", err)
+		}
+		logUpgradeEvent("schedule updated: enabled=%v window=%q reboot=%v",
+			sched.Enabled, sched.Window, sched.RebootIfRequired)
+	}
+
+	fmt.Println("Unattended Upgrades:")
+	if !sched.Enabled {
+		fmt.Println("  Status: disabled")
+		return nil
+	}
+	fmt.Println("  Status:             enabled")
+	fmt.Printf("  Window:             %s\n", sched.Window)
+	fmt.Printf("  Reboot if required: %v\n", sched.RebootIfRequired)
+	if w, err := parseMaintenanceWindow(sched.Window); err == nil {
+		if w.contains(time.Now()) {
+			fmt.Println("  Next window:        now")
+		} else {
+			fmt.Printf("  Next window:        %s\n", w.next(time.Now()).Format("Mon 2006-01-02 15:04"))
+		}
+	}
+	if report, err := loadLastUpgradeReport(); err == nil {
+		fmt.Printf("  Last run:           %s (%d upgraded, %d failed)\n",
+			report.Finished.Format("2006-01-02 15:04"), len(report.Upgraded), len(report.Failed))
+	}
+	return nil
+}
+
+func runUpgradeScheduleJob(cmd *cobra.Command, args []string) error {
+	now, _ := cmd.Flags().GetBool("now")
+
+	sched, err := loadUpgradeSchedule()
+	if err != nil {
+		return err
+	}
+	if !sched.Enabled && !now {
+		printVerbose("Unattended upgrades disabled\n")
+		return nil
+	}
+
+	inWindow := now
+	if !inWindow {
+		w, err := parseMaintenanceWindow(sched.Window)
+		if err != nil {
+			return err
+		}
+		inWindow = w.contains(time.Now())
+	}
+
+	mgr, err := manager.New(dbPath, repoURL, cacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to initialize package manager: %w", err)
+	}
+	defer mgr.Close()
+
+	if err := mgr.UpdateDatabase(); err != nil {
+		logUpgradeEvent("database update failed: %v", err)
+	}
+
+	upgrades, err := mgr.GetUpgradablePackages()
+	if err != nil {
+		return fmt.Errorf("failed to check for upgrades: %w", err)
+	}
+	if len(upgrades) == 0 {
+		printVerbose("All packages are up to date.\n")
+		return nil
+	}
+
+	if !inWindow {
+		// Outside the window: only download so the window is spent applying
+		fetched := 0
+		for _, u := range upgrades {
+			if _, err := mgr.Prefetch(u.Name); err != nil {
+				logUpgradeEvent("prefetch %s failed: %v", u.Name, err)
+				continue
+			}
+			fetched++
+		}
+		logUpgradeEvent("prefetched %d/%d upgrade(s) ahead of window", fetched, len(upgrades))
+		return nil
+	}
+
+	report := applyScheduledUpgrades(mgr, upgrades)
+
+	if report.RebootRequired && sched.RebootIfRequired && len(report.Failed) == 0 {
+		report.Rebooted = true
+	}
+	saveUpgradeReport(report)
+	logUpgradeEvent("upgrade run finished: %d upgraded, %d failed, reboot_required=%v",
+		len(report.Upgraded), len(report.Failed), report.RebootRequired)
+	notifyAuditRecord(upgradeReportRecord(report))
+
+	if report.Rebooted {
+		logUpgradeEvent("rebooting to complete upgrades")
+		return runCommand("reboot")
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d package(s) failed to upgrade", len(report.Failed))
+	}
+	return nil
+}
+
+func applyScheduledUpgrades(mgr *manager.Manager, upgrades []manager.PackageUpgrade) *UpgradeReport {
+	report := &UpgradeReport{Started: time.Now()}
+
+	snapshot, err := snapshotInstalledPackages(mgr)
+	if err != nil {
+		logUpgradeEvent("snapshot failed, aborting: %v", err)
+		report.Errors = append(report.Errors, "snapshot: "+err.Error())
+		for _, u := range upgrades {
+			report.Failed = append(report.Failed, u.Name)
+		}
+		report.Finished = time.Now()
+		return report
+	}
+	report.Snapshot = snapshot
+	logUpgradeEvent("snapshot written to %s", snapshot)
+
+	for _, u := range upgrades {
+		if err := mgr.Upgrade(u.Name); err != nil {
+			logUpgradeEvent("upgrade %s failed: %v", u.Name, err)
+			report.Failed = append(report.Failed, u.Name)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", u.Name, err))
+			continue
+		}
+		logUpgradeEvent("upgraded %s %s -> %s", u.Name, u.CurrentVersion, u.NewVersion)
+		report.Upgraded = append(report.Upgraded, u.Name)
+		if upgradeRequiresReboot(u.Name) {
+			report.RebootRequired = true
+		}
+	}
+
+	if _, err := os.Stat("/run/reboot-required"); err == nil {
+		report.RebootRequired = true
+	}
+	report.Finished = time.Now()
+	return report
+}
+
+// upgradeRequiresReboot reports whether upgrading pkg needs a reboot to take effect
+func upgradeRequiresReboot(pkg string) bool {
+	for _, prefix := range []string{"linux", "kernel", "initramfs", "busybox", "glibc", "musl"} {
+		if strings.HasPrefix(pkg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotInstalledPackages records the installed package set before upgrading
+func snapshotInstalledPackages(mgr *manager.Manager) (string, error) {
+	installed, err := mgr.ListInstalled()
+	if err != nil {
+		return "", err
+	}
+	versions := make(map[string]string, len(installed))
+	for _, p := range installed {
+		versions[p.Name] = p.Version
+	}
+
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(upgradeStateDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(upgradeStateDir, "snapshot-"+time.Now().Format("20060102-150405")+".json")
+	return path, os.WriteFile(path, data, 0644)
+}
+
+func saveUpgradeReport(report *UpgradeReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(upgradeStateDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(upgradeStateDir, "last-run.json"), data, 0644)
+}
+
+func loadLastUpgradeReport() (*UpgradeReport, error) {
+	data, err := os.ReadFile(filepath.Join(upgradeStateDir, "last-run.json"))
+	if err != nil {
+		return nil, err
+	}
+	var report UpgradeReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	// 2024-01-07 is a Sunday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		window   string
+		t        time.Time
+		expected bool
+	}{
+		{"Sun 03:00-05:00", at(7, 3, 0), true},
+		{"Sun 03:00-05:00", at(7, 4, 59), true},
+		{"Sun 03:00-05:00", at(7, 5, 0), false},
+		{"Sun 03:00-05:00", at(8, 4, 0), false},
+		{"Mon-Fri 22:00-02:00", at(8, 23, 0), true},
+		{"Mon-Fri 22:00-02:00", at(13, 1, 0), true}, // Saturday after Friday night
+		{"Mon-Fri 22:00-02:00", at(8, 1, 0), false}, // Monday early is Sunday's window
+		{"daily 12:00-13:00", at(10, 12, 30), true},
+		{"Mon,Wed 08:00-09:00", at(9, 8, 30), false}, // Tuesday
+	}
+
+	for _, tt := range tests {
+		w, err := parseMaintenanceWindow(tt.window)
+		if err != nil {
+			t.Fatalf("parseMaintenanceWindow(%q) failed: %v", tt.window, err)
+		}
+		if got := w.contains(tt.t); got != tt.expected {
+			t.Errorf("%q contains %s = %v, expected %v", tt.window, tt.t.Format("Mon 15:04"), got, tt.expected)
+		}
+	}
+}
+
+func TestParseMaintenanceWindowInvalid(t *testing.T) {
+	for _, s := range []string{"", "Sun", "Sun 03:00", "Funday 03:00-04:00", "Sun 25:00-26:00", "Sun 03:00-03:00"} {
+		if _, err := parseMaintenanceWindow(s); err == nil {
+			t.Errorf("parseMaintenanceWindow(%q) succeeded, expected error", s)
+		}
+	}
+}
+
+func TestUpgradeReportNotification(t *testing.T) {
+	tests := []struct {
+		report  UpgradeReport
+		result  string
+		details []string
+		events  map[string]bool // notify events setting: sent?
+	}{
+		{
+			UpgradeReport{Upgraded: []string{"curl", "vim"}, Snapshot: "/var/lib/mixos/upgrades/snapshot-1.json"},
+			"success",
+			[]string{"2 upgraded, 0 failed", "snapshot /var/lib/mixos/upgrades/snapshot-1.json"},
+			map[string]bool{"denied": false, "upgrade": true, "failed": false, "denied, upgrade": true},
+		},
+		{
+			UpgradeReport{Upgraded: []string{"linux"}, RebootRequired: true, Rebooted: true},
+			"success",
+			[]string{"1 upgraded, 0 failed", "rebooting"},
+			map[string]bool{"upgrade": true},
+		},
+		{
+			UpgradeReport{Upgraded: []string{"curl"}, Failed: []string{"vim"}, Errors: []string{"vim: checksum mismatch"}, RebootRequired: true},
+			"failed",
+			[]string{"1 upgraded, 1 failed", "reboot required", "vim: checksum mismatch"},
+			map[string]bool{"denied": false, "upgrade": true, "failed": true},
+		},
+		{
+			UpgradeReport{Failed: []string{"curl"}, Errors: []string{"snapshot: disk full"}},
+			"failed",
+			[]string{"0 upgraded, 1 failed", "snapshot: disk full"},
+			map[string]bool{"failed": true, "denied,failed": true},
+		},
+	}
+
+	for _, tt := range tests {
+		r := upgradeReportRecord(&tt.report)
+		if r.Action != "upgrade" || r.Result != tt.result {
+			t.Errorf("record of %+v: %s/%s, expected upgrade/%s", tt.report, r.Action, r.Result, tt.result)
+		}
+		if details := strings.Join(tt.details, "; "); r.Details != details {
+			t.Errorf("record details = %q, expected %q", r.Details, details)
+		}
+		for events, sent := range tt.events {
+			if got := notifyEventMatches(events, r); got != sent {
+				t.Errorf("events %q, %s run: sent = %v, expected %v", events, tt.result, got, sent)
+			}
+		}
+	}
+}
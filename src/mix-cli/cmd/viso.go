@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -45,9 +44,30 @@ var visoListCmd = &cobra.Command{
 var visoBootCmd = &cobra.Command{
 	Use:   "boot [viso-file]",
 	Short: "Show boot command for VISO",
-	Long:  `Display the QEMU command to boot a VISO image.`,
-	Args:  cobra.ExactArgs(1),
-	RunE:  runVisoBoot,
+	Long: `Display the QEMU command to boot a VISO image.
+
+--run boots the image instead: its kernel and initramfs are copied out of
+it, QEMU runs with the serial console of the guest on this terminal
+(Ctrl-A X quits), and the copies are removed when it exits. KVM is used
+when /dev/kvm is available.
+
+The command boots the architecture of the image, from its metadata, on
+the machine QEMU has for it: the default PC for x86_64, "virt" for
+aarch64. --arch overrides it; KVM is only used when the image has the
+architecture of this machine. --uefi boots with the UEFI firmware of the
+distribution (OVMF for x86_64 from the ovmf package, AAVMF for aarch64
+from qemu-efi-aarch64) on a q35 or virt machine.
+
+Images encrypted with "mix viso encrypt" are unlocked by QEMU: --run asks
+for the passphrase (or reads --passphrase-file), and the printed command
+asks for it in the shell.
+
+Examples:
+  mix viso boot mixos.viso --vram
+  mix viso boot mixos.viso --vram --memory 4G --run
+  mix viso boot mixos-arm64.viso --arch aarch64 --uefi`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoBoot,
 }
 
 func init() {
@@ -59,6 +79,10 @@ func init() {
 	visoBootCmd.Flags().Bool("vram", false, "Enable VRAM mode")
 	visoBootCmd.Flags().String("memory", "2G", "Memory size")
 	visoBootCmd.Flags().Bool("kvm", true, "Enable KVM acceleration")
+	visoBootCmd.Flags().Bool("run", false, "Boot the image in QEMU on this terminal")
+	visoBootCmd.Flags().String("arch", "", "Architecture to boot as: x86_64 or aarch64 (default: from the image)")
+	visoBootCmd.Flags().Bool("uefi", false, "Boot with UEFI firmware (OVMF, AAVMF) instead of BIOS")
+	visoBootCmd.Flags().String("passphrase-file", "", "Read the passphrase of an encrypted image from a file")
 }
 
 // VISO metadata structure
@@ -132,7 +156,25 @@ func runVisoInfo(cmd *cobra.Command, args []string) error {
 		fmt.Println("======")
 		fmt.Println("  mix viso info <file.viso>  - Show VISO file details")
 		fmt.Println("  mix viso list              - List available VISO images")
-		fmt.Println("  mix viso boot <file.viso>  - Show boot command")
+		fmt.Println("  mix viso boot <file.viso>  - Show or run the boot command")
+		fmt.Println("  mix viso create            - Build a VISO image")
+		fmt.Println("  mix viso verify <file>     - Check checksums and signatures")
+		fmt.Println("  mix viso sign <file>       - Sign an image")
+		fmt.Println("  mix viso convert <image>   - Convert an ISO or raw image")
+		fmt.Println("  mix viso mount <file>      - Mount an image for inspection")
+		fmt.Println("  mix viso extract <file>    - Extract files from an image")
+		fmt.Println("  mix viso inspect <file>    - Look into an image")
+		fmt.Println("  mix viso diff <a> <b>      - Compare two images")
+		fmt.Println("  mix viso delta <a> <b>     - Delta updates between images")
+		fmt.Println("  mix viso recompress <file> - Change the compression")
+		fmt.Println("  mix viso resize <file> <n> - Grow an image")
+		fmt.Println("  mix viso snapshot <cmd>    - Manage image snapshots")
+		fmt.Println("  mix viso push <file> <ref> - Push an image to a registry")
+		fmt.Println("  mix viso pull <ref>        - Pull an image from a registry")
+		fmt.Println("  mix viso write <file> <d>  - Write an image to a USB stick")
+		fmt.Println("  mix viso netboot <file>    - Export an image for PXE boot")
+		fmt.Println("  mix viso encrypt <file>    - Encrypt an image")
+		fmt.Println("  mix viso fsck <file>       - Check and repair an image")
 		fmt.Println("")
 
 		return nil
@@ -152,30 +194,29 @@ func runVisoInfo(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Modified:  %s\n", info.ModTime().Format("2006-01-02 15:04:05"))
 	fmt.Println("")
 
-	// Try to read metadata if it's a directory or mounted
-	metadataPath := filepath.Join(filepath.Dir(visoPath), "config", "viso.json")
-	if data, err := os.ReadFile(metadataPath); err == nil {
-		var metadata VisoMetadata
-		if err := json.Unmarshal(data, &metadata); err == nil {
-			fmt.Println("Metadata:")
-			fmt.Println("=========")
-			fmt.Printf("  Name:    %s\n", metadata.Name)
-			fmt.Printf("  Version: %s\n", metadata.Version)
-			fmt.Printf("  Format:  %s\n", metadata.Format)
-			fmt.Printf("  Created: %s\n", metadata.Created)
-			fmt.Println("")
-
-			fmt.Println("Features:")
-			fmt.Printf("  VRAM Support:     %v\n", metadata.Features.VramSupport)
-			fmt.Printf("  SDISK Boot:       %v\n", metadata.Features.SdiskBoot)
-			fmt.Printf("  Virtio Optimized: %v\n", metadata.Features.VirtioOptimized)
-			fmt.Println("")
-
-			fmt.Println("Requirements:")
-			fmt.Printf("  Min RAM:      %d MB\n", metadata.Requirements.MinRamMB)
-			fmt.Printf("  VRAM Min RAM: %d MB\n", metadata.Requirements.VramMinRamMB)
-			fmt.Printf("  Architecture: %s\n", metadata.Requirements.Arch)
-		}
+	// The header, then config/viso.json in the image or next to it
+	if metadata, source, err := readVisoMetadata(visoPath); err == nil {
+		fmt.Println("Metadata:")
+		fmt.Println("=========")
+		fmt.Printf("  Name:    %s\n", metadata.Name)
+		fmt.Printf("  Version: %s\n", metadata.Version)
+		fmt.Printf("  Format:  %s\n", metadata.Format)
+		fmt.Printf("  Created: %s\n", metadata.Created)
+		fmt.Printf("  Source:  %s\n", source)
+		fmt.Println("")
+
+		fmt.Println("Features:")
+		fmt.Printf("  VRAM Support:     %v\n", metadata.Features.VramSupport)
+		fmt.Printf("  SDISK Boot:       %v\n", metadata.Features.SdiskBoot)
+		fmt.Printf("  Virtio Optimized: %v\n", metadata.Features.VirtioOptimized)
+		fmt.Println("")
+
+		fmt.Println("Requirements:")
+		fmt.Printf("  Min RAM:      %d MB\n", metadata.Requirements.MinRamMB)
+		fmt.Printf("  VRAM Min RAM: %d MB\n", metadata.Requirements.VramMinRamMB)
+		fmt.Printf("  Architecture: %s\n", metadata.Requirements.Arch)
+	} else {
+		fmt.Printf("Metadata: %v\n", err)
 	}
 
 	fmt.Println("")
@@ -250,42 +291,161 @@ func runVisoBoot(cmd *cobra.Command, args []string) error {
 	vramMode, _ := cmd.Flags().GetBool("vram")
 	memory, _ := cmd.Flags().GetString("memory")
 	kvmEnabled, _ := cmd.Flags().GetBool("kvm")
+	run, _ := cmd.Flags().GetBool("run")
+	arch, _ := cmd.Flags().GetString("arch")
+	uefi, _ := cmd.Flags().GetBool("uefi")
+	passFile, _ := cmd.Flags().GetString("passphrase-file")
 
 	// Check if file exists
 	if _, err := os.Stat(visoPath); err != nil {
 		return fmt.Errorf("VISO file not found: %s", visoPath)
 	}
+	arch, err := visoBootArch(visoPath, arch)
+	if err != nil {
+		return err
+	}
+	b := &visoBoot{Image: visoPath, Memory: memory, VRAM: vramMode, KVM: kvmEnabled, Arch: arch, UEFI: uefi}
+	b.Encryption, b.PassphraseFile = visoEncryption(visoPath), passFile
+	if b.KVM && arch != visoHostArch() {
+		fmt.Printf("Note: KVM is off, this machine is %s and the image is %s\n", visoHostArch(), arch)
+		b.KVM = false
+	}
+	if uefi {
+		var found bool
+		if b.Firmware, found = visoFirmware(arch); !found {
+			if run {
+				return fmt.Errorf("no %s UEFI firmware found; install %s", arch, visoMachines[arch].FirmwarePackage)
+			}
+			fmt.Printf("\033[33mWarning:\033[0m no %s UEFI firmware found; install %s\n", arch, visoMachines[arch].FirmwarePackage)
+		}
+	}
+	if run {
+		return runVisoQemu(b)
+	}
 
 	fmt.Println("")
 	fmt.Println("QEMU Boot Command:")
 	fmt.Println("==================")
 	fmt.Println("")
 
-	var cmdParts []string
-	cmdParts = append(cmdParts, "qemu-system-x86_64")
-	cmdParts = append(cmdParts, fmt.Sprintf("  -drive file=%s,format=qcow2,if=virtio,cache=writeback,aio=threads", visoPath))
-	cmdParts = append(cmdParts, fmt.Sprintf("  -m %s", memory))
+	cmdParts := visoBootCommand(b)
+	if b.Encryption != "" {
+		// The shell asks for the passphrase and hands it to QEMU on a pipe
+		b.Secret = "/dev/fd/3"
+		cmdParts = visoBootCommand(b)
+		cmdParts[len(cmdParts)-1] += ` 3< <(printf %s "$VISO_PASS")`
+		fmt.Printf("read -rsp \"Passphrase for %s: \" VISO_PASS; echo\n", filepath.Base(visoPath))
+	}
+	printVisoBootCommand(cmdParts)
+	fmt.Println("")
 
-	if kvmEnabled {
-		cmdParts = append(cmdParts, "  -cpu host")
-		cmdParts = append(cmdParts, "  -enable-kvm")
+	if b.Encryption != "" {
+		fmt.Println("Note: the image is encrypted; the commands above ask for its passphrase (bash)")
+	}
+	if vramMode {
+		fmt.Println("Note: VRAM mode enabled - system will run from RAM")
+		fmt.Println("      Requires minimum 2GB RAM (4GB recommended)")
+	}
+
+	fmt.Println("")
+	return nil
+}
+
+// visoBoot describes how to boot a VISO image in QEMU
+type visoBoot struct {
+	Image     string
+	Memory    string
+	VRAM      bool
+	KVM       bool
+	Arch      string // x86_64 or aarch64; empty is x86_64
+	UEFI      bool
+	Firmware  string // UEFI firmware image
+	Kernel    string // passed to QEMU when given
+	Initramfs string
+
+	Encryption     string // how the image is encrypted, see visoEncryption
+	Secret         string // file QEMU reads the passphrase of the image from
+	PassphraseFile string // where --run reads the passphrase, instead of asking
+}
+
+// machine returns how QEMU emulates the architecture of the boot
+func (b *visoBoot) machine() visoMachine {
+	if m, ok := visoMachines[b.Arch]; ok {
+		return m
+	}
+	return visoMachines["x86_64"]
+}
+
+// visoQemuArgs returns the arguments of the QEMU command booting a VISO
+// image, each option followed by its value
+func visoQemuArgs(b *visoBoot) []string {
+	m := b.machine()
+	machine := m.Machine
+	if b.UEFI {
+		machine = m.UEFIMachine
+	}
+	var args []string
+	if machine != "" {
+		args = append(args, "-machine", machine)
+	}
+	if b.UEFI {
+		args = append(args, visoFirmwareArgs(b.Firmware)...)
+	}
+	drive := fmt.Sprintf("file=%s,format=%s", b.Image, visoImageFormat(b.Image))
+	if b.Encryption != "" {
+		args = append(args, "-object", visoSecretObject(b.Secret))
+		drive += "," + visoKeySecretOption(b.Encryption)
+	}
+	args = append(args,
+		"-drive", drive+",if=virtio,cache=writeback,aio=threads",
+		"-m", b.Memory,
+	)
+	if b.KVM {
+		args = append(args, "-cpu", "host", "-enable-kvm")
+	} else if m.CPU != "" {
+		args = append(args, "-cpu", m.CPU)
+	}
+	if b.Kernel != "" {
+		args = append(args, "-kernel", b.Kernel)
+	}
+	if b.Initramfs != "" {
+		args = append(args, "-initrd", b.Initramfs)
 	}
 
 	// Build kernel append line
-	appendParts := []string{"console=ttyS0"}
-	if vramMode {
+	appendParts := []string{"console=" + m.Console}
+	if b.VRAM {
 		appendParts = append(appendParts, "VRAM=auto")
 	}
 
 	// Get VISO name for SDISK
-	visoName := filepath.Base(visoPath)
+	visoName := filepath.Base(b.Image)
 	visoName = strings.TrimSuffix(visoName, ".viso")
 	appendParts = append(appendParts, fmt.Sprintf("SDISK=%s.VISO", visoName))
 
-	cmdParts = append(cmdParts, fmt.Sprintf("  -append \"%s\"", strings.Join(appendParts, " ")))
-	cmdParts = append(cmdParts, "  -nographic")
+	args = append(args, "-append", strings.Join(appendParts, " "))
+	return append(args, "-nographic")
+}
 
-	// Print command
+// visoBootCommand returns the lines of the QEMU command booting a VISO
+// image, an option and its value per line
+func visoBootCommand(b *visoBoot) []string {
+	cmdParts := []string{b.machine().Qemu}
+	for _, arg := range visoQemuArgs(b) {
+		if strings.ContainsAny(arg, " \t") {
+			arg = fmt.Sprintf("%q", arg)
+		}
+		if strings.HasPrefix(arg, "-") {
+			cmdParts = append(cmdParts, "  "+arg)
+		} else {
+			cmdParts[len(cmdParts)-1] += " " + arg
+		}
+	}
+	return cmdParts
+}
+
+// printVisoBootCommand prints a command one part per line
+func printVisoBootCommand(cmdParts []string) {
 	for i, part := range cmdParts {
 		if i < len(cmdParts)-1 {
 			fmt.Printf("%s \\\n", part)
@@ -293,14 +453,4 @@ func runVisoBoot(cmd *cobra.Command, args []string) error {
 			fmt.Println(part)
 		}
 	}
-
-	fmt.Println("")
-
-	if vramMode {
-		fmt.Println("Note: VRAM mode enabled - system will run from RAM")
-		fmt.Println("      Requires minimum 2GB RAM (4GB recommended)")
-	}
-
-	fmt.Println("")
-	return nil
 }
@@ -0,0 +1,457 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Convert
+// ============================================================================
+//
+// "mix viso convert" repacks the images other distributions ship into the
+// VISO layout. A live ISO already holds what a VISO image does: a kernel,
+// an initramfs and the root in a squashfs, at places that depend on the
+// distribution; they are extracted with bsdtar, which reads ISO 9660
+// without mounting it, and the squashfs is used as it is. A raw disk
+// image holds an installed root instead, on an ext2/3/4 filesystem, on
+// its own or in a partition: the largest one is dumped with debugfs and
+// packed as "mix viso create" does, with the kernel and the initramfs of
+// its /boot.
+
+const visoISOMagicOffset = 32769 // "CD001" of the primary volume descriptor
+
+// Where live ISOs keep their files, in order of preference; of the names
+// a pattern matches, the last in sort order (the newest version) is taken
+var (
+	visoISOKernels = []string{
+		"casper/vmlinuz", "casper/vmlinuz.efi", // Ubuntu
+		"live/vmlinuz", "live/vmlinuz-*", // Debian
+		"arch/boot/x86_64/vmlinuz-linux", // Arch
+		"images/pxeboot/vmlinuz",         // Fedora
+		"boot/x86_64/loader/linux",       // openSUSE
+		"isolinux/vmlinuz", "boot/vmlinuz-*", "boot/vmlinuz",
+	}
+	visoISOInitramfs = []string{
+		"casper/initrd", "casper/initrd.gz", "casper/initrd.lz",
+		"live/initrd.img", "live/initrd.img-*",
+		"arch/boot/x86_64/initramfs-linux.img",
+		"images/pxeboot/initrd.img",
+		"boot/x86_64/loader/initrd",
+		"isolinux/initrd.img", "boot/initrd.img-*", "boot/initramfs-*.img", "boot/initrd.img",
+	}
+	visoISORoots = []string{
+		"casper/filesystem.squashfs", "casper/minimal.squashfs",
+		"live/filesystem.squashfs",
+		"arch/x86_64/airootfs.sfs",
+		"LiveOS/squashfs.img",
+		"rootfs/rootfs.squashfs", "rootfs.squashfs",
+	}
+	// In the /boot of an installed root; the versioned names first, as the
+	// others are usually symlinks
+	visoRawKernels   = []string{"boot/vmlinuz-*", "boot/vmlinuz"}
+	visoRawInitramfs = []string{"boot/initrd.img-*", "boot/initramfs-*.img", "boot/initrd.img"}
+)
+
+// squashfsCompressions are the compressors of the squashfs superblock
+var squashfsCompressions = map[uint16]string{1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
+
+var visoConvertCmd = &cobra.Command{
+	Use:   "convert <image>",
+	Short: "Convert an ISO or raw disk image into a VISO image",
+	Long: `Convert a live ISO or a raw disk image into a VISO image.
+
+From a live ISO (Ubuntu, Debian, Arch, Fedora, openSUSE, ...), the
+kernel, the initramfs and the squashfs root are extracted and laid out
+as a VISO image; the root is not repacked. Requires bsdtar
+(libarchive-tools).
+
+From a raw disk image, the root is read from the ext2/3/4 filesystem of
+the image, or of its largest such partition, and packed with the kernel
+and the initramfs of its /boot. Run as root to keep the owners of its
+files. Requires debugfs (e2fsprogs) and mksquashfs.
+
+The initramfs of the original image does not know the VISO layout; give
+the MixOS initramfs with --initramfs to boot the result with SDISK.
+
+Examples:
+  mix viso convert ubuntu-24.04-desktop-amd64.iso -o ubuntu.viso
+  mix viso convert debian-live.iso -o debian.viso --initramfs /boot/initramfs-mixos.img
+  mix viso convert disk.img -o server.viso --compression zstd`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoConvert,
+}
+
+func init() {
+	visoCmd.AddCommand(visoConvertCmd)
+	visoConvertCmd.Flags().StringP("output", "o", "", "VISO image to write")
+	visoConvertCmd.Flags().String("kernel", "", "kernel to use instead of the image's")
+	visoConvertCmd.Flags().String("initramfs", "", "initramfs to use instead of the image's")
+	visoConvertCmd.Flags().String("name", "", "name recorded in the metadata (default: the image name)")
+	visoConvertCmd.Flags().String("version", "1.0.0", "version recorded in the metadata")
+	visoConvertCmd.Flags().String("compression", "xz", "squashfs compression of a raw image's root")
+	visoConvertCmd.Flags().String("cmdline", "console=ttyS0 VRAM=auto quiet", "kernel command line recorded in the metadata")
+	visoConvertCmd.Flags().Bool("force", false, "overwrite an existing image")
+	visoConvertCmd.MarkFlagRequired("output")
+}
+
+// matchVisoFile returns the name the first matching pattern picks
+func matchVisoFile(names, patterns []string) string {
+	for _, pattern := range patterns {
+		var matches []string
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				matches = append(matches, name)
+			}
+		}
+		if len(matches) > 0 {
+			sort.Strings(matches)
+			return matches[len(matches)-1]
+		}
+	}
+	return ""
+}
+
+// squashfsCompression reads the compressor of a squashfs
+func squashfsCompression(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sb := make([]byte, 96)
+	if _, err := io.ReadFull(f, sb); err != nil {
+		return "", fmt.Errorf("%s is not a squashfs", file)
+	}
+	info, err := parseSquashfsSuperblock(sb)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", file, err)
+	}
+	return info.Compression, nil
+}
+
+// isExtFilesystem reports whether r holds an ext2/3/4 superblock at off
+func isExtFilesystem(r io.ReaderAt, off int64) bool {
+	magic := make([]byte, 2)
+	_, err := r.ReadAt(magic, off+1080)
+	return err == nil && binary.LittleEndian.Uint16(magic) == 0xef53
+}
+
+// visoPartition is a span of a disk image, in bytes
+type visoPartition struct {
+	Start int64 `json:"start"`
+	Size  int64 `json:"size"`
+}
+
+// visoDiskPartitions reads the MBR or GPT partition table of a disk image
+// of 512-byte sectors
+func visoDiskPartitions(r io.ReaderAt) ([]visoPartition, error) {
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, fmt.Errorf("no partition table")
+	}
+	var parts []visoPartition
+	gpt := false
+	for i := 0; i < 4; i++ {
+		e := mbr[446+16*i:]
+		if e[4] == 0xee {
+			gpt = true
+			break
+		}
+		if e[4] != 0 {
+			parts = append(parts, visoPartition{
+				Start: int64(binary.LittleEndian.Uint32(e[8:])) * 512,
+				Size:  int64(binary.LittleEndian.Uint32(e[12:])) * 512,
+			})
+		}
+	}
+	if !gpt {
+		return parts, nil
+	}
+
+	hdr := make([]byte, 92)
+	if _, err := r.ReadAt(hdr, 512); err != nil || !bytes.Equal(hdr[:8], []byte("EFI PART")) {
+		return nil, fmt.Errorf("invalid GPT header")
+	}
+	table := int64(binary.LittleEndian.Uint64(hdr[72:])) * 512
+	count := binary.LittleEndian.Uint32(hdr[80:])
+	size := binary.LittleEndian.Uint32(hdr[84:])
+	if size < 48 || count > 1024 {
+		return nil, fmt.Errorf("invalid GPT header")
+	}
+	e := make([]byte, size)
+	for i := uint32(0); i < count; i++ {
+		if _, err := r.ReadAt(e, table+int64(i)*int64(size)); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(e[32:]))
+		last := int64(binary.LittleEndian.Uint64(e[40:]))
+		parts = append(parts, visoPartition{Start: first * 512, Size: (last - first + 1) * 512})
+	}
+	return parts, nil
+}
+
+// findVisoRawRoot returns where the root filesystem of a raw image is:
+// the whole image, or its largest ext partition
+func findVisoRawRoot(r io.ReaderAt, size int64) (visoPartition, error) {
+	if isExtFilesystem(r, 0) {
+		return visoPartition{Start: 0, Size: size}, nil
+	}
+	parts, err := visoDiskPartitions(r)
+	if err != nil {
+		return visoPartition{}, fmt.Errorf("no ext2/3/4 filesystem found: %w", err)
+	}
+	var root visoPartition
+	for _, p := range parts {
+		if p.Size > root.Size && isExtFilesystem(r, p.Start) {
+			root = p
+		}
+	}
+	if root.Size == 0 {
+		return visoPartition{}, fmt.Errorf("no ext2/3/4 partition found")
+	}
+	return root, nil
+}
+
+// extractVisoISO extracts the kernel, the initramfs and the root of a
+// live ISO into work
+func extractVisoISO(iso, work string) (kernel, initramfs, squashfs string, err error) {
+	bsdtar, err := exec.LookPath("bsdtar")
+	if err != nil {
+		return "", "", "", fmt.Errorf("bsdtar not found; install libarchive-tools")
+	}
+	out, err := exec.Command(bsdtar, "-tf", iso).Output()
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to read %s", iso)
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if name := strings.TrimPrefix(strings.TrimSpace(line), "./"); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	kernel = matchVisoFile(names, visoISOKernels)
+	initramfs = matchVisoFile(names, visoISOInitramfs)
+	squashfs = matchVisoFile(names, visoISORoots)
+	if squashfs == "" {
+		return "", "", "", fmt.Errorf("no squashfs root found in %s; is it a live ISO?", iso)
+	}
+	members := []string{squashfs}
+	for _, name := range []string{kernel, initramfs} {
+		if name != "" {
+			members = append(members, name)
+		}
+	}
+	if out, err := exec.Command(bsdtar, append([]string{"-xf", iso, "-C", work}, members...)...).CombinedOutput(); err != nil {
+		return "", "", "", fmt.Errorf("bsdtar failed: %s", strings.TrimSpace(string(out)))
+	}
+	join := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return filepath.Join(work, name)
+	}
+	return join(kernel), join(initramfs), join(squashfs), nil
+}
+
+// extractVisoRaw dumps the root filesystem of a raw image into work/root
+// and returns it with the kernel and the initramfs of its /boot
+func extractVisoRaw(raw, work string) (root, kernel, initramfs string, err error) {
+	debugfs, err := exec.LookPath("debugfs")
+	if err != nil {
+		return "", "", "", fmt.Errorf("debugfs not found; install e2fsprogs")
+	}
+	f, err := os.Open(raw)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", "", err
+	}
+	part, err := findVisoRawRoot(f, info.Size())
+	if err != nil {
+		return "", "", "", fmt.Errorf("%s: %w", raw, err)
+	}
+
+	// debugfs reads whole filesystems; a partition is copied out first
+	fsImage := raw
+	if part.Start != 0 {
+		fmt.Printf("  Root partition at %s (%s)\n", formatSize(part.Start), formatSize(part.Size))
+		fsImage = filepath.Join(work, "root.ext4")
+		out, err := os.Create(fsImage)
+		if err != nil {
+			return "", "", "", err
+		}
+		_, err = io.Copy(out, io.NewSectionReader(f, part.Start, part.Size))
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	// rdump cannot dump / into an existing directory, so the entries
+	// of / are dumped one by one
+	out, err := exec.Command(debugfs, "-R", "ls -p /", fsImage).Output()
+	if err != nil {
+		return "", "", "", fmt.Errorf("debugfs failed to read %s", raw)
+	}
+	var entries []string
+	for _, name := range parseDebugfsLs(string(out)) {
+		entries = append(entries, "/"+name)
+	}
+	if len(entries) == 0 {
+		return "", "", "", fmt.Errorf("%s: the filesystem is empty", raw)
+	}
+	root = filepath.Join(work, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		return "", "", "", err
+	}
+	cmd := "rdump " + strings.Join(entries, " ") + " " + root
+	if out, err := exec.Command(debugfs, "-R", cmd, fsImage).CombinedOutput(); err != nil {
+		return "", "", "", fmt.Errorf("debugfs failed: %s", strings.TrimSpace(string(out)))
+	}
+	if fsImage != raw {
+		os.Remove(fsImage)
+	}
+
+	var names []string
+	if des, err := os.ReadDir(filepath.Join(root, "boot")); err == nil {
+		for _, de := range des {
+			if de.Type().IsRegular() {
+				names = append(names, "boot/"+de.Name())
+			}
+		}
+	}
+	if name := matchVisoFile(names, visoRawKernels); name != "" {
+		kernel = filepath.Join(root, name)
+	}
+	if name := matchVisoFile(names, visoRawInitramfs); name != "" {
+		initramfs = filepath.Join(root, name)
+	}
+	return root, kernel, initramfs, nil
+}
+
+// isVisoISO reports whether a file is an ISO 9660 image
+func isVisoISO(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 5)
+	_, err = f.ReadAt(magic, visoISOMagicOffset)
+	return err == nil && string(magic) == "CD001"
+}
+
+func runVisoConvert(cmd *cobra.Command, args []string) error {
+	input := args[0]
+	output, _ := cmd.Flags().GetString("output")
+	kernel, _ := cmd.Flags().GetString("kernel")
+	initramfs, _ := cmd.Flags().GetString("initramfs")
+	name, _ := cmd.Flags().GetString("name")
+	version, _ := cmd.Flags().GetString("version")
+	compression, _ := cmd.Flags().GetString("compression")
+	cmdline, _ := cmd.Flags().GetString("cmdline")
+	force, _ := cmd.Flags().GetBool("force")
+
+	if info, err := os.Stat(input); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("image not found: %s", input)
+	}
+	for _, file := range []string{kernel, initramfs} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("file not found: %s", file)
+		}
+	}
+	if err := checkVisoOutput(output, force); err != nil {
+		return err
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	}
+
+	work, err := os.MkdirTemp(filepath.Dir(output), ".viso-convert-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	b := &visoBuild{Output: output, Name: name, Version: version, Cmdline: cmdline}
+	var found, foundInitramfs string
+	if isVisoISO(input) {
+		fmt.Printf("Extracting the live system of %s...\n", input)
+		found, foundInitramfs, b.Squashfs, err = extractVisoISO(input, work)
+		if err != nil {
+			return err
+		}
+		if b.Compression, err = squashfsCompression(b.Squashfs); err != nil {
+			return err
+		}
+		fmt.Printf("  Root: %s (%s)\n", strings.TrimPrefix(b.Squashfs, work+string(filepath.Separator)), b.Compression)
+	} else {
+		switch compression {
+		case "xz", "zstd", "lz4", "gzip":
+		default:
+			return fmt.Errorf("unknown compression %q (use xz, zstd, lz4 or gzip)", compression)
+		}
+		fmt.Printf("Reading the root filesystem of %s...\n", input)
+		b.Rootfs, found, foundInitramfs, err = extractVisoRaw(input, work)
+		if err != nil {
+			return err
+		}
+		b.Compression = compression
+	}
+
+	b.Kernel, b.Initramfs = kernel, initramfs
+	if b.Kernel == "" {
+		if found == "" {
+			return fmt.Errorf("no kernel found in %s; give one with --kernel", input)
+		}
+		b.Kernel = found
+		fmt.Printf("  Kernel: %s\n", filepath.Base(found))
+	}
+	if b.Initramfs == "" {
+		if foundInitramfs == "" {
+			return fmt.Errorf("no initramfs found in %s; give one with --initramfs", input)
+		}
+		b.Initramfs = foundInitramfs
+		fmt.Printf("  Initramfs: %s\n", filepath.Base(foundInitramfs))
+	}
+	fmt.Println("")
+
+	metadata, rootfsBytes, err := buildVisoImage(b)
+	if err != nil {
+		return err
+	}
+	if err := printVisoCreated(output, metadata, rootfsBytes, kernel, initramfs); err != nil {
+		return err
+	}
+	if initramfs == "" {
+		fmt.Printf("\n\033[33mNote:\033[0m the initramfs of %s does not boot the VISO layout;\n", filepath.Base(input))
+		fmt.Println("      convert again with --initramfs /boot/initramfs-mixos.img for SDISK boot.")
+	}
+	return nil
+}
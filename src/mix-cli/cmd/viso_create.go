@@ -0,0 +1,375 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Create
+// ============================================================================
+//
+// "mix viso create" does what build/scripts/build-viso.sh does for the
+// release images, from any root directory: it records the checksums of the
+// root for "mix vram verify", packs the root into a squashfs, lays it out
+// next to the kernel, the initramfs and viso.json as the initramfs expects
+// to find them, and writes the whole as an ext4 filesystem in a compressed
+// qcow2 image, with the checksums of the files it holds for "mix viso
+// verify" and the metadata in its header. mkfs.ext4 -d fills the
+// filesystem from a directory, so neither root nor a loop device is
+// needed.
+
+const (
+	visoLabel         = "MIXOS-VISO"
+	visoKernelPath    = "boot/vmlinuz-mixos"
+	visoInitramfsPath = "boot/initramfs-mixos.img"
+	visoRootfsPath    = "rootfs/rootfs.squashfs"
+	visoMetadataPath  = "config/viso.json"
+
+	visoVramMinRamMB  = 2048 // VRAM_MIN_SIZE_MB of the initramfs
+	visoVramOverhead  = 512  // VRAM_OVERHEAD_MB of the initramfs
+	visoImageHeadroom = 100  // MB of free space left in the filesystem
+)
+
+var visoCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Build a VISO image from a root directory",
+	Long: `Build a bootable VISO image from a root directory, a kernel and an
+initramfs.
+
+The root is packed into a squashfs and stored with the kernel, the
+initramfs and the viso.json metadata in an ext4 filesystem, written as a
+compressed qcow2 image, along with their checksums for "mix viso
+verify". The checksums of the files of the root are recorded in it
+first, in usr/share/mixos/manifest.sha256, for "mix vram verify".
+
+Requires mksquashfs (squashfs-tools), mkfs.ext4 (e2fsprogs) and qemu-img.
+
+Examples:
+  mix viso create --rootfs ./rootfs --kernel vmlinuz --initramfs init.img -o mixos.viso
+  mix viso create --rootfs ./rootfs --kernel vmlinuz --initramfs init.img \
+      -o mixos.viso --name MixOS-GO --version 1.1.0 --compression zstd`,
+	Args: cobra.NoArgs,
+	RunE: runVisoCreate,
+}
+
+func init() {
+	visoCmd.AddCommand(visoCreateCmd)
+	visoCreateCmd.Flags().String("rootfs", "", "root directory to pack")
+	visoCreateCmd.Flags().String("kernel", "", "kernel image")
+	visoCreateCmd.Flags().String("initramfs", "", "initramfs image")
+	visoCreateCmd.Flags().StringP("output", "o", "", "VISO image to write")
+	visoCreateCmd.Flags().String("name", "MixOS-GO", "name recorded in the metadata")
+	visoCreateCmd.Flags().String("version", "1.0.0", "version recorded in the metadata")
+	visoCreateCmd.Flags().String("compression", "xz", "squashfs compression (xz, zstd, lz4, gzip)")
+	visoCreateCmd.Flags().String("cmdline", "console=ttyS0 VRAM=auto quiet", "kernel command line recorded in the metadata")
+	visoCreateCmd.Flags().Bool("force", false, "overwrite an existing image")
+	visoCreateCmd.MarkFlagRequired("rootfs")
+	visoCreateCmd.MarkFlagRequired("kernel")
+	visoCreateCmd.MarkFlagRequired("initramfs")
+	visoCreateCmd.MarkFlagRequired("output")
+}
+
+// newVisoMetadata describes an image holding a squashfs root of
+// rootfsBytes
+func newVisoMetadata(name, version, compression, cmdline string, rootfsBytes int64) *VisoMetadata {
+	m := &VisoMetadata{
+		Name:    name,
+		Version: version,
+		Format:  "VISO",
+		Created: time.Now().Format(time.RFC3339),
+	}
+	m.Features.VramSupport = true
+	m.Features.SdiskBoot = true
+	m.Features.VirtioOptimized = true
+	m.Boot.Kernel = visoKernelPath
+	m.Boot.Initramfs = visoInitramfsPath
+	m.Boot.Cmdline = cmdline
+	m.Rootfs.Path = visoRootfsPath
+	m.Rootfs.Format = "squashfs"
+	m.Rootfs.Compression = compression
+	m.Requirements.MinRamMB = 512
+	// As check_vram_capability: room to unpack the root, plus overhead
+	m.Requirements.VramMinRamMB = max(visoVramMinRamMB, int(rootfsBytes>>20)*2+visoVramOverhead)
+	m.Requirements.Arch = "x86_64"
+	return m
+}
+
+// visoImageSizeMB returns the size of a filesystem to hold dir: its
+// contents, a tenth more for ext4 itself and some headroom
+func visoImageSizeMB(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	mb := (total + 1<<20 - 1) >> 20
+	return mb + mb/10 + visoImageHeadroom, nil
+}
+
+// copyVisoFile copies a boot file into the image layout
+func copyVisoFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// visoTools looks up the tools needed to build an image
+func visoTools(names ...string) (map[string]string, error) {
+	tools := map[string]string{}
+	var missing []string
+	for _, name := range names {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			missing = append(missing, name)
+			continue
+		}
+		tools[name] = path
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing tools: %s (install squashfs-tools, e2fsprogs and qemu-utils)", strings.Join(missing, ", "))
+	}
+	return tools, nil
+}
+
+// visoBuild describes an image to build: the root is packed from the
+// directory Rootfs, or taken as it is from the squashfs Squashfs, a
+// scratch file moved into the image when it can be
+type visoBuild struct {
+	Rootfs      string
+	Squashfs    string
+	Kernel      string
+	Initramfs   string
+	Output      string
+	Name        string
+	Version     string
+	Compression string
+	Cmdline     string
+	Qcow2       string // cluster compression: zlib (default), zstd or none
+}
+
+// visoQcow2Args returns the qemu-img convert options of a qcow2 cluster
+// compression
+func visoQcow2Args(compression string) ([]string, error) {
+	switch compression {
+	case "", "zlib":
+		return []string{"-c"}, nil
+	case "zstd":
+		return []string{"-c", "-o", "compression_type=zstd"}, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown qcow2 compression %q (use zlib, zstd or none)", compression)
+}
+
+// buildVisoImage builds the image b describes and returns its metadata
+// and the size of its root
+func buildVisoImage(b *visoBuild) (*VisoMetadata, int64, error) {
+	names := []string{"mkfs.ext4", "qemu-img"}
+	if b.Squashfs == "" {
+		names = append(names, "mksquashfs")
+	}
+	tools, err := visoTools(names...)
+	if err != nil {
+		return nil, 0, err
+	}
+	qcow2Args, err := visoQcow2Args(b.Qcow2)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stage, err := os.MkdirTemp(filepath.Dir(b.Output), ".viso-create-")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(stage)
+
+	step, steps := 0, 3
+	if b.Squashfs == "" {
+		steps = 5
+	}
+	progress := func(format string, args ...any) {
+		step++
+		fmt.Printf("[%d/%d] %s\n", step, steps, fmt.Sprintf(format, args...))
+	}
+
+	squashfs := filepath.Join(stage, visoRootfsPath)
+	if err := os.MkdirAll(filepath.Dir(squashfs), 0755); err != nil {
+		return nil, 0, err
+	}
+	if b.Squashfs == "" {
+		progress("Recording checksums of %s...", b.Rootfs)
+		if err := writeVramManifest(b.Rootfs); err != nil {
+			return nil, 0, fmt.Errorf("failed to write the manifest: %w", err)
+		}
+
+		progress("Packing the root (%s)...", b.Compression)
+		squashArgs := []string{b.Rootfs, squashfs, "-comp", b.Compression, "-b", "1M", "-noappend", "-no-progress", "-quiet"}
+		if out, err := exec.Command(tools["mksquashfs"], squashArgs...).CombinedOutput(); err != nil {
+			return nil, 0, fmt.Errorf("mksquashfs failed: %s", strings.TrimSpace(string(out)))
+		}
+	} else if err := os.Rename(b.Squashfs, squashfs); err != nil {
+		if err := copyVisoFile(b.Squashfs, squashfs); err != nil {
+			return nil, 0, fmt.Errorf("failed to copy the root: %w", err)
+		}
+	}
+	squashInfo, err := os.Stat(squashfs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	progress("Adding the kernel, initramfs, metadata and manifest...")
+	if err := copyVisoFile(b.Kernel, filepath.Join(stage, visoKernelPath)); err != nil {
+		return nil, 0, fmt.Errorf("failed to copy the kernel: %w", err)
+	}
+	if err := copyVisoFile(b.Initramfs, filepath.Join(stage, visoInitramfsPath)); err != nil {
+		return nil, 0, fmt.Errorf("failed to copy the initramfs: %w", err)
+	}
+	metadata := newVisoMetadata(b.Name, b.Version, b.Compression, b.Cmdline, squashInfo.Size())
+	data, err := json.MarshalIndent(metadata, "", "    ")
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := os.MkdirAll(filepath.Join(stage, filepath.Dir(visoMetadataPath)), 0755); err != nil {
+		return nil, 0, err
+	}
+	if err := os.WriteFile(filepath.Join(stage, visoMetadataPath), append(data, '\n'), 0644); err != nil {
+		return nil, 0, err
+	}
+	if err := writeVisoManifest(stage); err != nil {
+		return nil, 0, fmt.Errorf("failed to write the image manifest: %w", err)
+	}
+
+	sizeMB, err := visoImageSizeMB(stage)
+	if err != nil {
+		return nil, 0, err
+	}
+	progress("Creating a %dMB ext4 filesystem...", sizeMB)
+	raw := filepath.Join(filepath.Dir(b.Output), "."+filepath.Base(b.Output)+".raw")
+	defer os.Remove(raw)
+	if err := os.WriteFile(raw, nil, 0644); err != nil {
+		return nil, 0, err
+	}
+	if err := os.Truncate(raw, sizeMB<<20); err != nil {
+		return nil, 0, err
+	}
+	if out, err := exec.Command(tools["mkfs.ext4"], "-F", "-q", "-L", visoLabel, "-d", stage, raw).CombinedOutput(); err != nil {
+		return nil, 0, fmt.Errorf("mkfs.ext4 failed: %s", strings.TrimSpace(string(out)))
+	}
+	if err := writeVisoHeader(raw, metadata); err != nil {
+		fmt.Printf("  Warning: metadata left out of the image header: %v\n", err)
+	}
+
+	progress("Converting to qcow2...")
+	tmp := b.Output + ".tmp"
+	convertArgs := append(append([]string{"convert", "-f", "raw", "-O", "qcow2"}, qcow2Args...), raw, tmp)
+	if out, err := exec.Command(tools["qemu-img"], convertArgs...).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return nil, 0, fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(tmp, b.Output); err != nil {
+		os.Remove(tmp)
+		return nil, 0, err
+	}
+	return metadata, squashInfo.Size(), nil
+}
+
+// checkVisoOutput checks that an image may be written to output
+func checkVisoOutput(output string, force bool) error {
+	if !strings.HasSuffix(output, ".viso") {
+		return fmt.Errorf("%s: VISO images take the .viso extension", output)
+	}
+	if _, err := os.Stat(output); err == nil && !force {
+		return fmt.Errorf("%s already exists (use --force to overwrite)", output)
+	}
+	return nil
+}
+
+// printVisoCreated reports a new image and how to boot it
+func printVisoCreated(output string, metadata *VisoMetadata, rootfsBytes int64, kernel, initramfs string) error {
+	info, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n✓ Created %s (%s, root %s)\n", output, formatSize(info.Size()), formatSize(rootfsBytes))
+	fmt.Printf("  VRAM mode needs %d MB of RAM\n", metadata.Requirements.VramMinRamMB)
+	fmt.Println("\nBoot Command:")
+	fmt.Println("=============")
+	printVisoBootCommand(visoBootCommand(&visoBoot{Image: output, Memory: "2G", VRAM: true, KVM: true, Arch: metadata.Requirements.Arch, Kernel: kernel, Initramfs: initramfs}))
+	return nil
+}
+
+func runVisoCreate(cmd *cobra.Command, args []string) error {
+	rootfs, _ := cmd.Flags().GetString("rootfs")
+	kernel, _ := cmd.Flags().GetString("kernel")
+	initramfs, _ := cmd.Flags().GetString("initramfs")
+	output, _ := cmd.Flags().GetString("output")
+	name, _ := cmd.Flags().GetString("name")
+	version, _ := cmd.Flags().GetString("version")
+	compression, _ := cmd.Flags().GetString("compression")
+	cmdline, _ := cmd.Flags().GetString("cmdline")
+	force, _ := cmd.Flags().GetBool("force")
+
+	if info, err := os.Stat(rootfs); err != nil || !info.IsDir() {
+		return fmt.Errorf("root directory not found: %s", rootfs)
+	}
+	for _, file := range []string{kernel, initramfs} {
+		if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("file not found: %s", file)
+		}
+	}
+	if err := checkVisoOutput(output, force); err != nil {
+		return err
+	}
+	switch compression {
+	case "xz", "zstd", "lz4", "gzip":
+	default:
+		return fmt.Errorf("unknown compression %q (use xz, zstd, lz4 or gzip)", compression)
+	}
+
+	metadata, rootfsBytes, err := buildVisoImage(&visoBuild{
+		Rootfs:      rootfs,
+		Kernel:      kernel,
+		Initramfs:   initramfs,
+		Output:      output,
+		Name:        name,
+		Version:     version,
+		Compression: compression,
+		Cmdline:     cmdline,
+	})
+	if err != nil {
+		return err
+	}
+	return printVisoCreated(output, metadata, rootfsBytes, kernel, initramfs)
+}
@@ -0,0 +1,645 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Delta Updates
+// ============================================================================
+//
+// "mix viso delta create" writes the difference between two images as a
+// .vdelta file, and "mix viso delta apply" rebuilds the new image from the
+// old one and the delta. Both work on the raw filesystem of the images, as
+// the compression of qcow2 images hides what they share: the new
+// filesystem is matched against the blocks of the old one the way rsync
+// does, with a rolling checksum confirmed by SHA-256, so data that only
+// moved is copied rather than sent.
+//
+// A delta starts with "MIXOS-VDELTA\n", the length of its header as a
+// 32-bit big-endian integer and the header as JSON, read without
+// unpacking the rest. Then comes a gzip stream of operations: 'C' with the
+// offset and length of old data to copy, 'L' with a length and literal
+// data, and 'E' at the end, numbers as unsigned varints. The header holds
+// the size and SHA-256 of both raw filesystems: apply refuses an old image
+// that does not match, and checks the image it rebuilt before writing it.
+
+const (
+	visoDeltaMagic   = "MIXOS-VDELTA\n"
+	visoDeltaFormat  = "mixos-vdelta/1"
+	visoDeltaBlock   = 16 << 10 // matched block size
+	visoDeltaLiteral = 1 << 20  // longest literal operation
+	visoDeltaChunk   = 8 << 20  // read size of the new filesystem
+)
+
+// visoDeltaImage is an image a delta goes from or to
+type visoDeltaImage struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	Format  string `json:"format"` // qcow2 or raw
+	Size    int64  `json:"size"`   // of the raw filesystem
+	SHA256  string `json:"sha256"` // of the raw filesystem
+}
+
+// visoDeltaHeader is the header of a .vdelta file
+type visoDeltaHeader struct {
+	Format    string         `json:"format"`
+	BlockSize int            `json:"block_size"`
+	Created   string         `json:"created"`
+	From      visoDeltaImage `json:"from"`
+	To        visoDeltaImage `json:"to"`
+}
+
+// visoDeltaStats counts what the new filesystem takes from where
+type visoDeltaStats struct {
+	Copied  int64 // bytes copied from the old filesystem
+	Literal int64 // bytes carried in the delta
+}
+
+// visoBlock is a block of the old filesystem
+type visoBlock struct {
+	Offset int64
+	Strong [sha256.Size]byte
+}
+
+// visoBlockIndex finds blocks of the old filesystem by rolling checksum
+type visoBlockIndex struct {
+	size   int
+	blocks map[uint32][]visoBlock
+}
+
+var visoDeltaCmd = &cobra.Command{
+	Use:   "delta",
+	Short: "Create and apply delta updates between VISO images",
+	Long: `Create a delta holding what a new VISO image adds to an old one, and
+rebuild the new image from the old image and the delta, so an update of
+a 2 GB image can travel as a patch of the changes alone.
+
+The old image is checked against the delta before it is used, and the
+rebuilt image against the new image before it is written.
+
+Examples:
+  mix viso delta create mixos-1.0.0.viso mixos-1.1.0.viso -o upgrade.vdelta
+  mix viso delta apply mixos-1.0.0.viso upgrade.vdelta -o mixos-1.1.0.viso`,
+}
+
+var visoDeltaCreateCmd = &cobra.Command{
+	Use:   "create <old.viso> <new.viso>",
+	Short: "Write the delta from one image to another",
+	Long: `Write a .vdelta file from which "mix viso delta apply" rebuilds the new
+image out of the old one. Data of the new image found anywhere in the
+old one is referenced; the rest is carried, compressed.
+
+Requires debugfs (e2fsprogs), and qemu-img for qcow2 images.
+
+Examples:
+  mix viso delta create mixos-1.0.0.viso mixos-1.1.0.viso -o upgrade.vdelta`,
+	Args: cobra.ExactArgs(2),
+	RunE: runVisoDeltaCreate,
+}
+
+var visoDeltaApplyCmd = &cobra.Command{
+	Use:   "apply <old.viso> <delta>",
+	Short: "Rebuild an image from an old image and a delta",
+	Long: `Rebuild the new image of a delta from the old image it was made against.
+The old image must be exactly the one the delta expects; the rebuilt
+image is checked against the checksum of the new one before it is
+written, in the format of the new one.
+
+Requires debugfs (e2fsprogs), and qemu-img for qcow2 images.
+
+Examples:
+  mix viso delta apply mixos-1.0.0.viso upgrade.vdelta -o mixos-1.1.0.viso
+  mix viso verify mixos-1.1.0.viso`,
+	Args: cobra.ExactArgs(2),
+	RunE: runVisoDeltaApply,
+}
+
+func init() {
+	visoCmd.AddCommand(visoDeltaCmd)
+	visoDeltaCmd.AddCommand(visoDeltaCreateCmd)
+	visoDeltaCmd.AddCommand(visoDeltaApplyCmd)
+	visoDeltaCreateCmd.Flags().StringP("output", "o", "", "delta file to write (.vdelta)")
+	visoDeltaCreateCmd.Flags().Bool("force", false, "overwrite an existing delta")
+	visoDeltaCreateCmd.MarkFlagRequired("output")
+	visoDeltaApplyCmd.Flags().StringP("output", "o", "", "VISO image to write")
+	visoDeltaApplyCmd.Flags().Bool("force", false, "overwrite an existing image")
+	visoDeltaApplyCmd.MarkFlagRequired("output")
+}
+
+// visoWeakSum is the rolling checksum of rsync over a block
+func visoWeakSum(block []byte) (a, b uint32) {
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// indexVisoBlocks reads the old filesystem into an index of its blocks
+// and returns its size and SHA-256
+func indexVisoBlocks(r io.Reader, blockSize int) (*visoBlockIndex, int64, string, error) {
+	idx := &visoBlockIndex{size: blockSize, blocks: map[uint32][]visoBlock{}}
+	h := sha256.New()
+	br := bufio.NewReaderSize(io.TeeReader(r, h), visoDeltaChunk)
+	block := make([]byte, blockSize)
+	var off int64
+	for {
+		n, err := io.ReadFull(br, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			off += int64(n)
+			break
+		}
+		if err != nil {
+			return nil, 0, "", err
+		}
+		a, b := visoWeakSum(block)
+		weak := a | b<<16
+		strong := sha256.Sum256(block)
+		known := false
+		for _, c := range idx.blocks[weak] {
+			if c.Strong == strong {
+				known = true
+				break
+			}
+		}
+		if !known {
+			idx.blocks[weak] = append(idx.blocks[weak], visoBlock{Offset: off, Strong: strong})
+		}
+		off += int64(n)
+	}
+	return idx, off, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// find returns where the old filesystem holds block
+func (idx *visoBlockIndex) find(weak uint32, block []byte) (int64, bool) {
+	candidates, ok := idx.blocks[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := sha256.Sum256(block)
+	for _, c := range candidates {
+		if c.Strong == strong {
+			return c.Offset, true
+		}
+	}
+	return 0, false
+}
+
+// visoDeltaWriter writes the operations of a delta, merging copies of
+// consecutive old data
+type visoDeltaWriter struct {
+	w       io.Writer
+	copyOff int64
+	copyLen int64
+	stats   visoDeltaStats
+}
+
+func (d *visoDeltaWriter) flushCopy() error {
+	if d.copyLen == 0 {
+		return nil
+	}
+	op := binary.AppendUvarint([]byte{'C'}, uint64(d.copyOff))
+	op = binary.AppendUvarint(op, uint64(d.copyLen))
+	d.copyLen = 0
+	_, err := d.w.Write(op)
+	return err
+}
+
+func (d *visoDeltaWriter) copy(off, n int64) error {
+	d.stats.Copied += n
+	if d.copyLen > 0 && d.copyOff+d.copyLen == off {
+		d.copyLen += n
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.copyOff, d.copyLen = off, n
+	return nil
+}
+
+func (d *visoDeltaWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.stats.Literal += int64(len(data))
+	if _, err := d.w.Write(binary.AppendUvarint([]byte{'L'}, uint64(len(data)))); err != nil {
+		return err
+	}
+	_, err := d.w.Write(data)
+	return err
+}
+
+func (d *visoDeltaWriter) end() error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	_, err := d.w.Write([]byte{'E'})
+	return err
+}
+
+// encodeVisoDelta writes the operations that rebuild the new filesystem r
+// from the old one idx indexes, and returns the size and SHA-256 of r
+func encodeVisoDelta(w io.Writer, idx *visoBlockIndex, r io.Reader) (visoDeltaStats, int64, string, error) {
+	d := &visoDeltaWriter{w: w}
+	h := sha256.New()
+	r = io.TeeReader(r, h)
+	bs := idx.size
+
+	var buf []byte
+	start, lit := 0, 0 // window and pending literal in buf
+	var size int64
+	eof := false
+	// fill keeps a window and the byte after it in buf when it can; the
+	// pending literal is written out first
+	fill := func() error {
+		if eof || len(buf)-start > bs {
+			return nil
+		}
+		if err := d.literal(buf[lit:start]); err != nil {
+			return err
+		}
+		rest := append([]byte(nil), buf[start:]...)
+		chunk := make([]byte, visoDeltaChunk)
+		n, err := io.ReadFull(r, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return err
+		}
+		size += int64(n)
+		buf = append(rest, chunk[:n]...)
+		start, lit = 0, 0
+		return nil
+	}
+
+	var a, b uint32
+	rolling := false
+	for {
+		if err := fill(); err != nil {
+			return d.stats, 0, "", err
+		}
+		if len(buf)-start < bs {
+			break
+		}
+		if !rolling {
+			a, b = visoWeakSum(buf[start : start+bs])
+			rolling = true
+		}
+		if off, ok := idx.find(a|b<<16, buf[start:start+bs]); ok {
+			if err := d.literal(buf[lit:start]); err != nil {
+				return d.stats, 0, "", err
+			}
+			if err := d.copy(off, int64(bs)); err != nil {
+				return d.stats, 0, "", err
+			}
+			start += bs
+			lit = start
+			rolling = false
+			continue
+		}
+		if len(buf)-start == bs {
+			break // the last window, with nothing to roll in
+		}
+		out, in := uint32(buf[start]), uint32(buf[start+bs])
+		a = (a - out + in) & 0xffff
+		b = (b - uint32(bs)*out + a) & 0xffff
+		start++
+		if start-lit >= visoDeltaLiteral {
+			if err := d.literal(buf[lit:start]); err != nil {
+				return d.stats, 0, "", err
+			}
+			lit = start
+		}
+	}
+	if err := d.literal(buf[lit:]); err != nil {
+		return d.stats, 0, "", err
+	}
+	if err := d.end(); err != nil {
+		return d.stats, 0, "", err
+	}
+	return d.stats, size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// applyVisoDeltaOps rebuilds the new filesystem into w from the old one
+// and the operations of a delta
+func applyVisoDeltaOps(ops io.Reader, old io.ReaderAt, w io.Writer) error {
+	r := bufio.NewReader(ops)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("truncated delta: %w", err)
+		}
+		switch op {
+		case 'C':
+			off, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("truncated delta: %w", err)
+			}
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("truncated delta: %w", err)
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(old, int64(off), int64(n))); err != nil {
+				return err
+			}
+		case 'L':
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("truncated delta: %w", err)
+			}
+			if _, err := io.CopyN(w, r, int64(n)); err != nil {
+				return fmt.Errorf("truncated delta: %w", err)
+			}
+		case 'E':
+			return nil
+		default:
+			return fmt.Errorf("invalid delta operation %q", op)
+		}
+	}
+}
+
+// writeVisoDeltaHeader writes the magic and the header of a delta
+func writeVisoDeltaHeader(w io.Writer, hdr *visoDeltaHeader) error {
+	data, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	buf := append([]byte(visoDeltaMagic), binary.BigEndian.AppendUint32(nil, uint32(len(data)))...)
+	_, err = w.Write(append(buf, data...))
+	return err
+}
+
+// readVisoDeltaHeader reads the header of a delta, leaving r at its
+// operations
+func readVisoDeltaHeader(r io.Reader) (*visoDeltaHeader, error) {
+	magic := make([]byte, len(visoDeltaMagic)+4)
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.HasPrefix(magic, []byte(visoDeltaMagic)) {
+		return nil, fmt.Errorf("not a VISO delta")
+	}
+	n := binary.BigEndian.Uint32(magic[len(visoDeltaMagic):])
+	if n > 1<<20 {
+		return nil, fmt.Errorf("invalid delta header")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("truncated delta header")
+	}
+	var hdr visoDeltaHeader
+	if err := json.Unmarshal(data, &hdr); err != nil {
+		return nil, fmt.Errorf("invalid delta header: %w", err)
+	}
+	if hdr.Format != visoDeltaFormat {
+		return nil, fmt.Errorf("unsupported delta format %q", hdr.Format)
+	}
+	return &hdr, nil
+}
+
+// openVisoDeltaImage opens an image for a delta; an unpacked image has no
+// filesystem to match
+func openVisoDeltaImage(path string) (*visoImage, visoDeltaImage, error) {
+	img, err := openVisoImage(path)
+	if err != nil {
+		return nil, visoDeltaImage{}, err
+	}
+	if img.dir {
+		return nil, visoDeltaImage{}, fmt.Errorf("%s is a directory; deltas are made between image files", path)
+	}
+	d := visoDeltaImage{Format: visoImageFormat(path)}
+	if m, _, err := readVisoMetadata(path); err == nil {
+		d.Name, d.Version = m.Name, m.Version
+	}
+	return img, d, nil
+}
+
+// visoDeltaLabel names an image of a delta in messages
+func visoDeltaLabel(d visoDeltaImage) string {
+	if d.Version == "" {
+		return d.SHA256[:12]
+	}
+	return strings.TrimSpace(d.Name + " " + d.Version)
+}
+
+func runVisoDeltaCreate(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	force, _ := cmd.Flags().GetBool("force")
+	if !strings.HasSuffix(output, ".vdelta") {
+		return fmt.Errorf("%s: VISO deltas take the .vdelta extension", output)
+	}
+	if _, err := os.Stat(output); err == nil && !force {
+		return fmt.Errorf("%s already exists (use --force to overwrite)", output)
+	}
+
+	fmt.Printf("[1/3] Reading %s...\n", args[0])
+	oldImg, from, err := openVisoDeltaImage(args[0])
+	if err != nil {
+		return err
+	}
+	defer oldImg.Close()
+	oldRaw, err := os.Open(oldImg.raw)
+	if err != nil {
+		return err
+	}
+	idx, size, sum, err := indexVisoBlocks(oldRaw, visoDeltaBlock)
+	oldRaw.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", args[0], err)
+	}
+	from.Size, from.SHA256 = size, sum
+
+	fmt.Printf("[2/3] Reading %s...\n", args[1])
+	newImg, to, err := openVisoDeltaImage(args[1])
+	if err != nil {
+		return err
+	}
+	defer newImg.Close()
+	newRaw, err := os.Open(newImg.raw)
+	if err != nil {
+		return err
+	}
+	defer newRaw.Close()
+
+	fmt.Println("[3/3] Writing the delta...")
+	tmp := output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	// The sizes and checksum of the new filesystem are known once it is
+	// read, so the operations go to a scratch file first
+	ops, err := os.CreateTemp("", "viso-delta-")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer os.Remove(ops.Name())
+	defer ops.Close()
+	gz, _ := gzip.NewWriterLevel(ops, gzip.BestCompression)
+	stats, size, sum, err := encodeVisoDelta(gz, idx, newRaw)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write the delta: %w", err)
+	}
+	to.Size, to.SHA256 = size, sum
+
+	hdr := &visoDeltaHeader{
+		Format:    visoDeltaFormat,
+		BlockSize: visoDeltaBlock,
+		Created:   time.Now().Format(time.RFC3339),
+		From:      from,
+		To:        to,
+	}
+	err = writeVisoDeltaHeader(f, hdr)
+	if err == nil {
+		if _, err = ops.Seek(0, io.SeekStart); err == nil {
+			_, err = io.Copy(f, ops)
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	newInfo, err := os.Stat(args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n✓ Created %s (%s, for an image of %s)\n", output, formatSize(info.Size()), formatSize(newInfo.Size()))
+	fmt.Printf("  %s → %s\n", visoDeltaLabel(from), visoDeltaLabel(to))
+	if size > 0 {
+		fmt.Printf("  %.1f%% of the new image reused from the old one\n", float64(stats.Copied)*100/float64(size))
+	}
+	fmt.Printf("  Apply it with: mix viso delta apply %s %s -o <new.viso>\n", args[0], output)
+	return nil
+}
+
+func runVisoDeltaApply(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	force, _ := cmd.Flags().GetBool("force")
+	if err := checkVisoOutput(output, force); err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[1])
+	if err != nil {
+		return fmt.Errorf("delta not found: %s", args[1])
+	}
+	defer f.Close()
+	hdr, err := readVisoDeltaHeader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[1], err)
+	}
+	fmt.Printf("Delta %s → %s\n\n", visoDeltaLabel(hdr.From), visoDeltaLabel(hdr.To))
+
+	var qemuImg string
+	if hdr.To.Format == "qcow2" {
+		if qemuImg, err = exec.LookPath("qemu-img"); err != nil {
+			return fmt.Errorf("qemu-img not found; install qemu-utils")
+		}
+	}
+
+	fmt.Printf("[1/3] Checking %s...\n", args[0])
+	oldImg, _, err := openVisoDeltaImage(args[0])
+	if err != nil {
+		return err
+	}
+	defer oldImg.Close()
+	old, err := os.Open(oldImg.raw)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, old)
+	if err != nil {
+		return err
+	}
+	if size != hdr.From.Size || hex.EncodeToString(h.Sum(nil)) != hdr.From.SHA256 {
+		return fmt.Errorf("%s is not the image the delta was made against (%s)", args[0], visoDeltaLabel(hdr.From))
+	}
+
+	fmt.Println("[2/3] Rebuilding the new image...")
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: invalid delta: %w", args[1], err)
+	}
+	tmp, err := os.MkdirTemp("", "viso-delta-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	raw := filepath.Join(tmp, "image.raw")
+	out, err := os.Create(raw)
+	if err != nil {
+		return err
+	}
+	h.Reset()
+	w := bufio.NewWriterSize(io.MultiWriter(out, h), visoDeltaChunk)
+	err = applyVisoDeltaOps(gz, old, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[1], err)
+	}
+	if info, err := os.Stat(raw); err != nil || info.Size() != hdr.To.Size || hex.EncodeToString(h.Sum(nil)) != hdr.To.SHA256 {
+		return fmt.Errorf("the rebuilt image does not match %s; the delta is damaged", visoDeltaLabel(hdr.To))
+	}
+
+	fmt.Printf("[3/3] Writing %s...\n", output)
+	part := output + ".tmp"
+	if qemuImg != "" {
+		if out, err := exec.Command(qemuImg, "convert", "-f", "raw", "-O", "qcow2", "-c", raw, part).CombinedOutput(); err != nil {
+			os.Remove(part)
+			return fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+		}
+	} else if err := copyVisoFile(raw, part); err != nil {
+		os.Remove(part)
+		return err
+	}
+	if err := os.Rename(part, output); err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	fmt.Printf("\n✓ Created %s (%s)\n", output, visoDeltaLabel(hdr.To))
+	fmt.Println("  Contents match the checksum recorded in the delta")
+	fmt.Printf("  Check its signature with: mix viso verify %s\n", output)
+	return nil
+}
@@ -0,0 +1,425 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mixos-go/src/mix-cli/pkg/manager"
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Diff
+// ============================================================================
+//
+// "mix viso diff" compares two images: their metadata field by field, the
+// boot files through the manifests of the images, the packages installed
+// in their roots, and the files of the roots. Files are listed with
+// unsquashfs -lls; regular files both roots record in their manifest
+// (usr/share/mixos/manifest.sha256) are compared by checksum, the others
+// by type, owner, mode, size and link target. Directories only count as
+// added or removed.
+
+const visoPackagesDB = "var/lib/mix/packages.db"
+
+// visoLlsTime matches the time of an unsquashfs -lls line, before the path
+var visoLlsTime = regexp.MustCompile(` \d{4}-\d{2}-\d{2} \d{2}:\d{2} `)
+
+// visoFieldChange is a metadata field that differs
+type visoFieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// visoPackageChange is a package whose version differs
+type visoPackageChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// visoDiff is the report of "mix viso diff"
+type visoDiff struct {
+	Old      string            `json:"old"`
+	New      string            `json:"new"`
+	Metadata []visoFieldChange `json:"metadata"`
+	Boot     []string          `json:"boot"` // image files whose checksum differs
+	Packages struct {
+		Added   []string            `json:"added"`
+		Removed []string            `json:"removed"`
+		Changed []visoPackageChange `json:"changed"`
+	} `json:"packages"`
+	Files struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+		Changed []string `json:"changed"`
+	} `json:"files"`
+}
+
+// visoRootIndex is what diff knows of the root of an image
+type visoRootIndex struct {
+	Entries  map[string]string // path: type, owner, mode, size and target
+	Hashes   map[string]string // path: checksum, from the manifest
+	Packages map[string]string // name: version; nil without a database
+}
+
+var visoDiffCmd = &cobra.Command{
+	Use:   "diff <old.viso> <new.viso>",
+	Short: "Compare two VISO images",
+	Long: `Show what differs between two VISO images: metadata fields, boot files,
+installed packages (added, removed, upgraded) and the files of the root
+(added, removed, changed).
+
+Files recorded in the manifests of both roots are compared by checksum,
+others by type, owner, mode, size and link target; --files=false skips
+them. --json prints the report for release tooling. The exit status is 0 whether or not the
+images differ.
+
+Requires debugfs (e2fsprogs), qemu-img for qcow2 images, and unsquashfs
+(squashfs-tools).
+
+Examples:
+  mix viso diff mixos-1.0.0.viso mixos-1.1.0.viso
+  mix viso diff old.viso new.viso --json > changes.json`,
+	Args: cobra.ExactArgs(2),
+	RunE: runVisoDiff,
+}
+
+func init() {
+	visoCmd.AddCommand(visoDiffCmd)
+	visoDiffCmd.Flags().Bool("json", false, "print the report as JSON")
+	visoDiffCmd.Flags().Bool("files", true, "compare the files of the roots")
+}
+
+// readVisoPackages returns the installed packages of a package database
+func readVisoPackages(path string) (map[string]string, error) {
+	db, err := manager.NewDatabase(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the package database: %w", err)
+	}
+	defer db.Close()
+	installed, err := db.ListInstalled()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the package database: %w", err)
+	}
+	packages := map[string]string{}
+	for _, p := range installed {
+		packages[p.Name] = p.Version
+	}
+	return packages, nil
+}
+
+// parseSquashfsListing reads unsquashfs -lls output into a signature per
+// path; directories get their type alone, as their size follows their
+// entries
+func parseSquashfsListing(out []byte) map[string]string {
+	entries := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		loc := visoLlsTime.FindStringIndex(line)
+		if loc == nil || len(line) < 10 {
+			continue
+		}
+		fields := strings.Fields(line[:loc[0]])
+		if len(fields) < 3 {
+			continue
+		}
+		name := line[loc[1]:]
+		target := ""
+		if line[0] == 'l' {
+			name, target, _ = strings.Cut(name, " -> ")
+		}
+		// Paths start with the directory unsquashfs would extract into
+		_, rel, ok := strings.Cut(name, "/")
+		if !ok || rel == "" {
+			continue
+		}
+		if line[0] == 'd' {
+			entries[rel] = "d"
+			continue
+		}
+		entries[rel] = strings.Join(append(fields, target), " ")
+	}
+	return entries
+}
+
+// indexVisoRoot lists the root of an image and reads its manifest and
+// package database
+func indexVisoRoot(path string) (*visoRootIndex, error) {
+	unsquashfs, err := exec.LookPath("unsquashfs")
+	if err != nil {
+		return nil, fmt.Errorf("unsquashfs not found; install squashfs-tools")
+	}
+	img, err := openVisoImage(path)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	tmp, err := os.MkdirTemp("", "viso-diff-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	squashfs, err := img.RootSquashfs(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := exec.Command(unsquashfs, "-lls", squashfs).Output()
+	if err != nil {
+		return nil, fmt.Errorf("unsquashfs failed to list the root of %s", path)
+	}
+	idx := &visoRootIndex{Entries: parseSquashfsListing(out)}
+
+	root := filepath.Join(tmp, "root")
+	if out, err := exec.Command(unsquashfs, "-no-progress", "-d", root, squashfs, "/"+vramManifest, "/"+visoPackagesDB).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("unsquashfs failed: %s", strings.TrimSpace(string(out)))
+	}
+	if f, err := os.Open(filepath.Join(root, vramManifest)); err == nil {
+		entries, err := parseVramManifest(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s: %w", path, vramManifest, err)
+		}
+		idx.Hashes = map[string]string{}
+		for _, e := range entries {
+			idx.Hashes[e.Path] = e.Hash
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, visoPackagesDB)); err == nil {
+		if idx.Packages, err = readVisoPackages(filepath.Join(root, visoPackagesDB)); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// diffVisoRoots compares the files of two roots
+func diffVisoRoots(from, to *visoRootIndex) (added, removed, changed []string) {
+	for path, sig := range to.Entries {
+		oldSig, ok := from.Entries[path]
+		switch {
+		case !ok:
+			added = append(added, path)
+		case path == vramManifest:
+			// Follows the other files
+		case sig == "d" && oldSig == "d":
+		default:
+			// The checksums catch what keeps its size
+			oldHash, inOld := from.Hashes[path]
+			newHash, inNew := to.Hashes[path]
+			if sig != oldSig || (inOld && inNew && oldHash != newHash) {
+				changed = append(changed, path)
+			}
+		}
+	}
+	for path := range from.Entries {
+		if _, ok := to.Entries[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// diffVisoPackages compares two sets of installed packages
+func diffVisoPackages(from, to map[string]string) (added, removed []string, changed []visoPackageChange) {
+	for name, version := range to {
+		oldVersion, ok := from[name]
+		switch {
+		case !ok:
+			added = append(added, name+" "+version)
+		case oldVersion != version:
+			changed = append(changed, visoPackageChange{Name: name, Old: oldVersion, New: version})
+		}
+	}
+	for name, version := range from {
+		if _, ok := to[name]; !ok {
+			removed = append(removed, name+" "+version)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Name < changed[j].Name })
+	return added, removed, changed
+}
+
+// flattenVisoMetadata turns metadata into dotted fields and their values
+func flattenVisoMetadata(m *VisoMetadata) map[string]string {
+	fields := map[string]string{}
+	if m == nil {
+		return fields
+	}
+	data, _ := json.Marshal(m)
+	var tree map[string]any
+	json.Unmarshal(data, &tree)
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		if obj, ok := v.(map[string]any); ok {
+			for k, child := range obj {
+				walk(strings.TrimPrefix(prefix+"."+k, "."), child)
+			}
+			return
+		}
+		fields[prefix] = fmt.Sprint(v)
+	}
+	walk("", tree)
+	return fields
+}
+
+// diffVisoMetadata compares the metadata of two images
+func diffVisoMetadata(from, to *VisoMetadata) []visoFieldChange {
+	oldFields, newFields := flattenVisoMetadata(from), flattenVisoMetadata(to)
+	var changes []visoFieldChange
+	for field, value := range newFields {
+		if oldFields[field] != value {
+			changes = append(changes, visoFieldChange{Field: field, Old: oldFields[field], New: value})
+		}
+	}
+	for field, value := range oldFields {
+		if _, ok := newFields[field]; !ok {
+			changes = append(changes, visoFieldChange{Field: field, Old: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// readVisoImageHashes returns the checksums of the manifest of an image
+func readVisoImageHashes(path string) map[string]string {
+	img, err := openVisoImage(path)
+	if err != nil {
+		return nil
+	}
+	defer img.Close()
+	data, err := img.ReadFile(visoManifestPath)
+	if err != nil {
+		return nil
+	}
+	entries, err := parseVramManifest(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	hashes := map[string]string{}
+	for _, e := range entries {
+		hashes[e.Path] = e.Hash
+	}
+	return hashes
+}
+
+// printVisoList prints a section of the diff, prefixing each line
+func printVisoList(title, prefix string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Printf("  %s (%d):\n", title, len(items))
+	for _, item := range items {
+		fmt.Printf("    %s %s\n", prefix, item)
+	}
+}
+
+func printVisoDiff(d *visoDiff, withFiles bool) {
+	fmt.Printf("--- %s\n+++ %s\n\n", d.Old, d.New)
+
+	fmt.Println("Metadata:")
+	if len(d.Metadata) == 0 {
+		fmt.Println("  no changes")
+	}
+	for _, c := range d.Metadata {
+		fmt.Printf("  %-28s %s → %s\n", c.Field, c.Old, c.New)
+	}
+	fmt.Println("")
+
+	fmt.Println("Boot files:")
+	if len(d.Boot) == 0 {
+		fmt.Println("  no changes")
+	}
+	for _, rel := range d.Boot {
+		fmt.Printf("  ~ %s\n", rel)
+	}
+	fmt.Println("")
+
+	p := &d.Packages
+	fmt.Println("Packages:")
+	if len(p.Added)+len(p.Removed)+len(p.Changed) == 0 {
+		fmt.Println("  no changes")
+	}
+	printVisoList("Added", "+", p.Added)
+	printVisoList("Removed", "-", p.Removed)
+	if len(p.Changed) > 0 {
+		fmt.Printf("  Changed (%d):\n", len(p.Changed))
+		for _, c := range p.Changed {
+			fmt.Printf("    ~ %s %s → %s\n", c.Name, c.Old, c.New)
+		}
+	}
+
+	if withFiles {
+		f := &d.Files
+		fmt.Println("")
+		fmt.Println("Files:")
+		if len(f.Added)+len(f.Removed)+len(f.Changed) == 0 {
+			fmt.Println("  no changes")
+		}
+		printVisoList("Added", "+", f.Added)
+		printVisoList("Removed", "-", f.Removed)
+		printVisoList("Changed", "~", f.Changed)
+		fmt.Printf("\n%d added, %d removed, %d changed\n", len(f.Added), len(f.Removed), len(f.Changed))
+	}
+}
+
+func runVisoDiff(cmd *cobra.Command, args []string) error {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	withFiles, _ := cmd.Flags().GetBool("files")
+	d := &visoDiff{Old: args[0], New: args[1]}
+
+	var metadata [2]*VisoMetadata
+	var roots [2]*visoRootIndex
+	var hashes [2]map[string]string
+	for i, path := range args {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("VISO file not found: %s", path)
+		}
+		// An image without metadata compares as empty metadata
+		metadata[i], _, _ = readVisoMetadata(path)
+		hashes[i] = readVisoImageHashes(path)
+		var err error
+		if roots[i], err = indexVisoRoot(path); err != nil {
+			return err
+		}
+	}
+
+	d.Metadata = diffVisoMetadata(metadata[0], metadata[1])
+	for _, rel := range visoManifestFiles[:3] {
+		if hashes[0][rel] != hashes[1][rel] {
+			d.Boot = append(d.Boot, rel)
+		}
+	}
+	d.Packages.Added, d.Packages.Removed, d.Packages.Changed = diffVisoPackages(roots[0].Packages, roots[1].Packages)
+	if withFiles {
+		d.Files.Added, d.Files.Removed, d.Files.Changed = diffVisoRoots(roots[0], roots[1])
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	printVisoDiff(d, withFiles)
+	return nil
+}
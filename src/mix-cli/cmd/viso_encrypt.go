@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// ============================================================================
+// VISO Encryption
+// ============================================================================
+//
+// "mix viso encrypt" protects an image holding secrets with a passphrase,
+// in one of the two encrypted formats of QEMU: a qcow2 image whose
+// clusters are encrypted (encrypt.format=luks), or a LUKS1 image that
+// cryptsetup can open too. QEMU decrypts the disk, so the guest sees a
+// plain VISO disk and the initramfs needs nothing new. The passphrase
+// reaches qemu-img and QEMU through a secret object read from a file
+// only the user can read, never on a command line. Encrypted images are
+// only booted: openVisoImage refuses them, and "mix viso boot --run"
+// asks for the passphrase to get the kernel out of a decrypted copy.
+
+// visoLUKSMagic starts a LUKS image
+var visoLUKSMagic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+// visoSecretID names the QEMU secret object unlocking an image
+const visoSecretID = "viso0"
+
+var visoEncryptCmd = &cobra.Command{
+	Use:   "encrypt <viso-file>",
+	Short: "Encrypt a VISO image with a passphrase",
+	Long: `Encrypt a VISO image with a passphrase, so that an image holding
+secrets (keys, credentials, private packages) can be shared or stored
+where others can read it.
+
+--format qcow2, the default, uses the native encryption of qcow2 images:
+their clusters are encrypted with LUKS. --format luks writes a LUKS1
+image, which cryptsetup can open as well as QEMU. Either way the guest
+sees a plain disk and boots as usual. Encrypted data does not compress,
+so the image grows to about the size of its contents.
+
+The passphrase is asked twice on the terminal, or read from
+--passphrase-file. Boot an encrypted image with "mix viso boot --run",
+which asks for the passphrase, or with the command "mix viso boot"
+prints, which asks for it in the shell. Other commands cannot read it.
+The image is rewritten in place unless --output is given.
+
+Requires qemu-img.
+
+Examples:
+  mix viso encrypt mixos.viso
+  mix viso encrypt mixos.viso --format luks -o mixos-secret.viso
+  mix viso encrypt mixos.viso --passphrase-file /run/secrets/viso`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoEncrypt,
+}
+
+func init() {
+	visoCmd.AddCommand(visoEncryptCmd)
+	visoEncryptCmd.Flags().String("format", "qcow2", "encrypted format: qcow2 or luks")
+	visoEncryptCmd.Flags().String("passphrase-file", "", "read the passphrase from a file")
+	visoEncryptCmd.Flags().StringP("output", "o", "", "VISO image to write (default: rewrite the image)")
+	visoEncryptCmd.Flags().Bool("force", false, "overwrite an existing output image")
+}
+
+// visoEncryption returns how an image is encrypted: "qcow2" for the
+// native encryption of a qcow2 image, "luks" for a LUKS image, or ""
+func visoEncryption(path string) string {
+	switch visoImageFormat(path) {
+	case "luks":
+		return "luks"
+	case "qcow2":
+		f, err := os.Open(path)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		// crypt_method of the qcow2 header: 0 for none, 1 AES, 2 LUKS
+		header := make([]byte, 36)
+		if _, err := io.ReadFull(f, header); err == nil && binary.BigEndian.Uint32(header[32:36]) != 0 {
+			return "qcow2"
+		}
+	}
+	return ""
+}
+
+// readVisoPassphrase reads the passphrase of an image from a file, or
+// asks for it on the terminal, twice when confirm is set
+func readVisoPassphrase(file string, confirm bool, image string) ([]byte, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pass := bytes.TrimRight(data, "\r\n")
+		if len(pass) == 0 {
+			return nil, fmt.Errorf("%s holds no passphrase", file)
+		}
+		return pass, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase on; give --passphrase-file")
+	}
+	fmt.Printf("Passphrase for %s: ", image)
+	pass, err := term.ReadPassword(fd)
+	fmt.Println("")
+	if err != nil {
+		return nil, err
+	}
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if confirm {
+		fmt.Print("Repeat the passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Println("")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pass, again) {
+			return nil, fmt.Errorf("the passphrases do not match")
+		}
+	}
+	return pass, nil
+}
+
+// writeVisoSecret writes a passphrase to a file of dir only the user can
+// read, for a QEMU secret object
+func writeVisoSecret(dir string, pass []byte) (string, error) {
+	path := filepath.Join(dir, "secret")
+	if err := os.WriteFile(path, pass, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// visoSecretObject returns the QEMU object reading the secret of an image
+// from a file
+func visoSecretObject(file string) string {
+	return fmt.Sprintf("secret,id=%s,file=%s", visoSecretID, file)
+}
+
+// visoKeySecretOption returns the option of an encrypted format naming the
+// secret that unlocks it
+func visoKeySecretOption(encryption string) string {
+	if encryption == "luks" {
+		return "key-secret=" + visoSecretID
+	}
+	return "encrypt.key-secret=" + visoSecretID
+}
+
+// openEncryptedVisoImage opens an encrypted image through a raw copy
+// decrypted with the passphrase in secret. The copy cannot be saved back.
+func openEncryptedVisoImage(path, secret string) (*visoImage, error) {
+	tools, err := visoTools("debugfs", "qemu-img")
+	if err != nil {
+		return nil, err
+	}
+	v := &visoImage{Path: path, debugfs: tools["debugfs"], encrypted: true}
+	if v.tmp, err = os.MkdirTemp("", "viso-"); err != nil {
+		return nil, err
+	}
+	v.raw = filepath.Join(v.tmp, "image.raw")
+	opts := fmt.Sprintf("driver=%s,file.filename=%s,%s", visoImageFormat(path), strings.ReplaceAll(path, ",", ",,"), visoKeySecretOption(visoEncryption(path)))
+	args := []string{"convert", "--object", visoSecretObject(secret), "--image-opts", opts, "-O", "raw", v.raw}
+	if out, err := exec.Command(tools["qemu-img"], args...).CombinedOutput(); err != nil {
+		v.Close()
+		return nil, fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+	}
+	return v, nil
+}
+
+func runVisoEncrypt(cmd *cobra.Command, args []string) error {
+	image := args[0]
+	format, _ := cmd.Flags().GetString("format")
+	passFile, _ := cmd.Flags().GetString("passphrase-file")
+	output, _ := cmd.Flags().GetString("output")
+	force, _ := cmd.Flags().GetBool("force")
+
+	info, err := os.Stat(image)
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("VISO file not found: %s", image)
+	}
+	if enc := visoEncryption(image); enc != "" {
+		return fmt.Errorf("%s is already encrypted (%s)", image, enc)
+	}
+	var desc, opts string
+	switch format {
+	case "qcow2":
+		desc, opts = "qcow2 with LUKS-encrypted clusters", "encrypt.format=luks,"+visoKeySecretOption("qcow2")
+	case "luks":
+		desc, opts = "LUKS1", visoKeySecretOption("luks")
+	default:
+		return fmt.Errorf("unknown format %q (use qcow2 or luks)", format)
+	}
+	if output == "" {
+		output = image
+	} else if err := checkVisoOutput(output, force); err != nil {
+		return err
+	}
+	if err := checkVisoUnused(image); err != nil {
+		return err
+	}
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return fmt.Errorf("qemu-img not found; install qemu-utils")
+	}
+	pass, err := readVisoPassphrase(passFile, true, image)
+	if err != nil {
+		return err
+	}
+	work, err := os.MkdirTemp("", "viso-encrypt-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+	secret, err := writeVisoSecret(work, pass)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Encrypting %s (%s)...\n", image, desc)
+	tmp := output + ".tmp"
+	convertArgs := []string{"convert", "--object", visoSecretObject(secret), "-f", visoImageFormat(image), "-O", format, "-o", opts, image, tmp}
+	if out, err := exec.Command(qemuImg, convertArgs...).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	after, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n✓ Encrypted %s (%s)\n", output, desc)
+	fmt.Printf("  Image: %s\n", formatSizeChange(info.Size(), after.Size()))
+	fmt.Printf("  Boot it with: mix viso boot %s --run\n", output)
+	fmt.Println("  Keep the passphrase safe: the image cannot be read without it")
+	return nil
+}
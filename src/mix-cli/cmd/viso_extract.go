@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Extract
+// ============================================================================
+//
+// "mix viso extract" copies files out of an image with neither root nor a
+// mount: the squashfs root is dumped out of the image filesystem with
+// debugfs, then unsquashfs extracts the files asked for from it. Paths
+// keep their place under the destination, so /etc/os-release lands in
+// <dest>/etc/os-release. --image reads the image filesystem itself (boot/,
+// config/) instead of the root, as does an image without a squashfs root.
+
+var visoExtractCmd = &cobra.Command{
+	Use:   "extract <viso-file> <path>... <dest>",
+	Short: "Extract files from a VISO image",
+	Long: `Extract files or whole trees from the root of a VISO image into a
+directory, without root or a mount. Each path keeps its place under the
+destination: /etc/os-release is written to <dest>/etc/os-release.
+
+--all extracts the whole root. --image reads the filesystem of the image
+instead of the root: the kernel, the initramfs, the metadata, the
+manifest and its signatures (boot/, config/).
+
+Files keep their owners only when run as root; device files are skipped
+otherwise. Requires debugfs (e2fsprogs) for images, and unsquashfs
+(squashfs-tools) for the root.
+
+Examples:
+  mix viso extract mixos.viso /etc/os-release ./out/
+  mix viso extract mixos.viso /etc/mixos /usr/share/mixos ./out/
+  mix viso extract mixos.viso --all ./rootfs/
+  mix viso extract mixos.viso --image config/viso.json ./out/`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: runVisoExtract,
+}
+
+func init() {
+	visoCmd.AddCommand(visoExtractCmd)
+	visoExtractCmd.Flags().Bool("all", false, "extract the whole root, or the whole image with --image")
+	visoExtractCmd.Flags().Bool("image", false, "read the image filesystem instead of the root")
+	visoExtractCmd.Flags().Bool("force", false, "overwrite existing files in the destination")
+}
+
+// cleanVisoPath turns a path of the image into one relative to its top;
+// "" is the top itself
+func cleanVisoPath(p string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if strings.HasPrefix(clean, "..") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return clean, nil
+}
+
+// extractVisoImageFiles copies files of the image filesystem to dest
+func extractVisoImageFiles(img *visoImage, rels []string, dest string) error {
+	for _, rel := range rels {
+		dir := filepath.Join(dest, filepath.Dir(rel))
+		if rel == "" {
+			// debugfs cannot dump / itself, so its entries go one by one
+			names, err := img.ReadDir("")
+			if err != nil {
+				return err
+			}
+			if err := extractVisoImageFiles(img, names, dest); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := img.Dump(rel, dir); err != nil {
+			return err
+		}
+		fmt.Printf("  %s\n", "/"+rel)
+	}
+	return nil
+}
+
+// extractVisoRootFiles extracts files of the squashfs root of the image
+// to dest
+func extractVisoRootFiles(img *visoImage, rels []string, dest string) error {
+	unsquashfs, err := exec.LookPath("unsquashfs")
+	if err != nil {
+		return fmt.Errorf("unsquashfs not found; install squashfs-tools")
+	}
+	tmp, err := os.MkdirTemp("", "viso-extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	squashfs, err := img.RootSquashfs(tmp)
+	if err != nil {
+		return err
+	}
+
+	// The paths were checked not to exist, and dest may: -f
+	args := []string{"-no-progress", "-f", "-d", dest, squashfs}
+	for _, rel := range rels {
+		if rel != "" {
+			args = append(args, "/"+rel)
+		}
+	}
+	c := exec.Command(unsquashfs, args...)
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("unsquashfs failed: %w", err)
+	}
+	for _, rel := range rels {
+		if _, err := os.Lstat(filepath.Join(dest, rel)); err != nil {
+			return fmt.Errorf("/%s: not found in the root of %s", rel, img.Path)
+		}
+	}
+	return nil
+}
+
+func runVisoExtract(cmd *cobra.Command, args []string) error {
+	all, _ := cmd.Flags().GetBool("all")
+	fromImage, _ := cmd.Flags().GetBool("image")
+	force, _ := cmd.Flags().GetBool("force")
+
+	image, dest := args[0], args[len(args)-1]
+	paths := args[1 : len(args)-1]
+	if all && len(paths) > 0 {
+		return fmt.Errorf("--all takes no paths")
+	}
+	if !all && len(paths) == 0 {
+		return fmt.Errorf("give the paths to extract, or --all")
+	}
+	var rels []string
+	for _, p := range paths {
+		rel, err := cleanVisoPath(p)
+		if err != nil {
+			return err
+		}
+		rels = append(rels, rel)
+	}
+	if all {
+		rels = []string{""}
+	}
+	if !force {
+		for _, rel := range rels {
+			if _, err := os.Lstat(filepath.Join(dest, rel)); err == nil && rel != "" {
+				return fmt.Errorf("%s already exists (use --force to overwrite)", filepath.Join(dest, rel))
+			}
+		}
+	}
+
+	img, err := openVisoImage(image)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if !fromImage && !img.Exists(visoRootfsPath) {
+		fmt.Printf("%s has no squashfs root, reading the image filesystem\n", image)
+		fromImage = true
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	if fromImage {
+		fmt.Printf("Extracting from the filesystem of %s:\n", image)
+		err = extractVisoImageFiles(img, rels, dest)
+	} else {
+		fmt.Printf("Extracting from the root of %s:\n", image)
+		err = extractVisoRootFiles(img, rels, dest)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n✓ Extracted to %s\n", dest)
+	return nil
+}
@@ -0,0 +1,659 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Fsck
+// ============================================================================
+//
+// "mix viso fsck" checks an image layer by layer, from the outside in:
+// the qcow2 container (qemu-img check), the ext4 filesystem (e2fsck), the
+// squashfs root (its superblock, and its directory tables through
+// unsquashfs), the metadata (config/viso.json against the files and the
+// root, and the header copy of it) and the checksums of the manifest.
+//
+// With --repair it fixes what can be fixed without the original files:
+// leaked and corrupted qcow2 clusters, ext4 errors, metadata that
+// disagrees with the image, a stale header and a missing manifest. A
+// damaged kernel, initramfs or root cannot be rebuilt from the image; the
+// checksums tell which, and the image has to be restored or recreated.
+// Rewriting the metadata or the manifest voids the signatures of the
+// image, as "mix viso recompress" does.
+
+// Exit codes of "mix viso fsck", as those of e2fsck
+const (
+	visoFsckRepaired    = 1 // problems were found, and all repaired
+	visoFsckUncorrected = 4 // problems are left
+	visoFsckError       = 8 // the image could not be checked
+)
+
+var visoFsckCmd = &cobra.Command{
+	Use:   "fsck <viso-file>",
+	Short: "Check the consistency of a VISO image, and repair it",
+	Long: `Check a VISO image from the outside in: the qcow2 structure of the
+image (with qemu-img check), its ext4 filesystem (with e2fsck), the
+squashfs root, the metadata in config/viso.json and the image header,
+and the checksums of the manifest.
+
+Nothing is written unless --repair is given. --repair frees leaked qcow2
+clusters, rebuilds corrupted ones, fixes the filesystem, sets the
+metadata right where it disagrees with the image (root compression,
+VRAM requirement, paths), rewrites the header and records a missing
+manifest. Files whose checksum does not match cannot be repaired:
+restore the image from a good copy, or rebuild it with "mix viso create".
+Repairs that rewrite the metadata void the signatures of the image.
+
+The image must not be in use; --repair also refuses images mounted
+read-only.
+
+Exit codes:
+  0  the image is consistent
+  1  problems were found, and all repaired
+  4  problems are left
+  8  the image could not be checked
+
+Requires e2fsprogs, and qemu-img for qcow2 images; unsquashfs, when
+installed, reads the directory tables of the root.
+
+Examples:
+  mix viso fsck mixos.viso
+  mix viso fsck mixos.viso --repair`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoFsck,
+}
+
+func init() {
+	visoCmd.AddCommand(visoFsckCmd)
+	visoFsckCmd.Flags().Bool("repair", false, "repair the problems that can be repaired")
+}
+
+// visoFsck tallies the problems "mix viso fsck" finds, and repairs them
+// when asked to
+type visoFsck struct {
+	repair   bool
+	problems int
+	repaired int
+}
+
+func (f *visoFsck) ok(format string, args ...any) {
+	fmt.Printf("  \033[32m✓\033[0m %s\n", fmt.Sprintf(format, args...))
+}
+
+func (f *visoFsck) fail(format string, args ...any) {
+	f.problems++
+	fmt.Printf("  \033[31m✗\033[0m %s\n", fmt.Sprintf(format, args...))
+}
+
+// fixable reports a problem --repair fixes, and fixes it when repairing
+func (f *visoFsck) fixable(problem string, fix func() error) {
+	if !f.repair {
+		f.fail("%s (--repair fixes it)", problem)
+		return
+	}
+	if err := fix(); err != nil {
+		f.fail("%s: repair failed: %v", problem, err)
+		return
+	}
+	f.problems++
+	f.repaired++
+	fmt.Printf("  \033[32m✓\033[0m %s: repaired\n", problem)
+}
+
+// qemuImgCheck is the result of "qemu-img check --output=json"
+type qemuImgCheck struct {
+	CheckErrors      int `json:"check-errors"`
+	Corruptions      int `json:"corruptions"`
+	Leaks            int `json:"leaks"`
+	CorruptionsFixed int `json:"corruptions-fixed"`
+	LeaksFixed       int `json:"leaks-fixed"`
+}
+
+// parseQemuImgCheck reads the output of "qemu-img check --output=json",
+// which reports what is left after a repair and what the repair fixed
+func parseQemuImgCheck(out []byte) (*qemuImgCheck, error) {
+	var c qemuImgCheck
+	if err := json.Unmarshal(out, &c); err != nil {
+		return nil, fmt.Errorf("unexpected qemu-img check output: %w", err)
+	}
+	return &c, nil
+}
+
+// checkVisoContainer checks the qcow2 structure of an image with
+// qemu-img check, repairing it when asked to
+func checkVisoContainer(f *visoFsck, image, qemuImg string) error {
+	args := []string{"check", "--output=json", "-f", "qcow2"}
+	if f.repair {
+		args = append(args, "-r", "all")
+	} else {
+		args = append(args, "-U")
+	}
+	var stderr bytes.Buffer
+	c := exec.Command(qemuImg, append(args, image)...)
+	c.Stderr = &stderr
+	// qemu-img check exits 2 on corruptions and 3 on leaks; the output
+	// tells more
+	out, err := c.Output()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return err
+	}
+	result, perr := parseQemuImgCheck(out)
+	if perr != nil {
+		if err != nil {
+			return fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(stderr.String()))
+		}
+		return perr
+	}
+
+	clean := true
+	report := func(n, fixed int, what string) {
+		if fixed > 0 {
+			f.problems++
+			f.repaired++
+			fmt.Printf("  \033[32m✓\033[0m %d %s qcow2 cluster(s): repaired\n", fixed, what)
+			clean = false
+		}
+		if n > 0 {
+			f.fixable(fmt.Sprintf("%d %s qcow2 cluster(s)", n, what), func() error {
+				return fmt.Errorf("qemu-img could not repair them")
+			})
+			clean = false
+		}
+	}
+	report(result.Corruptions, result.CorruptionsFixed, "corrupted")
+	report(result.Leaks, result.LeaksFixed, "leaked")
+	if result.CheckErrors > 0 {
+		f.fail("qemu-img could not check the image: %d error(s)", result.CheckErrors)
+		clean = false
+	}
+	if clean {
+		f.ok("qcow2 structure")
+	}
+	return nil
+}
+
+// checkVisoFilesystem checks the ext4 filesystem of a raw image with
+// e2fsck, repairing it when asked to; it returns whether it was changed
+func checkVisoFilesystem(f *visoFsck, raw, e2fsck string) (bool, error) {
+	mode := "-n"
+	if f.repair {
+		mode = "-y"
+	}
+	out, err := exec.Command(e2fsck, "-f", mode, raw).CombinedOutput()
+	code := 0
+	if exit, ok := err.(*exec.ExitError); ok {
+		code = exit.ExitCode()
+	} else if err != nil {
+		return false, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	summary := strings.TrimSpace(lines[len(lines)-1])
+
+	switch {
+	case code >= 8:
+		return false, fmt.Errorf("e2fsck failed: %s", summary)
+	case code&4 != 0:
+		f.fail("ext4 filesystem has errors")
+		// the first problems e2fsck reports
+		shown := 0
+		for _, line := range lines {
+			if line = strings.TrimSpace(line); line == "" || line == summary || strings.HasPrefix(line, "e2fsck ") ||
+				strings.HasPrefix(line, "Pass ") || strings.HasPrefix(line, "Fix? ") {
+				continue
+			}
+			if shown == 5 {
+				fmt.Println("      ...")
+				break
+			}
+			fmt.Printf("      %s\n", line)
+			shown++
+		}
+		return false, nil
+	case code&3 != 0:
+		f.problems++
+		f.repaired++
+		fmt.Printf("  \033[32m✓\033[0m ext4 filesystem errors: repaired (%s)\n", summary)
+		return true, nil
+	}
+	f.ok("ext4 filesystem (%s)", summary)
+	return false, nil
+}
+
+// checkVisoRoot checks the squashfs root of an image: its superblock,
+// that it is whole, and its directory tables when unsquashfs is
+// installed. It returns the compression and size of the root, or "" when
+// the root is unusable.
+func checkVisoRoot(f *visoFsck, img *visoImage, work string) (string, int64) {
+	if !img.Exists(visoRootfsPath) {
+		f.fail("%s missing", visoRootfsPath)
+		return "", 0
+	}
+	squashfs, err := img.RootSquashfs(work)
+	if err != nil {
+		f.fail("%s unreadable: %v", visoRootfsPath, err)
+		return "", 0
+	}
+	if !img.dir {
+		defer os.Remove(squashfs)
+	}
+	file, err := os.Open(squashfs)
+	if err != nil {
+		f.fail("%s unreadable: %v", visoRootfsPath, err)
+		return "", 0
+	}
+	sb := make([]byte, 96)
+	_, err = io.ReadFull(file, sb)
+	stat, serr := file.Stat()
+	file.Close()
+	if serr != nil {
+		f.fail("%s unreadable: %v", visoRootfsPath, serr)
+		return "", 0
+	}
+	info, perr := parseSquashfsSuperblock(sb)
+	if err != nil || perr != nil {
+		f.fail("%s is not a squashfs", visoRootfsPath)
+		return "", 0
+	}
+	if info.Bytes > stat.Size() {
+		f.fail("%s is truncated: %s of %s", visoRootfsPath, formatSize(stat.Size()), formatSize(info.Bytes))
+		return "", 0
+	}
+
+	if unsquashfs, err := exec.LookPath("unsquashfs"); err == nil {
+		var stderr bytes.Buffer
+		c := exec.Command(unsquashfs, "-no-progress", "-l", squashfs)
+		c.Stdout = io.Discard
+		c.Stderr = &stderr
+		if err := c.Run(); err != nil {
+			f.fail("%s is damaged: %s", visoRootfsPath, strings.TrimSpace(stderr.String()))
+			return "", 0
+		}
+	} else {
+		fmt.Println("  unsquashfs not found; the directory tables of the root were not read")
+	}
+	f.ok("%s (squashfs, %s, %s)", visoRootfsPath, info.Compression, formatSize(stat.Size()))
+	return info.Compression, stat.Size()
+}
+
+// visoMetadataFix is a field of the metadata that disagrees with the
+// image, and how to set it right
+type visoMetadataFix struct {
+	Problem string
+	Apply   func(m *VisoMetadata)
+}
+
+// checkVisoMetadataFields compares metadata with the image it describes:
+// has tells whether the image holds a file, compression and rootBytes
+// describe its root ("" and 0 when it is unusable)
+func checkVisoMetadataFields(m *VisoMetadata, has func(rel string) bool, compression string, rootBytes int64) []visoMetadataFix {
+	var fixes []visoMetadataFix
+	if m.Format != "VISO" {
+		fixes = append(fixes, visoMetadataFix{fmt.Sprintf("format is %q, not \"VISO\"", m.Format),
+			func(m *VisoMetadata) { m.Format = "VISO" }})
+	}
+	paths := []struct {
+		field, want string
+		value       *string
+	}{
+		{"boot.kernel", visoKernelPath, &m.Boot.Kernel},
+		{"boot.initramfs", visoInitramfsPath, &m.Boot.Initramfs},
+		{"rootfs.path", visoRootfsPath, &m.Rootfs.Path},
+	}
+	for _, p := range paths {
+		if has(strings.TrimPrefix(*p.value, "/")) || !has(p.want) {
+			continue
+		}
+		field, want := p.field, p.want
+		fixes = append(fixes, visoMetadataFix{fmt.Sprintf("%s is %q, which the image does not hold", field, *p.value),
+			func(m *VisoMetadata) {
+				switch field {
+				case "boot.kernel":
+					m.Boot.Kernel = want
+				case "boot.initramfs":
+					m.Boot.Initramfs = want
+				default:
+					m.Rootfs.Path = want
+				}
+			}})
+	}
+	if compression == "" {
+		return fixes
+	}
+	if m.Rootfs.Format != "squashfs" {
+		fixes = append(fixes, visoMetadataFix{fmt.Sprintf("rootfs.format is %q, the root is a squashfs", m.Rootfs.Format),
+			func(m *VisoMetadata) { m.Rootfs.Format = "squashfs" }})
+	}
+	if m.Rootfs.Compression != compression {
+		fixes = append(fixes, visoMetadataFix{fmt.Sprintf("rootfs.compression is %q, the root is %s", m.Rootfs.Compression, compression),
+			func(m *VisoMetadata) { m.Rootfs.Compression = compression }})
+	}
+	// As newVisoMetadata: a lower requirement lets VRAM boots run out of
+	// memory, a higher one is the author's choice
+	need := max(visoVramMinRamMB, int(rootBytes>>20)*2+visoVramOverhead)
+	if rootBytes > 0 && m.Requirements.VramMinRamMB < need {
+		fixes = append(fixes, visoMetadataFix{fmt.Sprintf("requirements.vram_min_ram_mb is %d, the root needs %d", m.Requirements.VramMinRamMB, need),
+			func(m *VisoMetadata) { m.Requirements.VramMinRamMB = need }})
+	}
+	return fixes
+}
+
+// setVisoManifestEntry returns a manifest with the checksum of rel set to
+// hash, replacing its line or adding one
+func setVisoManifestEntry(manifest []byte, rel, hash string) []byte {
+	var buf bytes.Buffer
+	found := false
+	for _, line := range strings.SplitAfter(string(manifest), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == rel {
+			line = fmt.Sprintf("%s  %s\n", hash, rel)
+			found = true
+		}
+		buf.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			buf.WriteByte('\n')
+		}
+	}
+	if !found {
+		fmt.Fprintf(&buf, "%s  %s\n", hash, rel)
+	}
+	return buf.Bytes()
+}
+
+// hashVisoImageFile returns the SHA-256 of a file of an image
+func hashVisoImageFile(img *visoImage, rel string) (string, error) {
+	r, err := img.Open(rel)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeVisoFsckMetadata writes repaired metadata to config/viso.json and
+// the header of an image, and its checksum to the manifest
+func writeVisoFsckMetadata(img *visoImage, m *VisoMetadata) error {
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := img.WriteFile(visoMetadataPath, data); err != nil {
+		return err
+	}
+	if manifest, err := img.ReadFile(visoManifestPath); err == nil {
+		sum := sha256.Sum256(data)
+		if err := img.WriteFile(visoManifestPath, setVisoManifestEntry(manifest, visoMetadataPath, hex.EncodeToString(sum[:]))); err != nil {
+			return err
+		}
+	}
+	if img.dir {
+		return nil
+	}
+	return writeVisoFsckHeader(img, m)
+}
+
+// writeVisoFsckHeader rewrites the header of an image from its metadata
+func writeVisoFsckHeader(img *visoImage, m *VisoMetadata) error {
+	if err := writeVisoHeader(img.raw, m); err != nil {
+		return err
+	}
+	img.dirty = true
+	return nil
+}
+
+// checkVisoMetadata checks config/viso.json and the header of an image
+// against each other and against the image
+func checkVisoMetadata(f *visoFsck, img *visoImage, compression string, rootBytes int64) {
+	var header *VisoMetadata
+	if !img.dir {
+		if file, err := os.Open(img.raw); err == nil {
+			buf := make([]byte, visoHeaderSize)
+			if _, err := io.ReadFull(file, buf); err == nil {
+				header, _ = parseVisoHeader(buf)
+			}
+			file.Close()
+		}
+	}
+
+	repaired := f.repaired
+	var m *VisoMetadata
+	data, err := img.ReadFile(visoMetadataPath)
+	if err == nil {
+		m = &VisoMetadata{}
+		if jerr := json.Unmarshal(data, m); jerr != nil {
+			m, err = nil, fmt.Errorf("invalid JSON")
+		}
+	} else {
+		err = fmt.Errorf("missing")
+	}
+	if m == nil {
+		if header == nil {
+			f.fail("%s %v, and the image has no header to restore it from", visoMetadataPath, err)
+			return
+		}
+		m = header
+		f.fixable(fmt.Sprintf("%s %v", visoMetadataPath, err), func() error {
+			return writeVisoFsckMetadata(img, m)
+		})
+	}
+
+	if _, err := normalizeVisoArch(m.Requirements.Arch); err != nil {
+		f.fail("requirements.arch: %v", err)
+	}
+	fixes := checkVisoMetadataFields(m, img.Exists, compression, rootBytes)
+	for _, fix := range fixes {
+		f.fixable(visoMetadataPath+": "+fix.Problem, func() error {
+			fixed := *m
+			fix.Apply(&fixed)
+			if err := writeVisoFsckMetadata(img, &fixed); err != nil {
+				return err
+			}
+			*m = fixed
+			return nil
+		})
+	}
+	if len(fixes) == 0 {
+		f.ok("%s (%s %s, %s)", visoMetadataPath, m.Name, m.Version, m.Requirements.Arch)
+	}
+	if img.dir {
+		return
+	}
+
+	want, _ := json.Marshal(m)
+	got := []byte(nil)
+	if header != nil {
+		got, _ = json.Marshal(header)
+	}
+	switch {
+	case f.repaired > repaired:
+		// rewritten with the metadata
+	case header == nil:
+		f.fixable("image header missing", func() error { return writeVisoFsckHeader(img, m) })
+	case !bytes.Equal(want, got):
+		f.fixable("image header differs from "+visoMetadataPath, func() error { return writeVisoFsckHeader(img, m) })
+	default:
+		f.ok("image header")
+	}
+}
+
+// checkVisoContents checks the files of an image against its manifest,
+// recording a missing manifest when repairing; it returns whether the
+// manifest was rewritten
+func checkVisoContents(f *visoFsck, img *visoImage) bool {
+	manifest, err := img.ReadFile(visoManifestPath)
+	if err == nil {
+		failed, err := checkVisoManifest(img, manifest)
+		if err != nil {
+			f.fail("invalid manifest: %v", err)
+			return false
+		}
+		f.problems += failed
+		if failed > 0 {
+			fmt.Println("  Damaged files cannot be repaired: restore the image from a good copy,")
+			fmt.Println("  or rebuild it with \"mix viso create\"")
+		}
+		return false
+	}
+
+	rewritten := false
+	f.fixable(visoManifestPath+" missing", func() error {
+		var buf bytes.Buffer
+		for _, rel := range visoManifestFiles {
+			if !img.Exists(rel) {
+				continue
+			}
+			hash, err := hashVisoImageFile(img, rel)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&buf, "%s  %s\n", hash, rel)
+		}
+		rewritten = true
+		return img.WriteFile(visoManifestPath, buf.Bytes())
+	})
+	return rewritten
+}
+
+// fsckVisoImage checks an image, and repairs it when asked to
+func fsckVisoImage(image string, repair bool) (*visoFsck, error) {
+	info, err := os.Stat(image)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("VISO file not found: %s", image)
+	}
+	if enc := visoEncryption(image); enc != "" {
+		return nil, fmt.Errorf("%s is encrypted (%s); its contents cannot be checked", image, enc)
+	}
+	if err := checkVisoUnused(image); err != nil {
+		return nil, err
+	}
+	if repair {
+		abs, err := filepath.Abs(image)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range loadVisoMounts() {
+			if m.Image == abs {
+				return nil, fmt.Errorf("%s is mounted on %s; unmount it before repairing it", image, m.Mountpoint)
+			}
+		}
+	}
+	tools, err := visoTools("e2fsck")
+	if err != nil {
+		return nil, err
+	}
+	f := &visoFsck{repair: repair}
+
+	fmt.Printf("Checking %s\n\nImage:\n", image)
+	format := visoImageFormat(image)
+	if format == "qcow2" {
+		qemuImg, err := exec.LookPath("qemu-img")
+		if err != nil {
+			return nil, fmt.Errorf("qemu-img not found; install qemu-utils to check qcow2 images")
+		}
+		if err := checkVisoContainer(f, image, qemuImg); err != nil {
+			return nil, err
+		}
+	} else {
+		fmt.Println("  raw image (no container to check)")
+	}
+
+	img, err := openVisoImage(image)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	fmt.Println("\nFilesystem:")
+	sb, err := readVisoSuperblock(img.raw)
+	if err != nil {
+		f.fail("no ext4 filesystem: %v", err)
+		return f, nil
+	}
+	if size, err := visoDiskSize(image); err == nil && sb.Bytes > size {
+		f.fail("the filesystem (%s) is larger than the disk (%s): the image is truncated", formatSize(sb.Bytes), formatSize(size))
+	}
+	changed, err := checkVisoFilesystem(f, img.raw, tools["e2fsck"])
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		img.dirty = true
+	}
+
+	work, err := os.MkdirTemp("", "viso-fsck-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(work)
+	fmt.Println("\nRoot:")
+	compression, rootBytes := checkVisoRoot(f, img, work)
+
+	fmt.Println("\nMetadata:")
+	repaired := f.repaired
+	checkVisoMetadata(f, img, compression, rootBytes)
+	metadataRewritten := f.repaired > repaired
+
+	fmt.Println("\nContents:")
+	manifestRewritten := checkVisoContents(f, img)
+
+	if err := img.Save(); err != nil {
+		return nil, err
+	}
+	if metadataRewritten || manifestRewritten {
+		var signed []string
+		for _, ext := range []string{".sig", ".asc", ".minisig"} {
+			kind := visoSignatureKind(ext)
+			if img.Exists(visoManifestPath+ext) && (len(signed) == 0 || signed[len(signed)-1] != kind) {
+				signed = append(signed, kind)
+			}
+		}
+		if len(signed) > 0 {
+			fmt.Printf("\n\033[33mNote:\033[0m the %s signature of the image no longer applies;\n", strings.Join(signed, " and "))
+			fmt.Printf("      sign it again with: mix viso sign %s --key <key>\n", image)
+		}
+	}
+	return f, nil
+}
+
+func runVisoFsck(cmd *cobra.Command, args []string) error {
+	repair, _ := cmd.Flags().GetBool("repair")
+
+	f, err := fsckVisoImage(args[0], repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(visoFsckError)
+	}
+	fmt.Println("")
+	switch {
+	case f.problems == 0:
+		fmt.Println("\033[32m✓ CLEAN\033[0m")
+	case f.repaired == f.problems:
+		fmt.Printf("\033[32m✓ REPAIRED\033[0m: %d problem(s) repaired\n", f.repaired)
+		os.Exit(visoFsckRepaired)
+	default:
+		fmt.Printf("\033[31m✗ FAILED\033[0m: %d problem(s) found, %d repaired\n", f.problems, f.repaired)
+		os.Exit(visoFsckUncorrected)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ============================================================================
+// VISO Image Access
+// ============================================================================
+//
+// A VISO image is an ext4 filesystem, usually in a qcow2 image. Its files
+// are read with debugfs, which needs neither root nor a loop device; a
+// qcow2 image is first converted to a sparse raw copy with qemu-img. A
+// directory holding the same layout (an unpacked or mounted image) is
+// read directly.
+//
+// Files are written with debugfs -w too; the raw copy of a qcow2 image is
+// then converted back over the image by Save.
+
+var visoQcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// visoImage gives access to the files of a VISO image
+type visoImage struct {
+	Path      string // image or directory
+	dir       bool
+	raw       string // ext4 filesystem debugfs reads
+	tmp       string // removed on Close
+	debugfs   string
+	qemuImg   string // set for qcow2 images
+	dirty     bool   // the raw copy was written to
+	encrypted bool   // the raw copy was decrypted, and cannot be saved
+}
+
+// openVisoImage opens an image, a .viso file or a directory
+func openVisoImage(path string) (*visoImage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("VISO file not found: %s", path)
+	}
+	if info.IsDir() {
+		return &visoImage{Path: path, dir: true}, nil
+	}
+	debugfs, err := exec.LookPath("debugfs")
+	if err != nil {
+		return nil, fmt.Errorf("debugfs not found; install e2fsprogs")
+	}
+	if enc := visoEncryption(path); enc != "" {
+		return nil, fmt.Errorf("%s is encrypted (%s); boot it with \"mix viso boot %s --run\"", path, enc, path)
+	}
+	v := &visoImage{Path: path, raw: path, debugfs: debugfs}
+
+	head := make([]byte, len(visoQcow2Magic))
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(f, head)
+	f.Close()
+	if err != nil || !bytes.Equal(head, visoQcow2Magic) {
+		return v, nil
+	}
+
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img not found; install qemu-utils to read qcow2 images")
+	}
+	if v.tmp, err = os.MkdirTemp("", "viso-"); err != nil {
+		return nil, err
+	}
+	v.raw = filepath.Join(v.tmp, "image.raw")
+	v.qemuImg = qemuImg
+	if out, err := exec.Command(qemuImg, "convert", "-f", "qcow2", "-O", "raw", path, v.raw).CombinedOutput(); err != nil {
+		v.Close()
+		return nil, fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+	}
+	return v, nil
+}
+
+// Close removes the raw copy of a qcow2 image
+func (v *visoImage) Close() {
+	if v.tmp != "" {
+		os.RemoveAll(v.tmp)
+	}
+}
+
+// Exists reports whether the image holds the file rel
+func (v *visoImage) Exists(rel string) bool {
+	if v.dir {
+		info, err := os.Stat(filepath.Join(v.Path, rel))
+		return err == nil && info.Mode().IsRegular()
+	}
+	out, err := exec.Command(v.debugfs, "-R", "stat /"+rel, v.raw).Output()
+	return err == nil && bytes.Contains(out, []byte("Type: regular"))
+}
+
+// Open streams the file rel of the image
+func (v *visoImage) Open(rel string) (io.ReadCloser, error) {
+	if v.dir {
+		return os.Open(filepath.Join(v.Path, rel))
+	}
+	if !v.Exists(rel) {
+		return nil, fmt.Errorf("%s: %w", rel, os.ErrNotExist)
+	}
+	cmd := exec.Command(v.debugfs, "-R", "cat /"+rel, v.raw)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &visoImageFile{ReadCloser: out, cmd: cmd}, nil
+}
+
+// ReadFile returns the contents of the file rel of the image
+func (v *visoImage) ReadFile(rel string) ([]byte, error) {
+	f, err := v.Open(rel)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return data, err
+}
+
+// visoImageFile is a file streamed out of an image by debugfs
+type visoImageFile struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (f *visoImageFile) Close() error {
+	io.Copy(io.Discard, f.ReadCloser)
+	return f.cmd.Wait()
+}
+
+// WriteFile replaces the file rel of the image, or adds it; its directory
+// must exist
+func (v *visoImage) WriteFile(rel string, data []byte) error {
+	if v.dir {
+		return os.WriteFile(filepath.Join(v.Path, rel), data, 0644)
+	}
+	src, err := os.CreateTemp("", "viso-file-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src.Name())
+	_, err = src.Write(data)
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(src.Name(), 0644)
+
+	// debugfs writes into its current directory; rm fails harmlessly on a
+	// new file
+	script := fmt.Sprintf("cd /%s\nrm %s\nwrite %s %s\n", filepath.Dir(rel), filepath.Base(rel), src.Name(), filepath.Base(rel))
+	c := exec.Command(v.debugfs, "-w", "-f", "-", v.raw)
+	c.Stdin = strings.NewReader(script)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("debugfs failed: %s", strings.TrimSpace(string(out)))
+	}
+	if !v.Exists(rel) {
+		return fmt.Errorf("failed to write %s into %s", rel, v.Path)
+	}
+	v.dirty = true
+	return nil
+}
+
+// Save writes the changes to the raw copy of a qcow2 image back over the
+// image
+func (v *visoImage) Save() error {
+	if v.dirty && v.encrypted {
+		return fmt.Errorf("%s is encrypted and cannot be written to", v.Path)
+	}
+	if !v.dirty || v.qemuImg == "" {
+		return nil
+	}
+	tmp := v.Path + ".tmp"
+	if out, err := exec.Command(v.qemuImg, "convert", "-f", "raw", "-O", "qcow2", "-c", v.raw, tmp).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(tmp, v.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	v.dirty = false
+	return nil
+}
+
+// Dump copies the file or tree rel of the image into dir, under its own
+// name
+func (v *visoImage) Dump(rel, dir string) error {
+	if v.dir {
+		if out, err := exec.Command("cp", "-a", filepath.Join(v.Path, rel), dir).CombinedOutput(); err != nil {
+			return fmt.Errorf("cp failed: %s", strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	out, err := exec.Command(v.debugfs, "-R", fmt.Sprintf("rdump \"/%s\" \"%s\"", rel, dir), v.raw).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("debugfs failed: %s", strings.TrimSpace(string(out)))
+	}
+	// debugfs reports a missing file but still succeeds
+	if _, err := os.Lstat(filepath.Join(dir, filepath.Base(rel))); err != nil {
+		return fmt.Errorf("%s: not found in %s", rel, v.Path)
+	}
+	return nil
+}
+
+// ReadDir returns the names in the directory rel of the image, but for
+// lost+found
+func (v *visoImage) ReadDir(rel string) ([]string, error) {
+	if v.dir {
+		des, err := os.ReadDir(filepath.Join(v.Path, rel))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, de := range des {
+			if de.Name() != "lost+found" {
+				names = append(names, filepath.ToSlash(filepath.Join(rel, de.Name())))
+			}
+		}
+		return names, nil
+	}
+	out, err := exec.Command(v.debugfs, "-R", fmt.Sprintf("ls -p \"/%s\"", rel), v.raw).Output()
+	if err != nil {
+		return nil, fmt.Errorf("debugfs failed to read /%s", rel)
+	}
+	var names []string
+	for _, name := range parseDebugfsLs(string(out)) {
+		names = append(names, strings.TrimPrefix(rel+"/"+name, "/"))
+	}
+	return names, nil
+}
+
+// parseDebugfsLs reads the names of debugfs "ls -p" output, lines of
+// /inode/mode/uid/gid/name/size/, but for ., .. and lost+found
+func parseDebugfsLs(out string) []string {
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "/")
+		if len(fields) < 7 {
+			continue
+		}
+		switch name := fields[5]; name {
+		case ".", "..", "lost+found", "":
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// RootSquashfs returns the path of the squashfs root of the image,
+// dumped into dir unless the image is a directory
+func (v *visoImage) RootSquashfs(dir string) (string, error) {
+	if v.dir {
+		return filepath.Join(v.Path, visoRootfsPath), nil
+	}
+	if err := v.Dump(visoRootfsPath, dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(visoRootfsPath)), nil
+}
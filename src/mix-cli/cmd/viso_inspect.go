@@ -0,0 +1,608 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Inspect
+// ============================================================================
+//
+// "mix viso inspect" looks into an image where "mix viso info" only reads
+// its metadata: the partition table and the filesystems of the disk, the
+// version of the kernel from its bzImage header, what the initramfs holds
+// from its cpio archives, and, from files of the root extracted with
+// unsquashfs, the release and the number of installed packages.
+
+// visoRootInspectFiles are the files of the root inspect reads
+var visoRootInspectFiles = []string{"etc/os-release", visoPackagesDB, "etc/mixos/vram.conf", "etc/mixos/vram-hotset"}
+
+// visoInspection is the report of "mix viso inspect"
+type visoInspection struct {
+	Image        string          `json:"image"`
+	Format       string          `json:"format"`
+	FileBytes    int64           `json:"file_bytes"`
+	VirtualBytes int64           `json:"virtual_bytes"`
+	Partitions   []visoPartition `json:"partitions,omitempty"` // none: the filesystem fills the disk
+	Filesystem   *extSuperblock  `json:"filesystem,omitempty"`
+	Metadata     *VisoMetadata   `json:"metadata,omitempty"`
+	Kernel       string          `json:"kernel,omitempty"`
+	Initramfs    *cpioSummary    `json:"initramfs,omitempty"`
+	Rootfs       *squashfsInfo   `json:"rootfs,omitempty"`
+	Release      string          `json:"release,omitempty"`
+	Packages     int             `json:"packages"` // -1 when unknown
+	Features     []string        `json:"features"`
+	Notes        []string        `json:"notes,omitempty"`
+}
+
+// extSuperblock is what inspect reports of an ext2/3/4 filesystem
+type extSuperblock struct {
+	Type       string `json:"type"`
+	Label      string `json:"label"`
+	BlockSize  int64  `json:"block_size"`
+	Bytes      int64  `json:"bytes"`
+	FreeBytes  int64  `json:"free_bytes"`
+	InodeCount uint32 `json:"inodes"`
+}
+
+// squashfsInfo is what inspect reports of a squashfs
+type squashfsInfo struct {
+	Compression string    `json:"compression"`
+	BlockSize   uint32    `json:"block_size"`
+	Inodes      uint32    `json:"inodes"`
+	Bytes       int64     `json:"bytes"`
+	Created     time.Time `json:"created"`
+}
+
+// cpioSummary counts what an initramfs holds
+type cpioSummary struct {
+	Compression string `json:"compression"`
+	Archives    int    `json:"archives"` // early microcode comes first
+	Files       int    `json:"files"`
+	Dirs        int    `json:"dirs"`
+	Symlinks    int    `json:"symlinks"`
+	Bytes       int64  `json:"bytes"`
+	Modules     int    `json:"modules"`
+	HasInit     bool   `json:"has_init"`
+	MixOSInit   bool   `json:"mixos_init"` // the init knows SDISK
+}
+
+var visoInspectCmd = &cobra.Command{
+	Use:   "inspect <viso-file>",
+	Short: "Look into a VISO image",
+	Long: `Report what a VISO image holds: the partition table and filesystem of
+the disk, the metadata, the kernel version, a summary of the initramfs
+(files, kernel modules, whether its init boots VISO images), the root
+squashfs, the release and the number of installed packages, and the
+features the image has (signatures, manifest, VRAM configuration).
+
+Requires debugfs (e2fsprogs), qemu-img for qcow2 images, and unsquashfs
+(squashfs-tools) for the release and packages of the root.
+
+Examples:
+  mix viso inspect mixos.viso
+  mix viso inspect mixos.viso --json`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoInspect,
+}
+
+func init() {
+	visoCmd.AddCommand(visoInspectCmd)
+	visoInspectCmd.Flags().Bool("json", false, "print the report as JSON")
+}
+
+// parseExtSuperblock reads the superblock of an ext2/3/4 filesystem, the
+// 1024 bytes at offset 1024
+func parseExtSuperblock(sb []byte) (*extSuperblock, error) {
+	if len(sb) < 1024 || binary.LittleEndian.Uint16(sb[56:]) != 0xef53 {
+		return nil, fmt.Errorf("not an ext2/3/4 filesystem")
+	}
+	le := binary.LittleEndian
+	s := &extSuperblock{
+		InodeCount: le.Uint32(sb[0:]),
+		BlockSize:  1024 << le.Uint32(sb[24:]),
+		Label:      string(bytes.TrimRight(sb[120:136], "\x00")),
+	}
+	blocks := int64(le.Uint32(sb[4:]))
+	free := int64(le.Uint32(sb[12:]))
+	compat, incompat := le.Uint32(sb[92:]), le.Uint32(sb[96:])
+	if incompat&0x80 != 0 { // 64bit
+		blocks |= int64(le.Uint32(sb[336:])) << 32
+		free |= int64(le.Uint32(sb[344:])) << 32
+	}
+	s.Bytes, s.FreeBytes = blocks*s.BlockSize, free*s.BlockSize
+	switch {
+	case incompat&(0x40|0x80|0x200) != 0: // extents, 64bit, flex_bg
+		s.Type = "ext4"
+	case compat&0x4 != 0: // has_journal
+		s.Type = "ext3"
+	default:
+		s.Type = "ext2"
+	}
+	return s, nil
+}
+
+// parseSquashfsSuperblock reads the 96-byte superblock of a squashfs
+func parseSquashfsSuperblock(sb []byte) (*squashfsInfo, error) {
+	if len(sb) < 96 || !bytes.Equal(sb[:4], []byte("hsqs")) {
+		return nil, fmt.Errorf("not a squashfs")
+	}
+	le := binary.LittleEndian
+	comp, ok := squashfsCompressions[le.Uint16(sb[20:])]
+	if !ok {
+		return nil, fmt.Errorf("unknown squashfs compression")
+	}
+	return &squashfsInfo{
+		Compression: comp,
+		Inodes:      le.Uint32(sb[4:]),
+		Created:     time.Unix(int64(le.Uint32(sb[8:])), 0),
+		BlockSize:   le.Uint32(sb[12:]),
+		Bytes:       int64(le.Uint64(sb[40:])),
+	}, nil
+}
+
+// parseKernelVersion reads the version string of an x86 bzImage
+func parseKernelVersion(head []byte) string {
+	if len(head) < 0x210 || !bytes.Equal(head[0x202:0x206], []byte("HdrS")) {
+		return ""
+	}
+	off := 0x200 + int(binary.LittleEndian.Uint16(head[0x20e:]))
+	if off <= 0x200 || off >= len(head) {
+		return ""
+	}
+	version := head[off:]
+	if end := bytes.IndexByte(version, 0); end >= 0 {
+		version = version[:end]
+	}
+	return strings.TrimSpace(string(version))
+}
+
+// initramfsCompression tells how an initramfs segment is compressed from
+// its first bytes
+func initramfsCompression(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("0707")):
+		return "none"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return "xz"
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd"
+	case bytes.HasPrefix(head, []byte{0x02, 0x21, 0x4c, 0x18}):
+		return "lz4"
+	case bytes.HasPrefix(head, []byte{0x5d, 0, 0}):
+		return "lzma"
+	}
+	return ""
+}
+
+// readCpioArchive adds the entries of a newc cpio archive to s, up to its
+// trailer; it returns the bytes it read
+func readCpioArchive(r *bufio.Reader, s *cpioSummary) (int64, error) {
+	var read int64
+	skip := func(n int64) error {
+		m, err := io.CopyN(io.Discard, r, n)
+		read += m
+		return err
+	}
+	header := make([]byte, 110)
+	for {
+		n, err := io.ReadFull(r, header)
+		read += int64(n)
+		if err != nil {
+			return read, fmt.Errorf("truncated cpio archive")
+		}
+		if !bytes.HasPrefix(header, []byte("07070")) {
+			return read, fmt.Errorf("not a newc cpio archive")
+		}
+		field := func(i int) int64 {
+			v, _ := strconv.ParseInt(string(header[6+8*i:14+8*i]), 16, 64)
+			return v
+		}
+		mode, size, namesize := field(1), field(6), field(11)
+		name := make([]byte, namesize)
+		n, err = io.ReadFull(r, name)
+		read += int64(n)
+		if err != nil {
+			return read, fmt.Errorf("truncated cpio archive")
+		}
+		if err := skip((4 - (110+namesize)%4) % 4); err != nil {
+			return read, err
+		}
+		path := strings.TrimPrefix(string(bytes.TrimRight(name, "\x00")), "./")
+		if path == "TRAILER!!!" {
+			return read, nil
+		}
+
+		switch mode & 0170000 {
+		case 0040000:
+			s.Dirs++
+		case 0120000:
+			s.Symlinks++
+		case 0100000:
+			s.Files++
+			s.Bytes += size
+			if strings.HasSuffix(path, ".ko") || strings.Contains(path, ".ko.") {
+				s.Modules++
+			}
+		}
+		if path == "init" && size > 0 {
+			s.HasInit = true
+			data := make([]byte, size)
+			n, err := io.ReadFull(r, data)
+			read += int64(n)
+			if err != nil {
+				return read, fmt.Errorf("truncated cpio archive")
+			}
+			s.MixOSInit = bytes.Contains(data, []byte("SDISK"))
+		} else if err := skip(size); err != nil {
+			return read, fmt.Errorf("truncated cpio archive")
+		}
+		if err := skip((4 - size%4) % 4); err != nil {
+			return read, err
+		}
+	}
+}
+
+// summarizeInitramfs reads an initramfs: uncompressed archives (early
+// microcode) and a last, usually compressed, one
+func summarizeInitramfs(data []byte) (*cpioSummary, error) {
+	s := &cpioSummary{}
+	for {
+		data = bytes.TrimLeft(data, "\x00")
+		if len(data) == 0 {
+			break
+		}
+		comp := initramfsCompression(data)
+		if comp == "" {
+			return nil, fmt.Errorf("unknown initramfs format")
+		}
+		s.Compression = comp
+		s.Archives++
+		if comp == "none" {
+			n, err := readCpioArchive(bufio.NewReader(bytes.NewReader(data)), s)
+			if err != nil {
+				return nil, err
+			}
+			data = data[n:]
+			continue
+		}
+
+		var r io.Reader
+		if comp == "gzip" {
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			r = gz
+		} else {
+			tool, err := exec.LookPath(comp)
+			if err != nil {
+				return nil, fmt.Errorf("%s not found to read the %s initramfs", comp, comp)
+			}
+			c := exec.Command(tool, "-dc")
+			c.Stdin = bytes.NewReader(data)
+			out, err := c.Output()
+			if err != nil && len(out) == 0 {
+				return nil, fmt.Errorf("%s failed to decompress the initramfs", comp)
+			}
+			r = bytes.NewReader(out)
+		}
+		// The compressed archive may itself hold several: go through all
+		br := bufio.NewReader(r)
+		for {
+			if _, err := readCpioArchive(br, s); err != nil {
+				return nil, err
+			}
+			for {
+				b, err := br.Peek(1)
+				if err != nil || b[0] != 0 {
+					break
+				}
+				br.Discard(1)
+			}
+			if _, err := br.Peek(6); err != nil {
+				break
+			}
+		}
+		break
+	}
+	if s.Archives == 0 {
+		return nil, fmt.Errorf("empty initramfs")
+	}
+	return s, nil
+}
+
+// readVisoHead returns the first n bytes of the file rel of an image
+func readVisoHead(img *visoImage, rel string, n int) ([]byte, error) {
+	f, err := img.Open(rel)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, n)
+	m, err := io.ReadFull(f, head)
+	f.Close()
+	if m == 0 {
+		return nil, err
+	}
+	return head[:m], nil
+}
+
+// parseOSRelease returns the PRETTY_NAME of an os-release file
+func parseOSRelease(data []byte) string {
+	name := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "PRETTY_NAME":
+			return value
+		case "NAME":
+			name = value
+		}
+	}
+	return name
+}
+
+// inspectVisoRoot reads the release, the packages and the VRAM
+// configuration of the root of the image
+func inspectVisoRoot(img *visoImage, r *visoInspection) error {
+	unsquashfs, err := exec.LookPath("unsquashfs")
+	if err != nil {
+		return fmt.Errorf("unsquashfs not found; install squashfs-tools to read the root")
+	}
+	tmp, err := os.MkdirTemp("", "viso-inspect-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	squashfs, err := img.RootSquashfs(tmp)
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(tmp, "root")
+	args := []string{"-no-progress", "-d", root, squashfs}
+	for _, rel := range visoRootInspectFiles {
+		args = append(args, "/"+rel)
+	}
+	if out, err := exec.Command(unsquashfs, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("unsquashfs failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "etc/os-release")); err == nil {
+		r.Release = parseOSRelease(data)
+	}
+	if _, err := os.Stat(filepath.Join(root, visoPackagesDB)); err == nil {
+		packages, err := readVisoPackages(filepath.Join(root, visoPackagesDB))
+		if err != nil {
+			return err
+		}
+		r.Packages = len(packages)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/mixos/vram.conf")); err == nil {
+		r.Features = append(r.Features, "VRAM configuration (/etc/mixos/vram.conf)")
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/mixos/vram-hotset")); err == nil {
+		r.Features = append(r.Features, "VRAM hotset (/etc/mixos/vram-hotset)")
+	}
+	return nil
+}
+
+// inspectVisoImage gathers the report of an image; what cannot be read is
+// noted rather than failing
+func inspectVisoImage(path string) (*visoInspection, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("VISO file not found: %s", path)
+	}
+	r := &visoInspection{Image: path, Packages: -1, Format: "directory"}
+	note := func(format string, args ...any) { r.Notes = append(r.Notes, fmt.Sprintf(format, args...)) }
+	if !info.IsDir() {
+		r.Format = visoImageFormat(path)
+		r.FileBytes, r.VirtualBytes = info.Size(), info.Size()
+	}
+
+	img, err := openVisoImage(path)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	if !img.dir {
+		if raw, err := os.Stat(img.raw); err == nil {
+			r.VirtualBytes = raw.Size()
+		}
+		f, err := os.Open(img.raw)
+		if err != nil {
+			return nil, err
+		}
+		part, err := findVisoRawRoot(f, r.VirtualBytes)
+		if err == nil && part.Start != 0 {
+			r.Partitions, _ = visoDiskPartitions(f)
+		}
+		if err == nil {
+			sb := make([]byte, 1024)
+			if _, err := f.ReadAt(sb, part.Start+1024); err == nil {
+				r.Filesystem, _ = parseExtSuperblock(sb)
+			}
+		} else {
+			note("%v", err)
+		}
+		f.Close()
+	}
+
+	if m, _, err := readVisoMetadata(path); err == nil {
+		r.Metadata = m
+	} else {
+		note("%v", err)
+	}
+
+	if head, err := readVisoHead(img, visoKernelPath, 64<<10); err == nil {
+		if r.Kernel = parseKernelVersion(head); r.Kernel == "" {
+			r.Kernel = "unknown (not a bzImage)"
+		}
+	} else {
+		note("no kernel at %s", visoKernelPath)
+	}
+
+	if data, err := img.ReadFile(visoInitramfsPath); err == nil {
+		if r.Initramfs, err = summarizeInitramfs(data); err != nil {
+			note("initramfs: %v", err)
+		}
+	} else {
+		note("no initramfs at %s", visoInitramfsPath)
+	}
+
+	if head, err := readVisoHead(img, visoRootfsPath, 96); err == nil {
+		if r.Rootfs, err = parseSquashfsSuperblock(head); err != nil {
+			note("root: %v", err)
+		}
+	} else {
+		note("no root at %s", visoRootfsPath)
+	}
+	if r.Rootfs != nil {
+		if err := inspectVisoRoot(img, r); err != nil {
+			note("%v", err)
+		}
+	}
+
+	if img.Exists(visoManifestPath) {
+		r.Features = append(r.Features, "checksum manifest")
+	}
+	for _, ext := range []string{".sig", ".asc", ".minisig"} {
+		if img.Exists(visoManifestPath + ext) {
+			r.Features = append(r.Features, fmt.Sprintf("%s signature", visoSignatureKind(ext)))
+		}
+		if !img.dir {
+			if _, err := os.Stat(path + ext); err == nil {
+				r.Features = append(r.Features, fmt.Sprintf("detached %s signature (%s)", visoSignatureKind(ext), filepath.Base(path+ext)))
+			}
+		}
+	}
+	if m := r.Metadata; m != nil {
+		if m.Features.VramSupport {
+			r.Features = append(r.Features, "VRAM support")
+		}
+		if m.Features.SdiskBoot {
+			r.Features = append(r.Features, "SDISK boot")
+		}
+		if m.Features.VirtioOptimized {
+			r.Features = append(r.Features, "virtio optimized")
+		}
+	}
+	return r, nil
+}
+
+func printVisoInspection(r *visoInspection) {
+	fmt.Printf("VISO Image: %s\n", r.Image)
+	fmt.Println("")
+	fmt.Println("Disk:")
+	fmt.Printf("  Format:       %s\n", r.Format)
+	if r.Format != "directory" {
+		fmt.Printf("  Size:         %s (%s on disk)\n", formatSize(r.VirtualBytes), formatSize(r.FileBytes))
+		if len(r.Partitions) == 0 {
+			fmt.Println("  Partitions:   none (the filesystem fills the disk)")
+		}
+		for i, p := range r.Partitions {
+			fmt.Printf("  Partition %d:  %s at %s\n", i+1, formatSize(p.Size), formatSize(p.Start))
+		}
+	}
+	if fs := r.Filesystem; fs != nil {
+		fmt.Printf("  Filesystem:   %s, label %q, %s (%s free)\n", fs.Type, fs.Label, formatSize(fs.Bytes), formatSize(fs.FreeBytes))
+	}
+	fmt.Println("")
+
+	if m := r.Metadata; m != nil {
+		fmt.Println("Metadata:")
+		fmt.Printf("  Name:         %s %s\n", m.Name, m.Version)
+		fmt.Printf("  Created:      %s\n", m.Created)
+		fmt.Printf("  Architecture: %s\n", m.Requirements.Arch)
+		fmt.Printf("  Cmdline:      %s\n", m.Boot.Cmdline)
+		fmt.Println("")
+	}
+
+	fmt.Println("Boot:")
+	if r.Kernel != "" {
+		fmt.Printf("  Kernel:       %s\n", r.Kernel)
+	}
+	if s := r.Initramfs; s != nil {
+		fmt.Printf("  Initramfs:    %s, %d archive(s): %d files, %d directories, %d symlinks (%s)\n",
+			s.Compression, s.Archives, s.Files, s.Dirs, s.Symlinks, formatSize(s.Bytes))
+		fmt.Printf("                %d kernel module(s)", s.Modules)
+		switch {
+		case !s.HasInit:
+			fmt.Println(", no /init")
+		case s.MixOSInit:
+			fmt.Println(", MixOS init (SDISK/VRAM)")
+		default:
+			fmt.Println(", foreign init (does not boot the VISO layout)")
+		}
+	}
+	fmt.Println("")
+
+	if fs := r.Rootfs; fs != nil {
+		fmt.Println("Root:")
+		fmt.Printf("  Squashfs:     %s, %s, %d inodes, %dK blocks, built %s\n", fs.Compression, formatSize(fs.Bytes),
+			fs.Inodes, fs.BlockSize>>10, fs.Created.Format("2006-01-02 15:04"))
+		if r.Release != "" {
+			fmt.Printf("  Release:      %s\n", r.Release)
+		}
+		if r.Packages >= 0 {
+			fmt.Printf("  Packages:     %d installed\n", r.Packages)
+		} else {
+			fmt.Println("  Packages:     unknown")
+		}
+		fmt.Println("")
+	}
+
+	fmt.Println("Features:")
+	if len(r.Features) == 0 {
+		fmt.Println("  none")
+	}
+	for _, f := range r.Features {
+		fmt.Printf("  • %s\n", f)
+	}
+	if len(r.Notes) > 0 {
+		fmt.Println("")
+		fmt.Println("Notes:")
+		for _, n := range r.Notes {
+			fmt.Printf("  %s\n", n)
+		}
+	}
+}
+
+func runVisoInspect(cmd *cobra.Command, args []string) error {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	r, err := inspectVisoImage(args[0])
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	printVisoInspection(r)
+	return nil
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ============================================================================
+// VISO Machines
+// ============================================================================
+//
+// The QEMU machine an image boots on follows its architecture, recorded in
+// its metadata (requirements.arch): x86_64 boots on the default PC machine
+// of qemu-system-x86_64, aarch64 on the "virt" machine of
+// qemu-system-aarch64. With --uefi the machine starts from the EDK2 build
+// of the distribution (OVMF for x86_64, AAVMF for aarch64) instead of
+// SeaBIOS, to try the image as it boots on UEFI hardware. Firmware images
+// named *CODE* are read-only flash halves and go on a pflash drive; whole
+// images go to -bios.
+
+// visoMachine describes how QEMU emulates the machines of an architecture
+type visoMachine struct {
+	Qemu            string   // QEMU binary
+	Package         string   // package providing the QEMU binary
+	Machine         string   // -machine type, empty for the QEMU default
+	UEFIMachine     string   // -machine type with UEFI firmware
+	CPU             string   // -cpu model without KVM, empty for the QEMU default
+	Console         string   // serial console of the kernel
+	Firmware        []string // UEFI firmware images, in the order they are looked for
+	FirmwarePackage string   // package providing the UEFI firmware
+}
+
+var visoMachines = map[string]visoMachine{
+	"x86_64": {
+		Qemu:        "qemu-system-x86_64",
+		Package:     "qemu-system-x86",
+		UEFIMachine: "q35",
+		Console:     "ttyS0",
+		Firmware: []string{
+			"/usr/share/OVMF/OVMF_CODE.fd",
+			"/usr/share/edk2/ovmf/OVMF_CODE.fd",
+			"/usr/share/edk2/x64/OVMF_CODE.fd",
+			"/usr/share/qemu/ovmf-x86_64-code.bin",
+			"/usr/share/ovmf/OVMF.fd",
+		},
+		FirmwarePackage: "ovmf",
+	},
+	"aarch64": {
+		Qemu:        "qemu-system-aarch64",
+		Package:     "qemu-system-arm",
+		Machine:     "virt",
+		UEFIMachine: "virt",
+		CPU:         "max",
+		Console:     "ttyAMA0",
+		Firmware: []string{
+			"/usr/share/AAVMF/AAVMF_CODE.fd",
+			"/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw",
+			"/usr/share/qemu/aavmf-aarch64-code.bin",
+			"/usr/share/qemu-efi-aarch64/QEMU_EFI.fd",
+		},
+		FirmwarePackage: "qemu-efi-aarch64",
+	},
+}
+
+// normalizeVisoArch returns the architecture name of visoMachines for an
+// architecture as Go, Debian or the kernel name it; empty is x86_64
+func normalizeVisoArch(arch string) (string, error) {
+	switch strings.ToLower(arch) {
+	case "", "x86_64", "x86-64", "amd64":
+		return "x86_64", nil
+	case "aarch64", "arm64":
+		return "aarch64", nil
+	}
+	return "", fmt.Errorf("unsupported architecture %q (use x86_64 or aarch64)", arch)
+}
+
+// visoHostArch returns the architecture of this machine
+func visoHostArch() string {
+	arch, err := normalizeVisoArch(runtime.GOARCH)
+	if err != nil {
+		return runtime.GOARCH
+	}
+	return arch
+}
+
+// visoBootArch returns the architecture to boot an image as: arch when
+// given, else the one of its metadata
+func visoBootArch(image, arch string) (string, error) {
+	if arch == "" {
+		if m, _, err := readVisoMetadata(image); err == nil {
+			arch = m.Requirements.Arch
+		}
+	}
+	return normalizeVisoArch(arch)
+}
+
+// visoFirmware returns the UEFI firmware of an architecture installed on
+// this machine; when there is none, it returns the usual path and false
+func visoFirmware(arch string) (string, bool) {
+	candidates := visoMachines[arch].Firmware
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, true
+		}
+	}
+	return candidates[0], false
+}
+
+// visoFirmwareArgs returns the QEMU options loading a firmware image
+func visoFirmwareArgs(firmware string) []string {
+	name := strings.ToLower(filepath.Base(firmware))
+	if strings.Contains(name, "code") || strings.HasSuffix(name, "-pflash.raw") {
+		return []string{"-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", firmware)}
+	}
+	return []string{"-bios", firmware}
+}
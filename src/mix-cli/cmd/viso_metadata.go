@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ============================================================================
+// VISO Metadata Header
+// ============================================================================
+//
+// The metadata of an image travels inside it, in config/viso.json, but
+// reading that file means unpacking the whole qcow2 image for debugfs. A
+// copy is also kept at the very start of the disk, in the 1024 bytes ext4
+// leaves to a boot sector and never uses: "MIXOS-VISO-META\n", the
+// metadata as compact JSON, then zeros. qemu-img dd reads those bytes
+// alone, so "mix viso info" stays instant on images of any size, and the
+// metadata follows the image wherever it is copied.
+
+const (
+	visoHeaderMagic = "MIXOS-VISO-META\n"
+	visoHeaderSize  = 1024 // before the ext4 superblock
+)
+
+// encodeVisoHeader lays metadata out as the header of an image
+func encodeVisoHeader(m *VisoMetadata) ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(visoHeaderMagic)+len(data) > visoHeaderSize {
+		return nil, fmt.Errorf("metadata too large for the image header (%d bytes)", len(data))
+	}
+	header := make([]byte, visoHeaderSize)
+	copy(header, visoHeaderMagic)
+	copy(header[len(visoHeaderMagic):], data)
+	return header, nil
+}
+
+// parseVisoHeader reads the metadata out of the header of an image
+func parseVisoHeader(header []byte) (*VisoMetadata, error) {
+	data, ok := bytes.CutPrefix(header, []byte(visoHeaderMagic))
+	if !ok {
+		return nil, fmt.Errorf("no metadata header")
+	}
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+	var m VisoMetadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid metadata header: %w", err)
+	}
+	return &m, nil
+}
+
+// writeVisoHeader stores the header of an image at the start of its raw
+// filesystem
+func writeVisoHeader(raw string, m *VisoMetadata) error {
+	header, err := encodeVisoHeader(m)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(raw, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(header, 0)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readVisoHeader reads the first bytes of an image, through qemu-img for
+// a qcow2 image
+func readVisoHeader(path string) ([]byte, error) {
+	header := make([]byte, visoHeaderSize)
+	if visoImageFormat(path) == "raw" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := io.ReadFull(f, header); err != nil {
+			return nil, err
+		}
+		return header, nil
+	}
+
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img not found")
+	}
+	tmp, err := os.MkdirTemp("", "viso-header-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	out := filepath.Join(tmp, "header")
+	args := []string{"dd", "-f", "qcow2", "-O", "raw", fmt.Sprintf("bs=%d", visoHeaderSize), "count=1", "if=" + path, "of=" + out}
+	if msg, err := exec.Command(qemuImg, args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(msg)))
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return nil, err
+	}
+	copy(header, data)
+	return header, nil
+}
+
+// readVisoMetadata returns the metadata of an image and where it was
+// found: the header, config/viso.json inside the image, or the
+// config/viso.json an unpacked image keeps next to the file
+func readVisoMetadata(path string) (*VisoMetadata, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("VISO file not found: %s", path)
+	}
+	if !info.IsDir() {
+		if header, err := readVisoHeader(path); err == nil {
+			if m, err := parseVisoHeader(header); err == nil {
+				return m, "image header", nil
+			}
+		}
+	}
+
+	var m VisoMetadata
+	if img, err := openVisoImage(path); err == nil {
+		data, err := img.ReadFile(visoMetadataPath)
+		img.Close()
+		if err == nil {
+			if err := json.Unmarshal(data, &m); err != nil {
+				return nil, "", fmt.Errorf("invalid %s: %w", visoMetadataPath, err)
+			}
+			return &m, visoMetadataPath, nil
+		}
+	}
+
+	side := filepath.Join(filepath.Dir(path), visoMetadataPath)
+	data, err := os.ReadFile(side)
+	if err != nil {
+		return nil, "", fmt.Errorf("no metadata found in %s", path)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, "", fmt.Errorf("invalid %s: %w", side, err)
+	}
+	return &m, side, nil
+}
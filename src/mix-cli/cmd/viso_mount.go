@@ -0,0 +1,349 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Mount
+// ============================================================================
+//
+// "mix viso mount" attaches an image to a network block device with
+// qemu-nbd, which reads qcow2 and raw images alike, mounts its ext4
+// filesystem, and the squashfs root inside it next to it, so an image can
+// be browsed without booting it. Both are read-only unless --rw is given,
+// which only applies to the image filesystem. What is mounted is recorded
+// in /run/mixos/viso-mounts.json for "mix viso umount".
+
+const (
+	visoMountState = "/run/mixos/viso-mounts.json"
+	visoSysBlock   = "/sys/block"
+	visoNbdDevices = 16 // nbds_max of the nbd module
+)
+
+// visoMount is an image mounted by "mix viso mount"
+type visoMount struct {
+	Image      string    `json:"image"`
+	Device     string    `json:"device"`
+	Mountpoint string    `json:"mountpoint"`
+	Rootfs     string    `json:"rootfs,omitempty"` // where the squashfs root is mounted
+	ReadWrite  bool      `json:"read_write,omitempty"`
+	Mounted    time.Time `json:"mounted"`
+}
+
+var visoMountCmd = &cobra.Command{
+	Use:   "mount <viso-file> <mountpoint>",
+	Short: "Mount a VISO image for inspection",
+	Long: `Mount the filesystem of a VISO image, with the kernel, the initramfs,
+the metadata and the root, and the root itself next to it, so their
+files can be browsed without booting the image.
+
+The root is mounted on <mountpoint>-rootfs unless --rootfs-dir gives
+another directory or --no-rootfs is given. Everything is read-only;
+--rw makes the image filesystem writable (the root stays read-only).
+
+Requires root and qemu-nbd (qemu-utils). Run "mix viso mount" without
+arguments to list mounted images, and "mix viso umount" to release one.
+
+Examples:
+  mix viso mount mixos.viso /mnt/viso
+  ls /mnt/viso/boot /mnt/viso-rootfs/etc
+  mix viso umount /mnt/viso`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 && len(args) != 2 {
+			return fmt.Errorf("accepts an image and a mountpoint, or nothing to list the mounts")
+		}
+		return nil
+	},
+	RunE: runVisoMount,
+}
+
+var visoUmountCmd = &cobra.Command{
+	Use:   "umount <mountpoint|viso-file>",
+	Short: "Unmount a VISO image",
+	Long: `Unmount an image mounted with "mix viso mount": its root, its filesystem,
+and the network block device behind them.
+
+Examples:
+  mix viso umount /mnt/viso
+  mix viso umount mixos.viso
+  mix viso umount --all`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runVisoUmount,
+}
+
+func init() {
+	visoCmd.AddCommand(visoMountCmd)
+	visoCmd.AddCommand(visoUmountCmd)
+	visoMountCmd.Flags().String("rootfs-dir", "", "where to mount the root (default: <mountpoint>-rootfs)")
+	visoMountCmd.Flags().Bool("no-rootfs", false, "do not mount the root")
+	visoMountCmd.Flags().Bool("rw", false, "mount the image filesystem read-write")
+	visoUmountCmd.Flags().Bool("all", false, "unmount every mounted image")
+}
+
+func loadVisoMounts() []visoMount {
+	data, err := os.ReadFile(visoMountState)
+	if err != nil {
+		return nil
+	}
+	var mounts []visoMount
+	json.Unmarshal(data, &mounts)
+	return mounts
+}
+
+func saveVisoMounts(mounts []visoMount) error {
+	data, err := json.MarshalIndent(mounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(visoMountState), 0755)
+	return os.WriteFile(visoMountState, data, 0644)
+}
+
+// freeNbdDevice returns the first network block device no client holds
+func freeNbdDevice(sysBlock string) (string, error) {
+	found := false
+	for i := 0; i < visoNbdDevices; i++ {
+		name := fmt.Sprintf("nbd%d", i)
+		if _, err := os.Stat(filepath.Join(sysBlock, name)); err != nil {
+			continue
+		}
+		found = true
+		if _, err := os.Stat(filepath.Join(sysBlock, name, "pid")); os.IsNotExist(err) {
+			return "/dev/" + name, nil
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("no nbd devices; load the module with: modprobe nbd max_part=8")
+	}
+	return "", fmt.Errorf("all nbd devices are in use")
+}
+
+// waitNbdDevice waits for qemu-nbd to bring a device up
+func waitNbdDevice(device string) error {
+	size := filepath.Join(visoSysBlock, filepath.Base(device), "size")
+	for i := 0; i < 50; i++ {
+		if data, err := os.ReadFile(size); err == nil && strings.TrimSpace(string(data)) != "0" {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("%s did not come up", device)
+}
+
+// visoImageFormat tells qemu-nbd the format of an image
+func visoImageFormat(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "raw"
+	}
+	defer f.Close()
+	head := make([]byte, len(visoLUKSMagic))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return "raw"
+	}
+	switch {
+	case bytes.HasPrefix(head, visoQcow2Magic):
+		return "qcow2"
+	case bytes.Equal(head, visoLUKSMagic):
+		return "luks"
+	}
+	return "raw"
+}
+
+// releaseVisoMount unmounts what m records and disconnects its device;
+// it goes on past failures and returns the first
+func releaseVisoMount(m visoMount) error {
+	var first error
+	note := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if m.Rootfs != "" && isMountpoint(m.Rootfs) {
+		if out, err := exec.Command("umount", "-d", m.Rootfs).CombinedOutput(); err != nil {
+			note(fmt.Errorf("failed to unmount %s: %s", m.Rootfs, strings.TrimSpace(string(out))))
+		}
+	}
+	if isMountpoint(m.Mountpoint) {
+		if out, err := exec.Command("umount", m.Mountpoint).CombinedOutput(); err != nil {
+			note(fmt.Errorf("failed to unmount %s: %s", m.Mountpoint, strings.TrimSpace(string(out))))
+		}
+	}
+	if m.Device != "" {
+		if out, err := exec.Command("qemu-nbd", "--disconnect", m.Device).CombinedOutput(); err != nil {
+			note(fmt.Errorf("failed to disconnect %s: %s", m.Device, strings.TrimSpace(string(out))))
+		}
+	}
+	return first
+}
+
+func runVisoMount(cmd *cobra.Command, args []string) error {
+	mounts := loadVisoMounts()
+	if len(args) == 0 {
+		if len(mounts) == 0 {
+			fmt.Println("No VISO images mounted")
+			return nil
+		}
+		fmt.Println("Mounted VISO images:")
+		for _, m := range mounts {
+			mode := "ro"
+			if m.ReadWrite {
+				mode = "rw"
+			}
+			fmt.Printf("  %s\n    %s on %s (%s)\n", m.Image, m.Device, m.Mountpoint, mode)
+			if m.Rootfs != "" {
+				fmt.Printf("    root on %s (ro)\n", m.Rootfs)
+			}
+		}
+		return nil
+	}
+
+	image, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	mountpoint, err := filepath.Abs(args[1])
+	if err != nil {
+		return err
+	}
+	rootfsDir, _ := cmd.Flags().GetString("rootfs-dir")
+	noRootfs, _ := cmd.Flags().GetBool("no-rootfs")
+	rw, _ := cmd.Flags().GetBool("rw")
+
+	if info, err := os.Stat(image); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("VISO file not found: %s", args[0])
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("mounting an image must be run as root")
+	}
+	for _, m := range mounts {
+		if m.Mountpoint == mountpoint {
+			return fmt.Errorf("%s is already mounted on %s", m.Image, mountpoint)
+		}
+		if m.Image == image && (rw || m.ReadWrite) {
+			return fmt.Errorf("%s is already mounted on %s", image, m.Mountpoint)
+		}
+	}
+	if isMountpoint(mountpoint) {
+		return fmt.Errorf("%s is already a mountpoint", mountpoint)
+	}
+	if _, err := exec.LookPath("qemu-nbd"); err != nil {
+		return fmt.Errorf("qemu-nbd not found; install qemu-utils")
+	}
+	if _, err := os.Stat(filepath.Join(visoSysBlock, "nbd0")); err != nil {
+		exec.Command("modprobe", "nbd", "max_part=8").Run()
+	}
+	device, err := freeNbdDevice(visoSysBlock)
+	if err != nil {
+		return err
+	}
+
+	m := visoMount{Image: image, Device: device, Mountpoint: mountpoint, ReadWrite: rw, Mounted: time.Now()}
+	nbdArgs := []string{"--connect=" + device, "--format=" + visoImageFormat(image)}
+	mountOpts := "rw"
+	if !rw {
+		nbdArgs = append(nbdArgs, "--read-only")
+		mountOpts = "ro"
+	}
+	if out, err := exec.Command("qemu-nbd", append(nbdArgs, image)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("qemu-nbd failed: %s", strings.TrimSpace(string(out)))
+	}
+	if err := waitNbdDevice(device); err != nil {
+		releaseVisoMount(m)
+		return err
+	}
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		releaseVisoMount(m)
+		return err
+	}
+	if out, err := exec.Command("mount", "-t", "ext4", "-o", mountOpts, device, mountpoint).CombinedOutput(); err != nil {
+		releaseVisoMount(m)
+		return fmt.Errorf("failed to mount %s: %s", image, strings.TrimSpace(string(out)))
+	}
+	fmt.Printf("✓ Mounted %s on %s (%s)\n", args[0], mountpoint, mountOpts)
+
+	squashfs := filepath.Join(mountpoint, visoRootfsPath)
+	if _, err := os.Stat(squashfs); err == nil && !noRootfs {
+		if rootfsDir == "" {
+			rootfsDir = mountpoint + "-rootfs"
+		}
+		if m.Rootfs, err = filepath.Abs(rootfsDir); err != nil {
+			releaseVisoMount(m)
+			return err
+		}
+		if err := os.MkdirAll(m.Rootfs, 0755); err != nil {
+			releaseVisoMount(m)
+			return err
+		}
+		if out, err := exec.Command("mount", "-t", "squashfs", "-o", "ro,loop", squashfs, m.Rootfs).CombinedOutput(); err != nil {
+			releaseVisoMount(m)
+			return fmt.Errorf("failed to mount the root: %s", strings.TrimSpace(string(out)))
+		}
+		fmt.Printf("✓ Mounted the root on %s (ro)\n", m.Rootfs)
+	}
+
+	if err := saveVisoMounts(append(mounts, m)); err != nil {
+		return err
+	}
+	fmt.Printf("  Release it with: mix viso umount %s\n", mountpoint)
+	return nil
+}
+
+func runVisoUmount(cmd *cobra.Command, args []string) error {
+	all, _ := cmd.Flags().GetBool("all")
+	if len(args) == 0 && !all {
+		return fmt.Errorf("give a mountpoint or an image, or --all")
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("unmounting an image must be run as root")
+	}
+	target := ""
+	if len(args) == 1 {
+		abs, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		target = abs
+	}
+
+	var kept []visoMount
+	var first error
+	released := 0
+	for _, m := range loadVisoMounts() {
+		if !all && m.Mountpoint != target && m.Image != target && m.Rootfs != target {
+			kept = append(kept, m)
+			continue
+		}
+		if err := releaseVisoMount(m); err != nil {
+			fmt.Printf("✗ %s: %v\n", m.Image, err)
+			kept = append(kept, m)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		fmt.Printf("✓ Unmounted %s from %s\n", m.Image, m.Mountpoint)
+		released++
+	}
+	if err := saveVisoMounts(kept); err != nil {
+		return err
+	}
+	if first != nil {
+		return fmt.Errorf("some images could not be released")
+	}
+	if released == 0 && !all {
+		return fmt.Errorf("no VISO image mounted on %s", args[0])
+	}
+	return nil
+}
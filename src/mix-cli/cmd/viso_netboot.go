@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Netboot
+// ============================================================================
+//
+// "mix viso netboot" lays out what PXE and iPXE clients need to boot an
+// image from the network, in a directory to serve over TFTP or HTTP: the
+// kernel and initramfs at their place in the image, an iPXE script
+// (boot.ipxe) and a PXELINUX configuration (pxelinux.cfg/default), all
+// with paths relative to the directory. The kernel command line carries
+// SDISK and VRAM as "mix viso boot" does. Given the URL the directory is
+// served at (--url, or --serve to serve it from here), the root and the
+// metadata are exported too and VISO_URL points the initramfs at them:
+// it checks the minisign signature of the manifest, fetches the files it
+// lists over HTTP into RAM and boots without a disk.
+
+const (
+	visoNetbootIPXE     = "boot.ipxe"
+	visoNetbootPXELinux = "pxelinux.cfg/default"
+)
+
+var visoNetbootCmd = &cobra.Command{
+	Use:   "netboot <viso-file>",
+	Short: "Export a VISO image for PXE and iPXE network boot",
+	Long: `Export the kernel and initramfs of a VISO image to a directory served
+over TFTP or HTTP, with an iPXE script (boot.ipxe) and a PXELINUX
+configuration (pxelinux.cfg/default) to boot them. The boot loaders
+themselves (pxelinux.0, ipxe.efi) come from syslinux and iPXE.
+
+By default the client boots the image from its own disk, found with
+SDISK. With --url, the URL the directory is served at, the root of the
+image is exported too and the client fetches it over HTTP into RAM: a
+diskless boot. The image must be signed with minisign (mix viso sign),
+and the initramfs built with the public key, since the client checks the
+signature before it trusts anything it fetched. --serve serves the directory over HTTP on --listen until
+interrupted, and gives the URL itself when --url is not set.
+
+--vram adds VRAM=auto to the kernel command line; --cmdline appends
+more parameters.
+
+Examples:
+  mix viso netboot mixos.viso -o /srv/tftp
+  mix viso netboot mixos.viso -o ./tftpboot --vram --serve
+  mix viso netboot mixos.viso -o /var/www/mixos --url http://boot.lan/mixos/`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoNetboot,
+}
+
+func init() {
+	visoCmd.AddCommand(visoNetbootCmd)
+	visoNetbootCmd.Flags().StringP("output", "o", "tftpboot", "directory to export to")
+	visoNetbootCmd.Flags().Bool("vram", false, "boot in VRAM mode")
+	visoNetbootCmd.Flags().String("cmdline", "", "more kernel parameters")
+	visoNetbootCmd.Flags().String("url", "", "URL the directory is served at, for a diskless boot")
+	visoNetbootCmd.Flags().Bool("serve", false, "serve the directory over HTTP for a diskless boot")
+	visoNetbootCmd.Flags().String("listen", ":8080", "address to serve on with --serve")
+}
+
+// visoNetbootCmdline returns the kernel command line of a network boot
+func visoNetbootCmdline(image, arch string, vram bool, url, extra string) string {
+	parts := []string{"console=tty0", "console=" + visoMachines[arch].Console}
+	if vram {
+		parts = append(parts, "VRAM=auto")
+	}
+	parts = append(parts, fmt.Sprintf("SDISK=%s.VISO", strings.TrimSuffix(filepath.Base(image), ".viso")))
+	if url != "" {
+		parts = append(parts, "VISO_URL="+strings.TrimSuffix(url, "/"))
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	return strings.Join(parts, " ")
+}
+
+// visoIPXEScript returns an iPXE script booting the exported image
+func visoIPXEScript(label, cmdline string) string {
+	return fmt.Sprintf(`#!ipxe
+# %s, exported by mix viso netboot
+echo Booting %s
+kernel %s %s
+initrd %s
+boot
+`, label, label, visoKernelPath, cmdline, visoInitramfsPath)
+}
+
+// visoPXELinuxConfig returns a PXELINUX configuration booting the
+// exported image
+func visoPXELinuxConfig(label, cmdline string) string {
+	return fmt.Sprintf(`# %s, exported by mix viso netboot
+DEFAULT mixos
+PROMPT 0
+TIMEOUT 30
+
+LABEL mixos
+  MENU LABEL %s
+  KERNEL %s
+  INITRD %s
+  APPEND %s
+`, label, label, visoKernelPath, visoInitramfsPath, cmdline)
+}
+
+// visoServeURL returns the URL clients reach a listen address at, with
+// the first IPv4 address of this machine when the address has no host
+func visoServeURL(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", listen, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return "", err
+		}
+		host = ""
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				host = ipnet.IP.String()
+				break
+			}
+		}
+		if host == "" {
+			return "", fmt.Errorf("no network address to serve on; give --url")
+		}
+	}
+	return fmt.Sprintf("http://%s/", net.JoinHostPort(host, port)), nil
+}
+
+// exportVisoNetboot copies the files of an image a network boot needs
+// to dir, and the root and metadata as well for a diskless boot
+func exportVisoNetboot(image, dir string, diskless bool) error {
+	img, err := openVisoImage(image)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	files := []string{visoKernelPath, visoInitramfsPath}
+	if diskless {
+		if !img.Exists(visoRootfsPath) {
+			return fmt.Errorf("%s has no squashfs root (%s) to boot without a disk", image, visoRootfsPath)
+		}
+		// The initramfs does not trust the network with an unsigned root
+		if !img.Exists(visoManifestPath + ".minisig") {
+			return fmt.Errorf("%s is not signed; sign it with minisign (mix viso sign) to boot it without a disk", image)
+		}
+		files = append(files, visoRootfsPath, filepath.Dir(visoMetadataPath))
+	}
+	for _, rel := range files {
+		target := filepath.Join(dir, filepath.Dir(rel))
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		// debugfs does not write over what is there
+		if err := os.RemoveAll(filepath.Join(target, filepath.Base(rel))); err != nil {
+			return err
+		}
+		fmt.Printf("  %s\n", rel)
+		if err := img.Dump(rel, target); err != nil {
+			return fmt.Errorf("%s: %w", image, err)
+		}
+	}
+	return nil
+}
+
+func runVisoNetboot(cmd *cobra.Command, args []string) error {
+	image := args[0]
+	output, _ := cmd.Flags().GetString("output")
+	vram, _ := cmd.Flags().GetBool("vram")
+	extra, _ := cmd.Flags().GetString("cmdline")
+	url, _ := cmd.Flags().GetString("url")
+	serve, _ := cmd.Flags().GetBool("serve")
+	listen, _ := cmd.Flags().GetString("listen")
+
+	if info, err := os.Stat(image); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("VISO file not found: %s", image)
+	}
+	if url == "" && serve {
+		var err error
+		if url, err = visoServeURL(listen); err != nil {
+			return err
+		}
+	}
+	if url != "" && !strings.HasPrefix(url, "http://") {
+		return fmt.Errorf("the initramfs fetches the root over plain HTTP; give an http:// URL")
+	}
+	arch, err := visoBootArch(image, "")
+	if err != nil {
+		return err
+	}
+	label := strings.TrimSuffix(filepath.Base(image), ".viso")
+	if m, _, err := readVisoMetadata(image); err == nil && m.Name != "" {
+		label = fmt.Sprintf("%s %s", m.Name, m.Version)
+	}
+
+	fmt.Printf("Exporting %s to %s...\n", image, output)
+	if err := exportVisoNetboot(image, output, url != ""); err != nil {
+		return err
+	}
+	cmdline := visoNetbootCmdline(image, arch, vram, url, extra)
+	configs := map[string]string{
+		visoNetbootIPXE:     visoIPXEScript(label, cmdline),
+		visoNetbootPXELinux: visoPXELinuxConfig(label, cmdline),
+	}
+	for _, rel := range []string{visoNetbootIPXE, visoNetbootPXELinux} {
+		path := filepath.Join(output, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(configs[rel]), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("  %s\n", rel)
+	}
+
+	fmt.Printf("\n✓ Exported %s for network boot\n", image)
+	fmt.Printf("  Kernel command line: %s\n", cmdline)
+	if url == "" {
+		fmt.Println("  Clients boot the image from their own disk; give --url or --serve to boot them without one")
+	}
+	fmt.Println("")
+	fmt.Printf("  PXELINUX: serve %s over TFTP with pxelinux.0 and ldlinux.c32 from syslinux\n", output)
+	if url != "" {
+		fmt.Printf("  iPXE:     chain %s%s\n", strings.TrimSuffix(url, "/")+"/", visoNetbootIPXE)
+	} else {
+		fmt.Printf("  iPXE:     chain tftp://<server>/%s\n", visoNetbootIPXE)
+	}
+	if !serve {
+		return nil
+	}
+
+	fmt.Printf("\nServing %s on %s (Ctrl-C to stop)\n", output, url)
+	files := http.FileServer(http.Dir(output))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("  %s %s %s\n", time.Now().Format("15:04:05"), r.RemoteAddr, r.URL.Path)
+		files.ServeHTTP(w, r)
+	})
+	server := &http.Server{Addr: listen, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	return server.ListenAndServe()
+}
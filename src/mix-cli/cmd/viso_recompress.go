@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Recompress
+// ============================================================================
+//
+// "mix viso recompress" trades size against speed after the fact: the
+// squashfs root decides how fast VRAM mode unpacks into RAM and SDISK
+// reads, the qcow2 clusters how large the image is to download. A new
+// root compression unpacks the root and packs it again, then rebuilds
+// the image around it with buildVisoImage, as "mix viso create" does; a
+// new qcow2 compression alone only converts the image with qemu-img,
+// keeping its contents and signatures.
+
+var visoRecompressCmd = &cobra.Command{
+	Use:   "recompress <viso-file>",
+	Short: "Change the compression of a VISO image",
+	Long: `Rewrite a VISO image with another compression of its squashfs root,
+another compression of its qcow2 clusters, or both, and report the size
+change.
+
+--compression (xz, zstd, lz4, gzip, lzo) and --level repack the root;
+--level alone repacks it with its current compression. Levels go from 1
+to 9 for gzip and lzo and 1 to 22 for zstd; xz takes none, and any level
+selects high compression for lz4. Repacking the root needs root, to keep
+the owners of its files, and rebuilds the image: its signatures must be
+made again with "mix viso sign".
+
+--qcow2 (zlib, zstd, none) sets the compression of the image clusters.
+Alone, it keeps the contents of the image and its signatures.
+
+Lighter root compression (lz4, zstd at a low level) boots faster in VRAM
+mode; heavier compression (xz, zstd -19) and zstd clusters make smaller
+downloads. The image is rewritten in place unless --output is given.
+
+Requires unsquashfs and mksquashfs (squashfs-tools) to repack the root,
+debugfs and mkfs.ext4 (e2fsprogs) and qemu-img.
+
+Examples:
+  mix viso recompress mixos.viso --compression zstd --level 19
+  mix viso recompress mixos.viso --compression lz4 -o mixos-fast.viso
+  mix viso recompress mixos.viso --qcow2 zstd`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoRecompress,
+}
+
+func init() {
+	visoCmd.AddCommand(visoRecompressCmd)
+	visoRecompressCmd.Flags().String("compression", "", "squashfs compression of the root (xz, zstd, lz4, gzip, lzo)")
+	visoRecompressCmd.Flags().Int("level", 0, "compression level of the root")
+	visoRecompressCmd.Flags().String("qcow2", "", "compression of the qcow2 clusters (zlib, zstd, none)")
+	visoRecompressCmd.Flags().StringP("output", "o", "", "VISO image to write (default: rewrite the image)")
+	visoRecompressCmd.Flags().Bool("force", false, "overwrite an existing output image")
+}
+
+// squashfsLevelArgs returns the mksquashfs options of a compression and
+// level; level 0 is the default of the compressor
+func squashfsLevelArgs(compression string, level int) ([]string, error) {
+	args := []string{"-comp", compression}
+	switch compression {
+	case "gzip", "lzo", "zstd", "lz4", "xz":
+	default:
+		return nil, fmt.Errorf("unknown compression %q (use xz, zstd, lz4, gzip or lzo)", compression)
+	}
+	switch {
+	case level == 0:
+		return args, nil
+	case compression == "xz":
+		return nil, fmt.Errorf("xz takes no compression level")
+	case compression == "lz4":
+		return append(args, "-Xhc"), nil
+	case compression == "zstd" && (level < 1 || level > 22):
+		return nil, fmt.Errorf("zstd levels go from 1 to 22")
+	case compression != "zstd" && (level < 1 || level > 9):
+		return nil, fmt.Errorf("%s levels go from 1 to 9", compression)
+	}
+	return append(args, "-Xcompression-level", fmt.Sprint(level)), nil
+}
+
+// formatSizeChange describes how a size changed
+func formatSizeChange(before, after int64) string {
+	if before == 0 {
+		return formatSize(after)
+	}
+	return fmt.Sprintf("%s → %s (%+.1f%%)", formatSize(before), formatSize(after), float64(after-before)*100/float64(before))
+}
+
+// repackVisoRoot unpacks the root of img and packs it again into work
+func repackVisoRoot(img *visoImage, work, compression string, level int) (squashfs, from string, before int64, err error) {
+	tools, err := visoTools("unsquashfs", "mksquashfs")
+	if err != nil {
+		return "", "", 0, err
+	}
+	old, err := img.RootSquashfs(work)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if from, err = squashfsCompression(old); err != nil {
+		return "", "", 0, err
+	}
+	if compression == "" {
+		compression = from
+	}
+	compArgs, err := squashfsLevelArgs(compression, level)
+	if err != nil {
+		return "", "", 0, err
+	}
+	info, err := os.Stat(old)
+	if err != nil {
+		return "", "", 0, err
+	}
+	before = info.Size()
+
+	fmt.Printf("Unpacking the root (%s, %s)...\n", from, formatSize(before))
+	root := filepath.Join(work, "root")
+	if out, err := exec.Command(tools["unsquashfs"], "-no-progress", "-d", root, old).CombinedOutput(); err != nil {
+		return "", "", 0, fmt.Errorf("unsquashfs failed: %s", strings.TrimSpace(string(out)))
+	}
+	if !img.dir {
+		os.Remove(old)
+	}
+
+	desc := compression
+	if level != 0 {
+		desc = fmt.Sprintf("%s, level %d", compression, level)
+	}
+	fmt.Printf("Packing the root (%s)...\n", desc)
+	squashfs = filepath.Join(work, "repacked.squashfs")
+	args := append([]string{root, squashfs}, compArgs...)
+	args = append(args, "-b", "1M", "-noappend", "-no-progress", "-quiet")
+	if out, err := exec.Command(tools["mksquashfs"], args...).CombinedOutput(); err != nil {
+		return "", "", 0, fmt.Errorf("mksquashfs failed: %s", strings.TrimSpace(string(out)))
+	}
+	os.RemoveAll(root)
+	return squashfs, from, before, nil
+}
+
+func runVisoRecompress(cmd *cobra.Command, args []string) error {
+	image := args[0]
+	compression, _ := cmd.Flags().GetString("compression")
+	level, _ := cmd.Flags().GetInt("level")
+	qcow2, _ := cmd.Flags().GetString("qcow2")
+	output, _ := cmd.Flags().GetString("output")
+	force, _ := cmd.Flags().GetBool("force")
+
+	info, err := os.Stat(image)
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("VISO file not found: %s", image)
+	}
+	repack := compression != "" || level != 0
+	if !repack && qcow2 == "" {
+		return fmt.Errorf("nothing to change; give --compression, --level or --qcow2")
+	}
+	if output == "" {
+		output = image
+	} else if err := checkVisoOutput(output, force); err != nil {
+		return err
+	}
+	qcow2Args, err := visoQcow2Args(qcow2)
+	if err != nil {
+		return err
+	}
+	if compression != "" {
+		if _, err := squashfsLevelArgs(compression, level); err != nil {
+			return err
+		}
+	}
+	before := info.Size()
+
+	if !repack {
+		qemuImg, err := exec.LookPath("qemu-img")
+		if err != nil {
+			return fmt.Errorf("qemu-img not found; install qemu-utils")
+		}
+		fmt.Printf("Converting %s (qcow2 clusters: %s)...\n", image, qcow2)
+		tmp := output + ".tmp"
+		convertArgs := append([]string{"convert", "-f", visoImageFormat(image), "-O", "qcow2"}, qcow2Args...)
+		if out, err := exec.Command(qemuImg, append(convertArgs, image, tmp)...).CombinedOutput(); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+		}
+		if err := os.Rename(tmp, output); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		after, err := os.Stat(output)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\n✓ Recompressed %s\n", output)
+		fmt.Printf("  Image: %s\n", formatSizeChange(before, after.Size()))
+		return nil
+	}
+
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("repacking the root must be run as root, to keep the owners of its files")
+	}
+	img, err := openVisoImage(image)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if !img.Exists(visoRootfsPath) {
+		return fmt.Errorf("%s has no squashfs root (%s)", image, visoRootfsPath)
+	}
+	var signed []string
+	for _, ext := range []string{".sig", ".asc", ".minisig"} {
+		kind := visoSignatureKind(ext)
+		if img.Exists(visoManifestPath+ext) && (len(signed) == 0 || signed[len(signed)-1] != kind) {
+			signed = append(signed, kind)
+		}
+	}
+
+	work, err := os.MkdirTemp(filepath.Dir(output), ".viso-recompress-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+	b := &visoBuild{Output: output, Qcow2: qcow2, Cmdline: "console=ttyS0 VRAM=auto quiet", Version: "1.0.0"}
+	b.Name = strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
+	if m, _, err := readVisoMetadata(image); err == nil {
+		b.Name, b.Version, b.Cmdline = m.Name, m.Version, m.Boot.Cmdline
+	}
+	for _, rel := range []string{visoKernelPath, visoInitramfsPath} {
+		if err := img.Dump(rel, work); err != nil {
+			return err
+		}
+	}
+	b.Kernel = filepath.Join(work, filepath.Base(visoKernelPath))
+	b.Initramfs = filepath.Join(work, filepath.Base(visoInitramfsPath))
+
+	var from string
+	var rootBefore int64
+	if b.Squashfs, from, rootBefore, err = repackVisoRoot(img, work, compression, level); err != nil {
+		return err
+	}
+	b.Compression = compression
+	if b.Compression == "" {
+		b.Compression = from
+	}
+	fmt.Println("")
+
+	_, rootAfter, err := buildVisoImage(b)
+	if err != nil {
+		return err
+	}
+	after, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n✓ Recompressed %s\n", output)
+	fmt.Printf("  Root:  %s, %s\n", formatSizeChange(rootBefore, rootAfter), b.Compression)
+	fmt.Printf("  Image: %s\n", formatSizeChange(before, after.Size()))
+	if len(signed) > 0 {
+		fmt.Printf("\n\033[33mNote:\033[0m the %s signature of the image no longer applies;\n", strings.Join(signed, " and "))
+		fmt.Printf("      sign it again with: mix viso sign %s --key <key>\n", output)
+	}
+	return nil
+}
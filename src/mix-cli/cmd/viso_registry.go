@@ -0,0 +1,757 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Registry
+// ============================================================================
+//
+// "mix viso push" and "mix viso pull" move images through an OCI registry,
+// or a plain HTTPS server, as OCI artifacts: the image file is cut into
+// chunks stored as blobs named by their SHA-256, described by a manifest
+// whose config is the metadata of the image and which also carries its
+// detached signatures. Blobs the other side already has are not sent
+// again, so pushing a new version only uploads the chunks that changed,
+// and an interrupted pull resumes from the chunks it kept in
+// <output>.part/, the last one through an HTTP range request.
+//
+// A reference without a scheme (registry.example.com/mixos/base:1.2) names
+// a repository of an OCI registry, reached over HTTPS (HTTP on localhost).
+// A URL (https://files.example.com/mixos/base:1.2) names a directory of a
+// plain server, which holds manifests/<tag> and blobs/sha256/<hex> and
+// takes them with PUT for push. MIX_REGISTRY_USER and
+// MIX_REGISTRY_PASSWORD give the credentials of either, used for basic
+// authentication or to obtain a bearer token from the registry.
+
+const (
+	ociManifestType       = "application/vnd.oci.image.manifest.v1+json"
+	visoArtifactType      = "application/vnd.mixos.viso.v1"
+	visoConfigType        = "application/vnd.mixos.viso.config.v1+json"
+	visoChunkType         = "application/vnd.mixos.viso.chunk.v1"
+	visoSignatureType     = "application/vnd.mixos.viso.signature.v1"
+	visoChunkSize         = 64 << 20
+	ociTitleAnnotation    = "org.opencontainers.image.title"
+	visoSHA256Annotation  = "org.mixos.viso.sha256"
+	visoVersionAnnotation = "org.opencontainers.image.version"
+)
+
+// ociDescriptor points at a blob
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest describes a pushed image
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// visoRef is where an image is pushed or pulled
+type visoRef struct {
+	OCI  bool
+	Base string // URL of the repository
+	Repo string
+	Tag  string
+}
+
+// visoRegistry talks to the server of a reference
+type visoRegistry struct {
+	Ref       *visoRef
+	Client    *http.Client
+	User      string
+	Password  string
+	ChunkSize int64
+	token     string
+}
+
+var visoPushCmd = &cobra.Command{
+	Use:   "push <viso-file> <reference>",
+	Short: "Push a VISO image to a registry",
+	Long: `Push a VISO image, with its detached signatures, to an OCI registry or a
+plain HTTPS server. The image travels in content-addressed chunks; chunks
+the server already holds, from an earlier version or an interrupted push,
+are not sent again.
+
+A reference without a scheme names a repository of an OCI registry
+(registry.example.com/mixos/base:1.2); an https:// URL names a directory
+of a server that accepts PUT. The tag defaults to latest. Credentials
+come from MIX_REGISTRY_USER and MIX_REGISTRY_PASSWORD.
+
+Sign the image first ("mix viso sign") so pulls can check it.
+
+Examples:
+  mix viso push mixos.viso registry.example.com/mixos/base:1.2
+  mix viso push mixos.viso localhost:5000/mixos/base
+  mix viso push mixos.viso https://files.example.com/images/mixos:1.2`,
+	Args: cobra.ExactArgs(2),
+	RunE: runVisoPush,
+}
+
+var visoPullCmd = &cobra.Command{
+	Use:   "pull <reference>",
+	Short: "Pull a VISO image from a registry",
+	Long: `Pull a VISO image pushed with "mix viso push". Every chunk is checked
+against its checksum, and the whole image against the checksum recorded
+at push; an interrupted pull resumes where it stopped when run again.
+
+The pulled image is then verified as "mix viso verify" does, with its
+detached signatures: --pubkey and --keyring give the keys to check them
+with, and --require-signature refuses an unsigned image. An image that
+fails is removed. --no-verify skips this check.
+
+Examples:
+  mix viso pull registry.example.com/mixos/base:1.2
+  mix viso pull registry.example.com/mixos/base:1.2 -o base.viso \
+      --require-signature --pubkey mixos.pub
+  mix viso pull https://files.example.com/images/mixos:1.2`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoPull,
+}
+
+func init() {
+	visoCmd.AddCommand(visoPushCmd)
+	visoCmd.AddCommand(visoPullCmd)
+	visoPullCmd.Flags().StringP("output", "o", "", "VISO image to write (default: the pushed file name)")
+	visoPullCmd.Flags().Bool("force", false, "overwrite an existing image")
+	visoPullCmd.Flags().String("pubkey", "", "minisign public key to check signatures with")
+	visoPullCmd.Flags().String("keyring", "", "GPG keyring to check signatures with")
+	visoPullCmd.Flags().Bool("require-signature", false, "refuse an image without a valid signature")
+	visoPullCmd.Flags().Bool("no-verify", false, "skip the verification of the pulled image")
+}
+
+// parseVisoRef reads a reference: [scheme://]host[:port]/repository[:tag]
+func parseVisoRef(s string) (*visoRef, error) {
+	ref := &visoRef{OCI: true, Tag: "latest"}
+	scheme := "https"
+	rest := s
+	if i := strings.Index(s, "://"); i >= 0 {
+		scheme, rest = s[:i], s[i+3:]
+		if scheme != "https" && scheme != "http" {
+			return nil, fmt.Errorf("%s: unsupported scheme %q", s, scheme)
+		}
+		ref.OCI = false
+	}
+	host, repo, ok := strings.Cut(rest, "/")
+	if !ok || repo == "" || host == "" {
+		return nil, fmt.Errorf("%s: expected host/repository[:tag]", s)
+	}
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, ref.Tag = repo[:i], repo[i+1:]
+	}
+	if repo == "" || ref.Tag == "" {
+		return nil, fmt.Errorf("%s: expected host/repository[:tag]", s)
+	}
+	if ref.OCI {
+		if !strings.ContainsAny(host, ".:") && host != "localhost" {
+			return nil, fmt.Errorf("%s: %q is not a registry host", s, host)
+		}
+		if repo != strings.ToLower(repo) {
+			return nil, fmt.Errorf("%s: repository names are lowercase", s)
+		}
+		if h := strings.Split(host, ":")[0]; h == "localhost" || h == "127.0.0.1" {
+			scheme = "http"
+		}
+		ref.Base = scheme + "://" + host + "/v2/" + repo
+	} else {
+		ref.Base = scheme + "://" + host + "/" + repo
+	}
+	ref.Repo = repo
+	return ref, nil
+}
+
+// newVisoRegistry returns a client of the server of a reference
+func newVisoRegistry(ref *visoRef) *visoRegistry {
+	return &visoRegistry{
+		Ref:       ref,
+		Client:    http.DefaultClient,
+		User:      os.Getenv("MIX_REGISTRY_USER"),
+		Password:  os.Getenv("MIX_REGISTRY_PASSWORD"),
+		ChunkSize: visoChunkSize,
+	}
+}
+
+// parseAuthChallenge reads a WWW-Authenticate header: its scheme and
+// parameters
+func parseAuthChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key = strings.TrimSpace(key); key != "" {
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return strings.ToLower(scheme), params
+}
+
+// blobURL returns where the blob of a digest is kept
+func (r *visoRegistry) blobURL(digest string) string {
+	if r.Ref.OCI {
+		return r.Ref.Base + "/blobs/" + digest
+	}
+	return r.Ref.Base + "/blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func (r *visoRegistry) manifestURL() string {
+	return r.Ref.Base + "/manifests/" + r.Ref.Tag
+}
+
+// do sends a request with the credentials of the registry
+func (r *visoRegistry) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", "mix/"+version)
+	switch {
+	case r.token != "":
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	case r.User != "":
+		req.SetBasicAuth(r.User, r.Password)
+	}
+	return r.Client.Do(req)
+}
+
+// visoHTTPError describes an unexpected response
+func visoHTTPError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status)
+	if s := strings.TrimSpace(string(msg)); s != "" && !strings.HasPrefix(s, "<") {
+		err = fmt.Errorf("%w: %s", err, s)
+	}
+	return err
+}
+
+// login obtains a bearer token when the registry asks for one
+func (r *visoRegistry) login(push bool) error {
+	if !r.Ref.OCI {
+		return nil
+	}
+	u, _ := url.Parse(r.Ref.Base)
+	req, err := http.NewRequest(http.MethodGet, u.Scheme+"://"+u.Host+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		return fmt.Errorf("registry unreachable: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	scheme, params := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	if scheme == "basic" {
+		if r.User == "" {
+			return fmt.Errorf("%s needs credentials; set MIX_REGISTRY_USER and MIX_REGISTRY_PASSWORD", u.Host)
+		}
+		return nil
+	}
+	if scheme != "bearer" || params["realm"] == "" {
+		return fmt.Errorf("%s: unsupported authentication %q", u.Host, scheme)
+	}
+
+	scope := "repository:" + r.Ref.Repo + ":pull"
+	if push {
+		scope += ",push"
+	}
+	q := url.Values{"scope": {scope}}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	req, err = http.NewRequest(http.MethodGet, params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if r.User != "" {
+		req.SetBasicAuth(r.User, r.Password)
+	}
+	resp, err = r.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to log in to %s: %w", u.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to log in to %s: %w", u.Host, visoHTTPError(resp))
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to log in to %s: %w", u.Host, err)
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	return nil
+}
+
+// hasBlob reports whether the server holds a blob
+func (r *visoRegistry) hasBlob(d ociDescriptor) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, r.blobURL(d.Digest), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength < 0 || resp.ContentLength == d.Size, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, visoHTTPError(resp)
+}
+
+// putBlob uploads a blob, monolithically
+func (r *visoRegistry) putBlob(d ociDescriptor, body io.Reader) error {
+	target := r.blobURL(d.Digest)
+	if r.Ref.OCI {
+		req, err := http.NewRequest(http.MethodPost, r.Ref.Base+"/blobs/uploads/", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := r.do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return visoHTTPError(resp)
+		}
+		loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return fmt.Errorf("invalid upload location: %w", err)
+		}
+		q := loc.Query()
+		q.Set("digest", d.Digest)
+		loc.RawQuery = q.Encode()
+		target = loc.String()
+	}
+	req, err := http.NewRequest(http.MethodPut, target, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = d.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return visoHTTPError(resp)
+	}
+	return nil
+}
+
+// putManifest tags a manifest
+func (r *visoRegistry) putManifest(m *ociManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, r.manifestURL(), strings.NewReader(string(data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ociManifestType)
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return visoHTTPError(resp)
+	}
+	return nil
+}
+
+// getManifest reads the manifest of the tag of the reference
+func (r *visoRegistry) getManifest() (*ociManifest, error) {
+	req, err := http.NewRequest(http.MethodGet, r.manifestURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", ociManifestType)
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s:%s not found", r.Ref.Repo, r.Ref.Tag)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, visoHTTPError(resp)
+	}
+	var m ociManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.ArtifactType != visoArtifactType && m.Config.MediaType != visoConfigType {
+		return nil, fmt.Errorf("%s:%s is not a VISO image", r.Ref.Repo, r.Ref.Tag)
+	}
+	return &m, nil
+}
+
+// fetchBlob downloads a blob into file, going on from what file already
+// holds, and checks its checksum
+func (r *visoRegistry) fetchBlob(d ociDescriptor, file string) error {
+	hexDigest, ok := strings.CutPrefix(d.Digest, "sha256:")
+	if !ok {
+		return fmt.Errorf("unsupported digest %s", d.Digest)
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	have, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if have < d.Size {
+		req, err := http.NewRequest(http.MethodGet, r.blobURL(d.Digest), nil)
+		if err != nil {
+			return err
+		}
+		if have > 0 {
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(have, 10)+"-")
+		}
+		resp, err := r.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// The server sends it all again
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		default:
+			return visoHTTPError(resp)
+		}
+		if _, err := io.Copy(f, resp.Body); err != nil {
+			return fmt.Errorf("download of %s interrupted: %w", d.Digest, err)
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if size != d.Size || hex.EncodeToString(h.Sum(nil)) != hexDigest {
+		f.Close()
+		os.Remove(file)
+		return fmt.Errorf("%s does not match its checksum; it was discarded", d.Digest)
+	}
+	return nil
+}
+
+// visoChunks cuts an image into chunks and returns their descriptors and
+// the checksum of the whole image
+func visoChunks(f io.ReaderAt, size, chunkSize int64) ([]ociDescriptor, string, error) {
+	var chunks []ociDescriptor
+	whole := sha256.New()
+	for off := int64(0); off < size; off += chunkSize {
+		n := min(chunkSize, size-off)
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(h, whole), io.NewSectionReader(f, off, n)); err != nil {
+			return nil, "", err
+		}
+		chunks = append(chunks, ociDescriptor{
+			MediaType: visoChunkType,
+			Digest:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+			Size:      n,
+		})
+	}
+	return chunks, hex.EncodeToString(whole.Sum(nil)), nil
+}
+
+// visoBlobDescriptor describes data as a blob
+func visoBlobDescriptor(mediaType string, data []byte) ociDescriptor {
+	sum := sha256.Sum256(data)
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+}
+
+// pushVisoImage pushes an image and its detached signatures and tags it;
+// blobs the server holds are skipped
+func pushVisoImage(r *visoRegistry, image string) (*ociManifest, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, fmt.Errorf("VISO file not found: %s", image)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	config := []byte("{}")
+	m := &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  visoArtifactType,
+		Annotations:   map[string]string{ociTitleAnnotation: filepath.Base(image)},
+	}
+	if metadata, _, err := readVisoMetadata(image); err == nil {
+		if config, err = json.Marshal(metadata); err != nil {
+			return nil, err
+		}
+		m.Annotations[visoVersionAnnotation] = metadata.Version
+	}
+	m.Config = visoBlobDescriptor(visoConfigType, config)
+
+	fmt.Printf("Hashing %s (%s)...\n", image, formatSize(info.Size()))
+	chunks, sum, err := visoChunks(f, info.Size(), r.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	m.Annotations[visoSHA256Annotation] = sum
+	m.Layers = chunks
+	sigs := map[string][]byte{}
+	for _, ext := range []string{".sig", ".asc", ".minisig"} {
+		if data, err := os.ReadFile(image + ext); err == nil {
+			d := visoBlobDescriptor(visoSignatureType, data)
+			d.Annotations = map[string]string{ociTitleAnnotation: filepath.Base(image) + ext}
+			m.Layers = append(m.Layers, d)
+			sigs[d.Digest] = data
+		}
+	}
+
+	if err := r.login(true); err != nil {
+		return nil, err
+	}
+	blobs := append([]ociDescriptor{m.Config}, m.Layers...)
+	var chunk int64
+	for i, d := range blobs {
+		label := fmt.Sprintf("  [%d/%d] %s", i+1, len(blobs), d.Digest[:19])
+		exists, err := r.hasBlob(d)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			fmt.Printf("%s already there\n", label)
+		} else {
+			var body io.Reader
+			switch d.MediaType {
+			case visoConfigType:
+				body = strings.NewReader(string(config))
+			case visoSignatureType:
+				body = strings.NewReader(string(sigs[d.Digest]))
+			default:
+				body = io.NewSectionReader(f, chunk, d.Size)
+			}
+			if err := r.putBlob(d, body); err != nil {
+				return nil, err
+			}
+			fmt.Printf("%s pushed (%s)\n", label, formatSize(d.Size))
+		}
+		if d.MediaType == visoChunkType {
+			chunk += d.Size
+		}
+	}
+	if err := r.putManifest(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// pullVisoImage downloads an image into output, resuming from the chunks
+// kept in output.part/, and writes its detached signatures next to it
+func pullVisoImage(r *visoRegistry, output string) (*ociManifest, error) {
+	if err := r.login(false); err != nil {
+		return nil, err
+	}
+	m, err := r.getManifest()
+	if err != nil {
+		return nil, err
+	}
+	part := output + ".part"
+	if err := os.MkdirAll(part, 0755); err != nil {
+		return nil, err
+	}
+
+	var chunks []string
+	sigs := map[string]string{}
+	for i, d := range m.Layers {
+		name := strings.TrimPrefix(d.Digest, "sha256:")
+		if name == d.Digest || strings.ContainsAny(name, "/.") {
+			return nil, fmt.Errorf("unsupported digest %s", d.Digest)
+		}
+		file := filepath.Join(part, name)
+		label := fmt.Sprintf("  [%d/%d] %s", i+1, len(m.Layers), d.Digest[:19])
+		if info, err := os.Stat(file); err == nil && info.Size() == d.Size {
+			fmt.Printf("%s already there\n", label)
+		} else {
+			fmt.Printf("%s (%s)\n", label, formatSize(d.Size))
+		}
+		if err := r.fetchBlob(d, file); err != nil {
+			return nil, err
+		}
+		switch d.MediaType {
+		case visoChunkType:
+			chunks = append(chunks, file)
+		case visoSignatureType:
+			ext := path.Ext(d.Annotations[ociTitleAnnotation])
+			if visoSignatureKind(ext) != "" {
+				sigs[ext] = file
+			}
+		}
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("%s:%s holds no image", r.Ref.Repo, r.Ref.Tag)
+	}
+
+	fmt.Println("Assembling the image...")
+	tmp := output + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	for _, file := range chunks {
+		in, err := os.Open(file)
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return nil, err
+		}
+		_, err = io.Copy(io.MultiWriter(out, h), in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return nil, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if want := m.Annotations[visoSHA256Annotation]; want != "" && hex.EncodeToString(h.Sum(nil)) != want {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("the assembled image does not match the checksum recorded at push")
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	for ext, file := range sigs {
+		if err := copyVisoFile(file, output+ext); err != nil {
+			return nil, err
+		}
+	}
+	os.RemoveAll(part)
+	return m, nil
+}
+
+func runVisoPush(cmd *cobra.Command, args []string) error {
+	image := args[0]
+	if info, err := os.Stat(image); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("VISO file not found: %s", image)
+	}
+	ref, err := parseVisoRef(args[1])
+	if err != nil {
+		return err
+	}
+	m, err := pushVisoImage(newVisoRegistry(ref), image)
+	if err != nil {
+		return fmt.Errorf("push failed: %w", err)
+	}
+	signatures := len(m.Layers)
+	for _, d := range m.Layers {
+		if d.MediaType == visoChunkType {
+			signatures--
+		}
+	}
+	fmt.Printf("\n✓ Pushed %s to %s:%s\n", image, ref.Repo, ref.Tag)
+	fmt.Printf("  %d chunk(s), %d signature(s), sha256 %s\n", len(m.Layers)-signatures, signatures, m.Annotations[visoSHA256Annotation])
+	if signatures == 0 {
+		fmt.Println("  The image is unsigned; pulls cannot check where it comes from (see mix viso sign)")
+	}
+	return nil
+}
+
+func runVisoPull(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	force, _ := cmd.Flags().GetBool("force")
+	pubkey, _ := cmd.Flags().GetString("pubkey")
+	keyring, _ := cmd.Flags().GetString("keyring")
+	requireSignature, _ := cmd.Flags().GetBool("require-signature")
+	noVerify, _ := cmd.Flags().GetBool("no-verify")
+
+	ref, err := parseVisoRef(args[0])
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = path.Base(ref.Repo) + ".viso"
+	}
+	if err := checkVisoOutput(output, force); err != nil {
+		return err
+	}
+
+	fmt.Printf("Pulling %s:%s\n", ref.Repo, ref.Tag)
+	m, err := pullVisoImage(newVisoRegistry(ref), output)
+	if err != nil {
+		return fmt.Errorf("pull failed: %w (run the pull again to resume)", err)
+	}
+	fmt.Printf("\n✓ Pulled %s (sha256 %s)\n\n", output, m.Annotations[visoSHA256Annotation])
+	if noVerify {
+		return nil
+	}
+
+	passed, err := verifyVisoImage(output, keyring, pubkey, requireSignature)
+	if err == nil && !passed {
+		err = fmt.Errorf("the pulled image failed verification")
+	}
+	if err != nil {
+		os.Remove(output)
+		for _, ext := range []string{".sig", ".asc", ".minisig"} {
+			os.Remove(output + ext)
+		}
+		return fmt.Errorf("%w; %s was removed", err, output)
+	}
+	return nil
+}
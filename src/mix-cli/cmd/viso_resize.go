@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Resize
+// ============================================================================
+//
+// "mix viso resize" grows the disk of an image and, unless told not to,
+// the ext4 filesystem on it, where the changes "mix vram sync" saves and
+// the rest of the persistent state live (mixos/vram). The filesystem is
+// grown offline with resize2fs on the raw copy visoImage keeps of a qcow2
+// image, so neither root nor a mount is needed. Images only grow.
+
+var visoResizeCmd = &cobra.Command{
+	Use:   "resize <viso-file> <size>",
+	Short: "Grow a VISO image",
+	Long: `Grow the disk of a VISO image, and the filesystem on it so the space can
+be used for persistent storage: the changes saved by "mix vram sync",
+hibernation and the other state kept in mixos/ on the VISO disk.
+
+The size is absolute (8G) or relative to the current size (+4G), with a
+K, M, G or T suffix; a bare number is in megabytes. Images cannot shrink.
+--no-filesystem only grows the disk, leaving the new space unused.
+
+The image must not be mounted or running. Requires qemu-img for qcow2
+images, and resize2fs and e2fsck (e2fsprogs) to grow the filesystem.
+
+Examples:
+  mix viso resize mixos.viso +4G
+  mix viso resize mixos.viso 16G
+  mix viso resize mixos.viso +10G --no-filesystem`,
+	Args: cobra.ExactArgs(2),
+	RunE: runVisoResize,
+}
+
+func init() {
+	visoCmd.AddCommand(visoResizeCmd)
+	visoResizeCmd.Flags().Bool("no-filesystem", false, "grow the disk only, not its filesystem")
+}
+
+// visoDiskSize returns the size of the disk of an image: the virtual size
+// of a qcow2 image, the file size of a raw one
+func visoDiskSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, 32)
+	n, err := io.ReadFull(f, header)
+	if err == nil && bytes.Equal(header[:4], visoQcow2Magic) {
+		return int64(binary.BigEndian.Uint64(header[24:32])), nil
+	}
+	if err != nil && n < 4 {
+		return 0, fmt.Errorf("%s is empty", path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// parseVisoResize returns the new size of a disk of current bytes, from
+// an absolute size or one relative to it, rounded up to a megabyte
+func parseVisoResize(arg string, current int64) (int64, error) {
+	rel := strings.HasPrefix(arg, "+")
+	mb, err := parseSizeMB(strings.TrimPrefix(arg, "+"))
+	if err != nil {
+		return 0, err
+	}
+	size := mb << 20
+	if rel {
+		size += current
+	}
+	size = (size + 1<<20 - 1) &^ (1<<20 - 1)
+	if size <= current {
+		return 0, fmt.Errorf("the image is already %s; images can only grow", formatSize(current))
+	}
+	return size, nil
+}
+
+// growVisoFilesystem grows the ext4 filesystem of a raw image to fill it
+func growVisoFilesystem(raw string) error {
+	tools, err := visoTools("e2fsck", "resize2fs")
+	if err != nil {
+		return err
+	}
+	// resize2fs wants a freshly checked filesystem; e2fsck exits 1 when it
+	// fixed something
+	if out, err := exec.Command(tools["e2fsck"], "-f", "-p", raw).CombinedOutput(); err != nil {
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() > 1 {
+			return fmt.Errorf("e2fsck failed: %s", strings.TrimSpace(string(out)))
+		}
+	}
+	if out, err := exec.Command(tools["resize2fs"], raw).CombinedOutput(); err != nil {
+		return fmt.Errorf("resize2fs failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// readVisoSuperblock reads the ext4 superblock of a raw image
+func readVisoSuperblock(raw string) (*extSuperblock, error) {
+	f, err := os.Open(raw)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sb := make([]byte, 1024)
+	if _, err := f.ReadAt(sb, 1024); err != nil {
+		return nil, err
+	}
+	return parseExtSuperblock(sb)
+}
+
+func runVisoResize(cmd *cobra.Command, args []string) error {
+	image := args[0]
+	noFilesystem, _ := cmd.Flags().GetBool("no-filesystem")
+
+	info, err := os.Stat(image)
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("VISO file not found: %s", image)
+	}
+	if abs, err := filepath.Abs(image); err == nil {
+		for _, m := range loadVisoMounts() {
+			if m.Image == abs {
+				return fmt.Errorf("%s is mounted on %s; unmount it first", image, m.Mountpoint)
+			}
+		}
+	}
+	current, err := visoDiskSize(image)
+	if err != nil {
+		return err
+	}
+	size, err := parseVisoResize(args[1], current)
+	if err != nil {
+		return err
+	}
+	format := visoImageFormat(image)
+
+	if noFilesystem {
+		if format == "qcow2" {
+			qemuImg, err := exec.LookPath("qemu-img")
+			if err != nil {
+				return fmt.Errorf("qemu-img not found; install qemu-utils")
+			}
+			if out, err := exec.Command(qemuImg, "resize", "-f", "qcow2", image, fmt.Sprint(size)).CombinedOutput(); err != nil {
+				return fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+			}
+		} else if err := os.Truncate(image, size); err != nil {
+			return err
+		}
+		fmt.Printf("✓ Resized %s: %s\n", image, formatSizeChange(current, size))
+		fmt.Println("  The filesystem was left as it was; the new space is unused")
+		return nil
+	}
+
+	img, err := openVisoImage(image)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	before, err := readVisoSuperblock(img.raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", image, err)
+	}
+
+	fmt.Printf("Growing the disk to %s...\n", formatSize(size))
+	if err := os.Truncate(img.raw, size); err != nil {
+		return err
+	}
+	fmt.Println("Growing the filesystem...")
+	if err := growVisoFilesystem(img.raw); err != nil {
+		if format == "raw" {
+			os.Truncate(image, current)
+		}
+		return err
+	}
+	after, err := readVisoSuperblock(img.raw)
+	if err != nil {
+		return err
+	}
+	if format == "qcow2" {
+		fmt.Println("Writing the image...")
+		img.dirty = true
+		if err := img.Save(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("\n✓ Resized %s: %s\n", image, formatSizeChange(current, size))
+	fmt.Printf("  Filesystem: %s, %s free (was %s free)\n", formatSize(after.Bytes), formatSize(after.FreeBytes), formatSize(before.FreeBytes))
+	return nil
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// ============================================================================
+// VISO Run
+// ============================================================================
+//
+// "mix viso boot --run" starts the QEMU command "mix viso boot" prints.
+// An image has no boot loader of its own, so its kernel and initramfs are
+// copied out of it for -kernel and -initrd. QEMU gets the terminal: with
+// -nographic the serial console of the guest is multiplexed on stdio, and
+// Ctrl-A X quits. The terminal is restored and the copies removed however
+// QEMU ends.
+
+const visoKVMDevice = "/dev/kvm"
+
+// visoKVMAvailable reports whether KVM acceleration can be used
+func visoKVMAvailable() bool {
+	f, err := os.OpenFile(visoKVMDevice, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// runVisoQemu boots an image in QEMU on the current terminal and waits for
+// it to exit
+func runVisoQemu(b *visoBoot) error {
+	m := b.machine()
+	qemu, err := exec.LookPath(m.Qemu)
+	if err != nil {
+		return fmt.Errorf("%s not found; install %s", m.Qemu, m.Package)
+	}
+	if err := checkVisoUnused(b.Image); err != nil {
+		return err
+	}
+	if b.KVM && !visoKVMAvailable() {
+		fmt.Printf("\033[33mWarning:\033[0m %s is not available; running without KVM (slow)\n", visoKVMDevice)
+		b.KVM = false
+	}
+	if meta, _, err := readVisoMetadata(b.Image); err == nil && b.VRAM {
+		if mb, err := parseSizeMB(b.Memory); err == nil && mb < int64(meta.Requirements.VramMinRamMB) {
+			fmt.Printf("\033[33mWarning:\033[0m VRAM mode needs %d MB of RAM and the machine has %s;\n", meta.Requirements.VramMinRamMB, b.Memory)
+			fmt.Println("         the image will boot from disk")
+		}
+	}
+
+	tmp, err := os.MkdirTemp("", "viso-run-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	run := *b
+	var img *visoImage
+	if b.Encryption != "" {
+		pass, err := readVisoPassphrase(b.PassphraseFile, false, b.Image)
+		if err != nil {
+			return err
+		}
+		if run.Secret, err = writeVisoSecret(tmp, pass); err != nil {
+			return err
+		}
+		fmt.Println("Unlocking the image...")
+		img, err = openEncryptedVisoImage(b.Image, run.Secret)
+	} else {
+		img, err = openVisoImage(b.Image)
+	}
+	if err != nil {
+		return err
+	}
+	for _, rel := range []string{visoKernelPath, visoInitramfsPath} {
+		if err := img.Dump(rel, tmp); err != nil {
+			img.Close()
+			return fmt.Errorf("%s: %w", b.Image, err)
+		}
+	}
+	img.Close()
+	run.Kernel = filepath.Join(tmp, filepath.Base(visoKernelPath))
+	run.Initramfs = filepath.Join(tmp, filepath.Base(visoInitramfsPath))
+
+	c := exec.Command(qemu, visoQemuArgs(&run)...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	// QEMU puts the terminal in raw mode, and may not get to restore it
+	fd := int(os.Stdin.Fd())
+	if state, err := term.GetState(fd); err == nil {
+		defer term.Restore(fd, state)
+	}
+	// Ctrl-C goes to the guest; a SIGTERM stops QEMU
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	fmt.Printf("Booting %s (serial console on this terminal, Ctrl-A X to quit)\n\n", b.Image)
+	if err := c.Start(); err != nil {
+		return fmt.Errorf("failed to start QEMU: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	for {
+		select {
+		case sig := <-signals:
+			if sig != os.Interrupt {
+				c.Process.Signal(syscall.SIGTERM)
+			}
+		case err := <-done:
+			fmt.Println("")
+			if err != nil {
+				return fmt.Errorf("QEMU exited: %w", err)
+			}
+			fmt.Println("✓ QEMU exited")
+			return nil
+		}
+	}
+}
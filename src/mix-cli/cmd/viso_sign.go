@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Sign
+// ============================================================================
+//
+// "mix viso sign" signs the manifest inside an image and stores the
+// signature next to it in config/, where "mix viso verify" and the
+// initramfs look for it: the manifest covers the kernel, the initramfs,
+// the root and the metadata through their checksums, and the signature
+// travels with the image. --detached signs the whole image file instead,
+// into <image>.sig or <image>.minisig, for images published as they are.
+//
+// The key is a minisign secret key, or for GPG a secret key file or the ID
+// of a key of your keyring. The initramfs only checks minisign signatures,
+// with the public key built into it.
+
+var visoSignCmd = &cobra.Command{
+	Use:   "sign <viso-file>",
+	Short: "Sign a VISO image",
+	Long: `Sign the manifest of a VISO image and store the signature in the image,
+where "mix viso verify" and the boot path check it. The contents must
+match the manifest; an image that fails verification is not signed.
+
+--key is a minisign secret key (minisign -G), a GPG secret key file, or
+the ID of a key in your GPG keyring. The passphrase of the key is asked
+for when needed.
+
+--detached signs the whole image file instead and writes the signature
+next to it, as <image>.sig (GPG) or <image>.minisig (minisign).
+
+To have the system refuse images that are not signed by you at boot,
+build the initramfs with your minisign public key (VISO_PUBKEY=mixos.pub).
+
+Examples:
+  mix viso sign mixos.viso --key ~/.minisign/mixos.key
+  mix viso sign mixos.viso --key releases@mixos-go.org
+  mix viso sign mixos.viso --key ~/.minisign/mixos.key --detached`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoSign,
+}
+
+func init() {
+	visoCmd.AddCommand(visoSignCmd)
+	visoSignCmd.Flags().String("key", "", "minisign secret key, GPG secret key file or GPG key ID")
+	visoSignCmd.Flags().Bool("detached", false, "sign the whole image into a file next to it")
+	visoSignCmd.MarkFlagRequired("key")
+}
+
+// visoKeyKind tells whether key is a minisign secret key or a GPG key
+func visoKeyKind(key string) string {
+	data, err := os.ReadFile(key)
+	if err == nil && bytes.HasPrefix(data, []byte("untrusted comment:")) && bytes.Contains(data, []byte("minisign")) {
+		return "minisign"
+	}
+	return "gpg"
+}
+
+// visoSignatureExt is the extension of the signatures of each kind
+func visoSignatureExt(kind string) string {
+	if kind == "minisign" {
+		return ".minisig"
+	}
+	return ".sig"
+}
+
+// signVisoFile writes a detached signature of data to sig. A GPG key file
+// is imported into a keyring of its own for the occasion.
+func signVisoFile(kind, key, data, sig string) error {
+	var c *exec.Cmd
+	switch kind {
+	case "minisign":
+		minisign, err := exec.LookPath("minisign")
+		if err != nil {
+			return fmt.Errorf("minisign not found")
+		}
+		c = exec.Command(minisign, "-S", "-s", key, "-m", data, "-x", sig)
+	default:
+		gpg, err := exec.LookPath("gpg")
+		if err != nil {
+			return fmt.Errorf("gpg not found")
+		}
+		args := []string{"--yes", "--detach-sign", "--output", sig}
+		if _, err := os.Stat(key); err == nil {
+			home, err := os.MkdirTemp("", "viso-gnupg-")
+			if err != nil {
+				return err
+			}
+			defer func() {
+				exec.Command("gpgconf", "--homedir", home, "--kill", "all").Run()
+				os.RemoveAll(home)
+			}()
+			if out, err := exec.Command(gpg, "--homedir", home, "--batch", "--import", key).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to import %s: %s", key, bytes.TrimSpace(out))
+			}
+			args = append([]string{"--homedir", home}, args...)
+		} else {
+			args = append(args, "--local-user", key)
+		}
+		c = exec.Command(gpg, append(args, data)...)
+	}
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("%s failed to sign: %w", kind, err)
+	}
+	return nil
+}
+
+// signVisoManifest signs the manifest of an image and stores the
+// signature in it
+func signVisoManifest(path, kind, key string) (string, error) {
+	img, err := openVisoImage(path)
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+
+	manifest, err := img.ReadFile(visoManifestPath)
+	if err != nil {
+		return "", fmt.Errorf("%s has no manifest (%s); rebuild it with \"mix viso create\"", path, visoManifestPath)
+	}
+	fmt.Println("Checking contents:")
+	failed, err := checkVisoManifest(img, manifest)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest: %w", err)
+	}
+	if failed > 0 {
+		return "", fmt.Errorf("not signing: %d file(s) do not match the manifest", failed)
+	}
+
+	tmp, err := os.MkdirTemp("", "viso-sign-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	data := filepath.Join(tmp, "manifest.sha256")
+	sig := data + visoSignatureExt(kind)
+	if err := os.WriteFile(data, manifest, 0644); err != nil {
+		return "", err
+	}
+	fmt.Println("")
+	if err := signVisoFile(kind, key, data, sig); err != nil {
+		return "", err
+	}
+	signature, err := os.ReadFile(sig)
+	if err != nil {
+		return "", err
+	}
+	rel := visoManifestPath + visoSignatureExt(kind)
+	if err := img.WriteFile(rel, signature); err != nil {
+		return "", err
+	}
+	if err := img.Save(); err != nil {
+		return "", err
+	}
+	return rel, nil
+}
+
+func runVisoSign(cmd *cobra.Command, args []string) error {
+	path := args[0]
+	key, _ := cmd.Flags().GetString("key")
+	detached, _ := cmd.Flags().GetBool("detached")
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("VISO file not found: %s", path)
+	}
+	kind := visoKeyKind(key)
+
+	if detached {
+		sig := path + visoSignatureExt(kind)
+		if err := signVisoFile(kind, key, path, sig); err != nil {
+			return err
+		}
+		fmt.Printf("\n✓ Signed %s (%s): %s\n", path, kind, sig)
+		fmt.Println("  Re-sign after changing the image; the signature covers the whole file.")
+		return nil
+	}
+
+	rel, err := signVisoManifest(path, kind, key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n✓ Signed %s (%s): %s\n", path, kind, rel)
+	for _, ext := range []string{".sig", ".asc", ".minisig"} {
+		if _, err := os.Stat(path + ext); err == nil {
+			fmt.Printf("  \033[33m%s no longer matches the image; sign it again with --detached\033[0m\n", path+ext)
+		}
+	}
+	fmt.Printf("  Check it with: mix viso verify %s\n", path)
+	return nil
+}
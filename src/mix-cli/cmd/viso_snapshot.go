@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Snapshots
+// ============================================================================
+//
+// "mix viso snapshot" wraps the internal snapshots of qcow2 images, kept
+// inside the image file itself, so trying something on an image (booting
+// it, "mix vram sync", installing packages) has an easy undo. Snapshots
+// are listed from "qemu-img info --output=json". Commands that rewrite an
+// image from its raw contents (sign, resize, recompress) do not carry its
+// snapshots over.
+
+// visoSnapshot is an internal snapshot of a qcow2 image
+type visoSnapshot struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	DateSec int64  `json:"date-sec"`
+}
+
+var visoSnapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage the internal snapshots of a VISO image",
+	Long: `Create, list, revert to and delete snapshots kept inside a qcow2 VISO
+image, to go back to a known state of the image after experimenting
+with it.
+
+The image must not be running or mounted read-write. Raw images have no
+snapshots; convert them first with "mix viso recompress --qcow2 zlib".
+Signing, resizing or recompressing an image drops its snapshots.
+
+Requires qemu-img.
+
+Examples:
+  mix viso snapshot create mixos.viso before-upgrade
+  mix viso snapshot list mixos.viso
+  mix viso snapshot revert mixos.viso before-upgrade
+  mix viso snapshot delete mixos.viso before-upgrade`,
+}
+
+var visoSnapshotCreateCmd = &cobra.Command{
+	Use:   "create <viso-file> <name>",
+	Short: "Take a snapshot of an image",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runVisoSnapshotCreate,
+}
+
+var visoSnapshotListCmd = &cobra.Command{
+	Use:   "list <viso-file>",
+	Short: "List the snapshots of an image",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runVisoSnapshotList,
+}
+
+var visoSnapshotRevertCmd = &cobra.Command{
+	Use:   "revert <viso-file> <name>",
+	Short: "Bring an image back to a snapshot",
+	Long: `Bring an image back to the state of a snapshot. What changed in the
+image since the snapshot was taken is lost; the snapshot itself is kept.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runVisoSnapshotRevert,
+}
+
+var visoSnapshotDeleteCmd = &cobra.Command{
+	Use:   "delete <viso-file> <name>",
+	Short: "Delete a snapshot of an image",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runVisoSnapshotDelete,
+}
+
+func init() {
+	visoCmd.AddCommand(visoSnapshotCmd)
+	visoSnapshotCmd.AddCommand(visoSnapshotCreateCmd)
+	visoSnapshotCmd.AddCommand(visoSnapshotListCmd)
+	visoSnapshotCmd.AddCommand(visoSnapshotRevertCmd)
+	visoSnapshotCmd.AddCommand(visoSnapshotDeleteCmd)
+	visoSnapshotRevertCmd.Flags().BoolP("yes", "y", false, "assume yes to all prompts")
+}
+
+// parseVisoSnapshots reads the snapshots out of qemu-img info JSON
+func parseVisoSnapshots(data []byte) ([]visoSnapshot, error) {
+	var info struct {
+		Format    string         `json:"format"`
+		Snapshots []visoSnapshot `json:"snapshots"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid qemu-img output: %w", err)
+	}
+	if info.Format != "qcow2" {
+		return nil, fmt.Errorf("snapshots need a qcow2 image, not %s; convert it with \"mix viso recompress --qcow2 zlib\"", info.Format)
+	}
+	return info.Snapshots, nil
+}
+
+// findVisoSnapshot returns the snapshot of a name
+func findVisoSnapshot(snapshots []visoSnapshot, name string) (visoSnapshot, bool) {
+	for _, s := range snapshots {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return visoSnapshot{}, false
+}
+
+// visoSnapshots checks that an image can take snapshots and lists them
+func visoSnapshots(image string) (string, []visoSnapshot, error) {
+	if info, err := os.Stat(image); err != nil || !info.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("VISO file not found: %s", image)
+	}
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return "", nil, fmt.Errorf("qemu-img not found; install qemu-utils")
+	}
+	if visoImageFormat(image) != "qcow2" {
+		return "", nil, fmt.Errorf("%s is a raw image without snapshots; convert it with \"mix viso recompress %s --qcow2 zlib\"", image, image)
+	}
+	out, err := exec.Command(qemuImg, "info", "--output=json", "-U", image).Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("qemu-img failed to read %s", image)
+	}
+	snapshots, err := parseVisoSnapshots(out)
+	return qemuImg, snapshots, err
+}
+
+// checkVisoUnused refuses an image mounted read-write, whose snapshots
+// would not match what the filesystem holds
+func checkVisoUnused(image string) error {
+	abs, err := filepath.Abs(image)
+	if err != nil {
+		return err
+	}
+	for _, m := range loadVisoMounts() {
+		if m.Image == abs && m.ReadWrite {
+			return fmt.Errorf("%s is mounted read-write on %s; unmount it first", image, m.Mountpoint)
+		}
+	}
+	return nil
+}
+
+// runVisoSnapshotOp runs qemu-img snapshot with an option on an image
+func runVisoSnapshotOp(qemuImg, op, name, image string) error {
+	if out, err := exec.Command(qemuImg, "snapshot", op, name, image).CombinedOutput(); err != nil {
+		return fmt.Errorf("qemu-img failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func runVisoSnapshotCreate(cmd *cobra.Command, args []string) error {
+	image, name := args[0], args[1]
+	if err := checkVisoUnused(image); err != nil {
+		return err
+	}
+	qemuImg, snapshots, err := visoSnapshots(image)
+	if err != nil {
+		return err
+	}
+	if _, ok := findVisoSnapshot(snapshots, name); ok {
+		return fmt.Errorf("%s already has a snapshot %q", image, name)
+	}
+	if err := runVisoSnapshotOp(qemuImg, "-c", name, image); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Created snapshot %q of %s\n", name, image)
+	fmt.Printf("  Go back to it with: mix viso snapshot revert %s %s\n", image, name)
+	return nil
+}
+
+func runVisoSnapshotList(cmd *cobra.Command, args []string) error {
+	image := args[0]
+	_, snapshots, err := visoSnapshots(image)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		fmt.Printf("%s has no snapshots\n", image)
+		return nil
+	}
+	fmt.Printf("Snapshots of %s:\n\n", image)
+	fmt.Printf("  %-4s %-24s %s\n", "ID", "NAME", "TAKEN")
+	for _, s := range snapshots {
+		fmt.Printf("  %-4s %-24s %s\n", s.ID, s.Name, time.Unix(s.DateSec, 0).Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("\n%d snapshot(s)\n", len(snapshots))
+	return nil
+}
+
+func runVisoSnapshotRevert(cmd *cobra.Command, args []string) error {
+	image, name := args[0], args[1]
+	yes, _ := cmd.Flags().GetBool("yes")
+	if err := checkVisoUnused(image); err != nil {
+		return err
+	}
+	qemuImg, snapshots, err := visoSnapshots(image)
+	if err != nil {
+		return err
+	}
+	s, ok := findVisoSnapshot(snapshots, name)
+	if !ok {
+		return fmt.Errorf("%s has no snapshot %q", image, name)
+	}
+
+	if !yes {
+		fmt.Printf("Changes made to %s since %s will be lost.\n", image, time.Unix(s.DateSec, 0).Format("2006-01-02 15:04:05"))
+		fmt.Print("\nProceed with revert? [y/N] ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Revert cancelled.")
+			return nil
+		}
+	}
+	if err := runVisoSnapshotOp(qemuImg, "-a", name, image); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Reverted %s to snapshot %q\n", image, name)
+	return nil
+}
+
+func runVisoSnapshotDelete(cmd *cobra.Command, args []string) error {
+	image, name := args[0], args[1]
+	qemuImg, snapshots, err := visoSnapshots(image)
+	if err != nil {
+		return err
+	}
+	if _, ok := findVisoSnapshot(snapshots, name); !ok {
+		return fmt.Errorf("%s has no snapshot %q", image, name)
+	}
+	if err := runVisoSnapshotOp(qemuImg, "-d", name, image); err != nil {
+		return err
+	}
+	fmt.Printf("✓ Deleted snapshot %q of %s\n", name, image)
+	return nil
+}
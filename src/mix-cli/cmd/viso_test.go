@@ -0,0 +1,957 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVisoCreate(t *testing.T) {
+	m := newVisoMetadata("MixOS-GO", "1.1.0", "zstd", "console=ttyS0", 300<<20)
+	if m.Rootfs.Path != "rootfs/rootfs.squashfs" || m.Boot.Kernel != "boot/vmlinuz-mixos" || m.Rootfs.Compression != "zstd" {
+		t.Errorf("metadata layout = %+v", m)
+	}
+	if m.Requirements.VramMinRamMB != 2048 {
+		t.Errorf("VramMinRamMB for a small root = %d, expected 2048", m.Requirements.VramMinRamMB)
+	}
+	if m := newVisoMetadata("", "", "xz", "", 1500<<20); m.Requirements.VramMinRamMB != 1500*2+512 {
+		t.Errorf("VramMinRamMB for a 1500MB root = %d, expected %d", m.Requirements.VramMinRamMB, 1500*2+512)
+	}
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "rootfs"), 0755)
+	os.WriteFile(filepath.Join(dir, "rootfs/rootfs.squashfs"), make([]byte, 50<<20), 0644)
+	if got, err := visoImageSizeMB(dir); err != nil || got != 50+5+100 {
+		t.Errorf("visoImageSizeMB = %d, %v, expected %d", got, err, 155)
+	}
+
+	parts := visoBootCommand(&visoBoot{Image: "out/mixos.viso", Memory: "4G", VRAM: true, Kernel: "vmlinuz", Initramfs: "init.img"})
+	line := strings.Join(parts, " ")
+	for _, want := range []string{"-kernel vmlinuz", "-initrd init.img", "VRAM=auto", "SDISK=mixos.VISO", "-m 4G"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("boot command %q lacks %q", line, want)
+		}
+	}
+	if strings.Contains(line, "-enable-kvm") {
+		t.Errorf("boot command %q enables KVM", line)
+	}
+}
+
+func TestVisoVerify(t *testing.T) {
+	dir := t.TempDir()
+	for _, rel := range visoManifestFiles {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(dir, rel), []byte(rel+"\n"), 0644)
+	}
+	if err := writeVisoManifest(dir); err != nil {
+		t.Fatal(err)
+	}
+	img, err := openVisoImage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := img.ReadFile(visoManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed, err := checkVisoManifest(img, manifest); err != nil || failed != 0 {
+		t.Errorf("checkVisoManifest of an intact image = %d, %v", failed, err)
+	}
+	os.WriteFile(filepath.Join(dir, visoKernelPath), []byte("tampered\n"), 0644)
+	os.Remove(filepath.Join(dir, visoMetadataPath))
+	if failed, _ := checkVisoManifest(img, manifest); failed != 2 {
+		t.Errorf("checkVisoManifest of a tampered image = %d failures, expected 2", failed)
+	}
+
+	for path, kind := range map[string]string{"a.viso.sig": "gpg", "a.viso.asc": "gpg", "a.viso.minisig": "minisign", "a.viso": ""} {
+		if got := visoSignatureKind(path); got != kind {
+			t.Errorf("visoSignatureKind(%q) = %q, expected %q", path, got, kind)
+		}
+	}
+
+	good := "[GNUPG:] NEWSIG\n[GNUPG:] GOODSIG 0123456789ABCDEF Test Signer <t@example.com>\n[GNUPG:] VALIDSIG ...\n"
+	if signer, err := parseGPGStatus(good, nil, ""); err != nil || signer != "Test Signer <t@example.com>" {
+		t.Errorf("parseGPGStatus(good) = %q, %v", signer, err)
+	}
+	for _, status := range []string{
+		"[GNUPG:] BADSIG 0123456789ABCDEF Test Signer\n",
+		"[GNUPG:] ERRSIG 0123456789ABCDEF 22 10 00 1700000000 9\n[GNUPG:] NO_PUBKEY 0123456789ABCDEF\n",
+		"",
+	} {
+		if _, err := parseGPGStatus(status, nil, ""); err == nil {
+			t.Errorf("parseGPGStatus(%q) accepted the signature", status)
+		}
+	}
+}
+
+func TestVisoSign(t *testing.T) {
+	dir := t.TempDir()
+	key := filepath.Join(dir, "mixos.key")
+	os.WriteFile(key, []byte("untrusted comment: minisign encrypted secret key\nRWRTY0Iy...\n"), 0600)
+	if kind := visoKeyKind(key); kind != "minisign" {
+		t.Errorf("visoKeyKind(minisign key) = %q", kind)
+	}
+	if kind := visoKeyKind("releases@mixos-go.org"); kind != "gpg" {
+		t.Errorf("visoKeyKind(key ID) = %q", kind)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "config"), 0755)
+	img, err := openVisoImage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel := visoManifestPath + visoSignatureExt("minisign")
+	if err := img.WriteFile(rel, []byte("signature\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := img.ReadFile(rel); err != nil || string(data) != "signature\n" {
+		t.Errorf("ReadFile after WriteFile = %q, %v", data, err)
+	}
+	if err := img.Save(); err != nil {
+		t.Errorf("Save of a directory = %v", err)
+	}
+}
+
+func TestVisoConvert(t *testing.T) {
+	names := []string{"boot/grub/grub.cfg", "casper/vmlinuz", "casper/initrd", "casper/filesystem.squashfs",
+		"live/vmlinuz-6.1.0-17-amd64", "live/vmlinuz-6.1.0-18-amd64"}
+	if got := matchVisoFile(names, visoISOKernels); got != "casper/vmlinuz" {
+		t.Errorf("kernel = %q, expected casper/vmlinuz", got)
+	}
+	if got := matchVisoFile(names[4:], visoISOKernels); got != "live/vmlinuz-6.1.0-18-amd64" {
+		t.Errorf("kernel = %q, expected the newest one", got)
+	}
+	if got := matchVisoFile(names, visoISORoots); got != "casper/filesystem.squashfs" {
+		t.Errorf("root = %q", got)
+	}
+	if got := matchVisoFile(names[:1], visoISORoots); got != "" {
+		t.Errorf("root of an ISO without one = %q", got)
+	}
+
+	dir := t.TempDir()
+	sb := make([]byte, 96)
+	copy(sb, "hsqs")
+	binary.LittleEndian.PutUint16(sb[20:], 6)
+	squashfs := filepath.Join(dir, "root.squashfs")
+	os.WriteFile(squashfs, sb, 0644)
+	if comp, err := squashfsCompression(squashfs); err != nil || comp != "zstd" {
+		t.Errorf("squashfsCompression = %q, %v", comp, err)
+	}
+
+	// An MBR disk with a small ext4 partition and a larger one
+	disk := make([]byte, 8<<20)
+	disk[510], disk[511] = 0x55, 0xaa
+	for i, p := range []struct{ start, sectors uint32 }{{2048, 2048}, {4096, 8192}} {
+		e := disk[446+16*i:]
+		e[4] = 0x83
+		binary.LittleEndian.PutUint32(e[8:], p.start)
+		binary.LittleEndian.PutUint32(e[12:], p.sectors)
+		binary.LittleEndian.PutUint16(disk[int(p.start)*512+1080:], 0xef53)
+	}
+	root, err := findVisoRawRoot(bytes.NewReader(disk), int64(len(disk)))
+	if err != nil || root.Start != 4096*512 || root.Size != 8192*512 {
+		t.Errorf("findVisoRawRoot = %+v, %v", root, err)
+	}
+	if _, err := findVisoRawRoot(bytes.NewReader(make([]byte, 4096)), 4096); err == nil {
+		t.Error("findVisoRawRoot found a root in an empty image")
+	}
+}
+
+func TestVisoMount(t *testing.T) {
+	sys := t.TempDir()
+	if _, err := freeNbdDevice(sys); err == nil {
+		t.Error("freeNbdDevice found a device without the nbd module")
+	}
+	for _, name := range []string{"nbd0", "nbd1", "nbd2"} {
+		os.MkdirAll(filepath.Join(sys, name), 0755)
+	}
+	os.WriteFile(filepath.Join(sys, "nbd0", "pid"), []byte("1234\n"), 0644)
+	if dev, err := freeNbdDevice(sys); err != nil || dev != "/dev/nbd1" {
+		t.Errorf("freeNbdDevice = %q, %v, expected /dev/nbd1", dev, err)
+	}
+	os.WriteFile(filepath.Join(sys, "nbd1", "pid"), []byte("1235\n"), 0644)
+	os.WriteFile(filepath.Join(sys, "nbd2", "pid"), []byte("1236\n"), 0644)
+	if _, err := freeNbdDevice(sys); err == nil {
+		t.Error("freeNbdDevice found a device while all are in use")
+	}
+
+	image := filepath.Join(sys, "a.viso")
+	os.WriteFile(image, append(append([]byte{}, visoQcow2Magic...), 0, 0, 0, 3), 0644)
+	if f := visoImageFormat(image); f != "qcow2" {
+		t.Errorf("visoImageFormat(qcow2) = %q", f)
+	}
+	os.WriteFile(image, make([]byte, 4096), 0644)
+	if f := visoImageFormat(image); f != "raw" {
+		t.Errorf("visoImageFormat(raw) = %q", f)
+	}
+}
+
+func TestVisoExtract(t *testing.T) {
+	for p, expected := range map[string]string{"/etc/os-release": "etc/os-release", "usr/share/": "usr/share", "/": "", "/../../etc": "etc"} {
+		if rel, err := cleanVisoPath(p); err != nil || rel != expected {
+			t.Errorf("cleanVisoPath(%q) = %q, %v, expected %q", p, rel, err, expected)
+		}
+	}
+
+	names := parseDebugfsLs("/2/040755/0/0/./\n/2/040755/0/0/../\n/11/040700/0/0/lost+found/\n/12/040755/0/0/boot/\n/13/100644/0/0/viso.json/42/\n\n")
+	if strings.Join(names, " ") != "boot viso.json" {
+		t.Errorf("parseDebugfsLs = %q", names)
+	}
+
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "boot"), 0755)
+	os.MkdirAll(filepath.Join(dir, "config"), 0755)
+	os.WriteFile(filepath.Join(dir, visoKernelPath), []byte("kernel\n"), 0644)
+	os.WriteFile(filepath.Join(dir, visoMetadataPath), []byte("{}\n"), 0644)
+	img, err := openVisoImage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := extractVisoImageFiles(img, []string{visoMetadataPath}, dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, visoMetadataPath)); err != nil || string(data) != "{}\n" {
+		t.Errorf("extracted metadata = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, visoKernelPath)); err == nil {
+		t.Error("extracted a file that was not asked for")
+	}
+	if err := extractVisoImageFiles(img, []string{""}, dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, visoKernelPath)); err != nil {
+		t.Errorf("the whole image was not extracted: %v", err)
+	}
+}
+
+func TestVisoMetadataHeader(t *testing.T) {
+	m := newVisoMetadata("MixOS-GO", "1.2.0", "xz", "console=ttyS0 VRAM=auto quiet", 300<<20)
+	header, err := encodeVisoHeader(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != visoHeaderSize {
+		t.Errorf("header is %d bytes, expected %d", len(header), visoHeaderSize)
+	}
+
+	// The header goes before the superblock of the filesystem
+	raw := filepath.Join(t.TempDir(), "a.viso")
+	os.WriteFile(raw, make([]byte, 4096), 0644)
+	if err := writeVisoHeader(raw, m); err != nil {
+		t.Fatal(err)
+	}
+	got, source, err := readVisoMetadata(raw)
+	if err != nil || source != "image header" {
+		t.Fatalf("readVisoMetadata = %v, %q, %v", got, source, err)
+	}
+	if got.Version != "1.2.0" || got.Boot.Cmdline != m.Boot.Cmdline || got.Requirements.VramMinRamMB != m.Requirements.VramMinRamMB {
+		t.Errorf("metadata read back = %+v", got)
+	}
+	if data, _ := os.ReadFile(raw); len(data) != 4096 || data[visoHeaderSize] != 0 {
+		t.Error("writeVisoHeader wrote past the header")
+	}
+
+	if _, err := parseVisoHeader(make([]byte, visoHeaderSize)); err == nil {
+		t.Error("parseVisoHeader accepted an image without a header")
+	}
+	m.Name = strings.Repeat("x", visoHeaderSize)
+	if _, err := encodeVisoHeader(m); err == nil {
+		t.Error("encodeVisoHeader accepted metadata larger than the header")
+	}
+}
+
+// newcArchive lays out a newc cpio archive of name, mode and data triples
+func newcArchive(entries ...any) []byte {
+	var buf bytes.Buffer
+	add := func(name string, mode int, data string) {
+		fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			1, mode, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name + "\x00")
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+		buf.WriteString(data)
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	for i := 0; i+2 < len(entries); i += 3 {
+		add(entries[i].(string), entries[i+1].(int), entries[i+2].(string))
+	}
+	add("TRAILER!!!", 0, "")
+	return buf.Bytes()
+}
+
+func TestVisoInspect(t *testing.T) {
+	sb := make([]byte, 1024)
+	binary.LittleEndian.PutUint32(sb[0:], 8192)
+	binary.LittleEndian.PutUint32(sb[4:], 65536)
+	binary.LittleEndian.PutUint32(sb[12:], 1024)
+	binary.LittleEndian.PutUint32(sb[24:], 2)
+	binary.LittleEndian.PutUint16(sb[56:], 0xef53)
+	binary.LittleEndian.PutUint32(sb[96:], 0x240)
+	copy(sb[120:], visoLabel)
+	fs, err := parseExtSuperblock(sb)
+	if err != nil || fs.Type != "ext4" || fs.Label != visoLabel || fs.Bytes != 256<<20 || fs.FreeBytes != 4<<20 {
+		t.Errorf("parseExtSuperblock = %+v, %v", fs, err)
+	}
+
+	head := make([]byte, 0x400)
+	copy(head[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(head[0x20e:], 0x100)
+	copy(head[0x300:], "6.6.8-mixos (builder@mixos) #1 SMP\x00")
+	if v := parseKernelVersion(head); v != "6.6.8-mixos (builder@mixos) #1 SMP" {
+		t.Errorf("parseKernelVersion = %q", v)
+	}
+	if v := parseKernelVersion(make([]byte, 0x400)); v != "" {
+		t.Errorf("parseKernelVersion of a non-bzImage = %q", v)
+	}
+
+	// Early microcode, then the gzipped initramfs
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(newcArchive(
+		".", 040755, "",
+		"init", 0100755, "#!/bin/sh\n# VISO/SDISK/VRAM\n",
+		"bin/sh", 0120777, "busybox",
+		"lib/modules/6.6.8-mixos/kernel/fs/squashfs/squashfs.ko", 0100644, "module",
+	))
+	w.Close()
+	initramfs := append(newcArchive("kernel/x86/microcode/GenuineIntel.bin", 0100644, "ucode"), make([]byte, 512)...)
+	initramfs = append(initramfs, gz.Bytes()...)
+	s, err := summarizeInitramfs(initramfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Archives != 2 || s.Compression != "gzip" || s.Files != 3 || s.Dirs != 1 || s.Symlinks != 1 ||
+		s.Modules != 1 || !s.HasInit || !s.MixOSInit {
+		t.Errorf("summarizeInitramfs = %+v", s)
+	}
+	if _, err := summarizeInitramfs([]byte("not an initramfs")); err == nil {
+		t.Error("summarizeInitramfs accepted garbage")
+	}
+
+	release := "NAME=\"MixOS-GO\"\nVERSION=\"1.0\"\nPRETTY_NAME=\"MixOS-GO 1.0 (Revolution)\"\n"
+	if name := parseOSRelease([]byte(release)); name != "MixOS-GO 1.0 (Revolution)" {
+		t.Errorf("parseOSRelease = %q", name)
+	}
+}
+
+func TestVisoDiff(t *testing.T) {
+	listing := func(lines ...string) map[string]string {
+		return parseSquashfsListing([]byte(strings.Join(lines, "\n")))
+	}
+	old := &visoRootIndex{
+		Entries: listing(
+			"drwxr-xr-x root/root                68 2024-05-01 10:00 squashfs-root",
+			"drwxr-xr-x root/root                41 2024-05-01 10:00 squashfs-root/etc",
+			"-rw-r--r-- root/root                12 2024-05-01 10:00 squashfs-root/etc/hostname",
+			"-rw-r--r-- root/root               120 2024-05-01 10:00 squashfs-root/etc/os-release",
+			"-rw-r--r-- root/root                 9 2024-05-01 10:00 squashfs-root/etc/motd",
+			"lrwxrwxrwx root/root                 7 2024-05-01 10:00 squashfs-root/bin -> usr/bin",
+		),
+		Hashes: map[string]string{"etc/hostname": "aa", "etc/os-release": "bb"},
+	}
+	cur := &visoRootIndex{
+		Entries: listing(
+			"drwxr-xr-x root/root                80 2024-06-01 10:00 squashfs-root",
+			"drwxr-xr-x root/root                52 2024-06-01 10:00 squashfs-root/etc",
+			"-rw-r--r-- root/root                12 2024-06-01 10:00 squashfs-root/etc/hostname",
+			"-rw-r--r-- root/root               120 2024-06-01 10:00 squashfs-root/etc/os-release",
+			"-rw-r--r-- root/root                 4 2024-06-01 10:00 squashfs-root/etc/issue",
+			"lrwxrwxrwx root/root                 8 2024-06-01 10:00 squashfs-root/bin -> usr/sbin",
+		),
+		Hashes: map[string]string{"etc/hostname": "aa", "etc/os-release": "cc"},
+	}
+	added, removed, changed := diffVisoRoots(old, cur)
+	if strings.Join(added, ",") != "etc/issue" || strings.Join(removed, ",") != "etc/motd" ||
+		strings.Join(changed, ",") != "bin,etc/os-release" {
+		t.Errorf("diffVisoRoots = %v, %v, %v", added, removed, changed)
+	}
+
+	pAdded, pRemoved, pChanged := diffVisoPackages(
+		map[string]string{"busybox": "1.36.1", "vim": "9.0", "nano": "7.2"},
+		map[string]string{"busybox": "1.36.1", "vim": "9.1", "htop": "3.3.0"},
+	)
+	if fmt.Sprint(pAdded, pRemoved, pChanged) != "[htop 3.3.0] [nano 7.2] [{vim 9.0 9.1}]" {
+		t.Errorf("diffVisoPackages = %v, %v, %v", pAdded, pRemoved, pChanged)
+	}
+
+	a := newVisoMetadata("MixOS-GO", "1.0.0", "zstd", "console=ttyS0", 300<<20)
+	b := newVisoMetadata("MixOS-GO", "1.1.0", "zstd", "console=ttyS0 quiet", 300<<20)
+	b.Created = a.Created
+	fields := map[string]string{}
+	for _, c := range diffVisoMetadata(a, b) {
+		fields[c.Field] = c.Old + " -> " + c.New
+	}
+	if len(fields) != 2 || fields["version"] != "1.0.0 -> 1.1.0" || fields["boot.cmdline"] != "console=ttyS0 -> console=ttyS0 quiet" {
+		t.Errorf("diffVisoMetadata = %v", fields)
+	}
+}
+
+func TestVisoDelta(t *testing.T) {
+	// An old filesystem, and a new one with data inserted, changed and
+	// moved; the block size is small to keep the data small
+	old := make([]byte, 256<<10)
+	for i := range old {
+		old[i] = byte(i*7 + i/4096)
+	}
+	cur := append([]byte("inserted at the start"), old[:100<<10]...)
+	cur = append(cur, bytes.Repeat([]byte{0xee}, 3000)...)
+	cur = append(cur, old[160<<10:]...)
+	cur = append(cur, old[100<<10:130<<10]...)
+
+	idx, size, sum, err := indexVisoBlocks(bytes.NewReader(old), 4096)
+	if err != nil || size != int64(len(old)) || len(sum) != 64 {
+		t.Fatalf("indexVisoBlocks = %d, %q, %v", size, sum, err)
+	}
+	var ops bytes.Buffer
+	stats, size, sum, err := encodeVisoDelta(&ops, idx, bytes.NewReader(cur))
+	if err != nil || size != int64(len(cur)) {
+		t.Fatalf("encodeVisoDelta = %d, %v", size, err)
+	}
+	if stats.Copied+stats.Literal != size || stats.Literal > 3*4096+3000 {
+		t.Errorf("encodeVisoDelta stats = %+v for %d bytes", stats, size)
+	}
+
+	var rebuilt bytes.Buffer
+	if err := applyVisoDeltaOps(bytes.NewReader(ops.Bytes()), bytes.NewReader(old), &rebuilt); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt.Bytes(), cur) {
+		t.Error("applyVisoDeltaOps did not rebuild the new filesystem")
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(rebuilt.Bytes())) != sum {
+		t.Error("encodeVisoDelta returned the wrong checksum")
+	}
+	if err := applyVisoDeltaOps(bytes.NewReader(ops.Bytes()[:ops.Len()/2]), bytes.NewReader(old), io.Discard); err == nil {
+		t.Error("applyVisoDeltaOps accepted a truncated delta")
+	}
+
+	var f bytes.Buffer
+	hdr := &visoDeltaHeader{Format: visoDeltaFormat, BlockSize: 4096, From: visoDeltaImage{Format: "qcow2", SHA256: "aa"}}
+	if err := writeVisoDeltaHeader(&f, hdr); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("ops")
+	got, err := readVisoDeltaHeader(&f)
+	if err != nil || got.From.SHA256 != "aa" || f.String() != "ops" {
+		t.Errorf("readVisoDeltaHeader = %+v, %v; left %q", got, err, f.String())
+	}
+	if _, err := readVisoDeltaHeader(strings.NewReader("MIXOS-VISO-META\n{}")); err == nil {
+		t.Error("readVisoDeltaHeader accepted a metadata header")
+	}
+}
+
+func TestVisoRecompress(t *testing.T) {
+	for _, tt := range []struct {
+		compression string
+		level       int
+		args        string
+	}{
+		{"zstd", 19, "-comp zstd -Xcompression-level 19"},
+		{"gzip", 0, "-comp gzip"},
+		{"lz4", 9, "-comp lz4 -Xhc"},
+		{"xz", 0, "-comp xz"},
+		{"xz", 6, ""},
+		{"zstd", 23, ""},
+		{"lzo", 10, ""},
+		{"brotli", 0, ""},
+	} {
+		args, err := squashfsLevelArgs(tt.compression, tt.level)
+		if got := strings.Join(args, " "); got != tt.args || (err == nil) != (tt.args != "") {
+			t.Errorf("squashfsLevelArgs(%q, %d) = %q, %v", tt.compression, tt.level, got, err)
+		}
+	}
+
+	for compression, want := range map[string]string{"": "-c", "zlib": "-c", "zstd": "-c -o compression_type=zstd", "none": ""} {
+		if args, err := visoQcow2Args(compression); err != nil || strings.Join(args, " ") != want {
+			t.Errorf("visoQcow2Args(%q) = %v, %v", compression, args, err)
+		}
+	}
+	if _, err := visoQcow2Args("lzma"); err == nil {
+		t.Error("visoQcow2Args accepted lzma")
+	}
+
+	if got := formatSizeChange(200<<20, 150<<20); !strings.HasSuffix(got, "(-25.0%)") {
+		t.Errorf("formatSizeChange = %q", got)
+	}
+}
+
+func TestVisoResize(t *testing.T) {
+	const gb = int64(1) << 30
+	for _, tt := range []struct {
+		arg  string
+		want int64
+	}{
+		{"+4G", 6 * gb},
+		{"8G", 8 * gb},
+		{"+512M", 2*gb + 512<<20},
+		{"3072", 3 * gb},
+		{"+1M", 2*gb + 1<<20},
+		{"1G", 0},
+		{"2G", 0},
+		{"+big", 0},
+	} {
+		got, err := parseVisoResize(tt.arg, 2*gb)
+		if got != tt.want || (err == nil) != (tt.want != 0) {
+			t.Errorf("parseVisoResize(%q) = %d, %v; expected %d", tt.arg, got, err, tt.want)
+		}
+	}
+
+	dir := t.TempDir()
+	qcow2 := make([]byte, 512)
+	copy(qcow2, visoQcow2Magic)
+	binary.BigEndian.PutUint64(qcow2[24:], uint64(5*gb))
+	os.WriteFile(filepath.Join(dir, "a.viso"), qcow2, 0644)
+	os.WriteFile(filepath.Join(dir, "b.viso"), make([]byte, 4096), 0644)
+	if size, err := visoDiskSize(filepath.Join(dir, "a.viso")); err != nil || size != 5*gb {
+		t.Errorf("visoDiskSize of a qcow2 image = %d, %v", size, err)
+	}
+	if size, err := visoDiskSize(filepath.Join(dir, "b.viso")); err != nil || size != 4096 {
+		t.Errorf("visoDiskSize of a raw image = %d, %v", size, err)
+	}
+}
+
+func TestVisoSnapshot(t *testing.T) {
+	info := `{
+    "snapshots": [
+        {"icount": 0, "vm-state-size": 0, "date-sec": 1717236000, "date-nsec": 0,
+         "vm-clock-sec": 0, "vm-clock-nsec": 0, "id": "1", "name": "before-upgrade"},
+        {"vm-state-size": 0, "date-sec": 1717322400, "date-nsec": 0,
+         "vm-clock-sec": 0, "vm-clock-nsec": 0, "id": "2", "name": "clean"}
+    ],
+    "virtual-size": 1073741824,
+    "filename": "mixos.viso",
+    "format": "qcow2"
+}`
+	snapshots, err := parseVisoSnapshots([]byte(info))
+	if err != nil || len(snapshots) != 2 {
+		t.Fatalf("parseVisoSnapshots = %+v, %v", snapshots, err)
+	}
+	if s, ok := findVisoSnapshot(snapshots, "clean"); !ok || s.ID != "2" || s.DateSec != 1717322400 {
+		t.Errorf("findVisoSnapshot = %+v, %v", s, ok)
+	}
+	if _, ok := findVisoSnapshot(snapshots, "missing"); ok {
+		t.Error("findVisoSnapshot found a missing snapshot")
+	}
+	if snapshots, err := parseVisoSnapshots([]byte(`{"format": "qcow2", "virtual-size": 1}`)); err != nil || len(snapshots) != 0 {
+		t.Errorf("parseVisoSnapshots without snapshots = %+v, %v", snapshots, err)
+	}
+	if _, err := parseVisoSnapshots([]byte(`{"format": "raw"}`)); err == nil {
+		t.Error("parseVisoSnapshots accepted a raw image")
+	}
+}
+
+// fakeVisoRegistry serves the OCI distribution API from memory, behind a
+// bearer token
+func fakeVisoRegistry(t *testing.T) (*httptest.Server, map[string][]byte) {
+	blobs := map[string][]byte{}
+	manifests := map[string][]byte{}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"token": "secret"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="fake"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p := strings.TrimPrefix(r.URL.Path, "/v2/mixos/base")
+		switch {
+		case r.URL.Path == "/v2/":
+		case r.Method == http.MethodPost && p == "/blobs/uploads/":
+			w.Header().Set("Location", "/v2/mixos/base/blobs/uploads/1?state=x")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && strings.HasPrefix(p, "/blobs/uploads/"):
+			data, _ := io.ReadAll(r.Body)
+			blobs[r.URL.Query().Get("digest")] = data
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasPrefix(p, "/blobs/"):
+			data, ok := blobs[strings.TrimPrefix(p, "/blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		case r.Method == http.MethodPut && strings.HasPrefix(p, "/manifests/"):
+			manifests[p], _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasPrefix(p, "/manifests/"):
+			data, ok := manifests[p]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	return srv, blobs
+}
+
+func TestVisoRegistry(t *testing.T) {
+	for _, tt := range []struct {
+		ref, base, tag string
+	}{
+		{"registry.example.com/mixos/base:1.2", "https://registry.example.com/v2/mixos/base", "1.2"},
+		{"localhost:5000/mixos/base", "http://localhost:5000/v2/mixos/base", "latest"},
+		{"https://files.example.com/images/mixos:1.2", "https://files.example.com/images/mixos", "1.2"},
+		{"mixos/base:1.2", "", ""},
+		{"registry.example.com/MixOS:1.2", "", ""},
+		{"ftp://files.example.com/mixos", "", ""},
+	} {
+		ref, err := parseVisoRef(tt.ref)
+		if tt.base == "" {
+			if err == nil {
+				t.Errorf("parseVisoRef(%q) accepted", tt.ref)
+			}
+			continue
+		}
+		if err != nil || ref.Base != tt.base || ref.Tag != tt.tag {
+			t.Errorf("parseVisoRef(%q) = %+v, %v", tt.ref, ref, err)
+		}
+	}
+
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:mixos/base:pull"`)
+	if scheme != "bearer" || params["realm"] != "https://auth.example.com/token" || params["scope"] != "repository:mixos/base:pull" {
+		t.Errorf("parseAuthChallenge = %q, %v", scheme, params)
+	}
+
+	srv, blobs := fakeVisoRegistry(t)
+	defer srv.Close()
+	dir := t.TempDir()
+	image := filepath.Join(dir, "mixos.viso")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	copy(data[4096:], "changed")
+	os.WriteFile(image, data, 0644)
+	os.WriteFile(image+".minisig", []byte("untrusted comment: signature\n"), 0644)
+
+	ref, err := parseVisoRef(strings.TrimPrefix(srv.URL, "http://") + "/mixos/base:1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.Base = srv.URL + "/v2/mixos/base"
+	reg := newVisoRegistry(ref)
+	reg.ChunkSize = 4096
+	m, err := pushVisoImage(reg, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 chunks, 2 of them the same, and the signature
+	if len(m.Layers) != 5 || m.Layers[0].Digest != m.Layers[2].Digest || m.Layers[4].MediaType != visoSignatureType {
+		t.Errorf("pushVisoImage layers = %+v", m.Layers)
+	}
+	if len(blobs) != 5 {
+		t.Errorf("pushVisoImage stored %d blobs, expected 5", len(blobs))
+	}
+
+	// Resume from a chunk half downloaded
+	output := filepath.Join(dir, "pulled.viso")
+	os.MkdirAll(output+".part", 0755)
+	os.WriteFile(filepath.Join(output+".part", strings.TrimPrefix(m.Layers[0].Digest, "sha256:")), data[:1000], 0644)
+	reg = newVisoRegistry(ref)
+	if _, err := pullVisoImage(reg, output); err != nil {
+		t.Fatal(err)
+	}
+	if pulled, _ := os.ReadFile(output); !bytes.Equal(pulled, data) {
+		t.Error("pullVisoImage assembled a different image")
+	}
+	if sig, err := os.ReadFile(output + ".minisig"); err != nil || !strings.HasPrefix(string(sig), "untrusted comment") {
+		t.Errorf("pullVisoImage signature = %q, %v", sig, err)
+	}
+	if _, err := os.Stat(output + ".part"); !os.IsNotExist(err) {
+		t.Error("pullVisoImage left its chunks behind")
+	}
+
+	// A damaged blob is caught
+	blobs[m.Layers[2].Digest] = []byte("damaged")
+	if _, err := pullVisoImage(reg, filepath.Join(dir, "damaged.viso")); err == nil {
+		t.Error("pullVisoImage accepted a damaged chunk")
+	}
+}
+
+func TestVisoRun(t *testing.T) {
+	args := visoQemuArgs(&visoBoot{Image: "images/mixos.viso", Memory: "4G", VRAM: true, Kernel: "/tmp/vmlinuz", Initramfs: "/tmp/initramfs.img"})
+	joined := strings.Join(args, "|")
+	for _, want := range []string{"-m|4G", "-kernel|/tmp/vmlinuz", "-initrd|/tmp/initramfs.img", "-append|console=ttyS0 VRAM=auto SDISK=mixos.VISO", "|-nographic"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("visoQemuArgs = %q, lacks %q", joined, want)
+		}
+	}
+	if strings.Contains(joined, "-enable-kvm") {
+		t.Errorf("visoQemuArgs without KVM = %q", joined)
+	}
+
+	lines := visoBootCommand(&visoBoot{Image: "images/mixos.viso", Memory: "4G", VRAM: true})
+	if lines[0] != "qemu-system-x86_64" || lines[len(lines)-2] != `  -append "console=ttyS0 VRAM=auto SDISK=mixos.VISO"` {
+		t.Errorf("visoBootCommand = %q", lines)
+	}
+}
+
+func TestVisoMachine(t *testing.T) {
+	for in, want := range map[string]string{"": "x86_64", "amd64": "x86_64", "X86_64": "x86_64", "arm64": "aarch64", "aarch64": "aarch64"} {
+		if got, err := normalizeVisoArch(in); err != nil || got != want {
+			t.Errorf("normalizeVisoArch(%q) = %q, %v, expected %q", in, got, err, want)
+		}
+	}
+	if _, err := normalizeVisoArch("riscv64"); err == nil {
+		t.Error("normalizeVisoArch accepted riscv64")
+	}
+
+	dir := t.TempDir()
+	image := filepath.Join(dir, "arm.viso")
+	os.MkdirAll(filepath.Join(image, "config"), 0755)
+	os.WriteFile(filepath.Join(image, "config/viso.json"), []byte(`{"requirements": {"arch": "arm64"}}`), 0644)
+	if arch, err := visoBootArch(image, ""); err != nil || arch != "aarch64" {
+		t.Errorf("visoBootArch from metadata = %q, %v", arch, err)
+	}
+	if arch, err := visoBootArch(image, "x86_64"); err != nil || arch != "x86_64" {
+		t.Errorf("visoBootArch with --arch = %q, %v", arch, err)
+	}
+
+	lines := visoBootCommand(&visoBoot{Image: image, Memory: "2G", Arch: "aarch64", UEFI: true, Firmware: "/usr/share/AAVMF/AAVMF_CODE.fd"})
+	line := strings.Join(lines, " ")
+	if lines[0] != "qemu-system-aarch64" {
+		t.Errorf("aarch64 boot command runs %s", lines[0])
+	}
+	for _, want := range []string{"-machine virt", "-cpu max", "if=pflash,format=raw,readonly=on,file=/usr/share/AAVMF/AAVMF_CODE.fd", "console=ttyAMA0"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("aarch64 boot command %q lacks %q", line, want)
+		}
+	}
+	line = strings.Join(visoBootCommand(&visoBoot{Image: image, Memory: "2G", KVM: true, UEFI: true, Firmware: "/usr/share/ovmf/OVMF.fd"}), " ")
+	for _, want := range []string{"qemu-system-x86_64", "-machine q35", "-bios /usr/share/ovmf/OVMF.fd", "-cpu host", "console=ttyS0"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("x86_64 UEFI boot command %q lacks %q", line, want)
+		}
+	}
+	if line := strings.Join(visoBootCommand(&visoBoot{Image: image, Memory: "2G"}), " "); strings.Contains(line, "-machine") || strings.Contains(line, "-bios") {
+		t.Errorf("x86_64 BIOS boot command %q sets a machine or firmware", line)
+	}
+}
+
+func TestVisoWrite(t *testing.T) {
+	sys := t.TempDir()
+	devices := filepath.Join(sys, "devices")
+	usb := filepath.Join(devices, "pci0000:00/0000:00:14.0/usb2/2-1/block/sdb")
+	os.MkdirAll(filepath.Join(usb, "device"), 0755)
+	os.MkdirAll(filepath.Join(usb, "sdb1/holders"), 0755)
+	os.MkdirAll(filepath.Join(usb, "holders"), 0755)
+	os.WriteFile(filepath.Join(usb, "size"), []byte("30031872\n"), 0644)
+	os.WriteFile(filepath.Join(usb, "removable"), []byte("0\n"), 0644)
+	os.WriteFile(filepath.Join(usb, "device/vendor"), []byte("SanDisk \n"), 0644)
+	os.WriteFile(filepath.Join(usb, "device/model"), []byte("Cruzer Blade    \n"), 0644)
+	sata := filepath.Join(devices, "pci0000:00/0000:00:17.0/ata1/block/sda")
+	os.MkdirAll(sata, 0755)
+	os.WriteFile(filepath.Join(sata, "removable"), []byte("0\n"), 0644)
+	block := filepath.Join(sys, "block")
+	os.MkdirAll(block, 0755)
+	os.Symlink(usb, filepath.Join(block, "sdb"))
+	os.Symlink(sata, filepath.Join(block, "sda"))
+
+	d, err := readVisoDevice(block, "sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Path != "/dev/sdb" || d.Size != 30031872*512 || d.Model != "SanDisk Cruzer Blade" || !d.USB || !d.Removable {
+		t.Errorf("readVisoDevice(sdb) = %+v", d)
+	}
+	if d, err := readVisoDevice(block, "sda"); err != nil || d.Removable {
+		t.Errorf("readVisoDevice(sda) = %+v, %v; expected a fixed disk", d, err)
+	}
+	if _, err := readVisoDevice(block, "sdb1"); err == nil || !strings.Contains(err.Error(), "/dev/sdb") {
+		t.Errorf("readVisoDevice of a partition: %v", err)
+	}
+
+	if err := visoDeviceBusy(block, d, "/dev/sda1 / ext4 rw 0 0\n", "Filename Type Size Used Priority\n"); err != nil {
+		t.Errorf("visoDeviceBusy of an unused disk: %v", err)
+	}
+	if err := visoDeviceBusy(block, d, "/dev/sdb1 /media/my\\040stick vfat rw 0 0\n", ""); err == nil || !strings.Contains(err.Error(), "/media/my stick") {
+		t.Errorf("visoDeviceBusy of a mounted partition: %v", err)
+	}
+	if err := visoDeviceBusy(block, d, "", "/dev/sdb partition 1048572 0 -2\n"); err == nil || !strings.Contains(err.Error(), "swap") {
+		t.Errorf("visoDeviceBusy of swap: %v", err)
+	}
+	os.MkdirAll(filepath.Join(usb, "sdb1/holders/dm-0"), 0755)
+	if err := visoDeviceBusy(block, d, "", ""); err == nil || !strings.Contains(err.Error(), "dm-0") {
+		t.Errorf("visoDeviceBusy of a held partition: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("mixos"), 300000)
+	var out bytes.Buffer
+	sum, err := copyVisoDisk(&out, bytes.NewReader(data), int64(len(data)), "Writing")
+	if want := sha256.Sum256(data); err != nil || !bytes.Equal(sum, want[:]) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("copyVisoDisk = %x, %v", sum, err)
+	}
+	if _, err := copyVisoDisk(io.Discard, bytes.NewReader(data), int64(len(data))+1, "Writing"); err == nil {
+		t.Error("copyVisoDisk of a short image succeeded")
+	}
+}
+
+func TestVisoNetboot(t *testing.T) {
+	cmdline := visoNetbootCmdline("images/mixos.viso", "aarch64", true, "http://10.0.0.1:8080/", "quiet")
+	if cmdline != "console=tty0 console=ttyAMA0 VRAM=auto SDISK=mixos.VISO VISO_URL=http://10.0.0.1:8080 quiet" {
+		t.Errorf("visoNetbootCmdline = %q", cmdline)
+	}
+	if got := visoNetbootCmdline("mixos.viso", "x86_64", false, "", ""); got != "console=tty0 console=ttyS0 SDISK=mixos.VISO" {
+		t.Errorf("visoNetbootCmdline without a URL = %q", got)
+	}
+	if s := visoIPXEScript("MixOS 1.0", cmdline); !strings.HasPrefix(s, "#!ipxe\n") || !strings.Contains(s, "kernel boot/vmlinuz-mixos "+cmdline+"\n") || !strings.Contains(s, "initrd boot/initramfs-mixos.img\n") {
+		t.Errorf("visoIPXEScript = %q", s)
+	}
+	if s := visoPXELinuxConfig("MixOS 1.0", cmdline); !strings.Contains(s, "  APPEND "+cmdline+"\n") || !strings.Contains(s, "  KERNEL boot/vmlinuz-mixos\n") {
+		t.Errorf("visoPXELinuxConfig = %q", s)
+	}
+	if url, err := visoServeURL("127.0.0.1:8080"); err != nil || url != "http://127.0.0.1:8080/" {
+		t.Errorf("visoServeURL = %q, %v", url, err)
+	}
+	if _, err := visoServeURL("8080"); err == nil {
+		t.Error("visoServeURL accepted a port without a colon")
+	}
+
+	dir := t.TempDir()
+	image := filepath.Join(dir, "mixos.viso")
+	for _, rel := range append(visoManifestFiles, visoManifestPath) {
+		os.MkdirAll(filepath.Join(image, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(image, rel), []byte(rel), 0644)
+	}
+	out := filepath.Join(dir, "tftpboot")
+	if err := exportVisoNetboot(image, out, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(out, visoRootfsPath)); err == nil {
+		t.Error("the root was exported for a boot from disk")
+	}
+	if err := exportVisoNetboot(image, out, true); err == nil {
+		t.Error("an unsigned image was exported for a diskless boot")
+	}
+	os.WriteFile(filepath.Join(image, visoManifestPath+".minisig"), []byte(visoManifestPath+".minisig"), 0644)
+	if err := exportVisoNetboot(image, out, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{visoKernelPath, visoInitramfsPath, visoRootfsPath, visoMetadataPath, visoManifestPath, visoManifestPath + ".minisig"} {
+		if data, err := os.ReadFile(filepath.Join(out, rel)); err != nil || string(data) != rel {
+			t.Errorf("exported %s = %q, %v", rel, data, err)
+		}
+	}
+}
+
+func TestVisoEncrypt(t *testing.T) {
+	dir := t.TempDir()
+	qcow2 := func(cryptMethod uint32) []byte {
+		header := make([]byte, 512)
+		copy(header, visoQcow2Magic)
+		binary.BigEndian.PutUint32(header[32:36], cryptMethod)
+		return header
+	}
+	for name, tc := range map[string]struct {
+		data       []byte
+		format     string
+		encryption string
+	}{
+		"plain.viso": {qcow2(0), "qcow2", ""},
+		"qcow2.viso": {qcow2(2), "qcow2", "qcow2"},
+		"luks.viso":  {append(append([]byte{}, visoLUKSMagic...), make([]byte, 506)...), "luks", "luks"},
+		"raw.viso":   {make([]byte, 512), "raw", ""},
+		"short.viso": {[]byte("QFI"), "raw", ""},
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, tc.data, 0644)
+		if got := visoImageFormat(path); got != tc.format {
+			t.Errorf("visoImageFormat(%s) = %q, expected %q", name, got, tc.format)
+		}
+		if got := visoEncryption(path); got != tc.encryption {
+			t.Errorf("visoEncryption(%s) = %q, expected %q", name, got, tc.encryption)
+		}
+	}
+	if _, err := openVisoImage(filepath.Join(dir, "luks.viso")); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("openVisoImage of an encrypted image: %v", err)
+	}
+
+	passFile := filepath.Join(dir, "pass")
+	os.WriteFile(passFile, []byte("correct horse\n"), 0600)
+	if pass, err := readVisoPassphrase(passFile, true, "x.viso"); err != nil || string(pass) != "correct horse" {
+		t.Errorf("readVisoPassphrase = %q, %v", pass, err)
+	}
+	os.WriteFile(passFile, []byte("\n"), 0600)
+	if _, err := readVisoPassphrase(passFile, false, "x.viso"); err == nil {
+		t.Error("readVisoPassphrase accepted an empty passphrase")
+	}
+	secret, err := writeVisoSecret(dir, []byte("s3cret"))
+	if info, serr := os.Stat(secret); err != nil || serr != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("writeVisoSecret = %q, %v; mode %v", secret, err, info.Mode())
+	}
+
+	for enc, drive := range map[string]string{
+		"qcow2": "file=" + filepath.Join(dir, "qcow2.viso") + ",format=qcow2,encrypt.key-secret=viso0,if=virtio",
+		"luks":  "file=" + filepath.Join(dir, "luks.viso") + ",format=luks,key-secret=viso0,if=virtio",
+	} {
+		args := strings.Join(visoQemuArgs(&visoBoot{Image: filepath.Join(dir, enc+".viso"), Memory: "2G", Encryption: enc, Secret: "/dev/fd/3"}), " ")
+		if !strings.Contains(args, "-object secret,id=viso0,file=/dev/fd/3 ") || !strings.Contains(args, drive) {
+			t.Errorf("visoQemuArgs of a %s encrypted image = %q", enc, args)
+		}
+	}
+}
+
+func TestVisoFsck(t *testing.T) {
+	c, err := parseQemuImgCheck([]byte(`{"image-end-offset": 262144, "total-clusters": 16, "check-errors": 0, "leaks": 2, "corruptions-fixed": 1, "filename": "mixos.viso", "format": "qcow2"}`))
+	if err != nil || c.Leaks != 2 || c.CorruptionsFixed != 1 || c.Corruptions != 0 || c.CheckErrors != 0 {
+		t.Errorf("parseQemuImgCheck = %+v, %v", c, err)
+	}
+	if _, err := parseQemuImgCheck([]byte("qemu-img: Could not open")); err == nil {
+		t.Error("parseQemuImgCheck accepted text")
+	}
+
+	has := func(rel string) bool {
+		return rel == visoKernelPath || rel == visoInitramfsPath || rel == visoRootfsPath
+	}
+	m := newVisoMetadata("MixOS-GO", "1.1.0", "xz", "", 300<<20)
+	if fixes := checkVisoMetadataFields(m, has, "xz", 300<<20); len(fixes) != 0 {
+		t.Errorf("checkVisoMetadataFields of coherent metadata = %d fix(es)", len(fixes))
+	}
+	m.Boot.Kernel = "/boot/vmlinuz-mixos"
+	if fixes := checkVisoMetadataFields(m, has, "xz", 300<<20); len(fixes) != 0 {
+		t.Errorf("checkVisoMetadataFields rejected an absolute kernel path: %d fix(es)", len(fixes))
+	}
+	m.Boot.Initramfs = "boot/initrd.img"
+	m.Rootfs.Compression = "gzip"
+	m.Requirements.VramMinRamMB = 2048
+	fixes := checkVisoMetadataFields(m, has, "xz", 1<<30)
+	if len(fixes) != 3 {
+		t.Fatalf("checkVisoMetadataFields = %d fix(es), expected 3", len(fixes))
+	}
+	for _, fix := range fixes {
+		fix.Apply(m)
+	}
+	if m.Boot.Initramfs != visoInitramfsPath || m.Rootfs.Compression != "xz" || m.Requirements.VramMinRamMB != 2560 {
+		t.Errorf("repaired metadata = %+v", m)
+	}
+	// An unusable root leaves its fields alone
+	if fixes := checkVisoMetadataFields(m, has, "", 0); len(fixes) != 0 {
+		t.Errorf("checkVisoMetadataFields without a root = %d fix(es)", len(fixes))
+	}
+
+	manifest := []byte("aaaa  boot/vmlinuz-mixos\nbbbb  config/viso.json\n")
+	if got := string(setVisoManifestEntry(manifest, visoMetadataPath, "cccc")); got != "aaaa  boot/vmlinuz-mixos\ncccc  config/viso.json\n" {
+		t.Errorf("setVisoManifestEntry replacing = %q", got)
+	}
+	if got := string(setVisoManifestEntry([]byte("aaaa  boot/vmlinuz-mixos"), visoMetadataPath, "cccc")); got != "aaaa  boot/vmlinuz-mixos\ncccc  config/viso.json\n" {
+		t.Errorf("setVisoManifestEntry adding = %q", got)
+	}
+}
@@ -0,0 +1,325 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VISO Verify
+// ============================================================================
+//
+// "mix viso create" records the SHA-256 of the kernel, the initramfs, the
+// root and the metadata in config/manifest.sha256 inside the image, in
+// sha256sum format. "mix viso verify" hashes the files against it.
+//
+// A signature vouches for the image when present: a detached GPG (.sig) or
+// minisign (.minisig) signature of the manifest inside the image, next to
+// it in config/, which covers the contents through their checksums; or
+// one of the whole image file next to it, as downloads often come with.
+
+const (
+	visoManifestPath = "config/manifest.sha256"
+	visoPublicKey    = "/etc/mixos/viso.pub" // minisign key of trusted images
+)
+
+// visoManifestFiles are the files of an image the manifest covers
+var visoManifestFiles = []string{visoKernelPath, visoInitramfsPath, visoRootfsPath, visoMetadataPath}
+
+// Exit codes of "mix viso verify"
+const (
+	visoVerifyFailed = 1 // a checksum or signature does not match
+	visoVerifyError  = 2 // the image could not be checked
+)
+
+var visoVerifyCmd = &cobra.Command{
+	Use:   "verify <viso-file>",
+	Short: "Check the integrity and signature of a VISO image",
+	Long: `Check the kernel, the initramfs, the root and the metadata of a VISO
+image against the SHA-256 manifest recorded in it, and its signatures
+when it has any: a GPG or minisign signature of the manifest inside the
+image, or of the whole image next to it (<image>.sig, <image>.minisig).
+
+GPG signatures are checked against your keyring, or --keyring; minisign
+signatures against --pubkey (/etc/mixos/viso.pub by default). Unsigned
+images pass unless --require-signature is given.
+
+Exit codes:
+  0  the image is intact, and signed by a trusted key if signed
+  1  a checksum or a signature does not match
+  2  the image could not be checked
+
+Examples:
+  mix viso verify mixos.viso
+  mix viso verify mixos.viso --require-signature --pubkey mixos.pub`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVisoVerify,
+}
+
+func init() {
+	visoCmd.AddCommand(visoVerifyCmd)
+	visoVerifyCmd.Flags().String("keyring", "", "GPG keyring of trusted keys (default: your keyring)")
+	visoVerifyCmd.Flags().String("pubkey", visoPublicKey, "minisign public key of trusted images")
+	visoVerifyCmd.Flags().Bool("require-signature", false, "fail on unsigned images")
+}
+
+// writeVisoManifest records the checksums of the files of the image
+// layout in dir
+func writeVisoManifest(dir string) error {
+	var buf bytes.Buffer
+	for _, rel := range visoManifestFiles {
+		hash, err := hashVramFile(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", hash, rel)
+	}
+	return os.WriteFile(filepath.Join(dir, visoManifestPath), buf.Bytes(), 0644)
+}
+
+// visoSignature is a signature found for an image
+type visoSignature struct {
+	Kind  string // gpg or minisign
+	Sig   string // signature file
+	Data  string // signed file
+	Label string
+}
+
+// visoSignatureKind tells a signature file's kind from its extension
+func visoSignatureKind(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".minisig"):
+		return "minisign"
+	case strings.HasSuffix(path, ".sig"), strings.HasSuffix(path, ".asc"):
+		return "gpg"
+	}
+	return ""
+}
+
+// verifyVisoSignature checks a signature and returns who made it
+func verifyVisoSignature(s visoSignature, keyring, pubkey string) (string, error) {
+	switch s.Kind {
+	case "gpg":
+		gpg, err := exec.LookPath("gpg")
+		if err != nil {
+			return "", fmt.Errorf("gpg not found")
+		}
+		args := []string{"--batch", "--status-fd", "1"}
+		if keyring != "" {
+			args = append(args, "--no-default-keyring", "--keyring", keyring)
+		}
+		args = append(args, "--verify", s.Sig, s.Data)
+		var stderr bytes.Buffer
+		c := exec.Command(gpg, args...)
+		c.Stderr = &stderr
+		out, err := c.Output()
+		return parseGPGStatus(string(out), err, stderr.String())
+	case "minisign":
+		minisign, err := exec.LookPath("minisign")
+		if err != nil {
+			return "", fmt.Errorf("minisign not found")
+		}
+		out, err := exec.Command(minisign, "-V", "-p", pubkey, "-m", s.Data, "-x", s.Sig).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("%s", strings.TrimSpace(string(out)))
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if comment, ok := strings.CutPrefix(line, "Trusted comment: "); ok {
+				return comment, nil
+			}
+		}
+		return filepath.Base(pubkey), nil
+	}
+	return "", fmt.Errorf("unknown signature kind %q", s.Kind)
+}
+
+// parseGPGStatus reads the --status-fd output of gpg --verify
+func parseGPGStatus(status string, err error, stderr string) (string, error) {
+	signer := ""
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(strings.TrimPrefix(line, "[GNUPG:] "))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "GOODSIG":
+			if len(fields) > 2 {
+				signer = strings.Join(fields[2:], " ")
+			}
+		case "BADSIG":
+			return "", fmt.Errorf("bad signature")
+		case "NO_PUBKEY":
+			return "", fmt.Errorf("signed by unknown key %s", fields[len(fields)-1])
+		case "EXPKEYSIG", "REVKEYSIG":
+			return "", fmt.Errorf("signed by an expired or revoked key")
+		}
+	}
+	if signer == "" || err != nil {
+		if msg := strings.TrimSpace(stderr); msg != "" {
+			return "", fmt.Errorf("%s", msg)
+		}
+		return "", fmt.Errorf("no valid signature")
+	}
+	return signer, nil
+}
+
+// checkVisoManifest hashes the files of the image against its manifest
+// and prints the result; it returns the number of failures
+func checkVisoManifest(img *visoImage, manifest []byte) (int, error) {
+	entries, err := parseVramManifest(bytes.NewReader(manifest))
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	covered := map[string]bool{}
+	for _, e := range entries {
+		covered[e.Path] = true
+		f, err := img.Open(e.Path)
+		if err != nil {
+			fmt.Printf("  \033[31m✗\033[0m %-28s missing\n", e.Path)
+			failed++
+			continue
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, bufio.NewReader(f))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		switch {
+		case err != nil:
+			fmt.Printf("  \033[31m✗\033[0m %-28s unreadable: %v\n", e.Path, err)
+			failed++
+		case hex.EncodeToString(h.Sum(nil)) != e.Hash:
+			fmt.Printf("  \033[31m✗\033[0m %-28s checksum mismatch\n", e.Path)
+			failed++
+		default:
+			fmt.Printf("  \033[32m✓\033[0m %s\n", e.Path)
+		}
+	}
+	for _, rel := range visoManifestFiles[:3] {
+		if !covered[rel] && img.Exists(rel) {
+			fmt.Printf("  \033[31m✗\033[0m %-28s not in the manifest\n", rel)
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// findVisoSignatures lists the signatures of the manifest inside the
+// image, extracted to tmp, and of the image file next to it
+func findVisoSignatures(img *visoImage, manifest []byte, tmp string) ([]visoSignature, error) {
+	var sigs []visoSignature
+	manifestFile := ""
+	for _, ext := range []string{".sig", ".asc", ".minisig"} {
+		rel := visoManifestPath + ext
+		if !img.Exists(rel) {
+			continue
+		}
+		data, err := img.ReadFile(rel)
+		if err != nil {
+			return nil, err
+		}
+		if manifestFile == "" {
+			manifestFile = filepath.Join(tmp, "manifest.sha256")
+			if err := os.WriteFile(manifestFile, manifest, 0644); err != nil {
+				return nil, err
+			}
+		}
+		sig := filepath.Join(tmp, "manifest.sha256"+ext)
+		if err := os.WriteFile(sig, data, 0644); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, visoSignature{Kind: visoSignatureKind(rel), Sig: sig, Data: manifestFile, Label: rel})
+	}
+	if !img.dir {
+		for _, ext := range []string{".sig", ".asc", ".minisig"} {
+			if _, err := os.Stat(img.Path + ext); err == nil {
+				sigs = append(sigs, visoSignature{Kind: visoSignatureKind(ext), Sig: img.Path + ext, Data: img.Path,
+					Label: filepath.Base(img.Path + ext)})
+			}
+		}
+	}
+	return sigs, nil
+}
+
+// verifyVisoImage checks an image and prints the result; it returns
+// whether the image passed
+func verifyVisoImage(path, keyring, pubkey string, requireSignature bool) (bool, error) {
+	img, err := openVisoImage(path)
+	if err != nil {
+		return false, err
+	}
+	defer img.Close()
+
+	manifest, err := img.ReadFile(visoManifestPath)
+	if err != nil {
+		return false, fmt.Errorf("%s has no manifest (%s); rebuild it with \"mix viso create\"", path, visoManifestPath)
+	}
+	fmt.Printf("Verifying %s\n\nContents:\n", path)
+	failed, err := checkVisoManifest(img, manifest)
+	if err != nil {
+		return false, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp("", "viso-verify-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	sigs, err := findVisoSignatures(img, manifest, tmp)
+	if err != nil {
+		return false, err
+	}
+	fmt.Println("\nSignatures:")
+	if len(sigs) == 0 {
+		if requireSignature {
+			fmt.Println("  \033[31m✗\033[0m none, and one is required")
+			failed++
+		} else {
+			fmt.Println("  none (unsigned image)")
+		}
+	}
+	for _, s := range sigs {
+		signer, err := verifyVisoSignature(s, keyring, pubkey)
+		if err != nil {
+			fmt.Printf("  \033[31m✗\033[0m %s (%s): %v\n", s.Label, s.Kind, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  \033[32m✓\033[0m %s (%s): %s\n", s.Label, s.Kind, signer)
+	}
+
+	fmt.Println("")
+	if failed > 0 {
+		fmt.Printf("\033[31m✗ FAILED\033[0m: %d problem(s) found\n", failed)
+		return false, nil
+	}
+	fmt.Println("\033[32m✓ PASSED\033[0m")
+	return true, nil
+}
+
+func runVisoVerify(cmd *cobra.Command, args []string) error {
+	keyring, _ := cmd.Flags().GetString("keyring")
+	pubkey, _ := cmd.Flags().GetString("pubkey")
+	requireSignature, _ := cmd.Flags().GetBool("require-signature")
+
+	passed, err := verifyVisoImage(args[0], keyring, pubkey, requireSignature)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(visoVerifyError)
+	}
+	if !passed {
+		os.Exit(visoVerifyFailed)
+	}
+	return nil
+}
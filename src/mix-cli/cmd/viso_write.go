@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// VISO Write
+// ============================================================================
+//
+// "mix viso write" puts an image on a USB stick or SD card to boot MixOS
+// on real hardware. The device receives the raw disk of the image: a raw
+// image is copied as it is, a qcow2 image is read through a read-only
+// qemu-nbd device as "mix viso mount" does, so it is converted on the fly
+// without a temporary copy. Only whole removable disks (removable media,
+// or disks on USB) that nothing mounts or holds are written to unless
+// --force is given, and the device is opened exclusively so that the
+// kernel refuses it if it is in use after all. The image is hashed as it
+// is written and the device read back and hashed again, past the page
+// cache, to verify the write.
+
+const (
+	visoProcMounts = "/proc/mounts"
+	visoProcSwaps  = "/proc/swaps"
+	visoWriteBlock = 4 << 20
+)
+
+// visoDevice is a whole disk an image can be written to
+type visoDevice struct {
+	Path      string
+	Name      string // name in /sys/block
+	Size      int64
+	Model     string
+	Removable bool // removable media, or a disk on USB
+	USB       bool
+}
+
+var visoWriteCmd = &cobra.Command{
+	Use:   "write <viso-file> <device>",
+	Short: "Write a VISO image to a USB stick or SD card",
+	Long: `Write the disk of a VISO image to a whole removable device, such as
+/dev/sdb or /dev/mmcblk0, to boot MixOS on real hardware. Everything on
+the device is lost.
+
+qcow2 images are converted to raw on the fly. The write is verified by
+reading the device back, unless --no-verify is given.
+
+The device must be a whole disk, removable or on USB, not mounted, used
+as swap or held by LVM, RAID or dm-crypt. --force allows disks that are
+not removable; the other checks always apply.
+
+Must be run as root. Requires qemu-nbd (qemu-utils) and the nbd kernel
+module for qcow2 images.
+
+Examples:
+  mix viso write mixos.viso /dev/sdb
+  mix viso write mixos.viso /dev/disk/by-id/usb-SanDisk_Cruzer_Blade-0:0 -y
+  mix viso write mixos.viso /dev/mmcblk0 --no-verify`,
+	Args: cobra.ExactArgs(2),
+	RunE: runVisoWrite,
+}
+
+func init() {
+	visoCmd.AddCommand(visoWriteCmd)
+	visoWriteCmd.Flags().Bool("no-verify", false, "skip reading the device back after writing")
+	visoWriteCmd.Flags().Bool("force", false, "write to a disk that is not removable")
+	visoWriteCmd.Flags().BoolP("yes", "y", false, "assume yes to all prompts")
+}
+
+// readVisoDevice describes the whole disk name from sysfs
+func readVisoDevice(sysBlock, name string) (*visoDevice, error) {
+	dir := filepath.Join(sysBlock, name)
+	if _, err := os.Stat(dir); err != nil {
+		parents, _ := filepath.Glob(filepath.Join(sysBlock, "*", name))
+		if len(parents) > 0 {
+			return nil, fmt.Errorf("/dev/%s is a partition; give the whole disk, /dev/%s", name, filepath.Base(filepath.Dir(parents[0])))
+		}
+		return nil, fmt.Errorf("/dev/%s is not a disk", name)
+	}
+	d := &visoDevice{Path: "/dev/" + name, Name: name}
+	if data, err := os.ReadFile(filepath.Join(dir, "size")); err == nil {
+		fmt.Sscanf(strings.TrimSpace(string(data)), "%d", &d.Size)
+		d.Size *= 512
+	}
+	var model []string
+	for _, f := range []string{"vendor", "model"} {
+		if data, err := os.ReadFile(filepath.Join(dir, "device", f)); err == nil && strings.TrimSpace(string(data)) != "" {
+			model = append(model, strings.TrimSpace(string(data)))
+		}
+	}
+	d.Model = strings.Join(model, " ")
+	if link, err := os.Readlink(dir); err == nil {
+		d.USB = strings.Contains(link, "/usb")
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "removable"))
+	d.Removable = strings.TrimSpace(string(data)) == "1" || d.USB
+	return d, nil
+}
+
+// visoDeviceBusy returns why a disk or one of its partitions is in use,
+// from sysfs and the contents of /proc/mounts and /proc/swaps
+func visoDeviceBusy(sysBlock string, d *visoDevice, mounts, swaps string) error {
+	names := []string{d.Name}
+	parts, _ := filepath.Glob(filepath.Join(sysBlock, d.Name, d.Name+"*"))
+	for _, p := range parts {
+		names = append(names, filepath.Base(p))
+	}
+	for _, name := range names {
+		dev := "/dev/" + name
+		for _, line := range strings.Split(mounts, "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == dev {
+				return fmt.Errorf("%s is mounted on %s; unmount it first", dev, unescapeMountPath(fields[1]))
+			}
+		}
+		for _, line := range strings.Split(swaps, "\n") {
+			if fields := strings.Fields(line); len(fields) >= 1 && fields[0] == dev {
+				return fmt.Errorf("%s is used as swap; turn it off with: swapoff %s", dev, dev)
+			}
+		}
+		holders := filepath.Join(sysBlock, d.Name, "holders")
+		if name != d.Name {
+			holders = filepath.Join(sysBlock, d.Name, name, "holders")
+		}
+		if entries, err := os.ReadDir(holders); err == nil && len(entries) > 0 {
+			return fmt.Errorf("%s is held by /dev/%s (LVM, RAID or dm-crypt); release it first", dev, entries[0].Name())
+		}
+	}
+	return nil
+}
+
+// visoProgress draws a progress bar of the bytes written to it
+type visoProgress struct {
+	label string
+	total int64
+	done  int64
+	start time.Time
+	drawn time.Time
+}
+
+func newVisoProgress(label string, total int64) *visoProgress {
+	return &visoProgress{label: label, total: total, start: time.Now()}
+}
+
+func (p *visoProgress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.drawn) >= 200*time.Millisecond {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+func (p *visoProgress) draw() {
+	const width = 30
+	filled, percent := width, 100
+	if p.total > 0 {
+		filled = int(p.done * width / p.total)
+		percent = int(p.done * 100 / p.total)
+	}
+	rate := int64(float64(p.done) / time.Since(p.start).Seconds())
+	fmt.Printf("\r  %-9s [%s%s] %3d%%  %s / %s  %s/s   ", p.label, strings.Repeat("=", filled), strings.Repeat(" ", width-filled), percent, formatSize(p.done), formatSize(p.total), formatSize(rate))
+	p.drawn = time.Now()
+}
+
+// finish draws the bar a last time and ends its line
+func (p *visoProgress) finish() {
+	p.draw()
+	fmt.Println("")
+}
+
+// copyVisoDisk copies size bytes of the disk of an image to dst with a
+// progress bar, and returns their SHA-256
+func copyVisoDisk(dst io.Writer, src io.Reader, size int64, label string) ([]byte, error) {
+	h := sha256.New()
+	progress := newVisoProgress(label, size)
+	buf := make([]byte, visoWriteBlock)
+	n, err := io.CopyBuffer(io.MultiWriter(dst, h, progress), io.LimitReader(src, size), buf)
+	progress.finish()
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("read only %s of %s", formatSize(n), formatSize(size))
+	}
+	return h.Sum(nil), nil
+}
+
+// hashVisoDevice reads size bytes of a device back, not from the page
+// cache, and returns their SHA-256
+func hashVisoDevice(path string, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+	return copyVisoDisk(io.Discard, f, size, "Verifying")
+}
+
+// openVisoDisk opens the raw disk of an image for reading: the image file
+// itself when it is raw, a read-only qemu-nbd device for a qcow2 image.
+// release closes it.
+func openVisoDisk(image string) (disk *os.File, release func(), err error) {
+	if visoImageFormat(image) == "raw" {
+		f, err := os.Open(image)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { f.Close() }, nil
+	}
+	if _, err := exec.LookPath("qemu-nbd"); err != nil {
+		return nil, nil, fmt.Errorf("qemu-nbd not found; install qemu-utils")
+	}
+	if _, err := os.Stat(filepath.Join(visoSysBlock, "nbd0")); err != nil {
+		exec.Command("modprobe", "nbd", "max_part=8").Run()
+	}
+	device, err := freeNbdDevice(visoSysBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	if out, err := exec.Command("qemu-nbd", "--connect="+device, "--format=qcow2", "--read-only", image).CombinedOutput(); err != nil {
+		return nil, nil, fmt.Errorf("qemu-nbd failed: %s", strings.TrimSpace(string(out)))
+	}
+	disconnect := func() { exec.Command("qemu-nbd", "--disconnect", device).Run() }
+	if err := waitNbdDevice(device); err != nil {
+		disconnect()
+		return nil, nil, err
+	}
+	f, err := os.Open(device)
+	if err != nil {
+		disconnect()
+		return nil, nil, err
+	}
+	return f, func() { f.Close(); disconnect() }, nil
+}
+
+func runVisoWrite(cmd *cobra.Command, args []string) error {
+	image, target := args[0], args[1]
+	noVerify, _ := cmd.Flags().GetBool("no-verify")
+	force, _ := cmd.Flags().GetBool("force")
+	yes, _ := cmd.Flags().GetBool("yes")
+
+	if info, err := os.Stat(image); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("VISO file not found: %s", image)
+	}
+	if enc := visoEncryption(image); enc != "" {
+		return fmt.Errorf("%s is encrypted (%s), and MixOS cannot unlock its disk on real hardware", image, enc)
+	}
+	if err := checkVisoUnused(image); err != nil {
+		return err
+	}
+	path, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return fmt.Errorf("device not found: %s", target)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s is not a block device", target)
+	}
+	d, err := readVisoDevice(visoSysBlock, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	mounts, _ := os.ReadFile(visoProcMounts)
+	swaps, _ := os.ReadFile(visoProcSwaps)
+	if err := visoDeviceBusy(visoSysBlock, d, string(mounts), string(swaps)); err != nil {
+		return err
+	}
+	if !d.Removable && !force {
+		return fmt.Errorf("%s is not a removable disk; pass --force if it is the right one", d.Path)
+	}
+	size, err := visoDiskSize(image)
+	if err != nil {
+		return err
+	}
+	if size > d.Size {
+		return fmt.Errorf("%s needs %s and %s holds %s", image, formatSize(size), d.Path, formatSize(d.Size))
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("writing to a device must be run as root")
+	}
+
+	desc := []string{formatSize(d.Size)}
+	if d.Model != "" {
+		desc = append([]string{d.Model}, desc...)
+	}
+	switch {
+	case d.USB:
+		desc = append(desc, "USB")
+	case d.Removable:
+		desc = append(desc, "removable")
+	default:
+		desc = append(desc, "\033[33mnot removable\033[0m")
+	}
+	fmt.Printf("Image:  %s (%s, %s disk)\n", image, visoImageFormat(image), formatSize(size))
+	fmt.Printf("Device: %s (%s)\n", d.Path, strings.Join(desc, ", "))
+	if !yes {
+		fmt.Printf("\nAll data on %s will be lost. Proceed? [y/N] ", d.Path)
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Write cancelled.")
+			return nil
+		}
+	}
+	fmt.Println("")
+
+	disk, release, err := openVisoDisk(image)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// O_EXCL makes the kernel refuse a device that is mounted or held
+	dev, err := os.OpenFile(d.Path, os.O_WRONLY|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %w", d.Path, err)
+	}
+	start := time.Now()
+	sum, err := copyVisoDisk(dev, disk, size, "Writing")
+	if err == nil {
+		fmt.Println("  Flushing...")
+		err = dev.Sync()
+	}
+	if cerr := dev.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s failed: %w", d.Path, err)
+	}
+	took := time.Since(start).Round(time.Second)
+
+	if !noVerify {
+		written, err := hashVisoDevice(d.Path, size)
+		if err != nil {
+			return fmt.Errorf("reading %s back failed: %w", d.Path, err)
+		}
+		if !bytes.Equal(written, sum) {
+			return fmt.Errorf("verification failed: %s does not hold the image; the device may be faulty", d.Path)
+		}
+	}
+
+	fmt.Printf("\n✓ Wrote %s to %s (%s in %s)\n", image, d.Path, formatSize(size), took)
+	if !noVerify {
+		fmt.Println("  Verified by reading the device back")
+	}
+	name := strings.TrimSuffix(filepath.Base(image), ".viso")
+	fmt.Printf("  Boot %s and %s from it with SDISK=%s.VISO\n", visoKernelPath, visoInitramfsPath, name)
+	return nil
+}
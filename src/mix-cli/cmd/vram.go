@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -32,22 +33,48 @@ Benefits:
 var vramStatusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show VRAM status",
-	Long:  `Display current VRAM mode status and system memory information.`,
-	RunE:  runVramStatus,
+	Long: `Display current VRAM mode status and system memory information.
+
+While VRAM is active this includes how full the RAM root is, how much
+has changed since the last "mix vram sync" and when that sync ran.
+--json prints the same for monitoring agents; sizes are in bytes.
+
+--quiet prints nothing and exits with the state, for scripts:
+  0  VRAM is active
+  1  VRAM is inactive
+  2  this machine cannot run VRAM mode`,
+	RunE: runVramStatus,
 }
 
 var vramEnableCmd = &cobra.Command{
 	Use:   "enable",
 	Short: "Enable VRAM mode for next boot",
-	Long:  `Configure the system to boot in VRAM mode on next restart.`,
-	RunE:  runVramEnable,
+	Long: `Configure the system to boot in VRAM mode on next restart.
+
+VRAM=auto is added to the kernel command line of the MixOS entry of each
+bootloader found (GRUB, systemd-boot or syslinux), on the root and on the
+VISO disk. The previous configuration is kept as <file>.mix-vram.bak.
+
+With --budget, VRAM=<size> is added instead: the directories of the
+hotset (/etc/mixos/vram-hotset, or the list of the system profile) are
+loaded into RAM in order while they fit in that size, and the rest of
+the root runs from disk. This works on machines with too little memory
+for the whole root.
+
+Examples:
+  mix vram enable
+  mix vram enable --budget 2G`,
+	RunE: runVramEnable,
 }
 
 var vramDisableCmd = &cobra.Command{
 	Use:   "disable",
 	Short: "Disable VRAM mode",
-	Long:  `Configure the system to boot in normal mode on next restart.`,
-	RunE:  runVramDisable,
+	Long: `Configure the system to boot in normal mode on next restart.
+
+VRAM= is removed from the kernel command line of the MixOS boot entry,
+keeping the previous configuration as <file>.mix-vram.bak.`,
+	RunE: runVramDisable,
 }
 
 var vramInfoCmd = &cobra.Command{
@@ -63,6 +90,7 @@ func init() {
 	vramCmd.AddCommand(vramEnableCmd)
 	vramCmd.AddCommand(vramDisableCmd)
 	vramCmd.AddCommand(vramInfoCmd)
+	vramEnableCmd.Flags().String("budget", "", "load only as much of the root as fits in this size (e.g. 2G)")
 }
 
 // Memory information structure
@@ -72,6 +100,7 @@ type MemInfo struct {
 	MemAvailable int64
 	Buffers      int64
 	Cached       int64
+	Shmem        int64
 	SwapTotal    int64
 	SwapFree     int64
 }
@@ -106,6 +135,8 @@ func getMemInfo() (*MemInfo, error) {
 			info.Buffers = value
 		case "Cached:":
 			info.Cached = value
+		case "Shmem:":
+			info.Shmem = value
 		case "SwapTotal:":
 			info.SwapTotal = value
 		case "SwapFree:":
@@ -116,6 +147,35 @@ func getMemInfo() (*MemInfo, error) {
 	return info, nil
 }
 
+// parseSizeMB parses sizes like "2G", "512M" or "1024" (megabytes) into MB
+func parseSizeMB(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	factor := 1.0
+	switch s[len(s)-1] {
+	case 'K':
+		factor = 1.0 / 1024
+	case 'M':
+	case 'G':
+		factor = 1024
+	case 'T':
+		factor = 1024 * 1024
+	default:
+		s += "M"
+	}
+	s = s[:len(s)-1]
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * factor), nil
+}
+
 // Check if system is running in VRAM mode
 func isVramActive() bool {
 	// Check for VRAM status file
@@ -146,8 +206,11 @@ func checkVramCapability() (bool, string) {
 		return false, "Cannot read memory information"
 	}
 
-	// Minimum 2GB RAM required
+	// Minimum 2GB RAM required, less when zram compresses the root
 	minRAM := int64(2048)
+	if conf, err := loadVramConfig(); err == nil && conf.zram() {
+		minRAM = 1536
+	}
 	if info.MemTotal < minRAM {
 		return false, fmt.Sprintf("Insufficient RAM: %dMB (minimum %dMB required)", info.MemTotal, minRAM)
 	}
@@ -156,6 +219,17 @@ func checkVramCapability() (bool, string) {
 }
 
 func runVramStatus(cmd *cobra.Command, args []string) error {
+	if quiet, _ := cmd.Flags().GetBool("quiet"); quiet {
+		// Only the state: skip the walk for unsynced changes
+		stats := &VramStats{Active: isVramActive()}
+		stats.Capable, _ = checkVramCapability()
+		os.Exit(vramStatusCode(stats))
+	}
+	stats := collectVramStats(time.Now())
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		return printVramStatsJSON(stats)
+	}
+
 	fmt.Println("")
 	fmt.Println("╔══════════════════════════════════════════════════════════════╗")
 	fmt.Println("║                    VRAM Status                               ║")
@@ -163,7 +237,7 @@ func runVramStatus(cmd *cobra.Command, args []string) error {
 	fmt.Println("")
 
 	// Check if VRAM is active
-	if isVramActive() {
+	if stats.Active {
 		fmt.Println("  Status: \033[32mACTIVE\033[0m 🚀")
 		fmt.Println("  System is running entirely from RAM!")
 		fmt.Println("")
@@ -172,6 +246,8 @@ func runVramStatus(cmd *cobra.Command, args []string) error {
 		if data, err := os.ReadFile("/run/initramfs/vram-size"); err == nil {
 			fmt.Printf("  VRAM Size: %s MB\n", strings.TrimSpace(string(data)))
 		}
+		printVramStats(stats)
+		printZramStatus()
 	} else {
 		fmt.Println("  Status: \033[33mINACTIVE\033[0m")
 		fmt.Println("  System is running in normal mode.")
@@ -193,11 +269,10 @@ func runVramStatus(cmd *cobra.Command, args []string) error {
 	fmt.Println("")
 
 	// Check capability
-	capable, msg := checkVramCapability()
-	if capable {
-		fmt.Printf("  VRAM Capability: \033[32m%s\033[0m\n", msg)
+	if stats.Capable {
+		fmt.Printf("  VRAM Capability: \033[32m%s\033[0m\n", stats.Capability)
 	} else {
-		fmt.Printf("  VRAM Capability: \033[31m%s\033[0m\n", msg)
+		fmt.Printf("  VRAM Capability: \033[31m%s\033[0m\n", stats.Capability)
 	}
 
 	fmt.Println("")
@@ -205,49 +280,60 @@ func runVramStatus(cmd *cobra.Command, args []string) error {
 }
 
 func runVramEnable(cmd *cobra.Command, args []string) error {
-	// Check capability first
-	capable, msg := checkVramCapability()
-	if !capable {
-		return fmt.Errorf("cannot enable VRAM: %s", msg)
+	param := vramBootParam
+	if budget, _ := cmd.Flags().GetString("budget"); budget != "" {
+		mb, err := parseSizeMB(budget)
+		if err != nil {
+			return err
+		}
+		info, err := getMemInfo()
+		if err != nil {
+			return fmt.Errorf("failed to get memory info: %w", err)
+		}
+		if err := checkVramBudget(mb, info.MemTotal); err != nil {
+			return fmt.Errorf("cannot enable VRAM: %w", err)
+		}
+		param = vramBudgetParam(mb)
+	} else if capable, msg := checkVramCapability(); !capable {
+		return fmt.Errorf("cannot enable VRAM: %s (a size-limited root may fit, see --budget)", msg)
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM mode must be enabled as root")
 	}
 
 	fmt.Println("Enabling VRAM mode for next boot...")
+	edited, err := updateVramBoot(param)
+	if err != nil {
+		return err
+	}
 
-	// Update GRUB/bootloader configuration
-	grubCfg := "/boot/grub/grub.cfg"
-	if _, err := os.Stat(grubCfg); err == nil {
-		// Add VRAM=auto to kernel cmdline
-		fmt.Println("Updating bootloader configuration...")
-
-		// This would typically modify the bootloader config
-		// For now, we'll create a flag file
-		os.MkdirAll("/etc/mixos", 0755)
-		os.WriteFile("/etc/mixos/vram-enabled", []byte("auto\n"), 0644)
+	os.MkdirAll("/etc/mixos", 0755)
+	os.WriteFile("/etc/mixos/vram-enabled", []byte(strings.TrimPrefix(param, "VRAM=")+"\n"), 0644)
 
-		fmt.Println("")
-		fmt.Println("\033[32m✓ VRAM mode enabled!\033[0m")
-		fmt.Println("")
-		fmt.Println("On next boot, add this kernel parameter:")
-		fmt.Println("  VRAM=auto")
+	fmt.Println("")
+	fmt.Println("\033[32m✓ VRAM mode enabled!\033[0m")
+	fmt.Println("")
+	if !edited {
+		fmt.Println("No bootloader configuration found. On next boot, add this kernel parameter:")
+		fmt.Printf("  %s\n", param)
 		fmt.Println("")
 		fmt.Println("Or use the QEMU command:")
-		fmt.Println("  qemu-system-x86_64 ... -append \"VRAM=auto\"")
-	} else {
-		// Create flag file for initramfs to read
-		os.MkdirAll("/etc/mixos", 0755)
-		os.WriteFile("/etc/mixos/vram-enabled", []byte("auto\n"), 0644)
-
-		fmt.Println("")
-		fmt.Println("\033[32m✓ VRAM mode configured!\033[0m")
-		fmt.Println("")
-		fmt.Println("Boot with kernel parameter: VRAM=auto")
+		fmt.Printf("  qemu-system-x86_64 ... -append \"%s\"\n", param)
+		return nil
 	}
-
+	fmt.Println("The system will boot into RAM on next restart.")
 	return nil
 }
 
 func runVramDisable(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM mode must be disabled as root")
+	}
 	fmt.Println("Disabling VRAM mode...")
+	edited, err := updateVramBoot("")
+	if err != nil {
+		return err
+	}
 
 	// Remove VRAM flag file
 	os.Remove("/etc/mixos/vram-enabled")
@@ -255,11 +341,32 @@ func runVramDisable(cmd *cobra.Command, args []string) error {
 	fmt.Println("")
 	fmt.Println("\033[32m✓ VRAM mode disabled!\033[0m")
 	fmt.Println("")
+	if !edited {
+		fmt.Println("No bootloader configuration found; boot without the VRAM= kernel parameter.")
+		return nil
+	}
 	fmt.Println("System will boot in normal mode on next restart.")
-
 	return nil
 }
 
+// updateVramBoot sets param in the bootloader entries, or clears VRAM=
+// when it is empty, and prints what changed; it reports whether any
+// bootloader was found
+func updateVramBoot(param string) (bool, error) {
+	roots, release, err := vramBootRoots()
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	fmt.Println("Updating bootloader configuration...")
+	report, err := editVramBootEntries(roots, param)
+	for _, line := range report {
+		fmt.Printf("  ✓ %s\n", line)
+	}
+	return len(report) > 0, err
+}
+
 func runVramInfo(cmd *cobra.Command, args []string) error {
 	fmt.Println("")
 	fmt.Println("╔══════════════════════════════════════════════════════════════╗")
@@ -324,6 +431,14 @@ func runVramInfo(cmd *cobra.Command, args []string) error {
 		} else {
 			fmt.Println("  Current Mode:  Normal")
 		}
+
+		if conf, err := loadVramConfig(); err == nil {
+			fmt.Printf("  Compression:   %s\n", conf.describe())
+			fmt.Printf("  Backend:       %s\n", conf.describeBackend())
+			if boot := bootVramConfig(); boot != nil && isVramActive() && boot.describe() != conf.describe() {
+				fmt.Printf("                 (booted with %s)\n", boot.describe())
+			}
+		}
 	}
 
 	fmt.Println("")
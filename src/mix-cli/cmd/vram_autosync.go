@@ -0,0 +1,489 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Autosync
+// ============================================================================
+//
+// A small daemon that runs "mix vram sync" every interval, so that a power
+// loss only loses the changes made since the last flush. It is started by
+// an init script at boot and does nothing when the system did not boot in
+// VRAM mode.
+//
+// With --on-shutdown a shutdown hook runs first among the K scripts of
+// rcK: it stops the daemon, lets a sync in progress finish, and makes a
+// final sync with its progress on the console. Reboot and poweroff wait
+// for it, up to the shutdown timeout.
+
+const (
+	vramAutosyncConfig  = "/etc/mixos/vram-autosync.json"
+	vramAutosyncScript  = "/etc/init.d/S60vram-autosync"
+	vramAutosyncStopRC  = "/etc/init.d/K10vram-autosync"
+	vramShutdownHook    = "/etc/init.d/K05vram-shutdown"
+	vramAutosyncPIDFile = "/run/mix-vram-autosync.pid"
+	vramLogFile         = "/var/log/mixos/vram.log"
+
+	vramAutosyncDefaultInterval = 10 * time.Minute
+	vramAutosyncMinInterval     = time.Minute
+	vramShutdownDefaultTimeout  = 5 * time.Minute
+)
+
+// VramAutosync is the persisted autosync configuration
+type VramAutosync struct {
+	Enabled         bool      `json:"enabled"`
+	Interval        string    `json:"interval"`
+	OnShutdown      bool      `json:"on_shutdown"`
+	ShutdownTimeout string    `json:"shutdown_timeout,omitempty"` // how long the final sync may hold up a shutdown
+	Updated         time.Time `json:"updated"`
+}
+
+var vramAutosyncCmd = &cobra.Command{
+	Use:   "autosync",
+	Short: "Periodically write VRAM changes back to disk",
+	Long: `Run a background daemon that syncs the RAM root to disk.
+
+Without a subcommand the current configuration and the last sync are
+shown. With --on-shutdown, reboot and poweroff wait for a final sync,
+showing its progress on the console, for up to --shutdown-timeout.
+
+Examples:
+  mix vram autosync enable --interval 10m --on-shutdown
+  mix vram autosync enable --on-shutdown --shutdown-timeout 10m
+  mix vram autosync disable
+  mix vram autosync`,
+	RunE: runVramAutosyncStatus,
+}
+
+var vramAutosyncEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Enable the autosync daemon",
+	RunE:  runVramAutosyncEnable,
+}
+
+var vramAutosyncDisableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Disable the autosync daemon",
+	RunE:  runVramAutosyncDisable,
+}
+
+var vramAutosyncRunCmd = &cobra.Command{
+	Use:    "run",
+	Short:  "Run the autosync daemon (started by the init script)",
+	Hidden: true,
+	RunE:   runVramAutosyncDaemon,
+}
+
+var vramAutosyncShutdownCmd = &cobra.Command{
+	Use:    "shutdown",
+	Short:  "Make the final sync of a shutdown (run by the shutdown hook)",
+	Hidden: true,
+	RunE:   runVramAutosyncShutdown,
+}
+
+func init() {
+	vramCmd.AddCommand(vramAutosyncCmd)
+	vramAutosyncCmd.AddCommand(vramAutosyncEnableCmd)
+	vramAutosyncCmd.AddCommand(vramAutosyncDisableCmd)
+	vramAutosyncCmd.AddCommand(vramAutosyncRunCmd)
+	vramAutosyncCmd.AddCommand(vramAutosyncShutdownCmd)
+
+	vramAutosyncEnableCmd.Flags().Duration("interval", vramAutosyncDefaultInterval, "time between syncs")
+	vramAutosyncEnableCmd.Flags().Bool("on-shutdown", false, "also sync when the system shuts down")
+	vramAutosyncEnableCmd.Flags().Duration("shutdown-timeout", vramShutdownDefaultTimeout, "longest a shutdown waits for the final sync")
+}
+
+// ============================================================================
+// Configuration
+// ============================================================================
+
+func loadVramAutosync() (*VramAutosync, error) {
+	data, err := os.ReadFile(vramAutosyncConfig)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &VramAutosync{Interval: vramAutosyncDefaultInterval.String()}, nil
+		}
+		return nil, err
+	}
+	var conf VramAutosync
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", vramAutosyncConfig, err)
+	}
+	return &conf, nil
+}
+
+func saveVramAutosync(conf *VramAutosync) error {
+	conf.Updated = time.Now()
+	data, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(vramAutosyncConfig), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(vramAutosyncConfig, data, 0644)
+}
+
+// interval returns the configured interval, falling back to the default
+func (c *VramAutosync) interval() time.Duration {
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil || d < vramAutosyncMinInterval {
+		return vramAutosyncDefaultInterval
+	}
+	return d
+}
+
+// shutdownTimeout returns the configured shutdown timeout, falling back to
+// the default
+func (c *VramAutosync) shutdownTimeout() time.Duration {
+	d, err := time.ParseDuration(c.ShutdownTimeout)
+	if err != nil || d <= 0 {
+		return vramShutdownDefaultTimeout
+	}
+	return d
+}
+
+// describeShutdown summarizes the shutdown setting
+func (c *VramAutosync) describeShutdown() string {
+	if !c.OnShutdown {
+		return "no sync"
+	}
+	return fmt.Sprintf("sync before reboot and poweroff, up to %s", c.shutdownTimeout())
+}
+
+// vramAutosyncInitScript starts the daemon at boot. Stopping it waits for
+// a sync in progress, so that rcK only unmounts once it is on disk.
+const vramAutosyncInitScript = `#!/bin/sh
+# Managed by 'mix vram autosync' - do not edit
+
+MIX=/usr/bin/mix
+PIDFILE=` + vramAutosyncPIDFile + `
+LOGFILE=` + vramLogFile + `
+
+case "$1" in
+    start)
+        echo "Starting VRAM autosync..."
+        mkdir -p $(dirname $LOGFILE)
+        $MIX vram autosync run >> $LOGFILE 2>&1 &
+        echo $! > $PIDFILE
+        ;;
+    stop)
+        echo "Stopping VRAM autosync..."
+        if [ -f $PIDFILE ]; then
+            pid=$(cat $PIDFILE)
+            kill $pid 2>/dev/null
+            # Wait up to 5 minutes for a sync in progress
+            i=0
+            while kill -0 $pid 2>/dev/null && [ $i -lt 300 ]; do
+                sleep 1
+                i=$((i + 1))
+            done
+            rm -f $PIDFILE
+        fi
+        ;;
+    restart)
+        $0 stop
+        $0 start
+        ;;
+    *)
+        echo "Usage: $0 {start|stop|restart}"
+        exit 1
+        ;;
+esac
+`
+
+// vramShutdownHookScript holds up rcK until the final sync is made; its
+// output goes to the console, where the shutdown is shown
+const vramShutdownHookScript = `#!/bin/sh
+# Managed by 'mix vram autosync' - do not edit
+
+case "$1" in
+    stop)
+        /usr/bin/mix vram autosync shutdown < /dev/null > /dev/console 2>&1 || true
+        ;;
+esac
+`
+
+// installVramAutosync installs or removes the init script, its shutdown
+// link and the shutdown hook
+func installVramAutosync(enabled, onShutdown bool) error {
+	if !enabled || !onShutdown {
+		if err := os.Remove(vramShutdownHook); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !enabled {
+		for _, path := range []string{vramAutosyncStopRC, vramAutosyncScript} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(vramAutosyncScript), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(vramAutosyncScript, []byte(vramAutosyncInitScript), 0755); err != nil {
+		return err
+	}
+	if onShutdown {
+		if err := os.WriteFile(vramShutdownHook, []byte(vramShutdownHookScript), 0755); err != nil {
+			return err
+		}
+	}
+	os.Remove(vramAutosyncStopRC)
+	return os.Symlink(filepath.Base(vramAutosyncScript), vramAutosyncStopRC)
+}
+
+// vramAutosyncPID returns the pid of the running daemon, 0 if none
+func vramAutosyncPID() int {
+	data, err := os.ReadFile(vramAutosyncPIDFile)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return 0
+	}
+	return pid
+}
+
+// ============================================================================
+// Daemon
+// ============================================================================
+
+// autosyncVram runs one sync; syncVram records its outcome
+func autosyncVram(reason string) error {
+	_, _, err := syncVram(false, reason)
+	return err
+}
+
+func runVramAutosyncDaemon(cmd *cobra.Command, args []string) error {
+	if !isVramActive() {
+		fmt.Println("Not running in VRAM mode; autosync not needed")
+		return nil
+	}
+	conf, err := loadVramAutosync()
+	if err != nil {
+		return err
+	}
+	if !conf.Enabled {
+		return fmt.Errorf("VRAM autosync is disabled")
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	ticker := time.NewTicker(conf.interval())
+	defer ticker.Stop()
+	logVramEvent(vramEventDaemon, "autosync started: every %s, on shutdown %v", conf.interval(), conf.OnShutdown)
+
+	for {
+		select {
+		case <-ticker.C:
+			autosyncVram("periodic")
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				// Reload the configuration
+				if c, err := loadVramAutosync(); err == nil {
+					conf = c
+					ticker.Reset(conf.interval())
+					logVramEvent(vramEventDaemon, "autosync reloaded: every %s, on shutdown %v", conf.interval(), conf.OnShutdown)
+				}
+				continue
+			}
+			// The shutdown hook makes the final sync; without it, as
+			// installed by older versions, the daemon does
+			if _, err := os.Stat(vramShutdownHook); conf.OnShutdown && os.IsNotExist(err) {
+				autosyncVram("shutdown")
+			}
+			logVramEvent(vramEventDaemon, "autosync stopped")
+			return nil
+		}
+	}
+}
+
+// runVramAutosyncShutdown makes the final sync of a shutdown, printing
+// its progress every second; past the timeout it gives up so that the
+// shutdown goes on
+func runVramAutosyncShutdown(cmd *cobra.Command, args []string) error {
+	if !isVramActive() {
+		return nil
+	}
+	conf, err := loadVramAutosync()
+	if err != nil {
+		return err
+	}
+	timeout := conf.shutdownTimeout()
+	start := time.Now()
+	deadline := start.Add(timeout)
+	fmt.Println("VRAM: saving the RAM root to disk before shutdown...")
+
+	// Stop the daemon and let a sync in progress, its own or one started
+	// by hand, finish first
+	if pid := vramAutosyncPID(); pid != 0 {
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+	for time.Now().Before(deadline) {
+		if vramAutosyncPID() == 0 {
+			if unlock, err := lockVram(); err == nil {
+				unlock()
+				break
+			}
+		}
+		fmt.Printf("\r  Waiting for the sync in progress... %s ", time.Since(start).Round(time.Second))
+		time.Sleep(time.Second)
+	}
+
+	vramSyncWritten.Store(0)
+	done := make(chan error, 1)
+	go func() { done <- autosyncVram("shutdown") }()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	expired := time.NewTimer(time.Until(deadline))
+	defer expired.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			fmt.Print("\r\033[K")
+			if err != nil {
+				fmt.Printf("\033[31m✗ VRAM sync failed:\033[0m %v\n", err)
+				return nil
+			}
+			r := loadVramSyncResult()
+			if r == nil {
+				r = &VramSyncResult{}
+			}
+			fmt.Printf("\033[32m✓ RAM root saved:\033[0m %d file(s), %s in %s\n",
+				r.Files, formatSize(r.Bytes), time.Since(start).Round(time.Second))
+			return nil
+		case <-ticker.C:
+			fmt.Printf("\r  Syncing: %s written, %s elapsed, giving up in %s ", formatSize(vramSyncWritten.Load()),
+				time.Since(start).Round(time.Second), time.Until(deadline).Round(time.Second))
+		case <-expired.C:
+			fmt.Print("\r\033[K")
+			logVramEvent(vramEventFailure, "shutdown sync gave up after %s", timeout)
+			fmt.Printf("\033[33m✗ VRAM sync gave up after %s;\033[0m changes since the last sync are lost\n", timeout)
+			return nil
+		}
+	}
+}
+
+// ============================================================================
+// Commands
+// ============================================================================
+
+func runVramAutosyncEnable(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM autosync must be configured as root")
+	}
+	interval, _ := cmd.Flags().GetDuration("interval")
+	if interval < vramAutosyncMinInterval {
+		return fmt.Errorf("interval must be at least %s", vramAutosyncMinInterval)
+	}
+	conf, err := loadVramAutosync()
+	if err != nil {
+		return err
+	}
+	conf.Enabled = true
+	conf.Interval = interval.String()
+	if cmd.Flags().Changed("on-shutdown") {
+		conf.OnShutdown, _ = cmd.Flags().GetBool("on-shutdown")
+	}
+	if cmd.Flags().Changed("shutdown-timeout") {
+		timeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
+		if timeout <= 0 {
+			return fmt.Errorf("shutdown timeout must be positive")
+		}
+		conf.ShutdownTimeout = timeout.String()
+	}
+	if err := saveVramAutosync(conf); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	if err := installVramAutosync(true, conf.OnShutdown); err != nil {
+		return fmt.Errorf("failed to install init script: %w", err)
+	}
+	logVramEvent(vramEventConfig, "autosync enabled: every %s, on shutdown %v", interval, conf.OnShutdown)
+
+	fmt.Println("\033[32m✓ VRAM autosync enabled\033[0m")
+	fmt.Printf("  Interval:    %s\n", interval)
+	fmt.Printf("  On shutdown: %s\n", conf.describeShutdown())
+	if !isVramActive() {
+		fmt.Println("  The daemon starts on the next VRAM boot.")
+		return nil
+	}
+	if pid := vramAutosyncPID(); pid != 0 {
+		syscall.Kill(pid, syscall.SIGHUP)
+	} else if err := exec.Command(vramAutosyncScript, "start").Run(); err != nil {
+		return fmt.Errorf("failed to start the daemon: %w", err)
+	}
+	return nil
+}
+
+func runVramAutosyncDisable(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM autosync must be configured as root")
+	}
+	conf, err := loadVramAutosync()
+	if err != nil {
+		return err
+	}
+	if vramAutosyncPID() != 0 {
+		exec.Command(vramAutosyncScript, "stop").Run()
+	}
+	conf.Enabled = false
+	if err := saveVramAutosync(conf); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	if err := installVramAutosync(false, false); err != nil {
+		return fmt.Errorf("failed to remove init script: %w", err)
+	}
+	logVramEvent(vramEventConfig, "autosync disabled")
+	fmt.Println("✓ VRAM autosync disabled")
+	if isVramActive() {
+		fmt.Println("  Run 'mix vram sync' to keep this across reboots.")
+	}
+	return nil
+}
+
+func runVramAutosyncStatus(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramAutosync()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("VRAM Autosync:")
+	if !conf.Enabled {
+		fmt.Println("  Status:      disabled")
+	} else {
+		fmt.Println("  Status:      enabled")
+		fmt.Printf("  Interval:    %s\n", conf.interval())
+		fmt.Printf("  On shutdown: %s\n", conf.describeShutdown())
+		if pid := vramAutosyncPID(); pid != 0 {
+			fmt.Printf("  Daemon:      running (pid %d)\n", pid)
+		} else {
+			fmt.Println("  Daemon:      not running")
+		}
+	}
+	if r := loadVramSyncResult(); r != nil {
+		if r.Error != "" {
+			fmt.Printf("  Last sync:   %s, failed: %s\n", r.Time.Format("2006-01-02 15:04:05"), r.Error)
+		} else {
+			fmt.Printf("  Last sync:   %s (%d file(s), %s)\n", r.Time.Format("2006-01-02 15:04:05"), r.Files, formatSize(r.Bytes))
+		}
+	}
+	return nil
+}
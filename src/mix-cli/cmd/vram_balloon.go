@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// VRAM and the virtio balloon
+// ============================================================================
+//
+// Under QEMU/KVM the host takes memory back from the guest by inflating a
+// virtio balloon: the guest driver allocates pages and hands them over,
+// and MemAvailable drops under a RAM root that cannot shrink with it. The
+// pressure monitor follows the balloon through the balloon_inflate and
+// balloon_deflate counters of /proc/vmstat, in pages. When the host takes
+// vramBalloonStepMB or more it warns and syncs to disk right away, before
+// the OOM killer has a say; with balloon_shrink it also lowers the size
+// limit of the RAM root by as much, down to its data plus a reserve, so
+// that writes fail with "no space" instead. The limit grows back as the
+// host returns the memory.
+
+const (
+	vramBalloonDriver = "/sys/bus/virtio/drivers/virtio_balloon"
+	vramBalloonStepMB = 64 // smaller moves are ignored
+)
+
+// vramBalloonPresent reports whether a virtio balloon is bound
+func vramBalloonPresent() bool {
+	devices, _ := os.ReadDir(vramBalloonDriver)
+	for _, d := range devices {
+		if strings.HasPrefix(d.Name(), "virtio") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVramBalloon returns the size of the balloon in bytes from
+// /proc/vmstat, false when the kernel does not count it
+func parseVramBalloon(vmstat string, pageSize int64) (int64, bool) {
+	var inflated, deflated int64
+	found := false
+	for _, line := range strings.Split(vmstat, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "balloon_inflate":
+			inflated, found = n, true
+		case "balloon_deflate":
+			deflated = n
+		}
+	}
+	return max(0, inflated-deflated) * pageSize, found
+}
+
+// readVramBalloon returns the size of the balloon in MB, false when the
+// system has none
+func readVramBalloon() (int64, bool) {
+	if !vramBalloonPresent() {
+		return 0, false
+	}
+	data, err := os.ReadFile("/proc/vmstat")
+	if err != nil {
+		return 0, false
+	}
+	bytes, ok := parseVramBalloon(string(data), int64(os.Getpagesize()))
+	return bytes >> 20, ok
+}
+
+// vramBalloonShrink returns the size limit of target after the host took
+// takenMB: lower by as much, but not below its data plus the reserve
+func vramBalloonShrink(target *vramResizeTarget, takenMB int64) int64 {
+	return max(target.SizeMB-takenMB, target.UsedMB+vramResizeReserveMB)
+}
+
+// vramBalloonWatch follows the balloon for the pressure monitor
+type vramBalloonWatch struct {
+	lastMB     int64 // balloon size when last acted on
+	originalMB int64 // size limit of the root before it was lowered, 0 if it was not
+}
+
+// check compares the balloon with its last size and reacts to a move of
+// at least vramBalloonStepMB; sync runs the emergency sync
+func (w *vramBalloonWatch) check(conf *VramPressure, balloonMB, availableMB int64, sync func()) {
+	switch {
+	case balloonMB-w.lastMB >= vramBalloonStepMB:
+		taken := balloonMB - w.lastMB
+		warnVramPressure("the host took %dMB through the balloon (%dMB in total, %dMB available); syncing to disk",
+			taken, balloonMB, availableMB)
+		sync()
+		if conf.BalloonShrink {
+			w.shrink(taken)
+		}
+	case w.lastMB-balloonMB >= vramBalloonStepMB:
+		returned := w.lastMB - balloonMB
+		logVramEvent(vramEventPressure, "the host returned %dMB through the balloon (%dMB in total)", returned, balloonMB)
+		if w.originalMB != 0 {
+			w.grow(returned, availableMB)
+		}
+	default:
+		return
+	}
+	w.lastMB = balloonMB
+}
+
+// shrink lowers the size limit of the RAM root by takenMB
+func (w *vramBalloonWatch) shrink(takenMB int64) {
+	target, err := findVramResizeTarget("")
+	if err != nil || target.SizeMB == 0 {
+		logVramEvent(vramEventPressure, "RAM root left as it is: no size limit to lower")
+		return
+	}
+	size := vramBalloonShrink(target, takenMB)
+	if size >= target.SizeMB {
+		return
+	}
+	if err := target.apply(size); err != nil {
+		warnVramPressure("failed to shrink the %s to %dMB: %v", target.describe(), size, err)
+		return
+	}
+	if w.originalMB == 0 {
+		w.originalMB = target.SizeMB
+	}
+	warnVramPressure("shrank the %s from %dMB to %dMB while the host holds the memory", target.describe(), target.SizeMB, size)
+}
+
+// grow gives the RAM root back up to returnedMB of its size limit, as far
+// as it was lowered
+func (w *vramBalloonWatch) grow(returnedMB, availableMB int64) {
+	target, err := findVramResizeTarget("")
+	if err != nil {
+		return
+	}
+	size := min(w.originalMB, target.SizeMB+returnedMB)
+	if size <= target.SizeMB || checkVramResize(target, size, availableMB) != nil {
+		return
+	}
+	if err := target.apply(size); err != nil {
+		warnVramPressure("failed to grow the %s back to %dMB: %v", target.describe(), size, err)
+		return
+	}
+	logVramEvent(vramEventPressure, "grew the %s back from %dMB to %dMB", target.describe(), target.SizeMB, size)
+	if size == w.originalMB {
+		w.originalMB = 0
+	}
+}
+
+// describeVramBalloon summarizes the balloon for the status
+func describeVramBalloon() string {
+	mb, ok := readVramBalloon()
+	if !ok {
+		return "none"
+	}
+	return fmt.Sprintf("%d MB taken by the host (virtio-balloon)", mb)
+}
@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// VRAM Benchmark
+// ============================================================================
+//
+// "mix vram benchmark" measures what VRAM mode buys: sequential throughput
+// with 1MB blocks and random 4KB IOPS, on the RAM root and on the disk
+// underneath it. Disk writes are timed up to their fsync and the file is
+// dropped from the page cache before it is read, so that the disk numbers
+// are the disk's and not the cache's.
+
+const (
+	vramBenchBlock      = 1 << 20 // sequential block size
+	vramBenchPage       = 4 << 10 // random block size
+	vramBenchRandomOps  = 8192
+	vramBenchDefaultMB  = 256
+	vramBenchFilePrefix = ".mix-vram-bench"
+)
+
+// vramBenchResult holds the speeds measured on one target
+type vramBenchResult struct {
+	SeqWrite  float64 // MB/s
+	SeqRead   float64 // MB/s
+	RandWrite float64 // IOPS
+	RandRead  float64 // IOPS
+}
+
+var vramBenchmarkCmd = &cobra.Command{
+	Use:   "benchmark",
+	Short: "Compare the RAM root with the disk",
+	Long: `Run a short read/write benchmark on the RAM root and on the disk
+underneath it, and print the two side by side.
+
+Sequential tests use 1MB blocks; random tests use 4KB blocks at random
+offsets. A test file of --size is written to each target and removed
+afterwards. Without VRAM the RAM side runs on /dev/shm, so the benchmark
+also shows what enabling VRAM would change.
+
+Examples:
+  mix vram benchmark
+  mix vram benchmark --size 1G`,
+	RunE: runVramBenchmark,
+}
+
+func init() {
+	vramCmd.AddCommand(vramBenchmarkCmd)
+	vramBenchmarkCmd.Flags().String("size", "256M", "size of the test file")
+}
+
+// vramBenchmark runs all tests in dir with a test file of sizeMB; sync
+// makes writes durable and reads uncached, as a disk test needs
+func vramBenchmark(dir string, sizeMB int64, sync bool) (*vramBenchResult, error) {
+	f, err := os.CreateTemp(dir, vramBenchFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	result := &vramBenchResult{}
+	buf := make([]byte, vramBenchBlock)
+	rand.Read(buf)
+	size := sizeMB << 20
+
+	// Sequential write
+	start := time.Now()
+	for off := int64(0); off < size; off += vramBenchBlock {
+		if _, err := f.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	if err := flushVramBench(f, sync); err != nil {
+		return nil, err
+	}
+	result.SeqWrite = float64(sizeMB) / time.Since(start).Seconds()
+
+	// Sequential read
+	start = time.Now()
+	for off := int64(0); off < size; off += vramBenchBlock {
+		if _, err := f.ReadAt(buf, off); err != nil {
+			return nil, err
+		}
+	}
+	result.SeqRead = float64(sizeMB) / time.Since(start).Seconds()
+
+	pages := size / vramBenchPage
+	page := buf[:vramBenchPage]
+	if err := flushVramBench(f, sync); err != nil {
+		return nil, err
+	}
+
+	// Random read
+	start = time.Now()
+	for i := 0; i < vramBenchRandomOps; i++ {
+		if _, err := f.ReadAt(page, rand.Int63n(pages)*vramBenchPage); err != nil {
+			return nil, err
+		}
+	}
+	result.RandRead = vramBenchRandomOps / time.Since(start).Seconds()
+
+	// Random write
+	start = time.Now()
+	for i := 0; i < vramBenchRandomOps; i++ {
+		if _, err := f.WriteAt(page, rand.Int63n(pages)*vramBenchPage); err != nil {
+			return nil, err
+		}
+	}
+	if err := flushVramBench(f, sync); err != nil {
+		return nil, err
+	}
+	result.RandWrite = vramBenchRandomOps / time.Since(start).Seconds()
+	return result, nil
+}
+
+// flushVramBench writes the test file out and drops it from the page cache
+func flushVramBench(f *os.File, sync bool) error {
+	if !sync {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// vramBenchTargets returns the directories to test in RAM and on disk
+// with their labels; cleanup releases the disk
+func vramBenchTargets() (ramDir, ramLabel, diskDir, diskLabel string, cleanup func(), err error) {
+	cleanup = func() {}
+	active := isVramActive()
+	ramDir, ramLabel = "/dev/shm", "RAM (/dev/shm)"
+	if active {
+		ramDir, ramLabel = "/", "RAM root"
+		if paths := loadedVramPaths(); paths != nil {
+			ramDir = "/" + paths[0]
+			ramLabel = "RAM (" + ramDir + ")"
+		}
+	}
+
+	backing, berr := loadVramBacking()
+	if berr != nil {
+		if active {
+			return "", "", "", "", nil, berr
+		}
+		return ramDir, ramLabel, "/", "Disk (/)", cleanup, nil
+	}
+	unlock, err := lockVram()
+	if err != nil {
+		return "", "", "", "", nil, err
+	}
+	disk, unmount, err := backing.mount()
+	if err != nil {
+		unlock()
+		return "", "", "", "", nil, err
+	}
+	cleanup = func() {
+		unmount()
+		unlock()
+	}
+	return ramDir, ramLabel, disk, "Disk (" + backing.Device + ")", cleanup, nil
+}
+
+// checkVramBenchSpace makes sure the test file fits in dir
+func checkVramBenchSpace(dir string, sizeMB int64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	if free := int64(st.Bavail) * st.Bsize >> 20; free < sizeMB*2 {
+		return fmt.Errorf("%s has %dMB free; the %dMB test file needs twice that", dir, free, sizeMB)
+	}
+	return nil
+}
+
+func runVramBenchmark(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("the benchmark must run as root")
+	}
+	sizeArg, _ := cmd.Flags().GetString("size")
+	sizeMB, err := parseSizeMB(sizeArg)
+	if err != nil {
+		return err
+	}
+	if sizeMB < 16 {
+		return fmt.Errorf("--size must be at least 16M")
+	}
+
+	ramDir, ramLabel, diskDir, diskLabel, cleanup, err := vramBenchTargets()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	results := make([]*vramBenchResult, 2)
+	for i, target := range []struct {
+		dir, label string
+		sync       bool
+	}{{ramDir, ramLabel, false}, {diskDir, diskLabel, true}} {
+		if err := checkVramBenchSpace(target.dir, sizeMB); err != nil {
+			return err
+		}
+		fmt.Printf("Benchmarking %s with a %dMB file...\n", target.label, sizeMB)
+		if results[i], err = vramBenchmark(target.dir, sizeMB, target.sync); err != nil {
+			return fmt.Errorf("benchmark on %s failed: %w", target.dir, err)
+		}
+	}
+
+	ram, disk := results[0], results[1]
+	fmt.Println("")
+	fmt.Printf("  %-18s %16s %16s %9s\n", "Test", ramLabel, diskLabel, "Speedup")
+	fmt.Println("  ─────────────────────────────────────────────────────────────")
+	rows := []struct {
+		name      string
+		ram, disk float64
+		unit      string
+	}{
+		{"Sequential write", ram.SeqWrite, disk.SeqWrite, "MB/s"},
+		{"Sequential read", ram.SeqRead, disk.SeqRead, "MB/s"},
+		{"Random write 4K", ram.RandWrite, disk.RandWrite, "IOPS"},
+		{"Random read 4K", ram.RandRead, disk.RandRead, "IOPS"},
+	}
+	for _, r := range rows {
+		fmt.Printf("  %-18s %11.0f %-4s %11.0f %-4s %8.1fx\n", r.name, r.ram, r.unit, r.disk, r.unit, r.ram/r.disk)
+	}
+	fmt.Println("")
+	return nil
+}
@@ -0,0 +1,441 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Bootloader Entries
+// ============================================================================
+//
+// "mix vram enable" and "mix vram disable" add or remove VRAM=auto (or
+// VRAM=<size>) on the kernel command line of the MixOS boot entry of every bootloader found:
+//
+//	grub          boot/grub/grub.cfg     "linux" line of a menuentry
+//	systemd-boot  loader/entries/*.conf  "options" line
+//	syslinux      syslinux.cfg           "APPEND" line of a LABEL
+//
+// The boot entry is the bootloader's default entry when that boots MixOS
+// normally, or else the first MixOS entry that does. Configurations
+// are searched on the root and, on VISO boots, on the disk the system was
+// booted from. The previous file is kept next to the edited one.
+
+const (
+	vramBootParam  = "VRAM=auto"
+	vramBootBackup = ".mix-vram.bak"
+)
+
+// bootEntry is one entry of a bootloader configuration
+type bootEntry struct {
+	Title   string
+	Args    int // line of the kernel command line, -1 if the entry has none
+	End     int // last line of the entry
+	Default bool
+}
+
+// bootConfig is a bootloader configuration file
+type bootConfig struct {
+	Loader  string // grub, systemd-boot or syslinux
+	Path    string
+	Lines   []string
+	Entries []bootEntry
+}
+
+// vramBootSearch lists where each bootloader keeps its configuration,
+// relative to a root
+var vramBootSearch = []struct {
+	loader string
+	paths  []string
+}{
+	{"grub", []string{"boot/grub/grub.cfg", "boot/grub2/grub.cfg"}},
+	{"systemd-boot", []string{"boot/loader", "boot/efi/loader", "efi/loader"}},
+	{"syslinux", []string{"boot/syslinux/syslinux.cfg", "boot/extlinux/extlinux.conf", "boot/syslinux.cfg", "syslinux.cfg"}},
+}
+
+// ============================================================================
+// Parsing
+// ============================================================================
+
+// unquoteBootTitle strips the quotes around a grub title or default
+func unquoteBootTitle(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') {
+		if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+			return s[1 : end+1]
+		}
+	}
+	return strings.TrimSpace(strings.TrimSuffix(s, "{"))
+}
+
+// parseGrubConfig finds the menu entries of a grub.cfg
+func parseGrubConfig(lines []string) []bootEntry {
+	var entries []bootEntry
+	def := "0"
+	current := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		fields := strings.Fields(trimmed)
+		switch {
+		case strings.HasPrefix(trimmed, "set default="):
+			def = unquoteBootTitle(strings.TrimPrefix(trimmed, "set default="))
+		case len(fields) > 1 && fields[0] == "menuentry":
+			entries = append(entries, bootEntry{Title: unquoteBootTitle(strings.TrimPrefix(trimmed, "menuentry")), Args: -1, End: i})
+			current = len(entries) - 1
+		case current >= 0 && len(fields) > 0 && slices.Contains([]string{"linux", "linux16", "linuxefi"}, fields[0]):
+			entries[current].Args = i
+		case current >= 0 && trimmed == "}":
+			entries[current].End = i
+			current = -1
+		}
+	}
+	for i := range entries {
+		n, err := strconv.Atoi(def)
+		entries[i].Default = (err == nil && n == i) || entries[i].Title == def
+	}
+	return entries
+}
+
+// parseSyslinuxConfig finds the LABEL entries of a syslinux.cfg; keywords
+// are case-insensitive
+func parseSyslinuxConfig(lines []string) []bootEntry {
+	var entries []bootEntry
+	var labels []string
+	def := ""
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		keyword := strings.ToUpper(fields[0])
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), fields[0]))
+		switch {
+		case keyword == "DEFAULT":
+			def = rest
+		case keyword == "LABEL":
+			entries = append(entries, bootEntry{Title: rest, Args: -1, End: i})
+			labels = append(labels, rest)
+		case len(entries) == 0:
+			continue
+		case keyword == "MENU" && len(fields) > 2 && strings.ToUpper(fields[1]) == "LABEL":
+			entries[len(entries)-1].Title = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), fields[1]))
+			entries[len(entries)-1].End = i
+		case keyword == "APPEND":
+			entries[len(entries)-1].Args = i
+			entries[len(entries)-1].End = i
+		default:
+			if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") || keyword == "KERNEL" || keyword == "LINUX" ||
+				keyword == "INITRD" {
+				entries[len(entries)-1].End = i
+			}
+		}
+	}
+	for i := range entries {
+		entries[i].Default = labels[i] == def
+	}
+	return entries
+}
+
+// parseSystemdBootEntry reads a loader/entries/*.conf file, which holds one
+// entry; pattern is the "default" of loader.conf
+func parseSystemdBootEntry(lines []string, name, pattern string) []bootEntry {
+	entry := bootEntry{Title: strings.TrimSuffix(name, ".conf"), Args: -1, End: len(lines) - 1}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 1 && fields[0] == "title":
+			entry.Title = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "title"))
+		case len(fields) > 0 && fields[0] == "options":
+			entry.Args = i
+		}
+	}
+	if pattern != "" {
+		matched, _ := filepath.Match(pattern, name)
+		entry.Default = matched || pattern == strings.TrimSuffix(name, ".conf")
+	}
+	return []bootEntry{entry}
+}
+
+// readBootLines splits a configuration file into lines, without the final
+// newline
+func readBootLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), nil
+}
+
+// findBootConfigs returns the bootloader configurations below root
+func findBootConfigs(root string) []*bootConfig {
+	var configs []*bootConfig
+	for _, search := range vramBootSearch {
+		for _, rel := range search.paths {
+			path := filepath.Join(root, rel)
+			if search.loader == "systemd-boot" {
+				configs = append(configs, findSystemdBootEntries(path)...)
+				continue
+			}
+			lines, err := readBootLines(path)
+			if err != nil {
+				continue
+			}
+			conf := &bootConfig{Loader: search.loader, Path: path, Lines: lines}
+			if search.loader == "grub" {
+				conf.Entries = parseGrubConfig(lines)
+			} else {
+				conf.Entries = parseSyslinuxConfig(lines)
+			}
+			configs = append(configs, conf)
+			break
+		}
+	}
+	return configs
+}
+
+func findSystemdBootEntries(loaderDir string) []*bootConfig {
+	files, _ := filepath.Glob(filepath.Join(loaderDir, "entries", "*.conf"))
+	pattern := ""
+	if lines, err := readBootLines(filepath.Join(loaderDir, "loader.conf")); err == nil {
+		for _, line := range lines {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "default" {
+				pattern = fields[1]
+			}
+		}
+	}
+	var configs []*bootConfig
+	for _, path := range files {
+		lines, err := readBootLines(path)
+		if err != nil {
+			continue
+		}
+		configs = append(configs, &bootConfig{
+			Loader:  "systemd-boot",
+			Path:    path,
+			Lines:   lines,
+			Entries: parseSystemdBootEntry(lines, filepath.Base(path), pattern),
+		})
+	}
+	return configs
+}
+
+// ============================================================================
+// Editing
+// ============================================================================
+
+// bootArgs returns the kernel parameters of an entry
+func (c *bootConfig) bootArgs(e bootEntry) []string {
+	if e.Args < 0 {
+		return nil
+	}
+	fields := strings.Fields(c.Lines[e.Args])
+	if c.Loader == "grub" && len(fields) > 1 {
+		return fields[2:] // after "linux <kernel>"
+	}
+	return fields[1:]
+}
+
+// isMixOSEntry reports whether an entry boots MixOS
+func (c *bootConfig) isMixOSEntry(e bootEntry) bool {
+	if c.Loader == "systemd-boot" && strings.Contains(strings.ToLower(filepath.Base(c.Path)), "mixos") {
+		return true
+	}
+	return strings.Contains(strings.ToLower(e.Title), "mixos")
+}
+
+// isNormalBootEntry reports whether an entry boots the system as usual,
+// not the installer, a rescue shell or a debug mode
+func (c *bootConfig) isNormalBootEntry(e bootEntry) bool {
+	for _, arg := range c.bootArgs(e) {
+		if arg == "single" || arg == "debug" || strings.HasPrefix(arg, "init=") ||
+			strings.HasPrefix(arg, "mixos.mode=") || strings.HasPrefix(arg, "mixos.autoinstall") {
+			return false
+		}
+	}
+	return true
+}
+
+// mixosBootEntry picks the entry to edit among configs of one bootloader:
+// the default entry if it boots MixOS normally, else the first such entry
+func mixosBootEntry(configs []*bootConfig) (*bootConfig, int) {
+	for _, c := range configs {
+		for i, e := range c.Entries {
+			if e.Default && c.isMixOSEntry(e) && c.isNormalBootEntry(e) {
+				return c, i
+			}
+		}
+	}
+	for _, c := range configs {
+		for i, e := range c.Entries {
+			if c.isMixOSEntry(e) && c.isNormalBootEntry(e) {
+				return c, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// hasVramParam reports whether an entry boots with param, or with no
+// VRAM= parameter at all when param is empty
+func (c *bootConfig) hasVramParam(e bootEntry, param string) bool {
+	if param == "" {
+		return !slices.ContainsFunc(c.bootArgs(e), func(arg string) bool {
+			return strings.HasPrefix(arg, "VRAM=")
+		})
+	}
+	return slices.Contains(c.bootArgs(e), param)
+}
+
+// setVramParam adds param (VRAM=auto or VRAM=<size>) to an entry,
+// replacing any other VRAM= value, or removes all VRAM= parameters when
+// param is empty; it reports whether anything changed
+func (c *bootConfig) setVramParam(index int, param string) bool {
+	var add []string
+	if param != "" {
+		add = []string{param}
+	}
+	return c.setBootArgs(index, []string{"VRAM="}, add)
+}
+
+// setBootArgs removes the parameters of an entry that start with one of
+// prefixes and appends add; it reports whether anything changed
+func (c *bootConfig) setBootArgs(index int, prefixes, add []string) bool {
+	e := c.Entries[index]
+	if e.Args < 0 {
+		if len(add) == 0 {
+			return false
+		}
+		keyword := "options"
+		if c.Loader == "syslinux" {
+			keyword = "  APPEND"
+		}
+		c.Lines = slices.Insert(c.Lines, e.End+1, keyword+" "+strings.Join(add, " "))
+		return true
+	}
+
+	line := c.Lines[e.Args]
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	fields := strings.Fields(line)
+	keep := len(fields) - len(c.bootArgs(e))
+	args := slices.DeleteFunc(slices.Clone(fields[keep:]), func(arg string) bool {
+		return slices.ContainsFunc(prefixes, func(prefix string) bool {
+			return strings.HasPrefix(arg, prefix)
+		})
+	})
+	args = append(args, add...)
+	edited := indent + strings.Join(append(fields[:keep:keep], args...), " ")
+	if edited == line {
+		return false
+	}
+	c.Lines[e.Args] = edited
+	return true
+}
+
+// write saves the configuration, keeping the previous file as a backup
+// with the given suffix
+func (c *bootConfig) write(backup string) error {
+	old, err := os.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.Path+backup, old, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", c.Path, err)
+	}
+	tmp := c.Path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(c.Lines, "\n")+"\n"), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
+
+// editVramBootEntries sets param in the MixOS entry of each bootloader
+// found below roots, or clears VRAM= when it is empty, and checks the
+// result. It returns a line per edited entry.
+func editVramBootEntries(roots []string, param string) ([]string, error) {
+	var report []string
+	for _, root := range roots {
+		byLoader := map[string][]*bootConfig{}
+		for _, c := range findBootConfigs(root) {
+			byLoader[c.Loader] = append(byLoader[c.Loader], c)
+		}
+		for _, search := range vramBootSearch {
+			conf, index := mixosBootEntry(byLoader[search.loader])
+			if conf == nil {
+				continue
+			}
+			title := conf.Entries[index].Title
+			if !conf.setVramParam(index, param) {
+				report = append(report, fmt.Sprintf("%s: %q already up to date (%s)", conf.Loader, title, conf.Path))
+				continue
+			}
+			if err := conf.write(vramBootBackup); err != nil {
+				return report, fmt.Errorf("failed to update %s: %w", conf.Path, err)
+			}
+			if err := verifyVramBootEntry(conf, title, param); err != nil {
+				os.Rename(conf.Path+vramBootBackup, conf.Path)
+				return report, fmt.Errorf("%s: %w; restored the previous file", conf.Path, err)
+			}
+			report = append(report, fmt.Sprintf("%s: %q updated (%s, backup %s)",
+				conf.Loader, title, conf.Path, filepath.Base(conf.Path)+vramBootBackup))
+		}
+	}
+	return report, nil
+}
+
+// verifyVramBootEntry re-reads an edited configuration and checks the entry
+func verifyVramBootEntry(conf *bootConfig, title string, param string) error {
+	lines, err := readBootLines(conf.Path)
+	if err != nil {
+		return err
+	}
+	check := &bootConfig{Loader: conf.Loader, Path: conf.Path, Lines: lines}
+	switch conf.Loader {
+	case "grub":
+		check.Entries = parseGrubConfig(lines)
+	case "syslinux":
+		check.Entries = parseSyslinuxConfig(lines)
+	default:
+		check.Entries = parseSystemdBootEntry(lines, filepath.Base(conf.Path), "")
+	}
+	for _, e := range check.Entries {
+		if e.Title == title && check.isMixOSEntry(e) {
+			if !check.hasVramParam(e, param) {
+				return fmt.Errorf("entry %q was not updated", title)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("entry %q is missing after the edit", title)
+}
+
+// vramBootRoots returns where to look for bootloader configurations: the
+// root and, on VISO boots, the boot disk; release unmounts it
+func vramBootRoots() (roots []string, release func(), err error) {
+	release = func() {}
+	roots = []string{"/"}
+	backing, berr := loadVramBacking()
+	if berr != nil {
+		return roots, release, nil
+	}
+	unlock, err := lockVram()
+	if err != nil {
+		return nil, nil, err
+	}
+	disk, unmount, err := backing.mount()
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return append(roots, disk), func() {
+		unmount()
+		unlock()
+	}, nil
+}
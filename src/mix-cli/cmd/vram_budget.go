@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Size-limited VRAM
+// ============================================================================
+//
+// VRAM=<size> on the kernel command line (VRAM=2G, VRAM=1536M) loads as
+// much of the root into RAM as fits in that size, for machines that cannot
+// hold all of it. The initramfs takes the directories of vram.conf, then
+// those of the hotset, in order, and loads each one that still fits as in
+// selective VRAM. The hotset is /etc/mixos/vram-hotset, or else the list
+// shipped for the system profile in /usr/share/mixos/vram-hotset.
+//
+// What was loaded is recorded as for selective VRAM; the size is recorded
+// in /run/initramfs/vram-budget, in MB, and the directories left on disk
+// in /run/initramfs/vram-skipped, one "<dir> <MB>" per line.
+
+const (
+	vramBudgetFile   = "/run/initramfs/vram-budget"
+	vramSkippedFile  = "/run/initramfs/vram-skipped"
+	vramHotsetConfig = "/etc/mixos/vram-hotset"
+	vramHotsetDir    = "/usr/share/mixos/vram-hotset"
+
+	vramBudgetReserveMB = 512 // RAM the initramfs keeps for the system
+)
+
+// VramSkippedPath is a directory of the hotset left on disk
+type VramSkippedPath struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// vramBudgetParam returns the kernel parameter for a budget in MB
+func vramBudgetParam(mb int64) string {
+	if mb%1024 == 0 {
+		return fmt.Sprintf("VRAM=%dG", mb/1024)
+	}
+	return fmt.Sprintf("VRAM=%dM", mb)
+}
+
+// checkVramBudget fails when a budget of mb leaves too little of
+// memTotalMB to the system
+func checkVramBudget(mb, memTotalMB int64) error {
+	if mb < 1 {
+		return fmt.Errorf("a VRAM budget takes at least 1MB")
+	}
+	if mb+vramBudgetReserveMB > memTotalMB {
+		return fmt.Errorf("%s leaves less than %dMB of the %dMB of RAM to the system",
+			vramBudgetParam(mb), vramBudgetReserveMB, memTotalMB)
+	}
+	return nil
+}
+
+// vramHotsetPath returns the hotset a VRAM=<size> boot of root uses, as
+// the initramfs picks it, or "" if there is none
+func vramHotsetPath(root string) string {
+	profile := "default"
+	if data, err := os.ReadFile(filepath.Join(root, setupProfileFile)); err == nil {
+		if p := strings.TrimSpace(string(data)); p != "" {
+			profile = p
+		}
+	}
+	for _, p := range []string{vramHotsetConfig, filepath.Join(vramHotsetDir, profile), filepath.Join(vramHotsetDir, "default")} {
+		if _, err := os.Stat(filepath.Join(root, p)); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// parseVramSkipped reads the directories the initramfs left on disk
+func parseVramSkipped(data string) []VramSkippedPath {
+	var skipped []VramSkippedPath
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		mb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		skipped = append(skipped, VramSkippedPath{Path: fields[0], Bytes: mb << 20})
+	}
+	return skipped
+}
+
+// loadVramBudget returns the size the root was loaded within, in bytes,
+// and what did not fit; zero on boots without VRAM=<size>
+func loadVramBudget() (int64, []VramSkippedPath) {
+	data, err := os.ReadFile(vramBudgetFile)
+	if err != nil {
+		return 0, nil
+	}
+	mb, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	skipped, _ := os.ReadFile(vramSkippedFile)
+	return mb << 20, parseVramSkipped(string(skipped))
+}
@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// VRAM Compact
+// ============================================================================
+//
+// Deleting a file from the RAM root frees its memory, but some of it
+// lingers: the page cache keeps decompressed copies of the read-only
+// image (the lower layer of compressed VRAM, the part of the root left on
+// disk in selective VRAM), the slab keeps the dentries and inodes of
+// deleted files, a zram pool stays fragmented, and free memory is split
+// into pieces too small for huge pages. "mix vram compact" releases each
+// of these and reports what it recovered. Files deleted while a process
+// still holds them open cannot be reclaimed, so they are listed instead.
+
+const (
+	vramDropCaches    = "/proc/sys/vm/drop_caches"
+	vramCompactMemory = "/proc/sys/vm/compact_memory"
+
+	vramHugeOrder = 9 // 2MB blocks of 4KB pages
+)
+
+// vramHeldFile is a file deleted from the RAM root that a process keeps
+type vramHeldFile struct {
+	PID   int
+	Name  string // process name
+	Path  string
+	Bytes int64
+}
+
+var vramCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Reclaim memory held on behalf of the RAM root",
+	Long: `Release the memory that lingers after files are deleted from the RAM
+root: cached copies of the read-only image, the dentries and inodes of
+deleted files and the fragmentation of a zram pool. Free memory is then
+compacted into blocks large enough for huge pages.
+
+Files that were deleted but are still open take memory until their
+process closes them; they are listed with the process holding them.
+
+--all also drops the page cache of the whole system, the backing disk's
+included, which slows down the next reads from disk.
+
+Examples:
+  mix vram compact
+  mix vram compact --all`,
+	RunE: runVramCompact,
+}
+
+func init() {
+	vramCmd.AddCommand(vramCompactCmd)
+	vramCompactCmd.Flags().Bool("all", false, "drop the page cache of the whole system too")
+}
+
+// vramImageLayer returns the read-only image the root reads from, if any:
+// the lower layer of compressed VRAM, or the root itself in selective
+// VRAM, whose loaded directories are other filesystems
+func vramImageLayer() string {
+	switch vramMode() {
+	case "compressed":
+		return vramOverlayLower
+	case "selective":
+		return "/"
+	}
+	return ""
+}
+
+// dropVramFileCache drops the cached pages of the files below root that
+// are on its filesystem and returns how many files it went through
+func dropVramFileCache(root string) int {
+	top, err := os.Lstat(root)
+	if err != nil {
+		return 0
+	}
+	dev := top.Sys().(*syscall.Stat_t).Dev
+	files := 0
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil || info.Sys().(*syscall.Stat_t).Dev != dev || (rel != "." && vramExcluded(rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+		f.Close()
+		files++
+		return nil
+	})
+	return files
+}
+
+// parseBuddyInfo counts the free blocks of at least 2^order pages in
+// /proc/buddyinfo, in blocks of that size
+func parseBuddyInfo(data string, order int) int64 {
+	var blocks int64
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		// Node 0, zone Normal <order 0> <order 1> ...
+		if len(fields) < 5 || fields[0] != "Node" {
+			continue
+		}
+		for i, field := range fields[4:] {
+			if i < order {
+				continue
+			}
+			n, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				continue
+			}
+			blocks += n << (i - order)
+		}
+	}
+	return blocks
+}
+
+func vramHugeBlocks() int64 {
+	data, err := os.ReadFile("/proc/buddyinfo")
+	if err != nil {
+		return 0
+	}
+	return parseBuddyInfo(string(data), vramHugeOrder)
+}
+
+// heldVramFiles lists the files deleted from the filesystems of mounts
+// that processes still have open
+func heldVramFiles(proc string, mounts []string) []vramHeldFile {
+	devs := map[uint64]bool{}
+	for _, m := range mounts {
+		if info, err := os.Stat(m); err == nil {
+			devs[info.Sys().(*syscall.Stat_t).Dev] = true
+		}
+	}
+
+	var held []vramHeldFile
+	seen := map[[2]uint64]bool{}
+	pids, _ := filepath.Glob(filepath.Join(proc, "[0-9]*"))
+	for _, dir := range pids {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil {
+			continue
+		}
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link := filepath.Join(dir, "fd", fd.Name())
+			target, err := os.Readlink(link)
+			if err != nil || !strings.HasSuffix(target, " (deleted)") {
+				continue
+			}
+			info, err := os.Stat(link)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			st := info.Sys().(*syscall.Stat_t)
+			key := [2]uint64{st.Dev, st.Ino}
+			if !devs[st.Dev] || st.Nlink != 0 || seen[key] {
+				continue
+			}
+			seen[key] = true
+			name, _ := os.ReadFile(filepath.Join(dir, "comm"))
+			held = append(held, vramHeldFile{
+				PID:   pid,
+				Name:  strings.TrimSpace(string(name)),
+				Path:  strings.TrimSuffix(target, " (deleted)"),
+				Bytes: st.Blocks * 512,
+			})
+		}
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].Bytes > held[j].Bytes })
+	return held
+}
+
+// vramCompactStep runs one step and prints the free memory it recovered
+func vramCompactStep(label string, step func() string) int64 {
+	before, _ := getMemInfo()
+	detail := step()
+	after, _ := getMemInfo()
+	var freed int64
+	if before != nil && after != nil {
+		freed = max(0, after.MemFree-before.MemFree)
+	}
+	if detail != "" {
+		detail = " (" + detail + ")"
+	}
+	fmt.Printf("  %-26s %8s%s\n", label, formatSize(freed<<20), detail)
+	return freed
+}
+
+func runVramCompact(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM compact must be run as root")
+	}
+	if !isVramActive() {
+		return fmt.Errorf("system is not running in VRAM mode")
+	}
+	all, _ := cmd.Flags().GetBool("all")
+
+	start, err := getMemInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get memory info: %w", err)
+	}
+	hugeBefore := vramHugeBlocks()
+	syscall.Sync()
+
+	fmt.Println("Reclaiming memory...")
+	if layer := vramImageLayer(); layer != "" {
+		vramCompactStep("Cached image pages", func() string {
+			return fmt.Sprintf("%d files", dropVramFileCache(layer))
+		})
+	}
+	vramCompactStep("Dentries and inodes", func() string {
+		if err := os.WriteFile(vramDropCaches, []byte("2\n"), 0644); err != nil {
+			return err.Error()
+		}
+		return ""
+	})
+	if device := vramZramDevice(); device != "" {
+		vramCompactStep("zram pool", func() string {
+			before, _ := readZramStats(device)
+			if err := os.WriteFile(filepath.Join("/sys/block", filepath.Base(device), "compact"), []byte("1\n"), 0644); err != nil {
+				return err.Error()
+			}
+			after, _ := readZramStats(device)
+			if before == nil || after == nil {
+				return ""
+			}
+			return fmt.Sprintf("%s → %s", formatSize(before.MemUsed), formatSize(after.MemUsed))
+		})
+	}
+	if all {
+		vramCompactStep("System page cache", func() string {
+			if err := os.WriteFile(vramDropCaches, []byte("1\n"), 0644); err != nil {
+				return err.Error()
+			}
+			return ""
+		})
+	}
+	vramCompactStep("Memory compaction", func() string {
+		if err := os.WriteFile(vramCompactMemory, []byte("1\n"), 0644); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("2MB blocks free: %d → %d", hugeBefore, vramHugeBlocks())
+	})
+
+	end, err := getMemInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get memory info: %w", err)
+	}
+	recovered := max(0, end.MemFree-start.MemFree) << 20
+	fmt.Printf("\n✓ Recovered %s: %s free, %s available\n", formatSize(recovered),
+		formatSize(end.MemFree<<20), formatSize(end.MemAvailable<<20))
+	logVramEvent(vramEventMaintenance, "compacted: %s recovered", formatSize(recovered))
+
+	mounts := []string{"/"}
+	if loaded := loadedVramPaths(); loaded != nil {
+		mounts = nil
+		for _, p := range loaded {
+			mounts = append(mounts, "/"+p)
+		}
+	}
+	if held := heldVramFiles("/proc", mounts); len(held) > 0 {
+		var total int64
+		for _, h := range held {
+			total += h.Bytes
+		}
+		fmt.Printf("\n\033[33m%s\033[0m is held by deleted files that are still open:\n", formatSize(total))
+		for i, h := range held {
+			if i == 10 {
+				fmt.Printf("  ... and %d more\n", len(held)-i)
+				break
+			}
+			fmt.Printf("  %10s  %s (%s, pid %d)\n", formatSize(h.Bytes), h.Path, h.Name, h.PID)
+		}
+		fmt.Println("  Restart those processes to free it.")
+	}
+	return nil
+}
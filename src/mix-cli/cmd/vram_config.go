@@ -0,0 +1,541 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Configuration
+// ============================================================================
+//
+// /etc/mixos/vram.conf holds "key = value" settings and the directories of
+// selective VRAM, one absolute path per line:
+//
+//	compression = zstd
+//	level = 6
+//	backend = zram
+//	zram_algorithm = zstd
+//	size = 3072
+//	tmpfs_huge = within_size
+//	tmpfs_mpol = interleave
+//	tmpfs_mode = 0755
+//	tier_cache = /dev/nvme0n1p3
+//	exclude = /var/log
+//	/usr
+//
+// compression decides how the root is held in RAM. With "none", the
+// default, the initramfs unpacks the image into a tmpfs: the slowest boot
+// and the most memory, but nothing to decompress at run time. With an
+// algorithm it copies a squashfs image compressed with it into RAM and
+// runs the root from that through an overlay, so RAM holds the compressed
+// image plus what has been written since boot. "mix vram config" rebuilds
+// that image from the base image on the backing disk.
+//
+// backend decides where an unpacked root goes: a tmpfs, the default, or an
+// ext4 filesystem on a zram device, which compresses it transparently in
+// RAM with zram_algorithm so that machines with 2GB of RAM can run VRAM.
+//
+// size, in MB and set by "mix vram resize", caps an unpacked root: the
+// size of its tmpfs, or the RAM its zram device may use. Without it the
+// initramfs sizes the root from the image.
+//
+// tmpfs_huge, tmpfs_mpol and tmpfs_mode, set by "mix vram tune", are
+// passed to the tmpfs of an unpacked root as its huge=, mpol= and mode=
+// options; the directories of selective VRAM take the first two.
+//
+// tier_cache, set by "mix vram tier", is the SSD partition that caches
+// what a size-limited or selective root leaves on the backing disk.
+//
+// exclude, which may be repeated, keeps a directory on the backing disk
+// in VRAM mode; see "mix vram exclude".
+
+const (
+	vramImageName  = "rootfs.squashfs"      // the recompressed image, in the state directory
+	vramImageStamp = "rootfs.squashfs.base" // "<size> <mtime>" of the base image it was built from
+)
+
+// vramCompressor is a squashfs compression algorithm and its levels; min
+// 0 means it takes no level
+type vramCompressor struct {
+	min, max, def int
+}
+
+var vramCompressors = map[string]vramCompressor{
+	"gzip": {1, 9, 9},
+	"lzo":  {1, 9, 8},
+	"lz4":  {0, 0, 0},
+	"xz":   {0, 0, 0},
+	"zstd": {1, 22, 15},
+}
+
+// zramAlgorithms are the zram compression algorithms of the MixOS kernel
+var zramAlgorithms = []string{"lzo", "lzo-rle", "lz4", "lz4hc", "zstd", "deflate", "842"}
+
+const zramDefaultAlgorithm = "zstd"
+
+// vramConfig is the content of /etc/mixos/vram.conf
+type vramConfig struct {
+	Compression   string // "" or "none" unpacks the root
+	Level         int    // 0 for the algorithm's default
+	Backend       string // "" or "tmpfs", or "zram"
+	ZramAlgorithm string
+	Size          int64  // MB, 0 to size the root from the image
+	TmpfsHuge     string // huge= of the tmpfs, "" for the kernel's default
+	TmpfsMpol     string // mpol= of the tmpfs
+	TmpfsMode     string // mode= of the tmpfs, "" for 0755
+	TierCache     string // the SSD partition caching the backing disk
+	Exclude       []string
+	Paths         []string
+}
+
+var vramConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Choose how the root is compressed in RAM",
+	Long: `Show or change the VRAM settings.
+
+--compression none unpacks the whole image into RAM at boot. gzip, lzo,
+lz4, xz and zstd instead keep the root compressed in RAM: boot is faster
+and less memory is used, at the cost of decompressing on access. --level
+trades compression ratio against speed for gzip (1-9), lzo (1-9) and
+zstd (1-22). The RAM image is rebuilt from the base image right away;
+this needs mksquashfs and the VISO disk.
+
+--backend zram unpacks the root onto a compressed zram device instead of
+a tmpfs, so that it stays writable and fits machines with 2GB of RAM.
+--zram-algorithm picks its compression (lzo, lzo-rle, lz4, lz4hc, zstd,
+deflate or 842).
+
+Examples:
+  mix vram config --compression zstd --level 6
+  mix vram config --compression lz4
+  mix vram config --compression none --backend zram
+  mix vram config --backend zram --zram-algorithm lz4
+  mix vram config`,
+	RunE: runVramConfig,
+}
+
+func init() {
+	vramCmd.AddCommand(vramConfigCmd)
+	vramConfigCmd.Flags().String("compression", "", "none, gzip, lzo, lz4, xz or zstd")
+	vramConfigCmd.Flags().Int("level", 0, "compression level (default: the algorithm's own)")
+	vramConfigCmd.Flags().String("backend", "", "where the unpacked root lives: tmpfs or zram")
+	vramConfigCmd.Flags().String("zram-algorithm", "", "compression of the zram backend")
+}
+
+// parseVramConfig reads vram.conf; "#" starts a comment
+func parseVramConfig(data string) (*vramConfig, error) {
+	conf := &vramConfig{Paths: parseVramPaths(data)}
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "compression":
+			conf.Compression = value
+		case "level":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("level: expected a number, got %q", value)
+			}
+			conf.Level = n
+		case "backend":
+			conf.Backend = value
+		case "zram_algorithm":
+			conf.ZramAlgorithm = value
+		case "size":
+			n, err := parseSizeMB(value)
+			if err != nil {
+				return nil, fmt.Errorf("size: %w", err)
+			}
+			conf.Size = n
+		case "tmpfs_huge":
+			conf.TmpfsHuge = value
+		case "tmpfs_mpol":
+			conf.TmpfsMpol = value
+		case "tmpfs_mode":
+			conf.TmpfsMode = value
+		case "tier_cache":
+			conf.TierCache = value
+		case "exclude":
+			if !filepath.IsAbs(value) || filepath.Clean(value) == "/" {
+				return nil, fmt.Errorf("exclude: expected an absolute directory, got %q", value)
+			}
+			conf.Exclude = append(conf.Exclude, filepath.Clean(value))
+		}
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// validate checks the compression and backend settings
+func (c *vramConfig) validate() error {
+	switch c.Backend {
+	case "", "tmpfs":
+		if c.ZramAlgorithm != "" {
+			return fmt.Errorf("zram_algorithm needs backend = zram")
+		}
+	case "zram":
+		if c.compressed() {
+			return fmt.Errorf("the zram backend holds an unpacked root; use compression = none")
+		}
+		if c.ZramAlgorithm != "" && !slices.Contains(zramAlgorithms, c.ZramAlgorithm) {
+			return fmt.Errorf("unknown zram algorithm %q (use %s)", c.ZramAlgorithm, strings.Join(zramAlgorithms, ", "))
+		}
+	default:
+		return fmt.Errorf("unknown backend %q (use tmpfs or zram)", c.Backend)
+	}
+
+	if err := c.validateTmpfs(); err != nil {
+		return err
+	}
+	if c.TierCache != "" && (!strings.HasPrefix(c.TierCache, "/dev/") || filepath.Clean(c.TierCache) != c.TierCache) {
+		return fmt.Errorf("tier_cache: expected a device under /dev, got %q", c.TierCache)
+	}
+
+	if !c.compressed() {
+		if c.Level != 0 {
+			return fmt.Errorf("level needs a compression algorithm")
+		}
+		return nil
+	}
+	if c.Size != 0 {
+		return fmt.Errorf("size applies to an unpacked root; use compression = none")
+	}
+	comp, ok := vramCompressors[c.Compression]
+	if !ok {
+		return fmt.Errorf("unknown compression %q (use none, gzip, lzo, lz4, xz or zstd)", c.Compression)
+	}
+	if c.Level != 0 && comp.min == 0 {
+		return fmt.Errorf("%s takes no compression level", c.Compression)
+	}
+	if c.Level != 0 && (c.Level < comp.min || c.Level > comp.max) {
+		return fmt.Errorf("%s levels are %d-%d", c.Compression, comp.min, comp.max)
+	}
+	return nil
+}
+
+// compressed reports whether the root is kept compressed in RAM
+func (c *vramConfig) compressed() bool {
+	return c.Compression != "" && c.Compression != "none"
+}
+
+// describe summarizes the compression setting
+func (c *vramConfig) describe() string {
+	if !c.compressed() {
+		return "none (unpacked into RAM)"
+	}
+	level := c.Level
+	if level == 0 {
+		level = vramCompressors[c.Compression].def
+	}
+	if level == 0 {
+		return c.Compression
+	}
+	return fmt.Sprintf("%s level %d", c.Compression, level)
+}
+
+// zram reports whether the root is unpacked onto a zram device
+func (c *vramConfig) zram() bool {
+	return c.Backend == "zram"
+}
+
+// describeBackend summarizes the backend setting
+func (c *vramConfig) describeBackend() string {
+	switch {
+	case c.compressed():
+		return "squashfs image in RAM"
+	case c.zram() && c.ZramAlgorithm != "":
+		return "zram (" + c.ZramAlgorithm + ")"
+	case c.zram():
+		return "zram (" + zramDefaultAlgorithm + ")"
+	}
+	return "tmpfs"
+}
+
+func (c *vramConfig) format() string {
+	var b strings.Builder
+	b.WriteString("# VRAM settings and the directories loaded into RAM, one per line.\n")
+	b.WriteString("# Managed by 'mix vram config', 'mix vram resize', 'mix vram tune',\n")
+	b.WriteString("# 'mix vram tier', 'mix vram exclude' and 'mix vram paths'.\n")
+	b.WriteString("# No directories loads the whole root.\n")
+	if c.Compression != "" {
+		fmt.Fprintf(&b, "compression = %s\n", c.Compression)
+	}
+	if c.Level != 0 {
+		fmt.Fprintf(&b, "level = %d\n", c.Level)
+	}
+	if c.Backend != "" {
+		fmt.Fprintf(&b, "backend = %s\n", c.Backend)
+	}
+	if c.ZramAlgorithm != "" {
+		fmt.Fprintf(&b, "zram_algorithm = %s\n", c.ZramAlgorithm)
+	}
+	if c.Size != 0 {
+		fmt.Fprintf(&b, "size = %d\n", c.Size)
+	}
+	if c.TmpfsHuge != "" {
+		fmt.Fprintf(&b, "tmpfs_huge = %s\n", c.TmpfsHuge)
+	}
+	if c.TmpfsMpol != "" {
+		fmt.Fprintf(&b, "tmpfs_mpol = %s\n", c.TmpfsMpol)
+	}
+	if c.TmpfsMode != "" {
+		fmt.Fprintf(&b, "tmpfs_mode = %s\n", c.TmpfsMode)
+	}
+	if c.TierCache != "" {
+		fmt.Fprintf(&b, "tier_cache = %s\n", c.TierCache)
+	}
+	for _, p := range c.Exclude {
+		fmt.Fprintf(&b, "exclude = %s\n", p)
+	}
+	for _, p := range c.Paths {
+		b.WriteString(p + "\n")
+	}
+	return b.String()
+}
+
+func loadVramConfig() (*vramConfig, error) {
+	data, err := os.ReadFile(vramPathsConfig)
+	if os.IsNotExist(err) {
+		return &vramConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf, err := parseVramConfig(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", vramPathsConfig, err)
+	}
+	return conf, nil
+}
+
+// saveVramConfig writes vram.conf, and also into the stored changes on
+// the backing disk where the initramfs reads it: the root may be the
+// read-only image, or /etc may not be in RAM
+func saveVramConfig(conf *vramConfig) error {
+	data := []byte(conf.format())
+	err := os.MkdirAll(filepath.Dir(vramPathsConfig), 0755)
+	if err == nil {
+		err = os.WriteFile(vramPathsConfig, data, 0644)
+	}
+	if _, berr := loadVramBacking(); berr == nil {
+		if serr := storeVramFile(strings.TrimPrefix(vramPathsConfig, "/"), data, 0644); serr != nil {
+			return serr
+		}
+		if errors.Is(err, syscall.EROFS) {
+			return nil
+		}
+	}
+	return err
+}
+
+// bootVramConfig returns the settings the system was booted with, nil if
+// the initramfs did not record them
+func bootVramConfig() *vramConfig {
+	data, err := os.ReadFile("/run/initramfs/vram.conf")
+	if err != nil {
+		return nil
+	}
+	conf, err := parseVramConfig(string(data))
+	if err != nil {
+		return nil
+	}
+	return conf
+}
+
+// ============================================================================
+// RAM image
+// ============================================================================
+
+// mksquashfsArgs returns the mksquashfs options for the configured
+// compression. Small blocks keep random reads from RAM cheap.
+func (c *vramConfig) mksquashfsArgs() []string {
+	args := []string{"-comp", c.Compression, "-b", "128K", "-noappend", "-no-progress", "-quiet"}
+	if c.Level != 0 {
+		args = append(args, "-Xcompression-level", strconv.Itoa(c.Level))
+	}
+	return args
+}
+
+// buildVramImage recompresses the base image into the state directory on
+// the backing disk, or removes the RAM image when the root is unpacked.
+// It returns the size of the new image.
+func buildVramImage(conf *vramConfig) (int64, error) {
+	backing, err := loadVramBacking()
+	if err != nil {
+		return 0, err
+	}
+	unlock, err := lockVram()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	disk, unmount, err := backing.mount()
+	if err != nil {
+		return 0, err
+	}
+	defer unmount()
+
+	state := filepath.Join(disk, vramStateSubdir)
+	image := filepath.Join(state, vramImageName)
+	stamp := filepath.Join(state, vramImageStamp)
+	if !conf.compressed() {
+		os.Remove(stamp)
+		if err := os.Remove(image); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+
+	mksquashfs, err := exec.LookPath("mksquashfs")
+	if err != nil {
+		return 0, fmt.Errorf("mksquashfs not found; install squashfs-tools")
+	}
+	base := filepath.Join(disk, backing.Image)
+	baseInfo, err := os.Stat(base)
+	if err != nil {
+		return 0, err
+	}
+	lower, unmountImage, err := mountVramImage(base, "lower")
+	if err != nil {
+		return 0, err
+	}
+	defer unmountImage()
+
+	if err := os.MkdirAll(state, 0755); err != nil {
+		return 0, err
+	}
+	tmp := image + ".tmp"
+	args := append([]string{lower, tmp}, conf.mksquashfsArgs()...)
+	if out, err := exec.Command(mksquashfs, args...).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("mksquashfs failed: %s", strings.TrimSpace(string(out)))
+	}
+	if err := os.Rename(tmp, image); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	stampData := fmt.Sprintf("%d %d\n", baseInfo.Size(), baseInfo.ModTime().Unix())
+	if err := os.WriteFile(stamp, []byte(stampData), 0644); err != nil {
+		return 0, err
+	}
+	syscall.Sync()
+
+	info, err := os.Stat(image)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// ============================================================================
+// Command
+// ============================================================================
+
+func runVramConfig(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	recompress := cmd.Flags().Changed("compression") || cmd.Flags().Changed("level")
+	if !recompress && !cmd.Flags().Changed("backend") && !cmd.Flags().Changed("zram-algorithm") {
+		printVramConfig(conf)
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM settings must be changed as root")
+	}
+
+	if cmd.Flags().Changed("compression") {
+		conf.Compression, _ = cmd.Flags().GetString("compression")
+		conf.Level = 0
+	}
+	if cmd.Flags().Changed("level") {
+		conf.Level, _ = cmd.Flags().GetInt("level")
+	}
+	if cmd.Flags().Changed("backend") {
+		conf.Backend, _ = cmd.Flags().GetString("backend")
+		if !conf.zram() {
+			conf.ZramAlgorithm = ""
+		}
+	}
+	if cmd.Flags().Changed("zram-algorithm") {
+		conf.ZramAlgorithm, _ = cmd.Flags().GetString("zram-algorithm")
+	}
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	if (conf.compressed() || conf.zram()) && len(conf.Paths) > 0 {
+		fmt.Println("\033[33mNote:\033[0m compression and zram apply to full VRAM; the directories")
+		fmt.Println("      of selective VRAM are always unpacked into a tmpfs.")
+	}
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("failed to save %s: %w", vramPathsConfig, err)
+	}
+	fmt.Printf("✓ Compression: %s\n", conf.describe())
+	fmt.Printf("✓ Backend:     %s\n", conf.describeBackend())
+
+	if !recompress {
+		fmt.Println("  Takes effect on the next boot with VRAM=auto.")
+		return nil
+	}
+	if conf.compressed() {
+		fmt.Println("Rebuilding the RAM image (this may take a few minutes)...")
+	}
+	start := time.Now()
+	size, err := buildVramImage(conf)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild the RAM image: %w", err)
+	}
+	if conf.compressed() {
+		fmt.Printf("✓ RAM image rebuilt: %s in %s\n", formatSize(size), time.Since(start).Round(time.Second))
+	}
+	fmt.Println("  Takes effect on the next boot with VRAM=auto.")
+	return nil
+}
+
+func printVramConfig(conf *vramConfig) {
+	fmt.Println("VRAM Configuration:")
+	fmt.Printf("  Compression: %s\n", conf.describe())
+	fmt.Printf("  Backend:     %s\n", conf.describeBackend())
+	if conf.Size != 0 {
+		fmt.Printf("  Size:        %d MB\n", conf.Size)
+	} else if !conf.compressed() {
+		fmt.Println("  Size:        automatic")
+	}
+	if tuned := conf.tmpfsOptions(); tuned != "" {
+		fmt.Printf("  tmpfs:       %s\n", tuned)
+	}
+	if len(conf.Paths) > 0 {
+		fmt.Printf("  Paths:       %s\n", strings.Join(conf.Paths, ", "))
+	} else {
+		fmt.Println("  Paths:       whole root")
+	}
+	if len(conf.Exclude) > 0 {
+		fmt.Printf("  On disk:     %s\n", strings.Join(conf.Exclude, ", "))
+	}
+	if conf.TierCache != "" {
+		fmt.Printf("  Tier cache:  %s\n", conf.TierCache)
+	}
+	if boot := bootVramConfig(); boot != nil && isVramActive() && boot.describe() != conf.describe() {
+		fmt.Printf("  Booted with: %s\n", boot.describe())
+	}
+}
@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Events
+// ============================================================================
+//
+// What happens to the RAM root is recorded in /var/log/mixos/vram.log, one
+// JSON object per line: the time, a kind, a message and, for some kinds,
+// the numbers behind the message. "mix vram events" queries it. The log
+// also takes the output of the daemons, and holds plain "<time> <message>"
+// lines from older versions; the first are skipped and the second read
+// without a kind.
+//
+// The activation is recorded by an init script early in the boot, from
+// what the initramfs left in /run/initramfs. The log is in the RAM root
+// like the rest of /var: it survives a reboot once synced, or always with
+// /var/log kept on disk by "mix vram exclude".
+
+// Event kinds
+const (
+	vramEventActivate    = "activate"    // the root was loaded into RAM, or should have been
+	vramEventSyncStart   = "sync-start"  // a sync began
+	vramEventSync        = "sync"        // a sync finished
+	vramEventFailure     = "failure"     // something went wrong
+	vramEventPressure    = "pressure"    // memory ran low, or recovered
+	vramEventDaemon      = "daemon"      // autosync or the pressure monitor started or stopped
+	vramEventConfig      = "config"      // a setting changed
+	vramEventMaintenance = "maintenance" // compact, precache, persist, hibernate, discard
+)
+
+var vramEventKinds = []string{
+	vramEventActivate, vramEventSyncStart, vramEventSync, vramEventFailure,
+	vramEventPressure, vramEventDaemon, vramEventConfig, vramEventMaintenance,
+}
+
+// VramEvent is one entry of the VRAM log
+type VramEvent struct {
+	Time    time.Time              `json:"time"`
+	Kind    string                 `json:"kind"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+var vramEventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Show the log of VRAM activations, syncs and failures",
+	Long: `Show what happened to the RAM root: boot activations, syncs, failures,
+memory pressure, daemons starting and stopping and changed settings.
+
+--kind takes a comma-separated list of activate, sync-start, sync,
+failure, pressure, daemon, config and maintenance. --json prints the
+events as a JSON array, with the numbers behind each message.
+
+Examples:
+  mix vram events
+  mix vram events --kind failure,pressure --since 24h
+  mix vram events --json --limit 0`,
+	RunE: runVramEvents,
+}
+
+var vramEventsRecordBootCmd = &cobra.Command{
+	Use:    "record-boot",
+	Short:  "Record how the root was activated at boot (run by an init script)",
+	Hidden: true,
+	RunE:   runVramEventsRecordBoot,
+}
+
+func init() {
+	vramCmd.AddCommand(vramEventsCmd)
+	vramEventsCmd.AddCommand(vramEventsRecordBootCmd)
+	vramEventsCmd.Flags().Bool("json", false, "print the events as JSON")
+	vramEventsCmd.Flags().String("kind", "", "only these kinds, comma-separated")
+	vramEventsCmd.Flags().Duration("since", 0, "only events newer than this (e.g. 24h)")
+	vramEventsCmd.Flags().IntP("limit", "n", 50, "show the last N events, 0 for all")
+}
+
+// recordVramEvent appends an event to the VRAM log and forwards it to
+// syslog
+func recordVramEvent(e VramEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if line, err := json.Marshal(e); err == nil {
+		os.MkdirAll(filepath.Dir(vramLogFile), 0755)
+		if f, err := os.OpenFile(vramLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+			f.Write(append(line, '\n'))
+			f.Close()
+		}
+	}
+	if logger, err := exec.LookPath("logger"); err == nil {
+		exec.Command(logger, "-t", "mix-vram", e.Kind+": "+e.Message).Run()
+	}
+	printVerbose("%s\n", e.Message)
+}
+
+// logVramEvent records an event without data
+func logVramEvent(kind, format string, args ...interface{}) {
+	recordVramEvent(VramEvent{Kind: kind, Message: fmt.Sprintf(format, args...)})
+}
+
+// parseVramEvents reads the events of a VRAM log, oldest first
+func parseVramEvents(data string) []VramEvent {
+	var events []VramEvent
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "{") {
+			var e VramEvent
+			if json.Unmarshal([]byte(line), &e) == nil && !e.Time.IsZero() {
+				events = append(events, e)
+			}
+			continue
+		}
+		stamp, msg, ok := strings.Cut(line, " ")
+		if t, err := time.Parse(time.RFC3339, stamp); ok && err == nil {
+			events = append(events, VramEvent{Time: t, Message: msg})
+		}
+	}
+	return events
+}
+
+func loadVramEvents() ([]VramEvent, error) {
+	data, err := os.ReadFile(vramLogFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseVramEvents(string(data)), nil
+}
+
+// filterVramEvents keeps the events of kinds (all when empty) newer than
+// since, and the last limit of them (all when 0)
+func filterVramEvents(events []VramEvent, kinds []string, since time.Time, limit int) []VramEvent {
+	var kept []VramEvent
+	for _, e := range events {
+		if (len(kinds) == 0 || slices.Contains(kinds, e.Kind)) && !e.Time.Before(since) {
+			kept = append(kept, e)
+		}
+	}
+	if limit > 0 && len(kept) > limit {
+		kept = kept[len(kept)-limit:]
+	}
+	return kept
+}
+
+// vramBootEvent describes how this boot came up: the activation of the
+// RAM root, a failure when VRAM= was given but the root runs from disk,
+// or nothing
+func vramBootEvent(bootID string) *VramEvent {
+	data := map[string]interface{}{"boot_id": bootID}
+	if isVramActive() {
+		mode := vramMode()
+		data["mode"] = mode
+		msg := "VRAM active: " + mode
+		if size, err := os.ReadFile("/run/initramfs/vram-size"); err == nil {
+			if mb, err := strconv.ParseInt(strings.TrimSpace(string(size)), 10, 64); err == nil {
+				msg += ", " + formatSize(mb<<20)
+				data["size_bytes"] = mb << 20
+			}
+		}
+		if budget, skipped := loadVramBudget(); budget != 0 {
+			msg += fmt.Sprintf(" within %s, %d path(s) left on disk", formatSize(budget), len(skipped))
+			data["budget_bytes"] = budget
+		}
+		if cache, disk := loadVramTier(); cache != "" {
+			msg += fmt.Sprintf(", %s cached on %s", disk, cache)
+			data["tier_cache"] = cache
+		}
+		return &VramEvent{Kind: vramEventActivate, Message: msg, Data: data}
+	}
+	cmdline, _ := os.ReadFile("/proc/cmdline")
+	for _, arg := range strings.Fields(string(cmdline)) {
+		if strings.HasPrefix(arg, "VRAM=") {
+			data["param"] = arg
+			return &VramEvent{Kind: vramEventFailure, Message: arg + " was given but the root runs from disk", Data: data}
+		}
+	}
+	return nil
+}
+
+func runVramEventsRecordBoot(cmd *cobra.Command, args []string) error {
+	id, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return err
+	}
+	bootID := strings.TrimSpace(string(id))
+	e := vramBootEvent(bootID)
+	if e == nil {
+		return nil
+	}
+	// Once per boot, should the script run again
+	events, _ := loadVramEvents()
+	for _, old := range events {
+		if old.Data["boot_id"] == bootID {
+			return nil
+		}
+	}
+	recordVramEvent(*e)
+	return nil
+}
+
+func runVramEvents(cmd *cobra.Command, args []string) error {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	kindList, _ := cmd.Flags().GetString("kind")
+	since, _ := cmd.Flags().GetDuration("since")
+	limit, _ := cmd.Flags().GetInt("limit")
+
+	var kinds []string
+	for _, kind := range strings.Split(kindList, ",") {
+		if kind = strings.TrimSpace(kind); kind == "" {
+			continue
+		}
+		if !slices.Contains(vramEventKinds, kind) {
+			return fmt.Errorf("unknown event kind %q (use %s)", kind, strings.Join(vramEventKinds, ", "))
+		}
+		kinds = append(kinds, kind)
+	}
+	var after time.Time
+	if since > 0 {
+		after = time.Now().Add(-since)
+	}
+
+	events, err := loadVramEvents()
+	if err != nil {
+		return err
+	}
+	events = filterVramEvents(events, kinds, after, limit)
+
+	if asJSON {
+		if events == nil {
+			events = []VramEvent{}
+		}
+		data, err := json.MarshalIndent(events, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	if len(events) == 0 {
+		fmt.Println("No VRAM events recorded.")
+		return nil
+	}
+	for _, e := range events {
+		kind := e.Kind
+		if kind == "" {
+			kind = "-"
+		}
+		color := ""
+		switch e.Kind {
+		case vramEventFailure:
+			color = "\033[31m"
+		case vramEventPressure:
+			color = "\033[33m"
+		case vramEventActivate:
+			color = "\033[32m"
+		}
+		if color != "" {
+			kind = color + fmt.Sprintf("%-11s", kind) + "\033[0m"
+		}
+		fmt.Printf("%s  %-11s  %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), kind, e.Message)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Exclusions
+// ============================================================================
+//
+// Some directories should not live in RAM even in VRAM mode: logs that
+// must survive a crash, or a database that outgrows memory. Each "exclude"
+// in vram.conf keeps a directory on the backing disk, under
+// mixos/vram/excluded/<dir>: the initramfs bind-mounts it over the RAM
+// root, seeding it from the image on first use, and records what it bound
+// in /run/initramfs/vram-exclude. Syncs, verify and persist leave those
+// directories alone, since they are on disk already.
+
+const (
+	vramExcludeBound  = "/run/initramfs/vram-exclude"
+	vramExcludeSubdir = vramStateSubdir + "/excluded"
+)
+
+var vramExcludeCmd = &cobra.Command{
+	Use:   "exclude",
+	Short: "Keep directories on disk in VRAM mode",
+	Long: `Manage the directories that stay on the VISO disk when the root runs
+from RAM. Writes to them go straight to disk, so they survive a crash
+without a sync and take no memory.
+
+The first VRAM boot after adding a directory copies its contents from
+the image to the disk. Changes take effect on the next VRAM boot.
+
+Examples:
+  mix vram exclude add /var/log /var/lib/postgres
+  mix vram exclude remove /var/log
+  mix vram exclude list`,
+}
+
+var vramExcludeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the directories kept on disk",
+	RunE:  runVramExcludeList,
+}
+
+var vramExcludeAddCmd = &cobra.Command{
+	Use:   "add <dir>...",
+	Short: "Keep directories on disk",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runVramExcludeAdd,
+}
+
+var vramExcludeRemoveCmd = &cobra.Command{
+	Use:   "remove <dir>...",
+	Short: "Load directories into RAM again",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runVramExcludeRemove,
+}
+
+func init() {
+	vramCmd.AddCommand(vramExcludeCmd)
+	vramExcludeCmd.AddCommand(vramExcludeListCmd)
+	vramExcludeCmd.AddCommand(vramExcludeAddCmd)
+	vramExcludeCmd.AddCommand(vramExcludeRemoveCmd)
+}
+
+// vramDiskPaths returns the directories the initramfs bound from disk,
+// relative to the root
+func vramDiskPaths() []string {
+	data, err := os.ReadFile(vramExcludeBound)
+	if err != nil {
+		return nil
+	}
+	var rel []string
+	for _, p := range parseVramPaths(string(data)) {
+		rel = append(rel, strings.TrimPrefix(p, "/"))
+	}
+	return rel
+}
+
+// addVramExclude adds p to excludes, unless it is already covered or
+// covers one of them
+func addVramExclude(excludes []string, p string) ([]string, error) {
+	for _, q := range excludes {
+		switch {
+		case p == q || strings.HasPrefix(p, q+"/"):
+			return nil, fmt.Errorf("%s is already kept on disk with %s", p, q)
+		case strings.HasPrefix(q, p+"/"):
+			return nil, fmt.Errorf("%s holds %s, which is kept on disk; remove it first", p, q)
+		}
+	}
+	return append(excludes, p), nil
+}
+
+func runVramExcludeList(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	if len(conf.Exclude) == 0 {
+		fmt.Println("No directories excluded: VRAM boots load the whole root into RAM.")
+		return nil
+	}
+
+	bound := vramDiskPaths()
+	fmt.Println("Directories kept on disk on VRAM boots:")
+	for _, p := range conf.Exclude {
+		size, _ := dirSize(p)
+		state := ""
+		if slices.Contains(bound, strings.TrimPrefix(p, "/")) {
+			state = "  \033[32m(on disk)\033[0m"
+		} else if isVramActive() {
+			state = "  (in RAM until the next boot)"
+		}
+		fmt.Printf("  %-24s %10s%s\n", p, formatSize(size), state)
+	}
+	return nil
+}
+
+func runVramExcludeAdd(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if !filepath.IsAbs(arg) {
+			return fmt.Errorf("%s: expected an absolute path", arg)
+		}
+		p := filepath.Clean(arg)
+		switch {
+		case p == "/":
+			return fmt.Errorf("/ is the whole root; boot without VRAM=auto instead")
+		case strings.ContainsAny(p, " \t"):
+			return fmt.Errorf("%s: paths with spaces are not supported", p)
+		case vramExcluded(strings.TrimPrefix(p, "/")):
+			return fmt.Errorf("%s holds runtime state and is never in RAM", p)
+		}
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", p)
+		}
+		if conf.Exclude, err = addVramExclude(conf.Exclude, p); err != nil {
+			return err
+		}
+	}
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("failed to save %s: %w", vramPathsConfig, err)
+	}
+	fmt.Printf("✓ Excluded %s\n", strings.Join(args, ", "))
+	fmt.Println("  Takes effect on the next boot with VRAM=auto; run 'mix vram sync' first")
+	fmt.Println("  to keep the changes made to them in RAM.")
+	return nil
+}
+
+func runVramExcludeRemove(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		p := filepath.Clean(arg)
+		i := slices.Index(conf.Exclude, p)
+		if i < 0 {
+			return fmt.Errorf("%s is not excluded in %s", p, vramPathsConfig)
+		}
+		conf.Exclude = slices.Delete(conf.Exclude, i, i+1)
+	}
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("failed to save %s: %w", vramPathsConfig, err)
+	}
+	fmt.Printf("✓ Removed %s\n", strings.Join(args, ", "))
+	fmt.Println("  From the next boot with VRAM=auto they are loaded into RAM again, as")
+	fmt.Printf("  in the image; their files on disk stay in %s on the VISO disk.\n", vramExcludeSubdir)
+	return nil
+}
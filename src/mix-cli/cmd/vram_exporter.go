@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Prometheus Exporter
+// ============================================================================
+//
+// "mix vram exporter" serves the numbers of "mix vram status --json" in
+// the Prometheus text format on /metrics. Counting unsynced changes walks
+// the root, so a scrape reuses numbers up to vramExporterMaxAge old.
+
+const vramExporterMaxAge = 10 * time.Second
+
+var vramExporterCmd = &cobra.Command{
+	Use:   "exporter",
+	Short: "Serve VRAM metrics for Prometheus",
+	Long: `Expose VRAM statistics as Prometheus metrics on /metrics.
+
+Metrics include whether VRAM is active, the size and usage of the RAM
+root, the bytes changed since the last sync, the time of the last
+successful sync and the number of failed syncs since boot.
+
+Examples:
+  mix vram exporter
+  mix vram exporter --listen 127.0.0.1:9341`,
+	RunE: runVramExporter,
+}
+
+func init() {
+	vramCmd.AddCommand(vramExporterCmd)
+	vramExporterCmd.Flags().String("listen", ":9341", "address to listen on")
+}
+
+// formatVramMetrics renders stats and the last sync in the Prometheus text
+// exposition format
+func formatVramMetrics(stats *VramStats, sync *VramSyncResult) string {
+	var b strings.Builder
+	metric := func(name, kind, help string, value float64, labels ...string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		if len(labels) > 0 {
+			name += "{" + strings.Join(labels, ",") + "}"
+		}
+		fmt.Fprintf(&b, "%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	boolValue := func(v bool) float64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	metric("vram_active", "gauge", "Whether the root runs from RAM.", boolValue(stats.Active))
+	if stats.Active {
+		metric("vram_info", "gauge", "How the root is held in RAM.", 1, fmt.Sprintf("mode=%q", stats.Mode))
+	}
+	metric("vram_bytes_total", "gauge", "Size of the RAM root filesystem.", float64(stats.Size))
+	metric("vram_bytes_used", "gauge", "Bytes used in the RAM root filesystem.", float64(stats.Used))
+	metric("vram_dirty_bytes", "gauge", "Bytes changed since the last successful sync.", float64(stats.DirtyBytes))
+	metric("vram_dirty_files", "gauge", "Files changed since the last successful sync.", float64(stats.DirtyFiles))
+	metric("vram_page_cache_bytes", "gauge", "Page cache taken by the RAM root.", float64(stats.PageCache))
+	metric("vram_memory_available_bytes", "gauge", "MemAvailable of the system.", float64(stats.MemAvailable))
+	metric("vram_autosync_running", "gauge", "Whether the autosync daemon runs.", boolValue(stats.AutosyncActive))
+
+	var lastSuccess float64
+	var syncs, failures int
+	if sync != nil {
+		if !sync.LastSuccess.IsZero() {
+			lastSuccess = float64(sync.LastSuccess.Unix())
+		}
+		syncs, failures = sync.Syncs, sync.Failures
+	}
+	metric("vram_last_sync_timestamp_seconds", "gauge", "Unix time of the last successful sync, 0 if none.", lastSuccess)
+	metric("vram_syncs_total", "counter", "Syncs since boot.", float64(syncs))
+	metric("vram_sync_failures_total", "counter", "Failed syncs since boot.", float64(failures))
+
+	if z := stats.Zram; z != nil {
+		metric("vram_zram_original_bytes", "gauge", "Data stored on the zram device, uncompressed.", float64(z.Original))
+		metric("vram_zram_compressed_bytes", "gauge", "Data stored on the zram device, compressed.", float64(z.Compressed))
+		metric("vram_zram_memory_used_bytes", "gauge", "RAM taken by the zram device.", float64(z.MemUsed))
+	}
+	return b.String()
+}
+
+// vramMetricsCache keeps the last collected statistics for a while
+type vramMetricsCache struct {
+	mu        sync.Mutex
+	collected time.Time
+	body      string
+}
+
+func (c *vramMetricsCache) get() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.collected) > vramExporterMaxAge {
+		now := time.Now()
+		c.body = formatVramMetrics(collectVramStats(now), loadVramSyncResult())
+		c.collected = now
+	}
+	return c.body
+}
+
+func runVramExporter(cmd *cobra.Command, args []string) error {
+	listen, _ := cmd.Flags().GetString("listen")
+	cache := &vramMetricsCache{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprint(w, cache.get())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "MixOS VRAM exporter: metrics are on /metrics")
+	})
+
+	server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	fmt.Printf("Serving VRAM metrics on %s/metrics\n", listen)
+	return server.ListenAndServe()
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Hibernate
+// ============================================================================
+//
+// "mix vram hibernate" lets a VRAM machine power off without losing what
+// only lives in RAM. It syncs the root, then captures all of it, /tmp and
+// /var/tmp included, into a squashfs image in the state directory on the
+// backing disk and powers off. On the next boot the initramfs unpacks that
+// image into RAM in place of the boot image and the saved changes, and
+// removes it, so a hibernated root is resumed exactly once.
+//
+// Processes do not survive: this restores the files, not the session. The
+// image is tied to the boot image it was taken on, by size and mtime, and
+// is ignored once the boot image is replaced.
+
+const (
+	vramHibernateImage  = "hibernate.squashfs"
+	vramHibernateStamp  = "hibernate.squashfs.base" // "<size> <mtime>" of the boot image
+	vramHibernateResume = "hibernate.resume"        // the image while the initramfs resumes it
+)
+
+// vramHibernateKept are the runtime directories a hibernated root keeps
+var vramHibernateKept = []string{"tmp", "var/tmp"}
+
+var vramHibernateCmd = &cobra.Command{
+	Use:   "hibernate",
+	Short: "Save the whole RAM root to disk and power off",
+	Long: `Sync the RAM root, save all of it to the VISO disk, /tmp and /var/tmp
+included, and power off. The next boot resumes from that copy instead of
+the boot image, so nothing that was in RAM is lost; running processes
+are not restored.
+
+Only full VRAM (tmpfs or zram) can be hibernated. This needs mksquashfs.
+
+Examples:
+  mix vram hibernate
+  mix vram hibernate --reboot`,
+	RunE: runVramHibernate,
+}
+
+func init() {
+	vramCmd.AddCommand(vramHibernateCmd)
+	vramHibernateCmd.Flags().Bool("reboot", false, "reboot instead of powering off")
+	vramHibernateCmd.Flags().String("compression", "lz4", "gzip, lzo, lz4, xz or zstd")
+}
+
+// vramHibernateExcludes returns the directories whose contents stay out of
+// a hibernated root: those of a persisted one, except vramHibernateKept
+func vramHibernateExcludes(mounts, loaded []string) []string {
+	var excludes []string
+	for _, dir := range vramPersistExcludes(mounts, loaded) {
+		if !slices.Contains(vramHibernateKept, dir) {
+			excludes = append(excludes, dir)
+		}
+	}
+	return excludes
+}
+
+// hibernateVram writes the root to the state directory on the backing
+// disk and returns the size of the image
+func hibernateVram(compression string) (int64, error) {
+	backing, err := loadVramBacking()
+	if err != nil {
+		return 0, err
+	}
+	unlock, err := lockVram()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	disk, unmount, err := backing.mount()
+	if err != nil {
+		return 0, err
+	}
+	defer unmount()
+
+	baseInfo, err := os.Stat(filepath.Join(disk, backing.Image))
+	if err != nil {
+		return 0, err
+	}
+	state := filepath.Join(disk, vramStateSubdir)
+	if err := os.MkdirAll(state, 0755); err != nil {
+		return 0, err
+	}
+	image := filepath.Join(state, vramHibernateImage)
+	tmp := image + ".tmp"
+	excludes := vramHibernateExcludes(vramMountPoints(), nil)
+	if err := snapshotVramRoot(tmp, compression, excludes); err != nil {
+		return 0, err
+	}
+	// The stamp goes first: an image without one is never resumed
+	stamp := fmt.Sprintf("%d %d\n", baseInfo.Size(), baseInfo.ModTime().Unix())
+	if err := os.WriteFile(filepath.Join(state, vramHibernateStamp), []byte(stamp), 0644); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, image); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	os.Remove(filepath.Join(state, vramHibernateResume)) // left by a resume that failed
+	syscall.Sync()
+
+	info, err := os.Stat(image)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func runVramHibernate(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM hibernate must be run as root")
+	}
+	if !isVramActive() {
+		return fmt.Errorf("system is not running in VRAM mode")
+	}
+	if mode := vramMode(); mode != "tmpfs" && mode != "zram" {
+		return fmt.Errorf("only full VRAM can be hibernated, this root is %s; use 'mix vram sync'", mode)
+	}
+	if evicted := evictedVramPaths(); len(evicted) > 0 {
+		return fmt.Errorf("/%s were evicted from RAM; sync and reboot instead", strings.Join(evicted, ", /"))
+	}
+	compression, _ := cmd.Flags().GetString("compression")
+	if _, ok := vramCompressors[compression]; !ok {
+		return fmt.Errorf("unknown compression %q (use gzip, lzo, lz4, xz or zstd)", compression)
+	}
+	reboot, _ := cmd.Flags().GetBool("reboot")
+
+	// The saved changes are what the next normal boot gets, should the
+	// hibernated root not be resumed
+	fmt.Println("Syncing RAM root to disk...")
+	if _, _, err := syncVram(false, "hibernate"); err != nil {
+		return err
+	}
+
+	fmt.Println("Saving the RAM root (this may take a minute)...")
+	start := time.Now()
+	size, err := hibernateVram(compression)
+	if err != nil {
+		logVramEvent(vramEventFailure, "hibernate failed: %v", err)
+		return err
+	}
+	logVramEvent(vramEventMaintenance, "hibernated the RAM root: %s in %s", formatSize(size), time.Since(start).Round(time.Second))
+	fmt.Printf("✓ RAM root saved (%s) in %s; the next boot resumes it\n", formatSize(size), time.Since(start).Round(time.Second))
+
+	if reboot {
+		return runCommand("reboot")
+	}
+	return runCommand("poweroff")
+}
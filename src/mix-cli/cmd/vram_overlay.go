@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Overlay
+// ============================================================================
+//
+// Compressed VRAM runs the root as an overlay: the image in RAM is the
+// lower layer and everything written since boot lands in a tmpfs upper
+// layer. The initramfs mounts both under /run/initramfs, so the upper
+// layer is what changed since boot:
+//
+//	list     the files added, modified and deleted in the upper layer
+//	commit   bake the merged root into the boot image and the RAM image
+//	discard  drop the saved changes and block syncs until the next boot,
+//	         which then starts from the pristine image
+//
+// Deletions are whiteouts (0/0 character devices) and directories that
+// replace one of the lower layer are marked opaque.
+
+const (
+	vramOverlayLower = "/run/initramfs/vram-lower"
+	vramOverlayUpper = "/run/initramfs/vram-rw/upper"
+	vramDiscarded    = vramWorkDir + "/discarded" // written by "mix vram overlay discard"
+
+	vramOverlayOpaque = "trusted.overlay.opaque"
+)
+
+// vramOverlayChange is one entry of the upper layer
+type vramOverlayChange struct {
+	Kind  byte   // 'A'dded, 'M'odified, 'D'eleted or 'R'eplaced directory
+	Path  string // relative to the root
+	Bytes int64  // in the upper layer
+}
+
+var vramOverlayCmd = &cobra.Command{
+	Use:   "overlay",
+	Short: "Inspect, commit or discard what changed since boot",
+	Long: `Manage the upper layer of an overlay VRAM root (compressed VRAM), which
+holds everything written since boot.
+
+Without a subcommand the changes are listed.
+
+Examples:
+  mix vram overlay list
+  mix vram overlay commit
+  mix vram overlay discard --reboot`,
+	RunE: runVramOverlayList,
+}
+
+var vramOverlayListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the files changed since boot",
+	RunE:  runVramOverlayList,
+}
+
+var vramOverlayCommitCmd = &cobra.Command{
+	Use:   "commit",
+	Short: "Merge the changes into the boot image",
+	Long: `Bake the running root, with its changes, into a new boot image and
+rebuild the compressed RAM image from it, as "mix vram persist" does. The
+previous boot image is kept as <image>.prev.`,
+	RunE: runVramOverlayCommit,
+}
+
+var vramOverlayDiscardCmd = &cobra.Command{
+	Use:   "discard",
+	Short: "Throw the changes away and boot pristine next time",
+	Long: `Drop the changes saved by "mix vram sync" so that the next boot starts
+from the image as it is. Until then, syncs are refused so that the
+changes made in RAM are not saved again.`,
+	RunE: runVramOverlayDiscard,
+}
+
+func init() {
+	vramCmd.AddCommand(vramOverlayCmd)
+	vramOverlayCmd.AddCommand(vramOverlayListCmd)
+	vramOverlayCmd.AddCommand(vramOverlayCommitCmd)
+	vramOverlayCmd.AddCommand(vramOverlayDiscardCmd)
+	vramOverlayCommitCmd.Flags().String("compression", "xz", "compression of the new boot image: gzip, lzo, lz4, xz or zstd")
+	vramOverlayDiscardCmd.Flags().Bool("reboot", false, "reboot once the changes are discarded")
+	vramOverlayDiscardCmd.Flags().BoolP("yes", "y", false, "do not ask for confirmation")
+}
+
+// listVramOverlay reads the changes in upper against lower. A directory
+// that is new as a whole is one entry.
+func listVramOverlay(upper, lower string) ([]vramOverlayChange, error) {
+	var changes []vramOverlayChange
+	err := filepath.WalkDir(upper, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(upper, path)
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		_, lowerErr := os.Lstat(filepath.Join(lower, rel))
+		inLower := lowerErr == nil
+
+		switch {
+		case info.Mode()&fs.ModeCharDevice != 0 && info.Sys().(*syscall.Stat_t).Rdev == 0:
+			changes = append(changes, vramOverlayChange{Kind: 'D', Path: rel})
+		case d.IsDir() && !inLower:
+			size, _ := dirSize(path)
+			changes = append(changes, vramOverlayChange{Kind: 'A', Path: rel, Bytes: size})
+			return filepath.SkipDir
+		case d.IsDir():
+			if vramOverlayOpaqueDir(path) {
+				changes = append(changes, vramOverlayChange{Kind: 'R', Path: rel})
+			}
+		case inLower:
+			changes = append(changes, vramOverlayChange{Kind: 'M', Path: rel, Bytes: info.Size()})
+		default:
+			changes = append(changes, vramOverlayChange{Kind: 'A', Path: rel, Bytes: info.Size()})
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// vramOverlayOpaqueDir reports whether dir hides the directory below it
+func vramOverlayOpaqueDir(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := syscall.Getxattr(dir, vramOverlayOpaque, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// checkVramOverlay fails unless the root is an overlay whose layers the
+// initramfs left reachable
+func checkVramOverlay() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM overlay must be run as root")
+	}
+	if !isVramActive() {
+		return fmt.Errorf("system is not running in VRAM mode")
+	}
+	if vramMode() != "compressed" {
+		return fmt.Errorf("the VRAM root is not an overlay; use 'mix vram sync --dry-run' to see what changed")
+	}
+	if _, err := os.Stat(vramOverlayUpper); err != nil {
+		return fmt.Errorf("the overlay layers are not reachable; reboot with the current initramfs")
+	}
+	return nil
+}
+
+// checkVramDiscarded fails once the changes of this boot were discarded
+func checkVramDiscarded() error {
+	if _, err := os.Stat(vramDiscarded); err == nil {
+		return fmt.Errorf("changes were discarded with 'mix vram overlay discard'; reboot first")
+	}
+	return nil
+}
+
+func runVramOverlayList(cmd *cobra.Command, args []string) error {
+	if err := checkVramOverlay(); err != nil {
+		return err
+	}
+	changes, err := listVramOverlay(vramOverlayUpper, vramOverlayLower)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	shown := 0
+	for _, c := range changes {
+		if vramExcluded(c.Path) {
+			continue // runtime state, never saved
+		}
+		shown++
+		total += c.Bytes
+		size := ""
+		if c.Kind == 'A' || c.Kind == 'M' {
+			size = formatSize(c.Bytes)
+		}
+		fmt.Printf("  %c /%-50s %10s\n", c.Kind, c.Path, size)
+	}
+	if shown == 0 {
+		fmt.Println("No changes since boot.")
+		return nil
+	}
+	fmt.Printf("\n%d change(s), %s in the upper layer\n", shown, formatSize(total))
+	if checkVramDiscarded() != nil {
+		fmt.Println("\033[33mDiscarded:\033[0m these are dropped on the next boot.")
+	}
+	return nil
+}
+
+func runVramOverlayCommit(cmd *cobra.Command, args []string) error {
+	if err := checkVramOverlay(); err != nil {
+		return err
+	}
+	if err := checkVramDiscarded(); err != nil {
+		return err
+	}
+	compression, _ := cmd.Flags().GetString("compression")
+	if _, ok := vramCompressors[compression]; !ok {
+		return fmt.Errorf("unknown compression %q (use gzip, lzo, lz4, xz or zstd)", compression)
+	}
+
+	fmt.Println("Merging the changes into the boot image (this may take several minutes)...")
+	if err := commitVramRoot(compression); err != nil {
+		return err
+	}
+	fmt.Println("  The upper layer keeps the changes until the next boot.")
+	return nil
+}
+
+func runVramOverlayDiscard(cmd *cobra.Command, args []string) error {
+	if err := checkVramOverlay(); err != nil {
+		return err
+	}
+	yes, _ := cmd.Flags().GetBool("yes")
+	reboot, _ := cmd.Flags().GetBool("reboot")
+
+	if !yes {
+		fmt.Print("Discard all changes made since the image was built? [y/N] ")
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Cancelled.")
+			return nil
+		}
+	}
+
+	backing, err := loadVramBacking()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockVram()
+	if err != nil {
+		return err
+	}
+	disk, unmount, err := backing.mount()
+	if err != nil {
+		unlock()
+		return err
+	}
+	// Block syncs first, so that none saves the changes again
+	os.MkdirAll(vramWorkDir, 0700)
+	err = os.WriteFile(vramDiscarded, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+	if err == nil {
+		err = clearVramChanges(filepath.Join(disk, vramStateSubdir), nil)
+	}
+	syscall.Sync()
+	unmount()
+	unlock()
+	if err != nil {
+		return fmt.Errorf("failed to discard the changes: %w", err)
+	}
+	// The VRAM configuration is not a change to throw away: without it the
+	// next boot could come up in another mode
+	if data, err := os.ReadFile(vramPathsConfig); err == nil {
+		if err := storeVramFile(strings.TrimPrefix(vramPathsConfig, "/"), data, 0644); err != nil {
+			fmt.Printf("\033[33mNote:\033[0m the VRAM configuration was not kept: %v\n", err)
+		}
+	}
+	logVramEvent(vramEventMaintenance, "discarded the saved changes")
+
+	fmt.Println("✓ Changes discarded; the next boot starts from the pristine image")
+	if reboot {
+		return runCommand("reboot")
+	}
+	fmt.Println("  Syncs are off until then. Reboot with: reboot")
+	return nil
+}
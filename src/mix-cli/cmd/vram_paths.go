@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// Selective VRAM
+// ============================================================================
+//
+// Loading the whole root into RAM needs memory for all of it. When
+// /etc/mixos/vram.conf lists directories, a VRAM boot loads only those
+// into RAM and runs the rest of the root from the read-only image. The
+// initramfs reads the file from the changes saved by "mix vram sync", or
+// else from the image, and records what it loaded in
+// /run/initramfs/vram-paths. A sync then compares only those directories.
+
+const (
+	vramPathsConfig = "/etc/mixos/vram.conf"
+	vramPathsLoaded = "/run/initramfs/vram-paths"
+)
+
+var vramPathsCmd = &cobra.Command{
+	Use:   "paths",
+	Short: "Choose the directories loaded into RAM",
+	Long: `Manage the directories loaded into RAM in selective VRAM mode.
+
+With no directories configured a VRAM boot loads the whole root into
+RAM. Once directories are listed, only those are loaded and the rest of
+the system runs from disk. Changes take effect on the next VRAM boot.
+
+Examples:
+  mix vram paths add /usr /opt
+  mix vram paths remove /opt
+  mix vram paths list`,
+}
+
+var vramPathsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the directories loaded into RAM",
+	RunE:  runVramPathsList,
+}
+
+var vramPathsAddCmd = &cobra.Command{
+	Use:   "add <dir>...",
+	Short: "Load directories into RAM on VRAM boots",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runVramPathsAdd,
+}
+
+var vramPathsRemoveCmd = &cobra.Command{
+	Use:   "remove <dir>...",
+	Short: "Stop loading directories into RAM",
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runVramPathsRemove,
+}
+
+func init() {
+	vramCmd.AddCommand(vramPathsCmd)
+	vramPathsCmd.AddCommand(vramPathsListCmd)
+	vramPathsCmd.AddCommand(vramPathsAddCmd)
+	vramPathsCmd.AddCommand(vramPathsRemoveCmd)
+}
+
+// parseVramPaths reads a vram.conf: one absolute directory per line, "#"
+// starts a comment
+func parseVramPaths(data string) []string {
+	var paths []string
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if !filepath.IsAbs(line) {
+			continue
+		}
+		if p := filepath.Clean(line); p != "/" && !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// loadedVramPaths returns the directories the initramfs loaded into RAM,
+// relative to the root; nil when the whole root is in RAM
+func loadedVramPaths() []string {
+	data, err := os.ReadFile(vramPathsLoaded)
+	if err != nil {
+		return nil
+	}
+	var rel []string
+	for _, p := range parseVramPaths(string(data)) {
+		rel = append(rel, strings.TrimPrefix(p, "/"))
+	}
+	return rel
+}
+
+// validateVramPath checks a directory for vram.conf
+func validateVramPath(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("%s: expected an absolute path", p)
+	}
+	p = filepath.Clean(p)
+	if p == "/" {
+		return "", fmt.Errorf("/ is the whole root; remove all paths for full VRAM mode")
+	}
+	if strings.ContainsAny(p, " \t") {
+		return "", fmt.Errorf("%s: paths with spaces are not supported", p)
+	}
+	if vramExcluded(strings.TrimPrefix(p, "/")) {
+		return "", fmt.Errorf("%s holds runtime state and cannot be loaded into RAM", p)
+	}
+	if info, err := os.Stat(p); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", p)
+	}
+	return p, nil
+}
+
+// addVramPath adds p to paths; directories below p are dropped because p
+// covers them
+func addVramPath(paths []string, p string) ([]string, error) {
+	for _, q := range paths {
+		if p == q || strings.HasPrefix(p, q+"/") {
+			return nil, fmt.Errorf("%s is already loaded with %s", p, q)
+		}
+	}
+	paths = slices.DeleteFunc(paths, func(q string) bool {
+		return strings.HasPrefix(q, p+"/")
+	})
+	return append(paths, p), nil
+}
+
+func runVramPathsList(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	paths := conf.Paths
+	if len(paths) == 0 {
+		fmt.Println("No directories configured: VRAM boots load the whole root into RAM.")
+		return nil
+	}
+
+	loaded := loadedVramPaths()
+	var total int64
+	fmt.Println("Directories loaded into RAM on VRAM boots:")
+	for _, p := range paths {
+		size, _ := dirSize(p)
+		total += size
+		state := ""
+		if slices.Contains(loaded, strings.TrimPrefix(p, "/")) {
+			state = "  \033[32m(in RAM)\033[0m"
+		}
+		fmt.Printf("  %-24s %10s%s\n", p, formatSize(size), state)
+	}
+	fmt.Printf("\n  Total: %s\n", formatSize(total))
+	return nil
+}
+
+func runVramPathsAdd(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		p, err := validateVramPath(arg)
+		if err != nil {
+			return err
+		}
+		if conf.Paths, err = addVramPath(conf.Paths, p); err != nil {
+			return err
+		}
+	}
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("failed to save %s: %w", vramPathsConfig, err)
+	}
+	fmt.Printf("✓ Added %s\n", strings.Join(args, ", "))
+	fmt.Println("  Takes effect on the next boot with VRAM=auto.")
+	return nil
+}
+
+func runVramPathsRemove(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		p := filepath.Clean(arg)
+		i := slices.Index(conf.Paths, p)
+		if i < 0 {
+			return fmt.Errorf("%s is not in %s", p, vramPathsConfig)
+		}
+		conf.Paths = slices.Delete(conf.Paths, i, i+1)
+	}
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("failed to save %s: %w", vramPathsConfig, err)
+	}
+	fmt.Printf("✓ Removed %s\n", strings.Join(args, ", "))
+	if len(conf.Paths) == 0 {
+		fmt.Println("  No directories left: VRAM boots will load the whole root.")
+	}
+	fmt.Println("  Takes effect on the next boot with VRAM=auto.")
+	return nil
+}
@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Persist
+// ============================================================================
+//
+// "mix vram sync" keeps the changes made in RAM next to the image and lays
+// them over it on every boot. "mix vram persist" instead bakes the running
+// root into a new squashfs image that replaces the boot image, so the
+// stored changes are no longer needed and are dropped. The old image is
+// kept as <image>.prev where the disk supports hard links.
+//
+// Runtime state and other filesystems are left out, but their mount
+// points stay in the image as empty directories.
+
+var vramPersistCmd = &cobra.Command{
+	Use:   "persist",
+	Short: "Snapshot the RAM root into a new boot image",
+	Long: `Capture the running RAM root into a fresh squashfs image.
+
+By default the image replaces the root image on the VISO disk, so the
+next boot starts from the system as it is now; the previous image is
+kept as <image>.prev and the changes saved by "mix vram sync" are folded
+in. With --output the image is only written to that file.
+
+Runtime state (/proc, /sys, /dev, /run, /tmp, /mnt, /media, /var/tmp)
+and other mounted filesystems are not included. This needs mksquashfs.
+
+Examples:
+  mix vram persist
+  mix vram persist --output /mnt/usb/new-root.squashfs
+  mix vram persist --compression zstd`,
+	RunE: runVramPersist,
+}
+
+func init() {
+	vramCmd.AddCommand(vramPersistCmd)
+	vramPersistCmd.Flags().String("output", "", "write the image here instead of replacing the boot image")
+	vramPersistCmd.Flags().String("compression", "xz", "gzip, lzo, lz4, xz or zstd")
+}
+
+// unescapeMountPath decodes the octal escapes of /proc/mounts, such as
+// \040 for a space
+func unescapeMountPath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// vramMountPoints returns the mount points below the root, relative to it
+func vramMountPoints() []string {
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil
+	}
+	var mounts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] == "/" {
+			continue
+		}
+		mounts = append(mounts, strings.TrimPrefix(unescapeMountPath(fields[1]), "/"))
+	}
+	return mounts
+}
+
+// vramPersistExcludes returns the directories whose contents stay out of
+// the image: runtime state and mount points, except the directories that
+// selective VRAM loaded into RAM
+func vramPersistExcludes(mounts, loaded []string) []string {
+	excludes := slices.Clone(vramVolatilePaths)
+	for _, m := range mounts {
+		if slices.Contains(loaded, m) || vramExcluded(m) || slices.Contains(excludes, m) {
+			continue
+		}
+		excludes = append(excludes, m)
+	}
+	return excludes
+}
+
+// persistMksquashfsArgs returns the mksquashfs options for a snapshot of
+// the root; "dir/*" leaves the directory itself in the image
+func persistMksquashfsArgs(compression string, excludes []string) []string {
+	args := []string{"-comp", compression, "-b", "1M", "-noappend", "-no-progress", "-quiet", "-wildcards"}
+	if compression == "xz" {
+		args = append(args, "-Xbcj", "x86")
+	}
+	for _, dir := range excludes {
+		args = append(args, "-e", dir+"/*")
+	}
+	return args
+}
+
+// clearVramChanges drops the stored changes below scope, all of them when
+// scope is nil, once they are part of the image
+func clearVramChanges(state string, scope []string) error {
+	changes := &vramChanges{Scope: scope}
+	if scope == nil {
+		os.Remove(filepath.Join(state, "deleted"))
+		return os.RemoveAll(filepath.Join(state, "changes"))
+	}
+	for _, p := range scope {
+		if err := os.RemoveAll(filepath.Join(state, "changes", p)); err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(state, "deleted"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list strings.Builder
+	for _, rel := range strings.Split(string(data), "\n") {
+		if rel != "" && !changes.inScope(rel) {
+			list.WriteString(rel + "\n")
+		}
+	}
+	return os.WriteFile(filepath.Join(state, "deleted"), []byte(list.String()), 0644)
+}
+
+// snapshotVramRoot runs mksquashfs on the root into output, leaving out
+// the contents of excludes
+func snapshotVramRoot(output, compression string, excludes []string) error {
+	mksquashfs, err := exec.LookPath("mksquashfs")
+	if err != nil {
+		return fmt.Errorf("mksquashfs not found; install squashfs-tools")
+	}
+	args := append([]string{"/", output}, persistMksquashfsArgs(compression, excludes)...)
+	if out, err := exec.Command(mksquashfs, args...).CombinedOutput(); err != nil {
+		os.Remove(output)
+		return fmt.Errorf("mksquashfs failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// persistVramRoot replaces the boot image with a snapshot of the root and
+// returns its path
+func persistVramRoot(compression string) (string, error) {
+	backing, err := loadVramBacking()
+	if err != nil {
+		return "", err
+	}
+	unlock, err := lockVram()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	disk, unmount, err := backing.mount()
+	if err != nil {
+		return "", err
+	}
+	defer unmount()
+
+	image := filepath.Join(disk, backing.Image)
+	tmp := image + ".new"
+	excludes := vramPersistExcludes(vramMountPoints(), loadedVramPaths())
+	if err := snapshotVramRoot(tmp, compression, excludes); err != nil {
+		return "", err
+	}
+	syscall.Sync()
+
+	prev := image + ".prev"
+	os.Remove(prev)
+	if err := os.Link(image, prev); err != nil {
+		fmt.Printf("\033[33mNote:\033[0m the previous image cannot be kept: %v\n", err)
+	}
+	if err := os.Rename(tmp, image); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := clearVramChanges(filepath.Join(disk, vramStateSubdir), loadedVramPaths()); err != nil {
+		return "", fmt.Errorf("image replaced, but failed to clear the stored changes: %w", err)
+	}
+	syscall.Sync()
+	return fmt.Sprintf("%s:/%s", backing.Device, backing.Image), nil
+}
+
+func runVramPersist(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM persist must be run as root")
+	}
+	if !isVramActive() {
+		return fmt.Errorf("system is not running in VRAM mode")
+	}
+	if evicted := evictedVramPaths(); len(evicted) > 0 {
+		return fmt.Errorf("/%s were evicted from RAM; reboot before persisting", strings.Join(evicted, ", /"))
+	}
+	if err := checkVramDiscarded(); err != nil {
+		return err
+	}
+	compression, _ := cmd.Flags().GetString("compression")
+	if _, ok := vramCompressors[compression]; !ok {
+		return fmt.Errorf("unknown compression %q (use gzip, lzo, lz4, xz or zstd)", compression)
+	}
+	output, _ := cmd.Flags().GetString("output")
+
+	fmt.Println("Capturing the RAM root (this may take several minutes)...")
+	if output == "" {
+		return commitVramRoot(compression)
+	}
+	start := time.Now()
+	if err := writeVramManifest("/"); err != nil {
+		fmt.Printf("\033[33mNote:\033[0m the manifest cannot be updated, 'mix vram verify' will report changes: %v\n", err)
+	}
+	excludes := vramPersistExcludes(vramMountPoints(), loadedVramPaths())
+	if err := snapshotVramRoot(output, compression, excludes); err != nil {
+		return err
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Image written: %s (%s) in %s\n", output, formatSize(info.Size()), time.Since(start).Round(time.Second))
+	return nil
+}
+
+// commitVramRoot replaces the boot image with the running root, and
+// rebuilds the compressed RAM image from it when there is one
+func commitVramRoot(compression string) error {
+	start := time.Now()
+	if err := writeVramManifest("/"); err != nil {
+		fmt.Printf("\033[33mNote:\033[0m the manifest cannot be updated, 'mix vram verify' will report changes: %v\n", err)
+	}
+	image, err := persistVramRoot(compression)
+	if err != nil {
+		return err
+	}
+	logVramEvent(vramEventMaintenance, "persisted the RAM root into %s", image)
+	saveVramSyncResult(&VramSyncResult{Time: time.Now(), Duration: time.Since(start).Seconds()})
+	fmt.Printf("✓ Boot image replaced: %s in %s\n", image, time.Since(start).Round(time.Second))
+	fmt.Println("  Saved changes were folded into it; the old image is kept as .prev.")
+
+	if conf, err := loadVramConfig(); err == nil && conf.compressed() {
+		fmt.Println("Rebuilding the compressed RAM image...")
+		if _, err := buildVramImage(conf); err != nil {
+			return fmt.Errorf("failed to rebuild the RAM image: %w", err)
+		}
+	}
+	return nil
+}
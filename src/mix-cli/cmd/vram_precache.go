@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mixos-go/src/mix-cli/pkg/manager"
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Precache
+// ============================================================================
+//
+// Machines without the memory for VRAM can still run their hot
+// applications from RAM. "mix vram precache" copies the files of the given
+// packages into a tmpfs and bind-mounts the copies read-only over the
+// originals. A directory whose files all belong to the package is bound
+// as a whole, other files one by one. The binds last until they are
+// dropped or the system reboots; the disk copy is never modified.
+
+const (
+	vramPrecacheDir   = "/run/mixos/precache"      // the tmpfs holding the copies
+	vramPrecacheState = "/run/mixos/precache.json" // what is cached
+
+	vramPrecacheReserveMB = 512 // left available to the system
+)
+
+// vramPrecacheShared are directories that other packages install into,
+// which are never bound as a whole even when one package owns them today
+var vramPrecacheShared = []string{
+	"/usr", "/usr/bin", "/usr/sbin", "/usr/lib", "/usr/lib64", "/usr/libexec",
+	"/usr/share", "/usr/include", "/usr/local", "/usr/local/bin", "/usr/local/lib",
+	"/usr/local/share", "/usr/share/applications", "/usr/share/icons", "/usr/share/doc",
+	"/usr/share/man", "/etc", "/var", "/var/lib", "/opt",
+}
+
+// vramPrecached is one package held in RAM
+type vramPrecached struct {
+	Package string    `json:"package"`
+	Units   []string  `json:"units"` // bound files and directories
+	Bytes   int64     `json:"bytes"`
+	Loaded  time.Time `json:"loaded"`
+}
+
+var vramPrecacheCmd = &cobra.Command{
+	Use:   "precache [package]...",
+	Short: "Run selected applications from RAM",
+	Long: `Load the files of installed packages into RAM, so that just those
+applications get RAM-speed I/O on machines without enough memory for
+full VRAM mode.
+
+The files are copied to a tmpfs and mounted read-only over the
+originals until the next boot. Drop a package before upgrading it.
+Without arguments the cached packages are listed.
+
+Examples:
+  mix vram precache firefox libreoffice
+  mix vram precache
+  mix vram precache --drop firefox
+  mix vram precache --drop-all`,
+	RunE: runVramPrecache,
+}
+
+func init() {
+	vramCmd.AddCommand(vramPrecacheCmd)
+	vramPrecacheCmd.Flags().Bool("drop", false, "release the given packages from RAM")
+	vramPrecacheCmd.Flags().Bool("drop-all", false, "release all packages from RAM")
+}
+
+// precacheUnits groups the files of a package below root into what to
+// bind: the topmost directories that hold nothing but its files, short of
+// the shared ones, and the files that share a directory with others. Paths are absolute, as in
+// the package database.
+func precacheUnits(root string, files []string) []string {
+	owned := map[string]bool{}
+	for _, f := range files {
+		owned[filepath.Clean(f)] = true
+	}
+
+	// ownsDir reports whether every entry below dir belongs to the package
+	memo := map[string]bool{}
+	var ownsDir func(dir string) bool
+	ownsDir = func(dir string) bool {
+		if v, ok := memo[dir]; ok {
+			return v
+		}
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		result := err == nil && len(entries) > 0
+		for _, e := range entries {
+			if !result {
+				break
+			}
+			p := filepath.Join(dir, e.Name())
+			if e.IsDir() {
+				result = ownsDir(p)
+			} else {
+				result = owned[p]
+			}
+		}
+		memo[dir] = result
+		return result
+	}
+
+	var units []string
+	for f := range owned {
+		info, err := os.Lstat(filepath.Join(root, f))
+		if err != nil || !info.Mode().IsRegular() {
+			continue // symlinks point at files that are bound themselves
+		}
+		unit := f
+		for dir := filepath.Dir(f); filepath.Dir(dir) != "/" && !slices.Contains(vramPrecacheShared, dir) && ownsDir(dir); dir = filepath.Dir(dir) {
+			unit = dir
+		}
+		if !slices.Contains(units, unit) {
+			units = append(units, unit)
+		}
+	}
+	sort.Strings(units)
+	return units
+}
+
+func loadVramPrecache() []vramPrecached {
+	data, err := os.ReadFile(vramPrecacheState)
+	if err != nil {
+		return nil
+	}
+	var cached []vramPrecached
+	json.Unmarshal(data, &cached)
+	return cached
+}
+
+func saveVramPrecache(cached []vramPrecached) error {
+	data, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(vramPrecacheState), 0755)
+	return os.WriteFile(vramPrecacheState, data, 0644)
+}
+
+// precacheSize sums the bytes of units
+func precacheSize(units []string) int64 {
+	var total int64
+	for _, u := range units {
+		info, err := os.Lstat(u)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			size, _ := dirSize(u)
+			total += size
+		} else {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// bindVramPrecache copies unit into the tmpfs and mounts the copy
+// read-only over it
+func bindVramPrecache(unit string) error {
+	copyPath := filepath.Join(vramPrecacheDir, unit)
+	if err := os.MkdirAll(filepath.Dir(copyPath), 0755); err != nil {
+		return err
+	}
+	os.RemoveAll(copyPath)
+	if out, err := exec.Command("cp", "-a", unit, copyPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to copy %s: %s", unit, strings.TrimSpace(string(out)))
+	}
+	if err := syscall.Mount(copyPath, unit, "", syscall.MS_BIND, ""); err != nil {
+		os.RemoveAll(copyPath)
+		return fmt.Errorf("failed to bind %s: %w", unit, err)
+	}
+	// The flags of a bind mount can only be changed by remounting it
+	syscall.Mount("", unit, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, "")
+	return nil
+}
+
+// unbindVramPrecache releases the units of a package
+func unbindVramPrecache(p *vramPrecached) {
+	for _, unit := range p.Units {
+		syscall.Unmount(unit, syscall.MNT_DETACH)
+		os.RemoveAll(filepath.Join(vramPrecacheDir, unit))
+	}
+}
+
+func precacheVramPackage(mgr *manager.Manager, name string, availableMB int64) (*vramPrecached, error) {
+	installed, err := mgr.IsInstalled(name)
+	if err != nil {
+		return nil, err
+	}
+	if !installed {
+		return nil, fmt.Errorf("%s is not installed", name)
+	}
+	files, err := mgr.GetPackageFiles(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the files of %s: %w", name, err)
+	}
+	units := precacheUnits("/", files)
+	if len(units) == 0 {
+		return nil, fmt.Errorf("%s has no files to cache", name)
+	}
+	bytes := precacheSize(units)
+	if need := bytes>>20 + 1; need > availableMB-vramPrecacheReserveMB {
+		return nil, fmt.Errorf("%s needs %dMB: %dMB available, %dMB kept for the system",
+			name, need, availableMB, vramPrecacheReserveMB)
+	}
+
+	p := &vramPrecached{Package: name, Bytes: bytes, Loaded: time.Now()}
+	for _, unit := range units {
+		if err := bindVramPrecache(unit); err != nil {
+			unbindVramPrecache(p)
+			return nil, err
+		}
+		p.Units = append(p.Units, unit)
+	}
+	return p, nil
+}
+
+func runVramPrecache(cmd *cobra.Command, args []string) error {
+	drop, _ := cmd.Flags().GetBool("drop")
+	dropAll, _ := cmd.Flags().GetBool("drop-all")
+	cached := loadVramPrecache()
+
+	if len(args) == 0 && !dropAll {
+		if drop {
+			return fmt.Errorf("--drop needs the packages to release")
+		}
+		if len(cached) == 0 {
+			fmt.Println("No packages cached in RAM.")
+			return nil
+		}
+		var total int64
+		fmt.Println("Packages cached in RAM:")
+		for _, p := range cached {
+			total += p.Bytes
+			fmt.Printf("  %-24s %10s  %d mount(s), since %s\n", p.Package, formatSize(p.Bytes),
+				len(p.Units), p.Loaded.Format("15:04"))
+		}
+		fmt.Printf("\n  Total: %s\n", formatSize(total))
+		return nil
+	}
+
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM precache must be run as root")
+	}
+
+	if drop || dropAll {
+		var kept []vramPrecached
+		for i := range cached {
+			p := &cached[i]
+			if dropAll || slices.Contains(args, p.Package) {
+				unbindVramPrecache(p)
+				fmt.Printf("✓ Released %s (%s)\n", p.Package, formatSize(p.Bytes))
+				continue
+			}
+			kept = append(kept, *p)
+		}
+		if len(kept) == 0 && isMountpoint(vramPrecacheDir) {
+			syscall.Unmount(vramPrecacheDir, syscall.MNT_DETACH)
+		}
+		return saveVramPrecache(kept)
+	}
+
+	if isVramActive() && loadedVramPaths() == nil {
+		return fmt.Errorf("the whole root already runs from RAM")
+	}
+	mgr, err := manager.New(dbPath, repoURL, cacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to initialize package manager: %w", err)
+	}
+	defer mgr.Close()
+
+	if !isMountpoint(vramPrecacheDir) {
+		if err := os.MkdirAll(vramPrecacheDir, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount("tmpfs", vramPrecacheDir, "tmpfs", 0, "mode=0755"); err != nil {
+			return fmt.Errorf("failed to create tmpfs for the cache: %w", err)
+		}
+	}
+
+	for _, name := range args {
+		if slices.ContainsFunc(cached, func(p vramPrecached) bool { return p.Package == name }) {
+			fmt.Printf("  %s is already in RAM\n", name)
+			continue
+		}
+		info, err := getMemInfo()
+		if err != nil {
+			return fmt.Errorf("failed to get memory info: %w", err)
+		}
+		fmt.Printf("Loading %s into RAM...\n", name)
+		p, err := precacheVramPackage(mgr, name, info.MemAvailable)
+		if err != nil {
+			saveVramPrecache(cached)
+			return err
+		}
+		cached = append(cached, *p)
+		logVramEvent(vramEventMaintenance, "precached %s: %s in %d mount(s)", name, formatSize(p.Bytes), len(p.Units))
+		fmt.Printf("✓ %s in RAM (%s)\n", name, formatSize(p.Bytes))
+	}
+	if err := saveVramPrecache(cached); err != nil {
+		return err
+	}
+	fmt.Println("  Cached until the next boot; drop a package before upgrading it.")
+	return nil
+}
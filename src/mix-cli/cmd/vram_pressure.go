@@ -0,0 +1,563 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Memory Pressure
+// ============================================================================
+//
+// Everything written to a RAM root takes memory, and when it runs out the
+// OOM killer picks a process and the unsynced changes are at risk. The
+// pressure daemon watches MemAvailable and the kernel's pressure stall
+// information (PSI) and acts before that happens:
+//
+//	warning   a message on the console and in the VRAM log
+//	critical  an emergency sync, then the configured low-priority paths
+//	          are evicted from RAM
+//
+// Evicting a path empties it in RAM until the next boot; later syncs leave
+// it out, so what was stored for it comes back on the next boot. Only
+// paths whose contents the system can do without belong there, such as
+// caches and documentation.
+//
+// Inside a VM the monitor also follows the virtio balloon; see
+// vram_balloon.go.
+
+const (
+	vramPressureConfig  = "/etc/mixos/vram-pressure.json"
+	vramPressureScript  = "/etc/init.d/S61vram-pressure"
+	vramPressurePIDFile = "/run/mix-vram-pressure.pid"
+	vramEvictedPaths    = vramWorkDir + "/evicted"
+	vramPSIFile         = "/proc/pressure/memory"
+
+	vramPressureCheckInterval = 2 * time.Second
+	vramPressureCooldown      = 5 * time.Minute // between emergency syncs
+)
+
+// Pressure levels, in increasing order
+const (
+	vramPressureOK = iota
+	vramPressureWarning
+	vramPressureCritical
+)
+
+var vramPressureLevels = []string{"ok", "warning", "critical"}
+
+// VramPressure is the persisted pressure monitor configuration. Memory
+// thresholds are in MB of MemAvailable; PSI thresholds are the percentage
+// of the last 10s that some (warning) or all (critical) tasks stalled on
+// memory. BalloonShrink lowers the size limit of the RAM root while the
+// host holds memory taken through the virtio balloon.
+type VramPressure struct {
+	Enabled       bool      `json:"enabled"`
+	WarnMB        int64     `json:"warn_mb"`
+	CriticalMB    int64     `json:"critical_mb"`
+	WarnPSI       float64   `json:"warn_psi"`
+	CriticalPSI   float64   `json:"critical_psi"`
+	Evict         []string  `json:"evict,omitempty"`
+	BalloonShrink bool      `json:"balloon_shrink,omitempty"`
+	Updated       time.Time `json:"updated"`
+}
+
+var vramPressureCmd = &cobra.Command{
+	Use:   "pressure",
+	Short: "Act on low memory before the OOM killer does",
+	Long: `Run a daemon that watches available memory and memory pressure (PSI).
+
+Below --warn MB available, or with more than --warn-psi percent of time
+stalled on memory, a warning goes to the console and the VRAM log. Below
+--critical, or above --critical-psi, the RAM root is synced to disk and
+the --evict paths are emptied from RAM until the next boot.
+
+Inside a VM with a virtio balloon, the host taking memory back through
+it also brings a warning and a sync; with --balloon-shrink the size
+limit of the RAM root is lowered by as much until the host returns it.
+
+Without a subcommand the current pressure and configuration are shown.
+
+Examples:
+  mix vram pressure enable --warn 512M --critical 256M
+  mix vram pressure enable --evict /var/cache,/usr/share/doc
+  mix vram pressure enable --balloon-shrink
+  mix vram pressure disable
+  mix vram pressure`,
+	RunE: runVramPressureStatus,
+}
+
+var vramPressureEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Enable the pressure monitor",
+	RunE:  runVramPressureEnable,
+}
+
+var vramPressureDisableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Disable the pressure monitor",
+	RunE:  runVramPressureDisable,
+}
+
+var vramPressureRunCmd = &cobra.Command{
+	Use:    "run",
+	Short:  "Run the pressure monitor (started by the init script)",
+	Hidden: true,
+	RunE:   runVramPressureDaemon,
+}
+
+func init() {
+	vramCmd.AddCommand(vramPressureCmd)
+	vramPressureCmd.AddCommand(vramPressureEnableCmd)
+	vramPressureCmd.AddCommand(vramPressureDisableCmd)
+	vramPressureCmd.AddCommand(vramPressureRunCmd)
+
+	vramPressureEnableCmd.Flags().String("warn", "512M", "warn below this much available memory")
+	vramPressureEnableCmd.Flags().String("critical", "256M", "sync and evict below this much available memory")
+	vramPressureEnableCmd.Flags().Float64("warn-psi", 20, "warn above this memory stall percentage")
+	vramPressureEnableCmd.Flags().Float64("critical-psi", 10, "sync and evict above this full stall percentage")
+	vramPressureEnableCmd.Flags().StringSlice("evict", nil, "low-priority paths to empty from RAM when critical")
+	vramPressureEnableCmd.Flags().Bool("balloon-shrink", false, "shrink the RAM root while the host holds memory through the virtio balloon")
+}
+
+// ============================================================================
+// Configuration
+// ============================================================================
+
+func loadVramPressure() (*VramPressure, error) {
+	data, err := os.ReadFile(vramPressureConfig)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &VramPressure{WarnMB: 512, CriticalMB: 256, WarnPSI: 20, CriticalPSI: 10}, nil
+		}
+		return nil, err
+	}
+	var conf VramPressure
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", vramPressureConfig, err)
+	}
+	return &conf, nil
+}
+
+func saveVramPressure(conf *VramPressure) error {
+	conf.Updated = time.Now()
+	data, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(vramPressureConfig), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(vramPressureConfig, data, 0644)
+}
+
+// level classifies available memory in MB and the "some" and "full" PSI
+// averages
+func (c *VramPressure) level(availableMB int64, some, full float64) int {
+	switch {
+	case availableMB < c.CriticalMB || (c.CriticalPSI > 0 && full >= c.CriticalPSI):
+		return vramPressureCritical
+	case availableMB < c.WarnMB || (c.WarnPSI > 0 && some >= c.WarnPSI):
+		return vramPressureWarning
+	}
+	return vramPressureOK
+}
+
+// parseVramPSI reads the avg10 values of /proc/pressure/memory:
+//
+//	some avg10=1.52 avg60=0.40 avg300=0.08 total=123456
+//	full avg10=0.31 avg60=0.07 avg300=0.01 total=23456
+func parseVramPSI(data string) (some, full float64, err error) {
+	found := 0
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "avg10=") {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed PSI line %q", line)
+		}
+		switch fields[0] {
+		case "some":
+			some = v
+			found++
+		case "full":
+			full = v
+			found++
+		}
+	}
+	if found == 0 {
+		return 0, 0, fmt.Errorf("no PSI averages in %q", strings.TrimSpace(data))
+	}
+	return some, full, nil
+}
+
+// readVramPressure returns MemAvailable in MB and the PSI averages; the
+// averages are 0 when the kernel has no PSI
+func readVramPressure() (int64, float64, float64, error) {
+	info, err := getMemInfo()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var some, full float64
+	if data, err := os.ReadFile(vramPSIFile); err == nil {
+		some, full, _ = parseVramPSI(string(data))
+	}
+	return info.MemAvailable, some, full, nil
+}
+
+// ============================================================================
+// Eviction
+// ============================================================================
+
+// evictedVramPaths returns the paths evicted since boot, relative to the
+// root
+func evictedVramPaths() []string {
+	data, err := os.ReadFile(vramEvictedPaths)
+	if err != nil {
+		return nil
+	}
+	var rel []string
+	for _, p := range parseVramPaths(string(data)) {
+		rel = append(rel, strings.TrimPrefix(p, "/"))
+	}
+	return rel
+}
+
+// evictVramPath empties an absolute path in RAM and returns the bytes
+// freed. The path is recorded first, so that no sync stores its absence.
+func evictVramPath(path string) (int64, error) {
+	rel := strings.TrimPrefix(filepath.Clean(path), "/")
+	if underVramPaths(rel, evictedVramPaths()) {
+		return 0, nil
+	}
+	if loaded := loadedVramPaths(); loaded != nil && !underVramPaths(rel, loaded) {
+		return 0, fmt.Errorf("%s is not in RAM", path)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+
+	os.MkdirAll(vramWorkDir, 0700)
+	f, err := os.OpenFile(vramEvictedPaths, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	_, err = fmt.Fprintln(f, "/"+rel)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	freed, _ := dirSize(path)
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(path, e.Name())); err != nil {
+			return freed, err
+		}
+	}
+	return freed, nil
+}
+
+// ============================================================================
+// Daemon
+// ============================================================================
+
+// vramPressureInitScript starts the monitor at boot
+const vramPressureInitScript = `#!/bin/sh
+# Managed by 'mix vram pressure' - do not edit
+
+MIX=/usr/bin/mix
+PIDFILE=` + vramPressurePIDFile + `
+LOGFILE=` + vramLogFile + `
+
+case "$1" in
+    start)
+        echo "Starting VRAM pressure monitor..."
+        mkdir -p $(dirname $LOGFILE)
+        $MIX vram pressure run >> $LOGFILE 2>&1 &
+        echo $! > $PIDFILE
+        ;;
+    stop)
+        echo "Stopping VRAM pressure monitor..."
+        if [ -f $PIDFILE ]; then
+            kill $(cat $PIDFILE) 2>/dev/null
+            rm -f $PIDFILE
+        fi
+        ;;
+    restart)
+        $0 stop
+        $0 start
+        ;;
+    *)
+        echo "Usage: $0 {start|stop|restart}"
+        exit 1
+        ;;
+esac
+`
+
+// vramPressurePID returns the pid of the running monitor, 0 if none
+func vramPressurePID() int {
+	data, err := os.ReadFile(vramPressurePIDFile)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return 0
+	}
+	return pid
+}
+
+// warnVramPressure logs a pressure event and shows it on the console
+func warnVramPressure(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logVramEvent(vramEventPressure, "%s", msg)
+	if f, err := os.OpenFile("/dev/console", os.O_WRONLY|syscall.O_NOCTTY, 0); err == nil {
+		fmt.Fprintf(f, "\r\nmix-vram: %s\r\n", msg)
+		f.Close()
+	}
+}
+
+// relieveVramPressure syncs the RAM root and, once the changes are safe,
+// evicts the low-priority paths
+func relieveVramPressure(conf *VramPressure) {
+	if err := autosyncVram("emergency"); err != nil {
+		warnVramPressure("emergency sync failed, not evicting: %v", err)
+		return
+	}
+	for _, path := range conf.Evict {
+		freed, err := evictVramPath(path)
+		if err != nil {
+			warnVramPressure("failed to evict %s: %v", path, err)
+			continue
+		}
+		if freed > 0 {
+			warnVramPressure("evicted %s from RAM until the next boot, %s freed", path, formatSize(freed))
+		}
+	}
+}
+
+func runVramPressureDaemon(cmd *cobra.Command, args []string) error {
+	if !isVramActive() {
+		fmt.Println("Not running in VRAM mode; pressure monitor not needed")
+		return nil
+	}
+	conf, err := loadVramPressure()
+	if err != nil {
+		return err
+	}
+	if !conf.Enabled {
+		return fmt.Errorf("VRAM pressure monitor is disabled")
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	ticker := time.NewTicker(vramPressureCheckInterval)
+	defer ticker.Stop()
+	logVramEvent(vramEventDaemon, "pressure monitor started: warn below %dMB, critical below %dMB", conf.WarnMB, conf.CriticalMB)
+
+	level := vramPressureOK
+	var relieved time.Time
+	var balloon *vramBalloonWatch
+	if mb, ok := readVramBalloon(); ok {
+		balloon = &vramBalloonWatch{lastMB: mb}
+		logVramEvent(vramEventDaemon, "following the virtio balloon: %dMB taken by the host", mb)
+	}
+	for {
+		select {
+		case <-ticker.C:
+			available, some, full, err := readVramPressure()
+			if err != nil {
+				continue
+			}
+			if balloon != nil {
+				if mb, ok := readVramBalloon(); ok {
+					balloon.check(conf, mb, available, func() {
+						if time.Since(relieved) <= vramPressureCooldown {
+							return
+						}
+						relieved = time.Now()
+						if err := autosyncVram("balloon"); err != nil {
+							warnVramPressure("sync after the balloon inflated failed: %v", err)
+						}
+					})
+				}
+			}
+			next := conf.level(available, some, full)
+			switch {
+			case next == vramPressureCritical && (level < next || time.Since(relieved) > vramPressureCooldown):
+				warnVramPressure("critical memory pressure: %dMB available, %.1f%% stalled; syncing to disk",
+					available, full)
+				relieveVramPressure(conf)
+				relieved = time.Now()
+			case next == vramPressureWarning && level < next:
+				warnVramPressure("memory is running low: %dMB available, %.1f%% stalled; run 'mix vram sync'",
+					available, some)
+			case next < level:
+				logVramEvent(vramEventPressure, "memory pressure back to %s: %dMB available", vramPressureLevels[next], available)
+			}
+			level = next
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if c, err := loadVramPressure(); err == nil {
+					conf = c
+					logVramEvent(vramEventDaemon, "pressure monitor reloaded")
+				}
+				continue
+			}
+			logVramEvent(vramEventDaemon, "pressure monitor stopped")
+			return nil
+		}
+	}
+}
+
+// ============================================================================
+// Commands
+// ============================================================================
+
+func runVramPressureEnable(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("the pressure monitor must be configured as root")
+	}
+	conf, err := loadVramPressure()
+	if err != nil {
+		return err
+	}
+	for _, flag := range []struct {
+		name string
+		dst  *int64
+	}{{"warn", &conf.WarnMB}, {"critical", &conf.CriticalMB}} {
+		if cmd.Flags().Changed(flag.name) || *flag.dst == 0 {
+			v, _ := cmd.Flags().GetString(flag.name)
+			if *flag.dst, err = parseSizeMB(v); err != nil {
+				return fmt.Errorf("--%s: %w", flag.name, err)
+			}
+		}
+	}
+	if cmd.Flags().Changed("warn-psi") {
+		conf.WarnPSI, _ = cmd.Flags().GetFloat64("warn-psi")
+	}
+	if cmd.Flags().Changed("critical-psi") {
+		conf.CriticalPSI, _ = cmd.Flags().GetFloat64("critical-psi")
+	}
+	if conf.CriticalMB >= conf.WarnMB {
+		return fmt.Errorf("--critical (%dMB) must be below --warn (%dMB)", conf.CriticalMB, conf.WarnMB)
+	}
+	if cmd.Flags().Changed("balloon-shrink") {
+		conf.BalloonShrink, _ = cmd.Flags().GetBool("balloon-shrink")
+	}
+	if cmd.Flags().Changed("evict") {
+		paths, _ := cmd.Flags().GetStringSlice("evict")
+		conf.Evict = nil
+		for _, arg := range paths {
+			p, err := validateVramPath(arg)
+			if err != nil {
+				return err
+			}
+			conf.Evict = append(conf.Evict, p)
+		}
+	}
+
+	conf.Enabled = true
+	if err := saveVramPressure(conf); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(vramPressureScript), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(vramPressureScript, []byte(vramPressureInitScript), 0755); err != nil {
+		return fmt.Errorf("failed to install init script: %w", err)
+	}
+	logVramEvent(vramEventConfig, "pressure monitor enabled: warn below %dMB, critical below %dMB", conf.WarnMB, conf.CriticalMB)
+
+	fmt.Println("\033[32m✓ VRAM pressure monitor enabled\033[0m")
+	printVramPressureConfig(conf)
+	if !isVramActive() {
+		fmt.Println("  The monitor starts on the next VRAM boot.")
+		return nil
+	}
+	if pid := vramPressurePID(); pid != 0 {
+		syscall.Kill(pid, syscall.SIGHUP)
+	} else if err := exec.Command(vramPressureScript, "start").Run(); err != nil {
+		return fmt.Errorf("failed to start the monitor: %w", err)
+	}
+	return nil
+}
+
+func runVramPressureDisable(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("the pressure monitor must be configured as root")
+	}
+	conf, err := loadVramPressure()
+	if err != nil {
+		return err
+	}
+	if vramPressurePID() != 0 {
+		exec.Command(vramPressureScript, "stop").Run()
+	}
+	conf.Enabled = false
+	if err := saveVramPressure(conf); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	if err := os.Remove(vramPressureScript); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove init script: %w", err)
+	}
+	logVramEvent(vramEventConfig, "pressure monitor disabled")
+	fmt.Println("✓ VRAM pressure monitor disabled")
+	return nil
+}
+
+func printVramPressureConfig(conf *VramPressure) {
+	fmt.Printf("  Warning:     below %d MB available or %.0f%% stalled\n", conf.WarnMB, conf.WarnPSI)
+	fmt.Printf("  Critical:    below %d MB available or %.0f%% fully stalled\n", conf.CriticalMB, conf.CriticalPSI)
+	if len(conf.Evict) > 0 {
+		fmt.Printf("  Evict:       %s\n", strings.Join(conf.Evict, ", "))
+	} else {
+		fmt.Println("  Evict:       nothing (sync only)")
+	}
+	if conf.BalloonShrink {
+		fmt.Println("  Balloon:     sync and shrink the RAM root when it inflates")
+	} else {
+		fmt.Println("  Balloon:     sync when it inflates")
+	}
+}
+
+func runVramPressureStatus(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramPressure()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("VRAM Memory Pressure:")
+	if available, some, full, err := readVramPressure(); err == nil {
+		fmt.Printf("  Now:         %s (%d MB available, %.1f%% some / %.1f%% full stalled)\n",
+			vramPressureLevels[conf.level(available, some, full)], available, some, full)
+	}
+	if !conf.Enabled {
+		fmt.Println("  Monitor:     disabled")
+	} else if pid := vramPressurePID(); pid != 0 {
+		fmt.Printf("  Monitor:     running (pid %d)\n", pid)
+	} else {
+		fmt.Println("  Monitor:     enabled, not running")
+	}
+	printVramPressureConfig(conf)
+	fmt.Printf("  Balloon now: %s\n", describeVramBalloon())
+	if evicted := evictedVramPaths(); len(evicted) > 0 {
+		fmt.Printf("  Evicted:     /%s (until the next boot)\n", strings.Join(evicted, ", /"))
+	}
+	return nil
+}
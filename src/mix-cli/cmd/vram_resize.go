@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Resize
+// ============================================================================
+//
+// The initramfs sizes the RAM root from the image: a tmpfs of the image
+// size plus 256MB, or a zram device without a memory limit. "mix vram
+// resize" changes that at run time, by remounting the tmpfs with a new
+// size or by setting the mem_limit of the zram device, and stores the
+// size in vram.conf for the next boot. A root kept compressed writes to
+// a tmpfs the initramfs does not hand over, so it cannot be resized.
+
+// vramResizeReserveMB is the RAM left to the rest of the system when a
+// root grows, and the room left above its data when it shrinks
+const vramResizeReserveMB = 256
+
+var vramResizeCmd = &cobra.Command{
+	Use:   "resize <size>",
+	Short: "Grow or shrink the RAM root",
+	Long: `Change how much RAM the root may take, right away and for the next boot.
+
+The size is given like 3G, 2560M or 2560 (megabytes). Growing needs that
+much more available memory; shrinking needs the root's data to fit with
+256MB to spare. With the zram backend the size caps the RAM the
+compressed device uses. In selective VRAM mode --path picks the loaded
+directory to resize; those are sized from their content on every boot.
+
+Examples:
+  mix vram resize 3G
+  mix vram resize 1536M
+  mix vram resize 512M --path /usr`,
+	Args: cobra.ExactArgs(1),
+	RunE: runVramResize,
+}
+
+func init() {
+	vramCmd.AddCommand(vramResizeCmd)
+	vramResizeCmd.Flags().String("path", "", "loaded directory to resize (selective VRAM)")
+}
+
+// vramResizeTarget is what "mix vram resize" changes: a tmpfs mount or a
+// zram device
+type vramResizeTarget struct {
+	Mount  string // tmpfs mount point, "" for zram
+	Zram   string // /sys/block/zramN
+	SizeMB int64  // current limit, 0 for none
+	UsedMB int64
+}
+
+// checkVramResize validates a new size against the data in the root and
+// the memory available to grow it
+func checkVramResize(target *vramResizeTarget, sizeMB, availableMB int64) error {
+	if need := target.UsedMB + vramResizeReserveMB; sizeMB < need {
+		return fmt.Errorf("%dMB is too small: the root holds %dMB and needs %dMB to spare",
+			sizeMB, target.UsedMB, vramResizeReserveMB)
+	}
+	current := target.SizeMB
+	if current == 0 {
+		current = target.UsedMB
+	}
+	if grow := sizeMB - current; grow > availableMB-vramResizeReserveMB {
+		return fmt.Errorf("growing by %dMB needs more memory: %dMB available, %dMB kept for the system",
+			grow, availableMB, vramResizeReserveMB)
+	}
+	return nil
+}
+
+// findVramResizeTarget locates the tmpfs or zram device holding the root,
+// or the loaded directory path in selective mode
+func findVramResizeTarget(path string) (*vramResizeTarget, error) {
+	if loaded := loadedVramPaths(); loaded != nil {
+		if path == "" {
+			return nil, fmt.Errorf("the root is split across %s; choose one with --path", strings.Join(loaded, ", "))
+		}
+		if !slices.Contains(loaded, strings.TrimPrefix(filepath.Clean(path), "/")) {
+			return nil, fmt.Errorf("%s is not loaded into RAM", path)
+		}
+		return statVramTmpfs(filepath.Clean(path))
+	}
+	if path != "" && filepath.Clean(path) != "/" {
+		return nil, fmt.Errorf("--path needs selective VRAM; the whole root is in RAM")
+	}
+
+	if device := vramZramDevice(); device != "" {
+		sys := filepath.Join("/sys/block", filepath.Base(device))
+		stats, err := readZramStats(device)
+		if err != nil {
+			return nil, err
+		}
+		target := &vramResizeTarget{Zram: sys, UsedMB: stats.MemUsed >> 20}
+		if data, err := os.ReadFile(filepath.Join(sys, "mem_limit")); err == nil {
+			limit, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+			target.SizeMB = limit >> 20
+		}
+		return target, nil
+	}
+	if conf := bootVramConfig(); conf != nil && conf.compressed() {
+		return nil, fmt.Errorf("a compressed root cannot be resized at run time")
+	}
+	return statVramTmpfs("/")
+}
+
+// statVramTmpfs reads the size and usage of the tmpfs mounted at mount
+func statVramTmpfs(mount string) (*vramResizeTarget, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mount, &st); err != nil {
+		return nil, err
+	}
+	const tmpfsMagic = 0x01021994
+	if st.Type != tmpfsMagic {
+		return nil, fmt.Errorf("%s is not a tmpfs", mount)
+	}
+	return &vramResizeTarget{
+		Mount:  mount,
+		SizeMB: int64(st.Blocks) * st.Bsize >> 20,
+		UsedMB: int64(st.Blocks-st.Bfree) * st.Bsize >> 20,
+	}, nil
+}
+
+// apply sets the new size
+func (t *vramResizeTarget) apply(sizeMB int64) error {
+	if t.Zram != "" {
+		return os.WriteFile(filepath.Join(t.Zram, "mem_limit"), []byte(fmt.Sprintf("%dM", sizeMB)), 0644)
+	}
+	return syscall.Mount("tmpfs", t.Mount, "tmpfs", syscall.MS_REMOUNT, fmt.Sprintf("size=%dm", sizeMB))
+}
+
+func runVramResize(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM must be resized as root")
+	}
+	if !isVramActive() {
+		return fmt.Errorf("VRAM is not active")
+	}
+	sizeMB, err := parseSizeMB(args[0])
+	if err != nil {
+		return err
+	}
+	path, _ := cmd.Flags().GetString("path")
+
+	target, err := findVramResizeTarget(path)
+	if err != nil {
+		return err
+	}
+	info, err := getMemInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get memory info: %w", err)
+	}
+	if err := checkVramResize(target, sizeMB, info.MemAvailable); err != nil {
+		return err
+	}
+	if err := target.apply(sizeMB); err != nil {
+		return fmt.Errorf("failed to resize: %w", err)
+	}
+
+	from := "unlimited"
+	if target.SizeMB != 0 {
+		from = fmt.Sprintf("%d MB", target.SizeMB)
+	}
+	fmt.Printf("✓ Resized %s: %s → %d MB (%d MB used)\n", target.describe(), from, sizeMB, target.UsedMB)
+	if path != "" {
+		fmt.Println("  Loaded directories are sized from their content on the next boot.")
+		return nil
+	}
+	os.WriteFile("/run/initramfs/vram-size", []byte(fmt.Sprintf("%d\n", sizeMB)), 0644)
+
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	if conf.compressed() {
+		fmt.Println("  Not saved: the next boot keeps the root compressed.")
+		return nil
+	}
+	conf.Size = sizeMB
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("resized, but failed to save %s: %w", vramPathsConfig, err)
+	}
+	fmt.Printf("✓ Saved size = %d in %s for the next boot\n", sizeMB, vramPathsConfig)
+	return nil
+}
+
+func (t *vramResizeTarget) describe() string {
+	if t.Zram != "" {
+		return "zram " + filepath.Base(t.Zram) + " memory limit"
+	}
+	return "tmpfs " + t.Mount
+}
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ============================================================================
+// VRAM Statistics
+// ============================================================================
+//
+// "mix vram status" reports how full the RAM root is, how much has been
+// written since the last sync and would be lost on power failure, and how
+// long ago that sync was. --json prints the same for monitoring agents.
+//
+// Dirty data is counted from change times: files whose ctime is newer than
+// the last successful sync, or than the moment the initramfs finished
+// loading the root, are not on disk yet. Deletions are not counted.
+//
+// "mix vram status --quiet" prints nothing and exits with the state, for
+// scripts to branch on; the codes are stable.
+
+const vramStatusFile = "/run/initramfs/vram-status"
+
+// Exit codes of "mix vram status --quiet"
+const (
+	vramStatusActive    = 0
+	vramStatusInactive  = 1 // could run in VRAM mode, but does not
+	vramStatusIncapable = 2 // not enough RAM for VRAM mode
+)
+
+var vramStates = []string{"active", "inactive", "incapable"}
+
+// VramStats is the output of "mix vram status --json"; sizes are bytes
+type VramStats struct {
+	State          string            `json:"state"` // active, inactive or incapable
+	Active         bool              `json:"active"`
+	Capable        bool              `json:"capable"`
+	Capability     string            `json:"capability"`
+	Mode           string            `json:"mode,omitempty"` // tmpfs, zram, compressed or selective
+	Paths          []string          `json:"paths,omitempty"`
+	Budget         int64             `json:"budget,omitempty"` // VRAM=<size>
+	Skipped        []VramSkippedPath `json:"skipped,omitempty"`
+	Size           int64             `json:"size"`
+	Used           int64             `json:"used"`
+	Free           int64             `json:"free"`
+	DirtyFiles     int               `json:"dirty_files"`
+	DirtyBytes     int64             `json:"dirty_bytes"`
+	PageCache      int64             `json:"page_cache"`
+	LastSync       *time.Time        `json:"last_sync,omitempty"`
+	SinceSync      *float64          `json:"seconds_since_sync,omitempty"`
+	LastSyncError  string            `json:"last_sync_error,omitempty"`
+	Zram           *zramStats        `json:"zram,omitempty"`
+	MemTotal       int64             `json:"mem_total"`
+	MemAvailable   int64             `json:"mem_available"`
+	AutosyncActive bool              `json:"autosync_active"`
+}
+
+func init() {
+	vramStatusCmd.Flags().Bool("json", false, "print machine-readable JSON")
+	vramStatusCmd.Flags().BoolP("quiet", "q", false, "print nothing; exit 0 if active, 1 if inactive, 2 if incapable")
+}
+
+// vramStatusCode returns the exit code of "mix vram status --quiet"
+func vramStatusCode(stats *VramStats) int {
+	switch {
+	case stats.Active:
+		return vramStatusActive
+	case stats.Capable:
+		return vramStatusInactive
+	}
+	return vramStatusIncapable
+}
+
+// vramMode names how the running root is held in RAM
+func vramMode() string {
+	switch {
+	case loadedVramPaths() != nil:
+		return "selective"
+	case vramZramDevice() != "":
+		return "zram"
+	}
+	if conf := bootVramConfig(); conf != nil && conf.compressed() {
+		return "compressed"
+	}
+	return "tmpfs"
+}
+
+// vramDirty counts the files below root changed after since; scope
+// limits the walk to the loaded directories in selective mode
+func vramDirty(root string, scope []string, since time.Time) (int, int64) {
+	if scope == nil {
+		scope = []string{"."}
+	}
+
+	files, bytes := 0, int64(0)
+	for _, dir := range scope {
+		top, err := os.Lstat(filepath.Join(root, dir))
+		if err != nil {
+			continue
+		}
+		dev := top.Sys().(*syscall.Stat_t).Dev
+		filepath.WalkDir(filepath.Join(root, dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, path)
+			if rel != "." && vramExcluded(rel) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			st := info.Sys().(*syscall.Stat_t)
+			if d.IsDir() && st.Dev != dev {
+				return filepath.SkipDir
+			}
+			if time.Unix(st.Ctim.Unix()).After(since) {
+				files++
+				if info.Mode().IsRegular() {
+					bytes += info.Size()
+				}
+			}
+			return nil
+		})
+	}
+	return files, bytes
+}
+
+// collectVramStats gathers the VRAM statistics at now
+func collectVramStats(now time.Time) *VramStats {
+	stats := &VramStats{Active: isVramActive()}
+	stats.Capable, stats.Capability = checkVramCapability()
+	stats.State = vramStates[vramStatusCode(stats)]
+	if info, err := getMemInfo(); err == nil {
+		stats.MemTotal = info.MemTotal << 20
+		stats.MemAvailable = info.MemAvailable << 20
+	}
+	stats.AutosyncActive = vramAutosyncPID() != 0
+	if !stats.Active {
+		return stats
+	}
+
+	stats.Mode = vramMode()
+	scope := loadedVramPaths()
+	mounts := []string{"/"}
+	if scope != nil {
+		mounts = nil
+		for _, p := range scope {
+			mounts = append(mounts, "/"+p)
+		}
+		stats.Paths = mounts
+		stats.Budget, stats.Skipped = loadVramBudget()
+	}
+	for _, mount := range mounts {
+		var st syscall.Statfs_t
+		if syscall.Statfs(mount, &st) == nil {
+			stats.Size += int64(st.Blocks) * st.Bsize
+			stats.Used += int64(st.Blocks-st.Bfree) * st.Bsize
+			stats.Free += int64(st.Bavail) * st.Bsize
+		}
+	}
+
+	// A tmpfs lives in the page cache, so its usage is the cache it takes.
+	// Otherwise count the file cache, which in VRAM mode is the root's.
+	if stats.Mode == "tmpfs" || stats.Mode == "selective" {
+		stats.PageCache = stats.Used
+	} else if info, err := getMemInfo(); err == nil {
+		stats.PageCache = (info.Cached - info.Shmem) << 20
+	}
+	if device := vramZramDevice(); device != "" {
+		stats.Zram, _ = readZramStats(device)
+	}
+
+	// Dirty since the last successful sync, or since the root was loaded
+	var since time.Time
+	if info, err := os.Stat(vramStatusFile); err == nil {
+		since = info.ModTime()
+	}
+	if r := loadVramSyncResult(); r != nil {
+		t := r.Time
+		stats.LastSync = &t
+		seconds := now.Sub(t).Round(time.Second).Seconds()
+		stats.SinceSync = &seconds
+		stats.LastSyncError = r.Error
+		if r.LastSuccess.After(since) {
+			since = r.LastSuccess
+		}
+	}
+	stats.DirtyFiles, stats.DirtyBytes = vramDirty("/", scope, since)
+	return stats
+}
+
+// printVramStats shows the live statistics of an active VRAM root
+func printVramStats(stats *VramStats) {
+	fmt.Printf("  Mode:      %s\n", stats.Mode)
+	if stats.Budget > 0 {
+		fmt.Printf("  Budget:    %s (%s)\n", formatSize(stats.Budget), vramBudgetParam(stats.Budget>>20))
+		if hotset := vramHotsetPath("/"); hotset != "" {
+			fmt.Printf("  Hotset:    %s\n", hotset)
+		}
+	}
+	if len(stats.Paths) > 0 {
+		fmt.Printf("  In RAM:    %s\n", strings.Join(stats.Paths, ", "))
+	}
+	for i, s := range stats.Skipped {
+		label := ""
+		if i == 0 {
+			label = "On disk:"
+		}
+		fmt.Printf("  %-10s %s (%s)\n", label, s.Path, formatSize(s.Bytes))
+	}
+	if stats.Size > 0 {
+		fmt.Printf("  Usage:     %s of %s (%.0f%%), %s free\n", formatSize(stats.Used), formatSize(stats.Size),
+			float64(stats.Used)*100/float64(stats.Size), formatSize(stats.Free))
+	}
+	fmt.Printf("  In cache:  %s\n", formatSize(stats.PageCache))
+	fmt.Printf("  Unsynced:  %d file(s), %s\n", stats.DirtyFiles, formatSize(stats.DirtyBytes))
+	switch {
+	case stats.LastSync == nil:
+		fmt.Println("  Last sync: never")
+	case stats.LastSyncError != "":
+		fmt.Printf("  Last sync: \033[31mfailed\033[0m %s ago: %s\n", time.Duration(*stats.SinceSync)*time.Second, stats.LastSyncError)
+	default:
+		fmt.Printf("  Last sync: %s ago\n", time.Duration(*stats.SinceSync)*time.Second)
+	}
+	if stats.AutosyncActive {
+		fmt.Println("  Autosync:  running")
+	}
+}
+
+func printVramStatsJSON(stats *VramStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,743 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// ============================================================================
+// VRAM Sync
+// ============================================================================
+//
+// In VRAM mode the initramfs unpacks the squashfs root into a tmpfs, so
+// everything written afterwards lives only in memory. "mix vram sync"
+// compares the RAM root with the image it was unpacked from and stores the
+// difference next to the image on the backing disk:
+//
+//	<disk>/mixos/vram/changes/   new and modified files, as a tree
+//	<disk>/mixos/vram/deleted    paths removed from the image, one per line
+//
+// The initramfs lays both over the unpacked image on the next boot. Only
+// files whose type, size, mtime, mode, owner or link target differ from the
+// stored copy are written, like rsync's quick check.
+
+const (
+	vramBackingInfo = "/run/initramfs/vram-backing" // "<device> <fstype> <image>", written by the initramfs
+	vramWorkDir     = "/run/mixos/vram"
+	vramStateSubdir = "mixos/vram"
+	vramSyncStatus  = vramWorkDir + "/sync.json"
+)
+
+// vramVolatilePaths are never synced: pseudo filesystems, runtime state and
+// mount points
+var vramVolatilePaths = []string{
+	"proc", "sys", "dev", "run", "tmp", "mnt", "media",
+	"var/tmp", "var/run", "var/lock", "lost+found",
+}
+
+// VramSyncResult records the outcome of a sync
+type VramSyncResult struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration"` // seconds
+	Files    int       `json:"files"`    // entries written
+	Bytes    int64     `json:"bytes"`
+	Deleted  int       `json:"deleted"`
+	Removed  int       `json:"removed"` // stale entries dropped from the stored changes
+	Error    string    `json:"error,omitempty"`
+
+	// Since boot
+	Syncs       int       `json:"syncs"`
+	Failures    int       `json:"failures"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+}
+
+// vramSyncWritten counts the bytes the sync in progress has written, for
+// the progress shown at shutdown
+var vramSyncWritten atomic.Int64
+
+var vramSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Write changes made in RAM back to disk",
+	Long: `Persist the changes made to the RAM root since boot.
+
+The RAM root is compared with the squashfs image it was loaded from and
+the new, modified and deleted files are stored next to the image on the
+backing disk. They are restored on the next VRAM boot. Runtime state
+(/proc, /sys, /dev, /run, /tmp, /mnt, /media, /var/tmp) is not synced.
+
+Examples:
+  mix vram sync
+  mix vram sync --dry-run`,
+	RunE: runVramSync,
+}
+
+func init() {
+	vramCmd.AddCommand(vramSyncCmd)
+	vramSyncCmd.Flags().Bool("dry-run", false, "only list what would be written")
+}
+
+// ============================================================================
+// Backing store
+// ============================================================================
+
+// vramBacking is the disk and image the RAM root was loaded from
+type vramBacking struct {
+	Device string
+	FSType string
+	Image  string // path of the squashfs image on the device
+}
+
+func loadVramBacking() (*vramBacking, error) {
+	data, err := os.ReadFile(vramBackingInfo)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no backing disk recorded in %s (not booted from a VISO disk?)", vramBackingInfo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("malformed %s", vramBackingInfo)
+	}
+	return &vramBacking{Device: fields[0], FSType: fields[1], Image: fields[2]}, nil
+}
+
+// mount mounts the backing disk read-write and returns its mount point and
+// a function that unmounts it again
+func (b *vramBacking) mount() (string, func(), error) {
+	target := filepath.Join(vramWorkDir, "backing")
+	if isMountpoint(target) {
+		// Held open by a running sync daemon
+		return target, func() {}, nil
+	}
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return "", nil, err
+	}
+	err := syscall.Mount(b.Device, target, b.FSType, 0, "")
+	if errors.Is(err, syscall.EBUSY) {
+		// The initramfs still has it mounted read-only: share that
+		// superblock and switch it to read-write
+		if err = syscall.Mount(b.Device, target, b.FSType, syscall.MS_RDONLY, ""); err == nil {
+			if err = syscall.Mount("", target, "", syscall.MS_REMOUNT, ""); err != nil {
+				syscall.Unmount(target, 0)
+			}
+		}
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to mount %s read-write: %w", b.Device, err)
+	}
+	return target, func() { syscall.Unmount(target, 0) }, nil
+}
+
+// mountVramImage mounts a squashfs image read-only. mount(8) sets up the
+// loop device.
+func mountVramImage(image, name string) (string, func(), error) {
+	target := filepath.Join(vramWorkDir, name)
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return "", nil, err
+	}
+	if out, err := exec.Command("mount", "-t", "squashfs", "-o", "ro,loop", image, target).CombinedOutput(); err != nil {
+		return "", nil, fmt.Errorf("failed to mount %s: %s", image, strings.TrimSpace(string(out)))
+	}
+	return target, func() { exec.Command("umount", "-d", target).Run() }, nil
+}
+
+// lockVram takes the lock that keeps syncs and other writers of the stored
+// changes apart
+func lockVram() (func(), error) {
+	if err := os.MkdirAll(vramWorkDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(vramWorkDir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("another VRAM sync is in progress")
+	}
+	return func() { f.Close() }, nil
+}
+
+// ============================================================================
+// Comparing trees
+// ============================================================================
+
+// vramChanges is the difference between the RAM root and its image
+type vramChanges struct {
+	Scope   []string // trees that were compared; nil for the whole root
+	Kept    []string // trees inside the scope that were left out, such as evicted paths
+	Changed []string // new or modified entries, parents before children
+	Deleted []string // entries of the image that are gone; a deleted directory hides its contents
+}
+
+// inScope reports whether rel lies in one of the compared trees
+func (c *vramChanges) inScope(rel string) bool {
+	if underVramPaths(rel, c.Kept) {
+		return false
+	}
+	if c.Scope == nil {
+		return true
+	}
+	for _, p := range c.Scope {
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// aboveScope reports whether rel is a directory that contains a compared
+// or a kept tree
+func (c *vramChanges) aboveScope(rel string) bool {
+	for _, p := range append(c.Scope, c.Kept...) {
+		if strings.HasPrefix(p, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// underVramPaths reports whether rel is one of paths or lies below one
+func underVramPaths(rel string, paths []string) bool {
+	for _, p := range paths {
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// vramExcluded reports whether rel is runtime state that is never synced
+func vramExcluded(rel string) bool {
+	for _, p := range vramVolatilePaths {
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameVramEntry reports whether two entries look identical: same type,
+// permissions and owner, and for files the same size and mtime
+func sameVramEntry(a, b fs.FileInfo, aPath, bPath string) bool {
+	const permBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	if a.Mode().Type() != b.Mode().Type() || a.Mode()&permBits != b.Mode()&permBits {
+		return false
+	}
+	as, aok := a.Sys().(*syscall.Stat_t)
+	bs, bok := b.Sys().(*syscall.Stat_t)
+	if aok && bok && (as.Uid != bs.Uid || as.Gid != bs.Gid) {
+		return false
+	}
+	switch {
+	case a.Mode().IsRegular():
+		return a.Size() == b.Size() && a.ModTime().Unix() == b.ModTime().Unix()
+	case a.Mode()&fs.ModeSymlink != 0:
+		at, err1 := os.Readlink(aPath)
+		bt, err2 := os.Readlink(bPath)
+		return err1 == nil && err2 == nil && at == bt
+	case a.Mode()&(fs.ModeDevice|fs.ModeCharDevice) != 0:
+		return aok && bok && as.Rdev == bs.Rdev
+	}
+	return true
+}
+
+// diffVramRoot compares root with lower. Entries for which skip returns
+// true, and other filesystems mounted below root, are left out.
+func diffVramRoot(root, lower string, skip func(rel string) bool) (*vramChanges, error) {
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+	rootDev := rootInfo.Sys().(*syscall.Stat_t).Dev
+
+	changes := &vramChanges{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return nil
+		}
+		if skip(rel) || d.Type()&fs.ModeSocket != 0 {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && info.Sys().(*syscall.Stat_t).Dev != rootDev {
+			return filepath.SkipDir // a mount point
+		}
+		lowerPath := filepath.Join(lower, rel)
+		if lowerInfo, err := os.Lstat(lowerPath); err != nil || !sameVramEntry(info, lowerInfo, path, lowerPath) {
+			changes.Changed = append(changes.Changed, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.WalkDir(lower, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == lower && os.IsNotExist(err) {
+				return nil // not in the image at all
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(lower, path)
+		if rel == "." {
+			return nil
+		}
+		if skip(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(root, rel)); os.IsNotExist(err) {
+			if !strings.ContainsRune(rel, '\n') {
+				changes.Deleted = append(changes.Deleted, rel)
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// diffVramPaths compares only the trees below paths, which are relative
+// to root; without paths the whole root is compared
+func diffVramPaths(root, lower string, paths []string, skip func(rel string) bool) (*vramChanges, error) {
+	if len(paths) == 0 {
+		return diffVramRoot(root, lower, skip)
+	}
+	changes := &vramChanges{Scope: paths}
+	for _, p := range paths {
+		c, err := diffVramRoot(filepath.Join(root, p), filepath.Join(lower, p), func(rel string) bool {
+			return skip(filepath.Join(p, rel))
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range c.Changed {
+			changes.Changed = append(changes.Changed, filepath.Join(p, rel))
+		}
+		for _, rel := range c.Deleted {
+			changes.Deleted = append(changes.Deleted, filepath.Join(p, rel))
+		}
+	}
+	return changes, nil
+}
+
+// ============================================================================
+// Storing changes
+// ============================================================================
+
+// copyVramEntry copies one entry with its owner, permissions and times;
+// directories get only their attributes
+func copyVramEntry(src, dst string, info fs.FileInfo) (int64, error) {
+	var written int64
+	if old, err := os.Lstat(dst); err == nil && !(old.IsDir() && info.IsDir()) {
+		if err := os.RemoveAll(dst); err != nil {
+			return 0, err
+		}
+	}
+
+	st := info.Sys().(*syscall.Stat_t)
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		if err := os.Mkdir(dst, 0700); err != nil && !os.IsExist(err) {
+			return 0, err
+		}
+	case mode.IsRegular():
+		in, err := os.Open(src)
+		if err != nil {
+			return 0, err
+		}
+		defer in.Close()
+		tmp, err := os.CreateTemp(filepath.Dir(dst), ".vram-sync-*")
+		if err != nil {
+			return 0, err
+		}
+		written, err = io.Copy(tmp, in)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), dst)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return 0, err
+		}
+	case mode&fs.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return 0, err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return 0, err
+		}
+	default: // devices and fifos
+		if err := unix.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+		return written, err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		// After chown, which clears the setuid bits
+		if err := os.Chmod(dst, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return written, err
+		}
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(st.Atim.Nano()), unix.NsecToTimespec(st.Mtim.Nano())}
+	unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW)
+	return written, nil
+}
+
+// storeVramChanges makes state/changes hold exactly the changed entries of
+// root and writes state/deleted. Stored entries outside the compared trees
+// are kept.
+func storeVramChanges(root, state string, changes *vramChanges) (*VramSyncResult, error) {
+	result := &VramSyncResult{Deleted: len(changes.Deleted)}
+	changesDir := filepath.Join(state, "changes")
+	if err := os.MkdirAll(changesDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Everything changed plus the directories leading to it
+	keep := map[string]bool{}
+	for _, rel := range changes.Changed {
+		for p := rel; p != "." && !keep[p]; p = filepath.Dir(p) {
+			keep[p] = true
+		}
+	}
+
+	// Drop what is no longer different from the image
+	err := filepath.WalkDir(changesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(changesDir, path)
+		if rel == "." || keep[rel] || changes.aboveScope(rel) {
+			return nil
+		}
+		if !changes.inScope(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		result.Removed++
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string]bool{}
+	for _, rel := range changes.Changed {
+		changed[rel] = true
+	}
+	for _, rel := range changes.Changed {
+		// Parents that are unchanged themselves still need to exist
+		for _, dir := range vramParents(rel) {
+			if changed[dir] {
+				continue
+			}
+			dst := filepath.Join(changesDir, dir)
+			if _, err := os.Lstat(dst); err == nil {
+				continue
+			}
+			info, err := os.Lstat(filepath.Join(root, dir))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := copyVramEntry(filepath.Join(root, dir), dst, info); err != nil {
+				return nil, err
+			}
+		}
+
+		src, dst := filepath.Join(root, rel), filepath.Join(changesDir, rel)
+		info, err := os.Lstat(src)
+		if err != nil {
+			continue // removed since the comparison
+		}
+		if stored, err := os.Lstat(dst); err == nil && sameVramEntry(info, stored, src, dst) {
+			if !info.IsDir() {
+				continue
+			}
+		}
+		n, err := copyVramEntry(src, dst, info)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rel, err)
+		}
+		result.Files++
+		result.Bytes += n
+		vramSyncWritten.Add(n)
+	}
+
+	var list strings.Builder
+	if changes.Scope != nil || changes.Kept != nil {
+		if data, err := os.ReadFile(filepath.Join(state, "deleted")); err == nil {
+			for _, rel := range strings.Split(string(data), "\n") {
+				if rel != "" && !changes.inScope(rel) {
+					list.WriteString(rel + "\n")
+				}
+			}
+		}
+	}
+	for _, rel := range changes.Deleted {
+		list.WriteString(rel + "\n")
+	}
+	tmp := filepath.Join(state, "deleted.tmp")
+	if err := os.WriteFile(tmp, []byte(list.String()), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, filepath.Join(state, "deleted")); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// storeVramFile writes one file straight into the stored changes, for
+// settings that must reach the next boot even when their directory is not
+// in RAM
+func storeVramFile(rel string, data []byte, perm fs.FileMode) error {
+	backing, err := loadVramBacking()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockVram()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	disk, unmount, err := backing.mount()
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	path := filepath.Join(disk, vramStateSubdir, "changes", rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syscall.Sync()
+	return nil
+}
+
+// vramParents lists the directories above rel, outermost first
+func vramParents(rel string) []string {
+	var dirs []string
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// ============================================================================
+// Sync
+// ============================================================================
+
+// syncVram writes the changes of the running RAM root to the backing disk
+// and records the result
+func syncVram(dryRun bool, reason string) (*VramSyncResult, *vramChanges, error) {
+	start := time.Now()
+	if !dryRun {
+		logVramEvent(vramEventSyncStart, "%s sync started", reason)
+	}
+	result, changes, err := doSyncVram(dryRun)
+	if dryRun {
+		return result, changes, err
+	}
+	if result == nil {
+		result = &VramSyncResult{}
+	}
+	result.Time = start
+	result.Duration = time.Since(start).Round(time.Millisecond).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		recordVramEvent(VramEvent{
+			Kind:    vramEventFailure,
+			Message: fmt.Sprintf("%s sync failed: %v", reason, err),
+			Data:    map[string]interface{}{"reason": reason, "error": err.Error()},
+		})
+	} else {
+		recordVramEvent(VramEvent{
+			Kind: vramEventSync,
+			Message: fmt.Sprintf("%s sync: %d file(s), %s written, %d deleted in %.1fs",
+				reason, result.Files, formatSize(result.Bytes), result.Deleted, result.Duration),
+			Data: map[string]interface{}{
+				"reason": reason, "files": result.Files, "bytes": result.Bytes,
+				"deleted": result.Deleted, "duration": result.Duration,
+			},
+		})
+	}
+	saveVramSyncResult(result)
+	return result, changes, err
+}
+
+func doSyncVram(dryRun bool) (*VramSyncResult, *vramChanges, error) {
+	if os.Geteuid() != 0 {
+		return nil, nil, fmt.Errorf("VRAM sync must be run as root")
+	}
+	if !isVramActive() {
+		return nil, nil, fmt.Errorf("system is not running in VRAM mode")
+	}
+	if err := checkVramDiscarded(); err != nil {
+		return nil, nil, err
+	}
+	backing, err := loadVramBacking()
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock, err := lockVram()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	disk, unmount, err := backing.mount()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unmount()
+	lower, unmountImage, err := mountVramImage(filepath.Join(disk, backing.Image), "lower")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unmountImage()
+
+	// Evicted paths are gone from RAM only until the next boot, and
+	// excluded ones live on disk: keep what is stored for them
+	kept := append(evictedVramPaths(), vramDiskPaths()...)
+	changes, err := diffVramPaths("/", lower, loadedVramPaths(), func(rel string) bool {
+		return vramExcluded(rel) || underVramPaths(rel, kept)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to compare the RAM root: %w", err)
+	}
+	changes.Kept = kept
+	if dryRun {
+		return &VramSyncResult{Deleted: len(changes.Deleted)}, changes, nil
+	}
+
+	result, err := storeVramChanges("/", filepath.Join(disk, vramStateSubdir), changes)
+	if err != nil {
+		return nil, changes, fmt.Errorf("failed to write changes to %s: %w", backing.Device, err)
+	}
+	syscall.Sync()
+	return result, changes, nil
+}
+
+// saveVramSyncResult records r as the last sync and counts it in the
+// totals since boot
+func saveVramSyncResult(r *VramSyncResult) {
+	if prev := loadVramSyncResult(); prev != nil {
+		r.Syncs, r.Failures, r.LastSuccess = prev.Syncs, prev.Failures, prev.LastSuccess
+	}
+	r.Syncs++
+	if r.Error != "" {
+		r.Failures++
+	} else {
+		r.LastSuccess = r.Time
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(vramWorkDir, 0700)
+	os.WriteFile(vramSyncStatus, data, 0644)
+}
+
+// loadVramSyncResult returns the last sync since boot, nil if there was none
+func loadVramSyncResult() *VramSyncResult {
+	data, err := os.ReadFile(vramSyncStatus)
+	if err != nil {
+		return nil
+	}
+	var r VramSyncResult
+	if json.Unmarshal(data, &r) != nil {
+		return nil
+	}
+	return &r
+}
+
+func runVramSync(cmd *cobra.Command, args []string) error {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	if !dryRun {
+		fmt.Println("Syncing RAM root to disk...")
+	}
+	result, changes, err := syncVram(dryRun, "manual")
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		for _, rel := range changes.Changed {
+			fmt.Printf("  M /%s\n", rel)
+		}
+		for _, rel := range changes.Deleted {
+			fmt.Printf("  D /%s\n", rel)
+		}
+		fmt.Printf("\n%d changed and %d deleted path(s) differ from the image\n", len(changes.Changed), len(changes.Deleted))
+		return nil
+	}
+
+	fmt.Println("")
+	fmt.Println("\033[32m✓ VRAM sync complete\033[0m")
+	fmt.Printf("  Written:  %d file(s), %s\n", result.Files, formatSize(result.Bytes))
+	fmt.Printf("  Deleted:  %d path(s)\n", result.Deleted)
+	if result.Removed > 0 {
+		fmt.Printf("  Reverted: %d path(s) back to the image\n", result.Removed)
+	}
+	fmt.Printf("  Duration: %s\n", time.Duration(result.Duration*float64(time.Second)))
+	return nil
+}
@@ -0,0 +1,976 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestVramSync(t *testing.T) {
+	root, lower, state := t.TempDir(), t.TempDir(), t.TempDir()
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	write := func(dir, rel, content string) {
+		path := filepath.Join(dir, rel)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	for _, dir := range []string{root, lower} {
+		write(dir, "etc/hostname", "mixos\n")
+		write(dir, "etc/motd", "welcome\n")
+		write(dir, "usr/share/doc/README", "docs\n")
+		write(dir, "proc/version", "runtime\n")
+	}
+	write(root, "etc/hostname", "box01.lan\n")
+	write(root, "home/user/notes.txt", "hello\n")
+	write(root, "tmp/scratch", "gone on reboot\n")
+	os.Symlink("/usr/bin/vim", filepath.Join(root, "etc/editor"))
+	os.RemoveAll(filepath.Join(root, "usr/share/doc"))
+	os.Remove(filepath.Join(root, "proc/version"))
+
+	changes, err := diffVramRoot(root, lower, vramExcluded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"etc/hostname", "etc/editor", "home/user/notes.txt"} {
+		if !slices.Contains(changes.Changed, rel) {
+			t.Errorf("%s not reported as changed: %v", rel, changes.Changed)
+		}
+	}
+	for _, rel := range []string{"etc/motd", "tmp/scratch", "proc/version"} {
+		if slices.Contains(changes.Changed, rel) {
+			t.Errorf("%s reported as changed", rel)
+		}
+	}
+	if !slices.Equal(changes.Deleted, []string{"usr/share/doc"}) {
+		t.Errorf("deleted = %v, expected [usr/share/doc]", changes.Deleted)
+	}
+
+	result, err := storeVramChanges(root, state, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(state, "changes/etc/hostname")); string(data) != "box01.lan\n" {
+		t.Errorf("stored hostname = %q", data)
+	}
+	if target, _ := os.Readlink(filepath.Join(state, "changes/etc/editor")); target != "/usr/bin/vim" {
+		t.Errorf("stored editor link = %q", target)
+	}
+	if _, err := os.Stat(filepath.Join(state, "changes/etc/motd")); err == nil {
+		t.Error("unchanged etc/motd was stored")
+	}
+	if data, _ := os.ReadFile(filepath.Join(state, "deleted")); string(data) != "usr/share/doc\n" {
+		t.Errorf("deleted list = %q", data)
+	}
+	if result.Bytes == 0 {
+		t.Error("no bytes reported written")
+	}
+
+	// A second sync writes nothing new; reverting a file drops it
+	write(root, "etc/hostname", "mixos\n")
+	changes, _ = diffVramRoot(root, lower, vramExcluded)
+	result, err = storeVramChanges(root, state, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 {
+		t.Errorf("removed = %d, expected 1", result.Removed)
+	}
+	for _, rel := range changes.Changed {
+		if !strings.HasPrefix(rel, "home") && rel != "etc" && rel != "etc/editor" {
+			t.Errorf("unexpected change %s", rel)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(state, "changes/etc/hostname")); err == nil {
+		t.Error("reverted etc/hostname is still stored")
+	}
+	if _, err := os.Lstat(filepath.Join(state, "changes/etc/editor")); err != nil {
+		t.Error("etc/editor was dropped")
+	}
+}
+
+func TestVramAutosyncInterval(t *testing.T) {
+	tests := []struct {
+		interval string
+		expected time.Duration
+	}{
+		{"10m", 10 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"30s", vramAutosyncDefaultInterval}, // below the minimum
+		{"", vramAutosyncDefaultInterval},
+		{"often", vramAutosyncDefaultInterval},
+	}
+
+	for _, tt := range tests {
+		conf := &VramAutosync{Interval: tt.interval}
+		if got := conf.interval(); got != tt.expected {
+			t.Errorf("interval(%q) = %s, expected %s", tt.interval, got, tt.expected)
+		}
+	}
+}
+
+func TestVramAutosyncShutdown(t *testing.T) {
+	tests := []struct {
+		timeout  string
+		expected time.Duration
+	}{
+		{"10m", 10 * time.Minute},
+		{"45s", 45 * time.Second},
+		{"", vramShutdownDefaultTimeout},
+		{"-1m", vramShutdownDefaultTimeout},
+		{"later", vramShutdownDefaultTimeout},
+	}
+
+	for _, tt := range tests {
+		conf := &VramAutosync{ShutdownTimeout: tt.timeout}
+		if got := conf.shutdownTimeout(); got != tt.expected {
+			t.Errorf("shutdownTimeout(%q) = %s, expected %s", tt.timeout, got, tt.expected)
+		}
+	}
+
+	conf := &VramAutosync{ShutdownTimeout: "2m"}
+	if got := conf.describeShutdown(); got != "no sync" {
+		t.Errorf("describeShutdown() without on_shutdown = %q", got)
+	}
+	conf.OnShutdown = true
+	if got := conf.describeShutdown(); !strings.Contains(got, "2m0s") {
+		t.Errorf("describeShutdown() = %q, expected the timeout", got)
+	}
+	// rcK runs the hook before the daemon's own stop script
+	if filepath.Base(vramShutdownHook) >= filepath.Base(vramAutosyncStopRC) {
+		t.Errorf("%s sorts after %s", vramShutdownHook, vramAutosyncStopRC)
+	}
+}
+
+func TestVramPaths(t *testing.T) {
+	conf := "# loaded into RAM\n/usr\n  /opt/  # apps\n/\nrelative\n/usr\n"
+	if got := parseVramPaths(conf); !slices.Equal(got, []string{"/usr", "/opt"}) {
+		t.Errorf("parseVramPaths = %v, expected [/usr /opt]", got)
+	}
+
+	paths, err := addVramPath([]string{"/usr/lib", "/opt"}, "/usr")
+	if err != nil || !slices.Equal(paths, []string{"/opt", "/usr"}) {
+		t.Errorf("addVramPath(/usr) = %v, %v; expected [/opt /usr]", paths, err)
+	}
+	if _, err := addVramPath([]string{"/usr"}, "/usr/share"); err == nil {
+		t.Error("addVramPath accepted a directory already covered")
+	}
+}
+
+func TestVramSyncScope(t *testing.T) {
+	root, lower, state := t.TempDir(), t.TempDir(), t.TempDir()
+	for _, dir := range []string{root, lower} {
+		os.MkdirAll(filepath.Join(dir, "usr/bin"), 0755)
+		os.MkdirAll(filepath.Join(dir, "etc"), 0755)
+		os.WriteFile(filepath.Join(dir, "usr/bin/old"), []byte("old\n"), 0755)
+	}
+	os.WriteFile(filepath.Join(root, "usr/bin/tool"), []byte("tool\n"), 0755)
+	os.WriteFile(filepath.Join(root, "etc/ignored"), []byte("not in RAM\n"), 0644)
+	os.Remove(filepath.Join(root, "usr/bin/old"))
+
+	// Stored by an earlier full VRAM boot
+	os.MkdirAll(filepath.Join(state, "changes/etc/mixos"), 0755)
+	os.WriteFile(filepath.Join(state, "changes/etc/mixos/vram.conf"), []byte("/usr\n"), 0644)
+	os.WriteFile(filepath.Join(state, "deleted"), []byte("etc/motd\n"), 0644)
+
+	changes, err := diffVramPaths(root, lower, []string{"usr"}, vramExcluded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changes.Changed, []string{"usr/bin/tool"}) {
+		t.Errorf("changed = %v, expected [usr/bin/tool]", changes.Changed)
+	}
+	if !slices.Equal(changes.Deleted, []string{"usr/bin/old"}) {
+		t.Errorf("deleted = %v, expected [usr/bin/old]", changes.Deleted)
+	}
+
+	if _, err := storeVramChanges(root, state, changes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(state, "changes/etc/mixos/vram.conf")); err != nil {
+		t.Error("stored change outside the scope was dropped")
+	}
+	if data, _ := os.ReadFile(filepath.Join(state, "deleted")); string(data) != "etc/motd\nusr/bin/old\n" {
+		t.Errorf("deleted list = %q", data)
+	}
+}
+
+func TestVramConfig(t *testing.T) {
+	tests := []struct {
+		conf     string
+		expected string // describe(), or "error"
+	}{
+		{"", "none (unpacked into RAM)"},
+		{"compression = zstd\nlevel = 6\n/usr\n", "zstd level 6"},
+		{"compression = zstd\n", "zstd level 15"},
+		{"compression=lz4 # fast\n", "lz4"},
+		{"compression = none\n", "none (unpacked into RAM)"},
+		{"compression = zstd\nlevel = 23\n", "error"},
+		{"compression = lz4\nlevel = 3\n", "error"},
+		{"compression = brotli\n", "error"},
+		{"level = 6\n", "error"},
+		{"backend = zram\nzram_algorithm = lz4\n", "none (unpacked into RAM)"},
+		{"backend = zram\ncompression = zstd\n", "error"},
+		{"backend = zram\nzram_algorithm = brotli\n", "error"},
+		{"zram_algorithm = lz4\n", "error"},
+		{"backend = nvme\n", "error"},
+		{"size = 3G\n", "none (unpacked into RAM)"},
+		{"backend = zram\nsize = 1536\n", "none (unpacked into RAM)"},
+		{"compression = zstd\nsize = 2048\n", "error"},
+		{"size = lots\n", "error"},
+		{"exclude = /var/log\nexclude = /srv/db/\n/usr\n", "none (unpacked into RAM)"},
+		{"exclude = var/log\n", "error"},
+		{"exclude = /\n", "error"},
+		{"tmpfs_huge = within_size\ntmpfs_mpol = interleave:0-1,3\ntmpfs_mode = 1777\n", "none (unpacked into RAM)"},
+		{"tmpfs_mpol = prefer:1\n/usr\n", "none (unpacked into RAM)"},
+		{"tmpfs_huge = sometimes\n", "error"},
+		{"tmpfs_mpol = interleave:a\n", "error"},
+		{"tmpfs_mode = 0955\n", "error"},
+		{"tmpfs_mode = 17777\n", "error"},
+		{"backend = zram\ntmpfs_huge = always\n", "error"},
+		{"compression = zstd\ntmpfs_mpol = local\n", "error"},
+		{"tier_cache = /dev/nvme0n1p3\n/usr\n", "none (unpacked into RAM)"},
+		{"tier_cache = nvme0n1p3\n", "error"},
+		{"tier_cache = /dev/../etc/passwd\n", "error"},
+	}
+
+	for _, tt := range tests {
+		conf, err := parseVramConfig(tt.conf)
+		if tt.expected == "error" {
+			if err == nil {
+				t.Errorf("parseVramConfig(%q) succeeded, expected error", tt.conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseVramConfig(%q) failed: %v", tt.conf, err)
+			continue
+		}
+		if got := conf.describe(); got != tt.expected {
+			t.Errorf("parseVramConfig(%q) = %q, expected %q", tt.conf, got, tt.expected)
+		}
+		if again, err := parseVramConfig(conf.format()); err != nil || again.describe() != conf.describe() ||
+			again.describeBackend() != conf.describeBackend() || again.Size != conf.Size || !slices.Equal(again.Paths, conf.Paths) ||
+			!slices.Equal(again.Exclude, conf.Exclude) || again.tmpfsOptions() != conf.tmpfsOptions() ||
+			again.TierCache != conf.TierCache {
+			t.Errorf("%q does not survive format()", tt.conf)
+		}
+	}
+}
+
+func TestZramStats(t *testing.T) {
+	stats, err := parseZramMMStat("  314572800 104857600 110100480        0 110100480     1024        0        0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Original != 314572800 || stats.Compressed != 104857600 || stats.MemUsed != 110100480 {
+		t.Errorf("parsed %+v", stats)
+	}
+	if stats.ratio() != 3 {
+		t.Errorf("ratio = %.2f, expected 3", stats.ratio())
+	}
+	if _, err := parseZramMMStat("12 x 3"); err == nil {
+		t.Error("parseZramMMStat accepted a malformed line")
+	}
+
+	if got := selectedZramAlgorithm("lzo lzo-rle lz4 lz4hc [zstd] 842\n"); got != "zstd" {
+		t.Errorf("selectedZramAlgorithm = %q, expected zstd", got)
+	}
+}
+
+func TestVramDirty(t *testing.T) {
+	root := t.TempDir()
+	for _, rel := range []string{"usr/bin/tool", "etc/hostname", "tmp/scratch"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(root, rel), []byte("1234"), 0644)
+	}
+
+	since := time.Now().Add(-time.Hour)
+	files, bytes := vramDirty(root, []string{"usr"}, since)
+	if files != 3 || bytes != 4 { // usr, usr/bin, usr/bin/tool
+		t.Errorf("dirty in usr = %d files, %d bytes; expected 3, 4", files, bytes)
+	}
+	if files, bytes = vramDirty(root, nil, since); bytes != 8 {
+		t.Errorf("dirty bytes = %d, expected 8 (tmp is not synced)", bytes)
+	}
+	if files, _ = vramDirty(root, nil, time.Now().Add(time.Hour)); files != 0 {
+		t.Errorf("%d files dirty after a later sync", files)
+	}
+}
+
+func TestVramResize(t *testing.T) {
+	tests := []struct {
+		target    vramResizeTarget
+		size      int64
+		available int64
+		ok        bool
+	}{
+		{vramResizeTarget{SizeMB: 2048, UsedMB: 1200}, 3072, 4096, true},
+		{vramResizeTarget{SizeMB: 2048, UsedMB: 1200}, 3072, 1000, false}, // not enough memory to grow
+		{vramResizeTarget{SizeMB: 2048, UsedMB: 1200}, 1536, 0, true},     // shrinking needs no memory
+		{vramResizeTarget{SizeMB: 2048, UsedMB: 1200}, 1400, 4096, false}, // no room above the data
+		{vramResizeTarget{UsedMB: 800}, 1536, 1024, true},                 // zram without a limit
+	}
+
+	for _, tt := range tests {
+		err := checkVramResize(&tt.target, tt.size, tt.available)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkVramResize(%+v, %d, %d) = %v, expected ok=%v", tt.target, tt.size, tt.available, err, tt.ok)
+		}
+	}
+}
+
+func TestVramBenchmark(t *testing.T) {
+	dir := t.TempDir()
+	for _, sync := range []bool{false, true} {
+		result, err := vramBenchmark(dir, 2, sync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.SeqWrite <= 0 || result.SeqRead <= 0 || result.RandWrite <= 0 || result.RandRead <= 0 {
+			t.Errorf("sync=%v: %+v", sync, result)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("test file left behind: %v", entries)
+	}
+}
+
+func TestVramPressure(t *testing.T) {
+	conf := &VramPressure{WarnMB: 512, CriticalMB: 256, WarnPSI: 20, CriticalPSI: 10}
+	tests := []struct {
+		available  int64
+		some, full float64
+		expected   int
+	}{
+		{2048, 0, 0, vramPressureOK},
+		{400, 0, 0, vramPressureWarning},
+		{2048, 25, 2, vramPressureWarning},
+		{200, 0, 0, vramPressureCritical},
+		{2048, 40, 12, vramPressureCritical},
+	}
+	for _, tt := range tests {
+		if got := conf.level(tt.available, tt.some, tt.full); got != tt.expected {
+			t.Errorf("level(%d, %.0f, %.0f) = %s, expected %s", tt.available, tt.some, tt.full,
+				vramPressureLevels[got], vramPressureLevels[tt.expected])
+		}
+	}
+
+	some, full, err := parseVramPSI("some avg10=1.52 avg60=0.40 avg300=0.08 total=123456\n" +
+		"full avg10=0.31 avg60=0.07 avg300=0.01 total=23456\n")
+	if err != nil || some != 1.52 || full != 0.31 {
+		t.Errorf("parseVramPSI = %v, %v, %v", some, full, err)
+	}
+	if _, _, err := parseVramPSI(""); err == nil {
+		t.Error("parseVramPSI accepted empty input")
+	}
+}
+
+func TestVramBalloon(t *testing.T) {
+	vmstat := "nr_free_pages 12345\nballoon_inflate 262144\nballoon_deflate 131072\nballoon_migrate 7\n"
+	if got, ok := parseVramBalloon(vmstat, 4096); !ok || got != 512<<20 {
+		t.Errorf("parseVramBalloon = %d, %v, expected %d", got, ok, 512<<20)
+	}
+	if _, ok := parseVramBalloon("nr_free_pages 12345\n", 4096); ok {
+		t.Error("parseVramBalloon found a balloon in a kernel without one")
+	}
+
+	target := &vramResizeTarget{Mount: "/", SizeMB: 4096, UsedMB: 1024}
+	tests := []struct {
+		taken, expected int64
+	}{
+		{512, 3584},
+		{3000, 1024 + vramResizeReserveMB},
+		{8192, 1024 + vramResizeReserveMB},
+	}
+	for _, tt := range tests {
+		if got := vramBalloonShrink(target, tt.taken); got != tt.expected {
+			t.Errorf("vramBalloonShrink(%d) = %d, expected %d", tt.taken, got, tt.expected)
+		}
+	}
+}
+
+func TestVramSyncKept(t *testing.T) {
+	root, lower, state := t.TempDir(), t.TempDir(), t.TempDir()
+	for _, dir := range []string{root, lower} {
+		os.MkdirAll(filepath.Join(dir, "var/cache/mix"), 0755)
+		os.WriteFile(filepath.Join(dir, "var/cache/mix/index"), []byte("index\n"), 0644)
+	}
+	// Stored before var/cache was evicted, and emptied since
+	os.MkdirAll(filepath.Join(state, "changes/var/cache/mix"), 0755)
+	os.WriteFile(filepath.Join(state, "changes/var/cache/mix/pkg"), []byte("pkg\n"), 0644)
+	os.Remove(filepath.Join(root, "var/cache/mix/index"))
+
+	kept := []string{"var/cache"}
+	changes, err := diffVramRoot(root, lower, func(rel string) bool {
+		return vramExcluded(rel) || underVramPaths(rel, kept)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes.Kept = kept
+	if len(changes.Deleted) != 0 {
+		t.Errorf("evicted entries reported deleted: %v", changes.Deleted)
+	}
+	if _, err := storeVramChanges(root, state, changes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(state, "changes/var/cache/mix/pkg")); err != nil {
+		t.Error("stored change below an evicted path was dropped")
+	}
+}
+
+func TestVramBootEntries(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel, content string) {
+		path := filepath.Join(root, rel)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(content), 0644)
+	}
+	write("boot/grub/grub.cfg", `set timeout=5
+set default=0
+
+menuentry "MixOS-GO (Installer)" {
+    linux /boot/vmlinuz console=ttyS0 quiet mixos.mode=installer
+    initrd /boot/initramfs.img
+}
+
+menuentry "MixOS-GO (Standard)" {
+    linux /boot/vmlinuz console=ttyS0 VRAM=1 quiet
+    initrd /boot/initramfs.img
+}
+`)
+	write("boot/syslinux/syslinux.cfg", "DEFAULT mixos\nLABEL rescue\n  KERNEL /vmlinuz\n  APPEND single\nLABEL mixos\n  MENU LABEL MixOS-GO\n  KERNEL /vmlinuz\n")
+	write("boot/loader/loader.conf", "default mixos*\n")
+	write("boot/loader/entries/mixos.conf", "title MixOS-GO\nlinux /vmlinuz\noptions root=/dev/vda quiet\n")
+	write("boot/loader/entries/other.conf", "title Other\nlinux /vmlinuz-other\noptions quiet\n")
+
+	expected := map[string]string{
+		"boot/grub/grub.cfg":             "    linux /boot/vmlinuz console=ttyS0 quiet VRAM=auto",
+		"boot/syslinux/syslinux.cfg":     "  APPEND VRAM=auto",
+		"boot/loader/entries/mixos.conf": "options root=/dev/vda quiet VRAM=auto",
+	}
+	for _, param := range []string{vramBootParam, vramBootParam, "VRAM=2G", ""} {
+		report, err := editVramBootEntries([]string{root}, param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report) != 3 {
+			t.Errorf("param=%q: %d entries edited, expected 3: %v", param, len(report), report)
+		}
+		for rel, line := range expected {
+			data, _ := os.ReadFile(filepath.Join(root, rel))
+			if param != "" {
+				line = strings.Replace(line, vramBootParam, param, 1)
+			}
+			if strings.Contains(string(data), line) != (param != "") {
+				t.Errorf("param=%q: %s:\n%s", param, rel, data)
+			}
+			if strings.Count(string(data), "VRAM=") != min(1, len(param)) {
+				t.Errorf("param=%q: %s kept another VRAM=:\n%s", param, rel, data)
+			}
+			if _, err := os.Stat(filepath.Join(root, rel) + vramBootBackup); err != nil {
+				t.Errorf("no backup of %s", rel)
+			}
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "boot/grub/grub.cfg")); !strings.Contains(string(data), "quiet mixos.mode=installer\n") {
+		t.Errorf("installer entry was edited:\n%s", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "boot/loader/entries/other.conf")); strings.Contains(string(data), "VRAM") {
+		t.Error("non-MixOS entry was edited")
+	}
+}
+
+func TestVramPersist(t *testing.T) {
+	if got := unescapeMountPath(`/mnt/my\040disk`); got != "/mnt/my disk" {
+		t.Errorf("unescapeMountPath = %q", got)
+	}
+
+	excludes := vramPersistExcludes([]string{"proc", "sys/fs/cgroup", "boot", "usr", "home"}, []string{"usr"})
+	for _, dir := range []string{"proc", "tmp", "boot", "home"} {
+		if !slices.Contains(excludes, dir) {
+			t.Errorf("%s not excluded: %v", dir, excludes)
+		}
+	}
+	for _, dir := range []string{"usr", "sys/fs/cgroup"} {
+		if slices.Contains(excludes, dir) {
+			t.Errorf("%s excluded: %v", dir, excludes)
+		}
+	}
+	args := persistMksquashfsArgs("zstd", []string{"proc"})
+	if !slices.Contains(args, "proc/*") || !slices.Contains(args, "-wildcards") {
+		t.Errorf("mksquashfs args %v", args)
+	}
+
+	state := t.TempDir()
+	for _, rel := range []string{"changes/usr/bin/tool", "changes/etc/mixos/vram.conf"} {
+		os.MkdirAll(filepath.Join(state, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(state, rel), []byte("x\n"), 0644)
+	}
+	os.WriteFile(filepath.Join(state, "deleted"), []byte("usr/bin/old\netc/motd\n"), 0644)
+	if err := clearVramChanges(state, []string{"usr"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(state, "changes/usr")); err == nil {
+		t.Error("changes in the persisted scope were kept")
+	}
+	if _, err := os.Stat(filepath.Join(state, "changes/etc/mixos/vram.conf")); err != nil {
+		t.Error("changes outside the persisted scope were dropped")
+	}
+	if data, _ := os.ReadFile(filepath.Join(state, "deleted")); string(data) != "etc/motd\n" {
+		t.Errorf("deleted list = %q", data)
+	}
+	if err := clearVramChanges(state, nil); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(state); len(entries) != 0 {
+		t.Errorf("state not cleared: %v", entries)
+	}
+}
+
+func TestVramVerify(t *testing.T) {
+	root := t.TempDir()
+	for _, rel := range []string{"etc/hostname", "usr/bin/tool", "usr/lib/libx.so", "tmp/scratch"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(root, rel), []byte(rel+"\n"), 0644)
+	}
+	if err := writeVramManifest(root); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(root, vramManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseVramManifest(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("manifest has %d entries, expected 3 (tmp is runtime state): %v", len(entries), entries)
+	}
+
+	os.WriteFile(filepath.Join(root, "usr/bin/tool"), []byte("tampered\n"), 0644)
+	os.Remove(filepath.Join(root, "usr/lib/libx.so"))
+	modified, missing, checked := verifyVramRoot(root, entries, vramExcluded)
+	if checked != 3 || !slices.Equal(modified, []string{"usr/bin/tool"}) || !slices.Equal(missing, []string{"usr/lib/libx.so"}) {
+		t.Errorf("verify = modified %v, missing %v, %d checked", modified, missing, checked)
+	}
+
+	if _, err := parseVramManifest(strings.NewReader("abc  ./etc/hostname\n")); err == nil {
+		t.Error("parseVramManifest accepted a short hash")
+	}
+}
+
+func TestVramMetrics(t *testing.T) {
+	last := time.Unix(1700000000, 0)
+	stats := &VramStats{Active: true, Mode: "full", Size: 4 << 30, Used: 1 << 30, DirtyBytes: 4096, DirtyFiles: 2}
+	sync := &VramSyncResult{Time: last.Add(time.Minute), Error: "disk full", Syncs: 5, Failures: 1, LastSuccess: last}
+
+	out := formatVramMetrics(stats, sync)
+	for _, line := range []string{
+		"vram_active 1",
+		`vram_info{mode="full"} 1`,
+		"vram_bytes_total 4294967296",
+		"vram_bytes_used 1073741824",
+		"vram_dirty_bytes 4096",
+		"vram_last_sync_timestamp_seconds 1700000000",
+		"# TYPE vram_sync_failures_total counter",
+		"vram_sync_failures_total 1",
+		"vram_syncs_total 5",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "vram_zram") {
+		t.Error("zram metrics reported without a zram device")
+	}
+
+	out = formatVramMetrics(&VramStats{}, nil)
+	if !strings.Contains(out, "vram_active 0\n") || !strings.Contains(out, "vram_last_sync_timestamp_seconds 0\n") {
+		t.Errorf("inactive metrics:\n%s", out)
+	}
+}
+
+func TestVramLargestDirs(t *testing.T) {
+	root := t.TempDir()
+	for rel, size := range map[string]int{
+		"usr/lib/big":   256 << 10,
+		"usr/bin/tool":  64 << 10,
+		"var/log/x.log": 128 << 10,
+		"opt/small":     4 << 10,
+		"tmp/ignored":   512 << 10,
+	} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(root, rel), make([]byte, size), 0644)
+	}
+	os.WriteFile(filepath.Join(root, "file-at-root"), make([]byte, 1<<20), 0644)
+
+	var got []string
+	for _, d := range largestVramDirs(root, nil, 2) {
+		got = append(got, d.Path)
+	}
+	if !slices.Equal(got, []string{"usr", "var"}) {
+		t.Errorf("largest dirs = %v, expected [usr var]", got)
+	}
+
+	got = nil
+	for _, d := range largestVramDirs(root, []string{"usr"}, 10) {
+		got = append(got, d.Path)
+	}
+	if !slices.Equal(got, []string{"usr/lib", "usr/bin"}) {
+		t.Errorf("largest dirs in selective mode = %v, expected [usr/lib usr/bin]", got)
+	}
+}
+
+func TestVramHibernateExcludes(t *testing.T) {
+	excludes := vramHibernateExcludes([]string{"proc", "tmp", "home"}, nil)
+	for _, dir := range []string{"proc", "run", "home"} {
+		if !slices.Contains(excludes, dir) {
+			t.Errorf("%s not excluded: %v", dir, excludes)
+		}
+	}
+	for _, dir := range []string{"tmp", "var/tmp"} {
+		if slices.Contains(excludes, dir) {
+			t.Errorf("%s excluded from the hibernated root: %v", dir, excludes)
+		}
+	}
+}
+
+func TestVramOverlayList(t *testing.T) {
+	upper, lower := t.TempDir(), t.TempDir()
+	for _, rel := range []string{"etc/hostname", "etc/motd", "usr/share/doc/a/README"} {
+		os.MkdirAll(filepath.Join(lower, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(lower, rel), []byte("lower\n"), 0644)
+	}
+	for rel, content := range map[string]string{
+		"etc/hostname":     "changed\n",
+		"etc/new.conf":     "new\n",
+		"opt/app/bin/app":  "binary",
+		"opt/app/lib/x.so": "library",
+	} {
+		os.MkdirAll(filepath.Join(upper, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(upper, rel), []byte(content), 0644)
+	}
+	want := []string{"A etc/new.conf", "M etc/hostname", "A opt"}
+
+	// Whiteouts and opaque directories take root
+	if syscall.Mknod(filepath.Join(upper, "etc/motd"), syscall.S_IFCHR, 0) == nil {
+		want = append(want, "D etc/motd")
+	}
+	os.MkdirAll(filepath.Join(upper, "usr/share/doc"), 0755)
+	if syscall.Setxattr(filepath.Join(upper, "usr/share/doc"), vramOverlayOpaque, []byte("y"), 0) == nil {
+		want = append(want, "R usr/share/doc")
+	}
+
+	changes, err := listVramOverlay(upper, lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, fmt.Sprintf("%c %s", c.Kind, c.Path))
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("overlay changes = %v, expected %v", got, want)
+	}
+	for _, c := range changes {
+		if c.Path == "opt" && c.Bytes != int64(len("binary")+len("library")) {
+			t.Errorf("new directory counted as %d bytes", c.Bytes)
+		}
+	}
+}
+
+func TestVramExclude(t *testing.T) {
+	conf, err := parseVramConfig("exclude = /var/log\nexclude = /srv/db/\n/usr\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(conf.Exclude, []string{"/var/log", "/srv/db"}) || !slices.Equal(conf.Paths, []string{"/usr"}) {
+		t.Errorf("exclude = %v, paths = %v", conf.Exclude, conf.Paths)
+	}
+
+	excludes, err := addVramExclude(conf.Exclude, "/var/lib/postgres")
+	if err != nil || len(excludes) != 3 {
+		t.Errorf("addVramExclude = %v, %v", excludes, err)
+	}
+	for _, p := range []string{"/var/log", "/var/log/nginx", "/srv"} {
+		if _, err := addVramExclude(conf.Exclude, p); err == nil {
+			t.Errorf("addVramExclude accepted %s next to %v", p, conf.Exclude)
+		}
+	}
+}
+
+func TestVramStatusCode(t *testing.T) {
+	tests := []struct {
+		stats    VramStats
+		expected int
+	}{
+		{VramStats{Active: true, Capable: true}, 0},
+		{VramStats{Active: true}, 0}, // booted into VRAM on a machine that reads as too small
+		{VramStats{Capable: true}, 1},
+		{VramStats{}, 2},
+	}
+	for _, tt := range tests {
+		if got := vramStatusCode(&tt.stats); got != tt.expected {
+			t.Errorf("vramStatusCode(active %v, capable %v) = %d, expected %d", tt.stats.Active, tt.stats.Capable, got, tt.expected)
+		}
+	}
+}
+
+func TestVramPrecacheUnits(t *testing.T) {
+	root := t.TempDir()
+	for _, rel := range []string{
+		"usr/lib/firefox/firefox", "usr/lib/firefox/libxul.so", "usr/lib/firefox/browser/omni.ja",
+		"usr/bin/firefox-bin", "usr/bin/ls", "usr/share/icons/firefox.png", "usr/share/icons/other.png",
+	} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(root, rel), []byte(rel), 0644)
+	}
+	os.Symlink("../lib/firefox/firefox", filepath.Join(root, "usr/bin/firefox"))
+
+	files := []string{
+		"/usr/lib/firefox/firefox", "/usr/lib/firefox/libxul.so", "/usr/lib/firefox/browser/omni.ja",
+		"/usr/bin/firefox", "/usr/bin/firefox-bin", "/usr/share/icons/firefox.png",
+	}
+	units := precacheUnits(root, files)
+	want := []string{"/usr/bin/firefox-bin", "/usr/lib/firefox", "/usr/share/icons/firefox.png"}
+	if !slices.Equal(units, want) {
+		t.Errorf("precacheUnits = %v, expected %v", units, want)
+	}
+}
+
+func TestVramBudget(t *testing.T) {
+	for mb, param := range map[int64]string{2048: "VRAM=2G", 1536: "VRAM=1536M", 1024: "VRAM=1G"} {
+		if got := vramBudgetParam(mb); got != param {
+			t.Errorf("vramBudgetParam(%d) = %q, expected %q", mb, got, param)
+		}
+	}
+	if err := checkVramBudget(2048, 4096); err != nil {
+		t.Error(err)
+	}
+	if err := checkVramBudget(2048, 2048); err == nil {
+		t.Error("a budget of all the RAM was accepted")
+	}
+
+	skipped := parseVramSkipped("/usr/share 1200\n/opt 40\n\ngarbage\n/bad x\n")
+	expected := []VramSkippedPath{{"/usr/share", 1200 << 20}, {"/opt", 40 << 20}}
+	if !slices.Equal(skipped, expected) {
+		t.Errorf("skipped %v, expected %v", skipped, expected)
+	}
+
+	root := t.TempDir()
+	if p := vramHotsetPath(root); p != "" {
+		t.Errorf("hotset %q without any list", p)
+	}
+	write := func(rel, content string) {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(root, rel), []byte(content), 0644)
+	}
+	write("usr/share/mixos/vram-hotset/default", "/usr/bin\n")
+	write("usr/share/mixos/vram-hotset/server", "/usr/bin\n/var/lib\n")
+	write("etc/mixos/profile", "desktop\n")
+	if p := vramHotsetPath(root); p != vramHotsetDir+"/default" {
+		t.Errorf("hotset %q, expected the default list for a profile without one", p)
+	}
+	write("etc/mixos/profile", "server\n")
+	if p := vramHotsetPath(root); p != vramHotsetDir+"/server" {
+		t.Errorf("hotset %q, expected the server list", p)
+	}
+	write("etc/mixos/vram-hotset", "/opt\n")
+	if p := vramHotsetPath(root); p != vramHotsetConfig {
+		t.Errorf("hotset %q, expected %s to take precedence", p, vramHotsetConfig)
+	}
+}
+
+func TestVramTuneRecommend(t *testing.T) {
+	tests := []struct {
+		hw               vramHardware
+		huge, mpol, mode string
+	}{
+		{vramHardware{Nodes: 1, MemTotalMB: 16384, ShmemHuge: true}, "within_size", "", "0755"},
+		{vramHardware{Nodes: 2, MemTotalMB: 65536, ShmemHuge: true}, "within_size", "interleave", "0755"},
+		{vramHardware{Nodes: 1, MemTotalMB: 2048, ShmemHuge: true}, "never", "", "0755"},
+		{vramHardware{Nodes: 4, MemTotalMB: 32768, ShmemHuge: false}, "", "interleave", "0755"},
+	}
+	for _, tt := range tests {
+		huge, mpol, mode, reasons := recommendVramTune(tt.hw)
+		if huge != tt.huge || mpol != tt.mpol || mode != tt.mode {
+			t.Errorf("%+v: recommended %q %q %q, expected %q %q %q", tt.hw, huge, mpol, mode, tt.huge, tt.mpol, tt.mode)
+		}
+		if len(reasons) != 3 {
+			t.Errorf("%+v: %d reasons, expected one per option", tt.hw, len(reasons))
+		}
+		conf := &vramConfig{TmpfsHuge: huge, TmpfsMpol: mpol, TmpfsMode: mode}
+		if err := conf.validate(); err != nil {
+			t.Errorf("%+v: recommendation is invalid: %v", tt.hw, err)
+		}
+	}
+}
+
+func TestVramCompact(t *testing.T) {
+	buddy := `Node 0, zone      DMA      1      1      1      0      2      1      1      0      1      1      3
+Node 0, zone    DMA32      3      5      4      6      5      4      6      4      4      4    200
+Node 0, zone   Normal    100     50     20     10      5      2      1      0      0      7      2
+`
+	// order 9 counts once, order 10 twice
+	if blocks := parseBuddyInfo(buddy, vramHugeOrder); blocks != (1+3*2)+(4+200*2)+(7+2*2) {
+		t.Errorf("parsed %d free 2MB blocks", blocks)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "held")
+	if err := os.WriteFile(path, make([]byte, 64<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Remove(path)
+	os.WriteFile(filepath.Join(dir, "kept"), []byte("x"), 0644)
+
+	held := heldVramFiles("/proc", []string{dir})
+	found := false
+	for _, h := range held {
+		if h.PID == os.Getpid() && h.Path == path {
+			found = true
+			if h.Bytes < 64<<10 {
+				t.Errorf("held file takes %d bytes, expected at least 64KB", h.Bytes)
+			}
+		}
+		if strings.HasSuffix(h.Path, "/kept") {
+			t.Error("a file that was not deleted is listed")
+		}
+	}
+	if !found {
+		t.Errorf("the deleted file held open is not listed: %+v", held)
+	}
+}
+
+func TestVramTier(t *testing.T) {
+	// 1GB: 4MB of metadata plus 64KB per GB, then whole 256KB blocks
+	meta, data := vramTierLayout(2 << 20)
+	if meta != 8320 || data != 4079*vramTierBlockSectors {
+		t.Errorf("vramTierLayout(1GB) = %d, %d", meta, data)
+	}
+	if _, data := vramTierLayout(8000); data != 0 {
+		t.Errorf("a partition too small for the metadata has %d sectors of cache", data)
+	}
+
+	stats, err := parseVramTierStatus("0 41943040 cache 8 1234/4096 512 100/20000 300 100 30 40 0 100 0 1 writethrough 2 migration_threshold 2048 smq 0 rw -\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stats != (vramTierStats{BlockBytes: 256 << 10, Used: 100, Total: 20000, ReadHits: 300, ReadMisses: 100}) {
+		t.Errorf("parsed %+v", *stats)
+	}
+	if _, err := parseVramTierStatus("0 41943040 linear 8:1 0"); err == nil {
+		t.Error("a linear target parsed as a cache")
+	}
+
+	// nvme0n1 is an SSD with a 40GB partition; sda holds the VISO disk
+	// sda1, and sda2 is a small partition of it
+	sys := t.TempDir()
+	devices := map[string]string{
+		"nvme0n1":           "83886080",
+		"nvme0n1/nvme0n1p3": "83886080",
+		"sda":               "20971520",
+		"sda/sda1":          "16777216",
+		"sda/sda2":          "1048576",
+	}
+	os.MkdirAll(filepath.Join(sys, "class/block"), 0755)
+	for dev, size := range devices {
+		dir := filepath.Join(sys, "devices", dev)
+		os.MkdirAll(filepath.Join(dir, "holders"), 0755)
+		os.WriteFile(filepath.Join(dir, "size"), []byte(size+"\n"), 0644)
+		if strings.Contains(dev, "/") {
+			os.WriteFile(filepath.Join(dir, "partition"), []byte("1\n"), 0644)
+		} else {
+			os.MkdirAll(filepath.Join(dir, "queue"), 0755)
+			os.WriteFile(filepath.Join(dir, "queue/rotational"), []byte("0\n"), 0644)
+		}
+		os.Symlink(dir, filepath.Join(sys, "class/block", filepath.Base(dev)))
+	}
+	os.WriteFile(filepath.Join(sys, "devices/sda/queue/rotational"), []byte("1\n"), 0644)
+
+	size, rotational, err := vramTierPartition(sys, "nvme0n1p3", "sda1")
+	if err != nil || size != 40<<30 || rotational {
+		t.Errorf("nvme0n1p3 = %d, %v, %v", size, rotational, err)
+	}
+	for _, name := range []string{"nvme0n1", "sda", "sda1", "sda2", "sdb"} {
+		if _, _, err := vramTierPartition(sys, name, "sda1"); err == nil {
+			t.Errorf("%s accepted as the cache", name)
+		}
+	}
+	os.WriteFile(filepath.Join(sys, "devices/sda/sda2/size"), []byte("4194304\n"), 0644)
+	if _, rotational, err := vramTierPartition(sys, "sda2", "sda1"); err != nil || !rotational {
+		t.Errorf("sda2 = %v, %v, expected a rotational partition", rotational, err)
+	}
+	os.MkdirAll(filepath.Join(sys, "devices/nvme0n1/nvme0n1p3/holders/dm-0"), 0755)
+	if _, _, err := vramTierPartition(sys, "nvme0n1p3", "sda1"); err == nil {
+		t.Error("a partition in use accepted as the cache")
+	}
+}
+
+func TestVramEvents(t *testing.T) {
+	log := `2026-01-05T10:00:00Z periodic sync: 3 file(s), 12 KB written, 0 deleted in 0.1s
+Not running in VRAM mode; autosync not needed
+{"time":"2026-01-06T08:00:00Z","kind":"activate","message":"VRAM active: tmpfs","data":{"boot_id":"b1","mode":"tmpfs"}}
+{"time":"2026-01-06T09:00:00Z","kind":"sync-start","message":"periodic sync started"}
+{"time":"2026-01-06T09:00:01Z","kind":"sync","message":"periodic sync: 1 file(s)","data":{"files":1,"bytes":4096}}
+{"time":"2026-01-06T10:00:00Z","kind":"failure","message":"emergency sync failed"}
+{"kind":"sync","message":"no time"}
+{"time":"2026-01-06T11:00:00Z","kind":"pressure","message":"truncated
+`
+	events := parseVramEvents(log)
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+	if !slices.Equal(kinds, []string{"", vramEventActivate, vramEventSyncStart, vramEventSync, vramEventFailure}) {
+		t.Fatalf("parsed kinds %q", kinds)
+	}
+	if events[0].Message != "periodic sync: 3 file(s), 12 KB written, 0 deleted in 0.1s" {
+		t.Errorf("legacy line parsed as %q", events[0].Message)
+	}
+	if events[3].Data["bytes"] != float64(4096) {
+		t.Errorf("sync data = %v", events[3].Data)
+	}
+
+	since := time.Date(2026, 1, 6, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		kinds    []string
+		since    time.Time
+		limit    int
+		expected int
+	}{
+		{nil, time.Time{}, 0, 5},
+		{nil, time.Time{}, 2, 2},
+		{[]string{vramEventSync, vramEventFailure}, time.Time{}, 0, 2},
+		{nil, since, 0, 3},
+		{[]string{vramEventActivate}, since, 0, 0},
+	}
+	for _, tt := range tests {
+		got := filterVramEvents(events, tt.kinds, tt.since, tt.limit)
+		if len(got) != tt.expected {
+			t.Errorf("filterVramEvents(%v, %v, %d) kept %d, expected %d", tt.kinds, tt.since, tt.limit, len(got), tt.expected)
+		}
+	}
+	if last := filterVramEvents(events, nil, time.Time{}, 1); last[0].Kind != vramEventFailure {
+		t.Errorf("the limit kept %q instead of the newest event", last[0].Kind)
+	}
+}
@@ -0,0 +1,378 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// Tiered VRAM
+// ============================================================================
+//
+// Machines with modest RAM but a fast SSD keep the hottest directories in
+// RAM, as VRAM=<size> or selective VRAM do, and read the rest of the root
+// through a cache on the SSD rather than from the VISO disk. "mix vram
+// tier enable" marks a partition as the cache and names it in vram.conf
+// as tier_cache. On boots that leave part of the root on disk the
+// initramfs then puts a dm-cache in front of the VISO disk, laid out on
+// the partition as:
+//
+//	sectors 0-7  the marker written by "mix vram tier enable"
+//	then         dm-cache metadata: 4MB plus 16 bytes per cache block
+//	then         cache blocks of 256KB
+//
+// The cache is writethrough and starts empty on every boot, so the disk
+// always holds every write and no cached block goes stale when the disk
+// is written without the cache. A partition without the marker, such as
+// another disk that took its name, is never touched. The initramfs
+// records "<cache> <disk>" in /run/initramfs/vram-tier.
+
+const (
+	vramTierFile   = "/run/initramfs/vram-tier"
+	vramTierTarget = "vram-tier" // the dm-cache device, /dev/mapper/vram-tier
+	vramTierMarker = "MIXOS-VRAM-TIER\n"
+
+	vramTierMarkerSectors = 8
+	vramTierBlockSectors  = 512     // 256KB cache blocks
+	vramTierMinBytes      = 1 << 30 // smaller caches are not worth it
+)
+
+// vramTierStats is the state of the dm-cache, from "dmsetup status"
+type vramTierStats struct {
+	BlockBytes int64
+	Used       int64 // cache blocks
+	Total      int64
+	ReadHits   int64
+	ReadMisses int64
+}
+
+var vramTierCmd = &cobra.Command{
+	Use:   "tier",
+	Short: "Cache what stays on disk on a fast SSD",
+	Long: `Show or change the SSD cache of tiered VRAM.
+
+Tiered VRAM keeps the hottest directories in RAM, those of a VRAM=<size>
+boot or of "mix vram paths", and reads the rest of the root through a
+cache on an SSD partition instead of from the VISO disk. It suits
+machines with modest RAM and a fast NVMe drive.
+
+"enable" erases the partition and makes it the cache; --ram also sets
+the size loaded into RAM, as "mix vram enable --budget" does. The cache
+is writethrough and starts empty at each boot, so the disk always holds
+every write and the partition can be dropped at any time.
+
+Examples:
+  mix vram tier enable /dev/nvme0n1p3 --ram 2G
+  mix vram tier
+  mix vram tier disable`,
+	RunE: runVramTierStatus,
+}
+
+var vramTierEnableCmd = &cobra.Command{
+	Use:   "enable <partition>",
+	Short: "Make an SSD partition the cache of the VISO disk",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runVramTierEnable,
+}
+
+var vramTierDisableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Stop caching the VISO disk from the next boot",
+	RunE:  runVramTierDisable,
+}
+
+func init() {
+	vramCmd.AddCommand(vramTierCmd)
+	vramTierCmd.AddCommand(vramTierEnableCmd)
+	vramTierCmd.AddCommand(vramTierDisableCmd)
+	vramTierEnableCmd.Flags().String("ram", "", "also boot with this much of the root in RAM (e.g. 2G)")
+	vramTierEnableCmd.Flags().BoolP("yes", "y", false, "do not ask for confirmation")
+}
+
+// vramTierLayout splits a cache partition of sectors into metadata and
+// cache blocks, in sectors, as the initramfs does
+func vramTierLayout(sectors int64) (meta, data int64) {
+	meta = (8192 + sectors/16384 + 7) / 8 * 8
+	data = (sectors - vramTierMarkerSectors - meta) / vramTierBlockSectors * vramTierBlockSectors
+	return meta, max(0, data)
+}
+
+// parseVramTierStatus reads the "dmsetup status" line of a cache target:
+// <start> <length> cache <metadata block size> <used>/<total metadata
+// blocks> <cache block size> <used>/<total cache blocks> <read hits>
+// <read misses> ...
+func parseVramTierStatus(line string) (*vramTierStats, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 9 || fields[2] != "cache" {
+		return nil, fmt.Errorf("not a dm-cache status: %q", line)
+	}
+	used, total, ok := strings.Cut(fields[6], "/")
+	if !ok {
+		return nil, fmt.Errorf("bad dm-cache block count %q", fields[6])
+	}
+	stats := &vramTierStats{}
+	var err error
+	for _, f := range []struct {
+		field string
+		value *int64
+	}{
+		{fields[5], &stats.BlockBytes},
+		{used, &stats.Used},
+		{total, &stats.Total},
+		{fields[7], &stats.ReadHits},
+		{fields[8], &stats.ReadMisses},
+	} {
+		if *f.value, err = strconv.ParseInt(f.field, 10, 64); err != nil {
+			return nil, fmt.Errorf("bad dm-cache status %q: %w", line, err)
+		}
+	}
+	stats.BlockBytes *= 512
+	return stats, nil
+}
+
+// readVramTierStats returns the state of the running cache
+func readVramTierStats() (*vramTierStats, error) {
+	out, err := exec.Command("dmsetup", "status", vramTierTarget).Output()
+	if err != nil {
+		return nil, fmt.Errorf("dmsetup status %s: %w", vramTierTarget, err)
+	}
+	return parseVramTierStatus(string(out))
+}
+
+// loadVramTier returns the cache and the disk it caches on this boot,
+// empty when the boot is not tiered
+func loadVramTier() (cache, disk string) {
+	data, err := os.ReadFile(vramTierFile)
+	if err != nil {
+		return "", ""
+	}
+	cache, disk, _ = strings.Cut(strings.TrimSpace(string(data)), " ")
+	return cache, disk
+}
+
+// vramTierPartition checks that the block device below sys can hold the
+// cache of the disk named backing: a partition, or a disk without any,
+// that is neither that disk nor holds it, and that nothing uses. It
+// returns its size in bytes and whether it spins.
+func vramTierPartition(sys, name, backing string) (int64, bool, error) {
+	dir := filepath.Join(sys, "class/block", name)
+	if _, err := os.Stat(dir); err != nil {
+		return 0, false, fmt.Errorf("%s is not a block device", name)
+	}
+	if name == backing {
+		return 0, false, fmt.Errorf("%s is the VISO disk itself", name)
+	}
+	if _, err := os.Stat(filepath.Join(dir, backing)); backing != "" && err == nil {
+		return 0, false, fmt.Errorf("%s holds the VISO disk", name)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(dir, name+"*", "partition")); len(parts) > 0 {
+		return 0, false, fmt.Errorf("%s has partitions; give one of them", name)
+	}
+	if holders, _ := os.ReadDir(filepath.Join(dir, "holders")); len(holders) > 0 {
+		return 0, false, fmt.Errorf("%s is in use by %s", name, holders[0].Name())
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "size"))
+	if err != nil {
+		return 0, false, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("bad size of %s: %w", name, err)
+	}
+	if sectors*512 < vramTierMinBytes {
+		return 0, false, fmt.Errorf("%s holds %s; the cache takes at least %s", name,
+			formatSize(sectors*512), formatSize(vramTierMinBytes))
+	}
+
+	// A partition's queue is its disk's, the directory above it
+	queue := filepath.Join(dir, "queue/rotational")
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			queue = filepath.Join(filepath.Dir(real), "queue/rotational")
+		}
+	}
+	rotational, _ := os.ReadFile(queue)
+	return sectors * 512, strings.TrimSpace(string(rotational)) == "1", nil
+}
+
+// vramTierBacking returns the name of the disk the root is read from,
+// the one below the cache on tiered boots
+func vramTierBacking() string {
+	if _, disk := loadVramTier(); disk != "" {
+		return filepath.Base(disk)
+	}
+	backing, err := loadVramBacking()
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(backing.Device)
+}
+
+// writeVramTierMarker marks device as a cache; opening it exclusively
+// fails while it is mounted or otherwise in use
+func writeVramTierMarker(device string) error {
+	f, err := os.OpenFile(device, os.O_WRONLY|os.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	block := make([]byte, vramTierMarkerSectors*512)
+	copy(block, vramTierMarker)
+	if _, err := f.Write(block); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runVramTierEnable(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM tier must be set up as root")
+	}
+	yes, _ := cmd.Flags().GetBool("yes")
+	ram, _ := cmd.Flags().GetString("ram")
+
+	device, err := filepath.EvalSymlinks(args[0])
+	if err != nil {
+		return err
+	}
+	var param string
+	if ram != "" {
+		mb, err := parseSizeMB(ram)
+		if err != nil {
+			return err
+		}
+		info, err := getMemInfo()
+		if err != nil {
+			return fmt.Errorf("failed to get memory info: %w", err)
+		}
+		if err := checkVramBudget(mb, info.MemTotal); err != nil {
+			return err
+		}
+		param = vramBudgetParam(mb)
+	}
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	size, rotational, err := vramTierPartition("/sys", filepath.Base(device), vramTierBacking())
+	if err != nil {
+		return fmt.Errorf("cannot cache on %s: %w", device, err)
+	}
+
+	_, data := vramTierLayout(size / 512)
+	fmt.Printf("Cache: %s, %s of cache blocks\n", device, formatSize(data*512))
+	if rotational {
+		fmt.Printf("\033[33mWarning:\033[0m %s is on a rotational disk; a cache there gains little\n", device)
+	}
+	if !yes {
+		fmt.Printf("Everything on %s (%s) will be lost. Continue? [y/N] ", device, formatSize(size))
+		var response string
+		fmt.Scanln(&response)
+		if response != "y" && response != "Y" {
+			fmt.Println("Cancelled.")
+			return nil
+		}
+	}
+
+	if err := writeVramTierMarker(device); err != nil {
+		return fmt.Errorf("failed to set up %s: %w", device, err)
+	}
+	conf.TierCache = device
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("failed to save %s: %w", vramPathsConfig, err)
+	}
+	logVramEvent(vramEventConfig, "tier cache set up on %s (%s)", device, formatSize(data*512))
+	fmt.Printf("\033[32m✓ %s caches the VISO disk from the next boot\033[0m\n", device)
+
+	if param != "" {
+		edited, err := updateVramBoot(param)
+		if err != nil {
+			return err
+		}
+		os.MkdirAll("/etc/mixos", 0755)
+		os.WriteFile("/etc/mixos/vram-enabled", []byte(strings.TrimPrefix(param, "VRAM=")+"\n"), 0644)
+		if !edited {
+			fmt.Printf("  No bootloader configuration found; boot with %s.\n", param)
+		}
+		return nil
+	}
+	budget, _ := loadVramBudget()
+	if budget == 0 && len(conf.Paths) == 0 {
+		fmt.Println("  Choose what stays in RAM with --ram or 'mix vram paths'; a root")
+		fmt.Println("  loaded whole into RAM does not use the cache.")
+	}
+	return nil
+}
+
+func runVramTierDisable(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM tier must be changed as root")
+	}
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	if conf.TierCache == "" {
+		fmt.Println("No tier cache configured.")
+		return nil
+	}
+	device := conf.TierCache
+	conf.TierCache = ""
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("failed to save %s: %w", vramPathsConfig, err)
+	}
+	logVramEvent(vramEventConfig, "tier cache on %s disabled", device)
+	fmt.Printf("\033[32m✓ %s no longer caches the VISO disk from the next boot\033[0m\n", device)
+	fmt.Println("  The VRAM= boot parameter is left as it is.")
+	return nil
+}
+
+func runVramTierStatus(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	fmt.Println("VRAM Tier:")
+	if conf.TierCache == "" {
+		fmt.Println("  Cache:      not configured")
+	} else {
+		fmt.Printf("  Cache:      %s\n", conf.TierCache)
+	}
+	cache, disk := loadVramTier()
+	if cache == "" {
+		fmt.Println("  This boot:  not tiered")
+		return nil
+	}
+	fmt.Printf("  This boot:  %s in front of %s\n", cache, disk)
+	if budget, _ := loadVramBudget(); budget != 0 {
+		fmt.Printf("  In RAM:     %s budget\n", formatSize(budget))
+	} else if loaded := loadedVramPaths(); loaded != nil {
+		fmt.Printf("  In RAM:     /%s\n", strings.Join(loaded, ", /"))
+	}
+
+	stats, err := readVramTierStats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  Used:       %s of %s", formatSize(stats.Used*stats.BlockBytes), formatSize(stats.Total*stats.BlockBytes))
+	if stats.Total > 0 {
+		fmt.Printf(" (%.0f%%)", float64(stats.Used)*100/float64(stats.Total))
+	}
+	fmt.Println()
+	if reads := stats.ReadHits + stats.ReadMisses; reads > 0 {
+		fmt.Printf("  Reads:      %.0f%% from the cache (%d hits, %d misses)\n",
+			float64(stats.ReadHits)*100/float64(reads), stats.ReadHits, stats.ReadMisses)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Tuning
+// ============================================================================
+//
+// An unpacked root lives in a tmpfs, whose mount options decide how its
+// pages are allocated: huge= backs files with transparent huge pages,
+// fewer TLB misses at the cost of memory rounded up to 2MB, mpol= places
+// them on NUMA nodes, and mode= sets the permissions of the root
+// directory. "mix vram tune" stores them in vram.conf for the initramfs,
+// which falls back to the defaults should the kernel refuse them, and
+// remounts the running root with them; new options apply to the pages
+// allocated from then on.
+
+// vramHugeModes are the huge= values of tmpfs
+var vramHugeModes = []string{"never", "always", "within_size", "advise"}
+
+// vramMpolPattern matches the mpol= values of tmpfs
+var vramMpolPattern = regexp.MustCompile(`^(default|local|prefer:\d+|bind:\d+(-\d+)?(,\d+(-\d+)?)*|interleave(:\d+(-\d+)?(,\d+(-\d+)?)*)?)$`)
+
+// vramHugeMinMB is the memory below which huge pages are not recommended:
+// rounding small files up to 2MB pages costs more than they gain
+const vramHugeMinMB = 4096
+
+// vramHardware is what "mix vram tune --recommend" bases its advice on
+type vramHardware struct {
+	Nodes      int   // NUMA nodes
+	MemTotalMB int64 // RAM
+	ShmemHuge  bool  // the kernel supports huge pages in tmpfs
+}
+
+var vramTuneCmd = &cobra.Command{
+	Use:   "tune",
+	Short: "Tune huge pages, NUMA policy and mode of the RAM root",
+	Long: `Show or change the tmpfs options of an unpacked RAM root.
+
+--huge backs the root with transparent huge pages: never, always,
+within_size (files large enough to fill them) or advise (on madvise).
+--mpol places its pages on NUMA nodes: default, local, prefer:N,
+bind:NODES or interleave[:NODES], NODES like 0-1,3. --mode sets the
+permissions of the root directory, 0755 by default.
+
+--recommend picks the options for this machine, keeping those given
+explicitly; with --dry-run nothing is saved. The options are saved for
+the next boot and applied to the running root right away.
+
+Examples:
+  mix vram tune --recommend --dry-run
+  mix vram tune --recommend
+  mix vram tune --huge within_size --mpol interleave
+  mix vram tune --reset
+  mix vram tune`,
+	RunE: runVramTune,
+}
+
+func init() {
+	vramCmd.AddCommand(vramTuneCmd)
+	vramTuneCmd.Flags().String("huge", "", "huge pages: never, always, within_size or advise")
+	vramTuneCmd.Flags().String("mpol", "", "NUMA policy: default, local, prefer:N, bind:NODES or interleave[:NODES]")
+	vramTuneCmd.Flags().String("mode", "", "permissions of the root directory, in octal")
+	vramTuneCmd.Flags().Bool("recommend", false, "choose the options for the detected hardware")
+	vramTuneCmd.Flags().Bool("dry-run", false, "show the options without saving them")
+	vramTuneCmd.Flags().Bool("reset", false, "go back to the kernel's defaults")
+}
+
+// validateTmpfs checks the tmpfs options
+func (c *vramConfig) validateTmpfs() error {
+	if c.tmpfsOptions() == "" {
+		return nil
+	}
+	if c.compressed() || c.zram() {
+		return fmt.Errorf("tmpfs_huge, tmpfs_mpol and tmpfs_mode apply to an unpacked root on tmpfs")
+	}
+	if c.TmpfsHuge != "" && !slices.Contains(vramHugeModes, c.TmpfsHuge) {
+		return fmt.Errorf("unknown tmpfs_huge %q (use %s)", c.TmpfsHuge, strings.Join(vramHugeModes, ", "))
+	}
+	if c.TmpfsMpol != "" && !vramMpolPattern.MatchString(c.TmpfsMpol) {
+		return fmt.Errorf("invalid tmpfs_mpol %q (use default, local, prefer:N, bind:NODES or interleave[:NODES])", c.TmpfsMpol)
+	}
+	if c.TmpfsMode != "" {
+		if mode, err := strconv.ParseUint(c.TmpfsMode, 8, 32); err != nil || mode > 07777 {
+			return fmt.Errorf("tmpfs_mode: expected octal permissions like 0755, got %q", c.TmpfsMode)
+		}
+	}
+	return nil
+}
+
+// tmpfsOptions returns the tuned options as tmpfs takes them
+func (c *vramConfig) tmpfsOptions() string {
+	var opts []string
+	if c.TmpfsHuge != "" {
+		opts = append(opts, "huge="+c.TmpfsHuge)
+	}
+	if c.TmpfsMpol != "" {
+		opts = append(opts, "mpol="+c.TmpfsMpol)
+	}
+	if c.TmpfsMode != "" {
+		opts = append(opts, "mode="+c.TmpfsMode)
+	}
+	return strings.Join(opts, ",")
+}
+
+// detectVramHardware reads the NUMA layout, memory and huge page support
+func detectVramHardware() vramHardware {
+	hw := vramHardware{Nodes: 1}
+	if nodes, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*"); len(nodes) > 0 {
+		hw.Nodes = len(nodes)
+	}
+	if info, err := getMemInfo(); err == nil {
+		hw.MemTotalMB = info.MemTotal
+	}
+	_, err := os.Stat("/sys/kernel/mm/transparent_hugepage/shmem_enabled")
+	hw.ShmemHuge = err == nil
+	return hw
+}
+
+// recommendVramTune chooses the tmpfs options for hw, with a reason for
+// each; "" leaves an option to the kernel
+func recommendVramTune(hw vramHardware) (huge, mpol, mode string, reasons []string) {
+	switch {
+	case !hw.ShmemHuge:
+		reasons = append(reasons, "huge pages: the kernel has none for tmpfs")
+	case hw.MemTotalMB < vramHugeMinMB:
+		huge = "never"
+		reasons = append(reasons, fmt.Sprintf("huge=never: with %dMB of RAM, 2MB pages waste memory on small files", hw.MemTotalMB))
+	default:
+		huge = "within_size"
+		reasons = append(reasons, "huge=within_size: fewer TLB misses on large files, no waste on small ones")
+	}
+	if hw.Nodes > 1 {
+		mpol = "interleave"
+		reasons = append(reasons, fmt.Sprintf("mpol=interleave: spreads the root over the %d NUMA nodes for even bandwidth", hw.Nodes))
+	} else {
+		reasons = append(reasons, "mpol: a single NUMA node, nothing to place")
+	}
+	mode = "0755"
+	reasons = append(reasons, "mode=0755: the permissions of a root directory")
+	return huge, mpol, mode, reasons
+}
+
+// runningVramTmpfsOptions returns the huge=, mpol= and mode= options the
+// tmpfs at mount runs with, "" when it is not a tmpfs
+func runningVramTmpfsOptions(mount string) string {
+	data, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return ""
+	}
+	opts := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || unescapeMountPath(fields[1]) != mount {
+			continue
+		}
+		opts = ""
+		if fields[2] != "tmpfs" {
+			continue // hidden by a later mount, or not a tmpfs
+		}
+		var tuned []string
+		for _, opt := range strings.Split(fields[3], ",") {
+			if strings.HasPrefix(opt, "huge=") || strings.HasPrefix(opt, "mpol=") || strings.HasPrefix(opt, "mode=") {
+				tuned = append(tuned, opt)
+			}
+		}
+		opts = strings.Join(tuned, ",")
+		if opts == "" {
+			opts = "defaults"
+		}
+	}
+	return opts
+}
+
+// vramTuneMounts returns the tmpfs mounts of the running root
+func vramTuneMounts() []string {
+	if !isVramActive() {
+		return nil
+	}
+	switch vramMode() {
+	case "tmpfs":
+		return []string{"/"}
+	case "selective":
+		var mounts []string
+		for _, p := range loadedVramPaths() {
+			mounts = append(mounts, "/"+p)
+		}
+		return mounts
+	}
+	return nil
+}
+
+// applyVramTune remounts the tmpfs of the running root with the huge=
+// and mpol= options, and sets the mode of a full root; it returns the
+// mounts it changed
+func applyVramTune(conf *vramConfig) ([]string, error) {
+	var opts []string
+	if conf.TmpfsHuge != "" {
+		opts = append(opts, "huge="+conf.TmpfsHuge)
+	}
+	if conf.TmpfsMpol != "" {
+		opts = append(opts, "mpol="+conf.TmpfsMpol)
+	}
+	var applied []string
+	for _, mount := range vramTuneMounts() {
+		if len(opts) > 0 {
+			if err := syscall.Mount("tmpfs", mount, "tmpfs", syscall.MS_REMOUNT, strings.Join(opts, ",")); err != nil {
+				return applied, fmt.Errorf("failed to remount %s: %w", mount, err)
+			}
+		}
+		if mount == "/" && conf.TmpfsMode != "" {
+			mode, _ := strconv.ParseUint(conf.TmpfsMode, 8, 32)
+			if err := syscall.Chmod(mount, uint32(mode)); err != nil {
+				return applied, fmt.Errorf("failed to set the mode of %s: %w", mount, err)
+			}
+		}
+		if len(opts) > 0 || (mount == "/" && conf.TmpfsMode != "") {
+			applied = append(applied, mount)
+		}
+	}
+	return applied, nil
+}
+
+func printVramTune(conf *vramConfig) {
+	fmt.Println("VRAM tmpfs options:")
+	show := func(label, value string) {
+		if value == "" {
+			value = "kernel default"
+		}
+		fmt.Printf("  %-6s %s\n", label+":", value)
+	}
+	show("huge", conf.TmpfsHuge)
+	show("mpol", conf.TmpfsMpol)
+	show("mode", conf.TmpfsMode)
+	for _, mount := range vramTuneMounts() {
+		if running := runningVramTmpfsOptions(mount); running != "" {
+			fmt.Printf("  Running %s: %s\n", mount, running)
+		}
+	}
+	if conf.compressed() || conf.zram() {
+		fmt.Printf("  \033[33mNote:\033[0m the root is held as %s, not on a tmpfs.\n", conf.describeBackend())
+	}
+}
+
+func runVramTune(cmd *cobra.Command, args []string) error {
+	conf, err := loadVramConfig()
+	if err != nil {
+		return err
+	}
+	flags := cmd.Flags()
+	recommend, _ := flags.GetBool("recommend")
+	reset, _ := flags.GetBool("reset")
+	dryRun, _ := flags.GetBool("dry-run")
+	if !recommend && !reset && !flags.Changed("huge") && !flags.Changed("mpol") && !flags.Changed("mode") {
+		printVramTune(conf)
+		return nil
+	}
+
+	if reset {
+		conf.TmpfsHuge, conf.TmpfsMpol, conf.TmpfsMode = "", "", ""
+	}
+	if recommend {
+		hw := detectVramHardware()
+		huge, mpol, mode, reasons := recommendVramTune(hw)
+		support := "supported"
+		if !hw.ShmemHuge {
+			support = "unsupported"
+		}
+		fmt.Printf("Detected: %d NUMA node(s), %d MB of RAM, tmpfs huge pages %s\n", hw.Nodes, hw.MemTotalMB, support)
+		for _, reason := range reasons {
+			fmt.Printf("  • %s\n", reason)
+		}
+		conf.TmpfsHuge, conf.TmpfsMpol, conf.TmpfsMode = huge, mpol, mode
+	}
+	if flags.Changed("huge") {
+		conf.TmpfsHuge, _ = flags.GetString("huge")
+	}
+	if flags.Changed("mpol") {
+		conf.TmpfsMpol, _ = flags.GetString("mpol")
+	}
+	if flags.Changed("mode") {
+		conf.TmpfsMode, _ = flags.GetString("mode")
+	}
+	if err := conf.validate(); err != nil {
+		return err
+	}
+
+	options := conf.tmpfsOptions()
+	if options == "" {
+		options = "kernel defaults"
+	}
+	if dryRun {
+		fmt.Printf("Would set: %s\n", options)
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM settings must be changed as root")
+	}
+	if err := saveVramConfig(conf); err != nil {
+		return fmt.Errorf("failed to save %s: %w", vramPathsConfig, err)
+	}
+	fmt.Printf("✓ tmpfs options: %s\n", options)
+
+	applied, err := applyVramTune(conf)
+	if err != nil {
+		return fmt.Errorf("saved for the next boot, but %w", err)
+	}
+	if len(applied) > 0 {
+		logVramEvent(vramEventConfig, "tuned the RAM root: %s", options)
+		fmt.Printf("✓ Applied to %s; pages allocated from now on follow them\n", strings.Join(applied, ", "))
+	}
+	fmt.Println("  Takes effect in full on the next boot with VRAM=auto.")
+	return nil
+}
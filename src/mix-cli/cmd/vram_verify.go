@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Verify
+// ============================================================================
+//
+// The build writes the SHA-256 of every file of the root into the image as
+// usr/share/mixos/manifest.sha256, in sha256sum format. "mix vram verify"
+// hashes the RAM root against the manifest of the image it was loaded
+// from, read from the image itself so that a tampered root cannot vouch
+// for itself. Files changed on purpose and saved with "mix vram sync" are
+// reported as such; anything else is an error.
+
+const vramManifest = "usr/share/mixos/manifest.sha256"
+
+// vramManifestEntry is one line of the manifest
+type vramManifestEntry struct {
+	Path string // relative to the root
+	Hash string
+}
+
+var vramVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the RAM root against the image manifest",
+	Long: `Compare the files of the RAM root with the checksums recorded in the
+image it was loaded from, and list the files that were modified or are
+missing.
+
+Changes saved with "mix vram sync" are shown but not counted as errors.
+The command fails when other files differ, which points to corruption or
+tampering; run "mix vram sync" first to vouch for your own changes.`,
+	RunE: runVramVerify,
+}
+
+func init() {
+	vramCmd.AddCommand(vramVerifyCmd)
+}
+
+// parseVramManifest reads sha256sum output: "<hash>  ./<path>"
+func parseVramManifest(r io.Reader) ([]vramManifestEntry, error) {
+	var entries []vramManifestEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "\\") {
+			continue // sha256sum escapes names with newlines; skip them
+		}
+		hash, path, ok := strings.Cut(line, " ")
+		if !ok || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("malformed manifest line %q", line)
+		}
+		path = strings.TrimPrefix(strings.TrimPrefix(path, " "), "*")
+		path = strings.TrimPrefix(filepath.Clean(path), "/")
+		entries = append(entries, vramManifestEntry{Path: path, Hash: hash})
+	}
+	return entries, scanner.Err()
+}
+
+// hashVramFile returns the SHA-256 of a file
+func hashVramFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyVramRoot hashes the files of the manifest below root. Entries for
+// which skip returns true are not checked.
+func verifyVramRoot(root string, entries []vramManifestEntry, skip func(rel string) bool) (modified, missing []string, checked int) {
+	for _, e := range entries {
+		if skip(e.Path) {
+			continue
+		}
+		checked++
+		hash, err := hashVramFile(filepath.Join(root, e.Path))
+		switch {
+		case os.IsNotExist(err):
+			missing = append(missing, e.Path)
+		case err != nil || hash != e.Hash:
+			modified = append(modified, e.Path)
+		}
+	}
+	return modified, missing, checked
+}
+
+// writeVramManifest records the files of root in its manifest, so that an
+// image made from it can be verified
+func writeVramManifest(root string) error {
+	path := filepath.Join(root, vramManifest)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(f)
+
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rootDev := rootInfo.Sys().(*syscall.Stat_t).Dev
+	loaded := loadedVramPaths()
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		if rel == "." {
+			return nil
+		}
+		if vramExcluded(rel) || rel == vramManifest || rel == vramManifest+".tmp" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			info, err := d.Info()
+			if err == nil && info.Sys().(*syscall.Stat_t).Dev != rootDev && !underVramPaths(rel, loaded) {
+				return filepath.SkipDir // another filesystem
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		hash, err := hashVramFile(p)
+		if err != nil {
+			return nil
+		}
+		_, err = fmt.Fprintf(w, "%s  ./%s\n", hash, rel)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// vramSavedChange reports whether rel is covered by the changes stored by
+// "mix vram sync" in state
+func vramSavedChange(state string, deleted []string, rel string) bool {
+	if _, err := os.Lstat(filepath.Join(state, "changes", rel)); err == nil {
+		return true
+	}
+	return underVramPaths(rel, deleted)
+}
+
+func runVramVerify(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("VRAM verify must be run as root")
+	}
+	if !isVramActive() {
+		return fmt.Errorf("system is not running in VRAM mode")
+	}
+
+	// The manifest of the image, and the changes saved next to it
+	var manifest io.ReadCloser
+	state, source := "", "image"
+	if backing, err := loadVramBacking(); err == nil {
+		unlock, err := lockVram()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		disk, unmount, err := backing.mount()
+		if err != nil {
+			return err
+		}
+		defer unmount()
+		lower, unmountImage, err := mountVramImage(filepath.Join(disk, backing.Image), "lower")
+		if err != nil {
+			return err
+		}
+		defer unmountImage()
+		if manifest, err = os.Open(filepath.Join(lower, vramManifest)); err != nil {
+			return fmt.Errorf("the image has no manifest (%s); it was built without one", vramManifest)
+		}
+		state = filepath.Join(disk, vramStateSubdir)
+	} else {
+		if manifest, err = os.Open("/" + vramManifest); err != nil {
+			return fmt.Errorf("no manifest found: %w", err)
+		}
+		source = "root (the boot disk is unknown, so it cannot be trusted)"
+	}
+	entries, err := parseVramManifest(manifest)
+	manifest.Close()
+	if err != nil {
+		return err
+	}
+
+	var deleted []string
+	if state != "" {
+		if data, err := os.ReadFile(filepath.Join(state, "deleted")); err == nil {
+			deleted = strings.Fields(string(data))
+		}
+	}
+	// Evicted paths are not in RAM, and excluded ones live on disk
+	skipped := append(evictedVramPaths(), vramDiskPaths()...)
+	fmt.Printf("Verifying %d files against the manifest of the %s...\n", len(entries), source)
+	modified, missing, checked := verifyVramRoot("/", entries, func(rel string) bool {
+		return vramExcluded(rel) || underVramPaths(rel, skipped)
+	})
+
+	saved, unexpected := 0, 0
+	report := func(paths []string, what string) {
+		for _, rel := range paths {
+			if state != "" && vramSavedChange(state, deleted, rel) {
+				saved++
+				fmt.Printf("  %-50s %s (saved change)\n", "/"+rel, what)
+				continue
+			}
+			unexpected++
+			fmt.Printf("  %-50s \033[31m%s\033[0m\n", "/"+rel, what)
+		}
+	}
+	report(modified, "modified")
+	report(missing, "missing")
+
+	intact := checked - len(modified) - len(missing)
+	fmt.Printf("\n%d file(s) intact, %d modified, %d missing", intact, len(modified), len(missing))
+	if saved > 0 {
+		fmt.Printf(" (%d saved with 'mix vram sync')", saved)
+	}
+	fmt.Println()
+	if unexpected > 0 {
+		return fmt.Errorf("%d file(s) differ from the image", unexpected)
+	}
+	fmt.Println("\033[32m✓ RAM root verified\033[0m")
+	return nil
+}
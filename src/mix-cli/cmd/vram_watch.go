@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// VRAM Watch
+// ============================================================================
+//
+// "mix vram watch" is a live view of the RAM root in the manner of top.
+// Memory, sync state and pressure are sampled every second; the largest
+// directories take a walk of the whole root, so they are sized in the
+// background and refreshed every vramWatchDirsInterval. A sample that is
+// still being taken when the next tick comes is not started twice.
+
+const (
+	vramWatchInterval     = time.Second
+	vramWatchDirsInterval = 10 * time.Second
+	vramWatchTopDirs      = 10
+)
+
+var vramWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Live view of VRAM memory, sync and pressure",
+	Long: `Show a live, top-like view of the RAM root, refreshed every second:
+memory and RAM root usage, unsynced changes, the last sync, memory
+pressure and the largest directories held in RAM.
+
+Press q to quit.`,
+	RunE: runVramWatch,
+}
+
+func init() {
+	vramCmd.AddCommand(vramWatchCmd)
+}
+
+// vramDirUsage is the space a directory takes in the RAM root
+type vramDirUsage struct {
+	Path  string // relative to the root
+	Bytes int64
+}
+
+// largestVramDirs sizes the directories below root that are held in RAM
+// (the children of the root, or of the loaded paths in selective mode)
+// and returns the n largest. Runtime state and other filesystems are not
+// counted.
+func largestVramDirs(root string, scope []string, n int) []vramDirUsage {
+	if scope == nil {
+		scope = []string{"."}
+	}
+	var dirs []vramDirUsage
+	for _, top := range scope {
+		entries, err := os.ReadDir(filepath.Join(root, top))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			rel := filepath.Join(top, e.Name())
+			if !e.IsDir() || vramExcluded(rel) {
+				continue
+			}
+			if bytes := vramDiskUsage(root, rel); bytes > 0 {
+				dirs = append(dirs, vramDirUsage{Path: rel, Bytes: bytes})
+			}
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Bytes > dirs[j].Bytes })
+	if len(dirs) > n {
+		dirs = dirs[:n]
+	}
+	return dirs
+}
+
+// vramDiskUsage returns the space allocated below root/rel, as du does
+func vramDiskUsage(root, rel string) int64 {
+	top, err := os.Lstat(filepath.Join(root, rel))
+	if err != nil {
+		return 0
+	}
+	dev := top.Sys().(*syscall.Stat_t).Dev
+	var bytes int64
+	filepath.WalkDir(filepath.Join(root, rel), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		sub, _ := filepath.Rel(root, path)
+		if vramExcluded(sub) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if d.IsDir() && st.Dev != dev {
+			return filepath.SkipDir
+		}
+		bytes += st.Blocks * 512
+		return nil
+	})
+	return bytes
+}
+
+// ============================================================================
+// Model
+// ============================================================================
+
+type vramWatchTickMsg time.Time
+
+// vramWatchSampleMsg carries the statistics sampled at one tick
+type vramWatchSampleMsg struct {
+	stats     *VramStats
+	sync      *VramSyncResult
+	pressure  *VramPressure
+	level     int
+	some      float64
+	full      float64
+	monitored bool
+	evicted   []string
+}
+
+type vramWatchDirsMsg []vramDirUsage
+
+type vramWatchModel struct {
+	width    int
+	sample   *vramWatchSampleMsg
+	dirs     []vramDirUsage
+	sized    time.Time
+	sampling bool
+	sizing   bool
+}
+
+func vramWatchTick() tea.Cmd {
+	return tea.Tick(vramWatchInterval, func(t time.Time) tea.Msg {
+		return vramWatchTickMsg(t)
+	})
+}
+
+func sampleVramWatch() tea.Msg {
+	sample := &vramWatchSampleMsg{
+		stats: collectVramStats(time.Now()),
+		sync:  loadVramSyncResult(),
+	}
+	sample.pressure, _ = loadVramPressure()
+	if sample.pressure != nil {
+		if available, some, full, err := readVramPressure(); err == nil {
+			sample.level = sample.pressure.level(available, some, full)
+			sample.some, sample.full = some, full
+		}
+		sample.monitored = sample.pressure.Enabled && vramPressurePID() != 0
+	}
+	sample.evicted = evictedVramPaths()
+	return *sample
+}
+
+func sizeVramWatchDirs() tea.Msg {
+	return vramWatchDirsMsg(largestVramDirs("/", loadedVramPaths(), vramWatchTopDirs))
+}
+
+func (m vramWatchModel) Init() tea.Cmd {
+	return tea.Batch(sampleVramWatch, sizeVramWatchDirs, vramWatchTick())
+}
+
+func (m vramWatchModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmds []tea.Cmd
+
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "q", "esc":
+			return m, tea.Quit
+		}
+
+	case vramWatchTickMsg:
+		if !m.sampling {
+			m.sampling = true
+			cmds = append(cmds, sampleVramWatch)
+		}
+		if !m.sizing && time.Since(m.sized) >= vramWatchDirsInterval {
+			m.sizing = true
+			cmds = append(cmds, sizeVramWatchDirs)
+		}
+		cmds = append(cmds, vramWatchTick())
+
+	case vramWatchSampleMsg:
+		m.sample = &msg
+		m.sampling = false
+
+	case vramWatchDirsMsg:
+		m.dirs = msg
+		m.sized = time.Now()
+		m.sizing = false
+	}
+
+	return m, tea.Batch(cmds...)
+}
+
+// ============================================================================
+// View
+// ============================================================================
+
+// vramWatchBar draws a bar of width cells, filled by frac
+func vramWatchBar(frac float64, width int, color lipgloss.Color) string {
+	frac = max(0, min(frac, 1))
+	filled := int(float64(width)*frac + 0.5)
+	bar := lipgloss.NewStyle().Foreground(color).Render(strings.Repeat("█", filled))
+	bar += lipgloss.NewStyle().Foreground(mutedColor).Render(strings.Repeat("░", width-filled))
+	return bar
+}
+
+// vramUsageColor turns from green to yellow to red as frac fills up
+func vramUsageColor(frac float64) lipgloss.Color {
+	switch {
+	case frac >= 0.9:
+		return errorColor
+	case frac >= 0.75:
+		return warningColor
+	}
+	return successColor
+}
+
+func (m vramWatchModel) View() string {
+	var s strings.Builder
+	titleStyle := lipgloss.NewStyle().Foreground(primaryColor).Bold(true)
+	labelStyle := lipgloss.NewStyle().Foreground(secondaryColor).Bold(true)
+	mutedStyle := lipgloss.NewStyle().Foreground(mutedColor)
+
+	s.WriteString(titleStyle.Render("⚡ MixOS VRAM"))
+	s.WriteString(mutedStyle.Render("  " + time.Now().Format("15:04:05")))
+	s.WriteString("\n\n")
+	if m.sample == nil {
+		s.WriteString(mutedStyle.Render("Sampling..."))
+		return s.String()
+	}
+	stats := m.sample.stats
+
+	barWidth := 30
+	if m.width > 0 {
+		barWidth = max(10, min(50, m.width-50))
+	}
+	row := func(label string, used, total int64, extra string) {
+		frac := 0.0
+		if total > 0 {
+			frac = float64(used) / float64(total)
+		}
+		fmt.Fprintf(&s, "%s [%s] %3.0f%%  %s / %s%s\n", labelStyle.Render(fmt.Sprintf("%-10s", label)),
+			vramWatchBar(frac, barWidth, vramUsageColor(frac)), frac*100, formatSize(used), formatSize(total), extra)
+	}
+	row("Memory", stats.MemTotal-stats.MemAvailable, stats.MemTotal, "")
+	if stats.Size > 0 {
+		row("RAM root", stats.Used, stats.Size, mutedStyle.Render("  ("+stats.Mode+")"))
+	}
+	if z := stats.Zram; z != nil && z.Compressed > 0 {
+		fmt.Fprintf(&s, "%s %s stored in %s (%.1fx)\n", labelStyle.Render(fmt.Sprintf("%-10s", "zram")),
+			formatSize(z.Original), formatSize(z.MemUsed), float64(z.Original)/float64(z.Compressed))
+	}
+	s.WriteString("\n")
+
+	// Sync status
+	fmt.Fprintf(&s, "%s %d file(s), %s\n", labelStyle.Render(fmt.Sprintf("%-10s", "Unsynced")),
+		stats.DirtyFiles, formatSize(stats.DirtyBytes))
+	last := "never"
+	if r := m.sample.sync; r != nil {
+		last = time.Since(r.Time).Round(time.Second).String() + " ago"
+		if r.Error != "" {
+			last = lipgloss.NewStyle().Foreground(errorColor).Render("failed "+last) + ": " + r.Error
+		}
+		if r.Failures > 0 {
+			last += mutedStyle.Render(fmt.Sprintf("  (%d of %d failed since boot)", r.Failures, r.Syncs))
+		}
+	}
+	autosync := ""
+	if stats.AutosyncActive {
+		autosync = mutedStyle.Render("  autosync running")
+	}
+	fmt.Fprintf(&s, "%s %s%s\n", labelStyle.Render(fmt.Sprintf("%-10s", "Last sync")), last, autosync)
+
+	// Pressure
+	if p := m.sample.pressure; p != nil {
+		color := []lipgloss.Color{successColor, warningColor, errorColor}[m.sample.level]
+		monitor := "monitor off"
+		if m.sample.monitored {
+			monitor = "monitor running"
+		}
+		fmt.Fprintf(&s, "%s %s  %.1f%% some / %.1f%% full stalled%s\n", labelStyle.Render(fmt.Sprintf("%-10s", "Pressure")),
+			lipgloss.NewStyle().Foreground(color).Bold(true).Render(vramPressureLevels[m.sample.level]),
+			m.sample.some, m.sample.full, mutedStyle.Render("  "+monitor))
+	}
+	if len(m.sample.evicted) > 0 {
+		fmt.Fprintf(&s, "%s /%s\n", labelStyle.Render(fmt.Sprintf("%-10s", "Evicted")), strings.Join(m.sample.evicted, ", /"))
+	}
+	s.WriteString("\n")
+
+	// Largest directories
+	s.WriteString(titleStyle.Render("Largest directories in RAM"))
+	s.WriteString("\n")
+	if m.dirs == nil {
+		s.WriteString(mutedStyle.Render("  sizing..."))
+		s.WriteString("\n")
+	}
+	for _, d := range m.dirs {
+		frac := float64(d.Bytes) / float64(m.dirs[0].Bytes)
+		fmt.Fprintf(&s, "  %-24s %10s %s\n", "/"+d.Path, formatSize(d.Bytes), vramWatchBar(frac, barWidth, secondaryColor))
+	}
+
+	s.WriteString("\n")
+	s.WriteString(mutedStyle.Render("q quit"))
+	return s.String()
+}
+
+func runVramWatch(cmd *cobra.Command, args []string) error {
+	if !isVramActive() {
+		return fmt.Errorf("system is not running in VRAM mode")
+	}
+	p := tea.NewProgram(vramWatchModel{}, tea.WithAltScreen())
+	_, err := p.Run()
+	return err
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// zram Backend
+// ============================================================================
+//
+// With "backend = zram" the initramfs unpacks the root onto an ext4
+// filesystem on /dev/zram0, mounted with discard so that deleted files
+// give their memory back, and records the device in
+// /run/initramfs/vram-zram. The kernel reports the device's usage in
+// /sys/block/zramN/mm_stat.
+
+const vramZramInfo = "/run/initramfs/vram-zram"
+
+// zramStats is the memory use of a zram device, in bytes
+type zramStats struct {
+	Algorithm  string `json:"algorithm"`
+	DiskSize   int64  `json:"disk_size"`
+	Original   int64  `json:"original"` // data stored, uncompressed
+	Compressed int64  `json:"compressed"`
+	MemUsed    int64  `json:"mem_used"` // RAM taken, including allocator overhead
+}
+
+// ratio is the compression ratio of the stored data
+func (z *zramStats) ratio() float64 {
+	if z.Compressed == 0 {
+		return 0
+	}
+	return float64(z.Original) / float64(z.Compressed)
+}
+
+// parseZramMMStat parses mm_stat: orig_data_size compr_data_size
+// mem_used_total followed by counters we do not need
+func parseZramMMStat(data string) (*zramStats, error) {
+	fields := strings.Fields(data)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("malformed mm_stat %q", strings.TrimSpace(data))
+	}
+	var values [3]int64
+	for i := range values {
+		n, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed mm_stat %q", strings.TrimSpace(data))
+		}
+		values[i] = n
+	}
+	return &zramStats{Original: values[0], Compressed: values[1], MemUsed: values[2]}, nil
+}
+
+// selectedZramAlgorithm picks the bracketed entry of comp_algorithm,
+// e.g. "lzo lzo-rle lz4 [zstd]"
+func selectedZramAlgorithm(data string) string {
+	for _, f := range strings.Fields(data) {
+		if strings.HasPrefix(f, "[") && strings.HasSuffix(f, "]") {
+			return strings.Trim(f, "[]")
+		}
+	}
+	return ""
+}
+
+// vramZramDevice returns the zram device holding the root, "" when the
+// root is not on zram
+func vramZramDevice() string {
+	data, err := os.ReadFile(vramZramInfo)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readZramStats reads the usage of a zram device such as /dev/zram0
+func readZramStats(device string) (*zramStats, error) {
+	sys := filepath.Join("/sys/block", filepath.Base(device))
+	data, err := os.ReadFile(filepath.Join(sys, "mm_stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats, err := parseZramMMStat(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if data, err := os.ReadFile(filepath.Join(sys, "comp_algorithm")); err == nil {
+		stats.Algorithm = selectedZramAlgorithm(string(data))
+	}
+	if data, err := os.ReadFile(filepath.Join(sys, "disksize")); err == nil {
+		stats.DiskSize, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	return stats, nil
+}
+
+// printZramStatus shows the compressed and uncompressed usage of the zram
+// root, if the root is on zram
+func printZramStatus() {
+	device := vramZramDevice()
+	if device == "" {
+		return
+	}
+	stats, err := readZramStats(device)
+	if err != nil {
+		fmt.Printf("  zram:      %s (usage unavailable: %v)\n", device, err)
+		return
+	}
+	fmt.Printf("  Backend:   zram (%s, %s)\n", device, stats.Algorithm)
+	fmt.Printf("  Data:      %s uncompressed\n", formatSize(stats.Original))
+	fmt.Printf("  Stored in: %s compressed (%.1fx)\n", formatSize(stats.Compressed), stats.ratio())
+	fmt.Printf("  RAM used:  %s of %s device\n", formatSize(stats.MemUsed), formatSize(stats.DiskSize))
+}
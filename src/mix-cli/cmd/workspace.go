@@ -0,0 +1,599 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// ============================================================================
+// Workspaces - per-project overlay roots for developers
+// ============================================================================
+
+const (
+	workspaceRoot     = "/var/lib/mixos/workspaces"
+	workspaceMetaFile = "workspace.json"
+)
+
+// Workspace describes an isolated overlay root layered on top of the base system
+type Workspace struct {
+	Name     string    `json:"name"`
+	Base     string    `json:"base"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Layer    bool      `json:"layer,omitempty"` // upper and work live in layer.img
+}
+
+func (w *Workspace) dir() string        { return filepath.Join(workspaceRoot, w.Name) }
+func (w *Workspace) merged() string     { return filepath.Join(w.dir(), "merged") }
+func (w *Workspace) layerImage() string { return filepath.Join(w.dir(), "layer.img") }
+func (w *Workspace) layerDir() string   { return filepath.Join(w.dir(), "layer") }
+
+// layers returns the directory holding upper and work
+func (w *Workspace) layers() string {
+	if w.Layer {
+		return w.layerDir()
+	}
+	return w.dir()
+}
+
+func (w *Workspace) upper() string { return filepath.Join(w.layers(), "upper") }
+func (w *Workspace) work() string  { return filepath.Join(w.layers(), "work") }
+
+var workspaceCmd = &cobra.Command{
+	Use:   "workspace",
+	Short: "Manage per-project developer workspaces",
+	Long: `Workspaces are isolated overlay roots for development.
+
+Each workspace layers a private writable directory on top of the base
+system using overlayfs. Packages installed inside a workspace land in
+the workspace's upper layer and never touch the base system. When the
+base holds the workspaces themselves, as the default base / does, the
+upper layer lives in an ext4 image of its own (layer.img): overlayfs
+refuses an upper layer inside its lower one.
+
+Workspaces can be exported as VISO layers (squashfs), pushed to a VISO
+registry's content-addressed store, and removed with garbage collection
+once they are no longer used.`,
+}
+
+var workspaceCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create a new workspace",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runWorkspaceCreate,
+}
+
+var workspaceEnterCmd = &cobra.Command{
+	Use:   "enter <name> [command...]",
+	Short: "Enter a workspace shell",
+	Long:  `Mount the workspace overlay and start a shell (or the given command) inside it.`,
+	Args:  cobra.MinimumNArgs(1),
+	RunE:  runWorkspaceEnter,
+}
+
+var workspaceListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List workspaces",
+	RunE:  runWorkspaceList,
+}
+
+var workspaceExportCmd = &cobra.Command{
+	Use:   "export <name>",
+	Short: "Export a workspace as a VISO layer",
+	Long: `Pack the workspace's upper layer into a squashfs image usable as a VISO layer.
+
+With --push the layer also goes to a VISO registry (see "mix viso push"),
+which stores it in content-addressed chunks: chunks the registry holds
+from an earlier export are not sent again.
+
+Examples:
+  mix workspace export myproj
+  mix workspace export myproj --push registry.example.com/layers/myproj:1.0`,
+	Args: cobra.ExactArgs(1),
+	RunE: runWorkspaceExport,
+}
+
+var workspaceDeleteCmd = &cobra.Command{
+	Use:     "delete <name>",
+	Aliases: []string{"rm"},
+	Short:   "Delete a workspace",
+	Args:    cobra.ExactArgs(1),
+	RunE:    runWorkspaceDelete,
+}
+
+var workspaceGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Garbage-collect unused workspaces",
+	Long:  `Remove workspaces that have not been entered within the given age and are not mounted.`,
+	RunE:  runWorkspaceGC,
+}
+
+func init() {
+	rootCmd.AddCommand(workspaceCmd)
+	workspaceCmd.AddCommand(workspaceCreateCmd)
+	workspaceCmd.AddCommand(workspaceEnterCmd)
+	workspaceCmd.AddCommand(workspaceListCmd)
+	workspaceCmd.AddCommand(workspaceExportCmd)
+	workspaceCmd.AddCommand(workspaceDeleteCmd)
+	workspaceCmd.AddCommand(workspaceGCCmd)
+
+	workspaceCreateCmd.Flags().String("base", "/", "base root filesystem to layer on")
+	workspaceCreateCmd.Flags().String("size", "20G", "size of the layer image, when the base holds the workspaces")
+	workspaceExportCmd.Flags().StringP("output", "o", "", "output layer file (default <name>.vlayer)")
+	workspaceExportCmd.Flags().String("push", "", "also push the layer to a VISO registry reference")
+	workspaceExportCmd.Flags().String("compression", "xz", "squashfs compression (xz, zstd, gzip)")
+	workspaceGCCmd.Flags().Duration("older-than", 30*24*time.Hour, "remove workspaces unused for this long")
+	workspaceGCCmd.Flags().Bool("dry-run", false, "only show what would be removed")
+}
+
+// ============================================================================
+// Helpers
+// ============================================================================
+
+func validWorkspaceName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func loadWorkspace(name string) (*Workspace, error) {
+	if !validWorkspaceName(name) {
+		return nil, fmt.Errorf("invalid workspace name: %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(workspaceRoot, name, workspaceMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("workspace %s does not exist", name)
+		}
+		return nil, err
+	}
+	var ws Workspace
+	if err := json.Unmarshal(data, &ws); err != nil {
+		return nil, fmt.Errorf("corrupt workspace metadata for %s: %w", name, err)
+	}
+	return &ws, nil
+}
+
+func saveWorkspace(ws *Workspace) error {
+	data, err := json.MarshalIndent(ws, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ws.dir(), workspaceMetaFile), data, 0644)
+}
+
+func listWorkspaces() ([]*Workspace, error) {
+	entries, err := os.ReadDir(workspaceRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var result []*Workspace
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		ws, err := loadWorkspace(e.Name())
+		if err != nil {
+			continue
+		}
+		result = append(result, ws)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// isMountpoint reports whether path appears as a mount target in /proc/mounts
+func isMountpoint(path string) bool {
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == path {
+			return true
+		}
+	}
+	return false
+}
+
+// workspaceOverlaps reports whether the workspace store lies inside base,
+// on the same filesystem: overlayfs refuses (ELOOP) an upper or work
+// directory below its lower layer, so the layers then need a filesystem
+// of their own
+func workspaceOverlaps(base, store string) bool {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(base, store)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	// The store may not exist yet; its nearest existing parent tells
+	for {
+		var bs, ss syscall.Stat_t
+		if err := syscall.Stat(store, &ss); err == nil {
+			return syscall.Stat(base, &bs) == nil && bs.Dev == ss.Dev
+		}
+		if store == filepath.Dir(store) {
+			return false
+		}
+		store = filepath.Dir(store)
+	}
+}
+
+// createWorkspaceLayer makes the sparse ext4 image holding the upper and
+// work directories of a workspace
+func createWorkspaceLayer(ws *Workspace, sizeMB int64) error {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		return fmt.Errorf("mkfs.ext4 not found; install e2fsprogs")
+	}
+	f, err := os.Create(ws.layerImage())
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(sizeMB << 20)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-L", "ws-"+ws.Name, ws.layerImage()).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4 failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// mountWorkspaceLayer mounts the layer image of a workspace, if it has one
+func mountWorkspaceLayer(ws *Workspace) error {
+	if !ws.Layer || isMountpoint(ws.layerDir()) {
+		return nil
+	}
+	if out, err := exec.Command("mount", "-o", "loop", ws.layerImage(), ws.layerDir()).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount %s: %s", ws.layerImage(), strings.TrimSpace(string(out)))
+	}
+	for _, d := range []string{ws.upper(), ws.work()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workspaceInUse reports whether a workspace or its layer image is mounted
+func workspaceInUse(ws *Workspace) bool {
+	return isMountpoint(ws.merged()) || ws.Layer && isMountpoint(ws.layerDir())
+}
+
+// workspaceSize returns the space a workspace's changes take
+func workspaceSize(ws *Workspace) int64 {
+	if ws.Layer {
+		var st syscall.Stat_t
+		if syscall.Stat(ws.layerImage(), &st) != nil {
+			return 0
+		}
+		return st.Blocks * 512
+	}
+	size, _ := dirSize(ws.upper())
+	return size
+}
+
+func mountWorkspace(ws *Workspace) error {
+	if isMountpoint(ws.merged()) {
+		return nil
+	}
+	if err := mountWorkspaceLayer(ws); err != nil {
+		return err
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", ws.Base, ws.upper(), ws.work())
+	if err := syscall.Mount("overlay", ws.merged(), "overlay", 0, opts); err != nil {
+		return fmt.Errorf("failed to mount overlay: %w", err)
+	}
+
+	// Pseudo filesystems needed by most tooling inside the workspace
+	binds := []string{"/proc", "/sys", "/dev", "/run"}
+	for _, src := range binds {
+		target := filepath.Join(ws.merged(), src)
+		os.MkdirAll(target, 0755)
+		if err := syscall.Mount(src, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			printVerbose("Warning: could not bind %s: %v\n", src, err)
+		}
+	}
+	return nil
+}
+
+func unmountWorkspace(ws *Workspace) error {
+	for _, sub := range []string{"/run", "/dev", "/sys", "/proc"} {
+		syscall.Unmount(filepath.Join(ws.merged(), sub), syscall.MNT_DETACH)
+	}
+	for _, dir := range []string{ws.merged(), ws.layerDir()} {
+		if isMountpoint(dir) {
+			if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+				return fmt.Errorf("failed to unmount %s: %w", dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================================
+// Commands
+// ============================================================================
+
+func runWorkspaceCreate(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	base, _ := cmd.Flags().GetString("base")
+	size, _ := cmd.Flags().GetString("size")
+
+	if !validWorkspaceName(name) {
+		return fmt.Errorf("invalid workspace name: %q (use letters, digits, '-', '_' or '.')", name)
+	}
+	if info, err := os.Stat(base); err != nil || !info.IsDir() {
+		return fmt.Errorf("base root %s is not a directory", base)
+	}
+
+	ws := &Workspace{Name: name, Base: base, Created: time.Now(), LastUsed: time.Now()}
+	if _, err := os.Stat(ws.dir()); err == nil {
+		return fmt.Errorf("workspace %s already exists", name)
+	}
+	ws.Layer = workspaceOverlaps(base, workspaceRoot)
+
+	dirs := []string{ws.upper(), ws.work(), ws.merged()}
+	if ws.Layer {
+		sizeMB, err := parseSizeMB(size)
+		if err != nil {
+			return fmt.Errorf("invalid --size: %w", err)
+		}
+		dirs = []string{ws.layerDir(), ws.merged()}
+		defer func() {
+			if _, err := os.Stat(filepath.Join(ws.dir(), workspaceMetaFile)); err != nil {
+				os.RemoveAll(ws.dir())
+			}
+		}()
+		if err := os.MkdirAll(ws.dir(), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", ws.dir(), err)
+		}
+		if err := createWorkspaceLayer(ws, sizeMB); err != nil {
+			return err
+		}
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", d, err)
+		}
+	}
+	if err := saveWorkspace(ws); err != nil {
+		os.RemoveAll(ws.dir())
+		return fmt.Errorf("failed to write workspace metadata: %w", err)
+	}
+
+	fmt.Printf("✓ Workspace %s created\n", name)
+	fmt.Printf("  Base:  %s\n", base)
+	if ws.Layer {
+		fmt.Printf("  Upper: %s (%s image, the base holds %s)\n", ws.layerImage(), size, workspaceRoot)
+	} else {
+		fmt.Printf("  Upper: %s\n", ws.upper())
+	}
+	fmt.Println("")
+	fmt.Printf("Enter it with: mix workspace enter %s\n", name)
+	return nil
+}
+
+func runWorkspaceEnter(cmd *cobra.Command, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("entering a workspace requires root (try: mixmagisk mix workspace enter %s)", args[0])
+	}
+
+	ws, err := loadWorkspace(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := mountWorkspace(ws); err != nil {
+		return err
+	}
+
+	ws.LastUsed = time.Now()
+	saveWorkspace(ws)
+
+	command := args[1:]
+	if len(command) == 0 {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		command = []string{shell}
+		fmt.Printf("🧪 Entering workspace %s (type 'exit' to leave)\n", ws.Name)
+	}
+
+	c := exec.Command(command[0], command[1:]...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Dir = "/"
+	c.Env = append(os.Environ(),
+		"MIX_WORKSPACE="+ws.Name,
+		fmt.Sprintf("PS1=(%s) \\w$ ", ws.Name),
+	)
+	c.SysProcAttr = &syscall.SysProcAttr{Chroot: ws.merged()}
+
+	runErr := c.Run()
+
+	if err := unmountWorkspace(ws); err != nil {
+		printVerbose("Warning: %v\n", err)
+	}
+
+	if runErr != nil {
+		if exitErr, ok := runErr.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		return fmt.Errorf("failed to run in workspace: %w", runErr)
+	}
+	return nil
+}
+
+func runWorkspaceList(cmd *cobra.Command, args []string) error {
+	workspaces, err := listWorkspaces()
+	if err != nil {
+		return fmt.Errorf("failed to list workspaces: %w", err)
+	}
+
+	if len(workspaces) == 0 {
+		fmt.Println("No workspaces. Create one with: mix workspace create <name>")
+		return nil
+	}
+
+	fmt.Printf("Workspaces (%d):\n\n", len(workspaces))
+	for _, ws := range workspaces {
+		state := ""
+		if workspaceInUse(ws) {
+			state = " [mounted]"
+		}
+		fmt.Printf("  %-20s %10s  last used %s%s\n",
+			ws.Name, formatSize(workspaceSize(ws)), ws.LastUsed.Format("2006-01-02 15:04"), state)
+	}
+	return nil
+}
+
+func runWorkspaceExport(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	compression, _ := cmd.Flags().GetString("compression")
+	push, _ := cmd.Flags().GetString("push")
+
+	ws, err := loadWorkspace(args[0])
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = ws.Name + ".vlayer"
+	}
+	var ref *visoRef
+	if push != "" {
+		if ref, err = parseVisoRef(push); err != nil {
+			return err
+		}
+	}
+
+	if _, err := exec.LookPath("mksquashfs"); err != nil {
+		return fmt.Errorf("mksquashfs not found; install squashfs-tools")
+	}
+	if ws.Layer && !isMountpoint(ws.layerDir()) {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("reading the layer image requires root (try: mixmagisk mix workspace export %s)", ws.Name)
+		}
+		if err := mountWorkspaceLayer(ws); err != nil {
+			return err
+		}
+		defer syscall.Unmount(ws.layerDir(), syscall.MNT_DETACH)
+	}
+
+	fmt.Printf("Exporting workspace %s to %s...\n", ws.Name, output)
+	os.Remove(output)
+	if err := runCommand("mksquashfs", ws.upper(), output, "-comp", compression, "-noappend", "-quiet"); err != nil {
+		return fmt.Errorf("mksquashfs failed: %w", err)
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ Layer written: %s (%s)\n", output, formatSize(info.Size()))
+	if ref == nil {
+		return nil
+	}
+
+	fmt.Println("")
+	m, err := pushVisoImage(newVisoRegistry(ref), output)
+	if err != nil {
+		return fmt.Errorf("push failed: %w", err)
+	}
+	fmt.Printf("✓ Layer pushed to %s:%s (sha256 %s)\n", ref.Repo, ref.Tag, m.Annotations[visoSHA256Annotation])
+	return nil
+}
+
+func runWorkspaceDelete(cmd *cobra.Command, args []string) error {
+	ws, err := loadWorkspace(args[0])
+	if err != nil {
+		return err
+	}
+	if workspaceInUse(ws) {
+		return fmt.Errorf("workspace %s is in use", ws.Name)
+	}
+	if err := os.RemoveAll(ws.dir()); err != nil {
+		return fmt.Errorf("failed to remove workspace: %w", err)
+	}
+	fmt.Printf("✓ Workspace %s deleted\n", ws.Name)
+	return nil
+}
+
+func runWorkspaceGC(cmd *cobra.Command, args []string) error {
+	olderThan, _ := cmd.Flags().GetDuration("older-than")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	workspaces, err := listWorkspaces()
+	if err != nil {
+		return fmt.Errorf("failed to list workspaces: %w", err)
+	}
+
+	var freed int64
+	removed := 0
+	for _, ws := range workspaces {
+		if time.Since(ws.LastUsed) < olderThan || workspaceInUse(ws) {
+			continue
+		}
+		size := workspaceSize(ws)
+		if dryRun {
+			fmt.Printf("  would remove %s (%s)\n", ws.Name, formatSize(size))
+			continue
+		}
+		if err := os.RemoveAll(ws.dir()); err != nil {
+			fmt.Printf("  Warning: failed to remove %s: %v\n", ws.Name, err)
+			continue
+		}
+		fmt.Printf("  removed %s (%s)\n", ws.Name, formatSize(size))
+		freed += size
+		removed++
+	}
+
+	if !dryRun {
+		fmt.Printf("\nRemoved %d workspace(s), freed %s\n", removed, formatSize(freed))
+	}
+	return nil
+}
+
+// dirSize returns the total size of regular files below path
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestValidWorkspaceName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"myproj", true},
+		{"my-proj_2.0", true},
+		{"A", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../etc", false},
+		{"a/b", false},
+		{"my proj", false},
+		{"proj;rm", false},
+		{"projé", false},
+	}
+
+	for _, tt := range tests {
+		if got := validWorkspaceName(tt.name); got != tt.valid {
+			t.Errorf("validWorkspaceName(%q) = %v, expected %v", tt.name, got, tt.valid)
+		}
+		if !tt.valid {
+			if _, err := loadWorkspace(tt.name); err == nil || !strings.Contains(err.Error(), "invalid workspace name") {
+				t.Errorf("loadWorkspace(%q) = %v, expected invalid name", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestWorkspaceArgs(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		args  []string
+		valid bool
+	}{
+		{"create", []string{"myproj"}, true},
+		{"create", nil, false},
+		{"create", []string{"a", "b"}, false},
+		{"enter", []string{"myproj"}, true},
+		{"enter", []string{"myproj", "make", "-j4"}, true},
+		{"enter", nil, false},
+		{"export", []string{"myproj"}, true},
+		{"export", nil, false},
+		{"delete", []string{"myproj"}, true},
+		{"delete", []string{"a", "b"}, false},
+	}
+
+	for _, tt := range tests {
+		cmd, _, err := workspaceCmd.Find([]string{tt.cmd})
+		if err != nil || cmd.Name() != tt.cmd {
+			t.Fatalf("workspace %s not found: %v", tt.cmd, err)
+		}
+		if err := cmd.Args(cmd, tt.args); (err == nil) != tt.valid {
+			t.Errorf("workspace %s %q: err = %v, expected valid = %v", tt.cmd, tt.args, err, tt.valid)
+		}
+	}
+
+	// Rejected before anything is created
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+	create := []struct {
+		name, base string
+		err        string
+	}{
+		{"../escape", dir, "invalid workspace name"},
+		{"my proj", dir, "invalid workspace name"},
+		{"myproj", filepath.Join(dir, "missing"), "is not a directory"},
+		{"myproj", file, "is not a directory"},
+	}
+	defer workspaceCreateCmd.Flags().Set("base", "/")
+	for _, tt := range create {
+		workspaceCreateCmd.Flags().Set("base", tt.base)
+		err := runWorkspaceCreate(workspaceCreateCmd, []string{tt.name})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("workspace create %q --base %s = %v, expected %q", tt.name, tt.base, err, tt.err)
+		}
+	}
+}
+
+func TestWorkspaceOverlaps(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "base", "var", "lib"), 0755)
+	os.MkdirAll(filepath.Join(dir, "other"), 0755)
+	base := filepath.Join(dir, "base")
+
+	tests := []struct {
+		base, store string
+		overlaps    bool
+	}{
+		{base, filepath.Join(base, "var", "lib", "workspaces"), true}, // not created yet
+		{base, filepath.Join(base, "var", "lib"), true},
+		{base, base, true},
+		{base, filepath.Join(dir, "other", "workspaces"), false},
+		{base, filepath.Join(dir, "base2", "workspaces"), false}, // a sibling sharing the prefix
+		{filepath.Join(base, "var"), base, false},                // the store holds the base
+	}
+	for _, tt := range tests {
+		if got := workspaceOverlaps(tt.base, tt.store); got != tt.overlaps {
+			t.Errorf("workspaceOverlaps(%s, %s) = %v, expected %v", tt.base, tt.store, got, tt.overlaps)
+		}
+	}
+
+	// A store on a filesystem of its own below the base is fine for overlayfs
+	mnt := filepath.Join(base, "var", "lib", "mnt")
+	os.Mkdir(mnt, 0755)
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Logf("skipping the separate filesystem case: %v", err)
+		return
+	}
+	defer syscall.Unmount(mnt, syscall.MNT_DETACH)
+	if workspaceOverlaps(base, filepath.Join(mnt, "workspaces")) {
+		t.Error("a store on its own filesystem was taken to overlap the base")
+	}
+}
+
+func TestWorkspaceLayerPaths(t *testing.T) {
+	tests := []struct {
+		ws          Workspace
+		upper, work string
+	}{
+		{Workspace{Name: "overlay"}, workspaceRoot + "/overlay/upper", workspaceRoot + "/overlay/work"},
+		{Workspace{Name: "image", Layer: true}, workspaceRoot + "/image/layer/upper", workspaceRoot + "/image/layer/work"},
+	}
+	for _, tt := range tests {
+		if tt.ws.upper() != tt.upper || tt.ws.work() != tt.work {
+			t.Errorf("%s: upper %s, work %s; expected %s, %s", tt.ws.Name, tt.ws.upper(), tt.ws.work(), tt.upper, tt.work)
+		}
+		if tt.ws.merged() != workspaceRoot+"/"+tt.ws.Name+"/merged" {
+			t.Errorf("%s: merged %s", tt.ws.Name, tt.ws.merged())
+		}
+	}
+
+	// Metadata written before layer images existed loads as a plain overlay
+	var ws Workspace
+	if err := json.Unmarshal([]byte(`{"name":"old","base":"/srv/root"}`), &ws); err != nil || ws.Layer {
+		t.Errorf("old metadata: layer = %v, %v", ws.Layer, err)
+	}
+	data, _ := json.Marshal(&Workspace{Name: "image", Layer: true})
+	if err := json.Unmarshal(data, &ws); err != nil || !ws.Layer || ws.layerImage() != workspaceRoot+"/image/layer.img" {
+		t.Errorf("layer workspace round trip: %+v, %v", ws, err)
+	}
+}
@@ -249,6 +249,29 @@ func (m *Manager) Upgrade(pkgName string) error {
 	return m.Install(pkgName)
 }
 
+// Prefetch downloads and verifies a package into the cache without
+// installing it, so a later Install or Upgrade can run offline.
+func (m *Manager) Prefetch(pkgName string) (string, error) {
+	info, err := m.db.GetPackage(pkgName)
+	if err != nil {
+		return "", fmt.Errorf("package %s not found in database", pkgName)
+	}
+
+	pkgPath, err := m.downloadPackage(pkgName, info.Version)
+	if err != nil {
+		return "", fmt.Errorf("failed to download package: %w", err)
+	}
+
+	if info.Checksum != "" {
+		if err := m.verifyChecksum(pkgPath, info.Checksum); err != nil {
+			os.Remove(pkgPath)
+			return "", fmt.Errorf("checksum verification failed: %w", err)
+		}
+	}
+
+	return pkgPath, nil
+}
+
 func (m *Manager) IsInstalled(pkgName string) (bool, error) {
 	return m.db.IsInstalled(pkgName)
 }
@@ -0,0 +1,214 @@
+// Package shadow implements crypt(3) password hashing and /etc/shadow editing.
+package shadow
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	sha512Prefix        = "$6$"
+	sha512RoundsPrefix  = "rounds="
+	sha512DefaultRounds = 5000
+	sha512MinRounds     = 1000
+	sha512MaxRounds     = 999999999
+	sha512MaxSaltLen    = 16
+)
+
+// crypt(3) base64 alphabet
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// HashPassword hashes password with sha512crypt using a random salt.
+func HashPassword(password string) (string, error) {
+	salt, err := randomSalt(sha512MaxSaltLen)
+	if err != nil {
+		return "", err
+	}
+	return SHA512Crypt(password, sha512Prefix+salt)
+}
+
+// SHA512Crypt computes the sha512crypt ($6$) hash of password using the salt
+// (and optional rounds=N parameter) contained in setting.
+func SHA512Crypt(password, setting string) (string, error) {
+	if !strings.HasPrefix(setting, sha512Prefix) {
+		return "", fmt.Errorf("not a sha512crypt setting")
+	}
+	rest := strings.TrimPrefix(setting, sha512Prefix)
+
+	rounds := sha512DefaultRounds
+	customRounds := false
+	if strings.HasPrefix(rest, sha512RoundsPrefix) {
+		end := strings.IndexByte(rest, '$')
+		if end < 0 {
+			return "", fmt.Errorf("malformed rounds parameter")
+		}
+		n, err := strconv.Atoi(rest[len(sha512RoundsPrefix):end])
+		if err != nil {
+			return "", fmt.Errorf("malformed rounds parameter: %w", err)
+		}
+		if n < sha512MinRounds {
+			n = sha512MinRounds
+		}
+		if n > sha512MaxRounds {
+			n = sha512MaxRounds
+		}
+		rounds = n
+		customRounds = true
+		rest = rest[end+1:]
+	}
+
+	salt := rest
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > sha512MaxSaltLen {
+		salt = salt[:sha512MaxSaltLen]
+	}
+
+	key := []byte(password)
+	saltBytes := []byte(salt)
+
+	// Digest B
+	b := sha512.New()
+	b.Write(key)
+	b.Write(saltBytes)
+	b.Write(key)
+	sumB := b.Sum(nil)
+
+	// Digest A
+	a := sha512.New()
+	a.Write(key)
+	a.Write(saltBytes)
+	writeRepeated(a, sumB, len(key))
+	for i := len(key); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(key)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	// Digest DP -> P
+	dp := sha512.New()
+	for i := 0; i < len(key); i++ {
+		dp.Write(key)
+	}
+	p := repeatTo(dp.Sum(nil), len(key))
+
+	// Digest DS -> S
+	ds := sha512.New()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(saltBytes)
+	}
+	s := repeatTo(ds.Sum(nil), len(saltBytes))
+
+	// Rounds
+	c := sumA
+	for i := 0; i < rounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512Prefix)
+	if customRounds {
+		out.WriteString(fmt.Sprintf("%s%d$", sha512RoundsPrefix, rounds))
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+	for _, o := range order {
+		encode24(&out, c[o[0]], c[o[1]], c[o[2]], 4)
+	}
+	encode24(&out, 0, 0, c[63], 2)
+
+	return out.String(), nil
+}
+
+// Verify reports whether password matches the crypt(3) hash.
+func Verify(password, hash string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, sha512Prefix):
+		computed, err := SHA512Crypt(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, yescryptPrefix):
+		computed, err := Yescrypt(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+	case hash == "" || strings.HasPrefix(hash, "!") || strings.HasPrefix(hash, "*"):
+		return false, nil
+	default:
+		return false, fmt.Errorf("unsupported hash format")
+	}
+}
+
+func writeRepeated(h interface{ Write([]byte) (int, error) }, src []byte, n int) {
+	for ; n > len(src); n -= len(src) {
+		h.Write(src)
+	}
+	h.Write(src[:n])
+}
+
+func repeatTo(src []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		rem := n - len(out)
+		if rem > len(src) {
+			rem = len(src)
+		}
+		out = append(out, src[:rem]...)
+	}
+	return out
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+func randomSalt(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	for i := range buf {
+		buf[i] = cryptAlphabet[int(buf[i])%len(cryptAlphabet)]
+	}
+	return string(buf), nil
+}
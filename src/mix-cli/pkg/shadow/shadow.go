@@ -0,0 +1,175 @@
+package shadow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Entry is a single line of /etc/shadow.
+type Entry struct {
+	Name       string
+	Hash       string
+	LastChange int // days since epoch, -1 if empty
+	MinAge     int
+	MaxAge     int
+	Warn       int
+	Inactive   int
+	Expire     int // days since epoch, -1 if empty
+	Reserved   string
+}
+
+// ParseEntry parses one colon-separated shadow line.
+func ParseEntry(line string) (*Entry, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("malformed shadow entry")
+	}
+	for len(fields) < 9 {
+		fields = append(fields, "")
+	}
+
+	e := &Entry{Name: fields[0], Hash: fields[1], Reserved: fields[8]}
+	ints := []*int{&e.LastChange, &e.MinAge, &e.MaxAge, &e.Warn, &e.Inactive, &e.Expire}
+	for i, p := range ints {
+		*p = -1
+		if v := fields[i+2]; v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("malformed field %d for %s: %w", i+3, e.Name, err)
+			}
+			*p = n
+		}
+	}
+	return e, nil
+}
+
+// String renders the entry back into shadow line format.
+func (e *Entry) String() string {
+	num := func(n int) string {
+		if n < 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	return strings.Join([]string{
+		e.Name, e.Hash, num(e.LastChange), num(e.MinAge), num(e.MaxAge),
+		num(e.Warn), num(e.Inactive), num(e.Expire), e.Reserved,
+	}, ":")
+}
+
+// Lookup returns the shadow entry for user from the file at path.
+func Lookup(path, user string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, user+":") {
+			continue
+		}
+		return ParseEntry(line)
+	}
+	return nil, fmt.Errorf("no shadow entry for %s", user)
+}
+
+// DaysSinceEpoch returns t expressed as days since 1970-01-01, the unit used
+// by the date fields in /etc/shadow.
+func DaysSinceEpoch(t time.Time) int {
+	return int(t.Unix() / 86400)
+}
+
+// Expired reports whether the account can no longer log in at now: either
+// the account expiry date has passed, or the password has aged past its
+// maximum and the inactivity grace period has run out as well.
+func (e *Entry) Expired(now time.Time) bool {
+	today := DaysSinceEpoch(now)
+	if e.Expire > 0 && today >= e.Expire {
+		return true
+	}
+	// LastChange 0 means "change at next login", which still authenticates
+	return e.LastChange > 0 && e.MaxAge >= 0 && e.Inactive >= 0 &&
+		today >= e.LastChange+e.MaxAge+e.Inactive
+}
+
+// SetHash replaces (or adds) the password hash for user in the shadow file at
+// path. The file is rewritten atomically and keeps its mode and owner; a new
+// file gets mode 0640.
+func SetHash(path, user, hash string) error {
+	var lines []string
+	mode, uid, gid := os.FileMode(0640), -1, -1
+	if data, err := os.ReadFile(path); err == nil {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	today := DaysSinceEpoch(time.Now())
+	found := false
+	for i, line := range lines {
+		if !strings.HasPrefix(line, user+":") {
+			continue
+		}
+		e, err := ParseEntry(line)
+		if err != nil {
+			return err
+		}
+		e.Hash = hash
+		e.LastChange = today
+		lines[i] = e.String()
+		found = true
+	}
+	if !found {
+		e := &Entry{Name: user, Hash: hash, LastChange: today, MinAge: 0, MaxAge: 99999, Warn: 7, Inactive: -1, Expire: -1}
+		if len(lines) == 1 && lines[0] == "" {
+			lines = nil
+		}
+		lines = append(lines, e.String())
+	}
+
+	return writeFileAtomic(path, []byte(strings.Join(lines, "\n")+"\n"), mode, uid, gid)
+}
+
+// writeFileAtomic replaces path with data through a temporary file; uid and
+// gid of -1 leave the owner to the caller
+func writeFileAtomic(path string, data []byte, mode os.FileMode, uid, gid int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := tmp.Chown(uid, gid); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,181 @@
+package shadow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	tests := []struct {
+		password string
+		setting  string
+		expected string
+	}{
+		{
+			"Hello world!",
+			"$6$saltstring",
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			"Hello world!",
+			"$6$rounds=10000$saltstringsaltstring",
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+	}
+
+	for _, tt := range tests {
+		result, err := SHA512Crypt(tt.password, tt.setting)
+		if err != nil {
+			t.Fatalf("SHA512Crypt(%q) failed: %v", tt.setting, err)
+		}
+		if result != tt.expected {
+			t.Errorf("SHA512Crypt(%q) = %q, expected %q", tt.setting, result, tt.expected)
+		}
+	}
+}
+
+func TestHashAndVerify(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("HashPassword failed: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$6$") {
+		t.Fatalf("Expected sha512crypt hash, got %q", hash)
+	}
+
+	ok, err := Verify("secret", hash)
+	if err != nil || !ok {
+		t.Errorf("Verify with correct password = %v, %v", ok, err)
+	}
+	ok, _ = Verify("wrong", hash)
+	if ok {
+		t.Error("Verify accepted wrong password")
+	}
+	ok, _ = Verify("secret", "!"+hash)
+	if ok {
+		t.Error("Verify accepted locked account")
+	}
+}
+
+func TestSetHash(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "shadow-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "shadow")
+	os.WriteFile(path, []byte("root:*:19000:0:99999:7:::\n"), 0640)
+
+	if err := SetHash(path, "root", "$6$abc$def"); err != nil {
+		t.Fatalf("SetHash failed: %v", err)
+	}
+	if err := SetHash(path, "user", "$6$ghi$jkl"); err != nil {
+		t.Fatalf("SetHash failed: %v", err)
+	}
+
+	root, err := Lookup(path, "root")
+	if err != nil {
+		t.Fatalf("Lookup root failed: %v", err)
+	}
+	if root.Hash != "$6$abc$def" || root.MaxAge != 99999 {
+		t.Errorf("Unexpected root entry: %s", root)
+	}
+
+	user, err := Lookup(path, "user")
+	if err != nil {
+		t.Fatalf("Lookup user failed: %v", err)
+	}
+	if user.Hash != "$6$ghi$jkl" || user.Expire != -1 {
+		t.Errorf("Unexpected user entry: %s", user)
+	}
+}
+
+func TestSetHashKeepsModeAndOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shadow")
+	os.WriteFile(path, []byte("root:*:19000:0:99999:7:::\n"), 0600)
+	gid := os.Getgid()
+	if os.Getuid() == 0 {
+		gid = 42 // shadow
+		if err := os.Chown(path, 0, gid); err != nil {
+			t.Fatalf("chown: %v", err)
+		}
+	}
+
+	if err := SetHash(path, "root", "$6$abc$def"); err != nil {
+		t.Fatalf("SetHash failed: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %o, want 600", info.Mode().Perm())
+	}
+	if st := info.Sys().(*syscall.Stat_t); int(st.Gid) != gid {
+		t.Errorf("gid = %d, want %d", st.Gid, gid)
+	}
+}
+
+func TestYescrypt(t *testing.T) {
+	tests := []struct {
+		password string
+		hash     string
+	}{
+		{"password", "$y$j9T$F5Jx5fExrKuPp53xLKQ..1$tnSYvahCwPBHKZUspmcxMfb0.WiB9W.zEaKlOBL35rC"},
+		{"", "$y$j9T$F5Jx5fExrKuPp53xLKQ..1$5P1uc1zvKhieqEtKttbwCQrTPXpY1cK9wEnTDKAqLD8"},
+		{"secret", "$y$jBT$abcdefghijklmnop$QQH6a597tKyTNGz.VsH5oaFlzfW02tEQztbihS2mKr3"},
+	}
+
+	for _, tt := range tests {
+		result, err := Yescrypt(tt.password, tt.hash)
+		if err != nil {
+			t.Fatalf("Yescrypt(%q) failed: %v", tt.hash, err)
+		}
+		if result != tt.hash {
+			t.Errorf("Yescrypt(%q) = %q", tt.hash, result)
+		}
+	}
+
+	ok, err := Verify("password", tests[0].hash)
+	if err != nil || !ok {
+		t.Errorf("Verify with correct password = %v, %v", ok, err)
+	}
+	ok, _ = Verify("Password", tests[0].hash)
+	if ok {
+		t.Error("Verify accepted wrong password")
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	today := DaysSinceEpoch(now)
+
+	tests := []struct {
+		line    string
+		expired bool
+	}{
+		{"u:h:19000:0:99999:7:::", false},
+		{fmt.Sprintf("u:h:19000:0:99999:7::%d:", today), true},
+		{fmt.Sprintf("u:h:19000:0:99999:7::%d:", today+1), false},
+		{fmt.Sprintf("u:h:%d:0:30:7:10::", today-41), true},
+		{fmt.Sprintf("u:h:%d:0:30:7:10::", today-35), false},
+		{"u:h:0:0:30:7:10::", false},
+	}
+
+	for _, tt := range tests {
+		e, err := ParseEntry(tt.line)
+		if err != nil {
+			t.Fatalf("ParseEntry(%q) failed: %v", tt.line, err)
+		}
+		if got := e.Expired(now); got != tt.expired {
+			t.Errorf("Expired(%q) = %v, expected %v", tt.line, got, tt.expired)
+		}
+	}
+}
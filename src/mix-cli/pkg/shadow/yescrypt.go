@@ -0,0 +1,525 @@
+package shadow
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// yescrypt ($y$), the default hash of current Debian, Fedora and Arch
+// installs. Only the parameter set libxcrypt generates is implemented:
+// the "RW" flavor with default pwxform settings, any N/r/p/t, and no ROM.
+
+const (
+	yescryptPrefix = "$y$"
+
+	yescryptRW       = 0x002
+	yescryptDefaults = 0x0b6 // RW | ROUNDS_6 | GATHER_4 | SIMPLE_2 | SBOX_12K
+	yescryptPrehash  = 0x10000000
+
+	// pwxform parameters implied by yescryptDefaults
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	sWidth    = 8
+
+	pwxBytes = pwxGather * pwxSimple * 8
+	pwxWords = pwxBytes / 4
+	sBytes1  = (1 << sWidth) * pwxSimple * 8 // one S-box
+	sBytes   = 3 * sBytes1
+	sMask    = ((1 << sWidth) - 1) * pwxSimple * 8
+)
+
+// yescryptParams holds the cost parameters decoded from a setting string.
+type yescryptParams struct {
+	flags uint32
+	n     uint64
+	r     uint32
+	p     uint32
+	t     uint32
+}
+
+// Yescrypt computes the yescrypt hash of password using the parameters and
+// salt contained in setting.
+func Yescrypt(password, setting string) (string, error) {
+	if !strings.HasPrefix(setting, yescryptPrefix) {
+		return "", fmt.Errorf("not a yescrypt setting")
+	}
+	params, rest, err := decodeYescryptParams(setting[len(yescryptPrefix):])
+	if err != nil {
+		return "", err
+	}
+
+	saltStr := rest
+	if i := strings.IndexByte(rest, '$'); i >= 0 {
+		saltStr = rest[:i]
+	}
+	salt, err := decode64(saltStr)
+	if err != nil {
+		return "", fmt.Errorf("malformed yescrypt salt: %w", err)
+	}
+
+	hash := yescryptKDF([]byte(password), salt, params, 32)
+
+	prefix := setting[:len(setting)-len(rest)]
+	return prefix + saltStr + "$" + encode64(hash), nil
+}
+
+func decodeYescryptParams(s string) (*yescryptParams, string, error) {
+	var flavor, nLog2, have uint32
+	var err error
+
+	p := &yescryptParams{p: 1}
+	if flavor, s, err = decode64Uint32(s, 0); err != nil {
+		return nil, "", err
+	}
+	if flavor < yescryptRW {
+		return nil, "", fmt.Errorf("unsupported yescrypt flavor")
+	}
+	p.flags = yescryptRW + (flavor-yescryptRW)<<2
+	if p.flags != yescryptDefaults {
+		return nil, "", fmt.Errorf("unsupported yescrypt flavor")
+	}
+
+	if nLog2, s, err = decode64Uint32(s, 1); err != nil {
+		return nil, "", err
+	}
+	if nLog2 > 63 {
+		return nil, "", fmt.Errorf("yescrypt N out of range")
+	}
+	p.n = 1 << nLog2
+
+	if p.r, s, err = decode64Uint32(s, 1); err != nil {
+		return nil, "", err
+	}
+
+	if strings.HasPrefix(s, "$") {
+		return p, s[1:], nil
+	}
+	if have, s, err = decode64Uint32(s, 1); err != nil {
+		return nil, "", err
+	}
+	if have&1 != 0 {
+		if p.p, s, err = decode64Uint32(s, 2); err != nil {
+			return nil, "", err
+		}
+	}
+	if have&2 != 0 {
+		if p.t, s, err = decode64Uint32(s, 1); err != nil {
+			return nil, "", err
+		}
+	}
+	if have&^3 != 0 {
+		return nil, "", fmt.Errorf("unsupported yescrypt parameters")
+	}
+	if !strings.HasPrefix(s, "$") {
+		return nil, "", fmt.Errorf("malformed yescrypt setting")
+	}
+	if uint64(p.r)*uint64(p.p) >= 1<<30 || p.n > 1<<32 || p.n/uint64(p.p) < 2 {
+		return nil, "", fmt.Errorf("yescrypt parameters out of range")
+	}
+	return p, s[1:], nil
+}
+
+// yescryptKDF is yescrypt_kdf() for the RW flavor without ROM.
+func yescryptKDF(passwd, salt []byte, params *yescryptParams, keyLen int) []byte {
+	p := *params
+	if p.p >= 1 && p.n/uint64(p.p) >= 0x100 && p.n/uint64(p.p)*uint64(p.r) >= 0x20000 {
+		pre := p
+		pre.flags |= yescryptPrehash
+		pre.n >>= 6
+		pre.t = 0
+		passwd = yescryptKDFBody(passwd, salt, &pre, 32)
+	}
+	return yescryptKDFBody(passwd, salt, &p, keyLen)
+}
+
+func yescryptKDFBody(passwd, salt []byte, p *yescryptParams, keyLen int) []byte {
+	key := "yescrypt"
+	if p.flags&yescryptPrehash != 0 {
+		key = "yescrypt-prehash"
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(passwd)
+	passwd = mac.Sum(nil)
+
+	r := int(p.r)
+	bBytes, _ := pbkdf2.Key(sha256.New, string(passwd), salt, 1, 128*r*int(p.p))
+	B := make([]uint32, len(bBytes)/4)
+	for i := range B {
+		B[i] = binary.LittleEndian.Uint32(bBytes[i*4:])
+	}
+	copy(passwd, bBytes[:32])
+
+	V := make([]uint32, 32*r*int(p.n))
+	XY := make([]uint32, 64*r)
+	S := make([]uint32, int(p.p)*sBytes/4)
+	smix(B, r, p.n, p.p, p.t, p.flags, V, XY, S, passwd)
+
+	for i, w := range B {
+		binary.LittleEndian.PutUint32(bBytes[i*4:], w)
+	}
+	dk, _ := pbkdf2.Key(sha256.New, string(passwd), bBytes, 1, keyLen)
+
+	if p.flags&yescryptPrehash == 0 {
+		// ClientKey and StoredKey, as in SCRAM
+		mac := hmac.New(sha256.New, dk[:32])
+		mac.Write([]byte("Client Key"))
+		stored := sha256.Sum256(mac.Sum(nil))
+		copy(dk, stored[:])
+	}
+	return dk
+}
+
+// pwxformCtx holds the three rotating S-boxes and the S2 write position.
+type pwxformCtx struct {
+	s0, s1, s2 []uint32
+	w          int
+}
+
+func smix(B []uint32, r int, N uint64, p, t, flags uint32, V, XY, S []uint32, passwd []byte) {
+	s := 32 * r
+
+	nChunk := N / uint64(p)
+	nLoopAll := nChunk
+	if t <= 1 {
+		if t != 0 {
+			nLoopAll *= 2
+		}
+		nLoopAll = (nLoopAll + 2) / 3
+	} else {
+		nLoopAll *= uint64(t - 1)
+	}
+	nLoopRW := nLoopAll / uint64(p)
+
+	nChunk &^= 1
+	nLoopAll = (nLoopAll + 1) &^ 1
+	nLoopRW = (nLoopRW + 1) &^ 1
+
+	ctxs := make([]*pwxformCtx, p)
+	var vChunk uint64
+	for i := uint32(0); i < p; i, vChunk = i+1, vChunk+nChunk {
+		np := nChunk
+		if i == p-1 {
+			np = N - vChunk
+		}
+		Bp := B[s*int(i) : s*int(i+1)]
+		Vp := V[uint64(s)*vChunk:]
+		Si := S[int(i)*sBytes/4 : int(i+1)*sBytes/4]
+
+		smix1(Bp, 1, sBytes/128, 0, Si, XY, nil)
+		box := sBytes1 / 4
+		ctx := &pwxformCtx{s2: Si[:box], s1: Si[box : 2*box], s0: Si[2*box:]}
+		ctxs[i] = ctx
+
+		if i == 0 {
+			last := make([]byte, 64)
+			for k, w := range Bp[s-16:] {
+				binary.LittleEndian.PutUint32(last[k*4:], w)
+			}
+			mac := hmac.New(sha256.New, last)
+			mac.Write(passwd)
+			copy(passwd, mac.Sum(nil))
+		}
+
+		smix1(Bp, r, np, flags, Vp, XY, ctx)
+		smix2(Bp, r, p2floor(np), nLoopRW, flags, Vp, XY, ctx)
+	}
+
+	for i := uint32(0); i < p; i++ {
+		Bp := B[s*int(i) : s*int(i+1)]
+		smix2(Bp, r, N, nLoopAll-nLoopRW, flags&^yescryptRW, V, XY, ctxs[i])
+	}
+}
+
+func smix1(B []uint32, r int, N uint64, flags uint32, V, XY []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	X, Y := XY[:s], XY[s:2*s]
+
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			X[k*16+i] = B[k*16+(i*5%16)]
+		}
+	}
+
+	for i := uint64(0); i < N; i++ {
+		copy(V[i*uint64(s):], X)
+		if flags&yescryptRW != 0 && i > 1 {
+			j := wrap(integerify(X, r), i)
+			blkxor(X, V[j*uint64(s):j*uint64(s)+uint64(s)])
+		}
+		if ctx != nil {
+			blockmixPwxform(X, ctx, r)
+		} else {
+			blockmixSalsa8(X, Y, r)
+		}
+	}
+
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			B[k*16+(i*5%16)] = X[k*16+i]
+		}
+	}
+}
+
+func smix2(B []uint32, r int, N, nLoop uint64, flags uint32, V, XY []uint32, ctx *pwxformCtx) {
+	if nLoop == 0 {
+		return
+	}
+	s := 32 * r
+	X, Y := XY[:s], XY[s:2*s]
+
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			X[k*16+i] = B[k*16+(i*5%16)]
+		}
+	}
+
+	for i := uint64(0); i < nLoop; i++ {
+		j := integerify(X, r) & (N - 1)
+		Vj := V[j*uint64(s) : j*uint64(s)+uint64(s)]
+		blkxor(X, Vj)
+		if flags&yescryptRW != 0 {
+			copy(Vj, X)
+		}
+		if ctx != nil {
+			blockmixPwxform(X, ctx, r)
+		} else {
+			blockmixSalsa8(X, Y, r)
+		}
+	}
+
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			B[k*16+(i*5%16)] = X[k*16+i]
+		}
+	}
+}
+
+func blockmixSalsa8(B, Y []uint32, r int) {
+	var X [16]uint32
+	copy(X[:], B[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		blkxor(X[:], B[i*16:i*16+16])
+		salsa20(X[:], 8)
+		copy(Y[i*16:], X[:])
+	}
+	for i := 0; i < r; i++ {
+		copy(B[i*16:i*16+16], Y[(2*i)*16:])
+		copy(B[(i+r)*16:(i+r)*16+16], Y[(2*i+1)*16:])
+	}
+}
+
+func blockmixPwxform(B []uint32, ctx *pwxformCtx, r int) {
+	var X [pwxWords]uint32
+	r1 := 128 * r / pwxBytes
+
+	copy(X[:], B[(r1-1)*pwxWords:])
+	for i := 0; i < r1; i++ {
+		if r1 > 1 {
+			blkxor(X[:], B[i*pwxWords:(i+1)*pwxWords])
+		}
+		pwxform(X[:], ctx)
+		copy(B[i*pwxWords:], X[:])
+	}
+
+	i := (r1 - 1) * pwxBytes / 64
+	salsa20(B[i*16:i*16+16], 2)
+	for i++; i < 2*r; i++ {
+		blkxor(B[i*16:i*16+16], B[(i-1)*16:i*16])
+		salsa20(B[i*16:i*16+16], 2)
+	}
+}
+
+func pwxform(B []uint32, ctx *pwxformCtx) {
+	s0, s1, s2, w := ctx.s0, ctx.s1, ctx.s2, ctx.w
+
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			xj := B[j*pwxSimple*2:]
+			p0 := int(xj[0]&sMask) / 4
+			p1 := int(xj[1]&sMask) / 4
+
+			for k := 0; k < pwxSimple; k++ {
+				s0v := uint64(s0[p0+2*k+1])<<32 | uint64(s0[p0+2*k])
+				s1v := uint64(s1[p1+2*k+1])<<32 | uint64(s1[p1+2*k])
+
+				x := uint64(xj[2*k+1]) * uint64(xj[2*k])
+				x += s0v
+				x ^= s1v
+
+				xj[2*k] = uint32(x)
+				xj[2*k+1] = uint32(x >> 32)
+
+				if i != 0 && i != pwxRounds-1 {
+					s2[2*w] = uint32(x)
+					s2[2*w+1] = uint32(x >> 32)
+					w++
+				}
+			}
+		}
+	}
+
+	ctx.s0, ctx.s1, ctx.s2 = s2, s0, s1
+	ctx.w = w & ((1<<sWidth)*pwxSimple - 1)
+}
+
+// salsa20 applies the Salsa20 core to B, which is kept in the "SIMD
+// shuffled" word order used throughout yescrypt.
+func salsa20(B []uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = B[i]
+	}
+
+	rl := bits.RotateLeft32
+	for i := 0; i < rounds; i += 2 {
+		x[4] ^= rl(x[0]+x[12], 7)
+		x[8] ^= rl(x[4]+x[0], 9)
+		x[12] ^= rl(x[8]+x[4], 13)
+		x[0] ^= rl(x[12]+x[8], 18)
+		x[9] ^= rl(x[5]+x[1], 7)
+		x[13] ^= rl(x[9]+x[5], 9)
+		x[1] ^= rl(x[13]+x[9], 13)
+		x[5] ^= rl(x[1]+x[13], 18)
+		x[14] ^= rl(x[10]+x[6], 7)
+		x[2] ^= rl(x[14]+x[10], 9)
+		x[6] ^= rl(x[2]+x[14], 13)
+		x[10] ^= rl(x[6]+x[2], 18)
+		x[3] ^= rl(x[15]+x[11], 7)
+		x[7] ^= rl(x[3]+x[15], 9)
+		x[11] ^= rl(x[7]+x[3], 13)
+		x[15] ^= rl(x[11]+x[7], 18)
+
+		x[1] ^= rl(x[0]+x[3], 7)
+		x[2] ^= rl(x[1]+x[0], 9)
+		x[3] ^= rl(x[2]+x[1], 13)
+		x[0] ^= rl(x[3]+x[2], 18)
+		x[6] ^= rl(x[5]+x[4], 7)
+		x[7] ^= rl(x[6]+x[5], 9)
+		x[4] ^= rl(x[7]+x[6], 13)
+		x[5] ^= rl(x[4]+x[7], 18)
+		x[11] ^= rl(x[10]+x[9], 7)
+		x[8] ^= rl(x[11]+x[10], 9)
+		x[9] ^= rl(x[8]+x[11], 13)
+		x[10] ^= rl(x[9]+x[8], 18)
+		x[12] ^= rl(x[15]+x[14], 7)
+		x[13] ^= rl(x[12]+x[15], 9)
+		x[14] ^= rl(x[13]+x[12], 13)
+		x[15] ^= rl(x[14]+x[13], 18)
+	}
+
+	for i := 0; i < 16; i++ {
+		B[i] += x[i*5%16]
+	}
+}
+
+func blkxor(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func integerify(B []uint32, r int) uint64 {
+	X := B[(2*r-1)*16:]
+	return uint64(X[13])<<32 | uint64(X[0])
+}
+
+func p2floor(x uint64) uint64 {
+	for y := x & (x - 1); y != 0; y = x & (x - 1) {
+		x = y
+	}
+	return x
+}
+
+func wrap(x, i uint64) uint64 {
+	n := p2floor(i)
+	return (x & (n - 1)) + (i - n)
+}
+
+// decode64Uint32 decodes yescrypt's variable-length integer encoding.
+func decode64Uint32(s string, min uint32) (uint32, string, error) {
+	if s == "" {
+		return 0, "", fmt.Errorf("malformed yescrypt setting")
+	}
+	c := strings.IndexByte(cryptAlphabet, s[0])
+	if c < 0 {
+		return 0, "", fmt.Errorf("malformed yescrypt setting")
+	}
+	s = s[1:]
+
+	start, end, chars, shift := uint32(0), uint32(47), 1, uint32(0)
+	v := min
+	for uint32(c) > end {
+		v += (end + 1 - start) << shift
+		start = end + 1
+		end = start + (62-end)/2
+		chars++
+		shift += 6
+	}
+	v += (uint32(c) - start) << shift
+
+	for ; chars > 1; chars-- {
+		if s == "" {
+			return 0, "", fmt.Errorf("malformed yescrypt setting")
+		}
+		c := strings.IndexByte(cryptAlphabet, s[0])
+		if c < 0 {
+			return 0, "", fmt.Errorf("malformed yescrypt setting")
+		}
+		s = s[1:]
+		shift -= 6
+		v += uint32(c) << shift
+	}
+	return v, s, nil
+}
+
+// encode64 is yescrypt's little-endian base64 (not the sha-crypt order).
+func encode64(src []byte) string {
+	var out strings.Builder
+	for i := 0; i < len(src); {
+		var value, nbits uint32
+		for nbits < 24 && i < len(src) {
+			value |= uint32(src[i]) << nbits
+			nbits += 8
+			i++
+		}
+		for b := uint32(0); b < nbits; b += 6 {
+			out.WriteByte(cryptAlphabet[value&0x3f])
+			value >>= 6
+		}
+	}
+	return out.String()
+}
+
+// decode64 reverses encode64.
+func decode64(s string) ([]byte, error) {
+	var out []byte
+	for len(s) > 0 {
+		var value, nbits uint32
+		for len(s) > 0 && nbits < 24 {
+			c := strings.IndexByte(cryptAlphabet, s[0])
+			if c < 0 {
+				return nil, fmt.Errorf("invalid character %q", s[0])
+			}
+			s = s[1:]
+			value |= uint32(c) << nbits
+			nbits += 6
+		}
+		if nbits < 12 {
+			return nil, fmt.Errorf("truncated input")
+		}
+		for ; nbits >= 8; nbits -= 8 {
+			out = append(out, byte(value))
+			value >>= 8
+		}
+		if value != 0 {
+			return nil, fmt.Errorf("non-zero trailing bits")
+		}
+	}
+	return out, nil
+}